@@ -4,16 +4,17 @@ set -eux
 sh genversion.sh fuse/version.gen.go
 
 for target in "clean" "install" ; do
-  for d in raw fuse benchmark zipfs unionfs \
+  for d in raw fuse fuse/acl fs cuse benchmark zipfs unionfs squashfs objectfs httpfs gitfs synthfs dedupfs \
     example/hello example/loopback example/zipfs \
     example/bulkstat example/multizip example/unionfs \
-    example/autounionfs ; \
+    example/autounionfs example/fsck example/cryptfs example/squashfs example/httpfs \
+    example/gitfs example/synthfs example/dedupfs ; \
   do
     go ${target} go-fuse/${d}
   done
 done
 
-for d in fuse zipfs unionfs
+for d in fuse fuse/acl fs cuse zipfs unionfs squashfs objectfs httpfs gitfs synthfs dedupfs
 do
   (cd $d && go test go-fuse/$d )
 done
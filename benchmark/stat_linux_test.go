@@ -0,0 +1,68 @@
+package fuse
+
+import (
+	"fmt"
+	"github.com/hanwen/go-fuse/fuse"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+func BenchmarkCFuseThreadedStat(b *testing.B) {
+	b.StopTimer()
+
+	lines := GetTestLines()
+	unique := map[string]int{}
+	for _, l := range lines {
+		unique[l] = 1
+		dir, _ := filepath.Split(l)
+		for dir != "/" && dir != "" {
+			unique[dir] = 1
+			dir = filepath.Clean(dir)
+			dir, _ = filepath.Split(dir)
+		}
+	}
+
+	out := []string{}
+	for k := range unique {
+		out = append(out, k)
+	}
+
+	f, err := ioutil.TempFile("", "")
+	CheckSuccess(err)
+	sort.Strings(out)
+	for _, k := range out {
+		f.Write([]byte(fmt.Sprintf("/%s\n", k)))
+	}
+	f.Close()
+
+	mountPoint, _ := ioutil.TempDir("", "stat_test")
+	wd, _ := os.Getwd()
+	cmd := exec.Command(wd+"/cstatfs",
+		"-o",
+		"entry_timeout=0.0,attr_timeout=0.0,ac_attr_timeout=0.0,negative_timeout=0.0",
+		mountPoint)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("STATFS_INPUT=%s", f.Name()),
+		fmt.Sprintf("STATFS_DELAY_USEC=%d", delay / time.Microsecond))
+	cmd.Start()
+
+	stop := exec.Command(fuse.FusermountBinary(), "-u", mountPoint)
+	defer stop.Run()
+
+	for i, l := range lines {
+		lines[i] = filepath.Join(mountPoint, l)
+	}
+
+	// Wait for the daemon to mount.
+	time.Sleep(200 * time.Millisecond)
+	ttl := time.Millisecond * 100
+	threads := runtime.GOMAXPROCS(0)
+	results := TestingBOnePass(b, threads, time.Duration((ttl*12)/10), lines)
+	AnalyzeBenchmarkRuns("CFuse", results)
+}
@@ -7,11 +7,10 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,7 +23,6 @@ type StatFs struct {
 	fuse.DefaultFileSystem
 	entries map[string]*fuse.Attr
 	dirs    map[string][]fuse.DirEntry
-	delay   time.Duration
 }
 
 func (me *StatFs) add(name string, a *fuse.Attr) {
@@ -50,10 +48,6 @@ func (me *StatFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.
 	if e == nil {
 		return nil, fuse.ENOENT
 	}
-
-	if me.delay > 0 {
-		time.Sleep(me.delay)
-	}
 	return e, fuse.OK
 }
 
@@ -159,7 +153,6 @@ func GetTestLines() []string {
 func BenchmarkGoFuseThreadedStat(b *testing.B) {
 	b.StopTimer()
 	fs := NewStatFs()
-	fs.delay = delay
 	files := GetTestLines()
 	for _, fn := range files {
 		fs.add(fn, &fuse.Attr{Mode: fuse.S_IFREG | 0644})
@@ -176,7 +169,9 @@ func BenchmarkGoFuseThreadedStat(b *testing.B) {
 		AttrTimeout:     0.0,
 		NegativeTimeout: 0.0,
 	}
-	wd, clean := setupFs(fs, &opts)
+	wd, clean := setupFs(fuse.NewDelayFileSystem(fs, &fuse.DelayOptions{
+		Ops: map[string]fuse.Latency{"GetAttr": fuse.FixedLatency(delay)},
+	}), &opts)
 	defer clean()
 
 	for i, l := range files {
@@ -188,6 +183,55 @@ func BenchmarkGoFuseThreadedStat(b *testing.B) {
 	AnalyzeBenchmarkRuns("Go-FUSE", results)
 }
 
+// BenchmarkPathNodeFsStat measures GetAttr through PathNodeFs for
+// the test files, without the kernel round trip, so the cost of
+// resolving paths shows.
+func BenchmarkPathNodeFsStat(b *testing.B) {
+	b.StopTimer()
+	nodes := pathNodeFsNodes()
+	b.StartTimer()
+	a := fuse.Attr{}
+	for i := 0; i < b.N; i++ {
+		nodes[i%len(nodes)].GetAttr(&a, nil, nil)
+	}
+}
+
+// BenchmarkPathNodeFsThreadedStat is BenchmarkPathNodeFsStat from
+// GOMAXPROCS goroutines, which shows contention on the locks of
+// PathNodeFs.
+func BenchmarkPathNodeFsThreadedStat(b *testing.B) {
+	b.StopTimer()
+	nodes := pathNodeFsNodes()
+	var start uint32
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		a := fuse.Attr{}
+		i := int(atomic.AddUint32(&start, 1)) * len(nodes) / runtime.GOMAXPROCS(0)
+		for pb.Next() {
+			nodes[i%len(nodes)].GetAttr(&a, nil, nil)
+			i++
+		}
+	})
+}
+
+// pathNodeFsNodes returns the nodes for the test files in a
+// PathNodeFs, without mounting it.
+func pathNodeFsNodes() []fuse.FsNode {
+	fs := NewStatFs()
+	files := GetTestLines()
+	for _, fn := range files {
+		fs.add(fn, &fuse.Attr{Mode: fuse.S_IFREG | 0644})
+	}
+
+	nfs := fuse.NewPathNodeFs(fs, nil)
+	fuse.NewFileSystemConnector(nfs, nil)
+	nodes := make([]fuse.FsNode, len(files))
+	for i, fn := range files {
+		nodes[i] = nfs.LookupNode(fn).FsNode()
+	}
+	return nodes
+}
+
 func TestingBOnePass(b *testing.B, threads int, sleepTime time.Duration, files []string) (results []float64) {
 	runtime.GC()
 	todo := b.N
@@ -203,60 +247,3 @@ func TestingBOnePass(b *testing.B, threads int, sleepTime time.Duration, files [
 	}
 	return results
 }
-
-func BenchmarkCFuseThreadedStat(b *testing.B) {
-	b.StopTimer()
-
-	lines := GetTestLines()
-	unique := map[string]int{}
-	for _, l := range lines {
-		unique[l] = 1
-		dir, _ := filepath.Split(l)
-		for dir != "/" && dir != "" {
-			unique[dir] = 1
-			dir = filepath.Clean(dir)
-			dir, _ = filepath.Split(dir)
-		}
-	}
-
-	out := []string{}
-	for k := range unique {
-		out = append(out, k)
-	}
-
-	f, err := ioutil.TempFile("", "")
-	CheckSuccess(err)
-	sort.Strings(out)
-	for _, k := range out {
-		f.Write([]byte(fmt.Sprintf("/%s\n", k)))
-	}
-	f.Close()
-
-	mountPoint, _ := ioutil.TempDir("", "stat_test")
-	wd, _ := os.Getwd()
-	cmd := exec.Command(wd+"/cstatfs",
-		"-o",
-		"entry_timeout=0.0,attr_timeout=0.0,ac_attr_timeout=0.0,negative_timeout=0.0",
-		mountPoint)
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("STATFS_INPUT=%s", f.Name()),
-		fmt.Sprintf("STATFS_DELAY_USEC=%d", delay / time.Microsecond))
-	cmd.Start()
-
-	bin, err := exec.LookPath("fusermount")
-	CheckSuccess(err)
-	stop := exec.Command(bin, "-u", mountPoint)
-	CheckSuccess(err)
-	defer stop.Run()
-
-	for i, l := range lines {
-		lines[i] = filepath.Join(mountPoint, l)
-	}
-
-	// Wait for the daemon to mount.
-	time.Sleep(200 * time.Millisecond)
-	ttl := time.Millisecond * 100
-	threads := runtime.GOMAXPROCS(0)
-	results := TestingBOnePass(b, threads, time.Duration((ttl*12)/10), lines)
-	AnalyzeBenchmarkRuns("CFuse", results)
-}
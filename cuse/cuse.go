@@ -0,0 +1,96 @@
+// Package cuse implements character devices in userspace, using the
+// request loop of fuse.MountState.
+package cuse
+
+import (
+	"log"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+var _ = log.Println
+
+// Device is a character device. Each open of the device node yields a
+// separate fuse.File; only its Read, Write, Flush, Fsync and Release
+// methods are used.
+type Device interface {
+	Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status)
+}
+
+// NewDeviceState creates a MountState that serves dev as
+// /dev/opts.DevName.  Call Loop() on the result to serve requests,
+// and Unmount() to remove the device.
+func NewDeviceState(dev Device, opts *fuse.CuseOptions, mountOpts *fuse.MountOptions) (*fuse.MountState, error) {
+	state := fuse.NewMountState(newRawDevice(dev))
+	if err := state.MountCuse(opts, mountOpts); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+type openedFile struct {
+	fuse.Handled
+	fuse.File
+}
+
+// rawDevice translates the file operations of the FUSE protocol
+// into calls on the Device.
+type rawDevice struct {
+	fuse.DefaultRawFileSystem
+
+	dev   Device
+	files fuse.HandleMap
+}
+
+func newRawDevice(dev Device) *rawDevice {
+	return &rawDevice{
+		dev:   dev,
+		files: fuse.NewHandleMap(false),
+	}
+}
+
+func (d *rawDevice) file(fh uint64) fuse.File {
+	return (*openedFile)(unsafe.Pointer(d.files.Decode(fh))).File
+}
+
+func (d *rawDevice) Open(out *raw.OpenOut, header *raw.InHeader, input *raw.OpenIn) (status fuse.Status) {
+	f, code := d.dev.Open(input.Flags, &fuse.Context{Context: header.Context})
+	if !code.Ok() {
+		return code
+	}
+	for {
+		withFlags, ok := f.(*fuse.WithFlags)
+		if !ok {
+			break
+		}
+		out.OpenFlags |= withFlags.FuseFlags
+		f = withFlags.File
+	}
+
+	opened := &openedFile{File: f}
+	out.Fh = d.files.Register(&opened.Handled, opened)
+	return fuse.OK
+}
+
+func (d *rawDevice) Read(header *raw.InHeader, input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	return d.file(input.Fh).Read(input, bp)
+}
+
+func (d *rawDevice) Write(header *raw.InHeader, input *fuse.WriteIn, data []byte) (written uint32, code fuse.Status) {
+	return d.file(input.Fh).Write(input, data)
+}
+
+func (d *rawDevice) Flush(header *raw.InHeader, input *raw.FlushIn) fuse.Status {
+	return d.file(input.Fh).Flush((*fuse.FlushIn)(input))
+}
+
+func (d *rawDevice) Fsync(header *raw.InHeader, input *raw.FsyncIn) (code fuse.Status) {
+	return d.file(input.Fh).Fsync(int(input.FsyncFlags))
+}
+
+func (d *rawDevice) Release(header *raw.InHeader, input *raw.ReleaseIn) {
+	opened := (*openedFile)(unsafe.Pointer(d.files.Forget(input.Fh)))
+	opened.File.Release((*fuse.ReleaseIn)(input))
+}
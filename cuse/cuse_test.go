@@ -0,0 +1,47 @@
+package cuse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type helloDevice struct{}
+
+func (d *helloDevice) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	return fuse.NewDataFile([]byte("hello")), fuse.OK
+}
+
+func TestDevice(t *testing.T) {
+	if _, err := os.Stat("/dev/cuse"); err != nil {
+		t.Log("No /dev/cuse; skipping test.")
+		return
+	}
+	state, err := NewDeviceState(&helloDevice{}, &fuse.CuseOptions{
+		DevName: "gofusetest",
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewDeviceState: %v", err)
+	}
+	defer state.Unmount()
+	go state.Loop()
+
+	// The device node is created by udev asynchronously.
+	name := "/dev/gofusetest"
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(name); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+}
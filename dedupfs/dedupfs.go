@@ -0,0 +1,617 @@
+// Package dedupfs is a file system that stores the contents of files
+// as chunks named by their SHA-256 hash, so data that appears in
+// several files, or several times in one, is stored once.
+//
+// The backing directory holds the chunks, in chunks/, and the tree
+// with the attributes and chunk lists of all files, in meta.json.
+// Files are cut in chunks of a fixed size, so identical files, and
+// files that share aligned blocks, share storage.
+//
+// Files are changed in a scratch copy while they are open, and cut
+// in chunks when they are flushed, ie. on each close(2) and
+// fsync(2).  Only the chunks that were written to are hashed again.
+//
+// Files have inode numbers, and can be hard-linked; mount with
+// PathNodeFsOptions.ClientInodes so the kernel sees the links.
+package dedupfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+var _ = (fuse.FileSystem)((*DedupFs)(nil))
+
+type DedupFsOptions struct {
+	// ChunkSize is the size of the chunks that files are cut in,
+	// for a new backing directory; an existing one keeps its
+	// chunk size.  The default is 64 KiB.
+	ChunkSize int
+}
+
+const _ROOT_INO = 1
+
+// node is a file, directory or symlink.  Times are in nanoseconds.
+type node struct {
+	Mode  uint32
+	Uid   uint32
+	Gid   uint32
+	Nlink uint32
+	Size  uint64
+	Atime int64
+	Mtime int64
+	Ctime int64
+
+	Chunks  []string          `json:",omitempty"`
+	Target  string            `json:",omitempty"`
+	Entries map[string]uint64 `json:",omitempty"`
+}
+
+func (n *node) isDir() bool {
+	return n.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// meta is what is stored in meta.json.
+type meta struct {
+	ChunkSize int
+	NextIno   uint64
+	Nodes     map[uint64]*node
+}
+
+// DedupFs is a FileSystem that deduplicates file contents.
+type DedupFs struct {
+	fuse.DefaultFileSystem
+
+	dir   string
+	store chunkStore
+
+	// Protects meta, refs and files.
+	lock sync.Mutex
+	meta meta
+	// The number of references to each chunk.  Chunks without
+	// references are removed.
+	refs map[string]int
+	// Open files by inode number, shared by their handles.
+	files map[uint64]*openFile
+}
+
+// NewDedupFs opens the backing directory dir, which is set up if it
+// is empty.
+func NewDedupFs(dir string, opts *DedupFsOptions) (*DedupFs, error) {
+	fs := &DedupFs{
+		dir: dir,
+		store: chunkStore{
+			dir: filepath.Join(dir, "chunks"),
+			tmp: filepath.Join(dir, "tmp"),
+		},
+		refs:  map[string]int{},
+		files: map[uint64]*openFile{},
+	}
+	// Scratch files of an earlier run are garbage.
+	os.RemoveAll(fs.store.tmp)
+	for _, d := range []string{fs.store.dir, fs.store.tmp} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(fs.metaPath())
+	if os.IsNotExist(err) {
+		chunkSize := 64 << 10
+		if opts != nil && opts.ChunkSize > 0 {
+			chunkSize = opts.ChunkSize
+		}
+		now := time.Now().UnixNano()
+		fs.meta = meta{
+			ChunkSize: chunkSize,
+			NextIno:   _ROOT_INO + 1,
+			Nodes: map[uint64]*node{
+				_ROOT_INO: {
+					Mode:    fuse.S_IFDIR | 0755,
+					Nlink:   2,
+					Uid:     uint32(os.Getuid()),
+					Gid:     uint32(os.Getgid()),
+					Atime:   now,
+					Mtime:   now,
+					Ctime:   now,
+					Entries: map[string]uint64{},
+				},
+			},
+		}
+		if code := fs.save(); !code.Ok() {
+			return nil, fmt.Errorf("dedupfs: writing %s: %v", fs.metaPath(), code)
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &fs.meta); err != nil {
+		return nil, fmt.Errorf("dedupfs: %s: %v", fs.metaPath(), err)
+	}
+	if fs.meta.ChunkSize <= 0 || fs.meta.Nodes[_ROOT_INO] == nil {
+		return nil, fmt.Errorf("dedupfs: %s is corrupt", fs.metaPath())
+	}
+
+	for ino, n := range fs.meta.Nodes {
+		// Files that were unlinked while open.
+		if n.Nlink == 0 {
+			delete(fs.meta.Nodes, ino)
+			continue
+		}
+		if n.isDir() && n.Entries == nil {
+			n.Entries = map[string]uint64{}
+		}
+		for _, h := range n.Chunks {
+			fs.refs[h]++
+		}
+	}
+	fs.store.sweep(fs.refs)
+	return fs, nil
+}
+
+func (fs *DedupFs) String() string {
+	return fmt.Sprintf("DedupFs(%s)", fs.dir)
+}
+
+func (fs *DedupFs) metaPath() string {
+	return filepath.Join(fs.dir, "meta.json")
+}
+
+// save writes meta.json.  The caller must hold the lock.
+func (fs *DedupFs) save() fuse.Status {
+	data, err := json.Marshal(&fs.meta)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	tmp := fs.metaPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("DedupFs: %v", err)
+		return fuse.ToStatus(err)
+	}
+	if err := os.Rename(tmp, fs.metaPath()); err != nil {
+		log.Printf("DedupFs: %v", err)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
+}
+
+// ref and unref count references to chunks.  The caller must hold
+// the lock.
+func (fs *DedupFs) ref(hashes []string) {
+	for _, h := range hashes {
+		fs.refs[h]++
+	}
+}
+
+func (fs *DedupFs) unref(hashes []string) {
+	for _, h := range hashes {
+		fs.refs[h]--
+		if fs.refs[h] <= 0 {
+			delete(fs.refs, h)
+			fs.store.remove(h)
+		}
+	}
+}
+
+// lookup returns the node at name.  The caller must hold the lock.
+func (fs *DedupFs) lookup(name string) (uint64, *node, fuse.Status) {
+	ino := uint64(_ROOT_INO)
+	n := fs.meta.Nodes[ino]
+	if name == "" {
+		return ino, n, fuse.OK
+	}
+	for _, c := range strings.Split(name, "/") {
+		if !n.isDir() {
+			return 0, nil, fuse.ENOTDIR
+		}
+		var ok bool
+		if ino, ok = n.Entries[c]; !ok {
+			return 0, nil, fuse.ENOENT
+		}
+		n = fs.meta.Nodes[ino]
+	}
+	return ino, n, fuse.OK
+}
+
+// parent returns the directory that holds name, and the base name.
+// The caller must hold the lock.
+func (fs *DedupFs) parent(name string) (*node, string, fuse.Status) {
+	if name == "" {
+		return nil, "", fuse.EINVAL
+	}
+	dir, base := filepath.Split(name)
+	_, d, code := fs.lookup(strings.TrimSuffix(dir, "/"))
+	if !code.Ok() {
+		return nil, "", code
+	}
+	if !d.isDir() {
+		return nil, "", fuse.ENOTDIR
+	}
+	return d, base, fuse.OK
+}
+
+// add makes a new node named name.  The caller must hold the lock.
+func (fs *DedupFs) add(name string, n *node, context *fuse.Context) (uint64, fuse.Status) {
+	d, base, code := fs.parent(name)
+	if !code.Ok() {
+		return 0, code
+	}
+	if _, ok := d.Entries[base]; ok {
+		return 0, fuse.Status(syscall.EEXIST)
+	}
+	now := time.Now().UnixNano()
+	n.Atime, n.Mtime, n.Ctime = now, now, now
+	n.Uid, n.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+	if context != nil {
+		n.Uid, n.Gid = context.Uid, context.Gid
+	}
+	ino := fs.meta.NextIno
+	fs.meta.NextIno++
+	fs.meta.Nodes[ino] = n
+	d.Entries[base] = ino
+	d.Mtime, d.Ctime = now, now
+	if n.isDir() {
+		d.Nlink++
+	}
+	return ino, fs.save()
+}
+
+// remove takes name out of its directory, and drops its node when it
+// has no links and is not open.  The caller must hold the lock.
+func (fs *DedupFs) remove(d *node, base string) {
+	ino := d.Entries[base]
+	n := fs.meta.Nodes[ino]
+	delete(d.Entries, base)
+	now := time.Now().UnixNano()
+	d.Mtime, d.Ctime = now, now
+	n.Ctime = now
+	if n.isDir() {
+		d.Nlink--
+		n.Nlink = 0
+	} else {
+		n.Nlink--
+	}
+	if n.Nlink == 0 && fs.files[ino] == nil {
+		fs.drop(ino)
+	}
+}
+
+func (fs *DedupFs) drop(ino uint64) {
+	fs.unref(fs.meta.Nodes[ino].Chunks)
+	delete(fs.meta.Nodes, ino)
+}
+
+// inoAttr returns the attributes of ino, with the changes of the
+// file if it is open.
+func (fs *DedupFs) inoAttr(ino uint64) *fuse.Attr {
+	fs.lock.Lock()
+	n := fs.meta.Nodes[ino]
+	a := &fuse.Attr{
+		Ino:   ino,
+		Mode:  n.Mode,
+		Size:  n.Size,
+		Nlink: n.Nlink,
+		Owner: raw.Owner{Uid: n.Uid, Gid: n.Gid},
+	}
+	a.SetNs(n.Atime, n.Mtime, n.Ctime)
+	f := fs.files[ino]
+	fs.lock.Unlock()
+
+	if f != nil {
+		f.attr(a)
+	}
+	a.Blocks = (a.Size + 511) / 512
+	return a
+}
+
+func (fs *DedupFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fs.lock.Lock()
+	ino, _, code := fs.lookup(name)
+	fs.lock.Unlock()
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.inoAttr(ino), fuse.OK
+}
+
+// change applies fn to the node at name, and saves.
+func (fs *DedupFs) change(name string, fn func(n *node)) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	_, n, code := fs.lookup(name)
+	if !code.Ok() {
+		return code
+	}
+	fn(n)
+	n.Ctime = time.Now().UnixNano()
+	return fs.save()
+}
+
+func (fs *DedupFs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.change(name, func(n *node) {
+		n.Mode = n.Mode&syscall.S_IFMT | mode&07777
+	})
+}
+
+func (fs *DedupFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return fs.change(name, func(n *node) {
+		if uid != ^uint32(0) {
+			n.Uid = uid
+		}
+		if gid != ^uint32(0) {
+			n.Gid = gid
+		}
+	})
+}
+
+func (fs *DedupFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	atime, mtime = fuse.ResolveUtime(atime), fuse.ResolveUtime(mtime)
+	return fs.change(name, func(n *node) {
+		if atime != nil {
+			n.Atime = atime.UnixNano()
+		}
+		if mtime != nil {
+			n.Mtime = mtime.UnixNano()
+		}
+	})
+}
+
+func (fs *DedupFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	f, code := fs.Open(name, uint32(os.O_WRONLY), context)
+	if !code.Ok() {
+		return code
+	}
+	defer f.Release(&fuse.ReleaseIn{})
+	if code := f.Truncate(size, context); !code.Ok() {
+		return code
+	}
+	return f.Flush(&fuse.FlushIn{})
+}
+
+func (fs *DedupFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	_, code := fs.add(name, &node{
+		Mode:    fuse.S_IFDIR | mode&07777,
+		Nlink:   2,
+		Entries: map[string]uint64{},
+	}, context)
+	return code
+}
+
+func (fs *DedupFs) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	_, code := fs.add(linkName, &node{
+		Mode:   fuse.S_IFLNK | 0777,
+		Nlink:  1,
+		Size:   uint64(len(value)),
+		Target: value,
+	}, context)
+	return code
+}
+
+func (fs *DedupFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	_, n, code := fs.lookup(name)
+	if !code.Ok() {
+		return "", code
+	}
+	if n.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return "", fuse.EINVAL
+	}
+	return n.Target, fuse.OK
+}
+
+func (fs *DedupFs) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	ino, n, code := fs.lookup(oldName)
+	if !code.Ok() {
+		return code
+	}
+	if n.isDir() {
+		return fuse.EPERM
+	}
+	d, base, code := fs.parent(newName)
+	if !code.Ok() {
+		return code
+	}
+	if _, ok := d.Entries[base]; ok {
+		return fuse.Status(syscall.EEXIST)
+	}
+	d.Entries[base] = ino
+	n.Nlink++
+	now := time.Now().UnixNano()
+	n.Ctime, d.Mtime, d.Ctime = now, now, now
+	return fs.save()
+}
+
+func (fs *DedupFs) Unlink(name string, context *fuse.Context) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	d, base, code := fs.parent(name)
+	if !code.Ok() {
+		return code
+	}
+	ino, ok := d.Entries[base]
+	if !ok {
+		return fuse.ENOENT
+	}
+	if fs.meta.Nodes[ino].isDir() {
+		return fuse.Status(syscall.EISDIR)
+	}
+	fs.remove(d, base)
+	return fs.save()
+}
+
+func (fs *DedupFs) Rmdir(name string, context *fuse.Context) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	d, base, code := fs.parent(name)
+	if !code.Ok() {
+		return code
+	}
+	ino, ok := d.Entries[base]
+	if !ok {
+		return fuse.ENOENT
+	}
+	n := fs.meta.Nodes[ino]
+	if !n.isDir() {
+		return fuse.ENOTDIR
+	}
+	if len(n.Entries) > 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	fs.remove(d, base)
+	return fs.save()
+}
+
+func (fs *DedupFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if oldName == newName {
+		return fuse.OK
+	}
+	if strings.HasPrefix(newName, oldName+"/") {
+		return fuse.EINVAL
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	od, obase, code := fs.parent(oldName)
+	if !code.Ok() {
+		return code
+	}
+	ino, ok := od.Entries[obase]
+	if !ok {
+		return fuse.ENOENT
+	}
+	n := fs.meta.Nodes[ino]
+	nd, nbase, code := fs.parent(newName)
+	if !code.Ok() {
+		return code
+	}
+	if target, ok := nd.Entries[nbase]; ok {
+		if target == ino {
+			return fuse.OK
+		}
+		t := fs.meta.Nodes[target]
+		switch {
+		case n.isDir() && !t.isDir():
+			return fuse.ENOTDIR
+		case !n.isDir() && t.isDir():
+			return fuse.Status(syscall.EISDIR)
+		case t.isDir() && len(t.Entries) > 0:
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
+		fs.remove(nd, nbase)
+	}
+
+	delete(od.Entries, obase)
+	nd.Entries[nbase] = ino
+	if n.isDir() {
+		od.Nlink--
+		nd.Nlink++
+	}
+	now := time.Now().UnixNano()
+	n.Ctime, od.Mtime, od.Ctime, nd.Mtime, nd.Ctime = now, now, now, now, now
+	return fs.save()
+}
+
+func (fs *DedupFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	_, n, code := fs.lookup(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if !n.isDir() {
+		return nil, fuse.ENOTDIR
+	}
+	stream := make([]fuse.DirEntry, 0, len(n.Entries))
+	for name, ino := range n.Entries {
+		stream = append(stream, fuse.DirEntry{Name: name, Mode: fs.meta.Nodes[ino].Mode})
+	}
+	return stream, fuse.OK
+}
+
+func (fs *DedupFs) Open(name string, flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	fs.lock.Lock()
+	ino, n, code := fs.lookup(name)
+	if code.Ok() && n.isDir() {
+		code = fuse.Status(syscall.EISDIR)
+	}
+	if !code.Ok() {
+		fs.lock.Unlock()
+		return nil, code
+	}
+	f := fs.openLocked(ino)
+	fs.lock.Unlock()
+
+	file := &dedupFile{data: f}
+	if flags&syscall.O_TRUNC != 0 && flags&fuse.O_ANYWRITE != 0 {
+		if code := file.Truncate(0, context); !code.Ok() {
+			file.Release(&fuse.ReleaseIn{})
+			return nil, code
+		}
+	}
+	return file, fuse.OK
+}
+
+func (fs *DedupFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	fs.lock.Lock()
+	ino, code := fs.add(name, &node{
+		Mode:  fuse.S_IFREG | mode&07777,
+		Nlink: 1,
+	}, context)
+	if !code.Ok() {
+		fs.lock.Unlock()
+		return nil, code
+	}
+	f := fs.openLocked(ino)
+	fs.lock.Unlock()
+	return &dedupFile{data: f}, fuse.OK
+}
+
+func (fs *DedupFs) StatFs(name string) *fuse.StatfsOut {
+	return fuse.NewLoopbackFileSystem(fs.dir).StatFs("")
+}
+
+// DedupStats describes how well data is shared.
+type DedupStats struct {
+	// The number of files, and the bytes in them, counting hard
+	// links once.
+	Files        int
+	LogicalBytes int64
+
+	// The number of chunks, and the bytes in them.
+	Chunks      int
+	StoredBytes int64
+}
+
+// Stats returns the sizes of the stored files and of their chunks.
+// Changes to open files count once they are flushed.
+func (fs *DedupFs) Stats() DedupStats {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var s DedupStats
+	for _, n := range fs.meta.Nodes {
+		if n.Mode&syscall.S_IFMT == syscall.S_IFREG {
+			s.Files++
+			s.LogicalBytes += int64(n.Size)
+		}
+	}
+	for h := range fs.refs {
+		s.Chunks++
+		s.StoredBytes += fs.store.size(h)
+	}
+	return s
+}
@@ -0,0 +1,162 @@
+package dedupfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestDedupFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewDedupFs(dir, &DedupFsOptions{ChunkSize: 1024})
+	if err != nil {
+		t.Fatalf("NewDedupFs: %v", err)
+	}
+
+	create := func(name string, data []byte) {
+		f, code := fs.Create(name, uint32(os.O_WRONLY|os.O_CREATE), 0644, nil)
+		if !code.Ok() {
+			t.Fatalf("Create(%q): %v", name, code)
+		}
+		if n, code := f.Write(&fuse.WriteIn{}, data); !code.Ok() || int(n) != len(data) {
+			t.Fatalf("Write: %d %v", n, code)
+		}
+		if code := f.Flush(&fuse.FlushIn{}); !code.Ok() {
+			t.Fatalf("Flush: %v", code)
+		}
+		f.Release(&fuse.ReleaseIn{})
+	}
+	read := func(fs *DedupFs, name string) []byte {
+		f, code := fs.Open(name, uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			t.Fatalf("Open(%q): %v", name, code)
+		}
+		defer f.Release(&fuse.ReleaseIn{})
+		data, code := f.Read(&fuse.ReadIn{Size: 1 << 20}, fuse.NewGcBufferPool())
+		if !code.Ok() {
+			t.Fatalf("Read(%q): %v", name, code)
+		}
+		return data
+	}
+
+	// 4 chunks, of which 2 are the same.
+	a := append(bytes.Repeat([]byte("a"), 2048), bytes.Repeat([]byte("b"), 2000)...)
+	create("a", a)
+	fs.Mkdir("dir", 0755, nil)
+	create("dir/copy", a)
+	if s := fs.Stats(); s.Files != 2 || s.LogicalBytes != 2*int64(len(a)) || s.Chunks != 3 {
+		t.Errorf("stats: %+v", s)
+	}
+	if got := read(fs, "dir/copy"); !bytes.Equal(got, a) {
+		t.Errorf("copy: got %d bytes", len(got))
+	}
+
+	// A change to one chunk of an open file shows at once, and is
+	// stored when flushed.
+	f, _ := fs.Open("a", uint32(os.O_RDWR), nil)
+	f.Write(&fuse.WriteIn{Offset: 3000}, []byte("xyz"))
+	copy(a[3000:], "xyz")
+	if attr, _ := fs.GetAttr("a", nil); attr.Size != uint64(len(a)) {
+		t.Errorf("size: got %d", attr.Size)
+	}
+	if got := read(fs, "a"); !bytes.Equal(got, a) {
+		t.Errorf("read while open: differs")
+	}
+	f.Flush(&fuse.FlushIn{})
+	if s := fs.Stats(); s.Chunks != 4 {
+		t.Errorf("stats after write: %+v", s)
+	}
+	f.Release(&fuse.ReleaseIn{})
+
+	// Hard links share the inode and its data.
+	if code := fs.Link("a", "link", nil); !code.Ok() {
+		t.Fatalf("Link: %v", code)
+	}
+	la, _ := fs.GetAttr("link", nil)
+	aa, _ := fs.GetAttr("a", nil)
+	if la.Ino != aa.Ino || la.Nlink != 2 {
+		t.Errorf("link: %v, a: %v", la, aa)
+	}
+	if code := fs.Unlink("a", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if code := fs.Truncate("link", 100, nil); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	a = a[:100]
+
+	if code := fs.Rename("dir/copy", "moved", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	fs.Symlink("moved", "sym", nil)
+	if code := fs.Rmdir("dir", nil); !code.Ok() {
+		t.Fatalf("Rmdir: %v", code)
+	}
+	fs.Mkdir("empty", 0700, nil)
+
+	// All of it is there after reopening, and unused chunks are gone.
+	fs2, err := NewDedupFs(dir, nil)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := read(fs2, "link"); !bytes.Equal(got, a) {
+		t.Errorf("link after reopen: %q", got)
+	}
+	if got := read(fs2, "moved"); len(got) != 4048 || got[3000] != 'b' {
+		t.Errorf("moved after reopen: got %d bytes", len(got))
+	}
+	if target, _ := fs2.Readlink("sym", nil); target != "moved" {
+		t.Errorf("symlink: %q", target)
+	}
+	if _, code := fs2.GetAttr("dir", nil); code != fuse.ENOENT {
+		t.Errorf("removed dir: %v", code)
+	}
+	if code := fs2.Mkdir("empty/sub", 0700, nil); !code.Ok() {
+		t.Errorf("Mkdir in reloaded empty dir: %v", code)
+	}
+	// "moved" has 3 chunks, "link" 1.
+	if s := fs2.Stats(); s.Files != 2 || s.Chunks != 4 {
+		t.Errorf("stats after reopen: %+v", s)
+	}
+	chunkDirs, _ := ioutil.ReadDir(fs2.store.dir)
+	n := 0
+	for _, d := range chunkDirs {
+		names, _ := ioutil.ReadDir(fs2.store.dir + "/" + d.Name())
+		n += len(names)
+	}
+	if n != 4 {
+		t.Errorf("got %d chunk files", n)
+	}
+}
+
+// An unlinked file stays readable while it is open.
+func TestDedupFsUnlinkOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewDedupFs(dir, nil)
+	if err != nil {
+		t.Fatalf("NewDedupFs: %v", err)
+	}
+	f, _ := fs.Create("f", uint32(os.O_RDWR|os.O_CREATE), 0644, nil)
+	f.Write(&fuse.WriteIn{}, []byte("hello"))
+	f.Flush(&fuse.FlushIn{})
+	fs.Unlink("f", nil)
+	data, code := f.Read(&fuse.ReadIn{Size: 100}, fuse.NewGcBufferPool())
+	if !code.Ok() || string(data) != "hello" {
+		t.Errorf("read after unlink: %q %v", data, code)
+	}
+	f.Release(&fuse.ReleaseIn{})
+	if s := fs.Stats(); s.Files != 0 || s.Chunks != 0 {
+		t.Errorf("stats: %+v", s)
+	}
+}
@@ -0,0 +1,319 @@
+package dedupfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// openFile is the state of an open file, shared by all its handles,
+// also those opened through other links.
+type openFile struct {
+	fs  *DedupFs
+	ino uint64
+	// The number of handles, protected by fs.lock.
+	refs int
+
+	lock sync.Mutex
+	// scratch holds the contents once the file is changed, until
+	// the last handle is released.
+	scratch *os.File
+	size    uint64
+	// The chunks of scratch at the last flush, and the indices of
+	// the chunks written since.
+	chunks []string
+	dirty  map[int]bool
+	// changed is set if there are changes that are not flushed.
+	changed bool
+	mtime   int64
+}
+
+// openLocked returns the open state of ino, for a new handle.  The
+// caller must hold the lock.
+func (fs *DedupFs) openLocked(ino uint64) *openFile {
+	f := fs.files[ino]
+	if f == nil {
+		f = &openFile{fs: fs, ino: ino}
+		fs.files[ino] = f
+	}
+	f.refs++
+	return f
+}
+
+// attr puts unflushed changes in a.
+func (f *openFile) attr(a *fuse.Attr) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.changed {
+		a.Size = f.size
+		a.SetNs(a.Atimens(), f.mtime, f.mtime)
+	}
+}
+
+// committed returns the chunks and the size of the file at the last
+// flush.
+func (f *openFile) committed() ([]string, uint64) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	n := f.fs.meta.Nodes[f.ino]
+	return n.Chunks, n.Size
+}
+
+// materialize copies the contents to a scratch file.  The caller must
+// hold the lock.
+func (f *openFile) materialize() fuse.Status {
+	if f.scratch != nil {
+		return fuse.OK
+	}
+	chunks, size := f.committed()
+	scratch, err := ioutil.TempFile(f.fs.store.tmp, "file")
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	os.Remove(scratch.Name())
+	cs := int64(f.fs.meta.ChunkSize)
+	for i, h := range chunks {
+		data, err := f.fs.store.read(h)
+		if err == nil {
+			_, err = scratch.WriteAt(data, int64(i)*cs)
+		}
+		if err != nil {
+			log.Printf("DedupFs: chunk %s of inode %d: %v", h, f.ino, err)
+			scratch.Close()
+			return fuse.EIO
+		}
+	}
+	if err := scratch.Truncate(int64(size)); err != nil {
+		scratch.Close()
+		return fuse.ToStatus(err)
+	}
+	f.scratch = scratch
+	f.size = size
+	f.chunks = chunks
+	f.dirty = map[int]bool{}
+	return fuse.OK
+}
+
+// touch marks the chunks from start to end as changed.  The caller
+// must hold the lock.
+func (f *openFile) touch(start, end uint64) {
+	cs := uint64(f.fs.meta.ChunkSize)
+	for i := start / cs; i*cs < end; i++ {
+		f.dirty[int(i)] = true
+	}
+	f.changed = true
+	f.mtime = time.Now().UnixNano()
+}
+
+// flush cuts the changed chunks, and records the new chunk list.  The
+// caller must hold the lock.
+func (f *openFile) flush() fuse.Status {
+	if !f.changed {
+		return fuse.OK
+	}
+	fs := f.fs
+	cs := uint64(fs.meta.ChunkSize)
+	count := int((f.size + cs - 1) / cs)
+	chunks := make([]string, count)
+	copy(chunks, f.chunks)
+
+	// New chunks are referenced while they are written, so they
+	// cannot be removed meanwhile.
+	var pinned []string
+	unpin := func() {
+		fs.lock.Lock()
+		fs.unref(pinned)
+		fs.lock.Unlock()
+	}
+	buf := make([]byte, cs)
+	for i := 0; i < count; i++ {
+		if !f.dirty[i] && i < len(f.chunks) {
+			continue
+		}
+		end := uint64(i+1) * cs
+		if end > f.size {
+			end = f.size
+		}
+		data := buf[:end-uint64(i)*cs]
+		if _, err := f.scratch.ReadAt(data, int64(i)*int64(cs)); err != nil && err != io.EOF {
+			unpin()
+			return fuse.ToStatus(err)
+		}
+		h := hashChunk(data)
+		fs.lock.Lock()
+		fs.refs[h]++
+		fs.lock.Unlock()
+		pinned = append(pinned, h)
+		if !fs.store.has(h) {
+			if err := fs.store.write(h, data); err != nil {
+				log.Printf("DedupFs: writing chunk: %v", err)
+				unpin()
+				return fuse.ToStatus(err)
+			}
+		}
+		chunks[i] = h
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n := fs.meta.Nodes[f.ino]
+	fs.ref(chunks)
+	fs.unref(n.Chunks)
+	fs.unref(pinned)
+	n.Chunks = chunks
+	n.Size = f.size
+	n.Mtime = f.mtime
+	n.Ctime = f.mtime
+	f.chunks = chunks
+	f.dirty = map[int]bool{}
+	f.changed = false
+	return fs.save()
+}
+
+// release drops a handle.
+func (f *openFile) release() {
+	f.lock.Lock()
+	if code := f.flush(); !code.Ok() {
+		log.Printf("DedupFs: flushing inode %d: %v", f.ino, code)
+	}
+	f.lock.Unlock()
+
+	fs := f.fs
+	fs.lock.Lock()
+	f.refs--
+	last := f.refs == 0
+	if last {
+		delete(fs.files, f.ino)
+		if fs.meta.Nodes[f.ino].Nlink == 0 {
+			fs.drop(f.ino)
+			fs.save()
+		}
+	}
+	fs.lock.Unlock()
+
+	if last && f.scratch != nil {
+		f.scratch.Close()
+		f.scratch = nil
+	}
+}
+
+// dedupFile is a handle of an open file.
+type dedupFile struct {
+	fuse.DefaultFile
+	data *openFile
+}
+
+func (f *dedupFile) String() string {
+	return fmt.Sprintf("dedupFile(%d)", f.data.ino)
+}
+
+func (f *dedupFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.scratch != nil {
+		end := input.Offset + uint64(input.Size)
+		if end > d.size {
+			end = d.size
+		}
+		if input.Offset >= end {
+			return nil, fuse.OK
+		}
+		out := bp.AllocBuffer(uint32(end - input.Offset))
+		n, err := d.scratch.ReadAt(out, int64(input.Offset))
+		if err != nil && err != io.EOF {
+			bp.FreeBuffer(out)
+			return nil, fuse.ToStatus(err)
+		}
+		return out[:n], fuse.OK
+	}
+
+	chunks, size := d.committed()
+	end := input.Offset + uint64(input.Size)
+	if end > size {
+		end = size
+	}
+	if input.Offset >= end {
+		return nil, fuse.OK
+	}
+	cs := uint64(d.fs.meta.ChunkSize)
+	out := bp.AllocBuffer(uint32(end - input.Offset))
+	for off := input.Offset; off < end; {
+		i := off / cs
+		data, err := d.fs.store.read(chunks[i])
+		if err != nil {
+			log.Printf("DedupFs: chunk %s of inode %d: %v", chunks[i], d.ino, err)
+			bp.FreeBuffer(out)
+			return nil, fuse.EIO
+		}
+		if uint64(len(data)) <= off-i*cs {
+			log.Printf("DedupFs: chunk %s of inode %d is short", chunks[i], d.ino)
+			bp.FreeBuffer(out)
+			return nil, fuse.EIO
+		}
+		off += uint64(copy(out[off-input.Offset:], data[off-i*cs:]))
+	}
+	return out, fuse.OK
+}
+
+func (f *dedupFile) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if code := d.materialize(); !code.Ok() {
+		return 0, code
+	}
+	n, err := d.scratch.WriteAt(data, int64(input.Offset))
+	end := input.Offset + uint64(n)
+	if end > d.size {
+		d.size = end
+	}
+	d.touch(input.Offset, end)
+	return uint32(n), fuse.ToStatus(err)
+}
+
+func (f *dedupFile) Truncate(size uint64, context *fuse.Context) fuse.Status {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if code := d.materialize(); !code.Ok() {
+		return code
+	}
+	if err := d.scratch.Truncate(int64(size)); err != nil {
+		return fuse.ToStatus(err)
+	}
+	// The chunk that is cut, and those that are added, change.
+	if size < d.size {
+		d.touch(size, size+1)
+	} else {
+		d.touch(d.size, size)
+	}
+	d.size = size
+	return fuse.OK
+}
+
+func (f *dedupFile) GetAttr(out *fuse.Attr) fuse.Status {
+	*out = *f.data.fs.inoAttr(f.data.ino)
+	return fuse.OK
+}
+
+func (f *dedupFile) Flush(input *fuse.FlushIn) fuse.Status {
+	f.data.lock.Lock()
+	defer f.data.lock.Unlock()
+	return f.data.flush()
+}
+
+func (f *dedupFile) Fsync(flags int) fuse.Status {
+	return f.Flush(nil)
+}
+
+func (f *dedupFile) Release(input *fuse.ReleaseIn) {
+	f.data.release()
+}
@@ -0,0 +1,91 @@
+package dedupfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// chunkStore keeps chunks as files named by the SHA-256 of their
+// contents, in directories named by the first two hex digits.
+type chunkStore struct {
+	dir string
+	tmp string
+}
+
+func hashChunk(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *chunkStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *chunkStore) has(hash string) bool {
+	_, err := os.Lstat(s.path(hash))
+	return err == nil
+}
+
+// write stores data under hash.  The chunk appears atomically, so a
+// crash never leaves a partial chunk.
+func (s *chunkStore) write(hash string, data []byte) error {
+	p := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.tmp, "chunk")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *chunkStore) read(hash string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(hash))
+}
+
+func (s *chunkStore) remove(hash string) {
+	if err := os.Remove(s.path(hash)); err != nil && !os.IsNotExist(err) {
+		log.Printf("DedupFs: removing chunk %s: %v", hash, err)
+	}
+}
+
+// size returns the stored size of a chunk.
+func (s *chunkStore) size(hash string) int64 {
+	fi, err := os.Lstat(s.path(hash))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// sweep removes the chunks that are not in refs, eg. those written
+// before a crash, but not recorded.
+func (s *chunkStore) sweep(refs map[string]int) {
+	dirs, _ := ioutil.ReadDir(s.dir)
+	for _, d := range dirs {
+		names, _ := ioutil.ReadDir(filepath.Join(s.dir, d.Name()))
+		for _, n := range names {
+			if refs[n.Name()] == 0 {
+				os.Remove(filepath.Join(s.dir, d.Name(), n.Name()))
+			}
+		}
+	}
+}
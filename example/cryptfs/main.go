@@ -0,0 +1,50 @@
+// Mounts a directory of encrypted files, showing them decrypted.
+// The key file holds 32 bytes of key as hex digits.
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	names := flag.Bool("names", false, "encrypt file names too.")
+	flag.Parse()
+	if flag.NArg() < 3 {
+		fmt.Println("usage: cryptfs MOUNTPOINT CIPHERDIR KEYFILE")
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(flag.Arg(2))
+	if err != nil {
+		fmt.Printf("ReadFile fail: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		fmt.Printf("bad key: %v\n", err)
+		os.Exit(1)
+	}
+
+	cryptFs, err := fuse.NewCryptFileSystem(fuse.NewLoopbackFileSystem(flag.Arg(1)), key,
+		&fuse.CryptFsOptions{EncryptNames: *names})
+	if err != nil {
+		fmt.Printf("NewCryptFileSystem fail: %v\n", err)
+		os.Exit(1)
+	}
+	state, _, err := fuse.MountNodeFileSystem(flag.Arg(0), fuse.NewPathNodeFs(cryptFs, nil), nil)
+	if err != nil {
+		fmt.Printf("Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	state.Debug = *debug
+	state.Loop()
+}
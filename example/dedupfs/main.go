@@ -0,0 +1,37 @@
+// Mounts a file system that stores identical data once, in a
+// backing directory.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hanwen/go-fuse/dedupfs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	chunkSize := flag.Int("chunk_size", 64<<10, "chunk size for a new backing directory.")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Println("usage: dedupfs MOUNTPOINT BACKING-DIR")
+		os.Exit(2)
+	}
+
+	fs, err := dedupfs.NewDedupFs(flag.Arg(1), &dedupfs.DedupFsOptions{ChunkSize: *chunkSize})
+	if err != nil {
+		fmt.Printf("NewDedupFs fail: %v\n", err)
+		os.Exit(1)
+	}
+	nodeFs := fuse.NewPathNodeFs(fs, &fuse.PathNodeFsOptions{ClientInodes: true})
+	state, _, err := fuse.MountNodeFileSystem(flag.Arg(0), nodeFs, nil)
+	if err != nil {
+		fmt.Printf("Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	state.Debug = *debug
+	state.Loop()
+}
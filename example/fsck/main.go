@@ -0,0 +1,61 @@
+// Mounts another directory as loopback, and audits the mount with
+// FileSystemConnector.Check on SIGUSR1, or periodically with
+// -interval.  Reports are written to stdout as JSON, one per line.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	repair := flag.Bool("repair", false, "invalidate nodes that no longer resolve.")
+	interval := flag.Duration("interval", 0, "also check at this interval.")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Println("usage: fsck [-repair] [-interval DURATION] MOUNTPOINT ORIGINAL")
+		os.Exit(2)
+	}
+
+	pathFs := fuse.NewPathNodeFs(fuse.NewLoopbackFileSystem(flag.Arg(1)), nil)
+	conn := fuse.NewFileSystemConnector(pathFs, nil)
+	state := fuse.NewMountState(conn)
+	state.Debug = *debug
+	if err := state.Mount(flag.Arg(0), nil); err != nil {
+		fmt.Printf("Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	go state.Loop()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	var tick <-chan time.Time
+	if *interval > 0 {
+		tick = time.Tick(*interval)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case <-sigs:
+		case <-tick:
+		}
+		report := conn.Check(*repair)
+		if err := enc.Encode(report); err != nil {
+			log.Fatal("Encode: ", err)
+		}
+		if !report.Ok() {
+			log.Printf("found %d problems", len(report.Problems))
+		}
+	}
+}
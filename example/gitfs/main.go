@@ -0,0 +1,35 @@
+// Mounts a git repository read-only.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/gitfs"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Println("usage: gitfs MOUNTPOINT GIT-DIR")
+		os.Exit(2)
+	}
+
+	repo, err := gitfs.OpenRepo(flag.Arg(1))
+	if err != nil {
+		fmt.Printf("OpenRepo fail: %v\n", err)
+		os.Exit(1)
+	}
+	defer repo.Close()
+	state, _, err := fuse.MountNodeFileSystem(flag.Arg(0), gitfs.NewGitFs(repo), nil)
+	if err != nil {
+		fmt.Printf("Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	state.Debug = *debug
+	state.Loop()
+}
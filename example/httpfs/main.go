@@ -0,0 +1,54 @@
+// Mounts files published over HTTP read-only.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/httpfs"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	manifest := flag.String("manifest", "", "JSON manifest of the files; if unset, directory index pages are read.")
+	cache := flag.String("cache", "", "directory to cache blocks in; if unset, they are kept in memory.")
+	cacheSize := flag.Int64("cache_size", 256<<20, "bytes of blocks to cache.")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Println("usage: httpfs MOUNTPOINT URL")
+		os.Exit(2)
+	}
+
+	var entries []httpfs.ManifestEntry
+	if *manifest != "" {
+		f, err := os.Open(*manifest)
+		if err != nil {
+			fmt.Printf("Open fail: %v\n", err)
+			os.Exit(1)
+		}
+		entries, err = httpfs.ReadManifest(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("ReadManifest fail: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fs, err := httpfs.NewHttpFs(flag.Arg(1), entries, &httpfs.HttpFsOptions{
+		CacheDir:  *cache,
+		CacheSize: *cacheSize,
+	})
+	if err != nil {
+		fmt.Printf("NewHttpFs fail: %v\n", err)
+		os.Exit(1)
+	}
+	state, _, err := fuse.MountNodeFileSystem(flag.Arg(0), fs, nil)
+	if err != nil {
+		fmt.Printf("Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	state.Debug = *debug
+	state.Loop()
+}
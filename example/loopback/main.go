@@ -53,5 +53,6 @@ func main() {
 	}
 
 	fmt.Println("Mounted!")
+	state.UnmountOnSignal(nil)
 	state.Loop()
 }
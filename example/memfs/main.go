@@ -1,4 +1,4 @@
-// Mounts MemNodeFs for testing purposes.
+// Mounts MemNodeFs, an in-memory file system like tmpfs.
 
 package main
 
@@ -18,15 +18,14 @@ func main() {
 	// Scans the arg list and sets up flags
 	debug := flag.Bool("debug", false, "print debugging messages.")
 	flag.Parse()
-	if flag.NArg() < 2 {
+	if flag.NArg() < 1 {
 		// TODO - where to get program name?
-		fmt.Println("usage: main MOUNTPOINT BACKING-PREFIX")
+		fmt.Println("usage: main MOUNTPOINT")
 		os.Exit(2)
 	}
 
 	mountPoint := flag.Arg(0)
-	prefix := flag.Arg(1)
-	fs := fuse.NewMemNodeFs(prefix)
+	fs := fuse.NewMemNodeFs()
 	conn := fuse.NewFileSystemConnector(fs, nil)
 	state := fuse.NewMountState(conn)
 	state.Debug = *debug
@@ -0,0 +1,39 @@
+// Mounts a squashfs image read-only.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/squashfs"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Println("usage: squashfs MOUNTPOINT IMAGE")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(1))
+	if err != nil {
+		fmt.Printf("Open fail: %v\n", err)
+		os.Exit(1)
+	}
+	fs, err := squashfs.NewSquashFs(f)
+	if err != nil {
+		fmt.Printf("NewSquashFs fail: %v\n", err)
+		os.Exit(1)
+	}
+	state, _, err := fuse.MountNodeFileSystem(flag.Arg(0), fs, nil)
+	if err != nil {
+		fmt.Printf("Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	state.Debug = *debug
+	state.Loop()
+}
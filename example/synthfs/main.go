@@ -0,0 +1,58 @@
+// Shows the Go runtime state of this process as files, with a file to
+// start a garbage collection and one to set GOMAXPROCS.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/synthfs"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("usage: synthfs MOUNTPOINT")
+		os.Exit(2)
+	}
+
+	fs := synthfs.NewSynthFs(nil)
+	fs.AddFile("goroutines", synthfs.Text(func() string {
+		return strconv.Itoa(runtime.NumGoroutine())
+	}))
+	fs.AddFile("memstats", synthfs.Text(func() string {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return fmt.Sprintf("alloc %d\nsys %d\nnum_gc %d", m.Alloc, m.Sys, m.NumGC)
+	}))
+	fs.AddControl("control/gc", nil, func([]byte) error {
+		runtime.GC()
+		return nil
+	})
+	fs.AddControl("control/gomaxprocs", synthfs.Text(func() string {
+		return strconv.Itoa(runtime.GOMAXPROCS(0))
+	}), func(data []byte) error {
+		n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || n < 1 {
+			return syscall.EINVAL
+		}
+		runtime.GOMAXPROCS(n)
+		return nil
+	})
+
+	state, _, err := fuse.MountNodeFileSystem(flag.Arg(0), fs, nil)
+	if err != nil {
+		fmt.Printf("Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	state.Debug = *debug
+	state.Loop()
+}
@@ -21,6 +21,7 @@ func main() {
 	branchcache_ttl := flag.Float64("branchcache_ttl", 5.0, "Branch cache TTL in seconds.")
 	deldirname := flag.String(
 		"deletion_dirname", "GOUNIONFS_DELETIONS", "Directory name to use for deletions.")
+	branchesFile := flag.Bool("branches_file", false, "change branches by writing to .branches")
 
 	flag.Parse()
 	if len(flag.Args()) < 2 {
@@ -32,6 +33,7 @@ func main() {
 		DeletionCacheTTL: time.Duration(*delcache_ttl * float64(time.Second)),
 		BranchCacheTTL:   time.Duration(*branchcache_ttl * float64(time.Second)),
 		DeletionDirName:  *deldirname,
+		BranchesFile:     *branchesFile,
 	}
 
 	ufs, err := unionfs.NewUnionFsFromRoots(flag.Args()[1:], &ufsOptions, true)
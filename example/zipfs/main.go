@@ -25,9 +25,10 @@ func main() {
 	mem_profile := flag.String("mem-profile", "", "record memory profile.")
 	command := flag.String("run", "", "run this command after mounting.")
 	ttl := flag.Float64("ttl", 1.0, "attribute/entry cache TTL.")
+	writable := flag.Bool("writable", false, "allow changes, written to the zip file on unmount.")
 	flag.Parse()
 	if flag.NArg() < 2 {
-		fmt.Fprintf(os.Stderr, "usage: %s MOUNTPOINT ZIP-FILE\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "usage: %s MOUNTPOINT ZIP-FILE|ARCHIVE-DIR\n", os.Args[0])
 		os.Exit(2)
 	}
 
@@ -47,7 +48,15 @@ func main() {
 	}
 	
 	var fs fuse.NodeFileSystem
-	fs, err = zipfs.NewArchiveFileSystem(flag.Arg(1))
+	if fi, statErr := os.Stat(flag.Arg(1)); statErr == nil && fi.IsDir() {
+		fs = fuse.NewPathNodeFs(zipfs.NewArchiveDirFs(flag.Arg(1), nil), nil)
+	} else if *writable {
+		var zfs *zipfs.WritableZipFs
+		zfs, err = zipfs.NewWritableZipFs(flag.Arg(1))
+		fs = fuse.NewPathNodeFs(zfs, nil)
+	} else {
+		fs, err = zipfs.NewArchiveFileSystem(flag.Arg(1))
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "NewArchiveFileSystem failed: %v\n", err)
 		os.Exit(1)
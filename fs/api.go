@@ -0,0 +1,265 @@
+// The fs package mirrors the node API of the upstream go-fuse v2 fs
+// package on top of the FileSystemConnector of this tree, so file
+// systems can be shared between the two by changing the import
+// paths.
+//
+// A file system is a tree of structs that embed Inode.  Each node
+// implements the small interfaces (NodeGetattrer, NodeLookuper,
+// NodeReaddirer, ...) for the operations it supports; the others
+// return ENOSYS.  Open files are represented by FileHandle values,
+// which may implement FileReader, FileWriter, etc.
+//
+// Only a subset of v2 is provided.  Notable differences:
+//
+// - Mount returns the *fuse.MountState, already serving requests,
+// rather than a *fuse.Server.
+//
+// - Entry and attribute timeouts are taken from Options for the
+// whole mount, unless a node sets a non-zero timeout in AttrOut or
+// EntryOut.  A zero timeout cannot be asked for per node.
+//
+// - There are no lseek, locking or copy_file_range operations.
+//
+// - The context passed to operations carries the *fuse.Context of
+// the request, see FromContext.  Operations on open files are passed
+// context.Background().
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// OK is the Errno return value to indicate absence of errors.
+var OK = syscall.Errno(0)
+
+// ToErrno exhumes the syscall.Errno error from wrapped error values.
+func ToErrno(err error) syscall.Errno {
+	return syscall.Errno(fuse.ToStatus(err))
+}
+
+// InodeEmbedder is implemented by structs that embed Inode.  The
+// EmbeddedInode method is provided by Inode itself.
+type InodeEmbedder interface {
+	EmbeddedInode() *Inode
+}
+
+// Statfs implements statistics for the filesystem that holds this
+// Inode.
+type NodeStatfser interface {
+	Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno
+}
+
+// Access should return if the caller can access the file with the
+// given mode.
+type NodeAccesser interface {
+	Access(ctx context.Context, mask uint32) syscall.Errno
+}
+
+// Getattr reads attributes for an Inode.  The file handle f is set
+// if the kernel asks for the attributes of an open file.
+type NodeGetattrer interface {
+	Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno
+}
+
+// Setattr sets attributes for an Inode.
+type NodeSetattrer interface {
+	Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
+}
+
+// OnAdd is called when the node is added to the tree.  Only the root
+// node is notified, which makes it the place to set up persistent
+// children with NewPersistentInode and AddChild.
+type NodeOnAdder interface {
+	OnAdd(ctx context.Context)
+}
+
+// OnForget is called when the node is dropped from the tree.
+type NodeOnForgetter interface {
+	OnForget()
+}
+
+// Getxattr reads an extended attribute into dest, and returns its
+// size.  If dest is too small, it should return ERANGE and the size
+// of the attribute.
+type NodeGetxattrer interface {
+	Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno)
+}
+
+// Setxattr sets an extended attribute.
+type NodeSetxattrer interface {
+	Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno
+}
+
+// Removexattr removes an extended attribute.
+type NodeRemovexattrer interface {
+	Removexattr(ctx context.Context, attr string) syscall.Errno
+}
+
+// Listxattr copies the NUL-terminated names of the extended
+// attributes into dest, and returns their total size.  If dest is
+// too small, it should return ERANGE and the required size.
+type NodeListxattrer interface {
+	Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno)
+}
+
+// Readlink reads the content of a symlink.
+type NodeReadlinker interface {
+	Readlink(ctx context.Context) ([]byte, syscall.Errno)
+}
+
+// Open opens an Inode (of regular file type) for reading.  The
+// returned file handle is passed to the other file operations; it
+// may be nil if the node implements them itself.
+type NodeOpener interface {
+	Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
+// Reads data from a file.  If not implemented, the read is passed on
+// to the file handle.
+type NodeReader interface {
+	Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
+}
+
+// Writes data to a file.  If not implemented, the write is passed on
+// to the file handle.
+type NodeWriter interface {
+	Write(ctx context.Context, f FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno)
+}
+
+// Fsync is a signal to ensure writes to the Inode are flushed to
+// stable storage.
+type NodeFsyncer interface {
+	Fsync(ctx context.Context, f FileHandle, flags uint32) syscall.Errno
+}
+
+// Flush is called for the close(2) call on a file descriptor.
+type NodeFlusher interface {
+	Flush(ctx context.Context, f FileHandle) syscall.Errno
+}
+
+// Release is called when the last descriptor of an open file is
+// closed.
+type NodeReleaser interface {
+	Release(ctx context.Context, f FileHandle) syscall.Errno
+}
+
+// Lookup should find a direct child of a directory by the child's
+// name.  The child is created with NewInode, and its attributes
+// should be filled into out.
+type NodeLookuper interface {
+	Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno)
+}
+
+// Opendir is called before Readdir, and may deny listing the
+// directory.
+type NodeOpendirer interface {
+	Opendir(ctx context.Context) syscall.Errno
+}
+
+// Readdir opens a stream of directory entries.  If not implemented,
+// the children in the tree are listed.
+type NodeReaddirer interface {
+	Readdir(ctx context.Context) (DirStream, syscall.Errno)
+}
+
+// Mkdir is similar to Lookup, but must create a directory entry and
+// Inode.
+type NodeMkdirer interface {
+	Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno)
+}
+
+// Mknod is similar to Lookup, but must create a device entry and
+// Inode.
+type NodeMknoder interface {
+	Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno)
+}
+
+// Link is similar to Lookup, but must create a new link to an
+// existing Inode.
+type NodeLinker interface {
+	Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (node *Inode, errno syscall.Errno)
+}
+
+// Symlink is similar to Lookup, but must create a new symbolic link.
+type NodeSymlinker interface {
+	Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (node *Inode, errno syscall.Errno)
+}
+
+// Create is similar to Lookup, but should create a new child. It
+// typically also returns a FileHandle as a reference for future
+// reads/writes.
+type NodeCreater interface {
+	Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
+// Unlink should remove a child from this directory.  If the return
+// status is OK, the child is removed from the tree.
+type NodeUnlinker interface {
+	Unlink(ctx context.Context, name string) syscall.Errno
+}
+
+// Rmdir is like Unlink but for directories.
+type NodeRmdirer interface {
+	Rmdir(ctx context.Context, name string) syscall.Errno
+}
+
+// Rename should move a child from one directory to a different one.
+// The flags are always 0, as the protocol spoken here has no
+// RENAME2.
+type NodeRenamer interface {
+	Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno
+}
+
+// FileHandle is a resource identifier for opened files.  It may
+// implement any of the File* interfaces below.
+type FileHandle interface{}
+
+// FileReleaser is called when the file is closed for the last time.
+type FileReleaser interface {
+	Release(ctx context.Context) syscall.Errno
+}
+
+// FileGetattrer reads the attributes of an open file.
+type FileGetattrer interface {
+	Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno
+}
+
+// FileReader reads data from a file handle.
+type FileReader interface {
+	Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
+}
+
+// FileWriter writes data to a file handle.
+type FileWriter interface {
+	Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno)
+}
+
+// FileFlusher is called for each close(2) of a file descriptor.
+type FileFlusher interface {
+	Flush(ctx context.Context) syscall.Errno
+}
+
+// FileFsyncer flushes the file to stable storage.
+type FileFsyncer interface {
+	Fsync(ctx context.Context, flags uint32) syscall.Errno
+}
+
+// FileSetattrer sets attributes of an open file.
+type FileSetattrer interface {
+	Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
+}
+
+// DirStream lists directory entries.
+type DirStream interface {
+	// HasNext indicates if there are further entries.
+	HasNext() bool
+
+	// Next retrieves the next entry.
+	Next() (fuse.DirEntry, syscall.Errno)
+
+	// Close releases resources related to this directory stream.
+	Close()
+}
@@ -0,0 +1,568 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type contextKey struct{}
+
+// FromContext returns the request context of the caller, ie. its
+// uid, gid and pid.
+func FromContext(ctx context.Context) (*fuse.Context, bool) {
+	c, ok := ctx.Value(contextKey{}).(*fuse.Context)
+	return c, ok && c != nil
+}
+
+func newContext(c *fuse.Context) context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return context.WithValue(context.Background(), contextKey{}, c)
+}
+
+// nodeFs is the fuse.NodeFileSystem serving a tree of Inodes.
+type nodeFs struct {
+	fuse.DefaultNodeFileSystem
+
+	root      *Inode
+	connector *fuse.FileSystemConnector
+
+	mu      sync.Mutex
+	inodes  map[uint64]*Inode
+	nextIno uint64
+}
+
+// NewNodeFS returns a fuse.NodeFileSystem for the tree rooted at
+// root, which can be mounted with fuse.MountNodeFileSystem or
+// FileSystemConnector.Mount.  The options are only used for
+// FirstAutomaticIno here; see Mount for the others.
+func NewNodeFS(root InodeEmbedder, opts *Options) fuse.NodeFileSystem {
+	b := &nodeFs{
+		inodes:  map[uint64]*Inode{},
+		nextIno: 1 << 63,
+	}
+	if opts != nil && opts.FirstAutomaticIno > 0 {
+		b.nextIno = opts.FirstAutomaticIno
+	}
+	n := root.EmbeddedInode()
+	n.ops = root
+	n.stableAttr = StableAttr{Mode: syscall.S_IFDIR, Ino: 1}
+	n.bridge = b
+	n.persistent = true
+	n.node = &fsNode{inode: n}
+	b.root = n
+	b.inodes[1] = n
+	return b
+}
+
+func (b *nodeFs) String() string {
+	return fmt.Sprintf("fs.NodeFS(%T)", b.root.ops)
+}
+
+func (b *nodeFs) Root() fuse.FsNode {
+	return b.root.node
+}
+
+func (b *nodeFs) OnMount(conn *fuse.FileSystemConnector) {
+	b.connector = conn
+	if a, ok := b.root.ops.(NodeOnAdder); ok {
+		a.OnAdd(context.Background())
+	}
+}
+
+// unparent clears the parent of ch, if it still is name in parent.
+func (b *nodeFs) unparent(ch *fuse.Inode, parent *Inode, name string) {
+	n := toInode(ch)
+	if n == nil {
+		return
+	}
+	b.mu.Lock()
+	if n.parent == parent && n.parentName == name {
+		n.parent = nil
+		n.parentName = ""
+	}
+	b.mu.Unlock()
+}
+
+// fsNode implements fuse.FsNode by dispatching to the Node*
+// interfaces implemented by the Inode's embedder.
+type fsNode struct {
+	fuse.DefaultFsNode
+	inode *Inode
+}
+
+func (n *fsNode) Deletable() bool {
+	b := n.inode.bridge
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !n.inode.persistent
+}
+
+// OnForget is called with the tree lock held.
+func (n *fsNode) OnForget() {
+	b := n.inode.bridge
+	b.mu.Lock()
+	n.inode.parent = nil
+	n.inode.parentName = ""
+	if b.inodes[n.inode.stableAttr.Ino] == n.inode {
+		delete(b.inodes, n.inode.stableAttr.Ino)
+	}
+	b.mu.Unlock()
+	if f, ok := n.inode.ops.(NodeOnForgetter); ok {
+		f.OnForget()
+	}
+}
+
+// addChild puts a child returned from a Node* method into the tree,
+// and fills its attributes into out, if Lookup and friends did not.
+func (n *fsNode) addChild(name string, ch *Inode, entry *fuse.EntryOut, out *fuse.Attr, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	if ch == nil {
+		return nil, fuse.EIO
+	}
+	n.inode.AddChild(name, ch, true)
+	if out == nil {
+		return ch.node, fuse.OK
+	}
+	*out = entry.Attr
+	if out.Mode == 0 {
+		if code := ch.node.GetAttr(out, nil, context); !code.Ok() {
+			return nil, code
+		}
+	}
+	if out.Mode&syscall.S_IFMT == 0 {
+		out.Mode |= ch.stableAttr.Mode
+	}
+	out.EntryTimeout = entry.EntryTimeout()
+	out.AttrTimeout = entry.AttrTimeout()
+	return ch.node, fuse.OK
+}
+
+func (n *fsNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	l, ok := n.inode.ops.(NodeLookuper)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	entry := &fuse.EntryOut{}
+	ch, errno := l.Lookup(newContext(context), name, entry)
+	if errno != 0 {
+		return nil, fuse.Status(errno)
+	}
+	return n.addChild(name, ch, entry, out, context)
+}
+
+func (n *fsNode) Access(mode uint32, context *fuse.Context) fuse.Status {
+	if a, ok := n.inode.ops.(NodeAccesser); ok {
+		return fuse.Status(a.Access(newContext(context), mode))
+	}
+	return fuse.ENOSYS
+}
+
+func (n *fsNode) Readlink(context *fuse.Context) ([]byte, fuse.Status) {
+	if r, ok := n.inode.ops.(NodeReadlinker); ok {
+		data, errno := r.Readlink(newContext(context))
+		return data, fuse.Status(errno)
+	}
+	return nil, fuse.ENOSYS
+}
+
+func (n *fsNode) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	m, ok := n.inode.ops.(NodeMknoder)
+	if !ok {
+		return nil, fuse.ENOSYS
+	}
+	entry := &fuse.EntryOut{}
+	ch, errno := m.Mknod(newContext(context), name, mode, dev, entry)
+	if errno != 0 {
+		return nil, fuse.Status(errno)
+	}
+	return n.addChild(name, ch, entry, nil, context)
+}
+
+func (n *fsNode) Mkdir(name string, mode uint32, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	m, ok := n.inode.ops.(NodeMkdirer)
+	if !ok {
+		return nil, fuse.ENOSYS
+	}
+	entry := &fuse.EntryOut{}
+	ch, errno := m.Mkdir(newContext(context), name, mode, entry)
+	if errno != 0 {
+		return nil, fuse.Status(errno)
+	}
+	return n.addChild(name, ch, entry, nil, context)
+}
+
+func (n *fsNode) Symlink(name string, content string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	s, ok := n.inode.ops.(NodeSymlinker)
+	if !ok {
+		return nil, fuse.ENOSYS
+	}
+	entry := &fuse.EntryOut{}
+	ch, errno := s.Symlink(newContext(context), content, name, entry)
+	if errno != 0 {
+		return nil, fuse.Status(errno)
+	}
+	return n.addChild(name, ch, entry, nil, context)
+}
+
+func (n *fsNode) Link(name string, existing fuse.FsNode, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	l, ok := n.inode.ops.(NodeLinker)
+	target, isNode := existing.(*fsNode)
+	if !ok || !isNode {
+		return nil, fuse.ENOSYS
+	}
+	entry := &fuse.EntryOut{}
+	ch, errno := l.Link(newContext(context), target.inode.ops, name, entry)
+	if errno != 0 {
+		return nil, fuse.Status(errno)
+	}
+	return n.addChild(name, ch, entry, nil, context)
+}
+
+func (n *fsNode) Unlink(name string, context *fuse.Context) fuse.Status {
+	u, ok := n.inode.ops.(NodeUnlinker)
+	if !ok {
+		return fuse.ENOSYS
+	}
+	errno := u.Unlink(newContext(context), name)
+	if errno == 0 {
+		n.inode.RmChild(name)
+	}
+	return fuse.Status(errno)
+}
+
+func (n *fsNode) Rmdir(name string, context *fuse.Context) fuse.Status {
+	r, ok := n.inode.ops.(NodeRmdirer)
+	if !ok {
+		return fuse.ENOSYS
+	}
+	errno := r.Rmdir(newContext(context), name)
+	if errno == 0 {
+		n.inode.RmChild(name)
+	}
+	return fuse.Status(errno)
+}
+
+func (n *fsNode) Rename(oldName string, newParent fuse.FsNode, newName string, context *fuse.Context) fuse.Status {
+	r, ok := n.inode.ops.(NodeRenamer)
+	dest, isNode := newParent.(*fsNode)
+	if !ok || !isNode {
+		return fuse.ENOSYS
+	}
+	errno := r.Rename(newContext(context), oldName, dest.inode.ops, newName, 0)
+	if errno != 0 {
+		return fuse.Status(errno)
+	}
+	if ch := n.inode.GetChild(oldName); ch != nil {
+		n.inode.RmChild(oldName)
+		dest.inode.AddChild(newName, ch, true)
+	} else {
+		dest.inode.RmChild(newName)
+	}
+	return fuse.OK
+}
+
+func (n *fsNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuse.File, fuse.FsNode, fuse.Status) {
+	c, ok := n.inode.ops.(NodeCreater)
+	if !ok {
+		return nil, nil, fuse.ENOSYS
+	}
+	entry := &fuse.EntryOut{}
+	ch, fh, fuseFlags, errno := c.Create(newContext(context), name, flags, mode, entry)
+	if errno != 0 {
+		return nil, nil, fuse.Status(errno)
+	}
+	node, code := n.addChild(name, ch, entry, nil, context)
+	if !code.Ok() {
+		return nil, nil, code
+	}
+	return newFile(ch, fh, fuseFlags), node, fuse.OK
+}
+
+func (n *fsNode) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	var fh FileHandle
+	var fuseFlags uint32
+	if o, ok := n.inode.ops.(NodeOpener); ok {
+		var errno syscall.Errno
+		fh, fuseFlags, errno = o.Open(newContext(context), flags)
+		if errno != 0 {
+			return nil, fuse.Status(errno)
+		}
+	}
+	return newFile(n.inode, fh, fuseFlags), fuse.OK
+}
+
+func (n *fsNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	ctx := newContext(context)
+	if o, ok := n.inode.ops.(NodeOpendirer); ok {
+		if errno := o.Opendir(ctx); errno != 0 {
+			return nil, fuse.Status(errno)
+		}
+	}
+
+	r, ok := n.inode.ops.(NodeReaddirer)
+	if !ok {
+		var entries []fuse.DirEntry
+		for name, ch := range n.inode.Children() {
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: ch.stableAttr.Mode})
+		}
+		return entries, fuse.OK
+	}
+
+	stream, errno := r.Readdir(ctx)
+	if errno != 0 {
+		return nil, fuse.Status(errno)
+	}
+	defer stream.Close()
+	var entries []fuse.DirEntry
+	for stream.HasNext() {
+		e, errno := stream.Next()
+		if errno != 0 {
+			return nil, fuse.Status(errno)
+		}
+		entries = append(entries, e)
+	}
+	return entries, fuse.OK
+}
+
+// xattrBuffer calls get with growing buffers until the data fits.
+func xattrBuffer(get func(dest []byte) (uint32, syscall.Errno)) ([]byte, fuse.Status) {
+	dest := make([]byte, 1024)
+	for {
+		sz, errno := get(dest)
+		if errno == syscall.ERANGE && int(sz) > len(dest) {
+			dest = make([]byte, sz)
+			continue
+		}
+		if errno != 0 {
+			return nil, fuse.Status(errno)
+		}
+		return dest[:sz], fuse.OK
+	}
+}
+
+// Nodes without the xattr interfaces have no attributes.  This is
+// not ENOSYS, which the connector would remember for the whole mount.
+func (n *fsNode) GetXAttr(attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	g, ok := n.inode.ops.(NodeGetxattrer)
+	if !ok {
+		return nil, fuse.ENODATA
+	}
+	ctx := newContext(context)
+	return xattrBuffer(func(dest []byte) (uint32, syscall.Errno) {
+		return g.Getxattr(ctx, attribute, dest)
+	})
+}
+
+func (n *fsNode) ListXAttr(context *fuse.Context) ([]string, fuse.Status) {
+	l, ok := n.inode.ops.(NodeListxattrer)
+	if !ok {
+		return nil, fuse.OK
+	}
+	ctx := newContext(context)
+	data, code := xattrBuffer(func(dest []byte) (uint32, syscall.Errno) {
+		return l.Listxattr(ctx, dest)
+	})
+	if !code.Ok() {
+		return nil, code
+	}
+	var attrs []string
+	for _, a := range strings.Split(string(data), "\000") {
+		if a != "" {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs, fuse.OK
+}
+
+func (n *fsNode) SetXAttr(attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if s, ok := n.inode.ops.(NodeSetxattrer); ok {
+		return fuse.Status(s.Setxattr(newContext(context), attr, data, uint32(flags)))
+	}
+	return fuse.ENOTSUP
+}
+
+func (n *fsNode) RemoveXAttr(attr string, context *fuse.Context) fuse.Status {
+	if r, ok := n.inode.ops.(NodeRemovexattrer); ok {
+		return fuse.Status(r.Removexattr(newContext(context), attr))
+	}
+	return fuse.ENODATA
+}
+
+func (n *fsNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	ctx := newContext(context)
+	fh := fileHandle(file)
+	attr := &fuse.AttrOut{}
+	var errno syscall.Errno
+	if g, ok := n.inode.ops.(NodeGetattrer); ok {
+		errno = g.Getattr(ctx, fh, attr)
+	} else if g, ok := fh.(FileGetattrer); ok {
+		errno = g.Getattr(ctx, attr)
+	} else if n.inode.IsDir() {
+		attr.Mode = 0755
+	} else {
+		attr.Mode = 0644
+	}
+	if errno != 0 {
+		return fuse.Status(errno)
+	}
+	*out = attr.Attr
+	out.AttrTimeout = attr.Timeout()
+	if out.Mode&syscall.S_IFMT == 0 {
+		out.Mode |= n.inode.stableAttr.Mode
+	}
+	if out.Ino == 0 {
+		out.Ino = n.inode.stableAttr.Ino
+	}
+	return fuse.OK
+}
+
+func (n *fsNode) Setattr(file fuse.File, valid uint32, attr *fuse.Attr, context *fuse.Context) fuse.Status {
+	in := &fuse.SetAttrIn{}
+	in.Valid = valid
+	in.Size = attr.Size
+	in.Mode = attr.Mode
+	in.Owner = attr.Owner
+	in.Atime = attr.Atime
+	in.Atimensec = attr.Atimensec
+	in.Mtime = attr.Mtime
+	in.Mtimensec = attr.Mtimensec
+
+	ctx := newContext(context)
+	fh := fileHandle(file)
+	out := &fuse.AttrOut{}
+	if s, ok := n.inode.ops.(NodeSetattrer); ok {
+		return fuse.Status(s.Setattr(ctx, fh, in, out))
+	}
+	if s, ok := fh.(FileSetattrer); ok {
+		return fuse.Status(s.Setattr(ctx, in, out))
+	}
+	return fuse.ENOSYS
+}
+
+func (n *fsNode) StatFs() *fuse.StatfsOut {
+	s, ok := n.inode.ops.(NodeStatfser)
+	if !ok {
+		return nil
+	}
+	out := &fuse.StatfsOut{}
+	if errno := s.Statfs(context.Background(), out); errno != 0 {
+		return nil
+	}
+	return out
+}
+
+func (n *fsNode) FsyncDir(flags int, context *fuse.Context) fuse.Status {
+	if s, ok := n.inode.ops.(NodeFsyncer); ok {
+		return fuse.Status(s.Fsync(newContext(context), nil, uint32(flags)))
+	}
+	return fuse.ENOSYS
+}
+
+// file is the fuse.File for a FileHandle.  Operations go to the node
+// if it implements them, and to the handle otherwise.
+type file struct {
+	fuse.DefaultFile
+	node *Inode
+	fh   FileHandle
+}
+
+func newFile(node *Inode, fh FileHandle, fuseFlags uint32) fuse.File {
+	f := &file{node: node, fh: fh}
+	if fuseFlags == 0 {
+		return f
+	}
+	return &fuse.WithFlags{File: f, FuseFlags: fuseFlags}
+}
+
+// fileHandle returns the FileHandle behind a fuse.File passed in by
+// the connector, or nil.
+func fileHandle(f fuse.File) FileHandle {
+	for f != nil {
+		if mine, ok := f.(*file); ok {
+			return mine.fh
+		}
+		f = f.InnerFile()
+	}
+	return nil
+}
+
+func (f *file) String() string {
+	return fmt.Sprintf("fs.file(%v, %T)", f.node, f.fh)
+}
+
+func (f *file) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	ctx := context.Background()
+	dest := bp.AllocBuffer(input.Size)
+	var res fuse.ReadResult
+	var errno syscall.Errno
+	if r, ok := f.node.ops.(NodeReader); ok {
+		res, errno = r.Read(ctx, f.fh, dest, int64(input.Offset))
+	} else if r, ok := f.fh.(FileReader); ok {
+		res, errno = r.Read(ctx, dest, int64(input.Offset))
+	} else {
+		return nil, fuse.ENOSYS
+	}
+	if errno != 0 {
+		return nil, fuse.Status(errno)
+	}
+	data, code := res.Bytes(dest)
+	// Done may release the storage of data, so copy it into the
+	// buffer we send.
+	n := copy(dest, data)
+	res.Done()
+	return dest[:n], code
+}
+
+func (f *file) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	ctx := context.Background()
+	if w, ok := f.node.ops.(NodeWriter); ok {
+		n, errno := w.Write(ctx, f.fh, data, int64(input.Offset))
+		return n, fuse.Status(errno)
+	}
+	if w, ok := f.fh.(FileWriter); ok {
+		n, errno := w.Write(ctx, data, int64(input.Offset))
+		return n, fuse.Status(errno)
+	}
+	return 0, fuse.ENOSYS
+}
+
+func (f *file) Flush(input *fuse.FlushIn) fuse.Status {
+	ctx := context.Background()
+	if fl, ok := f.node.ops.(NodeFlusher); ok {
+		return fuse.Status(fl.Flush(ctx, f.fh))
+	}
+	if fl, ok := f.fh.(FileFlusher); ok {
+		return fuse.Status(fl.Flush(ctx))
+	}
+	return fuse.OK
+}
+
+func (f *file) Release(input *fuse.ReleaseIn) {
+	ctx := context.Background()
+	if r, ok := f.node.ops.(NodeReleaser); ok {
+		r.Release(ctx, f.fh)
+	} else if r, ok := f.fh.(FileReleaser); ok {
+		r.Release(ctx)
+	}
+}
+
+func (f *file) Fsync(flags int) fuse.Status {
+	ctx := context.Background()
+	if s, ok := f.node.ops.(NodeFsyncer); ok {
+		return fuse.Status(s.Fsync(ctx, f.fh, uint32(flags)))
+	}
+	if s, ok := f.fh.(FileFsyncer); ok {
+		return fuse.Status(s.Fsync(ctx, uint32(flags)))
+	}
+	return fuse.ENOSYS
+}
+
+func (f *file) GetAttr(out *fuse.Attr) fuse.Status {
+	return f.node.node.GetAttr(out, f, nil)
+}
@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// The nodes below are written against the v2 API, and only differ
+// from their v2 versions in the import paths.
+
+type testRoot struct {
+	Inode
+}
+
+func (r *testRoot) OnAdd(ctx context.Context) {
+	file := r.NewPersistentInode(ctx, &MemRegularFile{
+		Data: []byte("hello"),
+		Attr: fuse.Attr{Mode: 0644},
+	}, StableAttr{Ino: 2})
+	r.AddChild("file.txt", file, false)
+
+	dir := r.NewPersistentInode(ctx, &numberDir{}, StableAttr{Mode: syscall.S_IFDIR})
+	r.AddChild("numbers", dir, false)
+}
+
+// numberDir has the children "0", "1" and "2", created on lookup.
+type numberDir struct {
+	Inode
+}
+
+var _ = (NodeLookuper)((*numberDir)(nil))
+var _ = (NodeReaddirer)((*numberDir)(nil))
+
+func (d *numberDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	n, err := strconv.Atoi(name)
+	if err != nil || n < 0 || n > 2 {
+		return nil, syscall.ENOENT
+	}
+	out.Mode = 0444
+	out.Size = uint64(len(name))
+	return d.NewInode(ctx, &MemRegularFile{Data: []byte(name), Attr: fuse.Attr{Mode: 0444}}, StableAttr{}), OK
+}
+
+func (d *numberDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	var entries []fuse.DirEntry
+	for i := 0; i < 3; i++ {
+		entries = append(entries, fuse.DirEntry{Name: strconv.Itoa(i), Mode: syscall.S_IFREG})
+	}
+	return NewListDirStream(entries), OK
+}
+
+func TestMountV2Tree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := &testRoot{}
+	state, err := Mount(dir, root, nil)
+	if err != nil {
+		t.Fatal("Mount:", err)
+	}
+	state.Debug = fuse.VerboseTest()
+	defer state.Unmount()
+
+	content, err := ioutil.ReadFile(dir + "/file.txt")
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("ReadFile: %q, %v", content, err)
+	}
+	if err := ioutil.WriteFile(dir+"/file.txt", []byte("bye"), 0644); err != nil {
+		t.Fatal("WriteFile:", err)
+	}
+	file := root.GetChild("file.txt").Operations().(*MemRegularFile)
+	if string(file.Data) != "bye" {
+		t.Errorf("got data %q after write", file.Data)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ReadDir: %v, %v", entries, err)
+	}
+
+	entries, err = ioutil.ReadDir(dir + "/numbers")
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("ReadDir numbers: %v, %v", entries, err)
+	}
+	content, err = ioutil.ReadFile(dir + "/numbers/1")
+	if err != nil || string(content) != "1" {
+		t.Fatalf("ReadFile numbers/1: %q, %v", content, err)
+	}
+	if _, err := os.Lstat(dir + "/numbers/5"); !os.IsNotExist(err) {
+		t.Errorf("got %v for numbers/5, want ENOENT", err)
+	}
+
+	child := root.GetChild("numbers").GetChild("1")
+	if child == nil {
+		t.Fatal("numbers/1 not in tree after lookup")
+	}
+	if p := child.Path(nil); p != "numbers/1" {
+		t.Errorf("got path %q, want numbers/1", p)
+	}
+}
@@ -0,0 +1,230 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// StableAttr holds the attributes of an Inode that do not change
+// over its lifetime.
+type StableAttr struct {
+	// The file type, eg. syscall.S_IFDIR.  Zero means a regular
+	// file.
+	Mode uint32
+
+	// The inode number.  Inodes with the same Ino are the same
+	// Inode.  If zero, a number is assigned automatically.
+	Ino uint64
+
+	// The generation number; unused in this tree.
+	Gen uint64
+}
+
+// Inode is the node of the file system tree.  Embed it in the
+// structs that implement the Node* interfaces.  An Inode is backed
+// by a fuse.Inode of the connector, which tracks its children and
+// open files.
+type Inode struct {
+	stableAttr StableAttr
+	ops        InodeEmbedder
+	bridge     *nodeFs
+	node       *fsNode
+	persistent bool
+
+	// Protected by bridge.mu.  With hard links, this is the last
+	// name the Inode was added under.
+	parentName string
+	parent     *Inode
+}
+
+// EmbeddedInode returns n, which makes structs embedding Inode
+// implement InodeEmbedder.
+func (n *Inode) EmbeddedInode() *Inode {
+	return n
+}
+
+func (n *Inode) StableAttr() StableAttr {
+	return n.stableAttr
+}
+
+// Mode returns the file type of the Inode.
+func (n *Inode) Mode() uint32 {
+	return n.stableAttr.Mode
+}
+
+func (n *Inode) IsDir() bool {
+	return n.stableAttr.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// Operations returns the struct embedding n.
+func (n *Inode) Operations() InodeEmbedder {
+	return n.ops
+}
+
+// Root returns the root of the tree n belongs to.
+func (n *Inode) Root() *Inode {
+	return n.bridge.root
+}
+
+func (n *Inode) IsRoot() bool {
+	return n == n.bridge.root
+}
+
+func (n *Inode) String() string {
+	return fmt.Sprintf("i%d[%s]", n.stableAttr.Ino, fuse.FileMode(n.stableAttr.Mode))
+}
+
+// NewInode returns an Inode for the node ops, which should be fresh
+// or the result of an earlier NewInode call with the same Ino.  It
+// is added to the tree by returning it from Lookup, Mkdir and the
+// like, or by AddChild.  n must be part of a mounted tree.
+func (n *Inode) NewInode(ctx context.Context, ops InodeEmbedder, id StableAttr) *Inode {
+	return n.newInode(ops, id, false)
+}
+
+// NewPersistentInode is like NewInode, but the Inode is not dropped
+// from the tree when the kernel forgets it.  Use it for file systems
+// that are built in OnAdd.
+func (n *Inode) NewPersistentInode(ctx context.Context, ops InodeEmbedder, id StableAttr) *Inode {
+	return n.newInode(ops, id, true)
+}
+
+func (n *Inode) newInode(ops InodeEmbedder, id StableAttr, persistent bool) *Inode {
+	b := n.bridge
+	id.Mode &= syscall.S_IFMT
+	if id.Mode == 0 {
+		id.Mode = syscall.S_IFREG
+	}
+
+	b.mu.Lock()
+	if id.Ino == 0 {
+		id.Ino = b.nextIno
+		b.nextIno++
+	}
+	if old := b.inodes[id.Ino]; old != nil {
+		b.mu.Unlock()
+		return old
+	}
+	ch := ops.EmbeddedInode()
+	ch.ops = ops
+	ch.stableAttr = id
+	ch.bridge = b
+	ch.persistent = persistent
+	ch.node = &fsNode{inode: ch}
+	b.inodes[id.Ino] = ch
+	b.mu.Unlock()
+
+	n.node.Inode().New(ch.IsDir(), ch.node)
+	return ch
+}
+
+// ForgetPersistent makes a persistent Inode subject to forgetting
+// again.
+func (n *Inode) ForgetPersistent() {
+	n.bridge.mu.Lock()
+	n.persistent = false
+	n.bridge.mu.Unlock()
+}
+
+// AddChild adds ch as child name of n.  If a child by that name
+// exists, it is replaced if overwrite is set; otherwise AddChild
+// returns false.
+func (n *Inode) AddChild(name string, ch *Inode, overwrite bool) bool {
+	dir := n.node.Inode()
+	if old := dir.GetChild(name); old != nil {
+		if !overwrite {
+			return false
+		}
+		dir.RmChild(name)
+		n.bridge.unparent(old, n, name)
+	}
+	dir.AddChild(name, ch.node.Inode())
+
+	n.bridge.mu.Lock()
+	ch.parent = n
+	ch.parentName = name
+	n.bridge.mu.Unlock()
+	return true
+}
+
+// GetChild returns the child called name, or nil if it is not in
+// the tree.
+func (n *Inode) GetChild(name string) *Inode {
+	return toInode(n.node.Inode().GetChild(name))
+}
+
+// RmChild removes the named children from the tree.
+func (n *Inode) RmChild(names ...string) {
+	for _, name := range names {
+		n.bridge.unparent(n.node.Inode().RmChild(name), n, name)
+	}
+}
+
+// Children returns the children of n that are in the tree.
+func (n *Inode) Children() map[string]*Inode {
+	out := map[string]*Inode{}
+	for k, v := range n.node.Inode().FsChildren() {
+		if ch := toInode(v); ch != nil {
+			out[k] = ch
+		}
+	}
+	return out
+}
+
+// Parent returns a parent of n and the name of n in it, or nil if n
+// is not in the tree.
+func (n *Inode) Parent() (string, *Inode) {
+	n.bridge.mu.Lock()
+	defer n.bridge.mu.Unlock()
+	return n.parentName, n.parent
+}
+
+// Path returns the path of n relative to root, or to the root of the
+// tree if root is nil.  Inodes that are no longer in the tree are
+// reported as ".deleted".
+func (n *Inode) Path(root *Inode) string {
+	n.bridge.mu.Lock()
+	defer n.bridge.mu.Unlock()
+
+	var names []string
+	p := n
+	for p != root && p != n.bridge.root {
+		if p.parent == nil {
+			return ".deleted"
+		}
+		names = append(names, p.parentName)
+		p = p.parent
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/")
+}
+
+// NotifyEntry tells the kernel the child name of n has changed.
+func (n *Inode) NotifyEntry(name string) syscall.Errno {
+	return syscall.Errno(n.bridge.connector.EntryNotify(n.node.Inode(), name))
+}
+
+// NotifyContent tells the kernel the given range of the content of n
+// has changed.  A negative off invalidates the attributes only.
+func (n *Inode) NotifyContent(off, sz int64) syscall.Errno {
+	return syscall.Errno(n.bridge.connector.FileNotify(n.node.Inode(), off, sz))
+}
+
+// toInode returns the Inode behind a connector inode, or nil if it
+// belongs to a different kind of file system, eg. a submount.
+func toInode(n *fuse.Inode) *Inode {
+	if n == nil {
+		return nil
+	}
+	node, ok := n.FsNode().(*fsNode)
+	if !ok {
+		return nil
+	}
+	return node.inode
+}
@@ -0,0 +1,111 @@
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// MemRegularFile is a filesystem node that holds a read-write data
+// slice in memory.
+type MemRegularFile struct {
+	Inode
+
+	mu   sync.Mutex
+	Data []byte
+	Attr fuse.Attr
+}
+
+var _ = (NodeOpener)((*MemRegularFile)(nil))
+var _ = (NodeReader)((*MemRegularFile)(nil))
+var _ = (NodeWriter)((*MemRegularFile)(nil))
+var _ = (NodeGetattrer)((*MemRegularFile)(nil))
+var _ = (NodeSetattrer)((*MemRegularFile)(nil))
+
+func (f *MemRegularFile) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	return nil, raw.FOPEN_KEEP_CACHE, OK
+}
+
+func (f *MemRegularFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := off + int64(len(dest))
+	if end > int64(len(f.Data)) {
+		end = int64(len(f.Data))
+	}
+	if off > end {
+		off = end
+	}
+	return fuse.ReadResultData(f.Data[off:end]), OK
+}
+
+func (f *MemRegularFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := off + int64(len(data))
+	if end > int64(len(f.Data)) {
+		f.Data = append(f.Data, make([]byte, end-int64(len(f.Data)))...)
+	}
+	copy(f.Data[off:], data)
+	return uint32(len(data)), OK
+}
+
+func (f *MemRegularFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Attr = f.Attr
+	out.Size = uint64(len(f.Data))
+	return OK
+}
+
+func (f *MemRegularFile) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if sz, ok := in.GetSize(); ok {
+		if sz > uint64(len(f.Data)) {
+			f.Data = append(f.Data, make([]byte, sz-uint64(len(f.Data)))...)
+		}
+		f.Data = f.Data[:sz]
+	}
+	if mode, ok := in.GetMode(); ok {
+		f.Attr.Mode = mode &^ syscall.S_IFMT
+	}
+	if uid, ok := in.GetUID(); ok {
+		f.Attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		f.Attr.Gid = gid
+	}
+	if t, ok := in.GetATime(); ok {
+		f.Attr.SetTimes(&t, nil, nil)
+	}
+	if t, ok := in.GetMTime(); ok {
+		f.Attr.SetTimes(nil, &t, nil)
+	}
+	out.Attr = f.Attr
+	out.Size = uint64(len(f.Data))
+	return OK
+}
+
+// MemSymlink is an Inode holding a symlink in memory.
+type MemSymlink struct {
+	Inode
+	Attr fuse.Attr
+	Data []byte
+}
+
+var _ = (NodeReadlinker)((*MemSymlink)(nil))
+var _ = (NodeGetattrer)((*MemSymlink)(nil))
+
+func (l *MemSymlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return l.Data, OK
+}
+
+func (l *MemSymlink) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = l.Attr
+	out.Size = uint64(len(l.Data))
+	return OK
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Options sets options for the entire filesystem.
+type Options struct {
+	// MountOptions contain the options for mounting the fuse
+	// server.
+	fuse.MountOptions
+
+	// If set to nonnil, this defines the overall entry timeout
+	// for the file system.  See fuse.FileSystemOptions for the
+	// defaults.
+	EntryTimeout *time.Duration
+
+	// If set to nonnil, this defines the overall attribute
+	// timeout for the file system.
+	AttrTimeout *time.Duration
+
+	// If set to nonnil, this defines the overall negative entry
+	// timeout for the file system.
+	NegativeTimeout *time.Duration
+
+	// If nonzero, report this uid and gid for all files.
+	UID uint32
+	GID uint32
+
+	// FirstAutomaticIno is the first inode number handed out for
+	// a StableAttr with a zero Ino.  The default is 1<<63.
+	FirstAutomaticIno uint64
+}
+
+// fileSystemOptions translates opts into options for the connector.
+func (opts *Options) fileSystemOptions() *fuse.FileSystemOptions {
+	fsOpts := fuse.NewFileSystemOptions()
+	fsOpts.Owner = nil
+	if opts.EntryTimeout != nil {
+		fsOpts.EntryTimeout = *opts.EntryTimeout
+	}
+	if opts.AttrTimeout != nil {
+		fsOpts.AttrTimeout = *opts.AttrTimeout
+	}
+	if opts.NegativeTimeout != nil {
+		fsOpts.NegativeTimeout = *opts.NegativeTimeout
+	}
+	if opts.UID != 0 || opts.GID != 0 {
+		fsOpts.Owner = &fuse.Owner{Uid: opts.UID, Gid: opts.GID}
+	}
+	return fsOpts
+}
+
+// Mount mounts the tree rooted at root on dir, and starts serving
+// requests in the background.  Call Unmount on the returned
+// MountState to stop.
+func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.MountState, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	conn := fuse.NewFileSystemConnector(NewNodeFS(root, options), options.fileSystemOptions())
+	state := fuse.NewMountState(conn)
+	if err := state.Mount(dir, &options.MountOptions); err != nil {
+		return nil, err
+	}
+	go state.Loop()
+	return state, nil
+}
@@ -0,0 +1,332 @@
+// Package acl encodes and decodes POSIX access control lists in the
+// format the Linux kernel uses for the system.posix_acl_access and
+// system.posix_acl_default extended attributes.
+//
+// File systems mounted with MountOptions.PosixACL store these
+// attributes verbatim, but must keep them in sync with the
+// permission bits: on SetXAttr of an access ACL, the bits become
+// ACL.Mode(), and on Chmod, the ACL becomes ACL.Chmod(mode).  New
+// files inherit the default ACL of their directory through
+// ACL.Create.
+package acl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Names of the extended attributes holding ACLs.
+const (
+	AccessXAttr  = "system.posix_acl_access"
+	DefaultXAttr = "system.posix_acl_default"
+)
+
+// Version is the version of the extended attribute format.
+const Version = 2
+
+// Tag says to whom an Entry applies.
+type Tag uint16
+
+const (
+	UserObj  = Tag(0x01)
+	User     = Tag(0x02)
+	GroupObj = Tag(0x04)
+	Group    = Tag(0x08)
+	Mask     = Tag(0x10)
+	Other    = Tag(0x20)
+)
+
+var tagNames = map[Tag]string{
+	UserObj:  "user_obj",
+	User:     "user",
+	GroupObj: "group_obj",
+	Group:    "group",
+	Mask:     "mask",
+	Other:    "other",
+}
+
+func (t Tag) String() string {
+	if s, ok := tagNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("tag(0x%x)", uint16(t))
+}
+
+// Permission bits of an Entry.
+const (
+	Read    = 04
+	Write   = 02
+	Execute = 01
+)
+
+// UndefinedId is the Id of the entries other than User and Group.
+const UndefinedId = ^uint32(0)
+
+// Entry grants Perm to the user or group Id, or to the class of
+// users given by Tag.
+type Entry struct {
+	Tag  Tag
+	Perm uint16
+	Id   uint32
+}
+
+func (e Entry) String() string {
+	if e.Tag == User || e.Tag == Group {
+		return fmt.Sprintf("%v:%d:%o", e.Tag, e.Id, e.Perm)
+	}
+	return fmt.Sprintf("%v::%o", e.Tag, e.Perm)
+}
+
+// ACL is a list of entries.
+type ACL []Entry
+
+const (
+	headerSize = 4
+	entrySize  = 8
+)
+
+// Decode parses the value of an ACL extended attribute.  It does
+// not check the entries; use Valid for that.
+func Decode(data []byte) (ACL, error) {
+	if len(data) < headerSize || (len(data)-headerSize)%entrySize != 0 {
+		return nil, fmt.Errorf("acl: bad size %d", len(data))
+	}
+	if v := binary.LittleEndian.Uint32(data); v != Version {
+		return nil, fmt.Errorf("acl: unsupported version %d", v)
+	}
+	data = data[headerSize:]
+	a := make(ACL, 0, len(data)/entrySize)
+	for ; len(data) > 0; data = data[entrySize:] {
+		a = append(a, Entry{
+			Tag:  Tag(binary.LittleEndian.Uint16(data)),
+			Perm: binary.LittleEndian.Uint16(data[2:]),
+			Id:   binary.LittleEndian.Uint32(data[4:]),
+		})
+	}
+	return a, nil
+}
+
+// Encode returns the value for an ACL extended attribute.  The
+// entries are written in the order the kernel expects.
+func (a ACL) Encode() []byte {
+	sorted := a.sorted()
+	data := make([]byte, headerSize+entrySize*len(sorted))
+	binary.LittleEndian.PutUint32(data, Version)
+	b := data[headerSize:]
+	for _, e := range sorted {
+		id := e.Id
+		if e.Tag != User && e.Tag != Group {
+			id = UndefinedId
+		}
+		binary.LittleEndian.PutUint16(b, uint16(e.Tag))
+		binary.LittleEndian.PutUint16(b[2:], e.Perm)
+		binary.LittleEndian.PutUint32(b[4:], id)
+		b = b[entrySize:]
+	}
+	return data
+}
+
+type byTagId ACL
+
+func (a byTagId) Len() int      { return len(a) }
+func (a byTagId) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byTagId) Less(i, j int) bool {
+	if a[i].Tag != a[j].Tag {
+		return a[i].Tag < a[j].Tag
+	}
+	return a[i].Id < a[j].Id
+}
+
+func (a ACL) sorted() ACL {
+	s := append(ACL(nil), a...)
+	sort.Stable(byTagId(s))
+	return s
+}
+
+// Valid checks that the ACL has exactly one UserObj, GroupObj and
+// Other entry, no duplicate users or groups, and a Mask if it has
+// named users or groups.
+func (a ACL) Valid() error {
+	count := map[Tag]int{}
+	ids := map[Entry]bool{}
+	for _, e := range a {
+		if _, ok := tagNames[e.Tag]; !ok {
+			return fmt.Errorf("acl: unknown tag %v", e.Tag)
+		}
+		if e.Perm&^(Read|Write|Execute) != 0 {
+			return fmt.Errorf("acl: bad permissions in %v", e)
+		}
+		count[e.Tag]++
+		if e.Tag == User || e.Tag == Group {
+			key := Entry{Tag: e.Tag, Id: e.Id}
+			if ids[key] {
+				return fmt.Errorf("acl: duplicate entry %v", e)
+			}
+			ids[key] = true
+		}
+	}
+	for _, t := range []Tag{UserObj, GroupObj, Other} {
+		if count[t] != 1 {
+			return fmt.Errorf("acl: need one %v entry, have %d", t, count[t])
+		}
+	}
+	if count[Mask] > 1 {
+		return fmt.Errorf("acl: %d mask entries", count[Mask])
+	}
+	if count[Mask] == 0 && count[User]+count[Group] > 0 {
+		return fmt.Errorf("acl: named entries without mask")
+	}
+	return nil
+}
+
+// FromMode returns the minimal ACL for the permission bits of mode.
+func FromMode(mode uint32) ACL {
+	return ACL{
+		{Tag: UserObj, Perm: uint16(mode>>6) & 07, Id: UndefinedId},
+		{Tag: GroupObj, Perm: uint16(mode>>3) & 07, Id: UndefinedId},
+		{Tag: Other, Perm: uint16(mode) & 07, Id: UndefinedId},
+	}
+}
+
+// groupClass returns the index of the entry that stands for the
+// group permission bits: the Mask if there is one, or else the
+// GroupObj.
+func (a ACL) groupClass() int {
+	idx := -1
+	for i, e := range a {
+		switch e.Tag {
+		case Mask:
+			return i
+		case GroupObj:
+			idx = i
+		}
+	}
+	return idx
+}
+
+// Mode returns the permission bits implied by the ACL.
+func (a ACL) Mode() uint32 {
+	var mode uint32
+	for _, e := range a {
+		switch e.Tag {
+		case UserObj:
+			mode |= uint32(e.Perm&07) << 6
+		case Other:
+			mode |= uint32(e.Perm & 07)
+		}
+	}
+	if i := a.groupClass(); i >= 0 {
+		mode |= uint32(a[i].Perm&07) << 3
+	}
+	return mode
+}
+
+// Equivalent returns true if the permission bits say all there is to
+// the ACL.  Equivalent access ACLs need not be stored.
+func (a ACL) Equivalent() bool {
+	for _, e := range a {
+		switch e.Tag {
+		case User, Group, Mask:
+			return false
+		}
+	}
+	return true
+}
+
+// Chmod returns the ACL with the permission bits of mode applied, as
+// chmod(2) does: the owner and other bits replace the UserObj and
+// Other entries, and the group bits replace the Mask, or the
+// GroupObj if there is no mask.
+func (a ACL) Chmod(mode uint32) ACL {
+	c := append(ACL(nil), a...)
+	g := c.groupClass()
+	for i := range c {
+		switch {
+		case c[i].Tag == UserObj:
+			c[i].Perm = uint16(mode>>6) & 07
+		case c[i].Tag == Other:
+			c[i].Perm = uint16(mode) & 07
+		case i == g:
+			c[i].Perm = uint16(mode>>3) & 07
+		}
+	}
+	return c
+}
+
+// Create returns the access ACL and the permission bits for a new
+// file with the given mode, in a directory whose default ACL is a.
+// The ACL entries are limited by mode, rather than by the umask.  New
+// directories also get a as their default ACL.
+func (a ACL) Create(mode uint32) (ACL, uint32) {
+	c := append(ACL(nil), a...)
+	g := c.groupClass()
+	for i := range c {
+		switch {
+		case c[i].Tag == UserObj:
+			c[i].Perm &= uint16(mode>>6) & 07
+		case c[i].Tag == Other:
+			c[i].Perm &= uint16(mode) & 07
+		case i == g:
+			c[i].Perm &= uint16(mode>>3) & 07
+		}
+	}
+	return c, (mode &^ 0777) | c.Mode()
+}
+
+// Permits returns true if the ACL grants all of the permissions in
+// want to the user uid with groups gids, for a file owned by owner
+// and group.  It follows the access check algorithm of POSIX.1e, for
+// file systems that check permissions themselves.
+func (a ACL) Permits(uid uint32, gids []uint32, owner uint32, group uint32, want uint16) bool {
+	var mask uint16 = Read | Write | Execute
+	if i := a.groupClass(); i >= 0 && a[i].Tag == Mask {
+		mask = a[i].Perm
+	}
+
+	inGroup := func(g uint32) bool {
+		for _, id := range gids {
+			if id == g {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, e := range a {
+		switch {
+		case e.Tag == UserObj && uid == owner:
+			return e.Perm&want == want
+		case e.Tag == User && e.Id == uid:
+			return e.Perm&mask&want == want
+		}
+	}
+
+	matched := false
+	for _, e := range a {
+		var member bool
+		switch e.Tag {
+		case GroupObj:
+			member = inGroup(group)
+		case Group:
+			member = inGroup(e.Id)
+		}
+		if !member {
+			continue
+		}
+		if e.Perm&mask&want == want {
+			return true
+		}
+		matched = true
+	}
+	if matched {
+		return false
+	}
+
+	for _, e := range a {
+		if e.Tag == Other {
+			return e.Perm&want == want
+		}
+	}
+	return false
+}
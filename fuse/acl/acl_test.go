@@ -0,0 +1,139 @@
+package acl
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Value of system.posix_acl_access after
+// setfacl -m u::rw-,u:1000:r--,g::r--,m::r--,o::---
+var golden = []byte{
+	2, 0, 0, 0,
+	1, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+	2, 0, 4, 0, 0xe8, 0x03, 0, 0,
+	4, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+	0x10, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+	0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+}
+
+var goldenACL = ACL{
+	{Tag: UserObj, Perm: Read | Write, Id: UndefinedId},
+	{Tag: User, Perm: Read, Id: 1000},
+	{Tag: GroupObj, Perm: Read, Id: UndefinedId},
+	{Tag: Mask, Perm: Read, Id: UndefinedId},
+	{Tag: Other, Perm: 0, Id: UndefinedId},
+}
+
+func TestDecode(t *testing.T) {
+	a, err := Decode(golden)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !reflect.DeepEqual(a, goldenACL) {
+		t.Errorf("got %v, want %v", a, goldenACL)
+	}
+	if err := a.Valid(); err != nil {
+		t.Errorf("Valid: %v", err)
+	}
+
+	for _, bad := range [][]byte{nil, golden[:7], append([]byte{3}, golden[1:]...)} {
+		if _, err := Decode(bad); err == nil {
+			t.Errorf("Decode(%v) should fail", bad)
+		}
+	}
+}
+
+func TestEncodeSorts(t *testing.T) {
+	shuffled := ACL{goldenACL[4], goldenACL[3], goldenACL[1], goldenACL[0], goldenACL[2]}
+	if got := shuffled.Encode(); !bytes.Equal(got, golden) {
+		t.Errorf("got %v, want %v", got, golden)
+	}
+}
+
+func TestValid(t *testing.T) {
+	noMask := append(FromMode(0644), Entry{Tag: Group, Perm: Read, Id: 10})
+	dup := append(goldenACL.sorted(), Entry{Tag: User, Perm: Read, Id: 1000})
+	for _, a := range []ACL{nil, goldenACL[1:], noMask, dup} {
+		if a.Valid() == nil {
+			t.Errorf("%v should be invalid", a)
+		}
+	}
+	if err := FromMode(0755).Valid(); err != nil {
+		t.Errorf("FromMode: %v", err)
+	}
+}
+
+func TestMode(t *testing.T) {
+	if m := goldenACL.Mode(); m != 0640 {
+		t.Errorf("got mode %o, want 640", m)
+	}
+	if goldenACL.Equivalent() {
+		t.Error("ACL with named user is not equivalent to its mode")
+	}
+	a := FromMode(0751)
+	if m := a.Mode(); m != 0751 || !a.Equivalent() {
+		t.Errorf("got mode %o, equivalent %v", m, a.Equivalent())
+	}
+}
+
+func TestChmod(t *testing.T) {
+	c := goldenACL.Chmod(0705)
+	if m := c.Mode(); m != 0705 {
+		t.Errorf("got mode %o, want 705", m)
+	}
+	// The mask stands for the group bits; the group entry is
+	// untouched.
+	if c[2].Perm != Read || c[3].Perm != 0 {
+		t.Errorf("got %v", c)
+	}
+	if goldenACL[0].Perm != Read|Write {
+		t.Error("Chmod changed its receiver")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	def := ACL{
+		{Tag: UserObj, Perm: 07, Id: UndefinedId},
+		{Tag: Group, Perm: 07, Id: 20},
+		{Tag: GroupObj, Perm: 05, Id: UndefinedId},
+		{Tag: Mask, Perm: 07, Id: UndefinedId},
+		{Tag: Other, Perm: 05, Id: UndefinedId},
+	}
+	a, mode := def.Create(S_IFREG | 0664)
+	if mode != S_IFREG|0664 {
+		t.Errorf("got mode %o", mode)
+	}
+	if a[1].Perm != 07 || a[3].Perm != 06 {
+		t.Errorf("got %v", a)
+	}
+}
+
+const S_IFREG = 0100000
+
+func TestPermits(t *testing.T) {
+	const owner, group = 1, 2
+	for _, c := range []struct {
+		uid  uint32
+		gids []uint32
+		want uint16
+		ok   bool
+	}{
+		{owner, nil, Read | Write, true},
+		{1000, nil, Read, true},
+		{1000, nil, Write, false},
+		{5, []uint32{group}, Read, true},
+		{5, []uint32{group}, Write, false},
+		{5, nil, Read, false},
+	} {
+		if got := goldenACL.Permits(c.uid, c.gids, owner, group, c.want); got != c.ok {
+			t.Errorf("Permits(%d, %v, %o) = %v, want %v", c.uid, c.gids, c.want, got, c.ok)
+		}
+	}
+
+	// The mask limits named users.
+	masked := goldenACL.Chmod(0600)
+	if masked.Permits(1000, nil, owner, group, Read) {
+		t.Error("mask should hide read access of named user")
+	}
+}
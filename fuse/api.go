@@ -12,13 +12,59 @@ import (
 
 // Types for users to implement.
 
+// UnmountReason says why a file system is unmounted.
+type UnmountReason int
+
+const (
+	// The kernel closed the connection: the file system was
+	// unmounted with umount or fusermount -u, or the connection
+	// was aborted through /sys/fs/fuse/connections.
+	UNMOUNT_KERNEL = UnmountReason(iota)
+
+	// MountState.Unmount was called.
+	UNMOUNT_DAEMON
+
+	// Reading requests from the kernel failed.
+	UNMOUNT_ERROR
+
+	// FileSystemConnector.Unmount removed a mount, while the
+	// rest of the file system stays mounted.
+	UNMOUNT_SUBMOUNT
+
+	// MountState.Handoff passed the connection to another
+	// process, which serves the mount from then on.
+	UNMOUNT_HANDOFF
+)
+
+// UnmountMethod says how MountState.UnmountWithOptions removed the
+// mount.
+type UnmountMethod int
+
+const (
+	// A plain unmount, or closing the connection if the
+	// MountState did not mount itself.
+	UNMOUNT_NORMAL = UnmountMethod(iota)
+
+	// A forced unmount, which aborted the connection first.
+	UNMOUNT_FORCE
+
+	// A lazy unmount: the mount is gone from the namespace, and
+	// the kernel closes the connection once its last file is
+	// closed.
+	UNMOUNT_LAZY
+)
+
 // NodeFileSystem is a high level API that resembles the kernel's idea
 // of what an FS looks like.  NodeFileSystems can have multiple
 // hard-links to one file, for example. It is also suited if the data
 // to represent fits in memory: you can construct FsNode at mount
 // time, and the filesystem will be ready.
 type NodeFileSystem interface {
-	OnUnmount()
+	// OnUnmount is called once the file system is no longer
+	// mounted.  When the connection to the kernel closes, all
+	// requests have been answered by then, and the submounts of
+	// a file system are told before it.
+	OnUnmount(reason UnmountReason)
 	OnMount(conn *FileSystemConnector)
 	Root() FsNode
 
@@ -43,6 +89,14 @@ type FsNode interface {
 	// dropped from the tree.
 	OnForget()
 
+	// OnKernelForget is called when the kernel has dropped its
+	// last reference to this inode, ie. its lookup count went to
+	// zero.  Lookups that return this node wait until it
+	// returns, so it is a safe point to release expensive
+	// per-inode state.  The node may be looked up again later.
+	// It must not wait for kernel operations on the node.
+	OnKernelForget()
+
 	// Misc.
 	Access(mode uint32, context *Context) (code Status)
 	Readlink(c *Context) ([]byte, Status)
@@ -61,7 +115,14 @@ type FsNode interface {
 	Open(flags uint32, context *Context) (file File, code Status)
 	OpenDir(context *Context) ([]DirEntry, Status)
 
-	// XAttrs
+	// OpenDirStream opens the directory for reading in pieces,
+	// see DirStream.  If it returns ENOSYS, the connector reads
+	// the directory with OpenDir.
+	OpenDirStream(context *Context) (DirStream, Status)
+
+	// XAttrs.  ENOSYS means that the file system does not
+	// support the operation at all: it is not called again for
+	// the mount.
 	GetXAttr(attribute string, context *Context) (data []byte, code Status)
 	RemoveXAttr(attr string, context *Context) Status
 	SetXAttr(attr string, data []byte, flags int, context *Context) Status
@@ -72,9 +133,27 @@ type FsNode interface {
 	Chmod(file File, perms uint32, context *Context) (code Status)
 	Chown(file File, uid uint32, gid uint32, context *Context) (code Status)
 	Truncate(file File, size uint64, context *Context) (code Status)
-	Utimens(file File, atime int64, mtime int64, context *Context) (code Status)
+	// Utimens sets the access and modification times.  Nil
+	// times are left unchanged, and UtimeNow is the current time.
+	Utimens(file File, atime *time.Time, mtime *time.Time, context *Context) (code Status)
+
+	// Setattr applies all changes of a SETATTR request at
+	// once. valid is the mask of raw.FATTR_* bits present in
+	// attr; for FATTR_ATIME_NOW and FATTR_MTIME_NOW, the
+	// nanoseconds of the time are UTIME_NOW.  Returning ENOSYS
+	// makes the connector fall back to Chmod, Chown, Truncate and
+	// Utimens.
+	Setattr(file File, valid uint32, attr *Attr, context *Context) (code Status)
 
 	StatFs() *StatfsOut
+
+	// SyncFs is called on the root of each mount before it is
+	// unmounted, and for syncfs(2) on kernels that send SYNCFS.
+	SyncFs(context *Context) (code Status)
+
+	// FsyncDir is called for fsync(2) on a directory.  flags has
+	// raw.FUSE_FSYNC_FDATASYNC set for fdatasync(2).
+	FsyncDir(flags int, context *Context) (code Status)
 }
 
 // A filesystem API that uses paths rather than inodes.  A minimal
@@ -96,10 +175,14 @@ type FileSystem interface {
 	// hardlinks incurs a performance hit.
 	GetAttr(name string, context *Context) (*Attr, Status)
 
-	// These should update the file's ctime too.
+	// These should update the file's ctime too.  Like all
+	// operations on a name, they apply to the entry itself: if
+	// it is a symlink, it is the link that changes, not its
+	// target, as with lchown(2).  The kernel has resolved any
+	// symlinks that the caller wanted followed.
 	Chmod(name string, mode uint32, context *Context) (code Status)
 	Chown(name string, uid uint32, gid uint32, context *Context) (code Status)
-	Utimens(name string, AtimeNs int64, MtimeNs int64, context *Context) (code Status)
+	Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status)
 
 	Truncate(name string, size uint64, context *Context) (code Status)
 
@@ -113,7 +196,16 @@ type FileSystem interface {
 	Rmdir(name string, context *Context) (code Status)
 	Unlink(name string, context *Context) (code Status)
 
-	// Extended attributes.
+	// LinkKey returns a key that is equal for all names of the
+	// same file, for file systems whose inode numbers cannot be
+	// used to find hard links.  It is only called if
+	// PathNodeFsOptions.LinkKeys is set, for files with more than
+	// one link.
+	LinkKey(name string, context *Context) (key string, code Status)
+
+	// Extended attributes.  As for FsNode, ENOSYS turns the
+	// operation off for the whole mount.  As with Chown, they
+	// apply to symlinks themselves, like lgetxattr(2).
 	GetXAttr(name string, attribute string, context *Context) (data []byte, code Status)
 	ListXAttr(name string, context *Context) (attributes []string, code Status)
 	RemoveXAttr(name string, attr string, context *Context) Status
@@ -121,29 +213,143 @@ type FileSystem interface {
 
 	// Called after mount.
 	OnMount(nodeFs *PathNodeFs)
-	OnUnmount()
+	// Called when the PathNodeFs is unmounted; see
+	// NodeFileSystem.OnUnmount.
+	OnUnmount(reason UnmountReason)
 
 	// File handling.  If opening for writing, the file's mtime
 	// should be updated too.
 	Open(name string, flags uint32, context *Context) (file File, code Status)
 	Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status)
 
-	// Directory handling
+	// Directory handling.  OpenDirStream is tried first; if it
+	// returns ENOSYS, the directory is read with OpenDir.
 	OpenDir(name string, context *Context) (stream []DirEntry, code Status)
+	OpenDirStream(name string, context *Context) (stream DirStream, code Status)
 
 	// Symlinks.
 	Symlink(value string, linkName string, context *Context) (code Status)
 	Readlink(name string, context *Context) (string, Status)
 
 	StatFs(name string) *StatfsOut
+
+	// SyncFs should make all data written so far durable.  It
+	// is called before the file system is unmounted, and for
+	// syncfs(2) on kernels that send SYNCFS.
+	SyncFs(context *Context) (code Status)
+
+	// FsyncDir makes the entries of the directory durable.  flags
+	// has raw.FUSE_FSYNC_FDATASYNC set for fdatasync(2).
+	FsyncDir(name string, flags int, context *Context) (code Status)
 }
 
 type PathNodeFsOptions struct {
 	// If ClientInodes is set, use Inode returned from GetAttr to
 	// find hard-linked files.
 	ClientInodes bool
+
+	// If LinkKeys is set, hard-linked files are found with
+	// FileSystem.LinkKey rather than inode numbers, and Link is
+	// supported.  Use this if the file system has no inode
+	// numbers, or reuses them.  It takes precedence over
+	// ClientInodes.  Only files whose GetAttr reports Nlink > 1
+	// are asked for their key.
+	LinkKeys bool
+
+	// If set, directory entries of unknown type
+	// (S_IFUNKNOWN) are completed by calling GetAttr on them.
+	// This costs a GetAttr per entry, but helps programs that
+	// trust the d_type of readdir.
+	FillDirEntryTypes bool
+
+	// If set, the targets returned by FileSystem.Readlink are
+	// passed through this function, which may rewrite them, or
+	// deny them by returning an error status.
+	RewriteSymlink SymlinkRewriter
+
+	// If SillyRename is set, files that are unlinked or renamed
+	// over while they are open are renamed to a hidden
+	// ".fuse_hidden" name in the same directory instead, as NFS
+	// clients do, so operations on the open files keep working.
+	// The hidden file is removed when the last open file is
+	// released.  Without it, such files only support operations
+	// that their File implements.
+	SillyRename bool
+
+	// If CaseInsensitive is set, names are looked up ignoring
+	// case, and children are kept under a single spelling: the
+	// one found in the directory, or the first one looked up.
+	// Use it to serve case-insensitive clients from a
+	// case-sensitive FileSystem, or to wrap a case-insensitive
+	// one.  A failed lookup costs an OpenDir of the directory.
+	// NegativeTimeout should be 0, as the kernel caches negative
+	// entries by their exact name.
+	CaseInsensitive bool
+
+	// If set, every path is passed through this function before
+	// it reaches the FileSystem, eg. to add a prefix, or to map
+	// names into a per-mount namespace.  Returning an error
+	// status fails the operation, which can confine the mount to
+	// part of the FileSystem.
+	RewritePath PathRewriter
+
+	// If StableInodes is set, the inode numbers shown to the
+	// kernel are a hash of the path where a file was first seen,
+	// rather than node IDs, which depend on the order of
+	// lookups.  Files keep their numbers across remounts unless
+	// they are renamed; a renamed file keeps its old number until
+	// the next mount.  Inode numbers from the FileSystem are not
+	// used.  Hard links found through ClientInodes or LinkKeys
+	// share the number of the name seen first.
+	StableInodes bool
+
+	// If ReadOnly is set, operations that would change the file
+	// system fail with EROFS without reaching the FileSystem,
+	// and so do opens for writing.  Mounted as the root file
+	// system, it is mounted with "ro", so the kernel knows too.
+	ReadOnly bool
+
+	// DeletedNodes says how operations are served on a node that
+	// lost its path while the kernel still holds it, eg. a file
+	// that was unlinked or renamed over while open, without
+	// SillyRename.  The default passes the path ".deleted" to
+	// the FileSystem.
+	DeletedNodes DeletedNodeMode
+
+	// If set, DeletedResolver is asked for the path of nodes that
+	// lost theirs, instead of applying DeletedNodes.  If it
+	// returns an error status, the operation fails with it.
+	DeletedResolver DeletedNodeResolver
 }
 
+// DeletedNodeMode is the PathNodeFsOptions.DeletedNodes setting.
+type DeletedNodeMode int
+
+const (
+	// Pass ".deleted" as the path of deleted nodes.
+	DELETED_PATH = DeletedNodeMode(iota)
+
+	// Fail operations on deleted nodes with ESTALE.
+	DELETED_ESTALE
+
+	// Like DELETED_ESTALE, but serve GetAttr, Chmod, Chown,
+	// Truncate and Utimens from any open file of the node.
+	DELETED_FILES
+)
+
+// DeletedNodeResolver returns the path to use for a node that is no
+// longer in the tree of a PathNodeFs.
+type DeletedNodeResolver func(node *Inode) (string, Status)
+
+// SymlinkRewriter takes the name of a symlink, relative to the file
+// system root, and its target, and returns the target to show to the
+// kernel.
+type SymlinkRewriter func(name string, target string) (string, Status)
+
+// PathRewriter takes a path relative to the root of a PathNodeFs, and
+// returns the path to pass to the FileSystem.
+type PathRewriter func(name string) (string, Status)
+
 // A File object should be returned from FileSystem.Open and
 // FileSystem.Create.  Include DefaultFile into the struct to inherit
 // a default null implementation.  
@@ -163,17 +369,101 @@ type File interface {
 
 	Read(*ReadIn, BufferPool) ([]byte, Status)
 	Write(*WriteIn, []byte) (written uint32, code Status)
-	Flush() Status
-	Release()
+	// Flush is called on each close(2), and Release on the
+	// final one.  Files created for internal use are closed with
+	// zero FlushIn and ReleaseIn.
+	Flush(*FlushIn) Status
+	Release(*ReleaseIn)
+
+	// Fsync makes the file durable.  flags has
+	// raw.FUSE_FSYNC_FDATASYNC set for fdatasync(2), in which
+	// case metadata need not be flushed.
 	Fsync(flags int) (code Status)
 
 	// The methods below may be called on closed files, due to
-	// concurrency.  In that case, you should return EBADF.
-	Truncate(size uint64) Status
+	// concurrency.  In that case, you should return EBADF.  The
+	// context is the caller of the change, who need not be the
+	// process that opened the file.
+	Truncate(size uint64, context *Context) Status
 	GetAttr(out *Attr) (Status)
-	Chown(uid uint32, gid uint32) Status
-	Chmod(perms uint32) Status
-	Utimens(atimeNs int64, mtimeNs int64) Status
+	Chown(uid uint32, gid uint32, context *Context) Status
+	Chmod(perms uint32, context *Context) Status
+	Utimens(atime *time.Time, mtime *time.Time, context *Context) Status
+
+	// Setattr is the File equivalent of FsNode.Setattr.
+	Setattr(valid uint32, attr *Attr, context *Context) Status
+}
+
+// FdFile is implemented by Files whose data can be read straight from
+// a file descriptor, such as LoopbackFile.  Reads are then spliced
+// from the descriptor to the kernel, so the data is not copied
+// through userspace, and Read is only used if splicing fails.  The
+// descriptor is read at the offset of each request, and must stay
+// open until Release.
+//
+// Writes still go through Write: splicing them would mean reading
+// every request from /dev/fuse through a pipe, and the kernel's own
+// passthrough of I/O to a backing file needs a protocol version far
+// newer than the one spoken here.
+type FdFile interface {
+	File
+	Fd() int
+}
+
+// SparseFile is implemented by Files that know where their data is,
+// such as LoopbackFile.  Holes must read as zeros.  If both sides of
+// CopyFile are SparseFiles, only the data is copied, so holes stay
+// holes, and a copy of a large sparse file, like a VM image, does
+// not take its full size.
+type SparseFile interface {
+	File
+
+	// NextData returns the range [start, end) of the first data
+	// at or after offset, or ENXIO if there is none.
+	NextData(offset uint64) (start uint64, end uint64, code Status)
+}
+
+// CloneFile is implemented by Files that can share the storage of
+// another file, like FICLONE does.
+type CloneFile interface {
+	File
+
+	// CloneFrom makes the file a copy of src.  It fails, without
+	// changing the file, if src cannot be cloned, eg. because it
+	// is on another file system.
+	CloneFrom(src File) Status
+}
+
+// CopyRangeFile is implemented by Files that can copy data to other
+// files of the mount without it passing through the kernel, such as
+// LoopbackFile, which clones it on file systems that support that.
+// It serves copy_file_range(2); the kernel copies the data itself if
+// the source is not a CopyRangeFile, or CopyFileRange returns ENOTSUP
+// or EXDEV.
+type CopyRangeFile interface {
+	File
+
+	// CopyFileRange copies size bytes at offIn to dst at offOut.
+	// It returns the number of bytes copied, which is less than
+	// size at the end of the file.
+	CopyFileRange(offIn uint64, dst File, offOut uint64, size uint64) (written uint32, code Status)
+}
+
+// DirStream reads a directory in pieces, so directories need not fit
+// in memory, and offsets stay valid for seekdir(3).  Offsets are
+// cookies of the file system: 0 is the start of the directory, and
+// the Off of each DirEntry is where reading resumes after it.  They
+// must be below 1<<63; the connector uses the upper half for the
+// mount points and the "." and ".." entries it adds.
+type DirStream interface {
+	// ReadDir returns entries following offset.  It may return
+	// any number of them; the connector asks again from the Off
+	// of the last entry it could use.  No entries and OK mean
+	// the end of the directory.
+	ReadDir(offset uint64, context *Context) ([]DirEntry, Status)
+
+	// Release is called when the directory is closed.
+	Release()
 }
 
 // Wrap a File return in this to set FUSE flags.  Also used internally
@@ -209,6 +499,51 @@ type FileSystemOptions struct {
 	// back to callers) stay within int32, which is necessary for
 	// making stat() succeed in 32-bit programs.
 	PortableInodes bool
+
+	// If set, files and directories need no file handles. If the
+	// kernel supports it (CAP_NO_OPEN_SUPPORT and
+	// CAP_NO_OPENDIR_SUPPORT), it will stop sending OPEN, OPENDIR
+	// and RELEASE, and I/O is served by opening the node for the
+	// duration of each operation.  The kernel remembers this for
+	// the whole connection, so files in other mounts of the same
+	// connector are then opened per operation as well.
+	NoOpen bool
+
+	// If set, the connector checks permissions before calling
+	// the file system, like the kernel does with -o
+	// default_permissions: owner, group and other bits from
+	// GetAttr, the sticky bit of directories, and ownership for
+	// chmod, chown and utimes.  Access is answered without
+	// calling the file system.  Root passes all checks.  Each
+	// checked operation costs a GetAttr.
+	DefaultPermissions bool
+
+	// Preferred I/O size reported for files whose GetAttr
+	// leaves Blksize zero.  If 0, use 4096.
+	Blksize uint32
+
+	// If set, node IDs are never reused, and an Inode keeps its
+	// node ID after the kernel forgets it, for as long as it is
+	// in the tree.  Together with a generation number that is
+	// chosen at startup, this gives the stable file handles that
+	// NFS re-export and open_by_handle_at need; see
+	// MountOptions.ExportSupport.  Handles for nodes that were
+	// dropped, or that were issued by an earlier process, are
+	// answered with ESTALE.  Only the options of the root file
+	// system are consulted.
+	PersistentInodes bool
+
+	// If MaxInodes is positive, the kernel is asked to drop
+	// directory entries whenever it holds more than MaxInodes
+	// Inodes, until 90% of MaxInodes remain; see
+	// FileSystemConnector.EvictInodes.  Only the options of the
+	// root file system are consulted.
+	MaxInodes int
+
+	// Maximum number of entry notifications per second that
+	// FileSystemConnector.EntryNotifyMany sends.  If 0, use 1000.
+	// Only the options of the root file system are consulted.
+	NotifyRate int
 }
 
 type MountOptions struct {
@@ -232,6 +567,87 @@ type MountOptions struct {
 	// file system implements extended attributes, and you are not
 	// interested in security labels.
 	IgnoreSecurityLabels bool // ignoring labels should be provided as a fusermount mount option.
+
+	// If set, request and reply buffers come from this pool.
+	// The pool must be safe for concurrent use, and may be
+	// shared between mounts, eg. a single NewBufferPool() for
+	// all mounts of a process.  By default, each MountState has
+	// a pool of its own.
+	Buffers BufferPool
+
+	// MaxReaders caps the number of goroutines waiting for
+	// requests from the kernel.  Each of them holds a buffer of
+	// MaxWrite bytes, so processes with many mounts should set a
+	// low value.  The default is _MAX_READERS, 10.
+	MaxReaders int
+
+	// If PosixACL is set, the kernel is asked to enforce POSIX
+	// ACLs, which it reads from the system.posix_acl_access and
+	// system.posix_acl_default extended attributes.  This implies
+	// default permissions: the kernel checks access against the
+	// attributes and ACLs, and Access is no longer called.  The
+	// file system must store the ACLs, keep the permission bits
+	// in sync with the access ACL on SetXAttr, and update the ACL
+	// on Chmod.  The fuse/acl package has helpers for this.
+	// Check KernelSettings() to see whether the kernel agreed.
+	PosixACL bool
+
+	// If HandleKillPriv is set, the connector rather than the
+	// kernel clears the setuid and setgid bits of files that are
+	// written or truncated by unprivileged users, or chowned.
+	// The kernel clears them only if its cached attributes show
+	// them, while the connector asks the file system with
+	// GetAttr, and clears them with Chmod.  With killpriv v2, the
+	// kernel says when to clear; otherwise, the bits are
+	// cleared for callers other than root.  This costs a GetAttr
+	// per write.
+	HandleKillPriv bool
+
+	// If ExportSupport is set, the kernel is told that the file
+	// system can be exported, eg. over knfsd or with
+	// name_to_handle_at(2).  The kernel then looks up "." and
+	// ".." in directories to resolve file handles, also for node
+	// IDs it has forgotten.  For a FileSystemConnector, set
+	// FileSystemOptions.PersistentInodes as well.
+	ExportSupport bool
+
+	// If CacheSymlinks is set, the kernel is asked to keep the
+	// targets of symlinks in its page cache, so Readlink is only
+	// called the first time a symlink is followed.  Use it for
+	// file systems whose symlinks rarely change.  A changed
+	// target shows once the symlink is invalidated with
+	// FileNotify, or its node is forgotten.
+	CacheSymlinks bool
+
+	// If NoSplice is set, reads of an FdFile are copied through
+	// userspace like other reads, rather than spliced.  Writes
+	// are always copied.
+	NoSplice bool
+}
+
+// UnmountOptions says what MountState.UnmountWithOptions does when
+// the mount is busy.  A plain unmount is retried first; if it still
+// fails, a forced and then a lazy unmount are tried, if enabled.
+type UnmountOptions struct {
+	// How often to retry a plain unmount.  The default is 5.  If
+	// negative, there are no retries.
+	Retries int
+
+	// The delay before the first retry, which grows with each
+	// retry.  The default is 5ms.
+	RetryDelay time.Duration
+
+	// If Force is set, the unmount is forced.  For FUSE, this
+	// aborts the connection, so requests in flight and processes
+	// blocked on the file system fail with ENOTCONN.  Forcing
+	// needs root.
+	Force bool
+
+	// If Lazy is set, the mount is detached lazily, like
+	// umount -l, which succeeds even if files are open.  Loop
+	// keeps serving them until the last one is closed.  Darwin
+	// has no lazy unmount, so there it forces instead.
+	Lazy bool
 }
 
 // DefaultFileSystem implements a FileSystem that returns ENOSYS for every operation.
@@ -284,6 +700,7 @@ type RawFileSystem interface {
 	Write(*raw.InHeader, *WriteIn, []byte) (written uint32, code Status)
 	Flush(header *raw.InHeader, input *raw.FlushIn) Status
 	Fsync(*raw.InHeader, *raw.FsyncIn) (code Status)
+	CopyFileRange(*raw.InHeader, *raw.CopyFileRangeIn) (written uint32, code Status)
 
 	// Directory handling
 	OpenDir(out *raw.OpenOut, header *raw.InHeader, input *raw.OpenIn) (status Status)
@@ -293,9 +710,15 @@ type RawFileSystem interface {
 
 	//
 	StatFs(out *StatfsOut, eader *raw.InHeader) (code Status)
+	SyncFs(header *raw.InHeader, input *raw.SyncFsIn) (code Status)
 
 	// Provide callbacks for pushing notifications to the kernel.
 	Init(params *RawFsInit)
+
+	// OnUnmount is called by MountState.Loop when the connection
+	// to the kernel is closed, after all requests have been
+	// answered, and before Loop returns.
+	OnUnmount(reason UnmountReason)
 }
 
 // DefaultRawFileSystem returns ENOSYS for every operation.
@@ -312,7 +735,19 @@ type DefaultRawFileSystem struct{}
 // Somewhat confusingly, InodeNotify for a file that stopped to exist
 // will give the correct result for Lstat (ENOENT), but the kernel
 // will still issue file Open() on the inode.
+//
+// KernelSettings returns the parameters the kernel sent in INIT, and
+// NegotiatedSettings the ones we replied with, ie. the protocol
+// version and flags both sides support.  They are only meaningful
+// once the first request has been served.
 type RawFsInit struct {
-	InodeNotify func(*raw.NotifyInvalInodeOut) Status
-	EntryNotify func(parent uint64, name string) Status
+	InodeNotify        func(*raw.NotifyInvalInodeOut) Status
+	EntryNotify        func(parent uint64, name string) Status
+	KernelSettings     func() raw.InitIn
+	NegotiatedSettings func() raw.InitOut
+
+	// Interrupted returns a channel that is closed when the
+	// request with the given unique ID is interrupted, or nil if
+	// it is not in flight.
+	Interrupted func(unique uint64) <-chan struct{}
 }
@@ -92,13 +92,44 @@ func (a *Attr) SetNs(atimens int64, mtimens int64, ctimens int64) {
 		a.Mtime = uint64(mtimens / 1e9)
 		a.Mtimensec = uint32(mtimens % 1e9)
 	}
-	if atimens >= 0 {
+	if ctimens >= 0 {
 		a.Ctime = uint64(ctimens / 1e9)
 		a.Ctimensec = uint32(ctimens % 1e9)
 	}
 }
 
+// UTIME_NOW as the nanoseconds of a time in Attr stands for the
+// current time, as it does in a timespec for utimensat(2).
+const UTIME_NOW = (1 << 30) - 1
+
+// UtimeNow passed to Utimens stands for the current time.  Setting
+// the current time, as touch(1) does, only needs write access, where
+// other times need ownership of the file, so a file system should
+// pass it on to utimensat(2) as UTIME_NOW rather than read the clock.
+// Test for it with IsUtimeNow.
+var UtimeNow = time.Unix(0, 0).In(utimeNowZone)
+
+var utimeNowZone = time.FixedZone("UTIME_NOW", 0)
+
+// IsUtimeNow returns true if t is UtimeNow.
+func IsUtimeNow(t *time.Time) bool {
+	return t != nil && t.Location() == utimeNowZone
+}
+
+// ResolveUtime returns t, or the current time if t is UtimeNow, for
+// file systems that store the times themselves.
+func ResolveUtime(t *time.Time) *time.Time {
+	if IsUtimeNow(t) {
+		now := time.Now()
+		return &now
+	}
+	return t
+}
+
+// SetTimes sets the times that are not nil.  UtimeNow sets the
+// current time.
 func (a *Attr) SetTimes(access *time.Time, mod *time.Time, chstatus *time.Time) {
+	access, mod = ResolveUtime(access), ResolveUtime(mod)
 	if access != nil {
 		atimens := access.UnixNano()
 		a.Atime = uint64(atimens / 1e9)
@@ -116,36 +147,43 @@ func (a *Attr) SetTimes(access *time.Time, mod *time.Time, chstatus *time.Time)
 	}
 }
 
-func (a *Attr) FromStat(s *syscall.Stat_t) {
-	a.Ino = uint64(s.Ino)
-	a.Size = uint64(s.Size)
-	a.Blocks = uint64(s.Blocks)
-	a.Atime = uint64(s.Atim.Sec)
-	a.Atimensec = uint32(s.Atim.Nsec)
-	a.Mtime = uint64(s.Mtim.Sec)
-	a.Mtimensec = uint32(s.Mtim.Nsec)
-	a.Ctime = uint64(s.Ctim.Sec)
-	a.Ctimensec = uint32(s.Ctim.Nsec)
-	a.Mode = s.Mode
-	a.Nlink = uint32(s.Nlink)
-	a.Uid = uint32(s.Uid)
-	a.Gid = uint32(s.Gid)
-	a.Rdev = uint32(s.Rdev)
-	a.Blksize = uint32(s.Blksize)
-}
-
 func (a *Attr) ChangeTime() time.Time {
 	return time.Unix(int64(a.Ctime), int64(a.Ctimensec))
 }
 
+// AccessTime returns the access time, or UtimeNow if Atimensec is
+// UTIME_NOW.
 func (a *Attr) AccessTime() time.Time {
+	if a.Atimensec == UTIME_NOW {
+		return UtimeNow
+	}
 	return time.Unix(int64(a.Atime), int64(a.Atimensec))
 }
 
+// ModTime returns the modification time, or UtimeNow if Mtimensec is
+// UTIME_NOW.
 func (a *Attr) ModTime() time.Time {
+	if a.Mtimensec == UTIME_NOW {
+		return UtimeNow
+	}
 	return time.Unix(int64(a.Mtime), int64(a.Mtimensec))
 }
 
+// BirthTime returns the creation time, and false if it is unknown.
+func (a *Attr) BirthTime() (time.Time, bool) {
+	if a.Btime == 0 && a.Btimensec == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(a.Btime), int64(a.Btimensec)), true
+}
+
+func (a *Attr) SetBirthTime(t time.Time) {
+	ns := t.UnixNano()
+	a.Btime = uint64(ns / 1e9)
+	a.Btimensec = uint32(ns % 1e9)
+}
+
+// toRaw copies the fields that the kernel understands into out.
 func ToStatT(f os.FileInfo) *syscall.Stat_t {
 	s, _ := f.Sys().(*syscall.Stat_t)
 	if s != nil {
@@ -0,0 +1,47 @@
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func (a *Attr) FromStat(s *syscall.Stat_t) {
+	a.Ino = uint64(s.Ino)
+	a.Size = uint64(s.Size)
+	a.Blocks = uint64(s.Blocks)
+	a.Atime = uint64(s.Atimespec.Sec)
+	a.Atimensec = uint32(s.Atimespec.Nsec)
+	a.Mtime = uint64(s.Mtimespec.Sec)
+	a.Mtimensec = uint32(s.Mtimespec.Nsec)
+	a.Ctime = uint64(s.Ctimespec.Sec)
+	a.Ctimensec = uint32(s.Ctimespec.Nsec)
+	a.Mode = uint32(s.Mode)
+	a.Nlink = uint32(s.Nlink)
+	a.Uid = uint32(s.Uid)
+	a.Gid = uint32(s.Gid)
+	a.Rdev = uint32(s.Rdev)
+	a.Blksize = uint32(s.Blksize)
+	a.Btime = uint64(s.Birthtimespec.Sec)
+	a.Btimensec = uint32(s.Birthtimespec.Nsec)
+}
+
+// toRaw fills out from a.  The Darwin protocol has no block size,
+// but it does carry the birth time.
+func (a *Attr) toRaw(out *raw.Attr) {
+	out.Ino = a.Ino
+	out.Size = a.Size
+	out.Blocks = a.Blocks
+	out.Atime = a.Atime
+	out.Mtime = a.Mtime
+	out.Ctime = a.Ctime
+	out.Crtime = a.Btime
+	out.Atimensec = a.Atimensec
+	out.Mtimensec = a.Mtimensec
+	out.Ctimensec = a.Ctimensec
+	out.Crtimensec = a.Btimensec
+	out.Mode = a.Mode
+	out.Nlink = a.Nlink
+	out.Owner = a.Owner
+	out.Rdev = a.Rdev
+}
@@ -0,0 +1,68 @@
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func (a *Attr) FromStat(s *syscall.Stat_t) {
+	a.Ino = uint64(s.Ino)
+	a.Size = uint64(s.Size)
+	a.Blocks = uint64(s.Blocks)
+	a.Atime = uint64(s.Atim.Sec)
+	a.Atimensec = uint32(s.Atim.Nsec)
+	a.Mtime = uint64(s.Mtim.Sec)
+	a.Mtimensec = uint32(s.Mtim.Nsec)
+	a.Ctime = uint64(s.Ctim.Sec)
+	a.Ctimensec = uint32(s.Ctim.Nsec)
+	a.Mode = s.Mode
+	a.Nlink = uint32(s.Nlink)
+	a.Uid = uint32(s.Uid)
+	a.Gid = uint32(s.Gid)
+	a.Rdev = uint32(s.Rdev)
+	a.Blksize = uint32(s.Blksize)
+}
+
+// fromStatx fills a from the result of statx.  The device number is
+// encoded as in Stat_t.
+func (a *Attr) fromStatx(s *statxT) {
+	a.Ino = s.Ino
+	a.Size = s.Size
+	a.Blocks = s.Blocks
+	a.Atime = uint64(s.Atime.Sec)
+	a.Atimensec = s.Atime.Nsec
+	a.Mtime = uint64(s.Mtime.Sec)
+	a.Mtimensec = s.Mtime.Nsec
+	a.Ctime = uint64(s.Ctime.Sec)
+	a.Ctimensec = s.Ctime.Nsec
+	a.Mode = uint32(s.Mode)
+	a.Nlink = s.Nlink
+	a.Uid = s.Uid
+	a.Gid = s.Gid
+	a.Rdev = s.RdevMinor&0xff | s.RdevMajor<<8 | (s.RdevMinor&^0xff)<<12
+	a.Blksize = s.Blksize
+	if s.Mask&_STATX_BTIME != 0 {
+		a.Btime = uint64(s.Btime.Sec)
+		a.Btimensec = s.Btime.Nsec
+	}
+	a.Attributes = s.Attributes
+	a.AttributesMask = s.AttributesMask
+}
+
+func (a *Attr) toRaw(out *raw.Attr) {
+	out.Ino = a.Ino
+	out.Size = a.Size
+	out.Blocks = a.Blocks
+	out.Atime = a.Atime
+	out.Mtime = a.Mtime
+	out.Ctime = a.Ctime
+	out.Atimensec = a.Atimensec
+	out.Mtimensec = a.Mtimensec
+	out.Ctimensec = a.Ctimensec
+	out.Mode = a.Mode
+	out.Nlink = a.Nlink
+	out.Owner = a.Owner
+	out.Rdev = a.Rdev
+	out.Blksize = a.Blksize
+}
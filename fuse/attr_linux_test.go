@@ -0,0 +1,30 @@
+package fuse
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestSetBlocks(t *testing.T) {
+	m := &fileSystemMount{options: &FileSystemOptions{}}
+	a := raw.Attr{Size: 1025}
+	m.setBlocks(&a)
+	if a.Blksize != _DEFAULT_BLKSIZE || a.Blocks != 3 {
+		t.Errorf("default: got blksize %d blocks %d, want %d 3", a.Blksize, a.Blocks, _DEFAULT_BLKSIZE)
+	}
+
+	m.options.Blksize = 65536
+	a = raw.Attr{Size: 1025, Blocks: 8}
+	m.setBlocks(&a)
+	if a.Blksize != 65536 || a.Blocks != 8 {
+		t.Errorf("option: got blksize %d blocks %d, want 65536 8", a.Blksize, a.Blocks)
+	}
+
+	// A sparse file from a backend that sets Blksize.
+	a = raw.Attr{Size: 1 << 30, Blksize: 512}
+	m.setBlocks(&a)
+	if a.Blksize != 512 || a.Blocks != 0 {
+		t.Errorf("set by file system: got blksize %d blocks %d, want 512 0", a.Blksize, a.Blocks)
+	}
+}
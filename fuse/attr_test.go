@@ -1,8 +1,12 @@
 package fuse
 
 import (
+	"io/ioutil"
+	"os"
 	"syscall"
 	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
 )
 
 func TestFileMode(t *testing.T) {
@@ -11,3 +15,61 @@ func TestFileMode(t *testing.T) {
 		t.Error("Socket should not be directory")
 	}
 }
+
+func TestLoopbackBirthTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/file", []byte("hello"), 0644)
+	CheckSuccess(err)
+
+	fs := NewLoopbackFileSystem(dir)
+	a, code := fs.GetAttr("file", nil)
+	if !code.Ok() {
+		t.Fatalf("GetAttr: %v", code)
+	}
+	btime, ok := a.BirthTime()
+	if !ok {
+		t.Log("Birth time unsupported by the underlying file system.")
+		return
+	}
+	if btime.After(a.ChangeTime()) {
+		t.Errorf("birth time %v after change time %v", btime, a.ChangeTime())
+	}
+
+	var out raw.Attr
+	a.toRaw(&out)
+	if out.Ino != a.Ino || out.Mode != a.Mode || out.Size != 5 {
+		t.Errorf("toRaw mismatch: %v, %v", &out, a)
+	}
+}
+
+// statAttr must agree with its stat(2) fallback.
+func TestStatAttrFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(dir+"/file", []byte("hello"), 0644))
+	CheckSuccess(os.Symlink("file", dir+"/link"))
+	f, err := os.Open(dir + "/file")
+	CheckSuccess(err)
+	defer f.Close()
+
+	for _, c := range []struct {
+		fd    int
+		path  string
+		flags int
+	}{
+		{AT_FDCWD, dir + "/link", 0},
+		{AT_FDCWD, dir + "/link", _AT_SYMLINK_NOFOLLOW},
+		{int(f.Fd()), "", _AT_EMPTY_PATH},
+	} {
+		var got, want Attr
+		CheckSuccess(statAttr(&got, c.fd, c.path, c.flags))
+		CheckSuccess(statAttrFallback(&want, c.fd, c.path, c.flags))
+		got.Btime, got.Btimensec, got.Attributes, got.AttributesMask = want.Btime, want.Btimensec, 0, 0
+		if got != want {
+			t.Errorf("%q flags %x: got %v, want %v", c.path, c.flags, &got, &want)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package fuse
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes an operation on an AuditFileSystem.
+type AuditRecord struct {
+	Time time.Time
+
+	// Op is the name of the FileSystem or File method, eg. "Open"
+	// or "Read".
+	Op string
+
+	// Path is the file operated on.  For operations on open
+	// files, it is the name the file was opened with.
+	Path string
+
+	// NewPath is the second name of Rename and Link, and the
+	// target of Symlink.
+	NewPath string
+
+	// The caller, from the Context.  Reads and writes are
+	// attributed to the process that opened the file.
+	Uid uint32
+	Gid uint32
+	Pid uint32
+
+	// Flags are the flags of Open and Create.
+	Flags uint32
+
+	// Size is the number of bytes of Read and Write, and the size
+	// of Truncate.
+	Size uint64
+
+	Status   Status
+	Duration time.Duration
+}
+
+func (r *AuditRecord) String() string {
+	s := fmt.Sprintf("%s %s %q", r.Time.Format(time.RFC3339Nano), r.Op, r.Path)
+	if r.NewPath != "" {
+		s += fmt.Sprintf(" %q", r.NewPath)
+	}
+	s += fmt.Sprintf(" uid=%d gid=%d pid=%d", r.Uid, r.Gid, r.Pid)
+	if r.Flags != 0 {
+		s += fmt.Sprintf(" flags=%#o", r.Flags)
+	}
+	if r.Size != 0 {
+		s += fmt.Sprintf(" size=%d", r.Size)
+	}
+	return fmt.Sprintf("%s: %v (%v)", s, r.Status, r.Duration)
+}
+
+// AuditSink receives the records of an AuditFileSystem.  It is called
+// from the goroutines that serve requests, so it must be safe for
+// concurrent use, and should be quick.
+type AuditSink interface {
+	Audit(r *AuditRecord)
+}
+
+type AuditOptions struct {
+	// If Filter is set, only the records for which it returns
+	// true are kept, eg. only failures, or only some paths.
+	Filter func(r *AuditRecord) bool
+
+	// SampleRate is the fraction of records that are passed on
+	// to the sink, after filtering.  Zero passes all of them.
+	SampleRate float64
+
+	// If set, Read and Write on open files are recorded too.
+	// There can be many of them.
+	RecordIO bool
+}
+
+// AuditFileSystem is a wrapper that records each operation, with the
+// caller and the result, to an AuditSink.
+type AuditFileSystem struct {
+	FileSystem
+
+	sink    AuditSink
+	options AuditOptions
+}
+
+// NewAuditFileSystem wraps fs.
+func NewAuditFileSystem(fs FileSystem, sink AuditSink, opts *AuditOptions) *AuditFileSystem {
+	a := &AuditFileSystem{
+		FileSystem: fs,
+		sink:       sink,
+	}
+	if opts != nil {
+		a.options = *opts
+	}
+	return a
+}
+
+func (fs *AuditFileSystem) String() string {
+	return fmt.Sprintf("AuditFileSystem(%s)", fs.FileSystem.String())
+}
+
+func (fs *AuditFileSystem) submit(r *AuditRecord) {
+	if fs.options.Filter != nil && !fs.options.Filter(r) {
+		return
+	}
+	if rate := fs.options.SampleRate; rate > 0 && rate < 1 && rand.Float64() >= rate {
+		return
+	}
+	fs.sink.Audit(r)
+}
+
+func (fs *AuditFileSystem) newRecord(op string, name string, context *Context, start time.Time, code Status) *AuditRecord {
+	r := &AuditRecord{
+		Time:     start,
+		Op:       op,
+		Path:     name,
+		Status:   code,
+		Duration: time.Now().Sub(start),
+	}
+	if context != nil {
+		r.Uid = context.Uid
+		r.Gid = context.Gid
+		r.Pid = context.Pid
+	}
+	return r
+}
+
+// audit records an operation that started at start.  It is deferred
+// by the methods, with a pointer to their result.
+func (fs *AuditFileSystem) audit(op string, name string, newName string, context *Context, start time.Time, code *Status) {
+	r := fs.newRecord(op, name, context, start, *code)
+	r.NewPath = newName
+	fs.submit(r)
+}
+
+func (fs *AuditFileSystem) GetAttr(name string, context *Context) (a *Attr, code Status) {
+	defer fs.audit("GetAttr", name, "", context, time.Now(), &code)
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *AuditFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
+	defer fs.audit("Chmod", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *AuditFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) (code Status) {
+	defer fs.audit("Chown", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *AuditFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	defer fs.audit("Utimens", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Utimens(name, Atime, Mtime, context)
+}
+
+func (fs *AuditFileSystem) Truncate(name string, size uint64, context *Context) (code Status) {
+	start := time.Now()
+	code = fs.FileSystem.Truncate(name, size, context)
+	r := fs.newRecord("Truncate", name, context, start, code)
+	r.Size = size
+	fs.submit(r)
+	return code
+}
+
+func (fs *AuditFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
+	defer fs.audit("Access", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *AuditFileSystem) Link(oldName string, newName string, context *Context) (code Status) {
+	defer fs.audit("Link", oldName, newName, context, time.Now(), &code)
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *AuditFileSystem) Mkdir(name string, mode uint32, context *Context) (code Status) {
+	defer fs.audit("Mkdir", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *AuditFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) (code Status) {
+	defer fs.audit("Mknod", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *AuditFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
+	defer fs.audit("Rename", oldName, newName, context, time.Now(), &code)
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *AuditFileSystem) Rmdir(name string, context *Context) (code Status) {
+	defer fs.audit("Rmdir", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *AuditFileSystem) Unlink(name string, context *Context) (code Status) {
+	defer fs.audit("Unlink", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *AuditFileSystem) GetXAttr(name string, attribute string, context *Context) (data []byte, code Status) {
+	defer fs.audit("GetXAttr", name, "", context, time.Now(), &code)
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *AuditFileSystem) ListXAttr(name string, context *Context) (attributes []string, code Status) {
+	defer fs.audit("ListXAttr", name, "", context, time.Now(), &code)
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *AuditFileSystem) RemoveXAttr(name string, attr string, context *Context) (code Status) {
+	defer fs.audit("RemoveXAttr", name, "", context, time.Now(), &code)
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *AuditFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) (code Status) {
+	defer fs.audit("SetXAttr", name, "", context, time.Now(), &code)
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *AuditFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	start := time.Now()
+	file, code = fs.FileSystem.Open(name, flags, context)
+	return fs.opened("Open", name, flags, context, start, file, code)
+}
+
+func (fs *AuditFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	start := time.Now()
+	file, code = fs.FileSystem.Create(name, flags, mode, context)
+	return fs.opened("Create", name, flags, context, start, file, code)
+}
+
+func (fs *AuditFileSystem) opened(op string, name string, flags uint32, context *Context, start time.Time, file File, code Status) (File, Status) {
+	r := fs.newRecord(op, name, context, start, code)
+	r.Flags = flags
+	fs.submit(r)
+	if !code.Ok() {
+		return file, code
+	}
+	f := &auditFile{File: file, fs: fs, path: name}
+	if context != nil {
+		f.context = *context
+	}
+	return f, code
+}
+
+func (fs *AuditFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, code Status) {
+	defer fs.audit("OpenDir", name, "", context, time.Now(), &code)
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *AuditFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, code Status) {
+	defer fs.audit("OpenDirStream", name, "", context, time.Now(), &code)
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *AuditFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	defer fs.audit("Symlink", linkName, value, context, time.Now(), &code)
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *AuditFileSystem) Readlink(name string, context *Context) (value string, code Status) {
+	defer fs.audit("Readlink", name, "", context, time.Now(), &code)
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *AuditFileSystem) SyncFs(context *Context) (code Status) {
+	defer fs.audit("SyncFs", "", "", context, time.Now(), &code)
+	return fs.FileSystem.SyncFs(context)
+}
+
+func (fs *AuditFileSystem) FsyncDir(name string, flags int, context *Context) (code Status) {
+	defer fs.audit("FsyncDir", name, "", context, time.Now(), &code)
+	return fs.FileSystem.FsyncDir(name, flags, context)
+}
+
+// auditFile records the operations on a file opened through an
+// AuditFileSystem.
+type auditFile struct {
+	File
+	fs      *AuditFileSystem
+	path    string
+	context Context
+}
+
+func (f *auditFile) String() string {
+	return fmt.Sprintf("auditFile(%s)", f.File.String())
+}
+
+func (f *auditFile) InnerFile() File {
+	return f.File
+}
+
+// audit records an operation on the file.  Without a context, it is
+// attributed to the opener.
+func (f *auditFile) audit(op string, size uint64, context *Context, start time.Time, code Status) {
+	if context == nil {
+		context = &f.context
+	}
+	r := f.fs.newRecord(op, f.path, context, start, code)
+	r.Size = size
+	f.fs.submit(r)
+}
+
+func (f *auditFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	if !f.fs.options.RecordIO {
+		return f.File.Read(input, bp)
+	}
+	start := time.Now()
+	data, code := f.File.Read(input, bp)
+	f.audit("Read", uint64(len(data)), nil, start, code)
+	return data, code
+}
+
+func (f *auditFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	if !f.fs.options.RecordIO {
+		return f.File.Write(input, data)
+	}
+	start := time.Now()
+	n, code := f.File.Write(input, data)
+	f.audit("Write", uint64(n), nil, start, code)
+	return n, code
+}
+
+func (f *auditFile) Release(input *ReleaseIn) {
+	start := time.Now()
+	f.File.Release(input)
+	f.audit("Release", 0, nil, start, OK)
+}
+
+func (f *auditFile) Truncate(size uint64, context *Context) Status {
+	start := time.Now()
+	code := f.File.Truncate(size, context)
+	f.audit("Truncate", size, context, start, code)
+	return code
+}
+
+func (f *auditFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	start := time.Now()
+	code := f.File.Chown(uid, gid, context)
+	f.audit("Chown", 0, context, start, code)
+	return code
+}
+
+func (f *auditFile) Chmod(perms uint32, context *Context) Status {
+	start := time.Now()
+	code := f.File.Chmod(perms, context)
+	f.audit("Chmod", 0, context, start, code)
+	return code
+}
+
+func (f *auditFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	start := time.Now()
+	code := f.File.Utimens(atime, mtime, context)
+	f.audit("Utimens", 0, context, start, code)
+	return code
+}
+
+func (f *auditFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	start := time.Now()
+	code := f.File.Setattr(valid, attr, context)
+	f.audit("Setattr", 0, context, start, code)
+	return code
+}
+
+// writerAuditSink writes records as lines of text.
+type writerAuditSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterAuditSink returns an AuditSink that writes each record
+// as a line to w.
+func NewWriterAuditSink(w io.Writer) AuditSink {
+	return &writerAuditSink{w: w}
+}
+
+func (s *writerAuditSink) Audit(r *AuditRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fmt.Fprintln(s.w, r)
+}
@@ -0,0 +1,83 @@
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type auditCollector struct {
+	lock    sync.Mutex
+	records []AuditRecord
+}
+
+func (c *auditCollector) Audit(r *AuditRecord) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.records = append(c.records, *r)
+}
+
+func TestAuditFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	c := &auditCollector{}
+	fs := NewAuditFileSystem(NewLoopbackFileSystem(dir), c, &AuditOptions{RecordIO: true})
+	ctx := &Context{}
+	ctx.Uid, ctx.Gid, ctx.Pid = 1, 2, 3
+
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 0644, ctx)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Write(&WriteIn{}, []byte("hello"))
+	f.Release(&ReleaseIn{})
+	fs.Rename("file", "other", ctx)
+	fs.Unlink("file", ctx)
+
+	var ops []string
+	for _, r := range c.records {
+		ops = append(ops, r.Op)
+		if r.Uid != 1 || r.Gid != 2 || r.Pid != 3 {
+			t.Errorf("%s: got caller %d/%d/%d", r.Op, r.Uid, r.Gid, r.Pid)
+		}
+	}
+	if got := strings.Join(ops, " "); got != "Create Write Release Rename Unlink" {
+		t.Fatalf("got ops %q", got)
+	}
+	if r := c.records[1]; r.Path != "file" || r.Size != 5 || !r.Status.Ok() {
+		t.Errorf("Write record: %v", &r)
+	}
+	if r := c.records[3]; r.Path != "file" || r.NewPath != "other" {
+		t.Errorf("Rename record: %v", &r)
+	}
+	if r := c.records[4]; r.Status != ENOENT {
+		t.Errorf("Unlink record: %v", &r)
+	}
+}
+
+func TestAuditFsFilter(t *testing.T) {
+	var buf bytes.Buffer
+	fs := NewAuditFileSystem(&DefaultFileSystem{}, NewWriterAuditSink(&buf), &AuditOptions{
+		Filter: func(r *AuditRecord) bool { return r.Op != "GetAttr" },
+	})
+	fs.GetAttr("a", nil)
+	fs.Mkdir("b", 0755, nil)
+	if out := buf.String(); strings.Contains(out, "GetAttr") || !strings.Contains(out, `Mkdir "b"`) ||
+		strings.Count(out, "\n") != 1 {
+		t.Errorf("got %q", out)
+	}
+
+	c := &auditCollector{}
+	fs = NewAuditFileSystem(&DefaultFileSystem{}, c, &AuditOptions{SampleRate: 0.5})
+	for i := 0; i < 1000; i++ {
+		fs.Access("a", 0, nil)
+	}
+	if n := len(c.records); n < 300 || n > 700 {
+		t.Errorf("sampled %d of 1000 records", n)
+	}
+}
@@ -0,0 +1,109 @@
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// blockFileSystem is embedded by the wrappers that store the data of
+// regular files in blocks, and so have to see all of each write:
+// CryptFileSystem, CompressFileSystem and ChecksumFileSystem.  It
+// opens the backing files with blockFileFlags, and leaves appends
+// and truncation to the files that wrapFile makes.
+type blockFileSystem struct {
+	FileSystem
+
+	// wrapFile wraps a backing file that was just opened.  On
+	// failure, it must release file.
+	wrapFile func(name string, file File, flags uint32, context *Context) (File, Status)
+}
+
+// blockFileFlags returns the flags to open the backing file of a
+// wrapper that stores data in blocks.  Writes may need to read the
+// rest of their block, and appends and truncation are done by the
+// wrapper.
+func blockFileFlags(flags uint32) uint32 {
+	if flags&syscall.O_ACCMODE == syscall.O_WRONLY {
+		flags = flags&^syscall.O_ACCMODE | syscall.O_RDWR
+	}
+	return flags &^ (syscall.O_APPEND | syscall.O_TRUNC)
+}
+
+func (fs *blockFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	file, code = fs.FileSystem.Open(name, blockFileFlags(flags), context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.finishOpen(name, file, flags, context)
+}
+
+func (fs *blockFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	file, code = fs.FileSystem.Create(name, blockFileFlags(flags), mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.finishOpen(name, file, flags, context)
+}
+
+func (fs *blockFileSystem) finishOpen(name string, file File, flags uint32, context *Context) (File, Status) {
+	f, code := fs.wrapFile(name, file, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		if code = f.Truncate(0, context); !code.Ok() {
+			f.Release(&ReleaseIn{})
+			return nil, code
+		}
+	}
+	return f, OK
+}
+
+func (fs *blockFileSystem) Truncate(name string, size uint64, context *Context) (code Status) {
+	f, code := fs.Open(name, uint32(syscall.O_RDWR), context)
+	if !code.Ok() {
+		return code
+	}
+	defer f.Release(&ReleaseIn{})
+	return f.Truncate(size, context)
+}
+
+// blockFile is embedded by the open files of a blockFileSystem.
+type blockFile struct {
+	File
+
+	// If set, flush writes out what the wrapper keeps besides the
+	// data, on Flush and Fsync.
+	flush func() Status
+}
+
+func (f *blockFile) InnerFile() File {
+	return f.File
+}
+
+// Setattr leaves size changes to Truncate.
+func (f *blockFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	if valid&raw.FATTR_SIZE != 0 {
+		return ENOSYS
+	}
+	return f.File.Setattr(valid, attr, context)
+}
+
+func (f *blockFile) Flush(input *FlushIn) Status {
+	if f.flush != nil {
+		if code := f.flush(); !code.Ok() {
+			return code
+		}
+	}
+	return f.File.Flush(input)
+}
+
+func (f *blockFile) Fsync(flags int) Status {
+	if f.flush != nil {
+		if code := f.flush(); !code.Ok() {
+			return code
+		}
+	}
+	return f.File.Fsync(flags)
+}
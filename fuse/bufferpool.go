@@ -31,6 +31,10 @@ func (p *GcBufferPool) AllocBuffer(size uint32) []byte {
 func (p *GcBufferPool) FreeBuffer(slice []byte) {
 }
 
+func (p *GcBufferPool) String() string {
+	return "GcBufferPool"
+}
+
 // BufferPool implements a pool of buffers that returns slices with
 // capacity of a multiple of PAGESIZE, which have possibly been used,
 // and may contain random contents.
@@ -46,8 +50,16 @@ type BufferPoolImpl struct {
 	// Total count of created buffers.  Handy for finding memory
 	// leaks.
 	createdBuffers int
+
+	// The number of MountStates sharing the pool through
+	// MountOptions.Buffers.
+	mounts int
 }
 
+// _LEAK_LIMIT is the number of buffers a mount should not exceed in
+// tests.
+const _LEAK_LIMIT = 50
+
 func NewBufferPool() *BufferPoolImpl {
 	bp := new(BufferPoolImpl)
 	bp.buffersBySize = make([][][]byte, 0, 32)
@@ -116,8 +128,7 @@ func (p *BufferPoolImpl) AllocBuffer(size uint32) []byte {
 
 	p.outstandingBuffers[uintptr(unsafe.Pointer(&b[0]))] = true
 
-	// For testing should not have more than 20 buffers outstanding.
-	if paranoia && (p.createdBuffers > 50 || len(p.outstandingBuffers) > 50) {
+	if paranoia && p.leaking() {
 		panic("Leaking buffers")
 	}
 	p.lock.Unlock()
@@ -126,6 +137,23 @@ func (p *BufferPoolImpl) AllocBuffer(size uint32) []byte {
 	return b
 }
 
+// addMount records that another MountState uses the pool.
+func (p *BufferPoolImpl) addMount() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.mounts++
+}
+
+// leaking returns true if there are more buffers than the mounts of
+// the pool should need.  The lock must be held.
+func (p *BufferPoolImpl) leaking() bool {
+	limit := _LEAK_LIMIT
+	if p.mounts > 1 {
+		limit *= p.mounts
+	}
+	return p.createdBuffers > limit || len(p.outstandingBuffers) > limit
+}
+
 // FreeBuffer takes back a buffer if it was allocated through
 // AllocBuffer.  It is not an error to call FreeBuffer() on a slice
 // obtained elsewhere.
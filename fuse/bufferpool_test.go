@@ -26,3 +26,22 @@ func TestFreeBufferEmpty(t *testing.T) {
 	c := make([]byte, 0, 2*PAGESIZE)
 	bp.FreeBuffer(c)
 }
+
+// The leak check scales with the number of mounts sharing a pool.
+func TestBufferPoolSharedLeakLimit(t *testing.T) {
+	bp := NewBufferPool()
+	for i := 0; i < 2*_LEAK_LIMIT; i++ {
+		bp.AllocBuffer(PAGESIZE)
+	}
+	if !bp.leaking() {
+		t.Errorf("%d buffers for one mount are not a leak", 2*_LEAK_LIMIT)
+	}
+
+	for i := 0; i < 2; i++ {
+		ms := NewMountState(nil)
+		ms.setOptions(&MountOptions{Buffers: bp})
+	}
+	if bp.leaking() {
+		t.Errorf("%d buffers for two mounts are a leak", 2*_LEAK_LIMIT)
+	}
+}
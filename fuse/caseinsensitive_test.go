@@ -0,0 +1,53 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaseInsensitive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "Foo.txt"), []byte("data"), 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "Bar.txt"), []byte("data"), 0644))
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), &PathNodeFsOptions{CaseInsensitive: true})
+	NewFileSystemConnector(pfs, nil)
+	root := pfs.Root().(*pathInode)
+
+	var a Attr
+	upper, code := root.Lookup(&a, "FOO.TXT", nil)
+	if !code.Ok() {
+		t.Fatal("Lookup FOO.TXT:", code)
+	}
+	if p := pfs.Path(upper.Inode()); p != "Foo.txt" {
+		t.Errorf("stored as %q, want Foo.txt", p)
+	}
+	lower, code := root.Lookup(&a, "foo.txt", nil)
+	if !code.Ok() || lower != upper {
+		t.Errorf("Lookup foo.txt: %v, same node %v", code, lower == upper)
+	}
+	if _, code := root.Lookup(&a, "baz.txt", nil); code != ENOENT {
+		t.Errorf("Lookup of missing file: got %v, want ENOENT", code)
+	}
+
+	if code := root.Rename("foo.TXT", root, "FOO.txt", nil); !code.Ok() {
+		t.Fatal("Rename:", code)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "FOO.txt")); err != nil {
+		t.Errorf("case change by rename: %v", err)
+	}
+
+	if _, code := root.Lookup(&a, "bar.TXT", nil); !code.Ok() {
+		t.Fatal("Lookup bar.TXT:", code)
+	}
+	if code := root.Unlink("BAR.txt", nil); !code.Ok() {
+		t.Fatal("Unlink:", code)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "Bar.txt")); !os.IsNotExist(err) {
+		t.Errorf("Bar.txt after unlink: %v", err)
+	}
+}
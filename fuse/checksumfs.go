@@ -0,0 +1,635 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ChecksumFileSystem is a wrapper that keeps a CRC-32C checksum of
+// each block of each regular file, and verifies the blocks that are
+// read.  A block that does not match fails the read with EIO, and is
+// reported to ChecksumFsOptions.OnCorruption.  The data itself is
+// stored unchanged.
+//
+// Checksums are written when a file is flushed, ie. on each close(2)
+// and fsync(2), so after a crash, blocks written since then fail to
+// verify.  Files without checksums, eg. those that existed before the
+// file system was wrapped, are read without verifying, and get
+// checksums of their current contents when they are first written.
+type ChecksumFileSystem struct {
+	blockFileSystem
+
+	// inner is the wrapped file system, without the filter that
+	// hides sidecar files.
+	inner   FileSystem
+	options ChecksumFsOptions
+
+	// Open files by inode number, so all handles of a file share
+	// the checksums.
+	lock  sync.Mutex
+	files map[uint64]*checksumData
+}
+
+// ChecksumStore says where a ChecksumFileSystem keeps checksums.
+type ChecksumStore int
+
+const (
+	// In a hidden file next to each file, named .cksum.<name>.
+	// Such names are hidden from listings and cannot be used.
+	CHECKSUM_SIDECAR = ChecksumStore(iota)
+
+	// In the extended attribute user.checksums of each file, which
+	// is hidden.  Most file systems limit the size of attributes,
+	// eg. ext4 to a block, which limits the size of files to about
+	// a thousand blocks.
+	CHECKSUM_XATTR
+)
+
+type ChecksumFsOptions struct {
+	// BlockSize is the size of the checksummed blocks of new
+	// files.  Defaults to 4096.
+	BlockSize int
+
+	Store ChecksumStore
+
+	// If set, OnCorruption is called for each block that fails
+	// to verify.
+	OnCorruption func(e *CorruptionEvent)
+}
+
+// CorruptionEvent describes a block whose checksum does not match.
+type CorruptionEvent struct {
+	// Path is the name the file was opened with.
+	Path string
+
+	Block  uint64
+	Offset uint64
+}
+
+const (
+	_CHECKSUM_MAGIC       = "GFCK"
+	_CHECKSUM_HEADER_SIZE = 16
+	_CHECKSUM_PREFIX      = ".cksum."
+	_CHECKSUM_XATTR       = "user.checksums"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// NewChecksumFileSystem wraps fs.
+func NewChecksumFileSystem(fs FileSystem, opts *ChecksumFsOptions) *ChecksumFileSystem {
+	c := &ChecksumFileSystem{
+		blockFileSystem: blockFileSystem{FileSystem: fs},
+		inner:           fs,
+		files:           map[uint64]*checksumData{},
+	}
+	c.wrapFile = c.newFile
+	if opts != nil {
+		c.options = *opts
+	}
+	if c.options.BlockSize <= 0 {
+		c.options.BlockSize = 4096
+	}
+	if c.options.Store == CHECKSUM_SIDECAR {
+		c.FileSystem = NewFilterFileSystem(fs, &FilterOptions{
+			Globs: []string{_CHECKSUM_PREFIX + "*"},
+		})
+	}
+	return c
+}
+
+func (fs *ChecksumFileSystem) String() string {
+	return fmt.Sprintf("ChecksumFileSystem(%s)", fs.inner.String())
+}
+
+func sidecarName(name string) string {
+	dir, base := filepath.Split(name)
+	return dir + _CHECKSUM_PREFIX + base
+}
+
+// readSums returns the stored checksums of name, or ENOENT.
+func (fs *ChecksumFileSystem) readSums(name string, context *Context) ([]byte, Status) {
+	if fs.options.Store == CHECKSUM_XATTR {
+		data, code := fs.inner.GetXAttr(name, _CHECKSUM_XATTR, context)
+		if code == ENODATA {
+			code = ENOENT
+		}
+		return data, code
+	}
+	f, code := fs.inner.Open(sidecarName(name), uint32(os.O_RDONLY), context)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer f.Release(&ReleaseIn{})
+	var a Attr
+	if code := f.GetAttr(&a); !code.Ok() {
+		return nil, code
+	}
+	return f.Read(&ReadIn{Size: uint32(a.Size)}, NewGcBufferPool())
+}
+
+// writeSums stores checksums.  Sidecar files are replaced by a rename,
+// so they are never half written.
+func (fs *ChecksumFileSystem) writeSums(name string, data []byte, context *Context) Status {
+	if fs.options.Store == CHECKSUM_XATTR {
+		return fs.inner.SetXAttr(name, _CHECKSUM_XATTR, data, 0, context)
+	}
+	tmp := sidecarName(name) + ".tmp"
+	f, code := fs.inner.Create(tmp, uint32(os.O_WRONLY|os.O_CREATE|os.O_TRUNC), 0644, context)
+	if !code.Ok() {
+		return code
+	}
+	if n, c := f.Write(&WriteIn{Size: uint32(len(data))}, data); !c.Ok() {
+		code = c
+	} else if int(n) < len(data) {
+		code = EIO
+	}
+	f.Flush(&FlushIn{})
+	f.Release(&ReleaseIn{})
+	if code.Ok() {
+		code = fs.inner.Rename(tmp, sidecarName(name), context)
+	}
+	if !code.Ok() {
+		fs.inner.Unlink(tmp, context)
+	}
+	return code
+}
+
+func (fs *ChecksumFileSystem) newFile(name string, file File, flags uint32, context *Context) (File, Status) {
+	var a Attr
+	if code := file.GetAttr(&a); !code.Ok() {
+		file.Release(&ReleaseIn{})
+		return nil, code
+	}
+
+	fs.lock.Lock()
+	d := fs.files[a.Ino]
+	if d == nil || a.Ino == 0 {
+		d = &checksumData{fs: fs, ino: a.Ino, name: name}
+		if a.Ino != 0 {
+			fs.files[a.Ino] = d
+		}
+	}
+	d.refs++
+	fs.lock.Unlock()
+
+	f := &checksumFile{
+		data:     d,
+		writable: flags&syscall.O_ACCMODE != syscall.O_RDONLY,
+	}
+	f.blockFile = blockFile{File: file, flush: f.flush}
+	var code Status
+	d.lock.Lock()
+	if !d.loaded {
+		code = d.load(&a, context)
+	}
+	d.lock.Unlock()
+	if !code.Ok() {
+		f.Release(&ReleaseIn{})
+		return nil, code
+	}
+	return f, OK
+}
+
+func (fs *ChecksumFileSystem) putData(d *checksumData) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	d.refs--
+	if d.refs == 0 && fs.files[d.ino] == d {
+		delete(fs.files, d.ino)
+	}
+}
+
+func (fs *ChecksumFileSystem) Unlink(name string, context *Context) Status {
+	code := fs.FileSystem.Unlink(name, context)
+	if code.Ok() && fs.options.Store == CHECKSUM_SIDECAR {
+		fs.inner.Unlink(sidecarName(name), context)
+	}
+	return code
+}
+
+func (fs *ChecksumFileSystem) Rename(oldName string, newName string, context *Context) Status {
+	code := fs.FileSystem.Rename(oldName, newName, context)
+	if code.Ok() && fs.options.Store == CHECKSUM_SIDECAR {
+		if fs.inner.Rename(sidecarName(oldName), sidecarName(newName), context) == ENOENT {
+			fs.inner.Unlink(sidecarName(newName), context)
+		}
+	}
+	return code
+}
+
+// Link links the sidecar file too, so both names share checksums.
+func (fs *ChecksumFileSystem) Link(oldName string, newName string, context *Context) Status {
+	code := fs.FileSystem.Link(oldName, newName, context)
+	if code.Ok() && fs.options.Store == CHECKSUM_SIDECAR {
+		fs.inner.Link(sidecarName(oldName), sidecarName(newName), context)
+	}
+	return code
+}
+
+func (fs *ChecksumFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	if fs.options.Store == CHECKSUM_XATTR && attr == _CHECKSUM_XATTR {
+		return nil, ENODATA
+	}
+	return fs.FileSystem.GetXAttr(name, attr, context)
+}
+
+func (fs *ChecksumFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	if fs.options.Store == CHECKSUM_XATTR && attr == _CHECKSUM_XATTR {
+		return EPERM
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *ChecksumFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	if fs.options.Store == CHECKSUM_XATTR && attr == _CHECKSUM_XATTR {
+		return EPERM
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *ChecksumFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
+	attrs, code := fs.FileSystem.ListXAttr(name, context)
+	if fs.options.Store != CHECKSUM_XATTR || !code.Ok() {
+		return attrs, code
+	}
+	result := attrs[:0]
+	for _, a := range attrs {
+		if a != _CHECKSUM_XATTR {
+			result = append(result, a)
+		}
+	}
+	return result, code
+}
+
+// checksumData is the state of an open file, shared by its handles.
+type checksumData struct {
+	fs   *ChecksumFileSystem
+	ino  uint64
+	name string
+	refs int
+
+	lock   sync.Mutex
+	loaded bool
+	// verified is set if the file has checksums.
+	verified  bool
+	blockSize uint64
+	size      uint64
+	sums      []uint32
+	// dirty is set if the stored checksums are out of date.
+	dirty bool
+}
+
+func (d *checksumData) load(a *Attr, context *Context) Status {
+	d.size = a.Size
+	d.blockSize = uint64(d.fs.options.BlockSize)
+	data, code := d.fs.readSums(d.name, context)
+	if code == ENOENT {
+		// New files start out with checksums.
+		d.verified = a.Size == 0
+		d.dirty = d.verified
+		d.loaded = true
+		return OK
+	}
+	if !code.Ok() {
+		return code
+	}
+	if len(data) < _CHECKSUM_HEADER_SIZE || string(data[:4]) != _CHECKSUM_MAGIC ||
+		(len(data)-_CHECKSUM_HEADER_SIZE)%4 != 0 {
+		log.Printf("ChecksumFileSystem: bad checksums for %q", d.name)
+		d.report(0)
+		return EIO
+	}
+	d.blockSize = uint64(binary.BigEndian.Uint32(data[4:]))
+	if d.blockSize == 0 {
+		log.Printf("ChecksumFileSystem: bad block size for %q", d.name)
+		return EIO
+	}
+	d.sums = make([]uint32, (len(data)-_CHECKSUM_HEADER_SIZE)/4)
+	for i := range d.sums {
+		d.sums[i] = binary.BigEndian.Uint32(data[_CHECKSUM_HEADER_SIZE+4*i:])
+	}
+	d.verified = true
+	d.loaded = true
+	return OK
+}
+
+func (d *checksumData) report(block uint64) {
+	log.Printf("ChecksumFileSystem: %q: block %d is corrupt", d.name, block)
+	if d.fs.options.OnCorruption != nil {
+		d.fs.options.OnCorruption(&CorruptionEvent{
+			Path:   d.name,
+			Block:  block,
+			Offset: block * d.blockSize,
+		})
+	}
+}
+
+func (d *checksumData) blockCount(size uint64) int {
+	return int((size + d.blockSize - 1) / d.blockSize)
+}
+
+// readBlocks reads the blocks from first up to end, and verifies
+// them.
+func (d *checksumData) readBlocks(f File, first, end uint64) ([]byte, Status) {
+	if last := uint64(d.blockCount(d.size)); end > last {
+		end = last
+	}
+	if first >= end {
+		return nil, OK
+	}
+	data, code := f.Read(&ReadIn{
+		Offset: first * d.blockSize,
+		Size:   uint32((end - first) * d.blockSize),
+	}, NewGcBufferPool())
+	if !code.Ok() || !d.verified {
+		return data, code
+	}
+	for i := first; i < end; i++ {
+		start := (i - first) * d.blockSize
+		stop := start + d.blockSize
+		if stop > uint64(len(data)) {
+			stop = uint64(len(data))
+		}
+		if start > stop || i >= uint64(len(d.sums)) ||
+			crc32.Checksum(data[start:stop], castagnoli) != d.sums[i] {
+			d.report(i)
+			return nil, EIO
+		}
+	}
+	return data, OK
+}
+
+// adopt computes checksums for a file that has none.
+func (d *checksumData) adopt(f File) Status {
+	if d.verified {
+		return OK
+	}
+	count := d.blockCount(d.size)
+	d.sums = make([]uint32, count)
+	for i := 0; i < count; i++ {
+		data, code := d.readBlocks(f, uint64(i), uint64(i+1))
+		if !code.Ok() {
+			return code
+		}
+		d.sums[i] = crc32.Checksum(data, castagnoli)
+	}
+	d.verified = true
+	d.dirty = true
+	return OK
+}
+
+// resize updates the checksums for a new size, as if the file were
+// cut or padded with zeros.  It must be called before the data
+// changes.
+func (d *checksumData) resize(f File, size uint64) Status {
+	if size == d.size {
+		return OK
+	}
+	bs := d.blockSize
+	count := d.blockCount(size)
+	// The block that straddles the smaller size keeps part of its
+	// data.
+	small := size
+	if d.size < small {
+		small = d.size
+	}
+	var kept []byte
+	if small%bs != 0 {
+		data, code := d.readBlocks(f, small/bs, small/bs+1)
+		if !code.Ok() {
+			return code
+		}
+		kept = data[:small%bs]
+	}
+
+	if len(d.sums) > count {
+		d.sums = d.sums[:count]
+	}
+	for uint64(len(d.sums)) < uint64(count) {
+		d.sums = append(d.sums, 0)
+	}
+	for i := small / bs; i < uint64(count); i++ {
+		n := bs
+		if rest := size - i*bs; rest < n {
+			n = rest
+		}
+		block := make([]byte, n)
+		if i == small/bs {
+			copy(block, kept)
+		}
+		d.sums[i] = crc32.Checksum(block, castagnoli)
+	}
+	d.size = size
+	d.dirty = true
+	return OK
+}
+
+func (d *checksumData) flush(context *Context) Status {
+	if !d.dirty {
+		return OK
+	}
+	// Do not leave checksums behind for a file that is gone.
+	if a, code := d.fs.inner.GetAttr(d.name, context); !code.Ok() || (d.ino != 0 && a.Ino != d.ino) {
+		d.dirty = false
+		return OK
+	}
+	buf := make([]byte, _CHECKSUM_HEADER_SIZE+4*len(d.sums))
+	copy(buf, _CHECKSUM_MAGIC)
+	binary.BigEndian.PutUint32(buf[4:], uint32(d.blockSize))
+	binary.BigEndian.PutUint64(buf[8:], d.size)
+	for i, s := range d.sums {
+		binary.BigEndian.PutUint32(buf[_CHECKSUM_HEADER_SIZE+4*i:], s)
+	}
+	if code := d.fs.writeSums(d.name, buf, context); !code.Ok() {
+		return code
+	}
+	d.dirty = false
+	return OK
+}
+
+// checksumFile is an open file of a ChecksumFileSystem.
+type checksumFile struct {
+	blockFile
+	data     *checksumData
+	writable bool
+}
+
+func (f *checksumFile) String() string {
+	return fmt.Sprintf("checksumFile(%s)", f.File.String())
+}
+
+func (f *checksumFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	end := input.Offset + uint64(input.Size)
+	if end > d.size {
+		end = d.size
+	}
+	if input.Offset >= end {
+		return nil, OK
+	}
+	first := input.Offset / d.blockSize
+	data, code := d.readBlocks(f.File, first, (end+d.blockSize-1)/d.blockSize)
+	if !code.Ok() {
+		return nil, code
+	}
+	start := input.Offset - first*d.blockSize
+	stop := end - first*d.blockSize
+	if stop > uint64(len(data)) {
+		stop = uint64(len(data))
+	}
+	if start >= stop {
+		return nil, OK
+	}
+	return data[start:stop], OK
+}
+
+func (f *checksumFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if code := d.adopt(f.File); !code.Ok() {
+		return 0, code
+	}
+	if input.Offset > d.size {
+		if code := d.resize(f.File, input.Offset); !code.Ok() {
+			return 0, code
+		}
+		// Fill the gap, so the blocks before the write read
+		// as they were summed.
+		if code := f.File.Truncate(input.Offset, nil); !code.Ok() {
+			return 0, code
+		}
+	}
+
+	bs := d.blockSize
+	end := input.Offset + uint64(len(data))
+	first := input.Offset / bs
+	last := (end + bs - 1) / bs
+	// The old contents of the blocks at either end.
+	old, code := d.readBlocks(f.File, first, last)
+	if !code.Ok() {
+		return 0, code
+	}
+	buf := make([]byte, last*bs-first*bs)
+	copy(buf, old)
+	copy(buf[input.Offset-first*bs:], data)
+	newSize := d.size
+	if end > newSize {
+		newSize = end
+	}
+	if max := newSize - first*bs; uint64(len(buf)) > max {
+		buf = buf[:max]
+	}
+
+	n, code := f.File.Write(input, data)
+	if !code.Ok() {
+		d.dirty = true
+		return n, code
+	}
+	for uint64(len(d.sums)) < last {
+		d.sums = append(d.sums, 0)
+	}
+	for i := first; i < last; i++ {
+		start := (i - first) * bs
+		stop := start + bs
+		if stop > uint64(len(buf)) {
+			stop = uint64(len(buf))
+		}
+		d.sums[i] = crc32.Checksum(buf[start:stop], castagnoli)
+	}
+	d.size = newSize
+	d.dirty = true
+	return n, code
+}
+
+func (f *checksumFile) Truncate(size uint64, context *Context) Status {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if size == 0 {
+		// Nothing needs to be read or verified.
+		d.sums, d.size, d.verified, d.dirty = nil, 0, true, true
+	} else {
+		if code := d.adopt(f.File); !code.Ok() {
+			return code
+		}
+		if code := d.resize(f.File, size); !code.Ok() {
+			return code
+		}
+	}
+	if code := f.File.Truncate(size, context); !code.Ok() {
+		return code
+	}
+	return d.flush(context)
+}
+
+func (f *checksumFile) GetAttr(out *Attr) Status {
+	code := f.File.GetAttr(out)
+	if code.Ok() {
+		f.data.lock.Lock()
+		out.Size = f.data.size
+		f.data.lock.Unlock()
+	}
+	return code
+}
+
+func (f *checksumFile) flush() Status {
+	if !f.writable {
+		return OK
+	}
+	f.data.lock.Lock()
+	defer f.data.lock.Unlock()
+	return f.data.flush(nil)
+}
+
+func (f *checksumFile) Release(input *ReleaseIn) {
+	if code := f.flush(); !code.Ok() {
+		log.Printf("ChecksumFileSystem: writing checksums of %q: %v", f.data.name, code)
+	}
+	f.data.fs.putData(f.data)
+	f.File.Release(input)
+}
+
+// scrub verifies all blocks of an open file.
+func (f *checksumFile) scrub() Status {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.verified {
+		return OK
+	}
+	if uint64(len(d.sums)) != uint64(d.blockCount(d.size)) {
+		d.report(uint64(len(d.sums)))
+		return EIO
+	}
+	for i := 0; i < len(d.sums); i += 64 {
+		if _, code := d.readBlocks(f.File, uint64(i), uint64(i+64)); !code.Ok() {
+			return code
+		}
+	}
+	return OK
+}
+
+// Verify reads all of the file name, and returns EIO if a block does
+// not match its checksum.  Files without checksums verify.
+func (fs *ChecksumFileSystem) Verify(name string, context *Context) Status {
+	if strings.HasPrefix(filepath.Base(name), _CHECKSUM_PREFIX) && fs.options.Store == CHECKSUM_SIDECAR {
+		return ENOENT
+	}
+	f, code := fs.Open(name, uint32(os.O_RDONLY), context)
+	if !code.Ok() {
+		return code
+	}
+	defer f.Release(&ReleaseIn{})
+	return f.(*checksumFile).scrub()
+}
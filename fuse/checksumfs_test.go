@@ -0,0 +1,143 @@
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	var events []*CorruptionEvent
+	fs := NewChecksumFileSystem(NewLoopbackFileSystem(dir), &ChecksumFsOptions{
+		BlockSize:    1024,
+		OnCorruption: func(e *CorruptionEvent) { events = append(events, e) },
+	})
+
+	var want []byte
+	f, code := fs.Create("file", uint32(os.O_WRONLY|os.O_CREATE), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	write := func(f File, off int, data []byte) {
+		if n, code := f.Write(&WriteIn{Offset: uint64(off)}, data); !code.Ok() || int(n) != len(data) {
+			t.Fatalf("Write: %d, %v", n, code)
+		}
+		if len(want) < off+len(data) {
+			want = append(want, make([]byte, off+len(data)-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	read := func(off, size int) ([]byte, Status) {
+		g, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+		defer g.Release(&ReleaseIn{})
+		return g.Read(&ReadIn{Offset: uint64(off), Size: uint32(size)}, NewBufferPool())
+	}
+	check := func(what string) {
+		data, code := read(0, len(want)+100)
+		if !code.Ok() || !bytes.Equal(data, want) {
+			t.Errorf("%s: read %d bytes, %v", what, len(data), code)
+		}
+		if code := fs.Verify("file", nil); !code.Ok() {
+			t.Errorf("%s: Verify: %v", what, code)
+		}
+	}
+
+	write(f, 0, bytes.Repeat([]byte("0123456789"), 500))
+	write(f, 1020, []byte("straddling a block"))
+	write(f, 8000, []byte("past the end"))
+	f.Release(&ReleaseIn{})
+	check("write")
+
+	for _, size := range []int{7000, 1500, 9000, 1024, 0, 10} {
+		if code := fs.Truncate("file", uint64(size), nil); !code.Ok() {
+			t.Fatalf("Truncate(%d): %v", size, code)
+		}
+		if size < len(want) {
+			want = want[:size]
+		} else {
+			want = append(want, make([]byte, size-len(want))...)
+		}
+		check("truncate")
+	}
+
+	// The sidecar cannot be seen.
+	if _, code := fs.GetAttr(sidecarName("file"), nil); code.Ok() {
+		t.Errorf("sidecar is visible")
+	}
+	stream, _ := fs.OpenDir("", nil)
+	for _, e := range stream {
+		if e.Name != "file" {
+			t.Errorf("listed %q", e.Name)
+		}
+	}
+
+	// Damage the second block behind the file system's back.
+	f, _ = fs.Open("file", uint32(os.O_WRONLY|os.O_TRUNC), nil)
+	want = nil
+	write(f, 0, bytes.Repeat([]byte("x"), 3000))
+	f.Release(&ReleaseIn{})
+	raw, err := os.OpenFile(filepath.Join(dir, "file"), os.O_WRONLY, 0)
+	CheckSuccess(err)
+	raw.WriteAt([]byte("y"), 1500)
+	raw.Close()
+
+	if data, code := read(0, 1024); !code.Ok() || !bytes.Equal(data, want[:1024]) {
+		t.Errorf("intact block: %v", code)
+	}
+	if _, code := read(1000, 100); code != EIO {
+		t.Errorf("corrupt block: got %v, want EIO", code)
+	}
+	if len(events) != 1 || events[0].Path != "file" || events[0].Block != 1 || events[0].Offset != 1024 {
+		t.Errorf("events: %v", events)
+	}
+	if code := fs.Verify("file", nil); code != EIO {
+		t.Errorf("Verify: %v", code)
+	}
+
+	// Checksums follow renames.
+	if code := fs.Rename("file", "moved", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if code := fs.Verify("moved", nil); code != EIO {
+		t.Errorf("Verify after rename: %v", code)
+	}
+	fs.Unlink("moved", nil)
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("left behind: %v", names[0].Name())
+	}
+}
+
+// Files that existed before get checksums when they are written.
+func TestChecksumFsAdopt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "old"), bytes.Repeat([]byte("a"), 5000), 0644))
+
+	fs := NewChecksumFileSystem(NewLoopbackFileSystem(dir), &ChecksumFsOptions{BlockSize: 1024})
+	if code := fs.Verify("old", nil); !code.Ok() {
+		t.Errorf("Verify without checksums: %v", code)
+	}
+	f, code := fs.Open("old", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	f.Write(&WriteIn{Offset: 4000}, []byte("b"))
+	f.Release(&ReleaseIn{})
+	if _, err := os.Stat(filepath.Join(dir, sidecarName("old"))); err != nil {
+		t.Errorf("no sidecar: %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "old"), bytes.Repeat([]byte("c"), 5000), 0644)
+	if code := fs.Verify("old", nil); code != EIO {
+		t.Errorf("Verify after change: %v", code)
+	}
+}
@@ -0,0 +1,134 @@
+package fuse
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// The types in this file carry the names and methods of their
+// counterparts in the upstream v2 fuse package.  They are used by
+// package fs, so node implementations written against the v2 API
+// compile against this tree by changing the import paths only.
+
+// AttrOut holds the attributes returned from Getattr and Setattr in
+// package fs.
+type AttrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Dummy         uint32
+	Attr
+}
+
+func (o *AttrOut) SetTimeout(dt time.Duration) {
+	splitDuration(dt, &o.AttrValid, &o.AttrValidNsec)
+}
+
+func (o *AttrOut) Timeout() time.Duration {
+	return time.Duration(1e9*int64(o.AttrValid) + int64(o.AttrValidNsec))
+}
+
+// EntryOut holds the attributes of a newly looked up or created node
+// in package fs.  NodeId and Generation are assigned by the
+// connector, and are ignored on return.
+type EntryOut struct {
+	NodeId         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr
+}
+
+func (o *EntryOut) SetEntryTimeout(dt time.Duration) {
+	splitDuration(dt, &o.EntryValid, &o.EntryValidNsec)
+}
+
+func (o *EntryOut) SetAttrTimeout(dt time.Duration) {
+	splitDuration(dt, &o.AttrValid, &o.AttrValidNsec)
+}
+
+func (o *EntryOut) EntryTimeout() time.Duration {
+	return time.Duration(1e9*int64(o.EntryValid) + int64(o.EntryValidNsec))
+}
+
+func (o *EntryOut) AttrTimeout() time.Duration {
+	return time.Duration(1e9*int64(o.AttrValid) + int64(o.AttrValidNsec))
+}
+
+// SetAttrIn describes a SETATTR request; the getters return false
+// for fields that are not to be changed.
+type SetAttrIn struct {
+	raw.SetAttrIn
+}
+
+func (in *SetAttrIn) GetFh() (uint64, bool) {
+	return in.Fh, in.Valid&raw.FATTR_FH != 0
+}
+
+func (in *SetAttrIn) GetMode() (uint32, bool) {
+	return in.Mode, in.Valid&raw.FATTR_MODE != 0
+}
+
+func (in *SetAttrIn) GetUID() (uint32, bool) {
+	return in.Uid, in.Valid&raw.FATTR_UID != 0
+}
+
+func (in *SetAttrIn) GetGID() (uint32, bool) {
+	return in.Gid, in.Valid&raw.FATTR_GID != 0
+}
+
+func (in *SetAttrIn) GetSize() (uint64, bool) {
+	return in.Size, in.Valid&raw.FATTR_SIZE != 0
+}
+
+// GetATime returns the access time to set, which is the current
+// time for FATTR_ATIME_NOW.
+func (in *SetAttrIn) GetATime() (time.Time, bool) {
+	if in.Valid&raw.FATTR_ATIME_NOW != 0 {
+		return time.Now(), true
+	}
+	return time.Unix(int64(in.Atime), int64(in.Atimensec)), in.Valid&raw.FATTR_ATIME != 0
+}
+
+// GetMTime returns the modification time to set, which is the
+// current time for FATTR_MTIME_NOW.
+func (in *SetAttrIn) GetMTime() (time.Time, bool) {
+	if in.Valid&raw.FATTR_MTIME_NOW != 0 {
+		return time.Now(), true
+	}
+	return time.Unix(int64(in.Mtime), int64(in.Mtimensec)), in.Valid&raw.FATTR_MTIME != 0
+}
+
+// ReadResult is the data returned from a read in package fs.
+type ReadResult interface {
+	// Bytes returns the data, using buf as storage if it needs
+	// to.
+	Bytes(buf []byte) ([]byte, Status)
+
+	// Size returns the number of bytes in the result.
+	Size() int
+
+	// Done is called after the result was sent to the kernel.
+	Done()
+}
+
+type readResultData []byte
+
+// ReadResultData returns a ReadResult for data that is already in
+// memory.
+func ReadResultData(b []byte) ReadResult {
+	return readResultData(b)
+}
+
+func (r readResultData) Bytes(buf []byte) ([]byte, Status) {
+	return r, OK
+}
+
+func (r readResultData) Size() int {
+	return len(r)
+}
+
+func (r readResultData) Done() {
+}
@@ -0,0 +1,509 @@
+package fuse
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"syscall"
+)
+
+// CompressFileSystem is a wrapper that stores the contents of regular
+// files compressed on the wrapped FileSystem, and shows them
+// uncompressed, with their uncompressed sizes.
+//
+// The data is cut in blocks of BlockSize bytes, which are deflated
+// (as in gzip) separately, so any part of a file can be read without
+// decompressing what comes before.  A stored file is a header, the
+// blocks, and an index with the position of each block.  Blocks of
+// zeros are not stored at all.
+//
+// The index is written when a file opened for writing is flushed,
+// ie. on each close(2) and fsync(2).  A block that grows when it is
+// rewritten is moved to the end of the file; the space it leaves is
+// reused only when the file is truncated.
+type CompressFileSystem struct {
+	blockFileSystem
+
+	options CompressFsOptions
+
+	// Open files by inode number, so all handles of a file share
+	// the index.
+	lock  sync.Mutex
+	files map[uint64]*compressedData
+}
+
+type CompressFsOptions struct {
+	// BlockSize is the size of the uncompressed blocks of new
+	// files.  Defaults to 64 kb.
+	BlockSize int
+
+	// Level is the compress/flate level.  Defaults to
+	// flate.DefaultCompression.
+	Level int
+}
+
+const (
+	_COMPRESS_MAGIC       = "GFZ\x01"
+	_COMPRESS_HEADER_SIZE = 32
+	_COMPRESS_ENTRY_SIZE  = 16
+
+	// The block is stored uncompressed, because deflating did not
+	// make it smaller.
+	_COMPRESS_RAW = 1
+)
+
+// NewCompressFileSystem wraps fs, which holds the compressed data.
+func NewCompressFileSystem(fs FileSystem, opts *CompressFsOptions) *CompressFileSystem {
+	c := &CompressFileSystem{
+		blockFileSystem: blockFileSystem{FileSystem: fs},
+		files:           map[uint64]*compressedData{},
+	}
+	c.wrapFile = c.newFile
+	if opts != nil {
+		c.options = *opts
+	}
+	if c.options.BlockSize <= 0 {
+		c.options.BlockSize = 64 << 10
+	}
+	if c.options.Level == 0 {
+		c.options.Level = flate.DefaultCompression
+	}
+	return c
+}
+
+func (fs *CompressFileSystem) String() string {
+	return fmt.Sprintf("CompressFileSystem(%s)", fs.FileSystem.String())
+}
+
+func (fs *CompressFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() || !a.IsRegular() {
+		return a, code
+	}
+
+	c := *a
+	fs.lock.Lock()
+	d := fs.files[a.Ino]
+	fs.lock.Unlock()
+	if d != nil && a.Ino != 0 {
+		d.lock.Lock()
+		loaded, size := d.loaded, d.size
+		d.lock.Unlock()
+		if loaded {
+			c.Size = size
+			return &c, OK
+		}
+	}
+	if a.Size == 0 {
+		return &c, OK
+	}
+
+	f, code := fs.FileSystem.Open(name, uint32(syscall.O_RDONLY), context)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer f.Release(&ReleaseIn{})
+	hdr, code := readCompressHeader(f)
+	if !code.Ok() {
+		return nil, code
+	}
+	c.Size = hdr.size
+	return &c, OK
+}
+
+func (fs *CompressFileSystem) newFile(name string, file File, flags uint32, context *Context) (File, Status) {
+	var a Attr
+	code := file.GetAttr(&a)
+	if !code.Ok() {
+		file.Release(&ReleaseIn{})
+		return nil, code
+	}
+
+	fs.lock.Lock()
+	d := fs.files[a.Ino]
+	if d == nil || a.Ino == 0 {
+		d = &compressedData{fs: fs, ino: a.Ino}
+		if a.Ino != 0 {
+			fs.files[a.Ino] = d
+		}
+	}
+	d.refs++
+	fs.lock.Unlock()
+
+	f := &compressFile{
+		data:     d,
+		writable: flags&syscall.O_ACCMODE != syscall.O_RDONLY,
+	}
+	f.blockFile = blockFile{File: file, flush: f.flush}
+	d.lock.Lock()
+	if !d.loaded {
+		code = d.load(file)
+	}
+	d.lock.Unlock()
+	if !code.Ok() {
+		f.Release(&ReleaseIn{})
+		return nil, code
+	}
+	return f, OK
+}
+
+func (fs *CompressFileSystem) putData(d *compressedData) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	d.refs--
+	if d.refs == 0 && fs.files[d.ino] == d {
+		delete(fs.files, d.ino)
+	}
+}
+
+type compressHeader struct {
+	blockSize  uint32
+	size       uint64
+	indexStart uint64
+	indexCount uint32
+}
+
+func readCompressHeader(f File) (hdr compressHeader, code Status) {
+	data, code := f.Read(&ReadIn{Size: _COMPRESS_HEADER_SIZE}, NewGcBufferPool())
+	if !code.Ok() {
+		return hdr, code
+	}
+	if len(data) != _COMPRESS_HEADER_SIZE || string(data[:4]) != _COMPRESS_MAGIC {
+		log.Printf("CompressFileSystem: bad header in %v", f)
+		return hdr, EIO
+	}
+	hdr.blockSize = binary.BigEndian.Uint32(data[4:])
+	hdr.size = binary.BigEndian.Uint64(data[8:])
+	hdr.indexStart = binary.BigEndian.Uint64(data[16:])
+	hdr.indexCount = binary.BigEndian.Uint32(data[24:])
+	if hdr.blockSize == 0 {
+		log.Printf("CompressFileSystem: bad block size in %v", f)
+		return hdr, EIO
+	}
+	return hdr, OK
+}
+
+// compressedBlock is an entry of the index.  Blocks with zero length
+// are holes.
+type compressedBlock struct {
+	start  uint64
+	length uint32
+	flags  uint32
+}
+
+// compressedData is the state of an open file, shared by its
+// handles.
+type compressedData struct {
+	fs   *CompressFileSystem
+	ino  uint64
+	refs int
+
+	lock      sync.Mutex
+	loaded    bool
+	blockSize uint64
+	size      uint64
+	blocks    []compressedBlock
+	// end is where the next moved block goes.
+	end uint64
+	// dirty is set if the index on disk is out of date.
+	dirty bool
+}
+
+func (d *compressedData) load(f File) Status {
+	var a Attr
+	if code := f.GetAttr(&a); !code.Ok() {
+		return code
+	}
+	if a.Size == 0 {
+		d.blockSize = uint64(d.fs.options.BlockSize)
+		d.end = _COMPRESS_HEADER_SIZE
+		d.loaded = true
+		return OK
+	}
+
+	hdr, code := readCompressHeader(f)
+	if !code.Ok() {
+		return code
+	}
+	index, code := f.Read(&ReadIn{
+		Offset: hdr.indexStart,
+		Size:   hdr.indexCount * _COMPRESS_ENTRY_SIZE,
+	}, NewGcBufferPool())
+	if !code.Ok() {
+		return code
+	}
+	if len(index) != int(hdr.indexCount)*_COMPRESS_ENTRY_SIZE {
+		log.Printf("CompressFileSystem: short index in %v", f)
+		return EIO
+	}
+
+	d.blockSize = uint64(hdr.blockSize)
+	d.size = hdr.size
+	d.end = hdr.indexStart
+	d.blocks = make([]compressedBlock, hdr.indexCount)
+	for i := range d.blocks {
+		e := index[i*_COMPRESS_ENTRY_SIZE:]
+		d.blocks[i] = compressedBlock{
+			start:  binary.BigEndian.Uint64(e),
+			length: binary.BigEndian.Uint32(e[8:]),
+			flags:  binary.BigEndian.Uint32(e[12:]),
+		}
+	}
+	d.loaded = true
+	return OK
+}
+
+// flush writes the index and the header.
+func (d *compressedData) flush(f File, context *Context) Status {
+	if !d.dirty {
+		return OK
+	}
+	buf := make([]byte, _COMPRESS_HEADER_SIZE, _COMPRESS_HEADER_SIZE+len(d.blocks)*_COMPRESS_ENTRY_SIZE)
+	copy(buf, _COMPRESS_MAGIC)
+	binary.BigEndian.PutUint32(buf[4:], uint32(d.blockSize))
+	binary.BigEndian.PutUint64(buf[8:], d.size)
+	binary.BigEndian.PutUint64(buf[16:], d.end)
+	binary.BigEndian.PutUint32(buf[24:], uint32(len(d.blocks)))
+
+	entry := make([]byte, _COMPRESS_ENTRY_SIZE)
+	for _, b := range d.blocks {
+		binary.BigEndian.PutUint64(entry, b.start)
+		binary.BigEndian.PutUint32(entry[8:], b.length)
+		binary.BigEndian.PutUint32(entry[12:], b.flags)
+		buf = append(buf, entry...)
+	}
+
+	if code := writeFull(f, d.end, buf[_COMPRESS_HEADER_SIZE:]); !code.Ok() {
+		return code
+	}
+	if code := f.Truncate(d.end+uint64(len(buf)-_COMPRESS_HEADER_SIZE), context); !code.Ok() {
+		return code
+	}
+	if code := writeFull(f, 0, buf[:_COMPRESS_HEADER_SIZE]); !code.Ok() {
+		return code
+	}
+	d.dirty = false
+	return OK
+}
+
+func writeFull(f File, off uint64, data []byte) Status {
+	n, code := f.Write(&WriteIn{Offset: off}, data)
+	if code.Ok() && int(n) != len(data) {
+		code = EIO
+	}
+	return code
+}
+
+// blockLen returns the length of block i of the file.
+func (d *compressedData) blockLen(i uint64) uint64 {
+	l := d.size - i*d.blockSize
+	if l > d.blockSize {
+		l = d.blockSize
+	}
+	return l
+}
+
+// readBlock returns the contents of block i, which must exist.
+func (d *compressedData) readBlock(f File, i uint64) ([]byte, Status) {
+	b := d.blocks[i]
+	plain := make([]byte, d.blockLen(i))
+	if b.length == 0 {
+		return plain, OK
+	}
+
+	stored, code := f.Read(&ReadIn{Offset: b.start, Size: b.length}, NewGcBufferPool())
+	if !code.Ok() {
+		return nil, code
+	}
+	if len(stored) != int(b.length) {
+		log.Printf("CompressFileSystem: short block %d in %v", i, f)
+		return nil, EIO
+	}
+	if b.flags&_COMPRESS_RAW != 0 {
+		copy(plain, stored)
+		return plain, OK
+	}
+
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(stored)))
+	if err != nil {
+		log.Printf("CompressFileSystem: block %d in %v: %v", i, f, err)
+		return nil, EIO
+	}
+	copy(plain, data)
+	return plain, OK
+}
+
+// writeBlock stores plain as block i.
+func (d *compressedData) writeBlock(f File, i uint64, plain []byte) Status {
+	for uint64(len(d.blocks)) <= i {
+		d.blocks = append(d.blocks, compressedBlock{})
+	}
+	d.dirty = true
+
+	old := d.blocks[i]
+	if isZero(plain) {
+		d.blocks[i] = compressedBlock{}
+		return OK
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, d.fs.options.Level)
+	if err != nil {
+		return ToStatus(err)
+	}
+	w.Write(plain)
+	w.Close()
+
+	stored, flags := buf.Bytes(), uint32(0)
+	if len(stored) >= len(plain) {
+		stored, flags = plain, _COMPRESS_RAW
+	}
+	b := compressedBlock{old.start, uint32(len(stored)), flags}
+	if b.length > old.length {
+		b.start = d.end
+		d.end += uint64(b.length)
+	}
+	if code := writeFull(f, b.start, stored); !code.Ok() {
+		return code
+	}
+	d.blocks[i] = b
+	return OK
+}
+
+// compressFile is an open file of a CompressFileSystem.
+type compressFile struct {
+	blockFile
+	data     *compressedData
+	writable bool
+}
+
+func (f *compressFile) String() string {
+	return fmt.Sprintf("compressFile(%s)", f.File.String())
+}
+
+func (f *compressFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	end := input.Offset + uint64(input.Size)
+	if end > d.size {
+		end = d.size
+	}
+	if input.Offset >= end {
+		return nil, OK
+	}
+	out := bp.AllocBuffer(uint32(end - input.Offset))
+	for off := input.Offset; off < end; {
+		i := off / d.blockSize
+		plain, code := d.readBlock(f.File, i)
+		if !code.Ok() {
+			bp.FreeBuffer(out)
+			return nil, code
+		}
+		off += uint64(copy(out[off-input.Offset:], plain[off-i*d.blockSize:]))
+	}
+	return out, OK
+}
+
+func (f *compressFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	end := input.Offset + uint64(len(data))
+	for off := input.Offset; off < end; {
+		i := off / d.blockSize
+		start := i * d.blockSize
+		var plain []byte
+		if start < d.size {
+			var code Status
+			if plain, code = d.readBlock(f.File, i); !code.Ok() {
+				return uint32(off - input.Offset), code
+			}
+		}
+		blockEnd := start + d.blockSize
+		if blockEnd > end {
+			blockEnd = end
+		}
+		if need := int(blockEnd - start); len(plain) < need {
+			plain = append(plain, make([]byte, need-len(plain))...)
+		}
+		copy(plain[off-start:], data[off-input.Offset:])
+
+		if code := d.writeBlock(f.File, i, plain); !code.Ok() {
+			return uint32(off - input.Offset), code
+		}
+		off = blockEnd
+		if off > d.size {
+			d.size = off
+		}
+	}
+	return uint32(len(data)), OK
+}
+
+func (f *compressFile) Truncate(size uint64, context *Context) Status {
+	d := f.data
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if size == d.size {
+		return OK
+	}
+	d.dirty = true
+	count := (size + d.blockSize - 1) / d.blockSize
+	if size == 0 {
+		d.blocks = nil
+		d.end = _COMPRESS_HEADER_SIZE
+		d.blockSize = uint64(d.fs.options.BlockSize)
+	} else if size < d.size {
+		d.blocks = d.blocks[:count]
+		if rem := size % d.blockSize; rem != 0 {
+			// The cut off end of the last block must read
+			// as zeros if the file grows again.
+			plain, code := d.readBlock(f.File, count-1)
+			if !code.Ok() {
+				return code
+			}
+			if code := d.writeBlock(f.File, count-1, plain[:rem]); !code.Ok() {
+				return code
+			}
+		}
+	}
+	for uint64(len(d.blocks)) < count {
+		d.blocks = append(d.blocks, compressedBlock{})
+	}
+	d.size = size
+	return d.flush(f.File, context)
+}
+
+func (f *compressFile) GetAttr(out *Attr) Status {
+	code := f.File.GetAttr(out)
+	if code.Ok() {
+		f.data.lock.Lock()
+		out.Size = f.data.size
+		f.data.lock.Unlock()
+	}
+	return code
+}
+
+func (f *compressFile) flush() Status {
+	if !f.writable {
+		return OK
+	}
+	f.data.lock.Lock()
+	defer f.data.lock.Unlock()
+	return f.data.flush(f.File, nil)
+}
+
+func (f *compressFile) Release(input *ReleaseIn) {
+	if code := f.flush(); !code.Ok() {
+		log.Printf("CompressFileSystem: writing index of %v: %v", f.File, code)
+	}
+	f.data.fs.putData(f.data)
+	f.File.Release(input)
+}
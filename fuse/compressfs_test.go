@@ -0,0 +1,78 @@
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	fs := NewCompressFileSystem(NewLoopbackFileSystem(dir), &CompressFsOptions{BlockSize: 1024})
+
+	want := bytes.Repeat([]byte("compressible "), 1000)
+	f, code := fs.Create("file", uint32(os.O_WRONLY|os.O_CREATE), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	write := func(f File, off int, data []byte) {
+		if n, code := f.Write(&WriteIn{Offset: uint64(off)}, data); !code.Ok() || int(n) != len(data) {
+			t.Fatalf("Write: %d, %v", n, code)
+		}
+		if len(want) < off+len(data) {
+			want = append(want, make([]byte, off+len(data)-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	check := func(what string) {
+		a, code := fs.GetAttr("file", nil)
+		if !code.Ok() || a.Size != uint64(len(want)) {
+			t.Errorf("%s: GetAttr: %v, size %d, want %d", what, code, a.Size, len(want))
+		}
+		g, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			t.Fatalf("%s: Open: %v", what, code)
+		}
+		defer g.Release(&ReleaseIn{})
+		data, code := g.Read(&ReadIn{Size: uint32(len(want)) + 100}, NewBufferPool())
+		if !code.Ok() || !bytes.Equal(data, want) {
+			t.Errorf("%s: read %d bytes, %v", what, len(data), code)
+		}
+		if len(want) < 1100 {
+			return
+		}
+		data, code = g.Read(&ReadIn{Offset: 1000, Size: 100}, NewBufferPool())
+		if !code.Ok() || !bytes.Equal(data, want[1000:1100]) {
+			t.Errorf("%s: read at 1000: %q, %v", what, data, code)
+		}
+	}
+
+	write(f, 0, want)
+	check("write")
+	write(f, 1020, []byte("random data straddling a block"))
+	write(f, 20000, []byte("past the end"))
+	check("overwrite")
+	f.Release(&ReleaseIn{})
+	check("reopen")
+
+	var st os.FileInfo
+	if st, err = os.Stat(filepath.Join(dir, "file")); err != nil || st.Size() >= int64(len(want)/4) {
+		t.Errorf("stored size %d for %d bytes", st.Size(), len(want))
+	}
+
+	for _, size := range []int{15000, 1500, 30000, 1024, 0, 10} {
+		if code := fs.Truncate("file", uint64(size), nil); !code.Ok() {
+			t.Fatalf("Truncate(%d): %v", size, code)
+		}
+		if size < len(want) {
+			want = want[:size]
+		} else {
+			want = append(want, make([]byte, size-len(want))...)
+		}
+		check("truncate")
+	}
+}
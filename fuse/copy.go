@@ -2,36 +2,95 @@ package fuse
 
 import (
 	"os"
+	"syscall"
 )
 
+const copyBlockSize = 128 * (1 << 10)
+
+// CopyFile copies srcFile of srcFs to destFile of destFs.  If the
+// destination can clone the source, they share their storage;
+// otherwise if both are SparseFiles, holes are not filled in.
 func CopyFile(srcFs, destFs FileSystem, srcFile, destFile string, context *Context) Status {
 	src, code := srcFs.Open(srcFile, uint32(os.O_RDONLY), context)
 	if !code.Ok() {
 		return code
 	}
-	defer src.Release()
-	defer src.Flush()
+	defer src.Release(&ReleaseIn{})
+	defer src.Flush(&FlushIn{})
 
 	attr, code := srcFs.GetAttr(srcFile, context)
 	if !code.Ok() {
 		return code
 	}
 
-	w := WriteIn{
-		Flags: uint32(os.O_WRONLY | os.O_CREATE | os.O_TRUNC),
-	}
-	dst, code := destFs.Create(destFile, w.Flags, attr.Mode, context)
+	flags := uint32(os.O_WRONLY | os.O_CREATE | os.O_TRUNC)
+	dst, code := destFs.Create(destFile, flags, attr.Mode, context)
 	if !code.Ok() {
 		return code
 	}
-	defer dst.Release()
-	defer dst.Flush()
+	defer dst.Release(&ReleaseIn{})
+	defer dst.Flush(&FlushIn{})
+
+	if c, ok := withoutFlags(dst).(CloneFile); ok {
+		if c.CloneFrom(withoutFlags(src)).Ok() {
+			return OK
+		}
+	}
 
 	bp := NewBufferPool()
-	r := ReadIn{
-		Size: 128 * (1 << 10),
+	s, srcSparse := withoutFlags(src).(SparseFile)
+	_, dstSparse := withoutFlags(dst).(SparseFile)
+	if !srcSparse || !dstSparse {
+		return copyRange(src, dst, 0, 0, bp)
 	}
+
+	off := uint64(0)
 	for {
+		start, end, code := s.NextData(off)
+		if code == Status(syscall.ENXIO) {
+			break
+		}
+		if !code.Ok() {
+			// Eg. a file system without SEEK_DATA.
+			return copyRange(src, dst, off, 0, bp)
+		}
+		if code := copyRange(src, dst, start, end, bp); !code.Ok() {
+			return code
+		}
+		off = end
+	}
+	if off < attr.Size {
+		return dst.Truncate(attr.Size, context)
+	}
+	return OK
+}
+
+// withoutFlags returns the file below the wrappers that only do
+// bookkeeping, WithFlags and sillyFile, so its optional interfaces
+// such as FdFile can be used.
+func withoutFlags(f File) File {
+	for {
+		switch w := f.(type) {
+		case *WithFlags:
+			f = w.File
+		case *sillyFile:
+			f = w.File
+		default:
+			return f
+		}
+	}
+}
+
+// copyRange copies [start, end) of src to dst.  If end is 0, it
+// copies up to the end of src.
+func copyRange(src, dst File, start, end uint64, bp BufferPool) Status {
+	r := ReadIn{Offset: start}
+	w := WriteIn{Offset: start}
+	for end == 0 || r.Offset < end {
+		r.Size = copyBlockSize
+		if end > 0 && end-r.Offset < copyBlockSize {
+			r.Size = uint32(end - r.Offset)
+		}
 		data, code := src.Read(&r, bp)
 		if !code.Ok() {
 			return code
@@ -3,6 +3,7 @@ package fuse
 import (
 	"io/ioutil"
 	"os"
+	"syscall"
 	"testing"
 )
 
@@ -49,3 +50,31 @@ func TestCopyFile(t *testing.T) {
 	}
 
 }
+
+func TestCopyFileSparse(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(d)
+
+	f, err := os.Create(d + "/src")
+	CheckSuccess(err)
+	_, err = f.WriteAt([]byte("data"), 1<<20)
+	CheckSuccess(err)
+	CheckSuccess(f.Truncate(4 << 20))
+	f.Close()
+
+	fs := NewLoopbackFileSystem(d)
+	if code := CopyFile(fs, fs, "src", "dst", nil); !code.Ok() {
+		t.Fatal("CopyFile:", code)
+	}
+	data, err := ioutil.ReadFile(d + "/dst")
+	CheckSuccess(err)
+	if len(data) != 4<<20 || string(data[1<<20:1<<20+4]) != "data" {
+		t.Fatalf("copy has %d bytes", len(data))
+	}
+	var st syscall.Stat_t
+	CheckSuccess(syscall.Stat(d+"/dst", &st))
+	if st.Blocks*512 >= 1<<20 {
+		t.Errorf("holes were filled: %d blocks", st.Blocks)
+	}
+}
@@ -0,0 +1,68 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestCopyFileRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "src"), []byte("0123456789"), 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "dst"), []byte("abcdefghij"), 0644))
+
+	conn := NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(dir), nil), nil)
+	open := func(name string, flags int) (nodeId uint64, fh uint64) {
+		var entry raw.EntryOut
+		if code := conn.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, name); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		var out raw.OpenOut
+		if code := conn.Open(&out, &raw.InHeader{NodeId: entry.NodeId}, &raw.OpenIn{Flags: uint32(flags)}); !code.Ok() {
+			t.Fatalf("Open(%q): %v", name, code)
+		}
+		return entry.NodeId, out.Fh
+	}
+	srcId, srcFh := open("src", os.O_RDONLY)
+	dstId, dstFh := open("dst", os.O_WRONLY)
+	defer conn.Release(&raw.InHeader{NodeId: srcId}, &raw.ReleaseIn{Fh: srcFh})
+	defer conn.Release(&raw.InHeader{NodeId: dstId}, &raw.ReleaseIn{Fh: dstFh})
+
+	copyRange := func(offIn, offOut, size uint64) uint32 {
+		n, code := conn.CopyFileRange(&raw.InHeader{NodeId: srcId}, &raw.CopyFileRangeIn{
+			FhIn:      srcFh,
+			OffIn:     offIn,
+			NodeIdOut: dstId,
+			FhOut:     dstFh,
+			OffOut:    offOut,
+			Len:       size,
+		})
+		if !code.Ok() {
+			t.Fatalf("CopyFileRange: %v", code)
+		}
+		return n
+	}
+
+	if n := copyRange(2, 3, 4); n != 4 {
+		t.Errorf("copied %d bytes, want 4", n)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "dst")); string(data) != "abc2345hij" {
+		t.Errorf("got %q", data)
+	}
+
+	// Copies stop at the end of the source.
+	if n := copyRange(6, 8, 1<<20); n != 4 {
+		t.Errorf("copied %d bytes, want 4", n)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "dst")); string(data) != "abc2345h6789" {
+		t.Errorf("got %q", data)
+	}
+	if n := copyRange(10, 0, 10); n != 0 {
+		t.Errorf("copied %d bytes past the end", n)
+	}
+}
@@ -0,0 +1,557 @@
+package fuse
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// CryptFileSystem is a wrapper that encrypts the contents of files,
+// and optionally the names of all entries, before they reach the
+// wrapped FileSystem.  It works like gocryptfs: the wrapped file
+// system only sees ciphertext, and can be stored or synced anywhere.
+//
+// Each regular file starts with a header holding a random file ID,
+// from which the key for the file is derived.  The data follows in
+// blocks of BlockSize bytes, each sealed with AES-GCM under a random
+// nonce, with the block number as additional data so blocks cannot
+// be reordered.  Since nothing depends on the path, hard links and
+// renames are left to the wrapped file system and the PathNodeFs.
+//
+// Blocks of zeros are read as holes, so sparse files stay sparse.
+// WARNING: holes are not authenticated.  Whoever controls the wrapped
+// file system can zero any whole block of ciphertext, and it reads
+// back as zeros instead of failing, so only use CryptFileSystem where
+// that is acceptable.  Truncation and appends past the end are not
+// detected either.
+//
+// File sizes, the directory structure, modes, times and extended
+// attributes are not hidden.
+type CryptFileSystem struct {
+	blockFileSystem
+
+	options CryptFsOptions
+
+	contentKey []byte
+	names      cipher.AEAD
+	nameKey    []byte
+}
+
+type CryptFsOptions struct {
+	// BlockSize is the size of the plaintext blocks.  It must be
+	// the same each time the data is mounted.  Defaults to 4096.
+	BlockSize int
+
+	// If set, each name in a path, and the targets of symlinks,
+	// are encrypted too.  The same name encrypts the same way in
+	// every directory, so equal names can be told apart.  Names
+	// are limited to 163 bytes.
+	EncryptNames bool
+}
+
+const (
+	_CRYPT_VERSION     = 1
+	_CRYPT_ID_SIZE     = 16
+	_CRYPT_HEADER_SIZE = 2 + _CRYPT_ID_SIZE
+	_CRYPT_NONCE_SIZE  = 12
+	_CRYPT_TAG_SIZE    = 16
+	_CRYPT_OVERHEAD    = _CRYPT_NONCE_SIZE + _CRYPT_TAG_SIZE
+
+	// The longest encoded name most file systems accept.
+	_CRYPT_MAX_NAME = 255
+)
+
+// NewCryptFileSystem wraps fs, which holds the encrypted data.  The
+// key must be 32 bytes long.
+func NewCryptFileSystem(fs FileSystem, key []byte, opts *CryptFsOptions) (*CryptFileSystem, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("CryptFileSystem: key has %d bytes, want 32", len(key))
+	}
+	if opts == nil {
+		opts = &CryptFsOptions{}
+	}
+	c := &CryptFileSystem{
+		options:    *opts,
+		contentKey: deriveKey(key, "content"),
+		nameKey:    deriveKey(key, "names"),
+	}
+	if c.options.BlockSize <= 0 {
+		c.options.BlockSize = 4096
+	}
+
+	var err error
+	if c.names, err = newGCM(c.nameKey); err != nil {
+		return nil, err
+	}
+	c.FileSystem = fs
+	c.wrapFile = c.newFile
+	if c.options.EncryptNames {
+		c.FileSystem = &rewriteFileSystem{fs, c.encryptPath}
+	}
+	return c, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (fs *CryptFileSystem) String() string {
+	return fmt.Sprintf("CryptFileSystem(%s)", fs.FileSystem.String())
+}
+
+// encryptName encrypts a single name.  The nonce is derived from the
+// name, so lookups find the same ciphertext each time.
+func (fs *CryptFileSystem) encryptName(name string) (string, Status) {
+	h := hmac.New(sha256.New, fs.nameKey)
+	h.Write([]byte(name))
+	nonce := h.Sum(nil)[:_CRYPT_NONCE_SIZE]
+
+	sealed := fs.names.Seal(nonce, nonce, []byte(name), nil)
+	enc := base64.RawURLEncoding.EncodeToString(sealed)
+	if len(enc) > _CRYPT_MAX_NAME {
+		return "", Status(syscall.ENAMETOOLONG)
+	}
+	return enc, OK
+}
+
+func (fs *CryptFileSystem) decryptName(enc string) (string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(data) < _CRYPT_OVERHEAD {
+		return "", false
+	}
+	name, err := fs.names.Open(nil, data[:_CRYPT_NONCE_SIZE], data[_CRYPT_NONCE_SIZE:], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(name), true
+}
+
+// encryptPath is the PathRewriter for encrypted names.
+func (fs *CryptFileSystem) encryptPath(name string) (string, Status) {
+	if name == "" {
+		return "", OK
+	}
+	comps := strings.Split(name, "/")
+	for i, c := range comps {
+		enc, code := fs.encryptName(c)
+		if !code.Ok() {
+			return "", code
+		}
+		comps[i] = enc
+	}
+	return strings.Join(comps, "/"), OK
+}
+
+func (fs *CryptFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, code Status) {
+	stream, code = fs.FileSystem.OpenDir(name, context)
+	if !code.Ok() || !fs.options.EncryptNames {
+		return stream, code
+	}
+	result := stream[:0]
+	for _, e := range stream {
+		// Entries that were not put there by us are
+		// left out.
+		if plain, ok := fs.decryptName(e.Name); ok {
+			e.Name = plain
+			result = append(result, e)
+		}
+	}
+	return result, OK
+}
+
+func (fs *CryptFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, code Status) {
+	if fs.options.EncryptNames {
+		return nil, ENOSYS
+	}
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *CryptFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	if fs.options.EncryptNames {
+		nonce := make([]byte, _CRYPT_NONCE_SIZE)
+		if _, err := rand.Read(nonce); err != nil {
+			return ToStatus(err)
+		}
+		value = base64.RawURLEncoding.EncodeToString(fs.names.Seal(nonce, nonce, []byte(value), nil))
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *CryptFileSystem) Readlink(name string, context *Context) (string, Status) {
+	value, code := fs.FileSystem.Readlink(name, context)
+	if !code.Ok() || !fs.options.EncryptNames {
+		return value, code
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil && len(data) >= _CRYPT_OVERHEAD {
+		var plain []byte
+		plain, err = fs.names.Open(nil, data[:_CRYPT_NONCE_SIZE], data[_CRYPT_NONCE_SIZE:], nil)
+		if err == nil {
+			return string(plain), OK
+		}
+	}
+	log.Printf("CryptFileSystem: cannot decrypt link %q", name)
+	return "", EIO
+}
+
+func (fs *CryptFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() {
+		return a, code
+	}
+	switch {
+	case a.IsRegular():
+		c := *a
+		a = &c
+		a.Size = fs.plainSize(a.Size)
+	case a.IsSymlink() && fs.options.EncryptNames:
+		value, code := fs.Readlink(name, context)
+		if !code.Ok() {
+			return nil, code
+		}
+		c := *a
+		a = &c
+		a.Size = uint64(len(value))
+	}
+	return a, OK
+}
+
+func (fs *CryptFileSystem) newFile(name string, file File, flags uint32, context *Context) (File, Status) {
+	return &cryptFile{blockFile: blockFile{File: file}, fs: fs}, OK
+}
+
+func (fs *CryptFileSystem) cipherBlockSize() uint64 {
+	return uint64(fs.options.BlockSize) + _CRYPT_OVERHEAD
+}
+
+// plainSize returns the size of the plaintext stored in size bytes
+// of ciphertext.
+func (fs *CryptFileSystem) plainSize(size uint64) uint64 {
+	if size <= _CRYPT_HEADER_SIZE {
+		return 0
+	}
+	size -= _CRYPT_HEADER_SIZE
+	cbs := fs.cipherBlockSize()
+	plain := size / cbs * uint64(fs.options.BlockSize)
+	if rem := size % cbs; rem > _CRYPT_OVERHEAD {
+		plain += rem - _CRYPT_OVERHEAD
+	}
+	return plain
+}
+
+// cipherSize is the inverse of plainSize, for files with a header.
+func (fs *CryptFileSystem) cipherSize(size uint64) uint64 {
+	bs := uint64(fs.options.BlockSize)
+	c := _CRYPT_HEADER_SIZE + size/bs*fs.cipherBlockSize()
+	if rem := size % bs; rem > 0 {
+		c += rem + _CRYPT_OVERHEAD
+	}
+	return c
+}
+
+// cryptFile is an open file of a CryptFileSystem.  The kernel
+// serializes writes and truncation of a file, but the lock keeps
+// users of the same handle from racing on the blocks they share.
+type cryptFile struct {
+	blockFile
+	fs *CryptFileSystem
+
+	lock sync.Mutex
+	// The cipher for the file, once it has a header.
+	aead cipher.AEAD
+}
+
+func (f *cryptFile) String() string {
+	return fmt.Sprintf("cryptFile(%s)", f.File.String())
+}
+
+// header sets up the cipher from the header of the file.  If the
+// file is empty, it is given a header if create is set; otherwise
+// f.aead stays nil.  Once written, the header does not change, even
+// if the file is truncated.
+func (f *cryptFile) header(create bool) Status {
+	if f.aead != nil {
+		return OK
+	}
+	hdr, code := f.File.Read(&ReadIn{Size: _CRYPT_HEADER_SIZE}, NewGcBufferPool())
+	if !code.Ok() {
+		return code
+	}
+	switch {
+	case len(hdr) == 0 && !create:
+		return OK
+	case len(hdr) == 0:
+		hdr = make([]byte, _CRYPT_HEADER_SIZE)
+		binary.BigEndian.PutUint16(hdr, _CRYPT_VERSION)
+		if _, err := rand.Read(hdr[2:]); err != nil {
+			return ToStatus(err)
+		}
+		if n, code := f.File.Write(&WriteIn{}, hdr); !code.Ok() {
+			return code
+		} else if n != _CRYPT_HEADER_SIZE {
+			return EIO
+		}
+	case len(hdr) != _CRYPT_HEADER_SIZE || binary.BigEndian.Uint16(hdr) != _CRYPT_VERSION:
+		log.Printf("CryptFileSystem: bad header in %v", f.File)
+		return EIO
+	}
+
+	aead, err := newGCM(deriveKey(f.fs.contentKey, string(hdr[2:])))
+	if err != nil {
+		return ToStatus(err)
+	}
+	f.aead = aead
+	return OK
+}
+
+func (f *cryptFile) size() (uint64, Status) {
+	var a Attr
+	if code := f.File.GetAttr(&a); !code.Ok() {
+		return 0, code
+	}
+	return f.fs.plainSize(a.Size), OK
+}
+
+func (f *cryptFile) additionalData(n uint64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, n)
+	return ad
+}
+
+// readBlocks returns the plaintext of count blocks starting at
+// block first.  It is shorter if the file ends before.
+func (f *cryptFile) readBlocks(first uint64, count uint64) ([]byte, Status) {
+	cbs := f.fs.cipherBlockSize()
+	bp := NewGcBufferPool()
+	data, code := f.File.Read(&ReadIn{
+		Offset: _CRYPT_HEADER_SIZE + first*cbs,
+		Size:   uint32(count * cbs),
+	}, bp)
+	if !code.Ok() {
+		return nil, code
+	}
+
+	plain := make([]byte, 0, count*uint64(f.fs.options.BlockSize))
+	for i := uint64(0); len(data) > 0; i++ {
+		block := data
+		if uint64(len(block)) > cbs {
+			block = block[:cbs]
+		}
+		data = data[len(block):]
+		if len(block) <= _CRYPT_OVERHEAD {
+			log.Printf("CryptFileSystem: short block %d in %v", first+i, f.File)
+			return nil, EIO
+		}
+		if isZero(block) {
+			plain = append(plain, make([]byte, len(block)-_CRYPT_OVERHEAD)...)
+			continue
+		}
+		var err error
+		plain, err = f.aead.Open(plain, block[:_CRYPT_NONCE_SIZE], block[_CRYPT_NONCE_SIZE:], f.additionalData(first+i))
+		if err != nil {
+			log.Printf("CryptFileSystem: block %d of %v: %v", first+i, f.File, err)
+			return nil, EIO
+		}
+	}
+	return plain, OK
+}
+
+func isZero(data []byte) bool {
+	return bytes.Count(data, []byte{0}) == len(data)
+}
+
+// writeBlocks encrypts plain, and writes it as the blocks starting at
+// block first.
+func (f *cryptFile) writeBlocks(first uint64, plain []byte) Status {
+	bs := f.fs.options.BlockSize
+	out := make([]byte, 0, uint64(len(plain)/bs+1)*f.fs.cipherBlockSize())
+	for i := uint64(0); len(plain) > 0; i++ {
+		block := plain
+		if len(block) > bs {
+			block = block[:bs]
+		}
+		plain = plain[len(block):]
+
+		start := len(out)
+		out = append(out, make([]byte, _CRYPT_NONCE_SIZE)...)
+		if _, err := rand.Read(out[start:]); err != nil {
+			return ToStatus(err)
+		}
+		out = f.aead.Seal(out, out[start:], block, f.additionalData(first+i))
+	}
+
+	n, code := f.File.Write(&WriteIn{Offset: _CRYPT_HEADER_SIZE + first*f.fs.cipherBlockSize()}, out)
+	if code.Ok() && int(n) != len(out) {
+		code = EIO
+	}
+	return code
+}
+
+// padBlock grows the last block of a file of the given size to at
+// most want bytes, if it is not full.
+func (f *cryptFile) padBlock(size uint64, want int) Status {
+	bs := uint64(f.fs.options.BlockSize)
+	if size%bs == 0 {
+		return OK
+	}
+	last := size / bs
+	plain, code := f.readBlocks(last, 1)
+	if !code.Ok() {
+		return code
+	}
+	if len(plain) < want {
+		plain = append(plain, make([]byte, want-len(plain))...)
+	}
+	return f.writeBlocks(last, plain)
+}
+
+func (f *cryptFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if code := f.header(false); !code.Ok() || f.aead == nil || input.Size == 0 {
+		return nil, code
+	}
+	bs := uint64(f.fs.options.BlockSize)
+	first := input.Offset / bs
+	last := (input.Offset + uint64(input.Size) - 1) / bs
+	plain, code := f.readBlocks(first, last-first+1)
+	if !code.Ok() {
+		return nil, code
+	}
+
+	skip := input.Offset - first*bs
+	if skip >= uint64(len(plain)) {
+		return nil, OK
+	}
+	plain = plain[skip:]
+	if len(plain) > int(input.Size) {
+		plain = plain[:input.Size]
+	}
+	out := bp.AllocBuffer(uint32(len(plain)))
+	copy(out, plain)
+	return out, OK
+}
+
+func (f *cryptFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(data) == 0 {
+		return 0, OK
+	}
+	if code := f.header(true); !code.Ok() {
+		return 0, code
+	}
+	size, code := f.size()
+	if !code.Ok() {
+		return 0, code
+	}
+
+	bs := uint64(f.fs.options.BlockSize)
+	off := input.Offset
+	end := off + uint64(len(data))
+	first := off / bs
+	last := (end - 1) / bs
+	if size < first*bs {
+		// Complete the old last block; the blocks in between
+		// are holes.
+		if code := f.padBlock(size, int(bs)); !code.Ok() {
+			return 0, code
+		}
+	}
+
+	// Merge the data with the parts of the first and last block
+	// that it does not cover.
+	buf := make([]byte, end-first*bs)
+	if off > first*bs && first*bs < size {
+		old, code := f.readBlocks(first, 1)
+		if !code.Ok() {
+			return 0, code
+		}
+		copy(buf, old)
+	}
+	if end%bs != 0 && end < size {
+		old, code := f.readBlocks(last, 1)
+		if !code.Ok() {
+			return 0, code
+		}
+		if tail := end - last*bs; uint64(len(old)) > tail {
+			buf = append(buf, old[tail:]...)
+		}
+	}
+	copy(buf[off-first*bs:], data)
+
+	if code := f.writeBlocks(first, buf); !code.Ok() {
+		return 0, code
+	}
+	return uint32(len(data)), OK
+}
+
+func (f *cryptFile) Truncate(size uint64, context *Context) Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if code := f.header(size > 0); !code.Ok() {
+		return code
+	}
+	if f.aead == nil {
+		// Still empty.
+		return OK
+	}
+	cur, code := f.size()
+	if !code.Ok() {
+		return code
+	}
+
+	bs := uint64(f.fs.options.BlockSize)
+	switch {
+	case size > cur:
+		want := int(bs)
+		if size/bs == cur/bs {
+			want = int(size % bs)
+		}
+		if code := f.padBlock(cur, want); !code.Ok() {
+			return code
+		}
+	case size < cur && size%bs != 0:
+		last := size / bs
+		plain, code := f.readBlocks(last, 1)
+		if !code.Ok() {
+			return code
+		}
+		if code := f.File.Truncate(_CRYPT_HEADER_SIZE+last*f.fs.cipherBlockSize(), context); !code.Ok() {
+			return code
+		}
+		return f.writeBlocks(last, plain[:size%bs])
+	}
+	return f.File.Truncate(f.fs.cipherSize(size), context)
+}
+
+func (f *cryptFile) GetAttr(out *Attr) Status {
+	code := f.File.GetAttr(out)
+	if code.Ok() && out.IsRegular() {
+		out.Size = f.fs.plainSize(out.Size)
+	}
+	return code
+}
@@ -0,0 +1,166 @@
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newCryptTestFs(t *testing.T, opts *CryptFsOptions) (dir string, fs *CryptFileSystem) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	fs, err = NewCryptFileSystem(NewLoopbackFileSystem(dir), bytes.Repeat([]byte{1}, 32), opts)
+	if err != nil {
+		t.Fatalf("NewCryptFileSystem: %v", err)
+	}
+	return dir, fs
+}
+
+func TestCryptFsContents(t *testing.T) {
+	dir, fs := newCryptTestFs(t, &CryptFsOptions{BlockSize: 64})
+	defer os.RemoveAll(dir)
+
+	f, code := fs.Create("file", uint32(os.O_WRONLY|os.O_CREATE), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	var want []byte
+	write := func(off int, data string) {
+		if n, code := f.Write(&WriteIn{Offset: uint64(off)}, []byte(data)); !code.Ok() || int(n) != len(data) {
+			t.Fatalf("Write: %d, %v", n, code)
+		}
+		if len(want) < off+len(data) {
+			want = append(want, make([]byte, off+len(data)-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	check := func(what string) {
+		a, code := fs.GetAttr("file", nil)
+		if !code.Ok() || a.Size != uint64(len(want)) {
+			t.Errorf("%s: GetAttr: %v, size %d, want %d", what, code, a.Size, len(want))
+		}
+		data, code := f.Read(&ReadIn{Offset: 0, Size: 1000}, NewBufferPool())
+		if !code.Ok() || !bytes.Equal(data, want) {
+			t.Errorf("%s: got %q, want %q", what, data, want)
+		}
+		data, code = f.Read(&ReadIn{Offset: 70, Size: 10}, NewBufferPool())
+		if end := len(want); end > 70 {
+			if end > 80 {
+				end = 80
+			}
+			if !bytes.Equal(data, want[70:end]) {
+				t.Errorf("%s: read at 70: got %q, want %q", what, data, want[70:end])
+			}
+		}
+	}
+
+	write(0, strings.Repeat("abcdefgh", 10))
+	check("write")
+	write(60, "straddle")
+	check("overwrite")
+	write(200, "past end")
+	check("hole")
+	write(3, "x")
+	check("small write")
+
+	for _, size := range []int{130, 100, 128, 300, 5, 0, 40} {
+		if code := f.Truncate(uint64(size), nil); !code.Ok() {
+			t.Fatalf("Truncate(%d): %v", size, code)
+		}
+		if size < len(want) {
+			want = want[:size]
+		} else {
+			want = append(want, make([]byte, size-len(want))...)
+		}
+		check("truncate")
+	}
+	write(10, "abcdefgh")
+	check("write after truncate")
+	f.Release(&ReleaseIn{})
+
+	raw, _ := ioutil.ReadFile(filepath.Join(dir, "file"))
+	if bytes.Contains(raw, []byte("abcd")) {
+		t.Errorf("plaintext found in %q", raw)
+	}
+
+	other, _ := NewCryptFileSystem(NewLoopbackFileSystem(dir), bytes.Repeat([]byte{2}, 32), nil)
+	g, code := other.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer g.Release(&ReleaseIn{})
+	if _, code := g.Read(&ReadIn{Size: 10}, NewBufferPool()); code != EIO {
+		t.Errorf("read with wrong key: got %v, want EIO", code)
+	}
+}
+
+func TestCryptFsNames(t *testing.T) {
+	dir, fs := newCryptTestFs(t, &CryptFsOptions{EncryptNames: true})
+	defer os.RemoveAll(dir)
+
+	pfs := NewPathNodeFs(fs, nil)
+	NewFileSystemConnector(pfs, nil)
+	root := pfs.Root().(*pathInode)
+
+	if _, code := root.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	f, _, code := root.Create("file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Write(&WriteIn{}, []byte("hello"))
+	f.Release(&ReleaseIn{})
+	if _, code := root.Symlink("link", "dir/file", nil); !code.Ok() {
+		t.Fatalf("Symlink: %v", code)
+	}
+
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() == "dir" || e.Name() == "file" || e.Name() == "link" {
+			t.Errorf("name %q not encrypted", e.Name())
+		}
+	}
+	if val, code := fs.Readlink("link", nil); !code.Ok() || val != "dir/file" {
+		t.Errorf("Readlink: %q, %v", val, code)
+	}
+	if a, code := fs.GetAttr("link", nil); !code.Ok() || a.Size != uint64(len("dir/file")) {
+		t.Errorf("GetAttr link: %v, %v", a, code)
+	}
+
+	// The contents do not depend on the path.
+	dirNode := root.Inode().GetChild("dir").FsNode()
+	if code := root.Rename("file", dirNode, "file", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if code := fs.Link("dir/file", "copy", nil); !code.Ok() {
+		t.Fatalf("Link: %v", code)
+	}
+	for _, name := range []string{"dir/file", "copy"} {
+		f, code := fs.Open(name, uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			t.Fatalf("Open(%q): %v", name, code)
+		}
+		if data, _ := f.Read(&ReadIn{Size: 100}, NewBufferPool()); string(data) != "hello" {
+			t.Errorf("%s: got %q", name, data)
+		}
+		f.Release(&ReleaseIn{})
+	}
+
+	stream, code := fs.OpenDir("", nil)
+	var names []string
+	for _, e := range stream {
+		names = append(names, e.Name)
+	}
+	if got := strings.Join(names, " "); !code.Ok() || len(names) != 3 ||
+		!strings.Contains(got, "dir") || !strings.Contains(got, "link") || !strings.Contains(got, "copy") {
+		t.Errorf("OpenDir: %v, %v", names, code)
+	}
+
+	if code := fs.Mkdir(strings.Repeat("x", 200), 0755, nil); code.Ok() {
+		t.Errorf("Mkdir with long name succeeded")
+	}
+}
@@ -0,0 +1,94 @@
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+var _ = log.Println
+
+// CuseOptions describes a character device served through CUSE.
+type CuseOptions struct {
+	// The device appears as /dev/DevName.
+	DevName string
+
+	// Device numbers. If DevMajor is 0, the kernel picks a free
+	// major number.
+	DevMajor uint32
+	DevMinor uint32
+
+	// Pass ioctls on unchecked.
+	UnrestrictedIoctl bool
+}
+
+const cuseDevice = "/dev/cuse"
+
+// MountCuse opens the CUSE device, so Loop() will serve a character
+// device from the RawFileSystem rather than a mounted file system.
+// The kernel only sends file operations (OPEN, READ, WRITE, FLUSH,
+// FSYNC, RELEASE) in this mode.  Unmount() removes the device.
+func (ms *MountState) MountCuse(cuseOpts *CuseOptions, opts *MountOptions) error {
+	if cuseOpts.DevName == "" {
+		return fmt.Errorf("CUSE device needs a name")
+	}
+	ms.setOptions(opts)
+
+	f, err := os.OpenFile(cuseDevice, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	o := *cuseOpts
+	ms.cuseOptions = &o
+	ms.fileSystem.Init(&RawFsInit{
+		KernelSettings: ms.KernelSettings,
+	})
+	ms.mountFile = f
+	return nil
+}
+
+func doCuseInit(state *MountState, req *request) {
+	input := (*raw.CuseInitIn)(req.inData)
+	if state.cuseOptions == nil {
+		log.Printf("CUSE_INIT received on a FUSE mount")
+		req.status = EIO
+		return
+	}
+	if input.Major != FUSE_KERNEL_VERSION {
+		log.Printf("Major versions does not match. Given %d, want %d\n", input.Major, FUSE_KERNEL_VERSION)
+		req.status = EIO
+		return
+	}
+	if input.Minor < MINIMUM_MINOR_VERSION {
+		log.Printf("Minor version is less than we support. Given %d, want at least %d\n", input.Minor, MINIMUM_MINOR_VERSION)
+		req.status = EIO
+		return
+	}
+
+	state.kernelSettings = raw.InitIn{
+		Major: input.Major,
+		Minor: input.Minor,
+	}
+	out := &raw.CuseInitOut{
+		Major:    FUSE_KERNEL_VERSION,
+		Minor:    OUR_MINOR_VERSION,
+		MaxRead:  uint32(state.opts.MaxWrite),
+		MaxWrite: uint32(state.opts.MaxWrite),
+		DevMajor: state.cuseOptions.DevMajor,
+		DevMinor: state.cuseOptions.DevMinor,
+	}
+	if out.Minor > input.Minor {
+		out.Minor = input.Minor
+	}
+	if state.cuseOptions.UnrestrictedIoctl {
+		out.Flags |= raw.CUSE_UNRESTRICTED_IOCTL
+	}
+
+	req.outData = unsafe.Pointer(out)
+	req.flatData = []byte("DEVNAME=" + state.cuseOptions.DevName + "\000")
+	req.status = OK
+}
@@ -0,0 +1,67 @@
+package fuse
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestCuseInit(t *testing.T) {
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+	defer local.Close()
+
+	ms := NewMountState(&DefaultRawFileSystem{})
+	ms.setOptions(nil)
+	ms.cuseOptions = &CuseOptions{
+		DevName:  "gofusetest",
+		DevMajor: 240,
+	}
+	ms.mountFile = remote
+	go ms.Loop()
+
+	type cuseInitRequest struct {
+		header raw.InHeader
+		init   raw.CuseInitIn
+	}
+	input := cuseInitRequest{
+		header: raw.InHeader{
+			Opcode: _OP_CUSE_INIT,
+			Unique: 1,
+		},
+		init: raw.CuseInitIn{
+			Major: FUSE_KERNEL_VERSION,
+			Minor: OUR_MINOR_VERSION,
+		},
+	}
+	input.header.Length = uint32(unsafe.Sizeof(input))
+	_, err = local.Write((*[unsafe.Sizeof(input)]byte)(unsafe.Pointer(&input))[:])
+	CheckSuccess(err)
+
+	buf := make([]byte, 4096)
+	n, err := local.Read(buf)
+	CheckSuccess(err)
+	buf = buf[:n]
+
+	outH := (*raw.OutHeader)(unsafe.Pointer(&buf[0]))
+	if outH.Status != 0 || outH.Unique != 1 || int(outH.Length) != n {
+		t.Fatalf("bad reply header %+v, len %d", outH, n)
+	}
+	out := (*raw.CuseInitOut)(unsafe.Pointer(&buf[sizeOfOutHeader]))
+	if out.Major != FUSE_KERNEL_VERSION || out.DevMajor != 240 {
+		t.Errorf("bad CUSE_INIT reply: %+v", out)
+	}
+	info := buf[sizeOfOutHeader+unsafe.Sizeof(raw.CuseInitOut{}):]
+	if !bytes.Equal(info, []byte("DEVNAME=gofusetest\000")) {
+		t.Errorf("bad device info %q", info)
+	}
+	if ms.KernelSettings().Major != FUSE_KERNEL_VERSION {
+		t.Errorf("kernel settings not recorded: %v", ms.KernelSettings())
+	}
+
+	// Closing our end makes the reads fail, and Loop() exit.
+	syscall.Shutdown(int(local.Fd()), syscall.SHUT_RDWR)
+}
@@ -1,6 +1,8 @@
 package fuse
 
-import ()
+import (
+	"time"
+)
 
 // DefaultFileSystem
 func (fs *DefaultFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
@@ -55,6 +57,10 @@ func (fs *DefaultFileSystem) Link(oldName string, newName string, context *Conte
 	return ENOSYS
 }
 
+func (fs *DefaultFileSystem) LinkKey(name string, context *Context) (key string, code Status) {
+	return "", ENOSYS
+}
+
 func (fs *DefaultFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
 	return ENOSYS
 }
@@ -75,10 +81,14 @@ func (fs *DefaultFileSystem) OpenDir(name string, context *Context) (stream []Di
 	return nil, ENOSYS
 }
 
+func (fs *DefaultFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, status Status) {
+	return nil, ENOSYS
+}
+
 func (fs *DefaultFileSystem) OnMount(nodeFs *PathNodeFs) {
 }
 
-func (fs *DefaultFileSystem) OnUnmount() {
+func (fs *DefaultFileSystem) OnUnmount(reason UnmountReason) {
 }
 
 func (fs *DefaultFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
@@ -89,7 +99,7 @@ func (fs *DefaultFileSystem) Create(name string, flags uint32, mode uint32, cont
 	return nil, ENOSYS
 }
 
-func (fs *DefaultFileSystem) Utimens(name string, AtimeNs int64, CtimeNs int64, context *Context) (code Status) {
+func (fs *DefaultFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
 	return ENOSYS
 }
 
@@ -100,3 +110,11 @@ func (fs *DefaultFileSystem) String() string {
 func (fs *DefaultFileSystem) StatFs(name string) *StatfsOut {
 	return nil
 }
+
+func (fs *DefaultFileSystem) SyncFs(context *Context) (code Status) {
+	return ENOSYS
+}
+
+func (fs *DefaultFileSystem) FsyncDir(name string, flags int, context *Context) (code Status) {
+	return ENOSYS
+}
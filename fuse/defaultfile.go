@@ -2,6 +2,7 @@ package fuse
 
 import (
 	"log"
+	"time"
 
 	"github.com/hanwen/go-fuse/raw"
 )
@@ -27,11 +28,11 @@ func (f *DefaultFile) Write(*WriteIn, []byte) (uint32, Status) {
 	return 0, ENOSYS
 }
 
-func (f *DefaultFile) Flush() Status {
+func (f *DefaultFile) Flush(*FlushIn) Status {
 	return OK
 }
 
-func (f *DefaultFile) Release() {
+func (f *DefaultFile) Release(*ReleaseIn) {
 
 }
 
@@ -43,19 +44,23 @@ func (f *DefaultFile) Fsync(flags int) (code Status) {
 	return ENOSYS
 }
 
-func (f *DefaultFile) Utimens(atimeNs int64, mtimeNs int64) Status {
+func (f *DefaultFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
 	return ENOSYS
 }
 
-func (f *DefaultFile) Truncate(size uint64) Status {
+func (f *DefaultFile) Truncate(size uint64, context *Context) Status {
 	return ENOSYS
 }
 
-func (f *DefaultFile) Chown(uid uint32, gid uint32) Status {
+func (f *DefaultFile) Chown(uid uint32, gid uint32, context *Context) Status {
 	return ENOSYS
 }
 
-func (f *DefaultFile) Chmod(perms uint32) Status {
+func (f *DefaultFile) Chmod(perms uint32, context *Context) Status {
+	return ENOSYS
+}
+
+func (f *DefaultFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
 	return ENOSYS
 }
 
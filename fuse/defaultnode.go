@@ -2,6 +2,7 @@ package fuse
 
 import (
 	"log"
+	"time"
 )
 
 var _ = log.Println
@@ -9,7 +10,7 @@ var _ = log.Println
 type DefaultNodeFileSystem struct {
 }
 
-func (fs *DefaultNodeFileSystem) OnUnmount() {
+func (fs *DefaultNodeFileSystem) OnUnmount(reason UnmountReason) {
 }
 
 func (fs *DefaultNodeFileSystem) OnMount(conn *FileSystemConnector) {
@@ -37,6 +38,14 @@ func (n *DefaultFsNode) StatFs() *StatfsOut {
 	return nil
 }
 
+func (n *DefaultFsNode) SyncFs(context *Context) (code Status) {
+	return ENOSYS
+}
+
+func (n *DefaultFsNode) FsyncDir(flags int, context *Context) (code Status) {
+	return ENOSYS
+}
+
 func (n *DefaultFsNode) SetInode(node *Inode) {
 	if n.inode != nil {
 		panic("already have Inode")
@@ -58,6 +67,9 @@ func (n *DefaultFsNode) Inode() *Inode {
 func (n *DefaultFsNode) OnForget() {
 }
 
+func (n *DefaultFsNode) OnKernelForget() {
+}
+
 func (n *DefaultFsNode) Lookup(out *Attr, name string, context *Context) (node FsNode, code Status) {
 	return nil, ENOENT
 }
@@ -106,6 +118,10 @@ func (n *DefaultFsNode) Flush(file File, openFlags uint32, context *Context) (co
 	return ENOSYS
 }
 
+func (n *DefaultFsNode) OpenDirStream(context *Context) (DirStream, Status) {
+	return nil, ENOSYS
+}
+
 func (n *DefaultFsNode) OpenDir(context *Context) ([]DirEntry, Status) {
 	ch := n.Inode().Children()
 	s := make([]DirEntry, 0, len(ch))
@@ -156,6 +172,10 @@ func (n *DefaultFsNode) Truncate(file File, size uint64, context *Context) (code
 	return ENOSYS
 }
 
-func (n *DefaultFsNode) Utimens(file File, atime int64, mtime int64, context *Context) (code Status) {
+func (n *DefaultFsNode) Utimens(file File, atime *time.Time, mtime *time.Time, context *Context) (code Status) {
+	return ENOSYS
+}
+
+func (n *DefaultFsNode) Setattr(file File, valid uint32, attr *Attr, context *Context) (code Status) {
 	return ENOSYS
 }
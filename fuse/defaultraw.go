@@ -10,10 +10,21 @@ var _ = RawFileSystem((*DefaultRawFileSystem)(nil))
 func (fs *DefaultRawFileSystem) Init(init *RawFsInit) {
 }
 
+func (fs *DefaultRawFileSystem) OnUnmount(reason UnmountReason) {
+}
+
 func (fs *DefaultRawFileSystem) StatFs(out *StatfsOut, h *raw.InHeader) Status {
 	return ENOSYS
 }
 
+func (fs *DefaultRawFileSystem) CopyFileRange(header *raw.InHeader, input *raw.CopyFileRangeIn) (written uint32, code Status) {
+	return 0, ENOSYS
+}
+
+func (fs *DefaultRawFileSystem) SyncFs(header *raw.InHeader, input *raw.SyncFsIn) Status {
+	return ENOSYS
+}
+
 func (fs *DefaultRawFileSystem) Lookup(out *raw.EntryOut, h *raw.InHeader, name string) (code Status) {
 	return ENOSYS
 }
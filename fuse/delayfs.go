@@ -0,0 +1,298 @@
+package fuse
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Latency is a distribution of delays for a DelayFileSystem.
+type Latency interface {
+	// Sample draws a delay, using r for randomness.
+	Sample(r *rand.Rand) time.Duration
+}
+
+// FixedLatency always delays for the same time.
+type FixedLatency time.Duration
+
+func (l FixedLatency) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(l)
+}
+
+// UniformLatency delays for a time between Min and Max.
+type UniformLatency struct {
+	Min, Max time.Duration
+}
+
+func (l UniformLatency) Sample(r *rand.Rand) time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + time.Duration(r.Int63n(int64(l.Max-l.Min)))
+}
+
+// ParetoLatency has a long tail, like the round trips of a busy
+// network: most delays are close to Min, but some are many times
+// longer.  Smaller values of Shape give a longer tail.  Delays are
+// capped at Max, if it is set.
+type ParetoLatency struct {
+	Min   time.Duration
+	Shape float64
+	Max   time.Duration
+}
+
+func (l ParetoLatency) Sample(r *rand.Rand) time.Duration {
+	shape := l.Shape
+	if shape <= 0 {
+		shape = 1
+	}
+	// 1-Float64 is in (0, 1], so the power is finite.
+	d := time.Duration(float64(l.Min) / math.Pow(1-r.Float64(), 1/shape))
+	if l.Max > 0 && (d > l.Max || d < 0) {
+		d = l.Max
+	}
+	return d
+}
+
+type DelayOptions struct {
+	// Default is the latency of operations that are not in Ops.
+	// Nil means no delay.
+	Default Latency
+
+	// Ops has the latencies by method name of FileSystem or File,
+	// eg. "GetAttr" or "Read".
+	Ops map[string]Latency
+
+	// Jitter adds a uniform delay between -Jitter and +Jitter to
+	// each sample.  Delays do not go below zero.
+	Jitter time.Duration
+
+	// Seed seeds the random numbers, so that a run with the same
+	// operations in the same order sees the same delays.
+	Seed int64
+}
+
+// DelayFileSystem is a wrapper that sleeps before each operation, to
+// simulate slow file systems, such as ones on a network.
+type DelayFileSystem struct {
+	FileSystem
+
+	options DelayOptions
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// NewDelayFileSystem wraps fs.
+func NewDelayFileSystem(fs FileSystem, opts *DelayOptions) *DelayFileSystem {
+	d := &DelayFileSystem{FileSystem: fs}
+	if opts != nil {
+		d.options = *opts
+	}
+	d.rand = rand.New(rand.NewSource(d.options.Seed))
+	return d
+}
+
+func (fs *DelayFileSystem) String() string {
+	return fmt.Sprintf("DelayFileSystem(%s)", fs.FileSystem.String())
+}
+
+// Delay returns the delay for the next call of op.
+func (fs *DelayFileSystem) Delay(op string) time.Duration {
+	l := fs.options.Ops[op]
+	if l == nil {
+		l = fs.options.Default
+	}
+	if l == nil && fs.options.Jitter == 0 {
+		return 0
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var d time.Duration
+	if l != nil {
+		d = l.Sample(fs.rand)
+	}
+	if j := int64(fs.options.Jitter); j > 0 {
+		d += time.Duration(fs.rand.Int63n(2*j+1) - j)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (fs *DelayFileSystem) sleep(op string) {
+	if d := fs.Delay(op); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (fs *DelayFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	fs.sleep("GetAttr")
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *DelayFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
+	fs.sleep("Chmod")
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *DelayFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) (code Status) {
+	fs.sleep("Chown")
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *DelayFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	fs.sleep("Utimens")
+	return fs.FileSystem.Utimens(name, Atime, Mtime, context)
+}
+
+func (fs *DelayFileSystem) Truncate(name string, size uint64, context *Context) (code Status) {
+	fs.sleep("Truncate")
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *DelayFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
+	fs.sleep("Access")
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *DelayFileSystem) Link(oldName string, newName string, context *Context) (code Status) {
+	fs.sleep("Link")
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *DelayFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	fs.sleep("Mkdir")
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *DelayFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	fs.sleep("Mknod")
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *DelayFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
+	fs.sleep("Rename")
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *DelayFileSystem) Rmdir(name string, context *Context) (code Status) {
+	fs.sleep("Rmdir")
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *DelayFileSystem) Unlink(name string, context *Context) (code Status) {
+	fs.sleep("Unlink")
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *DelayFileSystem) GetXAttr(name string, attribute string, context *Context) (data []byte, code Status) {
+	fs.sleep("GetXAttr")
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *DelayFileSystem) ListXAttr(name string, context *Context) (attributes []string, code Status) {
+	fs.sleep("ListXAttr")
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *DelayFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	fs.sleep("RemoveXAttr")
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *DelayFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	fs.sleep("SetXAttr")
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *DelayFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	fs.sleep("Open")
+	file, code = fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return &delayFile{File: file, fs: fs}, code
+}
+
+func (fs *DelayFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	fs.sleep("Create")
+	file, code = fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return &delayFile{File: file, fs: fs}, code
+}
+
+func (fs *DelayFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, code Status) {
+	fs.sleep("OpenDir")
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *DelayFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, code Status) {
+	fs.sleep("OpenDir")
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *DelayFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	fs.sleep("Symlink")
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *DelayFileSystem) Readlink(name string, context *Context) (string, Status) {
+	fs.sleep("Readlink")
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *DelayFileSystem) StatFs(name string) *StatfsOut {
+	fs.sleep("StatFs")
+	return fs.FileSystem.StatFs(name)
+}
+
+func (fs *DelayFileSystem) SyncFs(context *Context) (code Status) {
+	fs.sleep("SyncFs")
+	return fs.FileSystem.SyncFs(context)
+}
+
+func (fs *DelayFileSystem) FsyncDir(name string, flags int, context *Context) (code Status) {
+	fs.sleep("FsyncDir")
+	return fs.FileSystem.FsyncDir(name, flags, context)
+}
+
+// delayFile delays the data operations of an open file.
+type delayFile struct {
+	File
+	fs *DelayFileSystem
+}
+
+func (f *delayFile) String() string {
+	return fmt.Sprintf("delayFile(%s)", f.File.String())
+}
+
+func (f *delayFile) InnerFile() File {
+	return f.File
+}
+
+func (f *delayFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	f.fs.sleep("Read")
+	return f.File.Read(input, bp)
+}
+
+func (f *delayFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	f.fs.sleep("Write")
+	return f.File.Write(input, data)
+}
+
+func (f *delayFile) Flush(input *FlushIn) Status {
+	f.fs.sleep("Flush")
+	return f.File.Flush(input)
+}
+
+func (f *delayFile) Fsync(flags int) (code Status) {
+	f.fs.sleep("Fsync")
+	return f.File.Fsync(flags)
+}
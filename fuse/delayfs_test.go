@@ -0,0 +1,63 @@
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayFsDistributions(t *testing.T) {
+	opts := &DelayOptions{
+		Default: FixedLatency(time.Millisecond),
+		Ops: map[string]Latency{
+			"Read":    UniformLatency{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond},
+			"GetAttr": ParetoLatency{Min: time.Millisecond, Shape: 1.5, Max: time.Second},
+		},
+		Seed: 42,
+	}
+	fs := NewDelayFileSystem(&DefaultFileSystem{}, opts)
+	for i := 0; i < 1000; i++ {
+		if d := fs.Delay("Open"); d != time.Millisecond {
+			t.Fatalf("fixed: got %v", d)
+		}
+		if d := fs.Delay("Read"); d < 10*time.Millisecond || d >= 20*time.Millisecond {
+			t.Fatalf("uniform: got %v", d)
+		}
+		if d := fs.Delay("GetAttr"); d < time.Millisecond || d > time.Second {
+			t.Fatalf("pareto: got %v", d)
+		}
+	}
+
+	// The same seed gives the same delays.
+	a := NewDelayFileSystem(&DefaultFileSystem{}, opts)
+	b := NewDelayFileSystem(&DefaultFileSystem{}, opts)
+	for i := 0; i < 100; i++ {
+		if da, db := a.Delay("GetAttr"), b.Delay("GetAttr"); da != db {
+			t.Fatalf("sample %d: %v != %v", i, da, db)
+		}
+	}
+}
+
+func TestDelayFsJitter(t *testing.T) {
+	fs := NewDelayFileSystem(&DefaultFileSystem{}, &DelayOptions{
+		Default: FixedLatency(time.Millisecond),
+		Jitter:  2 * time.Millisecond,
+	})
+	var zero, high bool
+	for i := 0; i < 1000; i++ {
+		d := fs.Delay("Open")
+		if d < 0 || d > 3*time.Millisecond {
+			t.Fatalf("got %v", d)
+		}
+		zero = zero || d == 0
+		high = high || d > 2*time.Millisecond
+	}
+	if !zero || !high {
+		t.Errorf("jitter does not spread: zero %v, high %v", zero, high)
+	}
+
+	start := time.Now()
+	fs.GetAttr("", nil)
+	if time.Now().Sub(start) > time.Second {
+		t.Errorf("GetAttr took too long")
+	}
+}
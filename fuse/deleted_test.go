@@ -0,0 +1,88 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pathRecorder records the paths passed to GetAttr.
+type pathRecorder struct {
+	FileSystem
+	paths []string
+}
+
+func (fs *pathRecorder) GetAttr(name string, context *Context) (*Attr, Status) {
+	fs.paths = append(fs.paths, name)
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func TestDeletedNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name     string
+		opts     PathNodeFsOptions
+		open     bool
+		wantPath string
+		want     Status
+	}{
+		{"path", PathNodeFsOptions{}, false, ".deleted", ENOENT},
+		{"estale", PathNodeFsOptions{DeletedNodes: DELETED_ESTALE}, true, "", ESTALE},
+		{"files-closed", PathNodeFsOptions{DeletedNodes: DELETED_FILES}, false, "", ESTALE},
+		{"files-open", PathNodeFsOptions{DeletedNodes: DELETED_FILES}, true, "", OK},
+		{"resolver", PathNodeFsOptions{
+			DeletedNodes: DELETED_ESTALE,
+			DeletedResolver: func(node *Inode) (string, Status) {
+				return "other", OK
+			},
+		}, false, "other", OK},
+	} {
+		CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+		CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "other"), nil, 0644))
+
+		fs := &pathRecorder{FileSystem: NewLoopbackFileSystem(dir)}
+		pfs := NewPathNodeFs(fs, &tc.opts)
+		NewFileSystemConnector(pfs, nil)
+		root := pfs.Root().(*pathInode)
+		var a Attr
+		node, code := root.Lookup(&a, "file", nil)
+		if !code.Ok() {
+			t.Fatalf("%s: Lookup: %v", tc.name, code)
+		}
+		file := node.(*pathInode)
+		if tc.open {
+			f, code := file.Open(uint32(os.O_RDONLY), nil)
+			if !code.Ok() {
+				t.Fatalf("%s: Open: %v", tc.name, code)
+			}
+			defer f.Release(&ReleaseIn{})
+			file.Inode().mount.registerFileHandle(file.Inode(), nil, f, uint32(os.O_RDONLY))
+		}
+		if code := root.Unlink("file", nil); !code.Ok() {
+			t.Fatalf("%s: Unlink: %v", tc.name, code)
+		}
+
+		fs.paths = nil
+		code = file.GetAttr(&a, nil, nil)
+		if code != tc.want {
+			t.Errorf("%s: GetAttr: got %v, want %v", tc.name, code, tc.want)
+		}
+		if tc.want.Ok() && a.Size != 4 && tc.wantPath == "" {
+			t.Errorf("%s: GetAttr from open file: size %d", tc.name, a.Size)
+		}
+		got := ""
+		if len(fs.paths) > 0 {
+			got = fs.paths[0]
+		}
+		if got != tc.wantPath {
+			t.Errorf("%s: FileSystem saw %q, want %q", tc.name, got, tc.wantPath)
+		}
+		if file.GetPath() != ".deleted" && tc.opts.DeletedResolver == nil {
+			t.Errorf("%s: GetPath: %q", tc.name, file.GetPath())
+		}
+	}
+}
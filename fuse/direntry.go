@@ -14,12 +14,28 @@ var eightPadding [8]byte
 const direntSize = int(unsafe.Sizeof(raw.Dirent{}))
 
 // DirEntry is a type for PathFileSystem and NodeFileSystem to return
-// directory contents in.
+// directory contents in.  Only the file type bits of Mode are used;
+// use S_IFUNKNOWN if the type is not known.
 type DirEntry struct {
 	Mode uint32
 	Name string
+
+	// Ino is the d_ino of the entry.  It is only shown if stat
+	// shows the inode numbers of the file system, see
+	// PathNodeFsOptions.StableInodes; otherwise both show node
+	// IDs.
+	Ino uint64
+
+	// Off is the offset of the next entry, for entries returned
+	// by a DirStream.
+	Off uint64
 }
 
+// S_IFUNKNOWN is the DirEntry mode for entries of unknown type. These
+// are sent to the kernel as DT_UNKNOWN, which tells readdir callers
+// to stat the entry themselves.
+const S_IFUNKNOWN = 0
+
 type DirEntryList struct {
 	buf     []byte
 	offset  uint64
@@ -33,10 +49,23 @@ func NewDirEntryList(data []byte, off uint64) *DirEntryList {
 }
 
 func (l *DirEntryList) AddDirEntry(e DirEntry) bool {
-	return l.Add(e.Name, uint64(raw.FUSE_UNKNOWN_INO), e.Mode)
+	return l.addDirEntry(e, l.offset+1)
+}
+
+// addDirEntry adds e, with off as the offset to continue after it.
+func (l *DirEntryList) addDirEntry(e DirEntry, off uint64) bool {
+	ino := e.Ino
+	if ino == 0 {
+		ino = raw.FUSE_UNKNOWN_INO
+	}
+	return l.add(e.Name, ino, e.Mode, off)
 }
 
 func (l *DirEntryList) Add(name string, inode uint64, mode uint32) bool {
+	return l.add(name, inode, mode, l.offset+1)
+}
+
+func (l *DirEntryList) add(name string, inode uint64, mode uint32, off uint64) bool {
 	padding := (8 - len(name)&7)&7
 	delta := padding + direntSize + len(name)
 	oldLen := len(l.buf)
@@ -47,7 +76,7 @@ func (l *DirEntryList) Add(name string, inode uint64, mode uint32) bool {
 	}
 	l.buf = l.buf[:newLen]
 	dirent := (*raw.Dirent)(unsafe.Pointer(&l.buf[oldLen]))
-	dirent.Off = l.offset+1
+	dirent.Off = off
 	dirent.Ino = inode
 	dirent.NameLen= uint32(len(name))
 	dirent.Typ = ModeToType(mode)
@@ -70,31 +99,83 @@ func (l *DirEntryList) Bytes() []byte {
 ////////////////////////////////////////////////////////////////
 
 type rawDir interface {
-	ReadDir(out *DirEntryList, input *ReadIn) (Status)
+	ReadDir(out *DirEntryList, input *ReadIn, context *Context) (Status)
 	Release()
 }
 
+// openDir opens node for reading, as a DirStream if the file system
+// offers one.
+func openDir(node *Inode, context *Context) (rawDir, Status) {
+	stream, code := node.fsInode.OpenDirStream(context)
+	if code.Ok() {
+		return newStreamDir(node, stream), OK
+	}
+	if code != ENOSYS {
+		return nil, code
+	}
+	entries, code := node.fsInode.OpenDir(context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return newConnectorDir(node, entries), OK
+}
+
+// entryIno returns the d_ino for e, an entry of dir.  It is the
+// st_ino that stat shows, see fileSystemMount.setIno: the node ID,
+// unless the file system has stable inode numbers.  A child that the
+// kernel has not looked up has no node ID yet, so its number is
+// unknown, as are the stable numbers of the entries that the
+// connector adds.
+func entryIno(dir *Inode, e DirEntry) uint64 {
+	if dir.mount.stableInodes {
+		return e.Ino
+	}
+	node := dir
+	if e.Name != "." {
+		node = dir.GetChild(e.Name)
+	}
+	switch {
+	case node == nil:
+		return 0
+	case node == dir.mount.connector.rootNode:
+		return raw.FUSE_ROOT_ID
+	}
+	return node.nodeId
+}
+
 type connectorDir struct {
-	node       FsNode 
+	node       *Inode
 	stream     []DirEntry
 	lastOffset uint64
 }
 
-func (d *connectorDir) ReadDir(list *DirEntryList, input *ReadIn) (code Status) {
+func newConnectorDir(node *Inode, stream []DirEntry) *connectorDir {
+	stream = append(stream, node.getMountDirEntries()...)
+	return &connectorDir{
+		node:   node,
+		stream: append(stream, DirEntry{Mode: S_IFDIR, Name: "."}, DirEntry{Mode: S_IFDIR, Name: ".."}),
+	}
+}
+
+func (d *connectorDir) ReadDir(list *DirEntryList, input *ReadIn, context *Context) (code Status) {
 	if d.stream == nil {
 		return OK
 	}
 	// rewinddir() should be as if reopening directory.
 	// TODO - test this.
 	if d.lastOffset > 0 && input.Offset == 0 {
-		d.stream, code = d.node.OpenDir(nil)
+		d.stream, code = d.node.fsInode.OpenDir(context)
 		if !code.Ok() {
 			return code
 		}
 	}
 
+	if input.Offset >= uint64(len(d.stream)) {
+		return OK
+	}
 	todo := d.stream[input.Offset:]
 	for _, e := range todo {
+		e.Ino = entryIno(d.node, e)
 		if !list.AddDirEntry(e) {
 			break
 		}
@@ -106,3 +187,62 @@ func (d *connectorDir) ReadDir(list *DirEntryList, input *ReadIn) (code Status)
 // Read everything so we make goroutines exit.
 func (d *connectorDir) Release() {
 }
+
+////////////////////////////////////////////////////////////////
+
+// The offsets of the entries that streamDir appends to a DirStream.
+const _DIR_EXTRA_OFFSET = uint64(1) << 63
+
+// streamDir reads a DirStream, followed by the mount points and "."
+// and "..", at offsets in the upper half.
+type streamDir struct {
+	node   *Inode
+	stream DirStream
+	extra  []DirEntry
+}
+
+func newStreamDir(node *Inode, stream DirStream) *streamDir {
+	extra := node.getMountDirEntries()
+	return &streamDir{
+		node:   node,
+		stream: stream,
+		extra:  append(extra, DirEntry{Mode: S_IFDIR, Name: "."}, DirEntry{Mode: S_IFDIR, Name: ".."}),
+	}
+}
+
+func (d *streamDir) ReadDir(list *DirEntryList, input *ReadIn, context *Context) Status {
+	off := input.Offset
+	for off&_DIR_EXTRA_OFFSET == 0 {
+		entries, code := d.stream.ReadDir(off, context)
+		if !code.Ok() {
+			return code
+		}
+		if len(entries) == 0 {
+			off = _DIR_EXTRA_OFFSET
+			break
+		}
+		for _, e := range entries {
+			if e.Off == 0 || e.Off&_DIR_EXTRA_OFFSET != 0 {
+				log.Printf("DirStream entry %q has invalid offset %x", e.Name, e.Off)
+				return EIO
+			}
+			e.Ino = entryIno(d.node, e)
+			if !list.addDirEntry(e, e.Off) {
+				return OK
+			}
+			off = e.Off
+		}
+	}
+	for i := off &^ _DIR_EXTRA_OFFSET; i < uint64(len(d.extra)); i++ {
+		e := d.extra[i]
+		e.Ino = entryIno(d.node, e)
+		if !list.addDirEntry(e, _DIR_EXTRA_OFFSET|(i+1)) {
+			break
+		}
+	}
+	return OK
+}
+
+func (d *streamDir) Release() {
+	d.stream.Release()
+}
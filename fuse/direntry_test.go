@@ -0,0 +1,232 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestDirEntryUnknownType(t *testing.T) {
+	l := NewDirEntryList(make([]byte, 256), 0)
+	if !l.AddDirEntry(DirEntry{Name: "x", Mode: S_IFUNKNOWN | 0644}) {
+		t.Fatal("AddDirEntry failed")
+	}
+	dirent := (*raw.Dirent)(unsafe.Pointer(&l.Bytes()[0]))
+	if dirent.Typ != syscall.DT_UNKNOWN {
+		t.Errorf("got type %d, want DT_UNKNOWN", dirent.Typ)
+	}
+}
+
+// unknownTypeFs strips the type from all directory entries.
+type unknownTypeFs struct {
+	FileSystem
+}
+
+func (fs *unknownTypeFs) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	return nil, ENOSYS
+}
+
+func (fs *unknownTypeFs) OpenDir(name string, context *Context) ([]DirEntry, Status) {
+	stream, code := fs.FileSystem.OpenDir(name, context)
+	for i := range stream {
+		stream[i].Mode = S_IFUNKNOWN
+	}
+	return stream, code
+}
+
+func TestFillDirEntryTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.Mkdir(dir+"/subdir", 0755))
+	CheckSuccess(ioutil.WriteFile(dir+"/file", []byte("hello"), 0644))
+
+	fs := &unknownTypeFs{NewLoopbackFileSystem(dir)}
+	for _, fill := range []bool{false, true} {
+		pfs := NewPathNodeFs(fs, &PathNodeFsOptions{FillDirEntryTypes: fill})
+		stream, code := pfs.Root().OpenDir(nil)
+		if !code.Ok() {
+			t.Fatalf("OpenDir: %v", code)
+		}
+		got := map[string]uint32{}
+		for _, e := range stream {
+			got[e.Name] = e.Mode & syscall.S_IFMT
+		}
+		want := map[string]uint32{"subdir": S_IFUNKNOWN, "file": S_IFUNKNOWN}
+		if fill {
+			want = map[string]uint32{"subdir": S_IFDIR, "file": S_IFREG}
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("fill %v: %q has type %o, want %o", fill, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestDirEntryIno(t *testing.T) {
+	l := NewDirEntryList(make([]byte, 256), 0)
+	l.AddDirEntry(DirEntry{Name: "known", Mode: S_IFREG, Ino: 42})
+	l.AddDirEntry(DirEntry{Name: "unknown", Mode: S_IFREG})
+	first := (*raw.Dirent)(unsafe.Pointer(&l.Bytes()[0]))
+	second := (*raw.Dirent)(unsafe.Pointer(&l.Bytes()[direntSize+8]))
+	if first.Ino != 42 {
+		t.Errorf("got ino %d, want 42", first.Ino)
+	}
+	if second.Ino != raw.FUSE_UNKNOWN_INO {
+		t.Errorf("got ino %x, want FUSE_UNKNOWN_INO", second.Ino)
+	}
+}
+
+// noInoFs strips the inode numbers from all directory entries.
+type noInoFs struct {
+	FileSystem
+}
+
+func (fs *noInoFs) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	return nil, ENOSYS
+}
+
+func (fs *noInoFs) OpenDir(name string, context *Context) ([]DirEntry, Status) {
+	stream, code := fs.FileSystem.OpenDir(name, context)
+	for i := range stream {
+		stream[i].Ino = 0
+	}
+	return stream, code
+}
+
+func TestPathNodeFsDirEntryIno(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(dir+"/file", []byte("hello"), 0644))
+
+	pfs := NewPathNodeFs(&noInoFs{NewLoopbackFileSystem(dir)}, &PathNodeFsOptions{StableInodes: true})
+	inos := func() map[string]uint64 {
+		stream, code := pfs.Root().OpenDir(nil)
+		if !code.Ok() {
+			t.Fatalf("OpenDir: %v", code)
+		}
+		m := map[string]uint64{}
+		for _, e := range stream {
+			m[e.Name] = e.Ino
+		}
+		return m
+	}
+	a, b := inos(), inos()
+	if a["file"] == 0 || a["file"] != b["file"] {
+		t.Errorf("synthetic inode numbers %d, %d: want equal and non-zero", a["file"], b["file"])
+	}
+}
+
+func TestReaddirIno(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	orig := dir + "/orig"
+	mnt := dir + "/mnt"
+	CheckSuccess(os.Mkdir(orig, 0755))
+	CheckSuccess(os.Mkdir(mnt, 0755))
+	CheckSuccess(ioutil.WriteFile(orig+"/file", []byte("hello"), 0644))
+
+	state, _, err := MountNodeFileSystem(mnt, NewPathNodeFs(NewLoopbackFileSystem(orig), nil), nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	// readdir shows the number that stat does.
+	var st syscall.Stat_t
+	CheckSuccess(syscall.Lstat(mnt+"/file", &st))
+
+	// Raw syscalls, so the fd is not added to the Go poller.
+	fd, err := syscall.Open(mnt, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	CheckSuccess(err)
+	defer syscall.Close(fd)
+	buf := make([]byte, 4096)
+	n, err := syscall.ReadDirent(fd, buf)
+	CheckSuccess(err)
+
+	found := false
+	for off := 0; off < n; {
+		d := (*syscall.Dirent)(unsafe.Pointer(&buf[off]))
+		off += int(d.Reclen)
+		name := (*[256]byte)(unsafe.Pointer(&d.Name[0]))
+		if string(name[:4]) != "file" || name[4] != 0 {
+			continue
+		}
+		found = true
+		if d.Ino != st.Ino {
+			t.Errorf("d_ino %d, want %d", d.Ino, st.Ino)
+		}
+		if d.Type != syscall.DT_REG {
+			t.Errorf("d_type %d, want DT_REG", d.Type)
+		}
+	}
+	if !found {
+		t.Error("file not found in readdir")
+	}
+}
+
+// connectorReaddir returns the d_ino of the entries of the root, as
+// the connector sends them to the kernel.
+func connectorReaddir(t *testing.T, c *FileSystemConnector) map[string]uint64 {
+	header := &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}
+	var open raw.OpenOut
+	if code := c.OpenDir(&open, header, &raw.OpenIn{}); !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	defer c.ReleaseDir(header, &raw.ReleaseIn{Fh: open.Fh})
+	l := NewDirEntryList(make([]byte, 4096), 0)
+	if code := c.ReadDir(l, header, &ReadIn{Fh: open.Fh, Size: 4096}); !code.Ok() {
+		t.Fatalf("ReadDir: %v", code)
+	}
+	inos := map[string]uint64{}
+	buf := l.Bytes()
+	for off := 0; off < len(buf); {
+		d := (*raw.Dirent)(unsafe.Pointer(&buf[off]))
+		name := string(buf[off+direntSize : off+direntSize+int(d.NameLen)])
+		inos[name] = d.Ino
+		off += direntSize + (int(d.NameLen)+7)&^7
+	}
+	return inos
+}
+
+func TestReaddirInoMatchesStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(dir+"/file", []byte("hello"), 0644))
+
+	for _, stable := range []bool{false, true} {
+		pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), &PathNodeFsOptions{StableInodes: stable})
+		c := NewFileSystemConnector(pfs, nil)
+		if ino := connectorReaddir(t, c)["file"]; !stable && ino != raw.FUSE_UNKNOWN_INO {
+			t.Errorf("d_ino before lookup: got %d, want FUSE_UNKNOWN_INO", ino)
+		}
+
+		var entry raw.EntryOut
+		if code := c.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file"); !code.Ok() {
+			t.Fatalf("Lookup: %v", code)
+		}
+		var attr raw.AttrOut
+		if code := c.GetAttr(&attr, &raw.InHeader{NodeId: entry.NodeId}, &raw.GetAttrIn{}); !code.Ok() {
+			t.Fatalf("GetAttr: %v", code)
+		}
+		var root raw.AttrOut
+		if code := c.GetAttr(&root, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, &raw.GetAttrIn{}); !code.Ok() {
+			t.Fatalf("GetAttr: %v", code)
+		}
+		inos := connectorReaddir(t, c)
+		if inos["file"] != attr.Ino || inos["file"] != entry.Ino {
+			t.Errorf("stable %v: d_ino %d, st_ino %d, entry ino %d", stable, inos["file"], attr.Ino, entry.Ino)
+		}
+		if !stable && inos["."] != root.Ino {
+			t.Errorf("stable %v: d_ino of . %d, st_ino %d", stable, inos["."], root.Ino)
+		}
+	}
+}
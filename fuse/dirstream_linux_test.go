@@ -0,0 +1,121 @@
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// bigDirFs has a root directory with many entries, which are only
+// generated as they are read.
+type bigDirFs struct {
+	DefaultFileSystem
+	count int
+}
+
+func (fs *bigDirFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	if name == "" {
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	}
+	return &Attr{Mode: S_IFREG | 0644}, OK
+}
+
+func (fs *bigDirFs) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	return &bigDirStream{fs}, OK
+}
+
+type bigDirStream struct {
+	fs *bigDirFs
+}
+
+// ReadDir returns at most 100 entries; offset i is the start of
+// entry i.
+func (s *bigDirStream) ReadDir(offset uint64, context *Context) ([]DirEntry, Status) {
+	var entries []DirEntry
+	for i := int(offset); i < s.fs.count && len(entries) < 100; i++ {
+		entries = append(entries, DirEntry{
+			Name: fmt.Sprintf("f%05d", i),
+			Mode: S_IFREG,
+			Off:  uint64(i + 1),
+		})
+	}
+	return entries, OK
+}
+
+func (s *bigDirStream) Release() {}
+
+type rawDirent struct {
+	name string
+	off  int64
+}
+
+// readDirents reads one batch of entries from the directory fd.
+func readDirents(fd int, size int) []rawDirent {
+	buf := make([]byte, size)
+	n, err := syscall.ReadDirent(fd, buf)
+	CheckSuccess(err)
+	var out []rawDirent
+	for off := 0; off < n; {
+		d := (*syscall.Dirent)(unsafe.Pointer(&buf[off]))
+		off += int(d.Reclen)
+		name := (*[256]byte)(unsafe.Pointer(&d.Name[0]))[:]
+		for i, c := range name {
+			if c == 0 {
+				name = name[:i]
+				break
+			}
+		}
+		out = append(out, rawDirent{string(name), d.Off})
+	}
+	return out
+}
+
+func TestDirStream(t *testing.T) {
+	mnt, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(mnt)
+
+	fs := &bigDirFs{count: 10000}
+	state, _, err := MountNodeFileSystem(mnt, NewPathNodeFs(fs, nil), nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	// Raw syscalls, so the fd is not added to the Go poller.
+	fd, err := syscall.Open(mnt, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	CheckSuccess(err)
+	defer syscall.Close(fd)
+
+	seen := map[string]bool{}
+	var first []rawDirent
+	for {
+		batch := readDirents(fd, 4096)
+		if len(batch) == 0 {
+			break
+		}
+		if first == nil {
+			first = batch
+		}
+		for _, e := range batch {
+			if seen[e.name] {
+				t.Fatalf("duplicate entry %q", e.name)
+			}
+			seen[e.name] = true
+		}
+	}
+	if len(seen) != fs.count+2 || !seen["."] || !seen[".."] || !seen["f09999"] {
+		t.Errorf("got %d entries, want %d and . and ..", len(seen), fs.count+2)
+	}
+
+	// seekdir to the offset after an entry continues with the
+	// next one.
+	_, err = syscall.Seek(fd, first[4].off, os.SEEK_SET)
+	CheckSuccess(err)
+	if batch := readDirents(fd, 4096); len(batch) == 0 || batch[0].name != first[5].name {
+		t.Errorf("after seek to %d: got %v, want %q first", first[4].off, batch, first[5].name)
+	}
+}
@@ -0,0 +1,1005 @@
+package fuse
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// CacheWriteMode says when a DiskCacheFileSystem writes file data to
+// its backend.
+type CacheWriteMode int
+
+const (
+	// Pass writes on at once.
+	CACHE_WRITE_THROUGH = CacheWriteMode(iota)
+
+	// Write to a local copy, and upload it in the background once
+	// the file is closed.  Changes to names and attributes are
+	// still passed on at once.
+	CACHE_WRITE_BACK
+)
+
+type DiskCacheOptions struct {
+	// MaxBytes bounds the size of the cached file data.  Files
+	// waiting to be uploaded are not counted.  Defaults to 1 GiB.
+	MaxBytes int64
+
+	// BlockSize is the unit in which data is fetched and cached.
+	// Defaults to 256 KiB.
+	BlockSize int
+
+	// TTL is how long attributes and directory listings are used
+	// without asking the backend.  Defaults to a minute.
+	TTL time.Duration
+
+	WriteMode CacheWriteMode
+}
+
+// DiskCacheFileSystem is a wrapper that keeps file data, attributes
+// and directory listings of a slow backend, like a network file
+// system, in a local directory.  The cache survives remounts: data
+// is kept in blocks that are named after the path, size and mtime of
+// their file, so blocks of files that changed are not used, and the
+// least recently used ones are dropped when there are too many.
+// Attributes and listings are saved on SyncFs and unmount.
+//
+// Files that are waiting to be uploaded in CACHE_WRITE_BACK mode are
+// uploaded when the cache is opened again after a crash.
+type DiskCacheFileSystem struct {
+	FileSystem
+
+	dir     string
+	options DiskCacheOptions
+	blocks  *diskBlockCache
+
+	lock  sync.Mutex
+	attrs map[string]*cachedAttr
+	dirs  map[string]*cachedDir
+	// Files with local changes, by name.
+	dirty   map[string]*dirtyFile
+	uploads sync.WaitGroup
+}
+
+type cachedAttr struct {
+	Attr   *Attr
+	Status Status
+	Time   time.Time
+}
+
+type cachedDir struct {
+	Entries []DirEntry
+	Time    time.Time
+}
+
+type diskCacheMeta struct {
+	Attrs map[string]*cachedAttr
+	Dirs  map[string]*cachedDir
+}
+
+// NewDiskCacheFileSystem wraps fs, with the cache in dir.  Only one
+// file system at a time may use dir.
+func NewDiskCacheFileSystem(fs FileSystem, dir string, opts *DiskCacheOptions) (*DiskCacheFileSystem, error) {
+	c := &DiskCacheFileSystem{
+		FileSystem: fs,
+		dir:        dir,
+		attrs:      map[string]*cachedAttr{},
+		dirs:       map[string]*cachedDir{},
+		dirty:      map[string]*dirtyFile{},
+	}
+	if opts != nil {
+		c.options = *opts
+	}
+	if c.options.MaxBytes <= 0 {
+		c.options.MaxBytes = 1 << 30
+	}
+	if c.options.BlockSize <= 0 {
+		c.options.BlockSize = 256 << 10
+	}
+	if c.options.TTL <= 0 {
+		c.options.TTL = time.Minute
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "dirty"), 0700); err != nil {
+		return nil, err
+	}
+	var err error
+	if c.blocks, err = newDiskBlockCache(filepath.Join(dir, "blocks"), c.options.MaxBytes); err != nil {
+		return nil, err
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "meta.json")); err == nil {
+		var meta diskCacheMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			log.Printf("DiskCacheFileSystem: %s/meta.json: %v", dir, err)
+		} else {
+			if meta.Attrs != nil {
+				c.attrs = meta.Attrs
+			}
+			if meta.Dirs != nil {
+				c.dirs = meta.Dirs
+			}
+		}
+	}
+
+	// Upload what a crash left behind.
+	names, err := filepath.Glob(filepath.Join(dir, "dirty", "*.path"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range names {
+		name, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		d := &dirtyFile{
+			name:  string(name),
+			local: strings.TrimSuffix(p, ".path"),
+			ready: true,
+		}
+		c.dirty[d.name] = d
+		c.scheduleUpload(d)
+	}
+	return c, nil
+}
+
+func (fs *DiskCacheFileSystem) String() string {
+	return fmt.Sprintf("DiskCacheFileSystem(%s)", fs.FileSystem.String())
+}
+
+func (fs *DiskCacheFileSystem) fresh(t time.Time) bool {
+	return time.Now().Sub(t) < fs.options.TTL
+}
+
+// invalidateLocked drops what is known about name and its parent.
+// The caller must hold the lock.
+func (fs *DiskCacheFileSystem) invalidateLocked(name string) {
+	delete(fs.attrs, name)
+	delete(fs.dirs, name)
+	delete(fs.dirs, parentName(name))
+}
+
+func parentName(name string) string {
+	dir := filepath.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+func (fs *DiskCacheFileSystem) invalidate(names ...string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, n := range names {
+		fs.invalidateLocked(n)
+	}
+}
+
+// Invalidate drops the cached attributes and listings of name, eg.
+// after it was changed behind the cache's back.  Cached data is
+// dropped as the file's size or mtime change.
+func (fs *DiskCacheFileSystem) Invalidate(name string) {
+	fs.invalidate(name)
+}
+
+// Sync waits for uploads, retries those that failed, and saves the
+// attributes and listings.
+func (fs *DiskCacheFileSystem) Sync() Status {
+	fs.uploads.Wait()
+	fs.lock.Lock()
+	var pending []*dirtyFile
+	for _, d := range fs.dirty {
+		if d.refs == 0 {
+			pending = append(pending, d)
+		}
+	}
+	fs.lock.Unlock()
+	result := OK
+	for _, d := range pending {
+		if code := fs.upload(d); !code.Ok() {
+			result = code
+		}
+	}
+	if code := fs.saveMeta(); !code.Ok() && result.Ok() {
+		result = code
+	}
+	return result
+}
+
+func (fs *DiskCacheFileSystem) saveMeta() Status {
+	fs.lock.Lock()
+	data, err := json.Marshal(&diskCacheMeta{Attrs: fs.attrs, Dirs: fs.dirs})
+	fs.lock.Unlock()
+	if err != nil {
+		return ToStatus(err)
+	}
+	tmp := filepath.Join(fs.dir, "meta.json.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return ToStatus(err)
+	}
+	return ToStatus(os.Rename(tmp, filepath.Join(fs.dir, "meta.json")))
+}
+
+func (fs *DiskCacheFileSystem) SyncFs(context *Context) Status {
+	if code := fs.Sync(); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.SyncFs(context)
+}
+
+func (fs *DiskCacheFileSystem) OnUnmount(reason UnmountReason) {
+	if code := fs.Sync(); !code.Ok() {
+		log.Printf("DiskCacheFileSystem: sync on unmount: %v", code)
+	}
+	fs.FileSystem.OnUnmount(reason)
+}
+
+// backendAttr returns the attributes of name, from the cache if they
+// are fresh.
+func (fs *DiskCacheFileSystem) backendAttr(name string, context *Context) (*Attr, Status) {
+	fs.lock.Lock()
+	c := fs.attrs[name]
+	if c == nil && name != "" {
+		// A fresh listing of the parent knows which names
+		// do not exist.
+		if d := fs.dirs[parentName(name)]; d != nil && fs.fresh(d.Time) {
+			base := filepath.Base(name)
+			found := false
+			for _, e := range d.Entries {
+				if e.Name == base {
+					found = true
+					break
+				}
+			}
+			if !found {
+				fs.lock.Unlock()
+				return nil, ENOENT
+			}
+		}
+	}
+	fs.lock.Unlock()
+	if c != nil && fs.fresh(c.Time) {
+		if !c.Status.Ok() {
+			return nil, c.Status
+		}
+		a := *c.Attr
+		return &a, OK
+	}
+
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if code.Ok() || code == ENOENT {
+		c := &cachedAttr{Status: code, Time: time.Now()}
+		if a != nil {
+			copied := *a
+			c.Attr = &copied
+		}
+		fs.lock.Lock()
+		fs.attrs[name] = c
+		fs.lock.Unlock()
+	}
+	return a, code
+}
+
+func (fs *DiskCacheFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	a, code := fs.backendAttr(name, context)
+	if !code.Ok() {
+		return a, code
+	}
+	fs.lock.Lock()
+	d := fs.dirty[name]
+	fs.lock.Unlock()
+	if d != nil {
+		d.attr(a)
+	}
+	return a, code
+}
+
+func (fs *DiskCacheFileSystem) OpenDir(name string, context *Context) ([]DirEntry, Status) {
+	fs.lock.Lock()
+	d := fs.dirs[name]
+	fs.lock.Unlock()
+	if d != nil && fs.fresh(d.Time) {
+		return append([]DirEntry(nil), d.Entries...), OK
+	}
+	entries, code := fs.FileSystem.OpenDir(name, context)
+	if code.Ok() {
+		fs.lock.Lock()
+		fs.dirs[name] = &cachedDir{
+			Entries: append([]DirEntry(nil), entries...),
+			Time:    time.Now(),
+		}
+		fs.lock.Unlock()
+	}
+	return entries, code
+}
+
+// OpenDirStream returns ENOSYS, so directories are read with
+// OpenDir, which is cached.
+func (fs *DiskCacheFileSystem) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	return nil, ENOSYS
+}
+
+func (fs *DiskCacheFileSystem) Chmod(name string, mode uint32, context *Context) Status {
+	defer fs.invalidate(name)
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *DiskCacheFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) Status {
+	defer fs.invalidate(name)
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *DiskCacheFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *Context) Status {
+	defer fs.invalidate(name)
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *DiskCacheFileSystem) Truncate(name string, size uint64, context *Context) Status {
+	fs.lock.Lock()
+	d := fs.dirty[name]
+	fs.lock.Unlock()
+	if d != nil {
+		f, code := fs.Open(name, uint32(os.O_WRONLY), context)
+		if !code.Ok() {
+			return code
+		}
+		defer f.Release(&ReleaseIn{})
+		return f.Truncate(size, context)
+	}
+	defer fs.invalidate(name)
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *DiskCacheFileSystem) Link(oldName string, newName string, context *Context) Status {
+	defer fs.invalidate(oldName, newName)
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *DiskCacheFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	defer fs.invalidate(name)
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *DiskCacheFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	defer fs.invalidate(name)
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *DiskCacheFileSystem) Symlink(value string, linkName string, context *Context) Status {
+	defer fs.invalidate(linkName)
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *DiskCacheFileSystem) Rmdir(name string, context *Context) Status {
+	defer fs.invalidate(name)
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *DiskCacheFileSystem) Unlink(name string, context *Context) Status {
+	code := fs.FileSystem.Unlink(name, context)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.invalidateLocked(name)
+	if d := fs.dirty[name]; d != nil && code.Ok() {
+		// The local copy goes when the last handle is closed.
+		delete(fs.dirty, name)
+		if d.refs == 0 {
+			d.remove()
+		}
+	}
+	return code
+}
+
+// Rename moves local changes along, so they are uploaded to the new
+// name.
+func (fs *DiskCacheFileSystem) Rename(oldName string, newName string, context *Context) Status {
+	code := fs.FileSystem.Rename(oldName, newName, context)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.invalidateLocked(oldName)
+	fs.invalidateLocked(newName)
+	prefix := oldName + "/"
+	for name := range fs.attrs {
+		if strings.HasPrefix(name, prefix) {
+			delete(fs.attrs, name)
+		}
+	}
+	for name := range fs.dirs {
+		if strings.HasPrefix(name, prefix) {
+			delete(fs.dirs, name)
+		}
+	}
+	if !code.Ok() {
+		return code
+	}
+	if d := fs.dirty[newName]; d != nil {
+		delete(fs.dirty, newName)
+		if d.refs == 0 {
+			d.remove()
+		}
+	}
+	for name, d := range fs.dirty {
+		if name != oldName && !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		delete(fs.dirty, name)
+		d.name = newName + name[len(oldName):]
+		fs.dirty[d.name] = d
+		if err := ioutil.WriteFile(d.local+".path", []byte(d.name), 0600); err != nil {
+			log.Printf("DiskCacheFileSystem: %v", err)
+		}
+	}
+	return code
+}
+
+func (fs *DiskCacheFileSystem) Open(name string, flags uint32, context *Context) (File, Status) {
+	write := flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0
+	fs.lock.Lock()
+	d := fs.dirty[name]
+	fs.lock.Unlock()
+	if d != nil || (write && fs.options.WriteMode == CACHE_WRITE_BACK) {
+		return fs.openDirty(name, flags&syscall.O_TRUNC != 0, context)
+	}
+	if write {
+		f, code := fs.FileSystem.Open(name, flags, context)
+		fs.invalidate(name)
+		if !code.Ok() {
+			return nil, code
+		}
+		return &writeThroughFile{File: f, fs: fs, name: name}, OK
+	}
+
+	a, code := fs.backendAttr(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if !a.IsRegular() {
+		return fs.FileSystem.Open(name, flags, context)
+	}
+	return &diskCacheFile{fs: fs, name: name, attr: *a, flags: flags}, OK
+}
+
+func (fs *DiskCacheFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (File, Status) {
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	fs.invalidate(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if fs.options.WriteMode == CACHE_WRITE_THROUGH {
+		return &writeThroughFile{File: f, fs: fs, name: name}, OK
+	}
+	// The entry exists on the backend, and the data follows.
+	f.Release(&ReleaseIn{})
+	return fs.openDirty(name, true, context)
+}
+
+// dirtyFile is a file with local changes, in CACHE_WRITE_BACK mode.
+type dirtyFile struct {
+	// name and refs, the number of open handles, are protected by
+	// DiskCacheFileSystem.lock.
+	name string
+	refs int
+
+	// local holds the contents, and local+".path" the name.
+	local string
+	// gen counts changes, so an upload knows whether it got all.
+	gen int64
+
+	// lock serializes fetching and uploading.
+	lock  sync.Mutex
+	ready bool
+}
+
+// attr puts the size and times of the local copy in a.
+func (d *dirtyFile) attr(a *Attr) {
+	fi, err := os.Stat(d.local)
+	if err != nil {
+		return
+	}
+	local := ToAttr(fi)
+	a.Size = local.Size
+	a.Blocks = local.Blocks
+	a.Mtime, a.Mtimensec = local.Mtime, local.Mtimensec
+	a.Ctime, a.Ctimensec = local.Ctime, local.Ctimensec
+}
+
+func (d *dirtyFile) remove() {
+	os.Remove(d.local)
+	os.Remove(d.local + ".path")
+}
+
+// openDirty opens the local copy of name, fetching it first if
+// needed.
+func (fs *DiskCacheFileSystem) openDirty(name string, truncate bool, context *Context) (File, Status) {
+	fs.lock.Lock()
+	d := fs.dirty[name]
+	if d == nil {
+		h := sha1.Sum([]byte(name))
+		d = &dirtyFile{
+			name:  name,
+			local: filepath.Join(fs.dir, "dirty", fmt.Sprintf("%x", h)),
+		}
+		fs.dirty[name] = d
+	}
+	d.refs++
+	fs.lock.Unlock()
+
+	d.lock.Lock()
+	code := OK
+	if !d.ready {
+		code = fs.fetch(d, truncate, context)
+	} else if truncate {
+		code = ToStatus(os.Truncate(d.local, 0))
+		atomic.AddInt64(&d.gen, 1)
+	}
+	d.lock.Unlock()
+	var f *os.File
+	if code.Ok() {
+		var err error
+		f, err = os.OpenFile(d.local, os.O_RDWR, 0)
+		code = ToStatus(err)
+	}
+	if !code.Ok() {
+		fs.releaseDirty(d)
+		return nil, code
+	}
+	return &writeBackFile{File: &LoopbackFile{File: f}, fs: fs, data: d}, OK
+}
+
+// fetch makes the local copy of d.  The caller must hold d.lock.
+func (fs *DiskCacheFileSystem) fetch(d *dirtyFile, empty bool, context *Context) Status {
+	tmp, err := ioutil.TempFile(filepath.Dir(d.local), "fetch")
+	if err != nil {
+		return ToStatus(err)
+	}
+	defer os.Remove(tmp.Name())
+	if !empty {
+		src, code := fs.FileSystem.Open(d.name, uint32(os.O_RDONLY), context)
+		if !code.Ok() {
+			tmp.Close()
+			return code
+		}
+		for off := uint64(0); ; {
+			data, code := src.Read(&ReadIn{Offset: off, Size: uint32(fs.options.BlockSize)}, NewGcBufferPool())
+			if !code.Ok() {
+				src.Release(&ReleaseIn{})
+				tmp.Close()
+				return code
+			}
+			if len(data) == 0 {
+				break
+			}
+			if _, err := tmp.WriteAt(data, int64(off)); err != nil {
+				src.Release(&ReleaseIn{})
+				tmp.Close()
+				return ToStatus(err)
+			}
+			off += uint64(len(data))
+		}
+		src.Release(&ReleaseIn{})
+	}
+	if err := tmp.Close(); err != nil {
+		return ToStatus(err)
+	}
+	fs.lock.Lock()
+	name := d.name
+	fs.lock.Unlock()
+	if err := ioutil.WriteFile(d.local+".path", []byte(name), 0600); err != nil {
+		return ToStatus(err)
+	}
+	if err := os.Rename(tmp.Name(), d.local); err != nil {
+		return ToStatus(err)
+	}
+	d.ready = true
+	return OK
+}
+
+func (fs *DiskCacheFileSystem) releaseDirty(d *dirtyFile) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	d.refs--
+	if d.refs > 0 {
+		return
+	}
+	if fs.dirty[d.name] != d {
+		// Unlinked while open.
+		d.remove()
+		return
+	}
+	if !d.ready {
+		delete(fs.dirty, d.name)
+		return
+	}
+	fs.scheduleUpload(d)
+}
+
+// scheduleUpload uploads d in the background.  The caller must hold
+// the lock.
+func (fs *DiskCacheFileSystem) scheduleUpload(d *dirtyFile) {
+	fs.uploads.Add(1)
+	go func() {
+		defer fs.uploads.Done()
+		if code := fs.upload(d); !code.Ok() {
+			log.Printf("DiskCacheFileSystem: upload of %q: %v", d.name, code)
+		}
+	}()
+}
+
+// upload writes the local copy of d to the backend.  Once all of it
+// is written, and it is not open, the local copy is dropped.
+func (fs *DiskCacheFileSystem) upload(d *dirtyFile) Status {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	fs.lock.Lock()
+	name := d.name
+	gone := fs.dirty[name] != d
+	fs.lock.Unlock()
+	if gone {
+		return OK
+	}
+	gen := atomic.LoadInt64(&d.gen)
+
+	code := fs.copyUp(d.local, name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.invalidateLocked(name)
+	if code == ENOENT {
+		code = OK
+		gen = -1
+	}
+	if code.Ok() && fs.dirty[name] == d && d.refs == 0 && (gen < 0 || atomic.LoadInt64(&d.gen) == gen) {
+		delete(fs.dirty, name)
+		d.remove()
+	}
+	return code
+}
+
+func (fs *DiskCacheFileSystem) copyUp(local string, name string) Status {
+	src, err := os.Open(local)
+	if err != nil {
+		return ToStatus(err)
+	}
+	defer src.Close()
+	// The entry was made on the backend when the file was
+	// created, so if it is gone, it was removed.
+	dst, code := fs.FileSystem.Open(name, uint32(os.O_WRONLY|os.O_TRUNC), nil)
+	if !code.Ok() {
+		return code
+	}
+	defer dst.Release(&ReleaseIn{})
+	buf := make([]byte, fs.options.BlockSize)
+	for off := int64(0); ; {
+		n, err := src.ReadAt(buf, off)
+		if n > 0 {
+			if _, code := dst.Write(&WriteIn{Offset: uint64(off), Size: uint32(n)}, buf[:n]); !code.Ok() {
+				return code
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ToStatus(err)
+		}
+	}
+	return dst.Flush(&FlushIn{})
+}
+
+// writeBackFile is a handle of the local copy of a file.
+type writeBackFile struct {
+	File
+	fs   *DiskCacheFileSystem
+	data *dirtyFile
+}
+
+func (f *writeBackFile) String() string {
+	return fmt.Sprintf("writeBackFile(%s)", f.File.String())
+}
+
+func (f *writeBackFile) InnerFile() File {
+	return f.File
+}
+
+func (f *writeBackFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	atomic.AddInt64(&f.data.gen, 1)
+	return f.File.Write(input, data)
+}
+
+func (f *writeBackFile) Truncate(size uint64, context *Context) Status {
+	atomic.AddInt64(&f.data.gen, 1)
+	return f.File.Truncate(size, context)
+}
+
+func (f *writeBackFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	atomic.AddInt64(&f.data.gen, 1)
+	return f.File.Setattr(valid, attr, context)
+}
+
+// GetAttr shows the attributes of the backend, with the size and
+// times of the local copy.
+func (f *writeBackFile) GetAttr(out *Attr) Status {
+	f.fs.lock.Lock()
+	name := f.data.name
+	f.fs.lock.Unlock()
+	a, code := f.fs.backendAttr(name, nil)
+	if !code.Ok() {
+		return f.File.GetAttr(out)
+	}
+	f.data.attr(a)
+	*out = *a
+	return OK
+}
+
+// Chown, Chmod and Utimens go to the backend.
+func (f *writeBackFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	return f.fs.Chown(f.data.name, uid, gid, context)
+}
+
+func (f *writeBackFile) Chmod(perms uint32, context *Context) Status {
+	return f.fs.Chmod(f.data.name, perms, context)
+}
+
+func (f *writeBackFile) Release(input *ReleaseIn) {
+	f.File.Release(input)
+	f.fs.releaseDirty(f.data)
+}
+
+// writeThroughFile drops cached attributes when the file changes.
+type writeThroughFile struct {
+	File
+	fs   *DiskCacheFileSystem
+	name string
+}
+
+func (f *writeThroughFile) String() string {
+	return fmt.Sprintf("writeThroughFile(%s)", f.File.String())
+}
+
+func (f *writeThroughFile) InnerFile() File {
+	return f.File
+}
+
+func (f *writeThroughFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	defer f.fs.invalidate(f.name)
+	return f.File.Write(input, data)
+}
+
+func (f *writeThroughFile) Truncate(size uint64, context *Context) Status {
+	defer f.fs.invalidate(f.name)
+	return f.File.Truncate(size, context)
+}
+
+func (f *writeThroughFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	defer f.fs.invalidate(f.name)
+	return f.File.Setattr(valid, attr, context)
+}
+
+func (f *writeThroughFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	defer f.fs.invalidate(f.name)
+	return f.File.Chown(uid, gid, context)
+}
+
+func (f *writeThroughFile) Chmod(perms uint32, context *Context) Status {
+	defer f.fs.invalidate(f.name)
+	return f.File.Chmod(perms, context)
+}
+
+func (f *writeThroughFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	defer f.fs.invalidate(f.name)
+	return f.File.Utimens(atime, mtime, context)
+}
+
+func (f *writeThroughFile) Release(input *ReleaseIn) {
+	f.File.Release(input)
+	f.fs.invalidate(f.name)
+}
+
+// diskCacheFile reads a file through the block cache.  The backend
+// file is opened at the first block that is not cached.
+type diskCacheFile struct {
+	DefaultFile
+	fs    *DiskCacheFileSystem
+	name  string
+	attr  Attr
+	flags uint32
+
+	lock    sync.Mutex
+	backend File
+}
+
+func (f *diskCacheFile) String() string {
+	return fmt.Sprintf("diskCacheFile(%q)", f.name)
+}
+
+func (f *diskCacheFile) blockKey(n uint64) string {
+	h := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d.%d\x00%d\x00%d",
+		f.name, f.attr.Size, f.attr.Mtime, f.attr.Mtimensec, f.fs.options.BlockSize, n)))
+	return fmt.Sprintf("%x.blk", h)
+}
+
+// block returns block n, from the cache or the backend.
+func (f *diskCacheFile) block(n uint64) ([]byte, Status) {
+	key := f.blockKey(n)
+	if data, ok := f.fs.blocks.get(key); ok {
+		return data, OK
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.backend == nil {
+		backend, code := f.fs.FileSystem.Open(f.name, f.flags, nil)
+		if !code.Ok() {
+			return nil, code
+		}
+		f.backend = backend
+	}
+	bs := uint64(f.fs.options.BlockSize)
+	data, code := f.backend.Read(&ReadIn{Offset: n * bs, Size: uint32(bs)}, NewGcBufferPool())
+	if !code.Ok() {
+		return nil, code
+	}
+	data = append([]byte(nil), data...)
+	want := bs
+	if rest := f.attr.Size - n*bs; rest < want {
+		want = rest
+	}
+	// A short block means the file changed; do not keep it.
+	if uint64(len(data)) == want {
+		f.fs.blocks.put(key, data)
+	}
+	return data, OK
+}
+
+func (f *diskCacheFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	end := input.Offset + uint64(input.Size)
+	if end > f.attr.Size {
+		end = f.attr.Size
+	}
+	if input.Offset >= end {
+		return nil, OK
+	}
+	bs := uint64(f.fs.options.BlockSize)
+	out := make([]byte, 0, end-input.Offset)
+	for off := input.Offset; off < end; {
+		n := off / bs
+		data, code := f.block(n)
+		if !code.Ok() {
+			return nil, code
+		}
+		start := off - n*bs
+		if start >= uint64(len(data)) {
+			break
+		}
+		stop := uint64(len(data))
+		if n*bs+stop > end {
+			stop = end - n*bs
+		}
+		out = append(out, data[start:stop]...)
+		off = n*bs + stop
+	}
+	return out, OK
+}
+
+func (f *diskCacheFile) GetAttr(out *Attr) Status {
+	*out = f.attr
+	return OK
+}
+
+func (f *diskCacheFile) Release(input *ReleaseIn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.backend != nil {
+		f.backend.Release(input)
+	}
+}
+
+// diskBlockCache keeps blocks in files in a directory.  The least
+// recently used blocks are dropped when the blocks take more than
+// max bytes.
+type diskBlockCache struct {
+	dir string
+	max int64
+
+	lock  sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	sizes map[string]int64
+	used  int64
+}
+
+func newDiskBlockCache(dir string, max int64) (*diskBlockCache, error) {
+	c := &diskBlockCache{
+		dir:   dir,
+		max:   max,
+		lru:   list.New(),
+		items: map[string]*list.Element{},
+		sizes: map[string]int64{},
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Blocks of earlier mounts are used again, oldest first out.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != ".blk" {
+			continue
+		}
+		c.items[fi.Name()] = c.lru.PushBack(fi.Name())
+		c.sizes[fi.Name()] = fi.Size()
+		c.used += fi.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+func (c *diskBlockCache) remove(e *list.Element) {
+	key := c.lru.Remove(e).(string)
+	delete(c.items, key)
+	c.used -= c.sizes[key]
+	delete(c.sizes, key)
+	os.Remove(filepath.Join(c.dir, key))
+}
+
+func (c *diskBlockCache) evict() {
+	for c.used > c.max && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *diskBlockCache) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e := c.items[key]
+	if e == nil {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	p := filepath.Join(c.dir, key)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		c.remove(e)
+		return nil, false
+	}
+	// The modification time orders blocks on the next start.
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+func (c *diskBlockCache) put(key string, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.items[key] != nil {
+		return
+	}
+	// Write and rename, so a crash never leaves a partial block.
+	tmp := filepath.Join(c.dir, key+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(c.dir, key)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	c.items[key] = c.lru.PushFront(key)
+	c.sizes[key] = int64(len(data))
+	c.used += int64(len(data))
+	c.evict()
+}
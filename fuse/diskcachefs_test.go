@@ -0,0 +1,190 @@
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingFileSystem counts the calls that reach the backend.
+type countingFileSystem struct {
+	FileSystem
+	getAttrs int
+	reads    int
+}
+
+func (fs *countingFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	fs.getAttrs++
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *countingFileSystem) Open(name string, flags uint32, context *Context) (File, Status) {
+	f, code := fs.FileSystem.Open(name, flags, context)
+	if code.Ok() {
+		f = &countingFile{f, fs}
+	}
+	return f, code
+}
+
+type countingFile struct {
+	File
+	fs *countingFileSystem
+}
+
+func (f *countingFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	f.fs.reads++
+	return f.File.Read(input, bp)
+}
+
+func setupDiskCacheFs(t *testing.T, opts *DiskCacheOptions) (backend string, cache string, clean func()) {
+	backend, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	cache, err = ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	return backend, cache, func() {
+		os.RemoveAll(backend)
+		os.RemoveAll(cache)
+	}
+}
+
+func readAll(t *testing.T, fs FileSystem, name string) []byte {
+	f, code := fs.Open(name, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open(%q): %v", name, code)
+	}
+	defer f.Release(&ReleaseIn{})
+	data, code := f.Read(&ReadIn{Size: 1 << 20}, NewBufferPool())
+	if !code.Ok() {
+		t.Fatalf("Read(%q): %v", name, code)
+	}
+	return data
+}
+
+func TestDiskCacheFs(t *testing.T) {
+	backendDir, cacheDir, clean := setupDiskCacheFs(t, nil)
+	defer clean()
+	want := bytes.Repeat([]byte("0123456789"), 1000)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(backendDir, "file"), want, 0644))
+
+	backend := &countingFileSystem{FileSystem: NewLoopbackFileSystem(backendDir)}
+	opts := &DiskCacheOptions{BlockSize: 4096, MaxBytes: 12000}
+	fs, err := NewDiskCacheFileSystem(backend, cacheDir, opts)
+	CheckSuccess(err)
+
+	if got := readAll(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes", len(got))
+	}
+	if got := readAll(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Errorf("second read: %d bytes", len(got))
+	}
+	if backend.reads != 3 {
+		t.Errorf("backend reads: %d", backend.reads)
+	}
+	if backend.getAttrs != 1 {
+		t.Errorf("backend GetAttrs: %d", backend.getAttrs)
+	}
+
+	// A listing answers for missing names.
+	fs.OpenDir("", nil)
+	if _, code := fs.GetAttr("missing", nil); code != ENOENT {
+		t.Errorf("missing: %v", code)
+	}
+	if backend.getAttrs != 1 {
+		t.Errorf("backend GetAttrs: %d", backend.getAttrs)
+	}
+
+	// Writes go through and drop the attributes.
+	f, code := fs.Open("file", uint32(os.O_WRONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	f.Write(&WriteIn{Offset: 9998}, []byte("abcd"))
+	f.Release(&ReleaseIn{})
+	want = append(want[:9998], "abcd"...)
+	if got := readAll(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Errorf("after write: %q", got[9990:])
+	}
+	// The blocks of the old contents make room for the new ones.
+	blocks, _ := ioutil.ReadDir(filepath.Join(cacheDir, "blocks"))
+	size := int64(0)
+	for _, b := range blocks {
+		size += b.Size()
+	}
+	if size > opts.MaxBytes || len(blocks) != 4 {
+		t.Errorf("cache has %d blocks, %d bytes", len(blocks), size)
+	}
+
+	// The cache survives a remount.
+	if code := fs.Sync(); !code.Ok() {
+		t.Fatalf("Sync: %v", code)
+	}
+	backend = &countingFileSystem{FileSystem: NewLoopbackFileSystem(backendDir)}
+	fs, err = NewDiskCacheFileSystem(backend, cacheDir, opts)
+	CheckSuccess(err)
+	f, _ = fs.Open("file", uint32(os.O_RDONLY), nil)
+	data, _ := f.Read(&ReadIn{Offset: 8192, Size: 4096}, NewBufferPool())
+	f.Release(&ReleaseIn{})
+	if !bytes.Equal(data, want[8192:]) || backend.reads != 0 || backend.getAttrs != 0 {
+		t.Errorf("after remount: %d bytes, %d reads, %d GetAttrs", len(data), backend.reads, backend.getAttrs)
+	}
+}
+
+func TestDiskCacheFsWriteBack(t *testing.T) {
+	backendDir, cacheDir, clean := setupDiskCacheFs(t, nil)
+	defer clean()
+	CheckSuccess(ioutil.WriteFile(filepath.Join(backendDir, "old"), []byte("old data"), 0644))
+	opts := &DiskCacheOptions{WriteMode: CACHE_WRITE_BACK}
+	fs, err := NewDiskCacheFileSystem(NewLoopbackFileSystem(backendDir), cacheDir, opts)
+	CheckSuccess(err)
+
+	f, code := fs.Create("new", uint32(os.O_WRONLY|os.O_CREATE), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Write(&WriteIn{}, []byte("hello"))
+	if data, _ := ioutil.ReadFile(filepath.Join(backendDir, "new")); len(data) != 0 {
+		t.Errorf("backend has %q before close", data)
+	}
+	if a, _ := fs.GetAttr("new", nil); a.Size != 5 {
+		t.Errorf("size while open: %d", a.Size)
+	}
+	f.Release(&ReleaseIn{})
+
+	f, _ = fs.Open("old", uint32(os.O_RDWR), nil)
+	f.Write(&WriteIn{Offset: 0}, []byte("new"))
+	if code := fs.Rename("old", "renamed", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	f.Release(&ReleaseIn{})
+
+	if code := fs.Sync(); !code.Ok() {
+		t.Fatalf("Sync: %v", code)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(backendDir, "new")); string(data) != "hello" {
+		t.Errorf("new: %q", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(backendDir, "renamed")); string(data) != "new data" {
+		t.Errorf("renamed: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(backendDir, "old")); err == nil {
+		t.Errorf("old name came back")
+	}
+	if names, _ := ioutil.ReadDir(filepath.Join(cacheDir, "dirty")); len(names) != 0 {
+		t.Errorf("local copies left: %v", names[0].Name())
+	}
+
+	// A local copy that was not uploaded is uploaded by the next
+	// mount.
+	f, _ = fs.Open("new", uint32(os.O_WRONLY|os.O_TRUNC), nil)
+	f.Write(&WriteIn{}, []byte("crash"))
+	fs, err = NewDiskCacheFileSystem(NewLoopbackFileSystem(backendDir), cacheDir, opts)
+	CheckSuccess(err)
+	if code := fs.Sync(); !code.Ok() {
+		t.Fatalf("Sync: %v", code)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(backendDir, "new")); string(data) != "crash" {
+		t.Errorf("after crash: %q", data)
+	}
+}
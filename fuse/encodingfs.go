@@ -0,0 +1,213 @@
+package fuse
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+)
+
+// NameEncoding is the character encoding of the names in a file
+// system.  Multi-byte encodings such as Shift-JIS can be provided by
+// wrapping the decoders of golang.org/x/text.
+type NameEncoding interface {
+	// DecodeRune decodes the first character of b.  It returns a
+	// size of 0 if b does not start with a valid character.
+	DecodeRune(b []byte) (r rune, size int)
+
+	// AppendRune appends the encoding of r to b.  It returns
+	// false if r has no encoding.
+	AppendRune(b []byte, r rune) ([]byte, bool)
+}
+
+type utf8Encoding struct{}
+
+func (utf8Encoding) DecodeRune(b []byte) (rune, int) {
+	r, size := utf8.DecodeRune(b)
+	if r == utf8.RuneError && size <= 1 {
+		return r, 0
+	}
+	return r, size
+}
+
+func (utf8Encoding) AppendRune(b []byte, r rune) ([]byte, bool) {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	return append(b, buf[:n]...), true
+}
+
+// UTF8 is for file systems that should hold UTF-8, but may have
+// invalid names.  The invalid bytes are escaped.
+var UTF8 NameEncoding = utf8Encoding{}
+
+// singleByteEncoding maps each byte to a character.
+type singleByteEncoding struct {
+	decode [256]rune
+	encode map[rune]byte
+}
+
+// NewSingleByteEncoding returns the encoding that maps each byte
+// to the character in table.  Bytes that map to utf8.RuneError are
+// not characters.
+func NewSingleByteEncoding(table [256]rune) NameEncoding {
+	e := &singleByteEncoding{
+		decode: table,
+		encode: map[rune]byte{},
+	}
+	for b, r := range table {
+		if r != utf8.RuneError {
+			e.encode[r] = byte(b)
+		}
+	}
+	return e
+}
+
+func (e *singleByteEncoding) DecodeRune(b []byte) (rune, int) {
+	if r := e.decode[b[0]]; r != utf8.RuneError {
+		return r, 1
+	}
+	return utf8.RuneError, 0
+}
+
+func (e *singleByteEncoding) AppendRune(b []byte, r rune) ([]byte, bool) {
+	c, ok := e.encode[r]
+	return append(b, c), ok
+}
+
+// Latin1 is ISO 8859-1, whose bytes are the first 256 Unicode
+// characters.
+var Latin1 NameEncoding
+
+func init() {
+	var table [256]rune
+	for i := range table {
+		table[i] = rune(i)
+	}
+	Latin1 = NewSingleByteEncoding(table)
+}
+
+// EncodingFileSystem is a wrapper for file systems whose names are
+// not in UTF-8.  Names, and the targets of symlinks, are shown in
+// UTF-8, and converted back for the wrapped FileSystem.
+//
+// Bytes that are not valid in the encoding are shown as %XX, with
+// the hexadecimal value of the byte, so all names can be opened and
+// renamed.  To round-trip, a % followed by two hexadecimal digits is
+// shown as %25; likewise, a %XX written by the caller always stands
+// for a byte.  Names with characters that the encoding lacks give
+// EILSEQ.
+type EncodingFileSystem struct {
+	FileSystem
+
+	encoding NameEncoding
+}
+
+// NewEncodingFileSystem wraps fs, whose names are in enc.
+func NewEncodingFileSystem(fs FileSystem, enc NameEncoding) *EncodingFileSystem {
+	e := &EncodingFileSystem{encoding: enc}
+	e.FileSystem = &rewriteFileSystem{fs, e.encode}
+	return e
+}
+
+func (fs *EncodingFileSystem) String() string {
+	return fmt.Sprintf("EncodingFileSystem(%s)", fs.FileSystem.String())
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// decode converts a name of the wrapped file system to UTF-8.
+func (fs *EncodingFileSystem) decode(name string) string {
+	b := []byte(name)
+	var out strings.Builder
+	for len(b) > 0 {
+		if b[0] == '%' && len(b) >= 3 && isHex(b[1]) && isHex(b[2]) {
+			out.WriteString("%25")
+			b = b[1:]
+			continue
+		}
+		r, size := fs.encoding.DecodeRune(b)
+		if size == 0 {
+			fmt.Fprintf(&out, "%%%02X", b[0])
+			b = b[1:]
+			continue
+		}
+		out.WriteRune(r)
+		b = b[size:]
+	}
+	return out.String()
+}
+
+// encode is the PathRewriter from UTF-8 names to the encoding.
+func (fs *EncodingFileSystem) encode(name string) (string, Status) {
+	out := make([]byte, 0, len(name))
+	for i := 0; i < len(name); {
+		if name[i] == '%' && i+2 < len(name) && isHex(name[i+1]) && isHex(name[i+2]) {
+			out = append(out, unhex(name[i+1])<<4|unhex(name[i+2]))
+			i += 3
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(name[i:])
+		var ok bool
+		if out, ok = fs.encoding.AppendRune(out, r); !ok || r == utf8.RuneError && size <= 1 {
+			return "", Status(syscall.EILSEQ)
+		}
+		i += size
+	}
+	return string(out), OK
+}
+
+func (fs *EncodingFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, code Status) {
+	stream, code = fs.FileSystem.OpenDir(name, context)
+	for i := range stream {
+		stream[i].Name = fs.decode(stream[i].Name)
+	}
+	return stream, code
+}
+
+func (fs *EncodingFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, code Status) {
+	stream, code = fs.FileSystem.OpenDirStream(name, context)
+	if !code.Ok() {
+		return stream, code
+	}
+	return &encodingDirStream{stream, fs}, code
+}
+
+func (fs *EncodingFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	if value, code = fs.encode(value); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *EncodingFileSystem) Readlink(name string, context *Context) (string, Status) {
+	value, code := fs.FileSystem.Readlink(name, context)
+	if !code.Ok() {
+		return value, code
+	}
+	return fs.decode(value), code
+}
+
+type encodingDirStream struct {
+	DirStream
+	fs *EncodingFileSystem
+}
+
+func (s *encodingDirStream) ReadDir(offset uint64, context *Context) ([]DirEntry, Status) {
+	entries, code := s.DirStream.ReadDir(offset, context)
+	for i := range entries {
+		entries[i].Name = s.fs.decode(entries[i].Name)
+	}
+	return entries, code
+}
@@ -0,0 +1,75 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestEncodingFsLatin1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	// "café" in Latin-1, and a name with a literal %41.
+	for _, n := range []string{"caf\xe9", "x%41"} {
+		CheckSuccess(ioutil.WriteFile(dir+"/"+n, []byte(n), 0644))
+	}
+
+	fs := NewEncodingFileSystem(NewLoopbackFileSystem(dir), Latin1)
+	entries, code := fs.OpenDir("", nil)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, " "), "café x%2541"; !code.Ok() || got != want {
+		t.Errorf("OpenDir: got %q, %v, want %q", got, code, want)
+	}
+	for _, n := range names {
+		if _, code := fs.GetAttr(n, nil); !code.Ok() {
+			t.Errorf("GetAttr(%q): %v", n, code)
+		}
+	}
+
+	f, code := fs.Create("naïve", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release(&ReleaseIn{})
+	if code := fs.Rename("naïve", "résumé", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if _, err := os.Lstat(dir + "/r\xe9sum\xe9"); err != nil {
+		t.Errorf("Lstat backing name: %v", err)
+	}
+	if code := fs.Symlink("café", "link", nil); !code.Ok() {
+		t.Fatalf("Symlink: %v", code)
+	}
+	if val, code := fs.Readlink("link", nil); val != "café" {
+		t.Errorf("Readlink: got %q, %v", val, code)
+	}
+	if _, code := fs.Create("日本", uint32(os.O_WRONLY), 0644, nil); code != Status(syscall.EILSEQ) {
+		t.Errorf("Create unmappable: got %v, want EILSEQ", code)
+	}
+}
+
+func TestEncodingFsUTF8Escape(t *testing.T) {
+	fs := &EncodingFileSystem{encoding: UTF8}
+	for backing, shown := range map[string]string{
+		"ok":         "ok",
+		"bad\xff":    "bad%FF",
+		"100%":       "100%",
+		"%ff":        "%25ff",
+		"日本\xe6\x97": "日本%E6%97",
+	} {
+		if got := fs.decode(backing); got != shown {
+			t.Errorf("decode(%q): got %q, want %q", backing, got, shown)
+		}
+		if got, code := fs.encode(shown); got != backing || !code.Ok() {
+			t.Errorf("encode(%q): got %q, %v, want %q", shown, got, code, backing)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestEvictInodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 6; i++ {
+		CheckSuccess(ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), nil, 0644))
+	}
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), nil)
+	c := NewFileSystemConnector(pfs, nil)
+	var notified []string
+	c.Init(&RawFsInit{
+		EntryNotify: func(parent uint64, name string) Status {
+			if parent != raw.FUSE_ROOT_ID {
+				t.Errorf("notify %q: parent %d", name, parent)
+			}
+			notified = append(notified, name)
+			return OK
+		},
+	})
+
+	rootHeader := &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}
+	for i := 0; i < 5; i++ {
+		out := raw.EntryOut{}
+		if code := c.Lookup(&out, rootHeader, fmt.Sprintf("file%d", i)); !code.Ok() {
+			t.Fatal("Lookup:", code)
+		}
+	}
+	// Only known to us, not to the kernel.
+	if pfs.LookupNode("file5") == nil {
+		t.Fatal("LookupNode failed")
+	}
+
+	s := c.InodeStats()
+	if s.Inodes != 7 || s.KernelInodes != 6 || s.Bytes <= 0 {
+		t.Errorf("stats: %+v", s)
+	}
+
+	if n := c.EvictInodes(3); n != 3 || len(notified) != 3 {
+		t.Errorf("EvictInodes: got %d, notified %v", n, notified)
+	}
+	if s := c.InodeStats(); s.Inodes != 6 {
+		t.Errorf("unused node not dropped: %+v", s)
+	}
+}
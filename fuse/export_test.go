@@ -0,0 +1,89 @@
+package fuse
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+type exportNodeFs struct {
+	DefaultNodeFileSystem
+	root *exportNode
+}
+
+func (fs *exportNodeFs) Root() FsNode {
+	return fs.root
+}
+
+type exportNode struct {
+	DefaultFsNode
+	dir bool
+}
+
+func (n *exportNode) GetAttr(out *Attr, file File, context *Context) Status {
+	out.Mode = S_IFREG | 0644
+	if n.dir {
+		out.Mode = S_IFDIR | 0755
+	}
+	return OK
+}
+
+func (n *exportNode) Lookup(out *Attr, name string, context *Context) (FsNode, Status) {
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		isDir := name == "dir"
+		ch = n.Inode().New(isDir, &exportNode{dir: isDir})
+		n.Inode().AddChild(name, ch)
+	}
+	return ch.FsNode(), ch.FsNode().GetAttr(out, nil, context)
+}
+
+func TestPersistentInodes(t *testing.T) {
+	fs := &exportNodeFs{root: &exportNode{dir: true}}
+	opts := NewFileSystemOptions()
+	opts.PersistentInodes = true
+	c := NewFileSystemConnector(fs, opts)
+
+	lookup := func(nodeId uint64, name string) (raw.EntryOut, Status) {
+		out := raw.EntryOut{}
+		code := c.Lookup(&out, &raw.InHeader{NodeId: nodeId}, name)
+		return out, code
+	}
+
+	dir, code := lookup(raw.FUSE_ROOT_ID, "dir")
+	if !code.Ok() {
+		t.Fatal("Lookup dir:", code)
+	}
+	file, code := lookup(dir.NodeId, "file")
+	if !code.Ok() {
+		t.Fatal("Lookup file:", code)
+	}
+	if file.Generation != dir.Generation || file.Generation == 0 {
+		t.Errorf("generations: dir %d, file %d", dir.Generation, file.Generation)
+	}
+
+	// The kernel may resolve a file handle after forgetting the node.
+	c.Forget(file.NodeId, 1)
+	self, code := lookup(file.NodeId, ".")
+	if !code.Ok() || self.NodeId != file.NodeId || self.Generation != file.Generation {
+		t.Errorf(`Lookup "." after forget: %v, id %d gen %d, want id %d gen %d`,
+			code, self.NodeId, self.Generation, file.NodeId, file.Generation)
+	}
+	c.Forget(self.NodeId, 1)
+
+	parent, code := lookup(dir.NodeId, "..")
+	if !code.Ok() || parent.NodeId != raw.FUSE_ROOT_ID {
+		t.Errorf(`Lookup ".." of dir: %v, id %d`, code, parent.NodeId)
+	}
+	c.Forget(parent.NodeId, 1)
+
+	c.toInode(dir.NodeId).RmChild("file")
+	if _, code := lookup(file.NodeId, "."); code != ESTALE {
+		t.Errorf(`Lookup "." of dropped node: got %v, want ESTALE`, code)
+	}
+
+	again, code := lookup(dir.NodeId, "file")
+	if !code.Ok() || again.NodeId == file.NodeId {
+		t.Errorf("node ID %d reused after drop", again.NodeId)
+	}
+}
@@ -0,0 +1,387 @@
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type FailoverOptions struct {
+	// Timeout fails a read that takes longer over to the next
+	// backend.  The slow call is left to finish, and its result
+	// is dropped.  Zero waits for ever.
+	Timeout time.Duration
+
+	// DownTime is how long a backend is skipped after it failed.
+	// Defaults to 30 seconds.
+	DownTime time.Duration
+
+	// If Sticky is set, reads stay on the backend that the file
+	// system failed over to, until it fails too.  Otherwise they
+	// go back to the primary when it is no longer down.
+	Sticky bool
+}
+
+// FailoverFileSystem is a wrapper for backends that hold the same
+// data, eg. replicas of network storage.  Reads go to the active
+// backend, at first the primary, and if that fails with an error of
+// the backend rather than of the request, like EIO or ETIMEDOUT, to
+// the next backend that is up.  Files opened for reading fail over
+// too.  Changes only go to the primary.
+type FailoverFileSystem struct {
+	FileSystem
+
+	options  FailoverOptions
+	backends []*failoverBackend
+
+	lock   sync.Mutex
+	active int
+}
+
+type failoverBackend struct {
+	fs FileSystem
+
+	// Protected by FailoverFileSystem.lock.
+	failures  int
+	downUntil time.Time
+	lastError Status
+}
+
+// FailoverBackendStatus describes the health of a backend.
+type FailoverBackendStatus struct {
+	Name   string
+	Active bool
+	Up     bool
+	// Failures counts the failures since the last success.
+	Failures  int
+	LastError Status
+}
+
+// NewFailoverFileSystem returns a FailoverFileSystem that prefers
+// backends in the order given.  The first is the primary.
+func NewFailoverFileSystem(backends []FileSystem, opts *FailoverOptions) *FailoverFileSystem {
+	fs := &FailoverFileSystem{FileSystem: backends[0]}
+	if opts != nil {
+		fs.options = *opts
+	}
+	if fs.options.DownTime <= 0 {
+		fs.options.DownTime = 30 * time.Second
+	}
+	for _, b := range backends {
+		fs.backends = append(fs.backends, &failoverBackend{fs: b})
+	}
+	return fs
+}
+
+func (fs *FailoverFileSystem) String() string {
+	var names []string
+	for _, b := range fs.backends {
+		names = append(names, b.fs.String())
+	}
+	return fmt.Sprintf("FailoverFileSystem(%s)", strings.Join(names, ", "))
+}
+
+// Backends returns the state of the backends, in order.
+func (fs *FailoverFileSystem) Backends() []FailoverBackendStatus {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	now := time.Now()
+	var result []FailoverBackendStatus
+	for i, b := range fs.backends {
+		result = append(result, FailoverBackendStatus{
+			Name:      b.fs.String(),
+			Active:    i == fs.active,
+			Up:        !now.Before(b.downUntil),
+			Failures:  b.failures,
+			LastError: b.lastError,
+		})
+	}
+	return result
+}
+
+// isBackendError returns true for errors that say the backend, rather
+// than the request, has a problem.
+func isBackendError(code Status) bool {
+	switch syscall.Errno(code) {
+	case syscall.EIO, syscall.ETIMEDOUT, syscall.ENOTCONN, syscall.ESTALE,
+		syscall.EHOSTDOWN, syscall.EHOSTUNREACH, syscall.ENETDOWN,
+		syscall.ENETUNREACH, syscall.ECONNREFUSED, syscall.ECONNRESET,
+		syscall.ECONNABORTED, syscall.EAGAIN:
+		return true
+	}
+	return false
+}
+
+// order returns the backends to try, the active one first.
+func (fs *FailoverFileSystem) order() []int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	now := time.Now()
+	if !fs.options.Sticky || now.Before(fs.backends[fs.active].downUntil) {
+		for i, b := range fs.backends {
+			if !now.Before(b.downUntil) {
+				fs.active = i
+				break
+			}
+		}
+	}
+	// Backends that are down come last, in case all are.
+	order := []int{fs.active}
+	var down []int
+	for i, b := range fs.backends {
+		if i == fs.active {
+			continue
+		}
+		if now.Before(b.downUntil) {
+			down = append(down, i)
+		} else {
+			order = append(order, i)
+		}
+	}
+	return append(order, down...)
+}
+
+func (fs *FailoverFileSystem) succeeded(i int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	b := fs.backends[i]
+	b.failures = 0
+	b.downUntil = time.Time{}
+	if fs.active != i && (fs.options.Sticky || time.Now().Before(fs.backends[fs.active].downUntil)) {
+		fs.active = i
+	}
+}
+
+func (fs *FailoverFileSystem) failed(i int, code Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	b := fs.backends[i]
+	b.failures++
+	b.lastError = code
+	b.downUntil = time.Now().Add(fs.options.DownTime)
+	log.Printf("FailoverFileSystem: %s failed with %v", b.fs.String(), code)
+}
+
+// call runs do on backend i, within the timeout.
+func (fs *FailoverFileSystem) call(i int, do func(fs FileSystem) (interface{}, Status)) (interface{}, Status) {
+	b := fs.backends[i].fs
+	if fs.options.Timeout <= 0 {
+		return do(b)
+	}
+	type result struct {
+		val  interface{}
+		code Status
+	}
+	done := make(chan result, 1)
+	timedOut := make(chan struct{})
+	go func() {
+		val, code := do(b)
+		select {
+		case done <- result{val, code}:
+		case <-timedOut:
+			if f, ok := val.(File); ok && code.Ok() {
+				f.Release(&ReleaseIn{})
+			}
+		}
+	}()
+	timer := time.NewTimer(fs.options.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.val, r.code
+	case <-timer.C:
+	}
+	close(timedOut)
+	// The call may have finished meanwhile.
+	select {
+	case r := <-done:
+		return r.val, r.code
+	default:
+	}
+	return nil, Status(syscall.ETIMEDOUT)
+}
+
+// try runs do on the backends in order, until one does not fail.  It
+// returns the result and the index of the backend.
+func (fs *FailoverFileSystem) try(do func(fs FileSystem) (interface{}, Status)) (val interface{}, backend int, code Status) {
+	for _, i := range fs.order() {
+		val, code = fs.call(i, do)
+		if !isBackendError(code) {
+			fs.succeeded(i)
+			return val, i, code
+		}
+		fs.failed(i, code)
+	}
+	return nil, -1, code
+}
+
+func (fs *FailoverFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	val, _, code := fs.try(func(fs FileSystem) (interface{}, Status) {
+		return fs.GetAttr(name, context)
+	})
+	a, _ := val.(*Attr)
+	return a, code
+}
+
+func (fs *FailoverFileSystem) Access(name string, mode uint32, context *Context) Status {
+	_, _, code := fs.try(func(fs FileSystem) (interface{}, Status) {
+		return nil, fs.Access(name, mode, context)
+	})
+	return code
+}
+
+func (fs *FailoverFileSystem) Readlink(name string, context *Context) (string, Status) {
+	val, _, code := fs.try(func(fs FileSystem) (interface{}, Status) {
+		return fs.Readlink(name, context)
+	})
+	s, _ := val.(string)
+	return s, code
+}
+
+func (fs *FailoverFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	val, _, code := fs.try(func(fs FileSystem) (interface{}, Status) {
+		return fs.GetXAttr(name, attr, context)
+	})
+	data, _ := val.([]byte)
+	return data, code
+}
+
+func (fs *FailoverFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
+	val, _, code := fs.try(func(fs FileSystem) (interface{}, Status) {
+		return fs.ListXAttr(name, context)
+	})
+	attrs, _ := val.([]string)
+	return attrs, code
+}
+
+func (fs *FailoverFileSystem) LinkKey(name string, context *Context) (string, Status) {
+	val, _, code := fs.try(func(fs FileSystem) (interface{}, Status) {
+		return fs.LinkKey(name, context)
+	})
+	key, _ := val.(string)
+	return key, code
+}
+
+// OpenDir reads the whole directory from one backend, so listings do
+// not mix backends.
+func (fs *FailoverFileSystem) OpenDir(name string, context *Context) ([]DirEntry, Status) {
+	val, _, code := fs.try(func(fs FileSystem) (interface{}, Status) {
+		return fs.OpenDir(name, context)
+	})
+	stream, _ := val.([]DirEntry)
+	return stream, code
+}
+
+// OpenDirStream returns ENOSYS, so directories are read with
+// OpenDir, which can fail over.
+func (fs *FailoverFileSystem) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	return nil, ENOSYS
+}
+
+func (fs *FailoverFileSystem) StatFs(name string) *StatfsOut {
+	val, _, _ := fs.try(func(fs FileSystem) (interface{}, Status) {
+		if out := fs.StatFs(name); out != nil {
+			return out, OK
+		}
+		return nil, EIO
+	})
+	out, _ := val.(*StatfsOut)
+	return out
+}
+
+func (fs *FailoverFileSystem) Open(name string, flags uint32, context *Context) (File, Status) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		return fs.FileSystem.Open(name, flags, context)
+	}
+	val, i, code := fs.try(func(fs FileSystem) (interface{}, Status) {
+		return fs.Open(name, flags, context)
+	})
+	if !code.Ok() {
+		return nil, code
+	}
+	return &failoverFile{
+		File:    val.(File),
+		fs:      fs,
+		name:    name,
+		flags:   flags,
+		backend: i,
+	}, OK
+}
+
+// failoverFile is a file opened for reading.  If reading fails, the
+// file is opened on the next backend, and the read is tried there.
+type failoverFile struct {
+	File
+	fs    *FailoverFileSystem
+	name  string
+	flags uint32
+
+	lock    sync.Mutex
+	backend int
+}
+
+func (f *failoverFile) String() string {
+	return fmt.Sprintf("failoverFile(%s)", f.File.String())
+}
+
+func (f *failoverFile) InnerFile() File {
+	return f.File
+}
+
+func (f *failoverFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fs := f.fs
+	file := f.File
+	data, code := fs.call(f.backend, func(FileSystem) (interface{}, Status) {
+		return file.Read(input, bp)
+	})
+	if !isBackendError(code) {
+		buf, _ := data.([]byte)
+		return buf, code
+	}
+	fs.failed(f.backend, code)
+	for _, i := range fs.order() {
+		if i == f.backend {
+			continue
+		}
+		val, c := fs.call(i, func(fs FileSystem) (interface{}, Status) {
+			return fs.Open(f.name, f.flags, nil)
+		})
+		if !c.Ok() {
+			if isBackendError(c) {
+				fs.failed(i, c)
+			}
+			continue
+		}
+		f.File.Release(&ReleaseIn{})
+		f.File = val.(File)
+		f.backend = i
+		file := f.File
+		data, code = fs.call(i, func(FileSystem) (interface{}, Status) {
+			return file.Read(input, bp)
+		})
+		if !isBackendError(code) {
+			fs.succeeded(i)
+			buf, _ := data.([]byte)
+			return buf, code
+		}
+		fs.failed(i, code)
+	}
+	return nil, code
+}
+
+func (f *failoverFile) GetAttr(out *Attr) Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.File.GetAttr(out)
+}
+
+func (f *failoverFile) Release(input *ReleaseIn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.File.Release(input)
+}
@@ -0,0 +1,105 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func setupFailoverFs(t *testing.T, wrap func(primary FileSystem) FileSystem, opts *FailoverOptions) (fs *FailoverFileSystem, clean func()) {
+	var dirs []string
+	var backends []FileSystem
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "go-fuse")
+		CheckSuccess(err)
+		dirs = append(dirs, dir)
+		CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644))
+		backends = append(backends, NewLoopbackFileSystem(dir))
+	}
+	backends[0] = wrap(backends[0])
+	return NewFailoverFileSystem(backends, opts), func() {
+		for _, d := range dirs {
+			os.RemoveAll(d)
+		}
+	}
+}
+
+func TestFailoverFs(t *testing.T) {
+	var faults *FaultFileSystem
+	fs, clean := setupFailoverFs(t, func(primary FileSystem) FileSystem {
+		faults = NewFaultFileSystem(primary)
+		return faults
+	}, &FailoverOptions{DownTime: 50 * time.Millisecond})
+	defer clean()
+
+	f, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer f.Release(&ReleaseIn{})
+
+	id := faults.AddFault(Fault{Status: EIO})
+	if a, code := fs.GetAttr("file", nil); !code.Ok() || a.Size != 5 {
+		t.Errorf("GetAttr: %v", code)
+	}
+	// Errors of the request do not fail over.
+	if _, code := fs.GetAttr("missing", nil); code != ENOENT {
+		t.Errorf("GetAttr(missing): %v", code)
+	}
+	b := fs.Backends()
+	if b[0].Up || b[0].Active || b[0].LastError != EIO || !b[1].Active {
+		t.Errorf("backends: %+v", b)
+	}
+	// An open file moves to the secondary.
+	if data, code := f.Read(&ReadIn{Size: 100}, NewBufferPool()); !code.Ok() || string(data) != "hello" {
+		t.Errorf("Read: %q, %v", data, code)
+	}
+
+	// Without stickiness, reads go back to the primary once it is
+	// no longer down.
+	faults.RemoveFault(id)
+	time.Sleep(60 * time.Millisecond)
+	fs.GetAttr("file", nil)
+	if b := fs.Backends(); !b[0].Active || !b[0].Up || b[0].Failures != 0 {
+		t.Errorf("backends after recovery: %+v", b)
+	}
+}
+
+func TestFailoverFsSticky(t *testing.T) {
+	var faults *FaultFileSystem
+	fs, clean := setupFailoverFs(t, func(primary FileSystem) FileSystem {
+		faults = NewFaultFileSystem(primary)
+		return faults
+	}, &FailoverOptions{DownTime: time.Millisecond, Sticky: true})
+	defer clean()
+
+	id := faults.AddFault(Fault{Op: "GetAttr", Status: Status(syscall.ETIMEDOUT)})
+	fs.GetAttr("file", nil)
+	faults.RemoveFault(id)
+	time.Sleep(5 * time.Millisecond)
+	fs.GetAttr("file", nil)
+	if b := fs.Backends(); !b[1].Active {
+		t.Errorf("backends: %+v", b)
+	}
+}
+
+func TestFailoverFsTimeout(t *testing.T) {
+	fs, clean := setupFailoverFs(t, func(primary FileSystem) FileSystem {
+		return NewDelayFileSystem(primary, &DelayOptions{Default: FixedLatency(time.Second)})
+	}, &FailoverOptions{Timeout: 20 * time.Millisecond})
+	defer clean()
+
+	start := time.Now()
+	if _, code := fs.GetAttr("file", nil); !code.Ok() {
+		t.Errorf("GetAttr: %v", code)
+	}
+	if d := time.Now().Sub(start); d > 500*time.Millisecond {
+		t.Errorf("took %v", d)
+	}
+	if b := fs.Backends(); b[0].LastError != Status(syscall.ETIMEDOUT) {
+		t.Errorf("backends: %+v", b)
+	}
+}
@@ -0,0 +1,515 @@
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault describes failures for a FaultFileSystem to inject.
+type Fault struct {
+	// Op is the name of the FileSystem or File method to fail,
+	// eg. "Read" or "GetAttr".  Empty matches all methods.
+	Op string
+
+	// Path is a filepath.Match pattern for the names to fail.
+	// Empty matches all names.  Methods of open files match the
+	// name the file was opened with.
+	Path string
+
+	// Status is returned instead of calling the method.
+	Status Status
+
+	// Every makes only every Nth matching call fail.  Zero or one
+	// fails all of them.
+	Every int
+
+	// Count removes the fault after it failed this many calls.
+	// Zero keeps it.
+	Count int
+
+	// If AfterRename is set, the fault only applies to names
+	// that were the target of a Rename less than this long ago,
+	// like on a file system that is slow to show renames.
+	AfterRename time.Duration
+}
+
+// The control extended attribute.  Setting it on any name adds the
+// fault described by the value, for that name unless the value has
+// a path.  The value has fields like "op=Read status=EIO every=3".
+// Setting "clear" removes all faults, and reading the attribute
+// lists them, one per line.
+const FaultXAttr = "user.gofuse.fault"
+
+// FaultFileSystem is a wrapper that fails operations as set up by
+// its faults, for testing how programs and other wrappers cope with
+// errors.
+type FaultFileSystem struct {
+	FileSystem
+
+	lock    sync.Mutex
+	faults  []*faultState
+	nextId  int
+	renamed map[string]time.Time
+}
+
+type faultState struct {
+	Fault
+	id       int
+	matches  int
+	failures int
+}
+
+// NewFaultFileSystem wraps fs.  It starts without faults.
+func NewFaultFileSystem(fs FileSystem) *FaultFileSystem {
+	return &FaultFileSystem{
+		FileSystem: fs,
+		renamed:    map[string]time.Time{},
+	}
+}
+
+func (fs *FaultFileSystem) String() string {
+	return fmt.Sprintf("FaultFileSystem(%s)", fs.FileSystem.String())
+}
+
+// AddFault adds a fault, and returns an id for RemoveFault.
+func (fs *FaultFileSystem) AddFault(f Fault) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.nextId++
+	fs.faults = append(fs.faults, &faultState{Fault: f, id: fs.nextId})
+	return fs.nextId
+}
+
+func (fs *FaultFileSystem) RemoveFault(id int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for i, f := range fs.faults {
+		if f.id == id {
+			fs.faults = append(fs.faults[:i], fs.faults[i+1:]...)
+			return
+		}
+	}
+}
+
+func (fs *FaultFileSystem) ClearFaults() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.faults = nil
+}
+
+// Faults returns the faults that are set up.
+func (fs *FaultFileSystem) Faults() []Fault {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var result []Fault
+	for _, f := range fs.faults {
+		result = append(result, f.Fault)
+	}
+	return result
+}
+
+func (f *faultState) match(op string, name string, renamed time.Time, now time.Time) bool {
+	if f.Op != "" && f.Op != op {
+		return false
+	}
+	if f.Path != "" {
+		if ok, _ := filepath.Match(f.Path, name); !ok {
+			return false
+		}
+	}
+	if f.AfterRename > 0 && (renamed.IsZero() || now.Sub(renamed) >= f.AfterRename) {
+		return false
+	}
+	return true
+}
+
+// check returns the status to fail op on name with, or OK.
+func (fs *FaultFileSystem) check(op string, name string) Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if len(fs.faults) == 0 {
+		return OK
+	}
+
+	now := time.Now()
+	renamed := fs.renamed[name]
+	for i, f := range fs.faults {
+		if !f.match(op, name, renamed, now) {
+			continue
+		}
+		f.matches++
+		if f.Every > 1 && f.matches%f.Every != 0 {
+			continue
+		}
+		f.failures++
+		if f.Count > 0 && f.failures >= f.Count {
+			fs.faults = append(fs.faults[:i], fs.faults[i+1:]...)
+		}
+		return f.Status
+	}
+	return OK
+}
+
+// noteRename remembers when name was the target of a rename, for
+// AfterRename faults.
+func (fs *FaultFileSystem) noteRename(name string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	var longest time.Duration
+	for _, f := range fs.faults {
+		if f.AfterRename > longest {
+			longest = f.AfterRename
+		}
+	}
+	now := time.Now()
+	for k, t := range fs.renamed {
+		if now.Sub(t) >= longest {
+			delete(fs.renamed, k)
+		}
+	}
+	if longest > 0 {
+		fs.renamed[name] = now
+	}
+}
+
+var faultErrnos = map[string]syscall.Errno{
+	"EACCES":    syscall.EACCES,
+	"EAGAIN":    syscall.EAGAIN,
+	"EBUSY":     syscall.EBUSY,
+	"EDQUOT":    syscall.EDQUOT,
+	"EEXIST":    syscall.EEXIST,
+	"EFBIG":     syscall.EFBIG,
+	"EINTR":     syscall.EINTR,
+	"EINVAL":    syscall.EINVAL,
+	"EIO":       syscall.EIO,
+	"ENOENT":    syscall.ENOENT,
+	"ENOSPC":    syscall.ENOSPC,
+	"ENOTCONN":  syscall.ENOTCONN,
+	"ENOTEMPTY": syscall.ENOTEMPTY,
+	"EPERM":     syscall.EPERM,
+	"EROFS":     syscall.EROFS,
+	"ESTALE":    syscall.ESTALE,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+	"EXDEV":     syscall.EXDEV,
+}
+
+func (f *Fault) String() string {
+	var fields []string
+	if f.Op != "" {
+		fields = append(fields, "op="+f.Op)
+	}
+	if f.Path != "" {
+		fields = append(fields, "path="+f.Path)
+	}
+	status := strconv.Itoa(int(f.Status))
+	for name, errno := range faultErrnos {
+		if Status(errno) == f.Status {
+			status = name
+		}
+	}
+	fields = append(fields, "status="+status)
+	if f.Every > 1 {
+		fields = append(fields, fmt.Sprintf("every=%d", f.Every))
+	}
+	if f.Count > 0 {
+		fields = append(fields, fmt.Sprintf("count=%d", f.Count))
+	}
+	if f.AfterRename > 0 {
+		fields = append(fields, fmt.Sprintf("rename=%v", f.AfterRename))
+	}
+	return strings.Join(fields, " ")
+}
+
+// ParseFault parses the description of a fault, as written by
+// Fault.String.  The status may be an errno name or number, and
+// defaults to EIO.
+func ParseFault(spec string) (f Fault, err error) {
+	f.Status = EIO
+	for _, field := range strings.Fields(spec) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return f, fmt.Errorf("bad field %q", field)
+		}
+		k, v := kv[0], kv[1]
+		switch k {
+		case "op":
+			f.Op = v
+		case "path":
+			f.Path = v
+		case "status":
+			if errno, ok := faultErrnos[v]; ok {
+				f.Status = Status(errno)
+			} else if n, e := strconv.Atoi(v); e == nil && n > 0 {
+				f.Status = Status(n)
+			} else {
+				err = fmt.Errorf("bad status %q", v)
+			}
+		case "every":
+			f.Every, err = strconv.Atoi(v)
+		case "count":
+			f.Count, err = strconv.Atoi(v)
+		case "rename":
+			f.AfterRename, err = time.ParseDuration(v)
+		default:
+			err = fmt.Errorf("unknown field %q", k)
+		}
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func (fs *FaultFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	if code := fs.check("GetAttr", name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *FaultFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
+	if code := fs.check("Chmod", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *FaultFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) (code Status) {
+	if code := fs.check("Chown", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *FaultFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	if code := fs.check("Utimens", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Utimens(name, Atime, Mtime, context)
+}
+
+func (fs *FaultFileSystem) Truncate(name string, size uint64, context *Context) (code Status) {
+	if code := fs.check("Truncate", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *FaultFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
+	if code := fs.check("Access", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *FaultFileSystem) Link(oldName string, newName string, context *Context) (code Status) {
+	if code := fs.check("Link", newName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *FaultFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	if code := fs.check("Mkdir", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *FaultFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	if code := fs.check("Mknod", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *FaultFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
+	if code := fs.check("Rename", oldName); !code.Ok() {
+		return code
+	}
+	code = fs.FileSystem.Rename(oldName, newName, context)
+	if code.Ok() {
+		fs.noteRename(newName)
+	}
+	return code
+}
+
+func (fs *FaultFileSystem) Rmdir(name string, context *Context) (code Status) {
+	if code := fs.check("Rmdir", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *FaultFileSystem) Unlink(name string, context *Context) (code Status) {
+	if code := fs.check("Unlink", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *FaultFileSystem) GetXAttr(name string, attribute string, context *Context) (data []byte, code Status) {
+	if attribute == FaultXAttr {
+		var lines []string
+		for _, f := range fs.Faults() {
+			lines = append(lines, f.String()+"\n")
+		}
+		return []byte(strings.Join(lines, "")), OK
+	}
+	if code := fs.check("GetXAttr", name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *FaultFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	if attr == FaultXAttr {
+		spec := strings.TrimSpace(string(data))
+		if spec == "clear" {
+			fs.ClearFaults()
+			return OK
+		}
+		f, err := ParseFault(spec)
+		if err != nil {
+			log.Printf("FaultFileSystem: %q: %v", spec, err)
+			return EINVAL
+		}
+		if f.Path == "" {
+			f.Path = name
+		}
+		fs.AddFault(f)
+		return OK
+	}
+	if code := fs.check("SetXAttr", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *FaultFileSystem) ListXAttr(name string, context *Context) (attributes []string, code Status) {
+	if code := fs.check("ListXAttr", name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *FaultFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	if code := fs.check("RemoveXAttr", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *FaultFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	if code := fs.check("Open", name); !code.Ok() {
+		return nil, code
+	}
+	file, code = fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return &faultFile{File: file, fs: fs, path: name}, code
+}
+
+func (fs *FaultFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	if code := fs.check("Create", name); !code.Ok() {
+		return nil, code
+	}
+	file, code = fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return &faultFile{File: file, fs: fs, path: name}, code
+}
+
+func (fs *FaultFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, code Status) {
+	if code := fs.check("OpenDir", name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *FaultFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, code Status) {
+	if code := fs.check("OpenDir", name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *FaultFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	if code := fs.check("Symlink", linkName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *FaultFileSystem) Readlink(name string, context *Context) (string, Status) {
+	if code := fs.check("Readlink", name); !code.Ok() {
+		return "", code
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *FaultFileSystem) FsyncDir(name string, flags int, context *Context) (code Status) {
+	if code := fs.check("FsyncDir", name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.FsyncDir(name, flags, context)
+}
+
+// faultFile injects the faults into the methods of an open file.
+type faultFile struct {
+	File
+	fs   *FaultFileSystem
+	path string
+}
+
+func (f *faultFile) String() string {
+	return fmt.Sprintf("faultFile(%s)", f.File.String())
+}
+
+func (f *faultFile) InnerFile() File {
+	return f.File
+}
+
+func (f *faultFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	if code := f.fs.check("Read", f.path); !code.Ok() {
+		return nil, code
+	}
+	return f.File.Read(input, bp)
+}
+
+func (f *faultFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	if code := f.fs.check("Write", f.path); !code.Ok() {
+		return 0, code
+	}
+	return f.File.Write(input, data)
+}
+
+func (f *faultFile) Flush(input *FlushIn) Status {
+	if code := f.fs.check("Flush", f.path); !code.Ok() {
+		return code
+	}
+	return f.File.Flush(input)
+}
+
+func (f *faultFile) Fsync(flags int) (code Status) {
+	if code := f.fs.check("Fsync", f.path); !code.Ok() {
+		return code
+	}
+	return f.File.Fsync(flags)
+}
+
+func (f *faultFile) Truncate(size uint64, context *Context) Status {
+	if code := f.fs.check("Truncate", f.path); !code.Ok() {
+		return code
+	}
+	return f.File.Truncate(size, context)
+}
@@ -0,0 +1,84 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaultFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(dir+"/file", []byte("data"), 0644))
+
+	fs := NewFaultFileSystem(NewLoopbackFileSystem(dir))
+	fs.AddFault(Fault{Op: "Read", Status: EIO, Every: 3})
+	id := fs.AddFault(Fault{Op: "Write", Path: "f*", Status: Status(syscall.ENOSPC)})
+
+	f, code := fs.Open("file", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer f.Release(&ReleaseIn{})
+	var codes []string
+	for i := 0; i < 6; i++ {
+		_, code := f.Read(&ReadIn{Size: 4}, NewBufferPool())
+		codes = append(codes, code.String())
+	}
+	if got, want := strings.Join(codes, " "), "OK OK 5=input/output error OK OK 5=input/output error"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, code := f.Write(&WriteIn{}, []byte("x")); code != Status(syscall.ENOSPC) {
+		t.Errorf("Write: got %v, want ENOSPC", code)
+	}
+	fs.RemoveFault(id)
+	if _, code := f.Write(&WriteIn{}, []byte("x")); !code.Ok() {
+		t.Errorf("Write after RemoveFault: %v", code)
+	}
+
+	fs.AddFault(Fault{Op: "GetAttr", Status: ENOENT, AfterRename: 100 * time.Millisecond})
+	if code := fs.Rename("file", "renamed", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if _, code := fs.GetAttr("renamed", nil); code != ENOENT {
+		t.Errorf("GetAttr right after rename: got %v, want ENOENT", code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, code := fs.GetAttr("renamed", nil); !code.Ok() {
+		t.Errorf("GetAttr later: %v", code)
+	}
+}
+
+func TestFaultFsXAttr(t *testing.T) {
+	fs := NewFaultFileSystem(&DefaultFileSystem{})
+	if code := fs.SetXAttr("a", FaultXAttr, []byte("op=Mkdir status=EROFS count=1"), 0, nil); !code.Ok() {
+		t.Fatalf("SetXAttr: %v", code)
+	}
+	if code := fs.SetXAttr("", FaultXAttr, []byte("bogus"), 0, nil); code != EINVAL {
+		t.Errorf("bad spec: got %v, want EINVAL", code)
+	}
+	data, _ := fs.GetXAttr("", FaultXAttr, nil)
+	if got := string(data); got != "op=Mkdir path=a status=EROFS count=1\n" {
+		t.Errorf("got listing %q", got)
+	}
+
+	if code := fs.Mkdir("b", 0755, nil); code != ENOSYS {
+		t.Errorf("Mkdir b: got %v, want ENOSYS", code)
+	}
+	if code := fs.Mkdir("a", 0755, nil); code != EROFS {
+		t.Errorf("Mkdir a: got %v, want EROFS", code)
+	}
+	if code := fs.Mkdir("a", 0755, nil); code != ENOSYS {
+		t.Errorf("Mkdir a after count: got %v, want ENOSYS", code)
+	}
+
+	fs.SetXAttr("", FaultXAttr, []byte("status=5"), 0, nil)
+	fs.SetXAttr("", FaultXAttr, []byte("clear"), 0, nil)
+	if len(fs.Faults()) != 0 {
+		t.Errorf("faults left after clear: %v", fs.Faults())
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"io"
 	"os"
 	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
 )
 
 var _ = fmt.Println
@@ -72,7 +75,7 @@ func (f *DevNullFile) Write(input *WriteIn, content []byte) (uint32, Status) {
 	return uint32(len(content)), OK
 }
 
-func (f *DevNullFile) Flush() Status {
+func (f *DevNullFile) Flush(input *FlushIn) Status {
 	return OK
 }
 
@@ -80,7 +83,7 @@ func (f *DevNullFile) Fsync(flags int) (code Status) {
 	return OK
 }
 
-func (f *DevNullFile) Truncate(size uint64) (code Status) {
+func (f *DevNullFile) Truncate(size uint64, context *Context) (code Status) {
 	return OK
 }
 
@@ -97,6 +100,27 @@ func (f *LoopbackFile) String() string {
 	return fmt.Sprintf("LoopbackFile(%s)", f.File.Name())
 }
 
+var _ = (FdFile)((*LoopbackFile)(nil))
+
+func (f *LoopbackFile) Fd() int {
+	return int(f.File.Fd())
+}
+
+var _ = (SparseFile)((*LoopbackFile)(nil))
+
+func (f *LoopbackFile) NextData(offset uint64) (start uint64, end uint64, code Status) {
+	fd := int(f.File.Fd())
+	s, err := syscall.Seek(fd, int64(offset), _SEEK_DATA)
+	if err != nil {
+		return 0, 0, ToStatus(err)
+	}
+	e, err := syscall.Seek(fd, s, _SEEK_HOLE)
+	if err != nil {
+		return 0, 0, ToStatus(err)
+	}
+	return uint64(s), uint64(e), OK
+}
+
 func (f *LoopbackFile) Read(input *ReadIn, buffers BufferPool) ([]byte, Status) {
 	slice := buffers.AllocBuffer(input.Size)
 
@@ -112,40 +136,39 @@ func (f *LoopbackFile) Write(input *WriteIn, data []byte) (uint32, Status) {
 	return uint32(n), ToStatus(err)
 }
 
-func (f *LoopbackFile) Release() {
+func (f *LoopbackFile) Release(input *ReleaseIn) {
 	f.File.Close()
 }
 
-func (f *LoopbackFile) Flush() Status {
+func (f *LoopbackFile) Flush(input *FlushIn) Status {
 	return OK
 }
 
 func (f *LoopbackFile) Fsync(flags int) (code Status) {
+	if flags&raw.FUSE_FSYNC_FDATASYNC != 0 {
+		return ToStatus(fdatasync(int(f.File.Fd())))
+	}
 	return ToStatus(syscall.Fsync(int(f.File.Fd())))
 }
 
-func (f *LoopbackFile) Truncate(size uint64) Status {
+func (f *LoopbackFile) Truncate(size uint64, context *Context) Status {
 	return ToStatus(syscall.Ftruncate(int(f.File.Fd()), int64(size)))
 }
 
-// futimens missing from 6g runtime.
+func (f *LoopbackFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	return Status(futimens(int(f.File.Fd()), atime, mtime))
+}
 
-func (f *LoopbackFile) Chmod(mode uint32) Status {
+func (f *LoopbackFile) Chmod(mode uint32, context *Context) Status {
 	return ToStatus(f.File.Chmod(os.FileMode(mode)))
 }
 
-func (f *LoopbackFile) Chown(uid uint32, gid uint32) Status {
+func (f *LoopbackFile) Chown(uid uint32, gid uint32, context *Context) Status {
 	return ToStatus(f.File.Chown(int(uid), int(gid)))
 }
 
 func (f *LoopbackFile) GetAttr(a *Attr) Status {
-	st := syscall.Stat_t{}
-	err := syscall.Fstat(int(f.File.Fd()), &st)
-	if err != nil {
-		return ToStatus(err)
-	}
-	a.FromStat(&st)
-	return OK
+	return ToStatus(statAttr(a, int(f.File.Fd()), "", _AT_EMPTY_PATH))
 }
 
 ////////////////////////////////////////////////////////////////
@@ -155,26 +178,44 @@ type ReadOnlyFile struct {
 	File
 }
 
+func (f *ReadOnlyFile) InnerFile() File {
+	return f.File
+}
+
 func (f *ReadOnlyFile) String() string {
 	return fmt.Sprintf("ReadOnlyFile(%s)", f.File.String())
 }
 
 func (f *ReadOnlyFile) Write(input *WriteIn, data []byte) (uint32, Status) {
-	return 0, EPERM
+	return 0, EROFS
 }
 
 func (f *ReadOnlyFile) Fsync(flag int) (code Status) {
 	return OK
 }
 
-func (f *ReadOnlyFile) Truncate(size uint64) Status {
-	return EPERM
+func (f *ReadOnlyFile) Truncate(size uint64, context *Context) Status {
+	return EROFS
+}
+
+func (f *ReadOnlyFile) Chmod(mode uint32, context *Context) Status {
+	return EROFS
+}
+
+func (f *ReadOnlyFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	return EROFS
+}
+
+func (f *ReadOnlyFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	return EROFS
 }
 
-func (f *ReadOnlyFile) Chmod(mode uint32) Status {
-	return EPERM
+func (f *ReadOnlyFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	return EROFS
 }
 
-func (f *ReadOnlyFile) Chown(uid uint32, gid uint32) Status {
-	return EPERM
+func (f *ReadOnlyFile) GetAttr(out *Attr) Status {
+	code := f.File.GetAttr(out)
+	out.Mode &^= 0222
+	return code
 }
@@ -0,0 +1,8 @@
+package fuse
+
+// Darwin numbers SEEK_HOLE and SEEK_DATA the other way around.  It
+// has no FICLONE, so LoopbackFile does not clone there.
+const (
+	_SEEK_HOLE = 3
+	_SEEK_DATA = 4
+)
@@ -0,0 +1,70 @@
+package fuse
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_SEEK_DATA = 3
+	_SEEK_HOLE = 4
+
+	_FICLONE      = 0x40049409
+	_FICLONERANGE = 0x4020940d
+)
+
+// fileCloneRange is struct file_clone_range of <linux/fs.h>.
+type fileCloneRange struct {
+	SrcFd      int64
+	SrcOffset  uint64
+	SrcLength  uint64
+	DestOffset uint64
+}
+
+var _ = (CloneFile)((*LoopbackFile)(nil))
+
+func (f *LoopbackFile) CloneFrom(src File) Status {
+	srcFd, ok := src.(FdFile)
+	if !ok {
+		return ENOSYS
+	}
+	_, errno := ioctl(f.Fd(), _FICLONE, uintptr(srcFd.Fd()))
+	return Status(errno)
+}
+
+var _ = (CopyRangeFile)((*LoopbackFile)(nil))
+
+// CopyFileRange clones the range if it can, and has the kernel copy
+// it otherwise, which also clones it where that is possible.
+func (f *LoopbackFile) CopyFileRange(offIn uint64, dst File, offOut uint64, size uint64) (uint32, Status) {
+	d, ok := dst.(FdFile)
+	if !ok {
+		return 0, EXDEV
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.Fd(), &st); err != nil {
+		return 0, ToStatus(err)
+	}
+	if offIn >= uint64(st.Size) {
+		return 0, OK
+	}
+
+	// Ranges must be block aligned, except at the end of the
+	// source, which a length of 0 clones up to.
+	arg := fileCloneRange{
+		SrcFd:      int64(f.Fd()),
+		SrcOffset:  offIn,
+		SrcLength:  size,
+		DestOffset: offOut,
+	}
+	if rest := uint64(st.Size) - offIn; size >= rest {
+		arg.SrcLength = 0
+		size = rest
+	}
+	if _, errno := ioctl(d.Fd(), _FICLONERANGE, uintptr(unsafe.Pointer(&arg))); errno == 0 {
+		return uint32(size), OK
+	}
+
+	n, err := copyFileRange(f.Fd(), int64(offIn), d.Fd(), int64(offOut), int(size))
+	return uint32(n), ToStatus(err)
+}
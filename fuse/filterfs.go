@@ -0,0 +1,122 @@
+package fuse
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type FilterOptions struct {
+	// Globs are filepath.Match patterns for the entries to hide.
+	// Patterns without a slash are matched against the base
+	// name, so "*.key" hides such files in every directory.
+	// Others are matched against the whole path.
+	Globs []string
+
+	// Regexps hide the entries whose path they match.
+	Regexps []*regexp.Regexp
+}
+
+// FilterFileSystem is a wrapper that hides the entries that match its
+// rules.  They are left out of directory listings, and all operations
+// on them, or on the entries in hidden directories, fail with ENOENT.
+type FilterFileSystem struct {
+	FileSystem
+
+	options FilterOptions
+}
+
+// NewFilterFileSystem wraps fs.
+func NewFilterFileSystem(fs FileSystem, opts *FilterOptions) *FilterFileSystem {
+	f := &FilterFileSystem{}
+	if opts != nil {
+		f.options = *opts
+	}
+	f.FileSystem = &rewriteFileSystem{fs, f.check}
+	return f
+}
+
+func (fs *FilterFileSystem) String() string {
+	return fmt.Sprintf("FilterFileSystem(%s)", fs.FileSystem.String())
+}
+
+// Hidden returns true if the entry at name matches one of the rules.
+// It does not look at the directories above it.
+func (fs *FilterFileSystem) Hidden(name string) bool {
+	base := filepath.Base(name)
+	for _, g := range fs.options.Globs {
+		target := base
+		if strings.Contains(g, "/") {
+			target = name
+		}
+		if ok, _ := filepath.Match(g, target); ok {
+			return true
+		}
+	}
+	for _, r := range fs.options.Regexps {
+		if r.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// check is the PathRewriter that denies hidden names, and names below
+// hidden directories.
+func (fs *FilterFileSystem) check(name string) (string, Status) {
+	for i := 0; i <= len(name); i++ {
+		if (i == len(name) || name[i] == '/') && i > 0 && fs.Hidden(name[:i]) {
+			return "", ENOENT
+		}
+	}
+	return name, OK
+}
+
+func (fs *FilterFileSystem) filter(dir string, entries []DirEntry) []DirEntry {
+	result := entries[:0]
+	for _, e := range entries {
+		if !fs.Hidden(filepath.Join(dir, e.Name)) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (fs *FilterFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, code Status) {
+	stream, code = fs.FileSystem.OpenDir(name, context)
+	if !code.Ok() {
+		return stream, code
+	}
+	return fs.filter(name, stream), code
+}
+
+func (fs *FilterFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, code Status) {
+	stream, code = fs.FileSystem.OpenDirStream(name, context)
+	if !code.Ok() {
+		return stream, code
+	}
+	return &filterDirStream{stream, fs, name}, code
+}
+
+// filterDirStream leaves the hidden entries out of a DirStream.
+type filterDirStream struct {
+	DirStream
+	fs  *FilterFileSystem
+	dir string
+}
+
+func (s *filterDirStream) ReadDir(offset uint64, context *Context) ([]DirEntry, Status) {
+	for {
+		entries, code := s.DirStream.ReadDir(offset, context)
+		if !code.Ok() || len(entries) == 0 {
+			return entries, code
+		}
+		// No entries would mean the end, so read on if all
+		// of them are hidden.
+		offset = entries[len(entries)-1].Off
+		if entries = s.fs.filter(s.dir, entries); len(entries) > 0 {
+			return entries, code
+		}
+	}
+}
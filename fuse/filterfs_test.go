@@ -0,0 +1,76 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFilterFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.MkdirAll(dir+"/src/build", 0755))
+	CheckSuccess(os.MkdirAll(dir+"/.git", 0755))
+	for _, n := range []string{"a.go", "secret.key", "src/b.go", "src/c.key", "src/build/out", ".git/HEAD"} {
+		CheckSuccess(ioutil.WriteFile(dir+"/"+n, []byte(n), 0644))
+	}
+
+	fs := NewFilterFileSystem(NewLoopbackFileSystem(dir), &FilterOptions{
+		Globs:   []string{"*.key", "src/build"},
+		Regexps: []*regexp.Regexp{regexp.MustCompile(`^\.git$`)},
+	})
+
+	for _, n := range []string{"a.go", "src", "src/b.go"} {
+		if _, code := fs.GetAttr(n, nil); !code.Ok() {
+			t.Errorf("GetAttr(%q): %v", n, code)
+		}
+	}
+	for _, n := range []string{"secret.key", "src/c.key", "src/build", "src/build/out", ".git/HEAD"} {
+		if _, code := fs.GetAttr(n, nil); code != ENOENT {
+			t.Errorf("GetAttr(%q): got %v, want ENOENT", n, code)
+		}
+	}
+	if _, code := fs.Open("src/build/out", 0, nil); code != ENOENT {
+		t.Errorf("Open hidden: got %v", code)
+	}
+	if code := fs.Rename("a.go", "new.key", nil); code != ENOENT {
+		t.Errorf("Rename to hidden: got %v", code)
+	}
+
+	names := func(entries []DirEntry) string {
+		var l []string
+		for _, e := range entries {
+			l = append(l, e.Name)
+		}
+		sort.Strings(l)
+		return strings.Join(l, " ")
+	}
+	for d, want := range map[string]string{"": "a.go src", "src": "b.go"} {
+		entries, code := fs.OpenDir(d, nil)
+		if got := names(entries); !code.Ok() || got != want {
+			t.Errorf("OpenDir(%q): got %q, %v, want %q", d, got, code, want)
+		}
+
+		stream, code := fs.OpenDirStream(d, nil)
+		if code == ENOSYS {
+			continue
+		}
+		var all []DirEntry
+		for off := uint64(0); ; {
+			entries, code := stream.ReadDir(off, nil)
+			if !code.Ok() || len(entries) == 0 {
+				break
+			}
+			all = append(all, entries...)
+			off = entries[len(entries)-1].Off
+		}
+		stream.Release()
+		if got := names(all); got != want {
+			t.Errorf("OpenDirStream(%q): got %q, want %q", d, got, want)
+		}
+	}
+}
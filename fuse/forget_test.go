@@ -0,0 +1,106 @@
+package fuse
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// forgetNodeFs checks that OnKernelForget only runs for nodes the
+// kernel does not know.
+type forgetNodeFs struct {
+	DefaultNodeFileSystem
+	root *forgetNode
+
+	mu      sync.Mutex
+	forgets int
+	known   int
+}
+
+func (fs *forgetNodeFs) Root() FsNode {
+	return fs.root
+}
+
+type forgetNode struct {
+	DefaultFsNode
+	fs *forgetNodeFs
+}
+
+func (n *forgetNode) GetAttr(out *Attr, file File, context *Context) Status {
+	out.Mode = S_IFDIR | 0755
+	return OK
+}
+
+func (n *forgetNode) Lookup(out *Attr, name string, context *Context) (FsNode, Status) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		ch = n.Inode().New(false, &forgetNode{fs: n.fs})
+		n.Inode().AddChild(name, ch)
+	}
+	out.Mode = S_IFREG | 0644
+	return ch.FsNode(), OK
+}
+
+func (n *forgetNode) OnKernelForget() {
+	// Releasing state takes time; let lookups run meanwhile.
+	runtime.Gosched()
+	count := n.Inode().LookupCount()
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	n.fs.forgets++
+	if count != 0 {
+		n.fs.known++
+	}
+}
+
+func TestOnKernelForget(t *testing.T) {
+	fs := &forgetNodeFs{}
+	fs.root = &forgetNode{fs: fs}
+	c := NewFileSystemConnector(fs, nil)
+
+	header := &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}
+	lookup := func() uint64 {
+		out := raw.EntryOut{}
+		if code := c.Lookup(&out, header, "file"); !code.Ok() {
+			t.Fatal("Lookup:", code)
+		}
+		return out.NodeId
+	}
+
+	id := lookup()
+	lookup()
+	node := c.toInode(id)
+	if n := node.LookupCount(); n != 2 {
+		t.Errorf("LookupCount after 2 lookups: %d", n)
+	}
+	c.Forget(id, 1)
+	if fs.forgets != 0 {
+		t.Errorf("OnKernelForget with lookup count %d", node.LookupCount())
+	}
+	c.Forget(id, 1)
+	if fs.forgets != 1 || node.LookupCount() != 0 {
+		t.Errorf("after last forget: %d forgets, lookup count %d", fs.forgets, node.LookupCount())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Forget(lookup(), 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if fs.known > 0 {
+		t.Errorf("%d of %d OnKernelForget calls for nodes known to the kernel", fs.known, fs.forgets)
+	}
+	if node.LookupCount() != 0 {
+		t.Errorf("lookup count %d after balanced lookups and forgets", node.LookupCount())
+	}
+}
@@ -0,0 +1,77 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFreeze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+	os.Mkdir(dir+"/orig/sub", 0755)
+	err = ioutil.WriteFile(dir+"/orig/existing", []byte("hello"), 0644)
+	CheckSuccess(err)
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir+"/orig"), nil)
+	state, _, err := MountNodeFileSystem(dir+"/mnt", pfs, nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	// Read once before freezing, so the kernel learns we don't
+	// implement POLL.
+	content, err := ioutil.ReadFile(dir + "/mnt/existing")
+	CheckSuccess(err)
+
+	if code := state.Freeze(); !code.Ok() {
+		state.Thaw()
+		t.Fatal("Freeze:", code)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- ioutil.WriteFile(dir+"/mnt/sub/new", []byte("world"), 0644)
+	}()
+
+	// Reads are still served while frozen.  The kernel holds the
+	// directory lock for the pending create, so read elsewhere.
+	content, err = ioutil.ReadFile(dir + "/mnt/existing")
+	CheckSuccess(err)
+	if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("write finished while frozen: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := os.Lstat(dir + "/orig/sub/new"); err == nil {
+		t.Error("file was created while frozen")
+	}
+
+	state.Thaw()
+	CheckSuccess(<-done)
+	content, err = ioutil.ReadFile(dir + "/orig/sub/new")
+	CheckSuccess(err)
+	if string(content) != "world" {
+		t.Errorf("got %q, want %q", content, "world")
+	}
+}
+
+func TestFreezeSyncs(t *testing.T) {
+	fs := &syncFs{}
+	state := NewMountState(NewFileSystemConnector(NewPathNodeFs(fs, nil), nil))
+	if code := state.Freeze(); !code.Ok() {
+		t.Errorf("Freeze: %v", code)
+	}
+	state.Thaw()
+	if fs.count() != 1 {
+		t.Errorf("got %d syncs, want 1", fs.count())
+	}
+}
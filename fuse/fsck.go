@@ -0,0 +1,303 @@
+package fuse
+
+// This file contains a consistency check of the connector state
+// against the mounted file systems, for use on live mounts.
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// CheckKind classifies the problems found by
+// FileSystemConnector.Check.
+type CheckKind string
+
+const (
+	// The node is in the tree, but GetAttr on it fails.
+	CheckUnresolvable = CheckKind("unresolvable")
+
+	// GetAttr reports a directory for a node that was created as
+	// a file, or vice versa.
+	CheckTypeMismatch = CheckKind("typeMismatch")
+
+	// An open file of the node reports a different type or size
+	// than the node itself.
+	CheckAttrMismatch = CheckKind("attrMismatch")
+
+	// The lookup count of a node does not match its registration
+	// with the kernel.
+	CheckLookupCount = CheckKind("lookupCount")
+
+	// A file handle is not listed on any node the kernel can
+	// reach, or an open file of a node has no handle.
+	CheckOrphanHandle = CheckKind("orphanHandle")
+)
+
+// CheckProblem describes a single inconsistency.
+type CheckProblem struct {
+	Kind CheckKind `json:"kind"`
+
+	// The path of the node from the root of the connector, which
+	// is ".".  It is empty for nodes that are no longer in the
+	// tree.
+	Path string `json:"path,omitempty"`
+
+	NodeId uint64 `json:"nodeId,omitempty"`
+	Handle uint64 `json:"handle,omitempty"`
+	Detail string `json:"detail"`
+
+	// Repaired is set if the kernel's caches for the node were
+	// invalidated successfully.
+	Repaired bool `json:"repaired"`
+}
+
+// CheckReport is the result of FileSystemConnector.Check.  It can be
+// marshaled with encoding/json.
+type CheckReport struct {
+	// Nodes is the number of nodes in the tree.
+	Nodes int `json:"nodes"`
+
+	// KernelNodes is the number of nodes registered with the
+	// kernel, including those no longer in the tree.
+	KernelNodes int `json:"kernelNodes"`
+
+	Mounts    int `json:"mounts"`
+	OpenFiles int `json:"openFiles"`
+
+	Problems []CheckProblem `json:"problems"`
+}
+
+func (r *CheckReport) Ok() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CheckReport) add(p CheckProblem) {
+	r.Problems = append(r.Problems, p)
+}
+
+// A node as found in the tree.
+type checkEntry struct {
+	path   string
+	parent *Inode
+	name   string
+	node   *Inode
+}
+
+// Check audits the state of the connector: each node in the tree
+// should resolve in its file system with the type it was created
+// with, lookup counts should match the kernel registrations, and
+// file handles should belong to nodes the kernel can reach.  If
+// repair is set, nodes that no longer resolve are invalidated in the
+// kernel, so the next access looks them up again.
+//
+// Check runs alongside normal operation.  Opens and releases that
+// race with it may show up as transient handle problems, so rerun
+// Check to confirm those.
+func (c *FileSystemConnector) Check(repair bool) *CheckReport {
+	report := &CheckReport{Problems: []CheckProblem{}}
+
+	entries := c.checkEntries()
+	reachable := map[*Inode]bool{}
+	for _, e := range entries {
+		reachable[e.node] = true
+	}
+	report.Nodes = len(reachable)
+
+	// Hard linked nodes are checked under their first name only.
+	checked := map[*Inode]bool{}
+	for _, e := range entries {
+		if checked[e.node] {
+			continue
+		}
+		checked[e.node] = true
+		c.checkNode(report, e, true, repair)
+	}
+
+	// Unlinked nodes leave the tree, but the kernel may hold on
+	// to them, eg. for open files.
+	known := map[*Inode]bool{}
+	for h, v := range c.inodeMap.registered() {
+		n := (*Inode)(unsafe.Pointer(v))
+		report.KernelNodes++
+		known[n] = true
+
+		n.treeLock.RLock()
+		id := n.nodeId
+		n.treeLock.RUnlock()
+		if id != h {
+			report.add(CheckProblem{
+				Kind:   CheckLookupCount,
+				NodeId: h,
+				Detail: fmt.Sprintf("node registered as %d has node ID %d", h, id),
+			})
+		}
+		if !checked[n] {
+			checked[n] = true
+			c.checkNode(report, checkEntry{node: n}, false, false)
+		}
+	}
+
+	c.checkHandles(report, entries, known)
+	return report
+}
+
+// checkEntries lists the tree breadth-first, with the children of
+// each directory in name order.
+func (c *FileSystemConnector) checkEntries() []checkEntry {
+	entries := []checkEntry{{path: ".", node: c.rootNode}}
+	expanded := map[*Inode]bool{}
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if !e.node.IsDir() || expanded[e.node] {
+			continue
+		}
+		expanded[e.node] = true
+		children := e.node.Children()
+		names := make([]string, 0, len(children))
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			entries = append(entries, checkEntry{
+				path:   filepath.Join(e.path, name),
+				parent: e.node,
+				name:   name,
+				node:   children[name],
+			})
+		}
+	}
+	return entries
+}
+
+// checkNode checks the lookup count of a node, and if attrs is set,
+// its attributes against the file system.  Must run outside
+// treeLock, since it calls into the file system.
+func (c *FileSystemConnector) checkNode(report *CheckReport, e checkEntry, attrs bool, repair bool) {
+	n := e.node
+	n.treeLock.RLock()
+	lookupCount, id := n.lookupCount, n.nodeId
+	n.treeLock.RUnlock()
+	if lookupCount < 0 || (lookupCount == 0) != (id == 0) {
+		report.add(CheckProblem{
+			Kind:   CheckLookupCount,
+			Path:   e.path,
+			NodeId: id,
+			Detail: fmt.Sprintf("lookup count %d for node ID %d", lookupCount, id),
+		})
+	}
+	if !attrs {
+		return
+	}
+
+	attr := Attr{}
+	code := n.fsInode.GetAttr(&attr, nil, nil)
+	if code == ENOSYS {
+		return
+	}
+	if !code.Ok() {
+		p := CheckProblem{
+			Kind:   CheckUnresolvable,
+			Path:   e.path,
+			NodeId: id,
+			Detail: fmt.Sprintf("GetAttr: %v", code),
+		}
+		if repair && e.parent != nil {
+			p.Repaired = c.EntryNotify(e.parent, e.name).Ok()
+		}
+		report.add(p)
+		return
+	}
+	if attr.IsDir() != n.IsDir() {
+		report.add(CheckProblem{
+			Kind:   CheckTypeMismatch,
+			Path:   e.path,
+			NodeId: id,
+			Detail: fmt.Sprintf("node has directory %v, GetAttr has mode %s", n.IsDir(), FileMode(attr.Mode)),
+		})
+		return
+	}
+
+	for _, f := range n.Files(0) {
+		if f.File == nil {
+			continue
+		}
+		fattr := Attr{}
+		if !f.File.GetAttr(&fattr).Ok() {
+			continue
+		}
+		if fattr.Mode&syscall.S_IFMT == attr.Mode&syscall.S_IFMT && fattr.Size == attr.Size {
+			continue
+		}
+		p := CheckProblem{
+			Kind:   CheckAttrMismatch,
+			Path:   e.path,
+			NodeId: id,
+			Detail: fmt.Sprintf("node has mode %s size %d, open file %v has mode %s size %d",
+				FileMode(attr.Mode), attr.Size, f.File, FileMode(fattr.Mode), fattr.Size),
+		}
+		if repair {
+			p.Repaired = c.FileNotify(n, -1, 0).Ok()
+		}
+		report.add(p)
+		break
+	}
+}
+
+// checkHandles compares the file handles of each mount with the open
+// files listed on the nodes.
+func (c *FileSystemConnector) checkHandles(report *CheckReport, entries []checkEntry, known map[*Inode]bool) {
+	nodes := map[*Inode]bool{}
+	for n := range known {
+		nodes[n] = true
+	}
+	var mounts []*fileSystemMount
+	for _, e := range entries {
+		nodes[e.node] = true
+		if e.node.mountPoint != nil {
+			mounts = append(mounts, e.node.mountPoint)
+		}
+	}
+	report.Mounts = len(mounts)
+
+	listed := map[*openedFile]*Inode{}
+	for n := range nodes {
+		n.openFilesMutex.Lock()
+		for _, f := range n.openFiles {
+			listed[f] = n
+		}
+		n.openFilesMutex.Unlock()
+	}
+
+	registered := map[*openedFile]bool{}
+	for _, m := range mounts {
+		for h, v := range m.openFiles.registered() {
+			f := (*openedFile)(unsafe.Pointer(v))
+			report.OpenFiles++
+			registered[f] = true
+			if n := listed[f]; n == nil || n.mount != m {
+				report.add(CheckProblem{
+					Kind:   CheckOrphanHandle,
+					Handle: h,
+					Detail: fmt.Sprintf("handle %d (%v) is not an open file of a node in the mount", h, f.WithFlags.File),
+				})
+			}
+		}
+	}
+	for f, n := range listed {
+		if registered[f] {
+			continue
+		}
+		n.treeLock.RLock()
+		id := n.nodeId
+		n.treeLock.RUnlock()
+		report.add(CheckProblem{
+			Kind:   CheckOrphanHandle,
+			NodeId: id,
+			Detail: fmt.Sprintf("open file %v has no handle", f.WithFlags.File),
+		})
+	}
+}
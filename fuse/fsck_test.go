@@ -0,0 +1,85 @@
+package fuse
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkKinds(r *CheckReport) map[CheckKind][]CheckProblem {
+	out := map[CheckKind][]CheckProblem{}
+	for _, p := range r.Problems {
+		out[p.Kind] = append(out[p.Kind], p)
+	}
+	return out
+}
+
+func TestCheckConsistent(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	err := ioutil.WriteFile(tc.mountFile, []byte(contents), 0644)
+	CheckSuccess(err)
+	err = os.Mkdir(tc.mountSubdir, 0755)
+	CheckSuccess(err)
+	f, err := os.Open(tc.mountFile)
+	CheckSuccess(err)
+	defer f.Close()
+
+	r := tc.connector.Check(false)
+	if !r.Ok() {
+		t.Fatalf("got problems on a fresh mount: %v", r.Problems)
+	}
+	if r.Nodes < 3 || r.KernelNodes < 3 || r.Mounts != 1 || r.OpenFiles != 1 {
+		t.Errorf("unexpected counts: %+v", r)
+	}
+	if _, err := json.Marshal(r); err != nil {
+		t.Errorf("Marshal: %v", err)
+	}
+}
+
+func TestCheckUnresolvable(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	err := ioutil.WriteFile(tc.origFile, []byte(contents), 0644)
+	CheckSuccess(err)
+	_, err = os.Lstat(tc.mountFile)
+	CheckSuccess(err)
+
+	// Remove the file behind the back of the mount.
+	err = os.Remove(tc.origFile)
+	CheckSuccess(err)
+
+	r := tc.connector.Check(true)
+	probs := checkKinds(r)[CheckUnresolvable]
+	if len(r.Problems) != 1 || len(probs) != 1 {
+		t.Fatalf("got problems %v, want one unresolvable", r.Problems)
+	}
+	if p := probs[0]; p.Path != filepath.Base(tc.mountFile) || !p.Repaired {
+		t.Errorf("got %+v, want repaired problem for %s", p, tc.mountFile)
+	}
+
+	// The entry was invalidated, so the kernel asks again.
+	if _, err := os.Lstat(tc.mountFile); !os.IsNotExist(err) {
+		t.Errorf("Lstat after repair: got %v, want ENOENT", err)
+	}
+}
+
+func TestCheckOrphanHandle(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	mount := tc.connector.rootNode.mount
+	orphan := &openedFile{}
+	h := mount.openFiles.Register(&orphan.Handled, orphan)
+	defer mount.openFiles.Forget(h)
+
+	r := tc.connector.Check(false)
+	probs := checkKinds(r)[CheckOrphanHandle]
+	if len(probs) != 1 || probs[0].Handle != h {
+		t.Errorf("got problems %v, want orphan handle %d", r.Problems, h)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -40,8 +41,28 @@ type FileSystemConnector struct {
 	// Translate between uint64 handles and *Inode.
 	inodeMap HandleMap
 
+	// If set, node IDs stay valid after the kernel forgets them;
+	// see FileSystemOptions.PersistentInodes.
+	persistentInodes bool
+
+	// Generation number for all nodes, reported in EntryOut.
+	generation uint64
+
 	// The root of the FUSE file system.
 	rootNode *Inode
+
+	// See FileSystemOptions.MaxInodes.
+	maxInodes int
+
+	// Set while EvictInodes runs for maxInodes.  Accessed
+	// atomically.
+	evicting int32
+
+	// Pending notifications from EntryNotifyMany.
+	entryNotifies *entryNotifyQueue
+
+	// Supplementary groups of callers, for DefaultPermissions.
+	groups *groupCache
 }
 
 func NewFileSystemOptions() *FileSystemOptions {
@@ -58,7 +79,20 @@ func NewFileSystemConnector(nodeFs NodeFileSystem, opts *FileSystemOptions) (c *
 	if opts == nil {
 		opts = NewFileSystemOptions()
 	}
-	c.inodeMap = NewHandleMap(opts.PortableInodes)
+	c.generation = 1
+	if opts.PersistentInodes {
+		c.inodeMap = newPersistentHandleMap()
+		c.persistentInodes = true
+		// File handles from an earlier process have the same
+		// node IDs, but must not resolve to our nodes.  The
+		// kernel keeps 32 bits of the generation.
+		c.generation = uint64(uint32(time.Now().UnixNano()) | 1)
+	} else {
+		c.inodeMap = NewHandleMap(opts.PortableInodes)
+	}
+	c.maxInodes = opts.MaxInodes
+	c.entryNotifies = newEntryNotifyQueue(c, opts.NotifyRate)
+	c.groups = newGroupCache()
 	c.rootNode = newInode(true, nodeFs.Root())
 
 	c.verify()
@@ -78,13 +112,25 @@ func (c *FileSystemConnector) verify() {
 	root.verify(c.rootNode.mountPoint)
 }
 
+// getRawAttr runs GetAttr on the node, and stores the result in the
+// wire format.
+func getRawAttr(fsi FsNode, out *raw.Attr, file File, context *Context) Status {
+	attr := Attr{}
+	code := fsi.GetAttr(&attr, file, context)
+	attr.toRaw(out)
+	return code
+}
+
 // Generate EntryOut and increase the lookup count for an inode.
 func (c *FileSystemConnector) childLookup(out *raw.EntryOut, fsi FsNode)  {
 	n := fsi.Inode()
-	fsi.GetAttr((*Attr)(&out.Attr), nil, nil)
-	n.mount.fillEntry(out)
-	out.Ino = c.lookupUpdate(n)
-	out.NodeId = out.Ino
+	attr := Attr{}
+	fsi.GetAttr(&attr, nil, nil)
+	attr.toRaw(&out.Attr)
+	n.mount.fillEntry(out, &attr)
+	out.NodeId = c.lookupUpdate(n)
+	n.mount.setIno(&out.Attr, out.NodeId)
+	out.Generation = c.generation
 	if out.Nlink == 0 {
 		// With Nlink == 0, newer kernels will refuse link
 		// operations.
@@ -102,6 +148,18 @@ func (c *FileSystemConnector) findMount(parent *Inode, name string) (mount *file
 	return parent.mounts[name]
 }
 
+// findMountRoot returns the root of the file system mounted at name.
+// A concurrent Unmount clears the root of the mount, so it is read
+// under the same lock as the mount.
+func (c *FileSystemConnector) findMountRoot(parent *Inode, name string) *Inode {
+	parent.treeLock.RLock()
+	defer parent.treeLock.RUnlock()
+	if m := parent.mounts[name]; m != nil {
+		return m.mountInode
+	}
+	return nil
+}
+
 func (c *FileSystemConnector) toInode(nodeid uint64) *Inode {
 	if nodeid == raw.FUSE_ROOT_ID {
 		return c.rootNode
@@ -112,23 +170,37 @@ func (c *FileSystemConnector) toInode(nodeid uint64) *Inode {
 
 // Must run outside treeLock.  Returns the nodeId.
 func (c *FileSystemConnector) lookupUpdate(node *Inode) uint64 {
+	node.lookupMutex.Lock()
+	defer node.lookupMutex.Unlock()
+
 	node.treeLock.Lock()
-	if node.lookupCount == 0 {
+	if node.nodeId == 0 {
 		node.nodeId = c.inodeMap.Register(&node.handled, node)
 	}
 	node.lookupCount += 1
+	id := node.nodeId
+	added := node.lookupCount == 1
 	node.treeLock.Unlock()
-	
-	return node.nodeId
+
+	if added {
+		c.considerEvict()
+	}
+	return id
 }
 
 // Must run outside treeLock.
 func (c *FileSystemConnector) forgetUpdate(node *Inode, forgetCount int) {
 	defer c.verify()
 
+	node.lookupMutex.Lock()
+	defer node.lookupMutex.Unlock()
+
 	node.treeLock.Lock()
 	node.lookupCount -= forgetCount
-	if node.lookupCount == 0 {
+	forgotten := node.lookupCount == 0
+	if forgotten && c.persistentInodes {
+		node.releaseNodeId()
+	} else if forgotten {
 		c.inodeMap.Forget(node.nodeId)
 		node.nodeId = 0
 	} else if node.lookupCount < 0 {
@@ -137,6 +209,19 @@ func (c *FileSystemConnector) forgetUpdate(node *Inode, forgetCount int) {
 
 	c.recursiveConsiderDropInode(node)
 	node.treeLock.Unlock()
+
+	// Still holding lookupMutex: a concurrent lookup of this node
+	// cannot hand it to the kernel before the hook is done.
+	if forgotten {
+		node.fsInode.OnKernelForget()
+	}
+}
+
+// readOnly returns true if the root file system wants a read-only
+// mount.
+func (c *FileSystemConnector) readOnly() bool {
+	ro, ok := c.rootNode.mountPoint.fs.(readOnlyFs)
+	return ok && ro.readOnly()
 }
 
 // InodeCount returns the number of inodes registered with the kernel.
@@ -144,6 +229,86 @@ func (c *FileSystemConnector) InodeHandleCount() int {
 	return c.inodeMap.Count()
 }
 
+// InodeStats describes the Inodes kept by a FileSystemConnector.
+type InodeStats struct {
+	// Inodes is the number of Inodes in the tree, over all
+	// mounts.
+	Inodes int
+
+	// KernelInodes is the number of Inodes the kernel holds a
+	// reference to.
+	KernelInodes int
+
+	// Bytes is a rough estimate of the memory used by the
+	// Inodes, their FsNodes and the directory entries.
+	Bytes int64
+}
+
+// Approximate size of an entry in Inode.children, without the name.
+const inodeEntryBytes = 48
+
+// InodeStats walks the Inode tree, and returns its statistics.
+func (c *FileSystemConnector) InodeStats() InodeStats {
+	s := InodeStats{KernelInodes: c.inodeMap.Count()}
+	root := c.rootNode
+	root.treeLock.RLock()
+	root.addStats(&s)
+	root.treeLock.RUnlock()
+	return s
+}
+
+// EvictInodes drops the Inodes that neither the kernel nor open files
+// use.  If the kernel then still holds more than max Inodes, it is
+// asked to drop the directory entries of files and empty directories
+// that are not open, in no particular order.  The kernel forgets the
+// Inodes later, and may keep entries that are in use, eg. as working
+// directory.  EvictInodes returns the number of entries it
+// invalidated.
+func (c *FileSystemConnector) EvictInodes(max int) int {
+	for _, root := range c.rootNode.mountRoots() {
+		root.treeLock.Lock()
+		c.recursiveConsiderDropInode(root)
+		root.treeLock.Unlock()
+	}
+
+	excess := c.inodeMap.Count() - max
+	if excess <= 0 || c.fsInit.EntryNotify == nil {
+		return 0
+	}
+	var entries []evictEntry
+	root := c.rootNode
+	root.treeLock.RLock()
+	root.collectEvictable(&entries, excess)
+	root.treeLock.RUnlock()
+
+	// Outside the treeLock: the kernel may send a FORGET before
+	// the notification returns.
+	n := 0
+	for _, e := range entries {
+		if c.EntryNotify(e.parent, e.name).Ok() {
+			n++
+		}
+	}
+	return n
+}
+
+// considerEvict starts EvictInodes in the background if the kernel
+// holds more than maxInodes Inodes.  It does not run in the request
+// that added the Inode, because the kernel may hold the directory
+// locked for it, which blocks the notification.
+func (c *FileSystemConnector) considerEvict() {
+	if c.maxInodes <= 0 || c.inodeMap.Count() <= c.maxInodes {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.evicting, 0, 1) {
+		return
+	}
+	go func() {
+		c.EvictInodes(c.maxInodes * 9 / 10)
+		atomic.StoreInt32(&c.evicting, 0)
+	}()
+}
+
 // Must hold treeLock.
 
 func (c *FileSystemConnector) recursiveConsiderDropInode(n *Inode) (drop bool) {
@@ -239,8 +404,7 @@ func (c *FileSystemConnector) LookupNode(parent *Inode, path string) *Inode {
 ////////////////////////////////////////////////////////////////
 
 func (c *FileSystemConnector) MountRoot(nodeFs NodeFileSystem, opts *FileSystemOptions) {
-	c.rootNode.mountFs(nodeFs, opts)
-	c.rootNode.mount.connector = c
+	c.rootNode.mountFs(c, nodeFs, opts)
 	nodeFs.OnMount(c)
 	c.verify()
 }
@@ -269,8 +433,7 @@ func (c *FileSystemConnector) Mount(parent *Inode, name string, nodeFs NodeFileS
 		opts = c.rootNode.mountPoint.options
 	}
 
-	node.mountFs(nodeFs, opts)
-	node.mount.connector = c
+	node.mountFs(c, nodeFs, opts)
 	parent.addChild(name, node)
 
 	if parent.mounts == nil {
@@ -311,17 +474,23 @@ func (c *FileSystemConnector) Unmount(node *Inode) Status {
 		return EBUSY
 	}
 
+	// The mount has its own treeLock, which must be held while
+	// looking at its children; lookups may run concurrently.
 	mountInode := mount.mountInode
+	mountInode.treeLock.Lock()
 	if !mountInode.canUnmount() {
+		mountInode.treeLock.Unlock()
 		return EBUSY
 	}
 
 	mount.mountInode = nil
 	mountInode.mountPoint = nil
+	mountInode.treeLock.Unlock()
 
 	delete(parentNode.mounts, name)
 	delete(parentNode.children, name)
-	mount.fs.OnUnmount()
+	c.syncMount(mountInode)
+	mount.fs.OnUnmount(UNMOUNT_SUBMOUNT)
 
 	c.EntryNotify(parentNode, name)
 
@@ -333,7 +502,7 @@ func (c *FileSystemConnector) FileNotify(node *Inode, off int64, length int64) S
 	if node == c.rootNode {
 		n = raw.FUSE_ROOT_ID
 	}
-	if n == 0 {
+	if n == 0 || c.fsInit.InodeNotify == nil {
 		return OK
 	}
 	out := raw.NotifyInvalInodeOut{
@@ -349,7 +518,7 @@ func (c *FileSystemConnector) EntryNotify(dir *Inode, name string) Status {
 	if dir == c.rootNode {
 		n = raw.FUSE_ROOT_ID
 	}
-	if n == 0 {
+	if n == 0 || c.fsInit.EntryNotify == nil {
 		return OK
 	}
 	return c.fsInit.EntryNotify(n, name)
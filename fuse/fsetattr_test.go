@@ -16,6 +16,9 @@ type MutableDataFile struct {
 	data []byte
 	Attr
 	GetAttrCalled bool
+
+	// The caller of the last Chmod.
+	ChmodContext *Context
 }
 
 func (f *MutableDataFile) String() string {
@@ -37,11 +40,11 @@ func (f *MutableDataFile) Write(w *WriteIn, d []byte) (uint32, Status) {
 	return w.Size, OK
 }
 
-func (f *MutableDataFile) Flush() Status {
+func (f *MutableDataFile) Flush(*FlushIn) Status {
 	return OK
 }
 
-func (f *MutableDataFile) Release() {
+func (f *MutableDataFile) Release(*ReleaseIn) {
 
 }
 
@@ -56,23 +59,24 @@ func (f *MutableDataFile) GetAttr(out *Attr) Status {
 	return OK
 }
 
-func (f *MutableDataFile) Utimens(atimeNs int64, mtimeNs int64) Status {
-	f.Attr.SetNs(atimeNs, mtimeNs, -1)
+func (f *MutableDataFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	f.Attr.SetTimes(atime, mtime, nil)
 	return OK
 }
 
-func (f *MutableDataFile) Truncate(size uint64) Status {
+func (f *MutableDataFile) Truncate(size uint64, context *Context) Status {
 	f.data = f.data[:size]
 	return OK
 }
 
-func (f *MutableDataFile) Chown(uid uint32, gid uint32) Status {
+func (f *MutableDataFile) Chown(uid uint32, gid uint32, context *Context) Status {
 	f.Attr.Uid = uid
 	f.Attr.Gid = gid
 	return OK
 }
 
-func (f *MutableDataFile) Chmod(perms uint32) Status {
+func (f *MutableDataFile) Chmod(perms uint32, context *Context) Status {
+	f.ChmodContext = context
 	f.Attr.Mode = (f.Attr.Mode &^ 07777) | perms
 	return OK
 }
@@ -174,6 +178,9 @@ func TestFSetAttr(t *testing.T) {
 	if fs.file.Attr.Mode&07777 != 024 {
 		t.Error("chmod")
 	}
+	if c := fs.file.ChmodContext; c == nil || c.Pid != uint32(os.Getpid()) {
+		t.Errorf("chmod: got caller %v, want pid %d", c, os.Getpid())
+	}
 
 	err = os.Chtimes(fn, time.Unix(0, 100e3), time.Unix(0, 101e3))
 	CheckSuccess(err)
@@ -3,6 +3,8 @@ package fuse
 import (
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 	
 	"github.com/hanwen/go-fuse/raw"
@@ -17,6 +19,10 @@ type openedFile struct {
 	WithFlags
 
 	dir rawDir
+
+	// The caller that opened the file, so it can be reopened
+	// on its behalf after a Handoff.
+	opener raw.Context
 }
 
 type fileSystemMount struct {
@@ -42,6 +48,68 @@ type fileSystemMount struct {
 	Debug bool
 
 	connector *FileSystemConnector
+
+	// Extended attribute operations, as xattrGet etc., for which
+	// the file system returned ENOSYS.  Accessed atomically.
+	noXAttr uint32
+
+	// If set, the inode numbers from GetAttr are passed to the
+	// kernel instead of the node IDs.
+	stableInodes bool
+}
+
+// stableInodeFs is implemented by NodeFileSystems that fill in inode
+// numbers of their own, see PathNodeFsOptions.StableInodes.
+type stableInodeFs interface {
+	stableInodes() bool
+}
+
+// readOnlyFs is implemented by NodeFileSystems that can be mounted
+// read-only, see PathNodeFsOptions.ReadOnly.
+type readOnlyFs interface {
+	readOnly() bool
+}
+
+// setIno sets the inode number the kernel sees for nodeId.
+func (m *fileSystemMount) setIno(out *raw.Attr, nodeId uint64) {
+	if !m.stableInodes || out.Ino == 0 {
+		out.Ino = nodeId
+	}
+}
+
+// Extended attribute operations, for fileSystemMount.noXAttr.
+const (
+	xattrGet = 1 << iota
+	xattrSet
+	xattrList
+	xattrRemove
+)
+
+// xattrUnsupported returns true if the file system returned ENOSYS
+// for the xattr operation op before.  It is not asked again.
+func (m *fileSystemMount) xattrUnsupported(op uint32) bool {
+	return atomic.LoadUint32(&m.noXAttr)&op != 0
+}
+
+// xattrStatus records an ENOSYS for xattr operation op, and returns
+// the status for the kernel.  On ENOSYS, the kernel stops sending op
+// for the whole connection.  That is what the root file system wants,
+// but submounts say ENOTSUP instead, which the caller sees either way,
+// so the other mounts are still asked.
+func (m *fileSystemMount) xattrStatus(op uint32, code Status) Status {
+	if code != ENOSYS {
+		return code
+	}
+	for {
+		old := atomic.LoadUint32(&m.noXAttr)
+		if atomic.CompareAndSwapUint32(&m.noXAttr, old, old|op) {
+			break
+		}
+	}
+	if m.parentInode != nil {
+		return ENOTSUP
+	}
+	return ENOSYS
 }
 
 // Must called with lock for parent held.
@@ -61,19 +129,34 @@ func (m *fileSystemMount) setOwner(attr *raw.Attr) {
 	}
 }
 
-func (m *fileSystemMount) fillEntry(out *raw.EntryOut) {
-	splitDuration(m.options.EntryTimeout, &out.EntryValid, &out.EntryValidNsec)
-	splitDuration(m.options.AttrTimeout, &out.AttrValid, &out.AttrValidNsec)
+// timeout returns the timeout to use, given the override from Attr,
+// and the default from the options.
+func timeout(override, def time.Duration) time.Duration {
+	switch {
+	case override < 0:
+		return 0
+	case override > 0:
+		return override
+	}
+	return def
+}
+
+// fillEntry fills in the timeouts of out, taking overrides from a.
+func (m *fileSystemMount) fillEntry(out *raw.EntryOut, a *Attr) {
+	splitDuration(timeout(a.EntryTimeout, m.options.EntryTimeout), &out.EntryValid, &out.EntryValidNsec)
+	splitDuration(timeout(a.AttrTimeout, m.options.AttrTimeout), &out.AttrValid, &out.AttrValidNsec)
 	m.setOwner(&out.Attr)
+	m.setBlocks(&out.Attr)
 	if out.Mode & S_IFDIR == 0 && out.Nlink == 0 {
 		out.Nlink = 1
 	}
 }
 
-func (m *fileSystemMount) fillAttr(out *raw.AttrOut, nodeId uint64) {
-	splitDuration(m.options.AttrTimeout, &out.AttrValid, &out.AttrValidNsec)
+func (m *fileSystemMount) fillAttr(out *raw.AttrOut, nodeId uint64, a *Attr) {
+	splitDuration(timeout(a.AttrTimeout, m.options.AttrTimeout), &out.AttrValid, &out.AttrValidNsec)
 	m.setOwner(&out.Attr)
-	out.Ino = nodeId
+	m.setBlocks(&out.Attr)
+	m.setIno(&out.Attr, nodeId)
 }
 
 func (m *fileSystemMount) getOpenedFile(h uint64) *openedFile {
@@ -105,6 +188,13 @@ func (m *fileSystemMount) unregisterFileHandle(handle uint64, node *Inode) *open
 }
 
 func (m *fileSystemMount) registerFileHandle(node *Inode, dir rawDir, f File, flags uint32) (uint64, *openedFile) {
+	return m.registerFileHandleAt(node, dir, f, flags, 0)
+}
+
+// registerFileHandleAt registers an open file under handle, or under a
+// new handle if it is 0.  Only mounts of a connector with
+// PersistentInodes can choose the handle.
+func (m *fileSystemMount) registerFileHandleAt(node *Inode, dir rawDir, f File, flags uint32, handle uint64) (uint64, *openedFile) {
 	node.openFilesMutex.Lock()
 	b := &openedFile{
 		dir: dir,
@@ -114,32 +204,42 @@ func (m *fileSystemMount) registerFileHandle(node *Inode, dir rawDir, f File, fl
 		},
 	}
 
+	if f != nil {
+		b.WithFlags.File = m.unwrapFile(f, &b.WithFlags)
+		b.WithFlags.File.SetInode(node)
+	}
+	node.openFiles = append(node.openFiles, b)
+	if handle == 0 {
+		handle = m.openFiles.Register(&b.Handled, b)
+	} else {
+		m.openFiles.(*persistentHandleMap).registerAt(&b.Handled, b, handle)
+	}
+	node.openFilesMutex.Unlock()
+	return handle, b
+}
+
+// unwrapFile strips WithFlags wrappers from f, accumulating their
+// flags and descriptions into dest, if non-nil.
+func (m *fileSystemMount) unwrapFile(f File, dest *WithFlags) File {
 	for {
 		withFlags, ok := f.(*WithFlags)
 		if !ok {
-			break
+			return f
+		}
+		if dest != nil {
+			dest.FuseFlags |= withFlags.FuseFlags
+			dest.Description += withFlags.Description
 		}
-
-		b.WithFlags.File = withFlags.File
-		b.WithFlags.FuseFlags |= withFlags.FuseFlags
-		b.WithFlags.Description += withFlags.Description
 		f = withFlags.File
 	}
-
-	if b.WithFlags.File != nil {
-		b.WithFlags.File.SetInode(node)
-	}
-	node.openFiles = append(node.openFiles, b)
-	handle := m.openFiles.Register(&b.Handled, b)
-	node.openFilesMutex.Unlock()
-	return handle, b
 }
 
-// Creates a return entry for a non-existent path.
-func (m *fileSystemMount) negativeEntry(out *raw.EntryOut) bool {
-	if m.options.NegativeTimeout > 0.0 {
+// Creates a return entry for a non-existent path.  The Lookup may
+// have set a timeout in a.
+func (m *fileSystemMount) negativeEntry(out *raw.EntryOut, a *Attr) bool {
+	if dt := timeout(a.EntryTimeout, m.options.NegativeTimeout); dt > 0 {
 		out.NodeId = 0
-		splitDuration(m.options.NegativeTimeout, &out.EntryValid, &out.EntryValidNsec)
+		splitDuration(dt, &out.EntryValid, &out.EntryValidNsec)
 		return true
 	}
 	return false
@@ -0,0 +1,14 @@
+package fuse
+
+import (
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// setBlocks fills in the block usage for file systems that leave
+// Blocks zero.  Darwin has no block size in its attributes, so
+// unlike on Linux, a zero Blocks cannot be kept by setting Blksize.
+func (m *fileSystemMount) setBlocks(attr *raw.Attr) {
+	if attr.Blocks == 0 {
+		attr.Blocks = (attr.Size + 511) / 512
+	}
+}
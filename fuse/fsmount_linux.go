@@ -0,0 +1,20 @@
+package fuse
+
+import (
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// setBlocks fills in the block size and usage for file systems that
+// leave Blksize zero, so du and tar see data in synthetic files.
+func (m *fileSystemMount) setBlocks(attr *raw.Attr) {
+	if attr.Blksize != 0 {
+		return
+	}
+	attr.Blksize = m.options.Blksize
+	if attr.Blksize == 0 {
+		attr.Blksize = _DEFAULT_BLKSIZE
+	}
+	if attr.Blocks == 0 {
+		attr.Blocks = (attr.Size + 511) / 512
+	}
+}
@@ -5,6 +5,7 @@ package fuse
 import (
 	"bytes"
 	"log"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/raw"
@@ -16,20 +17,137 @@ func (c *FileSystemConnector) Init(fsInit *RawFsInit) {
 	c.fsInit = *fsInit
 }
 
-func (c *FileSystemConnector) lookupMountUpdate(out *Attr, mount *fileSystemMount) (node *Inode, code Status) {
-	code = mount.fs.Root().GetAttr(out, nil, nil)
+// OnUnmount syncs all mounted file systems and passes reason to
+// their OnUnmount, the innermost ones first.  The kernel only sends
+// SYNCFS to virtiofs, so this is where a file system gets to flush
+// its data.  After a handoff, the receiving process serves the same
+// file systems, so nothing is synced.
+func (c *FileSystemConnector) OnUnmount(reason UnmountReason) {
+	roots := c.rootNode.mountRoots()
+	for i := len(roots) - 1; i >= 0; i-- {
+		if m := roots[i].mountPoint; m != nil {
+			if reason != UNMOUNT_HANDOFF {
+				c.syncMount(roots[i])
+			}
+			m.fs.OnUnmount(reason)
+		}
+	}
+}
+
+// syncMount calls SyncFs on the root of a mount that is going away.
+// There is no caller to report an error to, so it is logged.
+func (c *FileSystemConnector) syncMount(root *Inode) {
+	ctx := c.newContext(&raw.InHeader{NodeId: root.nodeId})
+	if code := root.fsInode.SyncFs(ctx); !code.Ok() && code != ENOSYS {
+		log.Printf("SyncFs of node %d on unmount: %v", root.nodeId, code)
+	}
+}
+
+// newContext returns the context of a request, which can watch for
+// interrupts if we are served by a MountState.
+func (c *FileSystemConnector) newContext(header *raw.InHeader) *Context {
+	ctx := newContext(header)
+	ctx.unique = header.Unique
+	ctx.interrupted = c.fsInit.Interrupted
+	ctx.groups = c.groups.get
+	return ctx
+}
+
+// noOpen returns true if opens on the node may be refused, so the
+// kernel sends I/O without a file handle.
+func (c *FileSystemConnector) noOpen(node *Inode, capability uint32) bool {
+	if !node.mount.options.NoOpen || c.fsInit.KernelSettings == nil {
+		return false
+	}
+	return c.fsInit.KernelSettings().Flags&capability != 0
+}
+
+// getFile returns the file for the handle fh. If fh is 0, the kernel
+// did not open the file, and the node is opened for the duration of
+// the operation; the caller should call the returned release
+// function when done.
+func (c *FileSystemConnector) getFile(node *Inode, fh uint64, flags uint32, context *Context) (f File, release func(), code Status) {
+	if fh != 0 {
+		opened := node.mount.getOpenedFile(fh)
+		return opened.WithFlags.File, func() {}, OK
+	}
+
+	// The flags are those of the kernel's open file, which have been
+	// applied already.
+	flags &^= syscall.O_CREAT | syscall.O_EXCL | syscall.O_TRUNC
+	f, code = node.fsInode.Open(flags, context)
+	if !code.Ok() {
+		return nil, nil, code
+	}
+	f = node.mount.unwrapFile(f, nil)
+	f.SetInode(node)
+	return f, func() { f.Release(&ReleaseIn{}) }, OK
+}
+
+// killPrivFlags returns the killpriv capabilities we negotiated.
+func (c *FileSystemConnector) killPrivFlags() uint32 {
+	if c.fsInit.KernelSettings == nil {
+		return 0
+	}
+	return c.fsInit.KernelSettings().Flags & (raw.CAP_HANDLE_KILLPRIV | raw.CAP_HANDLE_KILLPRIV_V2)
+}
+
+// killPrivFor returns true if the connector should clear the setuid
+// and setgid bits for an operation by the caller.  flagged says
+// whether the kernel asked for it, with killpriv v2.
+func (c *FileSystemConnector) killPrivFor(flagged bool, context *Context) bool {
+	flags := c.killPrivFlags()
+	switch {
+	case flags&raw.CAP_HANDLE_KILLPRIV_V2 != 0:
+		return flagged
+	case flags&raw.CAP_HANDLE_KILLPRIV != 0:
+		return context.Uid != 0
+	}
+	return false
+}
+
+// killPriv clears the setuid bit of node, and the setgid bit if the
+// file is group executable, as the kernel does for writes by
+// unprivileged users.
+func killPriv(node *Inode, f File, context *Context) Status {
+	attr := &Attr{}
+	if code := node.fsInode.GetAttr(attr, f, context); !code.Ok() {
+		return code
+	}
+	if attr.IsDir() {
+		return OK
+	}
+	mode := attr.Mode & 07777
+	if mode&syscall.S_ISUID != 0 {
+		mode &^= syscall.S_ISUID
+	}
+	if mode&(syscall.S_ISGID|syscall.S_IXGRP) == syscall.S_ISGID|syscall.S_IXGRP {
+		mode &^= syscall.S_ISGID
+	}
+	if mode == attr.Mode&07777 {
+		return OK
+	}
+	// The writer need not own the file, so the bits are cleared
+	// on behalf of the owner.
+	owner := *context
+	owner.Owner = attr.Owner
+	return node.fsInode.Chmod(f, mode, &owner)
+}
+
+func (c *FileSystemConnector) lookupMountUpdate(out *Attr, root *Inode) (node *Inode, code Status) {
+	code = root.mount.fs.Root().GetAttr(out, nil, nil)
 	if !code.Ok() {
 		log.Println("Root getattr should not return error", code)
 		out.Mode = S_IFDIR | 0755
-		return mount.mountInode, OK
+		return root, OK
 	}
 
-	return mount.mountInode, OK
+	return root, OK
 }
 
 func (c *FileSystemConnector) internalLookup(out *Attr, parent *Inode, name string, context *Context) (node *Inode, code Status) {
-	if subMount := c.findMount(parent, name); subMount != nil {
-		return c.lookupMountUpdate(out, subMount)
+	if root := c.findMountRoot(parent, name); root != nil {
+		return c.lookupMountUpdate(out, root)
 	}
 
 	child := parent.GetChild(name)
@@ -54,16 +172,44 @@ func (c *FileSystemConnector) internalLookup(out *Attr, parent *Inode, name stri
 	return child, code
 }
 
+// lookupDot answers lookups of "." and "..", which the kernel issues
+// to resolve file handles of exported file systems.
+func (c *FileSystemConnector) lookupDot(out *Attr, node *Inode, name string, context *Context) (*Inode, Status) {
+	if name == ".." && node != c.rootNode {
+		node = node.lookupParent()
+		if node == nil {
+			return nil, ENOENT
+		}
+	}
+	return node, node.fsInode.GetAttr(out, nil, context)
+}
+
 func (c *FileSystemConnector) Lookup(out *raw.EntryOut, header *raw.InHeader, name string) (code Status) {
 	parent := c.toInode(header.NodeId)
-	if !parent.IsDir() {
-		log.Printf("Lookup %q called on non-Directory node %d", name, header.NodeId)
-		return ENOTDIR
-	}
-	context := (*Context)(&header.Context)
-	outAttr := (*Attr)(&out.Attr)
-	child, code := c.internalLookup(outAttr, parent, name, context)
-	if code == ENOENT && parent.mount.negativeEntry(out) {
+	if parent == nil {
+		// Only with PersistentInodes: a file handle for a node
+		// that was dropped.
+		return ESTALE
+	}
+	context := c.newContext(header)
+	outAttr := &Attr{}
+	var child *Inode
+	if name == "." || name == ".." {
+		child, code = c.lookupDot(outAttr, parent, name, context)
+	} else {
+		if !parent.IsDir() {
+			log.Printf("Lookup %q called on non-Directory node %d", name, header.NodeId)
+			return ENOTDIR
+		}
+		if checkPerms(parent) {
+			if code := checkAccess(parent, raw.X_OK, context); !code.Ok() {
+				return code
+			}
+		}
+		child, code = c.internalLookup(outAttr, parent, name, context)
+	}
+	outAttr.toRaw(&out.Attr)
+	if code == ENOENT && parent.mount.negativeEntry(out, outAttr) {
 		return OK
 	}
 	if !code.Ok() {
@@ -73,10 +219,13 @@ func (c *FileSystemConnector) Lookup(out *raw.EntryOut, header *raw.InHeader, na
 		log.Println("Lookup returned OK with nil child", name)
 	}
 
-	child.mount.fillEntry(out)
+	child.mount.fillEntry(out, outAttr)
 	out.NodeId = c.lookupUpdate(child)
-	out.Generation = 1
-	out.Ino = out.NodeId
+	if child == c.rootNode {
+		out.NodeId = raw.FUSE_ROOT_ID
+	}
+	out.Generation = c.generation
+	child.mount.setIno(&out.Attr, out.NodeId)
 
 	return OK
 }
@@ -90,34 +239,41 @@ func (c *FileSystemConnector) GetAttr(out *raw.AttrOut, header *raw.InHeader, in
 	node := c.toInode(header.NodeId)
 
 	var f File
-	if input.Flags&raw.FUSE_GETATTR_FH != 0 {
+	if input.Flags&raw.FUSE_GETATTR_FH != 0 && input.Fh != 0 {
 		if opened := node.mount.getOpenedFile(input.Fh); opened != nil {
 			f = opened.WithFlags.File
 		}
 	}
 
-	dest := (*Attr)(&out.Attr)
-	code = node.fsInode.GetAttr(dest, f, (*Context)(&header.Context))
+	dest := &Attr{}
+	code = node.fsInode.GetAttr(dest, f, c.newContext(header))
 	if !code.Ok() {
 		return code
 	}
+	dest.toRaw(&out.Attr)
 
-	node.mount.fillAttr(out, header.NodeId)
+	node.mount.fillAttr(out, header.NodeId, dest)
 	return OK
 }
 
 func (c *FileSystemConnector) OpenDir(out *raw.OpenOut, header *raw.InHeader, input *raw.OpenIn) (code Status) {
 	node := c.toInode(header.NodeId)
-	stream, err := node.fsInode.OpenDir((*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(node) {
+		if code := checkAccess(node, raw.R_OK, ctx); !code.Ok() {
+			return code
+		}
+	}
+	dir, err := openDir(node, ctx)
 	if err != OK {
 		return err
 	}
-	stream = append(stream, node.getMountDirEntries()...)
-	de := &connectorDir{
-		node: node.FsNode(),
-		stream: append(stream, DirEntry{S_IFDIR, "."}, DirEntry{S_IFDIR, ".."}),
+	if c.noOpen(node, raw.CAP_NO_OPENDIR_SUPPORT) {
+		dir.Release()
+		return ENOSYS
 	}
-	h, opened := node.mount.registerFileHandle(node, de, nil, input.Flags)
+	h, opened := node.mount.registerFileHandle(node, dir, nil, input.Flags)
+	opened.opener = ctx.Context
 	out.OpenFlags = opened.FuseFlags
 	out.Fh = h
 	return OK
@@ -125,17 +281,44 @@ func (c *FileSystemConnector) OpenDir(out *raw.OpenOut, header *raw.InHeader, in
 
 func (c *FileSystemConnector) ReadDir(l *DirEntryList, header *raw.InHeader, input *ReadIn) (Status) {
 	node := c.toInode(header.NodeId)
+	ctx := c.newContext(header)
+	if input.Fh == 0 {
+		dir, code := openDir(node, ctx)
+		if !code.Ok() {
+			return code
+		}
+		defer dir.Release()
+		return dir.ReadDir(l, input, ctx)
+	}
 	opened := node.mount.getOpenedFile(input.Fh)
-	return opened.dir.ReadDir(l, input)
+	return opened.dir.ReadDir(l, input, ctx)
 }
 
 func (c *FileSystemConnector) Open(out *raw.OpenOut, header *raw.InHeader, input *raw.OpenIn) (status Status) {
 	node := c.toInode(header.NodeId)
-	f, code := node.fsInode.Open(input.Flags, (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(node) {
+		if code := checkAccess(node, openMask(input.Flags), ctx); !code.Ok() {
+			return code
+		}
+	}
+	f, code := node.fsInode.Open(input.Flags, ctx)
 	if !code.Ok() {
 		return code
 	}
+	if input.Flags&syscall.O_TRUNC != 0 &&
+		c.killPrivFor(input.OpenFlags&raw.OPEN_KILL_SUIDGID != 0, ctx) {
+		if code := killPriv(node, f, ctx); !code.Ok() {
+			node.mount.unwrapFile(f, nil).Release(&ReleaseIn{})
+			return code
+		}
+	}
+	if c.noOpen(node, raw.CAP_NO_OPEN_SUPPORT) {
+		node.mount.unwrapFile(f, nil).Release(&ReleaseIn{})
+		return ENOSYS
+	}
 	h, opened := node.mount.registerFileHandle(node, nil, f, input.Flags)
+	opened.opener = ctx.Context
 	out.OpenFlags = opened.FuseFlags
 	out.Fh = h
 	return OK
@@ -144,98 +327,177 @@ func (c *FileSystemConnector) Open(out *raw.OpenOut, header *raw.InHeader, input
 func (c *FileSystemConnector) SetAttr(out *raw.AttrOut, header *raw.InHeader, input *raw.SetAttrIn) (code Status) {
 	node := c.toInode(header.NodeId)
 	var f File
-	if input.Valid&raw.FATTR_FH != 0 {
+	if input.Valid&raw.FATTR_FH != 0 && input.Fh != 0 {
 		opened := node.mount.getOpenedFile(input.Fh)
 		f = opened.WithFlags.File
 	}
 
-	if code.Ok() && input.Valid&raw.FATTR_MODE != 0 {
-		permissions := uint32(07777) & input.Mode
-		code = node.fsInode.Chmod(f, permissions, (*Context)(&header.Context))
-	}
-	if code.Ok() && (input.Valid&(raw.FATTR_UID|raw.FATTR_GID) != 0) {
-		code = node.fsInode.Chown(f, uint32(input.Uid), uint32(input.Gid), (*Context)(&header.Context))
-	}
-	if code.Ok() && input.Valid&raw.FATTR_SIZE != 0 {
-		code = node.fsInode.Truncate(f, input.Size, (*Context)(&header.Context))
-	}
-	if code.Ok() && (input.Valid&(raw.FATTR_ATIME|raw.FATTR_MTIME|raw.FATTR_ATIME_NOW|raw.FATTR_MTIME_NOW) != 0) {
-		now := int64(0)
-		if input.Valid&raw.FATTR_ATIME_NOW != 0 || input.Valid&raw.FATTR_MTIME_NOW != 0 {
-			now = time.Now().UnixNano()
-		}
-
-		atime := int64(input.Atime*1e9) + int64(input.Atimensec)
-		if input.Valid&raw.FATTR_ATIME_NOW != 0 {
-			atime = now
+	ctx := c.newContext(header)
+	if checkPerms(node) {
+		if code := checkSetattr(node, input, ctx); !code.Ok() {
+			return code
 		}
-
-		mtime := int64(input.Mtime*1e9) + int64(input.Mtimensec)
-		if input.Valid&raw.FATTR_MTIME_NOW != 0 {
-			mtime = now
+	}
+	if c.killPrivSetattr(input, ctx) {
+		if code := killPriv(node, f, ctx); !code.Ok() {
+			return code
 		}
-
-		code = node.fsInode.Utimens(f, atime, mtime, (*Context)(&header.Context))
 	}
-
+	attr := setAttrInput(input)
+	code = node.fsInode.Setattr(f, input.Valid, attr, ctx)
+	if code == ENOSYS {
+		code = splitSetattr(node.fsInode, f, input.Valid, attr, ctx)
+	}
 	if !code.Ok() {
 		return code
 	}
 
 	// Must call GetAttr(); the filesystem may override some of
 	// the changes we effect here.
-	attr := (*Attr)(&out.Attr)
-	code = node.fsInode.GetAttr(attr, nil, (*Context)(&header.Context))
+	attr = &Attr{}
+	code = node.fsInode.GetAttr(attr, nil, ctx)
 	if code.Ok() {
-		node.mount.fillAttr(out, header.NodeId)
+		attr.toRaw(&out.Attr)
+		node.mount.fillAttr(out, header.NodeId, attr)
+	}
+	return code
+}
+
+// killPrivSetattr returns true if the setuid and setgid bits should
+// be cleared before a SETATTR.  An explicit mode wins; chown always
+// clears them, and truncate follows the rules of writes.
+func (c *FileSystemConnector) killPrivSetattr(input *raw.SetAttrIn, context *Context) bool {
+	if input.Valid&raw.FATTR_MODE != 0 || c.killPrivFlags() == 0 {
+		return false
+	}
+	if input.Valid&(raw.FATTR_UID|raw.FATTR_GID) != 0 {
+		return true
+	}
+	return input.Valid&raw.FATTR_SIZE != 0 &&
+		c.killPrivFor(input.Valid&raw.FATTR_KILL_SUIDGID != 0, context)
+}
+
+// setAttrInput returns the attributes of a SETATTR request, with
+// UTIME_NOW for the times of FATTR_ATIME_NOW and FATTR_MTIME_NOW.
+func setAttrInput(input *raw.SetAttrIn) *Attr {
+	attr := &Attr{
+		Size:      input.Size,
+		Atime:     input.Atime,
+		Atimensec: input.Atimensec,
+		Mtime:     input.Mtime,
+		Mtimensec: input.Mtimensec,
+		Mode:      input.Mode & 07777,
+		Owner:     input.Owner,
+	}
+	if input.Valid&raw.FATTR_ATIME_NOW != 0 {
+		attr.Atime, attr.Atimensec = 0, UTIME_NOW
+	}
+	if input.Valid&raw.FATTR_MTIME_NOW != 0 {
+		attr.Mtime, attr.Mtimensec = 0, UTIME_NOW
+	}
+	return attr
+}
+
+// splitSetattr applies a SETATTR as separate Chmod, Chown, Truncate
+// and Utimens calls, for nodes that do not implement Setattr.
+func splitSetattr(node FsNode, f File, valid uint32, attr *Attr, ctx *Context) (code Status) {
+	if valid&raw.FATTR_MODE != 0 {
+		code = node.Chmod(f, attr.Mode, ctx)
+	}
+	if code.Ok() && (valid&(raw.FATTR_UID|raw.FATTR_GID) != 0) {
+		code = node.Chown(f, attr.Uid, attr.Gid, ctx)
+	}
+	if code.Ok() && valid&raw.FATTR_SIZE != 0 {
+		code = node.Truncate(f, attr.Size, ctx)
+	}
+	if code.Ok() && (valid&(raw.FATTR_ATIME|raw.FATTR_MTIME|raw.FATTR_ATIME_NOW|raw.FATTR_MTIME_NOW) != 0) {
+		var atime, mtime *time.Time
+		if valid&(raw.FATTR_ATIME|raw.FATTR_ATIME_NOW) != 0 {
+			t := attr.AccessTime()
+			atime = &t
+		}
+		if valid&(raw.FATTR_MTIME|raw.FATTR_MTIME_NOW) != 0 {
+			t := attr.ModTime()
+			mtime = &t
+		}
+		code = node.Utimens(f, atime, mtime, ctx)
 	}
 	return code
 }
 
 func (c *FileSystemConnector) Readlink(header *raw.InHeader) (out []byte, code Status) {
 	n := c.toInode(header.NodeId)
-	return n.fsInode.Readlink((*Context)(&header.Context))
+	return n.fsInode.Readlink(c.newContext(header))
 }
 
 func (c *FileSystemConnector) Mknod(out *raw.EntryOut, header *raw.InHeader, input *raw.MknodIn, name string) (code Status) {
 	parent := c.toInode(header.NodeId)
-	ctx := (*Context)(&header.Context)
+	ctx := c.newContext(header)
+	ctx.Umask = input.Umask
+	if checkPerms(parent) {
+		if code := checkAccess(parent, raw.W_OK|raw.X_OK, ctx); !code.Ok() {
+			return code
+		}
+	}
 	fsNode, code := parent.fsInode.Mknod(name, input.Mode, uint32(input.Rdev), ctx)
 	if code.Ok() {
 		c.childLookup(out, fsNode)
-		code = fsNode.GetAttr((*Attr)(&out.Attr), nil, ctx)
+		code = getRawAttr(fsNode, &out.Attr, nil, ctx)
 	}
 	return code
 }
 
 func (c *FileSystemConnector) Mkdir(out *raw.EntryOut, header *raw.InHeader, input *raw.MkdirIn, name string) (code Status) {
 	parent := c.toInode(header.NodeId)
-	ctx := (*Context)(&header.Context)
+	ctx := c.newContext(header)
+	ctx.Umask = input.Umask
+	if checkPerms(parent) {
+		if code := checkAccess(parent, raw.W_OK|raw.X_OK, ctx); !code.Ok() {
+			return code
+		}
+	}
 	fsNode, code := parent.fsInode.Mkdir(name, input.Mode, ctx)
 	if code.Ok() {
 		c.childLookup(out, fsNode)
-		code = fsNode.GetAttr((*Attr)(&out.Attr), nil, ctx)
+		code = getRawAttr(fsNode, &out.Attr, nil, ctx)
 	}
 	return code
 }
 
 func (c *FileSystemConnector) Unlink(header *raw.InHeader, name string) (code Status) {
 	parent := c.toInode(header.NodeId)
-	return parent.fsInode.Unlink(name, (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(parent) {
+		if code := c.checkRemove(parent, name, ctx); !code.Ok() {
+			return code
+		}
+	}
+	return parent.fsInode.Unlink(name, ctx)
 }
 
 func (c *FileSystemConnector) Rmdir(header *raw.InHeader, name string) (code Status) {
 	parent := c.toInode(header.NodeId)
-	return parent.fsInode.Rmdir(name, (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(parent) {
+		if code := c.checkRemove(parent, name, ctx); !code.Ok() {
+			return code
+		}
+	}
+	return parent.fsInode.Rmdir(name, ctx)
 }
 
 func (c *FileSystemConnector) Symlink(out *raw.EntryOut, header *raw.InHeader, pointedTo string, linkName string) (code Status) {
 	parent := c.toInode(header.NodeId)
-	ctx := (*Context)(&header.Context)
+	ctx := c.newContext(header)
+	if checkPerms(parent) {
+		if code := checkAccess(parent, raw.W_OK|raw.X_OK, ctx); !code.Ok() {
+			return code
+		}
+	}
 	fsNode, code := parent.fsInode.Symlink(linkName, pointedTo, ctx)
 	if code.Ok() {
 		c.childLookup(out, fsNode)
-		code = fsNode.GetAttr((*Attr)(&out.Attr), nil, ctx)
+		code = getRawAttr(fsNode, &out.Attr, nil, ctx)
 	}
 	return code
 }
@@ -252,7 +514,13 @@ func (c *FileSystemConnector) Rename(header *raw.InHeader, input *raw.RenameIn,
 		return EXDEV
 	}
 
-	return oldParent.fsInode.Rename(oldName, newParent.fsInode, newName, (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(oldParent) {
+		if code := c.checkRename(oldParent, oldName, newParent, newName, ctx); !code.Ok() {
+			return code
+		}
+	}
+	return oldParent.fsInode.Rename(oldName, newParent.fsInode, newName, ctx)
 }
 
 func (c *FileSystemConnector) Link(out *raw.EntryOut, header *raw.InHeader, input *raw.LinkIn, name string) (code Status) {
@@ -262,11 +530,16 @@ func (c *FileSystemConnector) Link(out *raw.EntryOut, header *raw.InHeader, inpu
 	if existing.mount != parent.mount {
 		return EXDEV
 	}
-	ctx := (*Context)(&header.Context)
+	ctx := c.newContext(header)
+	if checkPerms(parent) {
+		if code := checkAccess(parent, raw.W_OK|raw.X_OK, ctx); !code.Ok() {
+			return code
+		}
+	}
 	fsNode, code := parent.fsInode.Link(name, existing.fsInode, ctx)
 	if code.Ok() {
 		c.childLookup(out, fsNode)
-		code = fsNode.GetAttr((*Attr)(&out.Attr), nil, ctx)
+		code = getRawAttr(fsNode, &out.Attr, nil, ctx)
 	}
 
 	return code
@@ -274,18 +547,30 @@ func (c *FileSystemConnector) Link(out *raw.EntryOut, header *raw.InHeader, inpu
 
 func (c *FileSystemConnector) Access(header *raw.InHeader, input *raw.AccessIn) (code Status) {
 	n := c.toInode(header.NodeId)
-	return n.fsInode.Access(input.Mask, (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(n) {
+		return checkAccess(n, input.Mask, ctx)
+	}
+	return n.fsInode.Access(input.Mask, ctx)
 }
 
 func (c *FileSystemConnector) Create(out *raw.CreateOut, header *raw.InHeader, input *raw.CreateIn, name string) (code Status) {
 	parent := c.toInode(header.NodeId)
-	f, fsNode, code := parent.fsInode.Create(name, uint32(input.Flags), input.Mode, (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	ctx.Umask = input.Umask
+	if checkPerms(parent) {
+		if code := checkAccess(parent, raw.W_OK|raw.X_OK, ctx); !code.Ok() {
+			return code
+		}
+	}
+	f, fsNode, code := parent.fsInode.Create(name, uint32(input.Flags), input.Mode, ctx)
 	if !code.Ok() {
 		return code
 	}
 
 	c.childLookup(&out.EntryOut, fsNode)
 	handle, opened := parent.mount.registerFileHandle(fsNode.Inode(), nil, f, input.Flags)
+	opened.opener = ctx.Context
 
 	out.OpenOut.OpenFlags = opened.FuseFlags
 	out.OpenOut.Fh = handle
@@ -293,12 +578,18 @@ func (c *FileSystemConnector) Create(out *raw.CreateOut, header *raw.InHeader, i
 }
 
 func (c *FileSystemConnector) Release(header *raw.InHeader, input *raw.ReleaseIn) {
+	if input.Fh == 0 {
+		return
+	}
 	node := c.toInode(header.NodeId)
 	opened := node.mount.unregisterFileHandle(input.Fh, node)
-	opened.WithFlags.File.Release()
+	opened.WithFlags.File.Release((*ReleaseIn)(input))
 }
 
 func (c *FileSystemConnector) ReleaseDir(header *raw.InHeader, input *raw.ReleaseIn) {
+	if input.Fh == 0 {
+		return
+	}
 	node := c.toInode(header.NodeId)
 	opened := node.mount.unregisterFileHandle(input.Fh, node)
 	opened.dir.Release()
@@ -306,30 +597,70 @@ func (c *FileSystemConnector) ReleaseDir(header *raw.InHeader, input *raw.Releas
 
 func (c *FileSystemConnector) GetXAttrSize(header *raw.InHeader, attribute string) (sz int, code Status) {
 	node := c.toInode(header.NodeId)
-	data, errno := node.fsInode.GetXAttr(attribute, (*Context)(&header.Context))
-	return len(data), errno
+	ctx := c.newContext(header)
+	if checkPerms(node) {
+		if code := checkXAttr(node, attribute, raw.R_OK, ctx); !code.Ok() {
+			return 0, code
+		}
+	}
+	if node.mount.xattrUnsupported(xattrGet) {
+		return 0, node.mount.xattrStatus(xattrGet, ENOSYS)
+	}
+	data, errno := node.fsInode.GetXAttr(attribute, ctx)
+	return len(data), node.mount.xattrStatus(xattrGet, errno)
 }
 
 func (c *FileSystemConnector) GetXAttrData(header *raw.InHeader, attribute string) (data []byte, code Status) {
 	node := c.toInode(header.NodeId)
-	return node.fsInode.GetXAttr(attribute, (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(node) {
+		if code := checkXAttr(node, attribute, raw.R_OK, ctx); !code.Ok() {
+			return nil, code
+		}
+	}
+	if node.mount.xattrUnsupported(xattrGet) {
+		return nil, node.mount.xattrStatus(xattrGet, ENOSYS)
+	}
+	data, code = node.fsInode.GetXAttr(attribute, ctx)
+	return data, node.mount.xattrStatus(xattrGet, code)
 }
 
 func (c *FileSystemConnector) RemoveXAttr(header *raw.InHeader, attr string) Status {
 	node := c.toInode(header.NodeId)
-	return node.fsInode.RemoveXAttr(attr, (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(node) {
+		if code := checkXAttr(node, attr, raw.W_OK, ctx); !code.Ok() {
+			return code
+		}
+	}
+	if node.mount.xattrUnsupported(xattrRemove) {
+		return node.mount.xattrStatus(xattrRemove, ENOSYS)
+	}
+	return node.mount.xattrStatus(xattrRemove, node.fsInode.RemoveXAttr(attr, ctx))
 }
 
 func (c *FileSystemConnector) SetXAttr(header *raw.InHeader, input *raw.SetXAttrIn, attr string, data []byte) Status {
 	node := c.toInode(header.NodeId)
-	return node.fsInode.SetXAttr(attr, data, int(input.Flags), (*Context)(&header.Context))
+	ctx := c.newContext(header)
+	if checkPerms(node) {
+		if code := checkXAttr(node, attr, raw.W_OK, ctx); !code.Ok() {
+			return code
+		}
+	}
+	if node.mount.xattrUnsupported(xattrSet) {
+		return node.mount.xattrStatus(xattrSet, ENOSYS)
+	}
+	return node.mount.xattrStatus(xattrSet, node.fsInode.SetXAttr(attr, data, int(input.Flags), ctx))
 }
 
 func (c *FileSystemConnector) ListXAttr(header *raw.InHeader) (data []byte, code Status) {
 	node := c.toInode(header.NodeId)
-	attrs, code := node.fsInode.ListXAttr((*Context)(&header.Context))
+	if node.mount.xattrUnsupported(xattrList) {
+		return nil, node.mount.xattrStatus(xattrList, ENOSYS)
+	}
+	attrs, code := node.fsInode.ListXAttr(c.newContext(header))
 	if code != OK {
-		return nil, code
+		return nil, node.mount.xattrStatus(xattrList, code)
 	}
 
 	b := bytes.NewBuffer([]byte{})
@@ -346,14 +677,71 @@ func (c *FileSystemConnector) ListXAttr(header *raw.InHeader) (data []byte, code
 
 func (c *FileSystemConnector) Write(header *raw.InHeader, input *WriteIn, data []byte) (written uint32, code Status) {
 	node := c.toInode(header.NodeId)
-	opened := node.mount.getOpenedFile(input.Fh)
-	return opened.WithFlags.File.Write(input, data)
+	ctx := c.newContext(header)
+	f, release, code := c.getFile(node, input.Fh, input.Flags, ctx)
+	if !code.Ok() {
+		return 0, code
+	}
+	defer release()
+	if c.killPrivFor(input.WriteFlags&WRITE_KILL_SUIDGID != 0, ctx) {
+		if code := killPriv(node, f, ctx); !code.Ok() {
+			return 0, code
+		}
+	}
+	return f.Write(input, data)
+}
+
+// The kernel caps the length of copy_file_range requests, but older
+// ones did not, and the reply only holds 32 bits.
+const maxCopyFileRange = (1<<32 - 1) &^ 4095
+
+func (c *FileSystemConnector) CopyFileRange(header *raw.InHeader, input *raw.CopyFileRangeIn) (written uint32, code Status) {
+	ctx := c.newContext(header)
+	src, releaseSrc, code := c.getFile(c.toInode(header.NodeId), input.FhIn, syscall.O_RDONLY, ctx)
+	if !code.Ok() {
+		return 0, code
+	}
+	defer releaseSrc()
+	dst, releaseDst, code := c.getFile(c.toInode(input.NodeIdOut), input.FhOut, syscall.O_WRONLY, ctx)
+	if !code.Ok() {
+		return 0, code
+	}
+	defer releaseDst()
+
+	cf, ok := withoutFlags(src).(CopyRangeFile)
+	if !ok {
+		return 0, ENOTSUP
+	}
+	size := input.Len
+	if size > maxCopyFileRange {
+		size = maxCopyFileRange
+	}
+	return cf.CopyFileRange(input.OffIn, withoutFlags(dst), input.OffOut, size)
 }
 
 func (c *FileSystemConnector) Read(header *raw.InHeader, input *ReadIn, bp BufferPool) ([]byte, Status) {
 	node := c.toInode(header.NodeId)
-	opened := node.mount.getOpenedFile(input.Fh)
-	return opened.WithFlags.File.Read(input, bp)
+	f, release, code := c.getFile(node, input.Fh, input.Flags, c.newContext(header))
+	if !code.Ok() {
+		return nil, code
+	}
+	defer release()
+	return f.Read(input, bp)
+}
+
+// readFd returns the descriptor of an FdFile to splice a read from.
+// release must be called once the reply is written.
+func (c *FileSystemConnector) readFd(header *raw.InHeader, input *ReadIn) (fd int, release func(), ok bool) {
+	node := c.toInode(header.NodeId)
+	f, release, code := c.getFile(node, input.Fh, input.Flags, c.newContext(header))
+	if !code.Ok() {
+		return 0, nil, false
+	}
+	if fdFile, isFd := withoutFlags(f).(FdFile); isFd {
+		return fdFile.Fd(), release, true
+	}
+	release()
+	return 0, nil, false
 }
 
 func (c *FileSystemConnector) StatFs(out *StatfsOut, header *raw.InHeader) Status {
@@ -366,9 +754,47 @@ func (c *FileSystemConnector) StatFs(out *StatfsOut, header *raw.InHeader) Statu
 	return OK
 }
 
+// SyncFs syncs the file system of the node and all file systems
+// mounted below it.  It returns ENOSYS only if none of them
+// implements SyncFs.
+func (c *FileSystemConnector) SyncFs(header *raw.InHeader, input *raw.SyncFsIn) Status {
+	ctx := c.newContext(header)
+	result := ENOSYS
+	for _, root := range c.toInode(header.NodeId).mountRoots() {
+		code := root.fsInode.SyncFs(ctx)
+		if code == ENOSYS {
+			continue
+		}
+		if result.Ok() || result == ENOSYS {
+			result = code
+		}
+	}
+	return result
+}
+
+func (c *FileSystemConnector) Fsync(header *raw.InHeader, input *raw.FsyncIn) Status {
+	node := c.toInode(header.NodeId)
+	// fsync does not need write access, and a read-only open
+	// also works for files without write permission.
+	f, release, code := c.getFile(node, input.Fh, syscall.O_RDONLY, c.newContext(header))
+	if !code.Ok() {
+		return code
+	}
+	defer release()
+	return f.Fsync(int(input.FsyncFlags))
+}
+
+func (c *FileSystemConnector) FsyncDir(header *raw.InHeader, input *raw.FsyncIn) Status {
+	node := c.toInode(header.NodeId)
+	return node.fsInode.FsyncDir(int(input.FsyncFlags), c.newContext(header))
+}
+
 func (c *FileSystemConnector) Flush(header *raw.InHeader, input *raw.FlushIn) Status {
+	if input.Fh == 0 {
+		return OK
+	}
 	node := c.toInode(header.NodeId)
 	opened := node.mount.getOpenedFile(input.Fh)
-	return opened.WithFlags.File.Flush()
+	return opened.WithFlags.File.Flush((*FlushIn)(input))
 }
 
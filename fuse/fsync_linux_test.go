@@ -0,0 +1,118 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// fsyncFs records the flags of fsync calls on files and directories.
+type fsyncFs struct {
+	DefaultFileSystem
+
+	mu        sync.Mutex
+	fileFlags []int
+	dirFlags  []int
+	openFlags []uint32
+}
+
+func (fs *fsyncFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	switch name {
+	case "", "dir":
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	case "file":
+		return &Attr{Mode: S_IFREG | 0644}, OK
+	}
+	return nil, ENOENT
+}
+
+func (fs *fsyncFs) OpenDir(name string, context *Context) ([]DirEntry, Status) {
+	return nil, OK
+}
+
+func (fs *fsyncFs) Open(name string, flags uint32, context *Context) (File, Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.openFlags = append(fs.openFlags, flags)
+	return &fsyncFile{fs: fs}, OK
+}
+
+func (fs *fsyncFs) FsyncDir(name string, flags int, context *Context) Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.dirFlags = append(fs.dirFlags, flags)
+	return OK
+}
+
+type fsyncFile struct {
+	DefaultFile
+	fs *fsyncFs
+}
+
+func (f *fsyncFile) Fsync(flags int) Status {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.fileFlags = append(f.fs.fileFlags, flags)
+	return OK
+}
+
+func (f *fsyncFile) Release(*ReleaseIn) {
+}
+
+func TestFsyncFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	fs := &fsyncFs{}
+	state, _, err := MountNodeFileSystem(dir, NewPathNodeFs(fs, nil), nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	f, err := os.OpenFile(dir+"/file", os.O_WRONLY, 0)
+	CheckSuccess(err)
+	defer f.Close()
+	CheckSuccess(syscall.Fsync(int(f.Fd())))
+	CheckSuccess(syscall.Fdatasync(int(f.Fd())))
+
+	d, err := os.Open(dir + "/dir")
+	CheckSuccess(err)
+	defer d.Close()
+	CheckSuccess(syscall.Fsync(int(d.Fd())))
+	CheckSuccess(syscall.Fdatasync(int(d.Fd())))
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	want := []int{0, raw.FUSE_FSYNC_FDATASYNC}
+	for _, got := range [][]int{fs.fileFlags, fs.dirFlags} {
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("got fsync flags %v, want %v", got, want)
+		}
+	}
+}
+
+// Without a file handle, fsync opens the file read-only, as a writable
+// open fails for read-only files.
+func TestFsyncWithoutHandle(t *testing.T) {
+	fs := &fsyncFs{}
+	c := NewFileSystemConnector(NewPathNodeFs(fs, nil), nil)
+	var out raw.EntryOut
+	if code := c.Lookup(&out, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file"); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	if code := c.Fsync(&raw.InHeader{NodeId: out.NodeId}, &raw.FsyncIn{}); !code.Ok() {
+		t.Fatalf("Fsync: %v", code)
+	}
+	if len(fs.openFlags) != 1 || fs.openFlags[0]&syscall.O_ACCMODE != syscall.O_RDONLY {
+		t.Errorf("got open flags %v, want O_RDONLY", fs.openFlags)
+	}
+	if len(fs.fileFlags) != 1 {
+		t.Errorf("got fsync calls %v, want 1", fs.fileFlags)
+	}
+}
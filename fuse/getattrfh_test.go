@@ -0,0 +1,99 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// sizedFs hands out files that each report their own size, while the
+// path reports pathSize.
+type sizedFs struct {
+	DefaultFileSystem
+
+	mu      sync.Mutex
+	deleted bool
+	opened  int
+}
+
+const pathSize = 5
+
+func (fs *sizedFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if name == "" {
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	}
+	if name == "file" && !fs.deleted {
+		return &Attr{Mode: S_IFREG | 0644, Size: pathSize}, OK
+	}
+	return nil, ENOENT
+}
+
+func (fs *sizedFs) Open(name string, flags uint32, context *Context) (File, Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.opened++
+	return &sizedFile{size: uint64(10 * fs.opened)}, OK
+}
+
+func (fs *sizedFs) Unlink(name string, context *Context) Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.deleted = true
+	return OK
+}
+
+type sizedFile struct {
+	DefaultFile
+	size uint64
+}
+
+func (f *sizedFile) GetAttr(out *Attr) Status {
+	*out = Attr{Mode: S_IFREG | 0644, Size: f.size}
+	return OK
+}
+
+func (f *sizedFile) Release(*ReleaseIn) {
+}
+
+func TestGetAttrFileHandle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	// No attribute caching, so each query reaches us.
+	state, _, err := MountNodeFileSystem(dir, NewPathNodeFs(&sizedFs{}, nil), &FileSystemOptions{})
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	f1, err := os.Open(dir + "/file")
+	CheckSuccess(err)
+	defer f1.Close()
+	f2, err := os.Open(dir + "/file")
+	CheckSuccess(err)
+	defer f2.Close()
+
+	fi, err := os.Lstat(dir + "/file")
+	CheckSuccess(err)
+	if fi.Size() != pathSize {
+		t.Errorf("stat without handle: got size %d, want %d", fi.Size(), pathSize)
+	}
+
+	// lseek(SEEK_END) is answered with GETATTR on the handle.
+	if end, err := f1.Seek(0, 2); err != nil || end != 10 {
+		t.Errorf("first handle: got size %d (%v), want 10", end, err)
+	}
+	if end, err := f2.Seek(0, 2); err != nil || end != 20 {
+		t.Errorf("second handle: got size %d (%v), want 20", end, err)
+	}
+
+	err = os.Remove(dir + "/file")
+	CheckSuccess(err)
+	if end, err := f1.Seek(0, 2); err != nil || end != 10 {
+		t.Errorf("after unlink: got size %d (%v), want 10", end, err)
+	}
+}
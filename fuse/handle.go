@@ -25,6 +25,9 @@ type HandleMap interface {
 	Decode(uint64) *Handled
 	Forget(uint64) *Handled
 	Has(uint64) bool
+
+	// registered returns the registered objects by handle.
+	registered() map[uint64]*Handled
 }
 
 type Handled struct {
@@ -94,6 +97,110 @@ func (m *portableHandleMap) Has(h uint64) bool {
 	return ok
 }
 
+func (m *portableHandleMap) registered() map[uint64]*Handled {
+	m.RLock()
+	out := make(map[uint64]*Handled, m.used)
+	for h, v := range m.handles {
+		if v != nil {
+			out[uint64(h)] = v
+		}
+	}
+	m.RUnlock()
+	return out
+}
+
+// persistentHandleMap hands out increasing handles, which are never
+// reused.  Decoding a forgotten handle returns nil rather than
+// panicking, so stale handles can be detected.
+type persistentHandleMap struct {
+	sync.RWMutex
+	handles map[uint64]*Handled
+	next    uint64
+}
+
+func newPersistentHandleMap() *persistentHandleMap {
+	return &persistentHandleMap{
+		handles: make(map[uint64]*Handled),
+		// Avoid handing out ID 0 and 1.
+		next: 2,
+	}
+}
+
+func (m *persistentHandleMap) Register(obj *Handled, asInt interface{}) (handle uint64) {
+	if obj.check != 0 {
+		panic(_ALREADY_MSG)
+	}
+	m.Lock()
+	handle = m.next
+	m.next++
+	obj.check = 1
+	obj.object = asInt
+	m.handles[handle] = obj
+	m.Unlock()
+	return handle
+}
+
+// registerAt registers obj under the unused handle h, eg. to restore
+// the handles of an earlier process.
+func (m *persistentHandleMap) registerAt(obj *Handled, asInt interface{}, h uint64) {
+	if obj.check != 0 {
+		panic(_ALREADY_MSG)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.handles[h] != nil {
+		log.Panicf("handle %d is in use", h)
+	}
+	obj.check = 1
+	obj.object = asInt
+	m.handles[h] = obj
+	if h >= m.next {
+		m.next = h + 1
+	}
+}
+
+func (m *persistentHandleMap) Count() int {
+	m.RLock()
+	c := len(m.handles)
+	m.RUnlock()
+	return c
+}
+
+func (m *persistentHandleMap) Decode(h uint64) *Handled {
+	m.RLock()
+	v := m.handles[h]
+	m.RUnlock()
+	return v
+}
+
+func (m *persistentHandleMap) Forget(h uint64) *Handled {
+	m.Lock()
+	v := m.handles[h]
+	if v != nil {
+		v.check = 0
+		delete(m.handles, h)
+	}
+	m.Unlock()
+	return v
+}
+
+func (m *persistentHandleMap) Has(h uint64) bool {
+	m.RLock()
+	ok := m.handles[h] != nil
+	m.RUnlock()
+	return ok
+}
+
+func (m *persistentHandleMap) registered() map[uint64]*Handled {
+	m.RLock()
+	out := make(map[uint64]*Handled, len(m.handles))
+	for h, v := range m.handles {
+		out[h] = v
+	}
+	m.RUnlock()
+	return out
+}
+
 // 32 bits version of HandleMap
 type int32HandleMap struct {
 	mutex   sync.Mutex
@@ -132,6 +239,16 @@ func (m *int32HandleMap) Forget(handle uint64) *Handled {
 	return val
 }
 
+func (m *int32HandleMap) registered() map[uint64]*Handled {
+	m.mutex.Lock()
+	out := make(map[uint64]*Handled, len(m.handles))
+	for h, v := range m.handles {
+		out[uint64(h)] = v
+	}
+	m.mutex.Unlock()
+	return out
+}
+
 func (m *int32HandleMap) Decode(handle uint64) *Handled {
 	val := (*Handled)(unsafe.Pointer(uintptr(handle & ((1 << 32) - 1))))
 	return val
@@ -247,6 +364,16 @@ func (m *int64HandleMap) Has(handle uint64) bool {
 	return ok
 }
 
+func (m *int64HandleMap) registered() map[uint64]*Handled {
+	m.mutex.Lock()
+	out := make(map[uint64]*Handled, len(m.handles))
+	for h, v := range m.handles {
+		out[h] = v
+	}
+	m.mutex.Unlock()
+	return out
+}
+
 func (m *int64HandleMap) Decode(handle uint64) (val *Handled) {
 	ptrBits := uintptr(handle & (1<<45 - 1))
 	check := uint32(handle >> 45)
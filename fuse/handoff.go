@@ -0,0 +1,465 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// HandoffFileSystem is implemented by RawFileSystems that keep state
+// the kernel depends on, such as node IDs and file handles.  The
+// state of the old process is saved by SaveHandoff, and restored by
+// RestoreHandoff in the new one.  FileSystemConnector implements it.
+type HandoffFileSystem interface {
+	SaveHandoff() ([]byte, error)
+	RestoreHandoff(state []byte) error
+}
+
+// handoffState is what is sent along with the /dev/fuse descriptor.
+// The INIT handshake happens only once per connection, so its result
+// must be carried over.
+type handoffState struct {
+	MountPoint         string
+	KernelSettings     raw.InitIn
+	NegotiatedSettings raw.InitOut
+
+	// From HandoffFileSystem.SaveHandoff.
+	FileSystem []byte
+}
+
+type handoffRequest struct {
+	conn *net.UnixConn
+	done chan error
+}
+
+// Handoff passes the connection to another process, which picks it
+// up with ReceiveHandoff, so the daemon can be upgraded without
+// unmounting.  It is for live upgrades only: the old process must be
+// running to send its state, and nothing is kept outside of it, so a
+// mount does not survive a crash of the daemon.  Handoff stops
+// reading requests, waits for the ones in flight, and sends the
+// connection over conn.  Requests that arrive in the
+// meantime are queued by the kernel and served by the new process.
+// On success, Loop calls OnUnmount with UNMOUNT_HANDOFF and returns,
+// and the mount is not removed; on failure, serving resumes.
+//
+// Loop must be running, and the connection must be non-blocking, as
+// it is for Mount and NewMountStateFd.
+func (ms *MountState) Handoff(conn *net.UnixConn) error {
+	if ms.cuseOptions != nil {
+		return fmt.Errorf("CUSE devices cannot be handed off")
+	}
+	if atomic.LoadInt32(&ms.looping) == 0 {
+		return fmt.Errorf("Handoff needs a running Loop")
+	}
+	req := &handoffRequest{conn: conn, done: make(chan error, 1)}
+	ms.handoffLock.Lock()
+	if ms.handoff != nil {
+		ms.handoffLock.Unlock()
+		return fmt.Errorf("a handoff is in progress")
+	}
+	ms.handoff = req
+	ms.handoffLock.Unlock()
+
+	// Wake up the loops blocked on reading.
+	if err := ms.mountFile.SetReadDeadline(time.Unix(1, 0)); err != nil {
+		ms.setHandoff(nil)
+		return fmt.Errorf("cannot interrupt reading: %v", err)
+	}
+	if err := <-req.done; err != nil {
+		return err
+	}
+	ms.waitLoop()
+	return nil
+}
+
+func (ms *MountState) pendingHandoff() *handoffRequest {
+	ms.handoffLock.Lock()
+	defer ms.handoffLock.Unlock()
+	return ms.handoff
+}
+
+func (ms *MountState) setHandoff(req *handoffRequest) {
+	ms.handoffLock.Lock()
+	ms.handoff = req
+	ms.handoffLock.Unlock()
+}
+
+// finishHandoff sends the connection once all loops have stopped.  It
+// returns false if sending failed, and the loops should restart.
+func (ms *MountState) finishHandoff() bool {
+	req := ms.pendingHandoff()
+	err := ms.sendHandoff(req.conn)
+	if err == nil {
+		ms.stopOnce.Do(func() {
+			ms.stopReason = UNMOUNT_HANDOFF
+		})
+		req.done <- nil
+		return true
+	}
+
+	ms.mountFile.SetReadDeadline(time.Time{})
+	ms.setHandoff(nil)
+	req.done <- err
+	return false
+}
+
+func (ms *MountState) sendHandoff(conn *net.UnixConn) error {
+	st := handoffState{
+		MountPoint:         ms.mountPoint,
+		KernelSettings:     ms.kernelSettings,
+		NegotiatedSettings: ms.negotiatedSettings,
+	}
+	if h, ok := ms.fileSystem.(HandoffFileSystem); ok {
+		data, err := h.SaveHandoff()
+		if err != nil {
+			return err
+		}
+		st.FileSystem = data
+	}
+	payload, err := json.Marshal(&st)
+	if err != nil {
+		return err
+	}
+
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(payload)))
+	if _, _, err := conn.WriteMsgUnix(header[:], syscall.UnixRights(ms.fd()), nil); err != nil {
+		return err
+	}
+	_, err = conn.Write(payload)
+	return err
+}
+
+// ReceiveHandoff takes over a connection sent by Handoff, and returns
+// a MountState that serves it with fs.  If fs is a
+// HandoffFileSystem, it gets the state saved by the file system of
+// the old process.  Mount options that the kernel has agreed on, like
+// MaxWrite, are taken from the old process rather than from opts.
+// Call Loop to start serving.
+func ReceiveHandoff(fs RawFileSystem, conn *net.UnixConn, opts *MountOptions) (*MountState, error) {
+	var header [4]byte
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(header[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, os.NewSyscallError("recvmsg", err)
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("handoff carries no connection")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, os.NewSyscallError("recvmsg", err)
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("handoff carries %d descriptors", len(fds))
+	}
+	fd := fds[0]
+
+	var st handoffState
+	if err := readHandoffState(conn, header[:], n, &st); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// Non-blocking reads go through the poller, so a later
+	// Handoff can interrupt them.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("fcntl", err)
+	}
+	file := os.NewFile(uintptr(fd), "/dev/fuse")
+
+	o := MountOptions{MaxBackground: _DEFAULT_BACKGROUND_TASKS}
+	if opts != nil {
+		o = *opts
+	}
+	o.MaxWrite = int(st.NegotiatedSettings.MaxWrite)
+
+	ms := NewMountState(fs)
+	ms.setOptions(&o)
+	ms.kernelSettings = st.KernelSettings
+	ms.negotiatedSettings = st.NegotiatedSettings
+	ms.unmountByClose = st.MountPoint == ""
+	ms.init(file, st.MountPoint)
+	if h, ok := fs.(HandoffFileSystem); ok && st.FileSystem != nil {
+		if err := h.RestoreHandoff(st.FileSystem); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// readHandoffState reads the rest of the header, of which n bytes
+// arrived with the descriptor, and the state that follows it.
+func readHandoffState(r io.Reader, header []byte, n int, st *handoffState) error {
+	if _, err := io.ReadFull(r, header[n:]); err != nil {
+		return err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, st)
+}
+
+// connectorHandoff is the state of a FileSystemConnector that the
+// kernel depends on.
+type connectorHandoff struct {
+	Generation uint64
+	Nodes      []handoffNode
+	Files      []handoffFile
+}
+
+// handoffNode is a node ID known to the kernel.  Path is nil if the
+// node was no longer in the tree.
+type handoffNode struct {
+	Id      uint64
+	Path    []string
+	Dir     bool
+	Lookups int
+}
+
+type handoffFile struct {
+	Node  uint64
+	Fh    uint64
+	Flags uint32
+	Dir   bool
+
+	// The caller that opened the file.  It is nil in the state
+	// of versions that did not save it.
+	Opener *raw.Context `json:",omitempty"`
+}
+
+// SaveHandoff records the node IDs and file handles held by the
+// kernel.  It needs FileSystemOptions.PersistentInodes, so they do
+// not depend on addresses in this process.  Nodes are recorded by
+// their path, and must be found under that path by the file system
+// of the new process.
+func (c *FileSystemConnector) SaveHandoff() ([]byte, error) {
+	m, ok := c.inodeMap.(*persistentHandleMap)
+	if !ok {
+		return nil, fmt.Errorf("handing off needs FileSystemOptions.PersistentInodes")
+	}
+
+	st := connectorHandoff{Generation: c.generation}
+	ids := map[*Inode]uint64{c.rootNode: raw.FUSE_ROOT_ID}
+	for id, h := range m.registered() {
+		n := h.object.(*Inode)
+		if n == c.rootNode || n.mount == nil {
+			continue
+		}
+		ids[n] = id
+		path, _ := c.handoffPath(n)
+		n.treeLock.RLock()
+		lookups := n.lookupCount
+		n.treeLock.RUnlock()
+		st.Nodes = append(st.Nodes, handoffNode{
+			Id:      id,
+			Path:    path,
+			Dir:     n.IsDir(),
+			Lookups: lookups,
+		})
+	}
+
+	handles := map[*openedFile]uint64{}
+	mounts := map[*fileSystemMount]bool{}
+	for n, id := range ids {
+		if !mounts[n.mount] {
+			mounts[n.mount] = true
+			for fh, h := range n.mount.openFiles.registered() {
+				handles[h.object.(*openedFile)] = fh
+			}
+		}
+		n.openFilesMutex.Lock()
+		for _, f := range n.openFiles {
+			opener := f.opener
+			st.Files = append(st.Files, handoffFile{
+				Node:   id,
+				Fh:     handles[f],
+				Flags:  f.OpenFlags,
+				Dir:    f.dir != nil,
+				Opener: &opener,
+			})
+		}
+		n.openFilesMutex.Unlock()
+	}
+	return json.Marshal(&st)
+}
+
+// handoffPath returns the names leading from the root to n, or false
+// if n is not in the tree.
+func (c *FileSystemConnector) handoffPath(n *Inode) ([]string, bool) {
+	var path []string
+	for n != c.rootNode {
+		parent := n.lookupParent()
+		if parent == nil {
+			return nil, false
+		}
+		name := ""
+		parent.treeLock.RLock()
+		for k, ch := range parent.children {
+			if ch == n {
+				name = k
+				break
+			}
+		}
+		parent.treeLock.RUnlock()
+		if name == "" {
+			return nil, false
+		}
+		path = append([]string{name}, path...)
+		n = parent
+	}
+	return path, true
+}
+
+// RestoreHandoff restores the node IDs and file handles saved by
+// SaveHandoff in the old process, by looking up the nodes and
+// reopening the files.  The nodes are looked up with the uid, gid
+// and pid of this process, and the files are reopened with those of
+// the callers that opened them.  Nodes that are gone, eg. files that
+// were unlinked while open, and files that cannot be reopened,
+// return ESTALE until the kernel forgets or releases them.  It must
+// be called before serving any requests.
+func (c *FileSystemConnector) RestoreHandoff(state []byte) error {
+	m, ok := c.inodeMap.(*persistentHandleMap)
+	if !ok {
+		return fmt.Errorf("handing off needs FileSystemOptions.PersistentInodes")
+	}
+	var st connectorHandoff
+	if err := json.Unmarshal(state, &st); err != nil {
+		return err
+	}
+
+	c.generation = st.Generation
+	context := &Context{Context: raw.Context{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+		Pid: uint32(os.Getpid()),
+	}}
+	for _, sn := range st.Nodes {
+		if m.Has(sn.Id) {
+			return fmt.Errorf("node %d is in use", sn.Id)
+		}
+		n := c.restoreLookup(sn.Path, context)
+		if n == nil || n.nodeId != 0 || n.IsDir() != sn.Dir {
+			if sn.Lookups == 0 {
+				continue
+			}
+			n = c.rootNode.New(sn.Dir, &lostNode{})
+		}
+		n.lookupMutex.Lock()
+		n.treeLock.Lock()
+		m.registerAt(&n.handled, n, sn.Id)
+		n.nodeId = sn.Id
+		n.lookupCount = sn.Lookups
+		n.treeLock.Unlock()
+		n.lookupMutex.Unlock()
+	}
+
+	for _, sf := range st.Files {
+		n := c.toInode(sf.Node)
+		if n == nil {
+			continue
+		}
+		if n.mount.openFiles.Has(sf.Fh) {
+			return fmt.Errorf("file handle %d is in use", sf.Fh)
+		}
+		flags := sf.Flags &^ uint32(syscall.O_CREAT|syscall.O_EXCL|syscall.O_TRUNC)
+		opener := context
+		if sf.Opener != nil {
+			opener = &Context{Context: *sf.Opener}
+		}
+		var opened *openedFile
+		if sf.Dir {
+			dir, code := openDir(n, opener)
+			if !code.Ok() {
+				dir = newConnectorDir(n, nil)
+			}
+			_, opened = n.mount.registerFileHandleAt(n, dir, nil, flags, sf.Fh)
+		} else {
+			f, code := n.fsInode.Open(flags, opener)
+			if !code.Ok() {
+				f = &lostFile{}
+			}
+			_, opened = n.mount.registerFileHandleAt(n, nil, f, flags, sf.Fh)
+		}
+		opened.opener = opener.Context
+	}
+	c.verify()
+	return nil
+}
+
+func (c *FileSystemConnector) restoreLookup(path []string, context *Context) *Inode {
+	if path == nil {
+		return nil
+	}
+	n := c.rootNode
+	for _, name := range path {
+		if !n.IsDir() {
+			return nil
+		}
+		child, code := c.internalLookup(&Attr{}, n, name, context)
+		if !code.Ok() || child == nil {
+			return nil
+		}
+		n = child
+	}
+	return n
+}
+
+// lostNode stands in for a node that could not be restored after a
+// Handoff.
+type lostNode struct {
+	DefaultFsNode
+}
+
+func (n *lostNode) Lookup(out *Attr, name string, context *Context) (FsNode, Status) {
+	return nil, ESTALE
+}
+
+func (n *lostNode) GetAttr(out *Attr, file File, context *Context) Status {
+	return ESTALE
+}
+
+func (n *lostNode) Open(flags uint32, context *Context) (File, Status) {
+	return nil, ESTALE
+}
+
+func (n *lostNode) OpenDir(context *Context) ([]DirEntry, Status) {
+	return nil, ESTALE
+}
+
+// lostFile stands in for a file that could not be reopened after a
+// Handoff.
+type lostFile struct {
+	DefaultFile
+}
+
+func (f *lostFile) Read(*ReadIn, BufferPool) ([]byte, Status) {
+	return nil, ESTALE
+}
+
+func (f *lostFile) Write(*WriteIn, []byte) (uint32, Status) {
+	return 0, ESTALE
+}
+
+func (f *lostFile) GetAttr(*Attr) Status {
+	return ESTALE
+}
@@ -0,0 +1,221 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func unixConnPair() (a, b *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	CheckSuccess(err)
+	conn := func(fd int) *net.UnixConn {
+		f := os.NewFile(uintptr(fd), "handoff")
+		defer f.Close()
+		c, err := net.FileConn(f)
+		CheckSuccess(err)
+		return c.(*net.UnixConn)
+	}
+	return conn(fds[0]), conn(fds[1])
+}
+
+// kernelRequest sends a request with the given input over the fake
+// /dev/fuse connection, and returns the status and data of the reply.
+func kernelRequest(local *os.File, opcode int32, unique uint64, nodeId uint64, in []byte) (Status, []byte) {
+	header := raw.InHeader{
+		Opcode: opcode,
+		Unique: unique,
+		NodeId: nodeId,
+	}
+	header.Length = uint32(unsafe.Sizeof(header)) + uint32(len(in))
+	msg := append((*[unsafe.Sizeof(header)]byte)(unsafe.Pointer(&header))[:], in...)
+	_, err := local.Write(msg)
+	CheckSuccess(err)
+
+	buf := make([]byte, 1<<16)
+	n, err := local.Read(buf)
+	CheckSuccess(err)
+	reply := (*raw.OutHeader)(unsafe.Pointer(&buf[0]))
+	if reply.Unique != unique {
+		panic("reply to another request")
+	}
+	return Status(-reply.Status), buf[unsafe.Sizeof(*reply):n]
+}
+
+func TestHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("hello"), 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "gone"), []byte("bye"), 0644))
+
+	newConnector := func() *FileSystemConnector {
+		opts := NewFileSystemOptions()
+		opts.PersistentInodes = true
+		return NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(dir), nil), opts)
+	}
+
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+	defer local.Close()
+	fd, err := syscall.Dup(int(remote.Fd()))
+	CheckSuccess(err)
+	remote.Close()
+
+	old := newConnector()
+	oldMs, err := NewMountStateFd(old, fd, "", nil)
+	CheckSuccess(err)
+	oldDone := make(chan bool)
+	go func() {
+		oldMs.Loop()
+		oldDone <- true
+	}()
+
+	init := raw.InitIn{Major: FUSE_KERNEL_VERSION, Minor: OUR_MINOR_VERSION, MaxReadAhead: 4096}
+	if code, _ := kernelRequest(local, _OP_INIT, 1, 0, (*[unsafe.Sizeof(init)]byte)(unsafe.Pointer(&init))[:]); !code.Ok() {
+		t.Fatal("INIT:", code)
+	}
+
+	lookup := func(parent uint64, name string) uint64 {
+		var out raw.EntryOut
+		if code := old.Lookup(&out, &raw.InHeader{NodeId: parent}, name); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		return out.NodeId
+	}
+	subId := lookup(raw.FUSE_ROOT_ID, "sub")
+	fileId := lookup(subId, "file")
+	goneId := lookup(raw.FUSE_ROOT_ID, "gone")
+	var open raw.OpenOut
+	if code := old.Open(&open, &raw.InHeader{NodeId: fileId}, &raw.OpenIn{Flags: uint32(os.O_RDONLY)}); !code.Ok() {
+		t.Fatal("Open:", code)
+	}
+	CheckSuccess(os.Remove(filepath.Join(dir, "gone")))
+
+	a, b := unixConnPair()
+	defer a.Close()
+	defer b.Close()
+	handoff := make(chan error, 1)
+	go func() {
+		handoff <- oldMs.Handoff(a)
+	}()
+	ms, err := ReceiveHandoff(newConnector(), b, nil)
+	CheckSuccess(err)
+	CheckSuccess(<-handoff)
+	<-oldDone
+	if oldMs.stopReason != UNMOUNT_HANDOFF {
+		t.Errorf("old loop stopped with %v", oldMs.stopReason)
+	}
+	if got, want := ms.NegotiatedSettings(), oldMs.NegotiatedSettings(); got != want {
+		t.Errorf("negotiated settings: got %+v, want %+v", got, want)
+	}
+
+	done := make(chan bool)
+	go func() {
+		ms.Loop()
+		done <- true
+	}()
+
+	// The node ID and file handle of the old process still work.
+	read := ReadIn{Fh: open.Fh, Size: 100}
+	code, data := kernelRequest(local, _OP_READ, 2, fileId, (*[unsafe.Sizeof(read)]byte)(unsafe.Pointer(&read))[:])
+	if !code.Ok() || string(data) != "hello" {
+		t.Errorf("READ: %v, %q", code, data)
+	}
+	var getAttr raw.GetAttrIn
+	if code, _ := kernelRequest(local, _OP_GETATTR, 3, subId, (*[unsafe.Sizeof(getAttr)]byte)(unsafe.Pointer(&getAttr))[:]); !code.Ok() {
+		t.Errorf("GETATTR: %v", code)
+	}
+	if code, _ := kernelRequest(local, _OP_GETATTR, 4, goneId, (*[unsafe.Sizeof(getAttr)]byte)(unsafe.Pointer(&getAttr))[:]); code != ESTALE {
+		t.Errorf("GETATTR of removed node: got %v, want ESTALE", code)
+	}
+
+	CheckSuccess(ms.Unmount())
+	<-done
+}
+
+func TestHandoffFailureResumes(t *testing.T) {
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+	defer local.Close()
+	fd, err := syscall.Dup(int(remote.Fd()))
+	CheckSuccess(err)
+	remote.Close()
+
+	// Without PersistentInodes, the state cannot be saved.
+	c := NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(os.TempDir()), nil), nil)
+	ms, err := NewMountStateFd(c, fd, "", nil)
+	CheckSuccess(err)
+	done := make(chan bool)
+	go func() {
+		ms.Loop()
+		done <- true
+	}()
+
+	a, b := unixConnPair()
+	defer a.Close()
+	defer b.Close()
+	if err := ms.Handoff(a); err == nil {
+		t.Fatal("Handoff succeeded without PersistentInodes")
+	}
+
+	var getAttr raw.GetAttrIn
+	if code, _ := kernelRequest(local, _OP_GETATTR, 1, raw.FUSE_ROOT_ID, (*[unsafe.Sizeof(getAttr)]byte)(unsafe.Pointer(&getAttr))[:]); !code.Ok() {
+		t.Errorf("GETATTR after failed handoff: %v", code)
+	}
+	CheckSuccess(ms.Unmount())
+	<-done
+}
+
+// openerFs records the caller of Open.
+type openerFs struct {
+	DefaultFileSystem
+	opener *raw.Context
+}
+
+func (fs *openerFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	if name == "" {
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	}
+	return &Attr{Mode: S_IFREG | 0644}, OK
+}
+
+func (fs *openerFs) Open(name string, flags uint32, context *Context) (File, Status) {
+	c := context.Context
+	fs.opener = &c
+	return NewDataFile(nil), OK
+}
+
+// Files are reopened on behalf of the caller that opened them.
+func TestHandoffOpener(t *testing.T) {
+	newConnector := func(fs FileSystem) *FileSystemConnector {
+		opts := NewFileSystemOptions()
+		opts.PersistentInodes = true
+		return NewFileSystemConnector(NewPathNodeFs(fs, nil), opts)
+	}
+	old := newConnector(&openerFs{})
+	var entry raw.EntryOut
+	if code := old.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file"); !code.Ok() {
+		t.Fatal("Lookup:", code)
+	}
+	caller := raw.Context{Owner: raw.Owner{Uid: 1234, Gid: 5678}, Pid: 42}
+	var open raw.OpenOut
+	if code := old.Open(&open, &raw.InHeader{NodeId: entry.NodeId, Context: caller}, &raw.OpenIn{}); !code.Ok() {
+		t.Fatal("Open:", code)
+	}
+	state, err := old.SaveHandoff()
+	CheckSuccess(err)
+
+	fs := &openerFs{}
+	CheckSuccess(newConnector(fs).RestoreHandoff(state))
+	if fs.opener == nil || *fs.opener != caller {
+		t.Errorf("reopened by %v, want %v", fs.opener, caller)
+	}
+}
@@ -0,0 +1,335 @@
+package fuse
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse/acl"
+)
+
+// OverflowId is the id reported for ids that have no mapping, like
+// the kernel's overflowuid and overflowgid.
+const OverflowId = 65534
+
+// IdRange maps Count consecutive ids starting at Outside, as the
+// kernel and its callers see them, to ids starting at Inside, as the
+// FileSystem sees them.  This is a line of /proc/PID/uid_map.
+type IdRange struct {
+	Inside  uint32
+	Outside uint32
+	Count   uint32
+}
+
+// IdMap translates uids and gids between the caller and the file
+// system.  An empty list of ranges maps ids to themselves; otherwise
+// ids outside all ranges become OverflowId.
+type IdMap struct {
+	Uids []IdRange
+	Gids []IdRange
+}
+
+// NewIdMapFromProc reads the uid and gid mapping of the user
+// namespace of process pid.  Mounting with it shows the file system
+// of a container to the host with host ids, or vice versa.
+func NewIdMapFromProc(pid int) (*IdMap, error) {
+	m := &IdMap{}
+	var err error
+	if m.Uids, err = readIdRanges(fmt.Sprintf("/proc/%d/uid_map", pid)); err != nil {
+		return nil, err
+	}
+	if m.Gids, err = readIdRanges(fmt.Sprintf("/proc/%d/gid_map", pid)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func readIdRanges(name string) ([]IdRange, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []IdRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var r IdRange
+		if _, err := fmt.Sscan(line, &r.Inside, &r.Outside, &r.Count); err != nil {
+			return nil, fmt.Errorf("%s: bad line %q: %v", name, line, err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, scanner.Err()
+}
+
+// mapId translates id through ranges, to the inside if inward is set.
+// The "unchanged" id ^uint32(0) of chown is kept.
+func mapId(ranges []IdRange, id uint32, inward bool) uint32 {
+	if len(ranges) == 0 || id == ^uint32(0) {
+		return id
+	}
+	for _, r := range ranges {
+		from, to := r.Inside, r.Outside
+		if inward {
+			from, to = r.Outside, r.Inside
+		}
+		if id >= from && id-from < r.Count {
+			return to + (id - from)
+		}
+	}
+	return OverflowId
+}
+
+func (m *IdMap) InsideUid(uid uint32) uint32  { return mapId(m.Uids, uid, true) }
+func (m *IdMap) InsideGid(gid uint32) uint32  { return mapId(m.Gids, gid, true) }
+func (m *IdMap) OutsideUid(uid uint32) uint32 { return mapId(m.Uids, uid, false) }
+func (m *IdMap) OutsideGid(gid uint32) uint32 { return mapId(m.Gids, gid, false) }
+
+// context returns a copy of c with the caller ids mapped inside.
+func (m *IdMap) context(c *Context) *Context {
+	if c == nil {
+		return nil
+	}
+	mapped := *c
+	mapped.Uid = m.InsideUid(c.Uid)
+	mapped.Gid = m.InsideGid(c.Gid)
+	return &mapped
+}
+
+// attr returns a copy of a with the owner mapped outside.
+func (m *IdMap) attr(a *Attr) *Attr {
+	if a == nil {
+		return nil
+	}
+	mapped := *a
+	mapped.Uid = m.OutsideUid(a.Uid)
+	mapped.Gid = m.OutsideGid(a.Gid)
+	return &mapped
+}
+
+// xattr maps the user and group entries of POSIX ACL attributes.
+// Other attributes, and ACLs that do not decode, are returned as is.
+func (m *IdMap) xattr(attr string, data []byte, inward bool) []byte {
+	if attr != acl.AccessXAttr && attr != acl.DefaultXAttr {
+		return data
+	}
+	a, err := acl.Decode(data)
+	if err != nil {
+		return data
+	}
+	for i := range a {
+		switch a[i].Tag {
+		case acl.User:
+			a[i].Id = mapId(m.Uids, a[i].Id, inward)
+		case acl.Group:
+			a[i].Id = mapId(m.Gids, a[i].Id, inward)
+		}
+	}
+	return a.Encode()
+}
+
+// IdMapFileSystem translates ids between callers and a FileSystem,
+// like an idmapped mount: the caller ids in the Context and the
+// arguments of Chown are mapped inside, and the owners in returned
+// attributes are mapped outside.
+type IdMapFileSystem struct {
+	FileSystem
+	Map *IdMap
+}
+
+func NewIdMapFileSystem(fs FileSystem, m *IdMap) *IdMapFileSystem {
+	return &IdMapFileSystem{FileSystem: fs, Map: m}
+}
+
+// wrap returns f with attributes and ownership changes translated,
+// keeping any WithFlags on the outside, where the connector looks
+// for it.
+func (fs *IdMapFileSystem) wrap(f File) File {
+	if f == nil {
+		return nil
+	}
+	if withFlags, ok := f.(*WithFlags); ok {
+		wrapped := *withFlags
+		wrapped.File = fs.wrap(withFlags.File)
+		return &wrapped
+	}
+	return &idMapFile{File: f, m: fs.Map}
+}
+
+func (fs *IdMapFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	a, code := fs.FileSystem.GetAttr(name, fs.Map.context(context))
+	return fs.Map.attr(a), code
+}
+
+func (fs *IdMapFileSystem) Readlink(name string, context *Context) (string, Status) {
+	return fs.FileSystem.Readlink(name, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	return fs.FileSystem.Mknod(name, mode, dev, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	return fs.FileSystem.Mkdir(name, mode, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Unlink(name string, context *Context) (code Status) {
+	return fs.FileSystem.Unlink(name, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Rmdir(name string, context *Context) (code Status) {
+	return fs.FileSystem.Rmdir(name, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	return fs.FileSystem.Symlink(value, linkName, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
+	return fs.FileSystem.Rename(oldName, newName, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Link(oldName string, newName string, context *Context) (code Status) {
+	return fs.FileSystem.Link(oldName, newName, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) LinkKey(name string, context *Context) (key string, code Status) {
+	return fs.FileSystem.LinkKey(name, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
+	return fs.FileSystem.Chmod(name, mode, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) (code Status) {
+	return fs.FileSystem.Chown(name, fs.Map.InsideUid(uid), fs.Map.InsideGid(gid), fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Truncate(name string, offset uint64, context *Context) (code Status) {
+	return fs.FileSystem.Truncate(name, offset, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	return fs.FileSystem.Utimens(name, Atime, Mtime, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
+	return fs.FileSystem.Access(name, mode, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	file, code = fs.FileSystem.Open(name, flags, fs.Map.context(context))
+	return fs.wrap(file), code
+}
+
+func (fs *IdMapFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	file, code = fs.FileSystem.Create(name, flags, mode, fs.Map.context(context))
+	return fs.wrap(file), code
+}
+
+func (fs *IdMapFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, status Status) {
+	return fs.FileSystem.OpenDir(name, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, status Status) {
+	stream, status = fs.FileSystem.OpenDirStream(name, fs.Map.context(context))
+	if stream != nil {
+		stream = &idMapDirStream{stream, fs.Map}
+	}
+	return stream, status
+}
+
+// idMapDirStream maps the caller of directory reads.
+type idMapDirStream struct {
+	DirStream
+	m *IdMap
+}
+
+func (s *idMapDirStream) ReadDir(offset uint64, context *Context) ([]DirEntry, Status) {
+	return s.DirStream.ReadDir(offset, s.m.context(context))
+}
+
+func (fs *IdMapFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	data, code := fs.FileSystem.GetXAttr(name, attr, fs.Map.context(context))
+	if !code.Ok() {
+		return data, code
+	}
+	return fs.Map.xattr(attr, data, false), code
+}
+
+func (fs *IdMapFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	return fs.FileSystem.SetXAttr(name, attr, fs.Map.xattr(attr, data, true), flags, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
+	return fs.FileSystem.ListXAttr(name, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	return fs.FileSystem.RemoveXAttr(name, attr, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) SyncFs(context *Context) (code Status) {
+	return fs.FileSystem.SyncFs(fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) FsyncDir(name string, flags int, context *Context) (code Status) {
+	return fs.FileSystem.FsyncDir(name, flags, fs.Map.context(context))
+}
+
+func (fs *IdMapFileSystem) String() string {
+	return fmt.Sprintf("IdMapFileSystem(%s)", fs.FileSystem.String())
+}
+
+// idMapFile translates the ids of an open file of an
+// IdMapFileSystem.
+type idMapFile struct {
+	File
+	m *IdMap
+}
+
+func (f *idMapFile) InnerFile() File {
+	return f.File
+}
+
+func (f *idMapFile) String() string {
+	return fmt.Sprintf("idMapFile(%s)", f.File.String())
+}
+
+func (f *idMapFile) GetAttr(out *Attr) Status {
+	code := f.File.GetAttr(out)
+	if code.Ok() {
+		*out = *f.m.attr(out)
+	}
+	return code
+}
+
+func (f *idMapFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	return f.File.Chown(f.m.InsideUid(uid), f.m.InsideGid(gid), f.m.context(context))
+}
+
+func (f *idMapFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	mapped := *attr
+	mapped.Uid = f.m.InsideUid(attr.Uid)
+	mapped.Gid = f.m.InsideGid(attr.Gid)
+	return f.File.Setattr(valid, &mapped, f.m.context(context))
+}
+
+func (f *idMapFile) Chmod(perms uint32, context *Context) Status {
+	return f.File.Chmod(perms, f.m.context(context))
+}
+
+func (f *idMapFile) Truncate(size uint64, context *Context) Status {
+	return f.File.Truncate(size, f.m.context(context))
+}
+
+func (f *idMapFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	return f.File.Utimens(atime, mtime, f.m.context(context))
+}
@@ -0,0 +1,86 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// contextRecordFs records the caller of Mkdir.
+type contextRecordFs struct {
+	FileSystem
+	mkdirUid uint32
+}
+
+func (fs *contextRecordFs) Mkdir(name string, mode uint32, context *Context) Status {
+	fs.mkdirUid = context.Uid
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func TestIdMapFileSystem(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to chown and switch users")
+	}
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	orig := filepath.Join(dir, "orig")
+	mnt := filepath.Join(dir, "mnt")
+	CheckSuccess(os.Mkdir(orig, 0777))
+	CheckSuccess(os.Mkdir(mnt, 0755))
+	CheckSuccess(os.Chmod(orig, 0777))
+	CheckSuccess(os.Chmod(dir, 0755))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(orig, "file"), []byte("hello"), 0644))
+
+	// Inside ids 0-999 are outside ids 1000-1999.
+	m := &IdMap{
+		Uids: []IdRange{{Inside: 0, Outside: 1000, Count: 1000}},
+		Gids: []IdRange{{Inside: 0, Outside: 1000, Count: 1000}},
+	}
+	record := &contextRecordFs{FileSystem: NewLoopbackFileSystem(orig)}
+	idfs := NewIdMapFileSystem(record, m)
+	opts := NewFileSystemOptions()
+	opts.Owner = nil
+	state, _, err := MountNodeFileSystem(mnt, NewPathNodeFs(idfs, nil), opts)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	owner := func(name string) (uint32, uint32) {
+		fi, err := os.Lstat(name)
+		CheckSuccess(err)
+		st := fi.Sys().(*syscall.Stat_t)
+		return st.Uid, st.Gid
+	}
+
+	if uid, gid := owner(filepath.Join(mnt, "file")); uid != 1000 || gid != 1000 {
+		t.Errorf("stat: got owner %d:%d, want 1000:1000", uid, gid)
+	}
+
+	CheckSuccess(os.Chown(filepath.Join(mnt, "file"), 1005, 1007))
+	if uid, gid := owner(filepath.Join(orig, "file")); uid != 5 || gid != 7 {
+		t.Errorf("chown: got backing owner %d:%d, want 5:7", uid, gid)
+	}
+
+	f, code := idfs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	a := &Attr{}
+	if code := f.GetAttr(a); !code.Ok() || a.Uid != 1005 || a.Gid != 1007 {
+		t.Errorf("File.GetAttr: got owner %d:%d (%v), want 1005:1007", a.Uid, a.Gid, code)
+	}
+	f.Release(&ReleaseIn{})
+
+	CheckSuccess(os.Mkdir(filepath.Join(mnt, "byroot"), 0755))
+	if record.mkdirUid != OverflowId {
+		t.Errorf("mkdir by unmapped root: got caller %d, want %d", record.mkdirUid, OverflowId)
+	}
+	CheckSuccess(asUser(func() error { return os.Mkdir(filepath.Join(mnt, "byuser"), 0755) }))
+	if record.mkdirUid != 0 {
+		t.Errorf("mkdir by 1000: got caller %d, want 0", record.mkdirUid)
+	}
+}
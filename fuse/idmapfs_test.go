@@ -0,0 +1,29 @@
+package fuse
+
+import "testing"
+
+func TestIdMapRanges(t *testing.T) {
+	m := &IdMap{Uids: []IdRange{{Inside: 0, Outside: 100000, Count: 1000}}}
+	cases := []struct {
+		outside, inside uint32
+	}{
+		{100000, 0},
+		{100999, 999},
+		{101000, OverflowId},
+		{0, OverflowId},
+	}
+	for _, c := range cases {
+		if got := m.InsideUid(c.outside); got != c.inside {
+			t.Errorf("InsideUid(%d) = %d, want %d", c.outside, got, c.inside)
+		}
+	}
+	if got := m.OutsideUid(5); got != 100005 {
+		t.Errorf("OutsideUid(5) = %d, want 100005", got)
+	}
+	if got := m.InsideGid(1234); got != 1234 {
+		t.Errorf("InsideGid without ranges = %d, want 1234", got)
+	}
+	if got := m.InsideUid(^uint32(0)); got != ^uint32(0) {
+		t.Errorf("InsideUid(-1) = %d, want -1", got)
+	}
+}
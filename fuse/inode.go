@@ -2,7 +2,9 @@ package fuse
 
 import (
 	"log"
+	"reflect"
 	"sync"
+	"unsafe"
 )
 
 var _ = log.Println
@@ -55,9 +57,22 @@ type Inode struct {
 	// for Deletable().
 	lookupCount int
 
+	// lookupMutex serializes changes of lookupCount with the
+	// OnKernelForget call when it drops to zero.  It must be
+	// acquired before treeLock.
+	lookupMutex sync.Mutex
+
 	// Non-nil if this inode is a mountpoint, ie. the Root of a
 	// NodeFileSystem.
 	mountPoint *fileSystemMount
+
+	// The directory this inode was last added to, for looking up
+	// "..".  Nil for mountpoints, and after removal.
+	parent *Inode
+
+	// Values attached with SetData, and their protection.
+	dataMutex sync.Mutex
+	data      map[interface{}]interface{}
 }
 
 func newInode(isDir bool, fsNode FsNode) *Inode {
@@ -85,6 +100,8 @@ func (n *Inode) AnyFile() (file File) {
 	return file
 }
 
+// Children returns a snapshot of the children, including
+// mountpoints.
 func (n *Inode) Children() (out map[string]*Inode) {
 	n.treeLock.RLock()
 	out = make(map[string]*Inode, len(n.children))
@@ -111,10 +128,52 @@ func (n *Inode) FsChildren() (out map[string]*Inode) {
 	return out
 }
 
+// NodeId returns the ID the kernel knows the inode by, or 0 if the
+// kernel does not know it.  The root of the connector is
+// FUSE_ROOT_ID to the kernel, whatever NodeId returns.
+func (n *Inode) NodeId() uint64 {
+	n.treeLock.RLock()
+	defer n.treeLock.RUnlock()
+	return n.nodeId
+}
+
+// LookupCount returns how many references the kernel holds to this
+// inode.  Zero means the kernel does not know the inode.
+func (n *Inode) LookupCount() int {
+	n.treeLock.RLock()
+	defer n.treeLock.RUnlock()
+	return n.lookupCount
+}
+
 func (n *Inode) FsNode() FsNode {
 	return n.fsInode
 }
 
+// SetData attaches value to the inode under key, for file systems
+// and wrappers that keep state per inode.  As with context values,
+// key should be of an unexported type, so different users do not
+// collide.  A nil value removes the key.  The data lives as long as
+// the Inode.
+func (n *Inode) SetData(key, value interface{}) {
+	n.dataMutex.Lock()
+	defer n.dataMutex.Unlock()
+	if value == nil {
+		delete(n.data, key)
+		return
+	}
+	if n.data == nil {
+		n.data = make(map[interface{}]interface{})
+	}
+	n.data[key] = value
+}
+
+// Data returns the value attached to the inode under key, or nil.
+func (n *Inode) Data(key interface{}) interface{} {
+	n.dataMutex.Lock()
+	defer n.dataMutex.Unlock()
+	return n.data[key]
+}
+
 // Files() returns an opens file that have bits in common with the
 // give mask.  Use mask==0 to return all files.
 func (n *Inode) Files(mask uint32) (files []WithFlags) {
@@ -156,6 +215,18 @@ func (n *Inode) AddChild(name string, child *Inode) {
 	n.treeLock.Unlock()
 }
 
+// addChildOnce adds child as name, unless there is a child by that
+// name already, and returns the child in the tree.
+func (n *Inode) addChildOnce(name string, child *Inode) *Inode {
+	n.treeLock.Lock()
+	defer n.treeLock.Unlock()
+	if ch := n.children[name]; ch != nil {
+		return ch
+	}
+	n.addChild(name, child)
+	return child
+}
+
 func (n *Inode) RmChild(name string) (ch *Inode) {
 	n.treeLock.Lock()
 	ch = n.rmChild(name)
@@ -175,6 +246,9 @@ func (n *Inode) addChild(name string, child *Inode) {
 		}
 	}
 	n.children[name] = child
+	if child.mountPoint == nil {
+		child.parent = n
+	}
 }
 
 // Must be called with treeLock for the mount held.
@@ -182,17 +256,52 @@ func (n *Inode) rmChild(name string) (ch *Inode) {
 	ch = n.children[name]
 	if ch != nil {
 		delete(n.children, name)
+		if ch.parent == n {
+			ch.parent = nil
+			ch.releaseNodeId()
+		}
 	}
 	return ch
 }
 
+// releaseNodeId gives up the node ID of an inode that the kernel has
+// forgotten and that is no longer in the tree.  With
+// PersistentInodes, the kernel may ask for forgotten node IDs until
+// then.  Must be called with treeLock held.
+func (n *Inode) releaseNodeId() {
+	if n.lookupCount > 0 || n.nodeId == 0 || n.parent != nil || n.mountPoint != nil {
+		return
+	}
+	n.mount.connector.inodeMap.Forget(n.nodeId)
+	n.nodeId = 0
+}
+
+// lookupParent returns the directory containing n, or nil if n is the
+// root or not in the tree.
+func (n *Inode) lookupParent() *Inode {
+	if n.mountPoint != nil {
+		return n.mountPoint.parentInode
+	}
+	n.treeLock.RLock()
+	defer n.treeLock.RUnlock()
+	return n.parent
+}
+
 // Can only be called on untouched inodes.
-func (n *Inode) mountFs(fs NodeFileSystem, opts *FileSystemOptions) {
+func (n *Inode) mountFs(c *FileSystemConnector, fs NodeFileSystem, opts *FileSystemOptions) {
 	n.mountPoint = &fileSystemMount{
 		fs:         fs,
 		openFiles:  NewHandleMap(false),
 		mountInode: n,
 		options:    opts,
+		connector:  c,
+	}
+	if c.persistentInodes {
+		// So file handles can be restored after a Handoff.
+		n.mountPoint.openFiles = newPersistentHandleMap()
+	}
+	if s, ok := fs.(stableInodeFs); ok {
+		n.mountPoint.stableInodes = s.stableInodes()
 	}
 	n.mount = n.mountPoint
 	n.treeLock = &n.mountPoint.treeLock
@@ -217,6 +326,90 @@ func (n *Inode) canUnmount() bool {
 	return ok
 }
 
+// addStats adds n and the nodes below it to s.  Must be called with
+// treeLock held for reading.
+func (n *Inode) addStats(s *InodeStats) {
+	s.Inodes++
+	s.Bytes += int64(unsafe.Sizeof(*n))
+	if t := reflect.TypeOf(n.fsInode); t != nil && t.Kind() == reflect.Ptr {
+		s.Bytes += int64(t.Elem().Size())
+	}
+	for name, ch := range n.children {
+		s.Bytes += int64(len(name) + inodeEntryBytes)
+		if ch.mountPoint != nil {
+			ch.treeLock.RLock()
+			ch.addStats(s)
+			ch.treeLock.RUnlock()
+		} else {
+			ch.addStats(s)
+		}
+	}
+}
+
+// A directory entry to invalidate, for EvictInodes.
+type evictEntry struct {
+	parent *Inode
+	name   string
+}
+
+// collectEvictable appends up to max entries below n whose Inodes the
+// kernel may forget: leaves that are known to the kernel, and not
+// open.  Must be called with treeLock held for reading.
+func (n *Inode) collectEvictable(out *[]evictEntry, max int) {
+	for name, ch := range n.children {
+		if len(*out) >= max {
+			return
+		}
+		if ch.mountPoint != nil {
+			ch.treeLock.RLock()
+			ch.collectEvictable(out, max)
+			ch.treeLock.RUnlock()
+			continue
+		}
+		if len(ch.children) > 0 {
+			ch.collectEvictable(out, max)
+			continue
+		}
+		if ch.lookupCount == 0 {
+			continue
+		}
+		ch.openFilesMutex.Lock()
+		open := len(ch.openFiles) > 0
+		ch.openFilesMutex.Unlock()
+		if !open {
+			*out = append(*out, evictEntry{n, name})
+		}
+	}
+}
+
+// mountRoots returns the root of the mount containing n, followed by
+// the roots of all mounts below it.
+func (n *Inode) mountRoots() []*Inode {
+	root := n.mount.mountInode
+	out := []*Inode{root}
+
+	var subs []*Inode
+	root.treeLock.RLock()
+	root.collectMountRoots(&subs)
+	root.treeLock.RUnlock()
+
+	for _, s := range subs {
+		out = append(out, s.mountRoots()...)
+	}
+	return out
+}
+
+// Must be called with treeLock held.
+func (n *Inode) collectMountRoots(out *[]*Inode) {
+	for _, ch := range n.children {
+		if ch.mountPoint != nil {
+			*out = append(*out, ch)
+		} else {
+			ch.collectMountRoots(out)
+		}
+	}
+}
+
 func (n *Inode) getMountDirEntries() (out []DirEntry) {
 	n.treeLock.RLock()
 	for k := range n.mounts {
@@ -236,7 +429,8 @@ func (n *Inode) verify(cur *fileSystemMount) {
 	if n.lookupCount < 0 {
 		log.Panicf("negative lookup count %d on node %d", n.lookupCount, n.nodeId)
 	}
-	if (n.lookupCount == 0) != (n.nodeId == 0) {
+	if n.lookupCount > 0 && n.nodeId == 0 ||
+		n.lookupCount == 0 && n.nodeId != 0 && !n.mount.connector.persistentInodes {
 		log.Panicf("kernel registration mismatch: lookup %d id %d", n.lookupCount, n.nodeId)
 	}
 	if n.mountPoint != nil {
@@ -0,0 +1,142 @@
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+type inodeDataKey int
+
+func TestInodeData(t *testing.T) {
+	c := NewFileSystemConnector(NewPathNodeFs(&DefaultFileSystem{}, nil), nil)
+	n := c.rootNode
+	if v := n.Data(inodeDataKey(0)); v != nil {
+		t.Errorf("unset key: got %v", v)
+	}
+	n.SetData(inodeDataKey(0), "a")
+	n.SetData(inodeDataKey(1), 42)
+	// Equal values of different types are different keys.
+	n.SetData(0, "other")
+	if v := n.Data(inodeDataKey(0)); v != "a" {
+		t.Errorf("got %v, want a", v)
+	}
+	if v := n.Data(inodeDataKey(1)); v != 42 {
+		t.Errorf("got %v, want 42", v)
+	}
+	n.SetData(inodeDataKey(0), nil)
+	if v := n.Data(inodeDataKey(0)); v != nil {
+		t.Errorf("removed key: got %v", v)
+	}
+	if v := n.Data(0); v != "other" {
+		t.Errorf("got %v, want other", v)
+	}
+}
+
+func TestDumpTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.Mkdir(filepath.Join(dir, "dir"), 0755))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "dir/file"), nil, 0644))
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), nil)
+	c := NewFileSystemConnector(pfs, nil)
+	dirOut := raw.EntryOut{}
+	if code := c.Lookup(&dirOut, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "dir"); !code.Ok() {
+		t.Fatal("Lookup:", code)
+	}
+	if pfs.LookupNode("dir/file") == nil {
+		t.Fatal("LookupNode failed")
+	}
+	if code := pfs.Mount("dir/sub", &DefaultNodeFileSystem{}, nil); !code.Ok() {
+		t.Fatal("Mount:", code)
+	}
+
+	n := pfs.Node("dir")
+	if n.NodeId() != dirOut.NodeId || n.LookupCount() != 1 {
+		t.Errorf("dir: id %d lookups %d, want %d 1", n.NodeId(), n.LookupCount(), dirOut.NodeId)
+	}
+	if ch := n.Children(); len(ch) != 2 || ch["file"] == nil || ch["sub"] == nil {
+		t.Errorf("children: %v", ch)
+	}
+
+	got := pfs.DumpTree()
+	want := fmt.Sprintf(`/ id=%d lookups=1 open=0
+  dir id=%d lookups=1 open=0
+    file id=0 lookups=0 open=0
+    sub id=0 lookups=0 open=0 mount=DefaultNodeFileSystem
+`, c.rootNode.NodeId(), dirOut.NodeId)
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// barrierFs has a file under every name.  GetAttr of a file waits
+// until all workers look it up, so their lookups overlap.
+type barrierFs struct {
+	DefaultFileSystem
+	workers int
+
+	mu       sync.Mutex
+	barriers map[string]*sync.WaitGroup
+}
+
+func (fs *barrierFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	if name == "" {
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	}
+	fs.mu.Lock()
+	b := fs.barriers[name]
+	if b == nil {
+		b = &sync.WaitGroup{}
+		b.Add(fs.workers)
+		fs.barriers[name] = b
+	}
+	fs.mu.Unlock()
+	b.Done()
+	b.Wait()
+	return &Attr{Mode: S_IFREG | 0644}, OK
+}
+
+// Concurrent lookups of a name, as with PARALLEL_DIROPS, return the
+// node that stays in the tree.
+func TestConcurrentLookupSameName(t *testing.T) {
+	const workers = 8
+	const names = 100
+	fs := &barrierFs{workers: workers, barriers: map[string]*sync.WaitGroup{}}
+	c := NewFileSystemConnector(NewPathNodeFs(fs, nil), nil)
+	var wg sync.WaitGroup
+	ids := make([][]uint64, workers)
+	for i := range ids {
+		ids[i] = make([]uint64, names)
+		wg.Add(1)
+		go func(ids []uint64) {
+			defer wg.Done()
+			for j := range ids {
+				var out raw.EntryOut
+				if code := c.Lookup(&out, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, fmt.Sprint(j)); !code.Ok() {
+					t.Errorf("Lookup: %v", code)
+				}
+				ids[j] = out.NodeId
+			}
+		}(ids[i])
+	}
+	wg.Wait()
+	for j := 0; j < names; j++ {
+		n := c.rootNode.GetChild(fmt.Sprint(j))
+		for i := range ids {
+			if c.toInode(ids[i][j]) != n {
+				t.Fatalf("lookup of %d returned node %d, which is not in the tree", j, ids[i][j])
+			}
+		}
+		if n.LookupCount() != workers {
+			t.Errorf("node %d has %d lookups, want %d", j, n.LookupCount(), workers)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package fuse
+
+// interrupted returns the channel that is closed when the request
+// unique is interrupted, or nil if it is not in flight.
+func (ms *MountState) interrupted(unique uint64) <-chan struct{} {
+	ms.notifyLock.Lock()
+	defer ms.notifyLock.Unlock()
+	req := ms.byUnique[unique]
+	if req == nil {
+		return nil
+	}
+	if req.interrupt == nil {
+		req.interrupt = make(chan struct{})
+		if req.interrupted {
+			close(req.interrupt)
+		}
+	}
+	return req.interrupt
+}
+
+// interrupt interrupts the request unique.  It returns false if the
+// request is not in flight.
+func (ms *MountState) interrupt(unique uint64) bool {
+	ms.notifyLock.Lock()
+	defer ms.notifyLock.Unlock()
+	req := ms.byUnique[unique]
+	if req == nil {
+		return false
+	}
+	ms.interruptLocked(req)
+	return true
+}
+
+// interruptAll interrupts all requests in flight, and returns how many
+// there were.
+func (ms *MountState) interruptAll() int {
+	ms.notifyLock.Lock()
+	defer ms.notifyLock.Unlock()
+	for _, req := range ms.byUnique {
+		ms.interruptLocked(req)
+	}
+	return len(ms.byUnique)
+}
+
+func (ms *MountState) interruptLocked(req *request) {
+	if req.interrupted {
+		return
+	}
+	req.interrupted = true
+	if req.interrupt != nil {
+		close(req.interrupt)
+	}
+}
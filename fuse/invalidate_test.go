@@ -0,0 +1,68 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestInvalidateTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.MkdirAll(filepath.Join(dir, "dir/sub"), 0755))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "dir/a"), nil, 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "dir/sub/b"), nil, 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "other"), nil, 0644))
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), nil)
+	c := NewFileSystemConnector(pfs, nil)
+	names := map[uint64]string{raw.FUSE_ROOT_ID: ""}
+	var entries []string
+	var inodes []string
+	c.Init(&RawFsInit{
+		EntryNotify: func(parent uint64, name string) Status {
+			entries = append(entries, names[parent]+"/"+name)
+			return OK
+		},
+		InodeNotify: func(out *raw.NotifyInvalInodeOut) Status {
+			inodes = append(inodes, names[out.Ino])
+			return OK
+		},
+	})
+
+	for _, p := range []string{"dir", "dir/a", "dir/sub", "dir/sub/b", "other"} {
+		dir, base := filepath.Split(p)
+		parent := uint64(raw.FUSE_ROOT_ID)
+		for id, n := range names {
+			if n == strings.TrimSuffix(dir, "/") {
+				parent = id
+			}
+		}
+		out := raw.EntryOut{}
+		if code := c.Lookup(&out, &raw.InHeader{NodeId: parent}, base); !code.Ok() {
+			t.Fatalf("Lookup %q: %v", p, code)
+		}
+		names[out.NodeId] = p
+	}
+
+	if code := pfs.InvalidateTree("dir"); !code.Ok() {
+		t.Fatal("InvalidateTree:", code)
+	}
+	sort.Strings(inodes)
+	if got, want := strings.Join(inodes, " "), "dir dir/a dir/sub dir/sub/b"; got != want {
+		t.Errorf("inodes: got %q, want %q", got, want)
+	}
+	if len(entries) != 3 || entries[0] != "dir/sub/b" {
+		t.Errorf("entries: got %v", entries)
+	}
+	sort.Strings(entries)
+	if got, want := strings.Join(entries, " "), "dir/a dir/sub dir/sub/b"; got != want {
+		t.Errorf("entries: got %q, want %q", got, want)
+	}
+}
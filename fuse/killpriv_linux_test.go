@@ -0,0 +1,157 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// asUser runs fn on a thread with file system uid and gid 1000 and
+// no supplementary groups, which also drops CAP_FSETID.  The thread
+// is not reused.
+func asUser(fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		syscall.RawSyscall(syscall.SYS_SETGROUPS, 0, 0, 0)
+		syscall.Syscall(syscall.SYS_SETFSGID, 1000, 0, 0)
+		syscall.Syscall(syscall.SYS_SETFSUID, 1000, 0, 0)
+		done <- fn()
+	}()
+	return <-done
+}
+
+func TestHandleKillPriv(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to switch users")
+	}
+	orig, err := ioutil.TempDir("", "go-fuse-orig")
+	CheckSuccess(err)
+	defer os.RemoveAll(orig)
+	mnt, err := ioutil.TempDir("", "go-fuse-mnt")
+	CheckSuccess(err)
+	defer os.RemoveAll(mnt)
+
+	state := NewMountState(NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(orig), nil), nil))
+	state.Debug = VerboseTest()
+	CheckSuccess(state.Mount(mnt, &MountOptions{HandleKillPriv: true}))
+	go state.Loop()
+	defer state.Unmount()
+
+	const suid = syscall.S_ISUID | syscall.S_ISGID | 0777
+	mode := func(name string) uint32 {
+		fi, err := os.Lstat(filepath.Join(orig, name))
+		CheckSuccess(err)
+		return uint32(fi.Sys().(*syscall.Stat_t).Mode) & 07777
+	}
+	setup := func(name string) string {
+		p := filepath.Join(orig, name)
+		CheckSuccess(ioutil.WriteFile(p, []byte("hello"), 0777))
+		CheckSuccess(os.Chmod(p, os.ModeSetuid|os.ModeSetgid|0777))
+		return filepath.Join(mnt, name)
+	}
+
+	// Written by root: the bits stay with killpriv v2.
+	CheckSuccess(ioutil.WriteFile(setup("root"), []byte("world"), 0777))
+	if state.KernelSettings().Flags&(raw.CAP_HANDLE_KILLPRIV|raw.CAP_HANDLE_KILLPRIV_V2) == 0 {
+		t.Skip("kernel does not support HANDLE_KILLPRIV")
+	}
+	if state.KernelSettings().Flags&raw.CAP_HANDLE_KILLPRIV_V2 != 0 {
+		if m := mode("root"); m != suid {
+			t.Errorf("write by root: got mode %o, want %o", m, suid)
+		}
+	}
+
+	write := setup("write")
+	err = asUser(func() error {
+		f, err := os.OpenFile(write, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write([]byte("world"))
+		return err
+	})
+	CheckSuccess(err)
+	if m := mode("write"); m != 0777 {
+		t.Errorf("write: got mode %o, want 777", m)
+	}
+
+	trunc := setup("truncate")
+	CheckSuccess(asUser(func() error { return os.Truncate(trunc, 1) }))
+	if m := mode("truncate"); m != 0777 {
+		t.Errorf("truncate: got mode %o, want 777", m)
+	}
+
+	chown := setup("chown")
+	CheckSuccess(os.Chown(chown, 1000, 1000))
+	if m := mode("chown"); m != 0777 {
+		t.Errorf("chown: got mode %o, want 777", m)
+	}
+}
+
+// killPrivFs has a setuid file owned by root, and records the
+// callers of Chmod.
+type killPrivFs struct {
+	DefaultFileSystem
+	mode   uint32
+	chmods []raw.Owner
+}
+
+func (fs *killPrivFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	if name == "" {
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	}
+	return &Attr{Mode: S_IFREG | fs.mode}, OK
+}
+
+func (fs *killPrivFs) Open(name string, flags uint32, context *Context) (File, Status) {
+	return &killPrivFile{}, OK
+}
+
+type killPrivFile struct {
+	DefaultFile
+}
+
+func (f *killPrivFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	return uint32(len(data)), OK
+}
+
+func (fs *killPrivFs) Chmod(name string, mode uint32, context *Context) Status {
+	fs.mode = mode
+	fs.chmods = append(fs.chmods, context.Owner)
+	return OK
+}
+
+// The writer need not own the file, so the setuid bit is cleared as
+// the owner.
+func TestKillPrivAsOwner(t *testing.T) {
+	fs := &killPrivFs{mode: syscall.S_ISUID | 0777}
+	c := NewFileSystemConnector(NewPathNodeFs(fs, nil), nil)
+	c.Init(&RawFsInit{
+		KernelSettings: func() raw.InitIn {
+			return raw.InitIn{Flags: raw.CAP_HANDLE_KILLPRIV}
+		},
+	})
+	var out raw.EntryOut
+	if code := c.Lookup(&out, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file"); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	header := &raw.InHeader{NodeId: out.NodeId}
+	header.Uid = 1000
+	header.Gid = 1000
+	if _, code := c.Write(header, &WriteIn{}, []byte("x")); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	if fs.mode != 0777 {
+		t.Errorf("got mode %o, want 777", fs.mode)
+	}
+	if len(fs.chmods) != 1 || fs.chmods[0] != (raw.Owner{}) {
+		t.Errorf("got Chmod callers %v, want the owner", fs.chmods)
+	}
+}
@@ -0,0 +1,66 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// sameInoFs reports the same inode number for all files, so only
+// link keys can tell hard links apart.
+type sameInoFs struct {
+	*LoopbackFileSystem
+}
+
+func (fs *sameInoFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	a, code := fs.LoopbackFileSystem.GetAttr(name, context)
+	if a != nil {
+		a.Ino = 1
+	}
+	return a, code
+}
+
+func TestLinkKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(dir+"/file", []byte("data"), 0644))
+	CheckSuccess(ioutil.WriteFile(dir+"/other", []byte("data"), 0644))
+
+	pfs := NewPathNodeFs(&sameInoFs{NewLoopbackFileSystem(dir)}, &PathNodeFsOptions{LinkKeys: true})
+	NewFileSystemConnector(pfs, nil)
+	root := pfs.Root().(*pathInode)
+
+	file := pfs.LookupNode("file")
+	other := pfs.LookupNode("other")
+	if file == nil || other == nil {
+		t.Fatal("lookup failed")
+	}
+
+	link, code := root.Link("link", file.FsNode(), nil)
+	if !code.Ok() {
+		t.Fatal("Link:", code)
+	}
+	if link != file.FsNode() {
+		t.Errorf("Link returned a new node")
+	}
+
+	CheckSuccess(os.Link(dir+"/file", dir+"/outside"))
+	var a Attr
+	node, code := root.Lookup(&a, "outside", nil)
+	if !code.Ok() {
+		t.Fatal("Lookup:", code)
+	}
+	if node != file.FsNode() {
+		t.Errorf("Lookup of link made outside returned a new node")
+	}
+
+	CheckSuccess(os.Link(dir+"/other", dir+"/other2"))
+	node, code = root.Lookup(&a, "other2", nil)
+	if !code.Ok() {
+		t.Fatal("Lookup:", code)
+	}
+	if node == file.FsNode() {
+		t.Errorf("files with equal inode numbers were merged")
+	}
+}
@@ -2,6 +2,7 @@ package fuse
 
 import (
 	"sync"
+	"time"
 
 	"github.com/hanwen/go-fuse/raw"
 )
@@ -72,6 +73,11 @@ func (fs *LockingFileSystem) Link(oldName string, newName string, context *Conte
 	return fs.FileSystem.Link(oldName, newName, context)
 }
 
+func (fs *LockingFileSystem) LinkKey(name string, context *Context) (key string, code Status) {
+	defer fs.locked()()
+	return fs.FileSystem.LinkKey(name, context)
+}
+
 func (fs *LockingFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
 	defer fs.locked()()
 	return fs.FileSystem.Chmod(name, mode, context)
@@ -96,14 +102,40 @@ func (fs *LockingFileSystem) OpenDir(name string, context *Context) (stream []Di
 	return fs.FileSystem.OpenDir(name, context)
 }
 
+func (fs *LockingFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, status Status) {
+	defer fs.locked()()
+	stream, status = fs.FileSystem.OpenDirStream(name, context)
+	if stream != nil {
+		stream = &lockingDirStream{stream, fs}
+	}
+	return stream, status
+}
+
+// lockingDirStream serializes the reads of a directory stream with
+// the other calls into the file system.
+type lockingDirStream struct {
+	DirStream
+	fs *LockingFileSystem
+}
+
+func (s *lockingDirStream) ReadDir(offset uint64, context *Context) ([]DirEntry, Status) {
+	defer s.fs.locked()()
+	return s.DirStream.ReadDir(offset, context)
+}
+
+func (s *lockingDirStream) Release() {
+	defer s.fs.locked()()
+	s.DirStream.Release()
+}
+
 func (fs *LockingFileSystem) OnMount(nodeFs *PathNodeFs) {
 	defer fs.locked()()
 	fs.FileSystem.OnMount(nodeFs)
 }
 
-func (fs *LockingFileSystem) OnUnmount() {
+func (fs *LockingFileSystem) OnUnmount(reason UnmountReason) {
 	defer fs.locked()()
-	fs.FileSystem.OnUnmount()
+	fs.FileSystem.OnUnmount(reason)
 }
 
 func (fs *LockingFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
@@ -116,9 +148,9 @@ func (fs *LockingFileSystem) Create(name string, flags uint32, mode uint32, cont
 	return fs.FileSystem.Create(name, flags, mode, context)
 }
 
-func (fs *LockingFileSystem) Utimens(name string, AtimeNs int64, CtimeNs int64, context *Context) (code Status) {
+func (fs *LockingFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
 	defer fs.locked()()
-	return fs.FileSystem.Utimens(name, AtimeNs, CtimeNs, context)
+	return fs.FileSystem.Utimens(name, Atime, Mtime, context)
 }
 
 func (fs *LockingFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
@@ -141,6 +173,16 @@ func (fs *LockingFileSystem) RemoveXAttr(name string, attr string, context *Cont
 	return fs.FileSystem.RemoveXAttr(name, attr, context)
 }
 
+func (fs *LockingFileSystem) SyncFs(context *Context) Status {
+	defer fs.locked()()
+	return fs.FileSystem.SyncFs(context)
+}
+
+func (fs *LockingFileSystem) FsyncDir(name string, flags int, context *Context) Status {
+	defer fs.locked()()
+	return fs.FileSystem.FsyncDir(name, flags, context)
+}
+
 ////////////////////////////////////////////////////////////////
 // Locking raw FS.
 
@@ -286,6 +328,11 @@ func (fs *LockingRawFileSystem) Write(header *raw.InHeader, input *WriteIn, data
 	return fs.RawFileSystem.Write(header, input, data)
 }
 
+func (fs *LockingRawFileSystem) CopyFileRange(header *raw.InHeader, input *raw.CopyFileRangeIn) (written uint32, code Status) {
+	defer fs.locked()()
+	return fs.RawFileSystem.CopyFileRange(header, input)
+}
+
 func (fs *LockingRawFileSystem) Flush(header *raw.InHeader, input *raw.FlushIn) Status {
 	defer fs.locked()()
 	return fs.RawFileSystem.Flush(header, input)
@@ -305,3 +352,8 @@ func (fs *LockingRawFileSystem) FsyncDir(header *raw.InHeader, input *raw.FsyncI
 	defer fs.locked()()
 	return fs.RawFileSystem.FsyncDir(header, input)
 }
+
+func (fs *LockingRawFileSystem) SyncFs(header *raw.InHeader, input *raw.SyncFsIn) (code Status) {
+	defer fs.locked()()
+	return fs.RawFileSystem.SyncFs(header, input)
+}
@@ -12,8 +12,6 @@ import (
 	"path/filepath"
 	"syscall"
 	"time"
-
-	"github.com/hanwen/go-fuse/raw"
 )
 
 var _ = fmt.Println
@@ -37,21 +35,16 @@ func (fs *LoopbackFileSystem) GetPath(relPath string) string {
 }
 
 func (fs *LoopbackFileSystem) GetAttr(name string, context *Context) (a *Attr, code Status) {
-	fullPath := fs.GetPath(name)
-	var err error = nil
-	st := syscall.Stat_t{}
-	if name == "" {
-		// When GetAttr is called for the toplevel directory, we always want
-		// to look through symlinks.
-		err = syscall.Stat(fullPath, &st)
-	} else {
-		err = syscall.Lstat(fullPath, &st)
+	// When GetAttr is called for the toplevel directory, we always want
+	// to look through symlinks.
+	flags := 0
+	if name != "" {
+		flags = _AT_SYMLINK_NOFOLLOW
 	}
-	if err != nil {
+	a = &Attr{}
+	if err := statAttr(a, AT_FDCWD, fs.GetPath(name), flags); err != nil {
 		return nil, ToStatus(err)
 	}
-	a = &Attr{}
-	a.FromStat(&st)
 	return a, OK
 }
 
@@ -74,7 +67,8 @@ func (fs *LoopbackFileSystem) OpenDir(name string, context *Context) (stream []D
 				Name: n,
 			}
 			if s := ToStatT(infos[i]); s != nil {
-				d.Mode = s.Mode
+				d.Mode = uint32(s.Mode)
+				d.Ino = s.Ino
 			} else {
 				log.Println("ReadDir entry %q for %q has no stat info", n, name)
 			}
@@ -93,8 +87,11 @@ func (fs *LoopbackFileSystem) OpenDir(name string, context *Context) (stream []D
 	return output, OK
 }
 
+// Open and Create never follow a symlink in the last component: the
+// kernel resolves symlinks itself, so one found here was put there
+// behind our back, and might point outside Root.
 func (fs *LoopbackFileSystem) Open(name string, flags uint32, context *Context) (fuseFile File, status Status) {
-	f, err := os.OpenFile(fs.GetPath(name), int(flags), 0)
+	f, err := os.OpenFile(fs.GetPath(name), int(flags)|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, ToStatus(err)
 	}
@@ -107,15 +104,15 @@ func (fs *LoopbackFileSystem) Chmod(path string, mode uint32, context *Context)
 }
 
 func (fs *LoopbackFileSystem) Chown(path string, uid uint32, gid uint32, context *Context) (code Status) {
-	return ToStatus(os.Chown(fs.GetPath(path), int(uid), int(gid)))
+	return ToStatus(os.Lchown(fs.GetPath(path), int(uid), int(gid)))
 }
 
 func (fs *LoopbackFileSystem) Truncate(path string, offset uint64, context *Context) (code Status) {
 	return ToStatus(os.Truncate(fs.GetPath(path), int64(offset)))
 }
 
-func (fs *LoopbackFileSystem) Utimens(path string, AtimeNs int64, MtimeNs int64, context *Context) (code Status) {
-	return ToStatus(os.Chtimes(fs.GetPath(path), time.Unix(0, AtimeNs), time.Unix(0, MtimeNs)))
+func (fs *LoopbackFileSystem) Utimens(path string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	return Status(Lutimens(fs.GetPath(path), Atime, Mtime))
 }
 
 func (fs *LoopbackFileSystem) Readlink(name string, context *Context) (out string, code Status) {
@@ -123,12 +120,39 @@ func (fs *LoopbackFileSystem) Readlink(name string, context *Context) (out strin
 	return f, ToStatus(err)
 }
 
+// setOwner gives a newly created file to the caller.  This only
+// works if we run as root; otherwise new files belong to the user
+// running the file system.
+func (fs *LoopbackFileSystem) setOwner(path string, context *Context) Status {
+	if context == nil || os.Geteuid() != 0 {
+		return OK
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &st); err != nil {
+		return ToStatus(err)
+	}
+	gid := int(context.Gid)
+	if st.Gid != uint32(os.Getegid()) {
+		// Inherited from a setgid directory.
+		gid = -1
+	}
+	return ToStatus(os.Lchown(path, int(context.Uid), gid))
+}
+
 func (fs *LoopbackFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) (code Status) {
-	return ToStatus(syscall.Mknod(fs.GetPath(name), mode, int(dev)))
+	p := fs.GetPath(name)
+	if err := syscall.Mknod(p, mode, int(dev)); err != nil {
+		return ToStatus(err)
+	}
+	return fs.setOwner(p, context)
 }
 
 func (fs *LoopbackFileSystem) Mkdir(path string, mode uint32, context *Context) (code Status) {
-	return ToStatus(os.Mkdir(fs.GetPath(path), os.FileMode(mode)))
+	p := fs.GetPath(path)
+	if err := os.Mkdir(p, os.FileMode(mode)); err != nil {
+		return ToStatus(err)
+	}
+	return fs.setOwner(p, context)
 }
 
 // Don't use os.Remove, it removes twice (unlink followed by rmdir).
@@ -141,7 +165,11 @@ func (fs *LoopbackFileSystem) Rmdir(name string, context *Context) (code Status)
 }
 
 func (fs *LoopbackFileSystem) Symlink(pointedTo string, linkName string, context *Context) (code Status) {
-	return ToStatus(os.Symlink(pointedTo, fs.GetPath(linkName)))
+	p := fs.GetPath(linkName)
+	if err := os.Symlink(pointedTo, p); err != nil {
+		return ToStatus(err)
+	}
+	return fs.setOwner(p, context)
 }
 
 func (fs *LoopbackFileSystem) Rename(oldPath string, newPath string, context *Context) (code Status) {
@@ -153,52 +181,75 @@ func (fs *LoopbackFileSystem) Link(orig string, newName string, context *Context
 	return ToStatus(os.Link(fs.GetPath(orig), fs.GetPath(newName)))
 }
 
+// LinkKey identifies the file by device and inode number.
+func (fs *LoopbackFileSystem) LinkKey(name string, context *Context) (key string, code Status) {
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(fs.GetPath(name), &st); err != nil {
+		return "", ToStatus(err)
+	}
+	return fmt.Sprintf("%x:%x", st.Dev, st.Ino), OK
+}
+
 func (fs *LoopbackFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
 	return ToStatus(syscall.Access(fs.GetPath(name), mode))
 }
 
 func (fs *LoopbackFileSystem) Create(path string, flags uint32, mode uint32, context *Context) (fuseFile File, code Status) {
-	f, err := os.OpenFile(fs.GetPath(path), int(flags)|os.O_CREATE, os.FileMode(mode))
-	return &LoopbackFile{File: f}, ToStatus(err)
+	p := fs.GetPath(path)
+	f, err := os.OpenFile(p, int(flags)|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, os.FileMode(mode))
+	if os.IsExist(err) && int(flags)&os.O_EXCL == 0 {
+		// Created by someone else meanwhile; leave its owner.
+		return fs.Open(path, flags, context)
+	}
+	if err != nil {
+		return nil, ToStatus(err)
+	}
+	if code := fs.setOwner(p, context); !code.Ok() {
+		f.Close()
+		return nil, code
+	}
+	return &LoopbackFile{File: f}, OK
 }
 
 func (fs *LoopbackFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
 	data := make([]byte, 1024)
-	data, errNo := GetXAttr(fs.GetPath(name), attr, data)
+	data, errNo := LGetXAttr(fs.GetPath(name), attr, data)
 
 	return data, Status(errNo)
 }
 
 func (fs *LoopbackFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
-	data, errNo := ListXAttr(fs.GetPath(name))
+	data, errNo := LListXAttr(fs.GetPath(name))
 
 	return data, Status(errNo)
 }
 
+func (fs *LoopbackFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	return Status(LSetxattr(fs.GetPath(name), attr, data, flags))
+}
+
 func (fs *LoopbackFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
-	return Status(Removexattr(fs.GetPath(name), attr))
+	return Status(LRemovexattr(fs.GetPath(name), attr))
 }
 
 func (fs *LoopbackFileSystem) String() string {
 	return fmt.Sprintf("LoopbackFileSystem(%s)", fs.Root)
 }
 
-func (fs *LoopbackFileSystem) StatFs(name string) *StatfsOut {
-	s := syscall.Statfs_t{}
-	err := syscall.Statfs(fs.GetPath(name), &s)
-	if err == nil {
-		return &StatfsOut{
-			raw.Kstatfs{
-				Blocks:  s.Blocks,
-				Bsize:   uint32(s.Bsize),
-				Bfree:   s.Bfree,
-				Bavail:  s.Bavail,
-				Files:   s.Files,
-				Ffree:   s.Ffree,
-				Frsize:  uint32(s.Frsize),
-				NameLen: uint32(s.Namelen),
-			},
-		}
+func (fs *LoopbackFileSystem) SyncFs(context *Context) (code Status) {
+	f, err := os.Open(fs.Root)
+	if err != nil {
+		return ToStatus(err)
+	}
+	defer f.Close()
+	return Status(syncfs(int(f.Fd())))
+}
+
+func (fs *LoopbackFileSystem) FsyncDir(name string, flags int, context *Context) (code Status) {
+	f, err := os.Open(fs.GetPath(name))
+	if err != nil {
+		return ToStatus(err)
 	}
-	return nil
+	defer f.Close()
+	return (&LoopbackFile{File: f}).Fsync(flags)
 }
@@ -0,0 +1,33 @@
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// OpenDirStream is not supported on Darwin, whose directory offsets
+// cannot be passed through; the connector falls back to OpenDir.
+func (fs *LoopbackFileSystem) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	return nil, ENOSYS
+}
+
+func (fs *LoopbackFileSystem) StatFs(name string) *StatfsOut {
+	s := syscall.Statfs_t{}
+	err := syscall.Statfs(fs.GetPath(name), &s)
+	if err == nil {
+		return &StatfsOut{
+			raw.Kstatfs{
+				Blocks:  s.Blocks,
+				Bsize:   s.Bsize,
+				Bfree:   s.Bfree,
+				Bavail:  s.Bavail,
+				Files:   s.Files,
+				Ffree:   s.Ffree,
+				Frsize:  s.Bsize,
+				NameLen: 255,
+			},
+		}
+	}
+	return nil
+}
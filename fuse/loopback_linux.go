@@ -0,0 +1,96 @@
+package fuse
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// OpenDirStream reads the directory with getdents(2), so the offsets
+// are those of the underlying file system.
+func (fs *LoopbackFileSystem) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	fd, err := syscall.Open(fs.GetPath(name), syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, ToStatus(err)
+	}
+	return &loopbackDirStream{fd: fd}, OK
+}
+
+type loopbackDirStream struct {
+	// Protects the file position of fd.
+	lock sync.Mutex
+	fd   int
+	buf  []byte
+}
+
+func (s *loopbackDirStream) ReadDir(offset uint64, context *Context) ([]DirEntry, Status) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := syscall.Seek(s.fd, int64(offset), os.SEEK_SET); err != nil {
+		return nil, ToStatus(err)
+	}
+	if s.buf == nil {
+		s.buf = make([]byte, 8192)
+	}
+	for {
+		n, err := syscall.ReadDirent(s.fd, s.buf)
+		if err != nil {
+			return nil, ToStatus(err)
+		}
+		if n == 0 {
+			return nil, OK
+		}
+		var entries []DirEntry
+		for off := 0; off < n; {
+			d := (*syscall.Dirent)(unsafe.Pointer(&s.buf[off]))
+			off += int(d.Reclen)
+			name := (*[256]byte)(unsafe.Pointer(&d.Name[0]))[:]
+			for i, c := range name {
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+			entries = append(entries, DirEntry{
+				Name: string(name),
+				Mode: uint32(d.Type) << 12,
+				Ino:  d.Ino,
+				Off:  uint64(d.Off),
+			})
+		}
+		// A batch of only "." and ".." is not the end.
+		if len(entries) > 0 {
+			return entries, OK
+		}
+	}
+}
+
+func (s *loopbackDirStream) Release() {
+	syscall.Close(s.fd)
+}
+
+func (fs *LoopbackFileSystem) StatFs(name string) *StatfsOut {
+	s := syscall.Statfs_t{}
+	err := syscall.Statfs(fs.GetPath(name), &s)
+	if err == nil {
+		return &StatfsOut{
+			raw.Kstatfs{
+				Blocks:  s.Blocks,
+				Bsize:   uint32(s.Bsize),
+				Bfree:   s.Bfree,
+				Bavail:  s.Bavail,
+				Files:   s.Files,
+				Ffree:   s.Ffree,
+				Frsize:  uint32(s.Frsize),
+				NameLen: uint32(s.Namelen),
+			},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func clearStatfs(s *syscall.Statfs_t) {
+	empty := syscall.Statfs_t{}
+	s.Type = 0
+	s.Fsid = empty.Fsid
+	s.Spare = empty.Spare
+	// TODO - figure out what this is for.
+	s.Flags = 0
+}
+
+// This test is racy. If an external process consumes space while this
+// runs, we may see spurious differences between the two statfs() calls.
+func TestStatFs(t *testing.T) {
+	ts := NewTestCase(t)
+	defer ts.Cleanup()
+
+	empty := syscall.Statfs_t{}
+	s1 := empty
+	err := syscall.Statfs(ts.orig, &s1)
+	if err != nil {
+		t.Fatal("statfs orig", err)
+	}
+
+	s2 := syscall.Statfs_t{}
+	err = syscall.Statfs(ts.mnt, &s2)
+
+	if err != nil {
+		t.Fatal("statfs mnt", err)
+	}
+
+	clearStatfs(&s1)
+	clearStatfs(&s2)
+	if fmt.Sprintf("%v", s2) != fmt.Sprintf("%v", s1) {
+		t.Error("Mismatch", s1, s2)
+	}
+}
+
+func TestFStatFs(t *testing.T) {
+	ts := NewTestCase(t)
+	defer ts.Cleanup()
+
+	fOrig, err := os.OpenFile(ts.orig+"/file", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	CheckSuccess(err)
+	defer fOrig.Close()
+
+	empty := syscall.Statfs_t{}
+	s1 := empty
+	errno := syscall.Fstatfs(int(fOrig.Fd()), &s1)
+	if errno != nil {
+		t.Fatal("statfs orig", err)
+	}
+
+	fMnt, err := os.OpenFile(ts.mnt+"/file", os.O_RDWR, 0644)
+	CheckSuccess(err)
+	defer fMnt.Close()
+	s2 := empty
+
+	errno = syscall.Fstatfs(int(fMnt.Fd()), &s2)
+	if errno != nil {
+		t.Fatal("statfs mnt", err)
+	}
+
+	clearStatfs(&s1)
+	clearStatfs(&s2)
+	if fmt.Sprintf("%v", s2) != fmt.Sprintf("%v", s1) {
+		t.Error("Mismatch", s1, s2)
+	}
+}
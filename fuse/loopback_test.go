@@ -14,6 +14,8 @@ import (
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/hanwen/go-fuse/raw"
 )
 
 var _ = strings.Join
@@ -127,11 +129,10 @@ func TestTouch(t *testing.T) {
 	err = os.Chtimes(ts.mountFile, time.Unix(42, 0), time.Unix(43, 0))
 	CheckSuccess(err)
 
-	var stat syscall.Stat_t
-	err = syscall.Lstat(ts.mountFile, &stat)
+	fi, err := os.Lstat(ts.mountFile)
 	CheckSuccess(err)
-	if stat.Atim.Sec != 42 || stat.Mtim.Sec != 43 {
-		t.Errorf("Got wrong timestamps %v", stat)
+	if a := ToAttr(fi); a.Atime != 42 || a.Mtime != 43 {
+		t.Errorf("Got wrong timestamps %v", a)
 	}
 }
 
@@ -506,6 +507,51 @@ func TestReaddir(t *testing.T) {
 	dir.Close()
 }
 
+func TestParallelLookup(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	if tc.state.KernelSettings().Flags&raw.CAP_PARALLEL_DIROPS == 0 {
+		t.Skip("Kernel does not support FUSE_PARALLEL_DIROPS.")
+	}
+
+	names := []string{}
+	for i := 0; i < 10; i++ {
+		n := fmt.Sprintf("file%d", i)
+		err := ioutil.WriteFile(filepath.Join(tc.orig, n), []byte(contents), 0644)
+		CheckSuccess(err)
+		names = append(names, n)
+	}
+
+	const workers = 8
+	results := make(chan map[string]uint64, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			inos := map[string]uint64{}
+			for _, n := range names {
+				fi, err := os.Lstat(filepath.Join(tc.mnt, n))
+				if err != nil {
+					t.Errorf("Lstat(%q): %v", n, err)
+					continue
+				}
+				inos[n] = fi.Sys().(*syscall.Stat_t).Ino
+			}
+			results <- inos
+		}()
+	}
+
+	for i := 0; i < workers; i++ {
+		<-results
+	}
+	// Each name has a single node, which the kernel knows.
+	root := tc.pathFs.Root().Inode()
+	for _, n := range names {
+		ch := root.GetChild(n)
+		if ch == nil || ch.nodeId == 0 || ch.LookupCount() == 0 {
+			t.Errorf("%q: node %v is not the one the kernel looked up", n, ch)
+		}
+	}
+}
+
 func TestFSync(t *testing.T) {
 	tc := NewTestCase(t)
 	defer tc.Cleanup()
@@ -681,74 +727,6 @@ func TestIoctl(t *testing.T) {
 	ioctl(int(f.Fd()), 0x5401, 42)
 }
 
-func clearStatfs(s *syscall.Statfs_t) {
-	empty := syscall.Statfs_t{}
-	s.Type = 0
-	s.Fsid = empty.Fsid
-	s.Spare = empty.Spare
-	// TODO - figure out what this is for.
-	s.Flags = 0
-}
-
-// This test is racy. If an external process consumes space while this
-// runs, we may see spurious differences between the two statfs() calls.
-func TestStatFs(t *testing.T) {
-	ts := NewTestCase(t)
-	defer ts.Cleanup()
-
-	empty := syscall.Statfs_t{}
-	s1 := empty
-	err := syscall.Statfs(ts.orig, &s1)
-	if err != nil {
-		t.Fatal("statfs orig", err)
-	}
-
-	s2 := syscall.Statfs_t{}
-	err = syscall.Statfs(ts.mnt, &s2)
-
-	if err != nil {
-		t.Fatal("statfs mnt", err)
-	}
-
-	clearStatfs(&s1)
-	clearStatfs(&s2)
-	if fmt.Sprintf("%v", s2) != fmt.Sprintf("%v", s1) {
-		t.Error("Mismatch", s1, s2)
-	}
-}
-
-func TestFStatFs(t *testing.T) {
-	ts := NewTestCase(t)
-	defer ts.Cleanup()
-
-	fOrig, err := os.OpenFile(ts.orig+"/file", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
-	CheckSuccess(err)
-	defer fOrig.Close()
-
-	empty := syscall.Statfs_t{}
-	s1 := empty
-	errno := syscall.Fstatfs(int(fOrig.Fd()), &s1)
-	if errno != nil {
-		t.Fatal("statfs orig", err)
-	}
-
-	fMnt, err := os.OpenFile(ts.mnt+"/file", os.O_RDWR, 0644)
-	CheckSuccess(err)
-	defer fMnt.Close()
-	s2 := empty
-
-	errno = syscall.Fstatfs(int(fMnt.Fd()), &s2)
-	if errno != nil {
-		t.Fatal("statfs mnt", err)
-	}
-
-	clearStatfs(&s1)
-	clearStatfs(&s2)
-	if fmt.Sprintf("%v", s2) != fmt.Sprintf("%v", s1) {
-		t.Error("Mismatch", s1, s2)
-	}
-}
-
 func TestOriginalIsSymlink(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "go-fuse")
 	CheckSuccess(err)
@@ -811,3 +789,142 @@ func TestUmask(t *testing.T) {
 		t.Errorf("got %o, expect mode %o for file %s", got, expect, fn)
 	}
 }
+
+func TestNegotiatedSettings(t *testing.T) {
+	ts := NewTestCase(t)
+	defer ts.Cleanup()
+
+	// Make sure INIT has been served.
+	_, err := os.Lstat(ts.mnt)
+	CheckSuccess(err)
+
+	kernel := ts.state.KernelSettings()
+	got := ts.state.NegotiatedSettings()
+	if got.Major != FUSE_KERNEL_VERSION {
+		t.Errorf("got major %d, want %d", got.Major, FUSE_KERNEL_VERSION)
+	}
+	want := uint32(OUR_MINOR_VERSION)
+	if kernel.Minor < want {
+		want = kernel.Minor
+	}
+	if got.Minor != want {
+		t.Errorf("got minor %d, want the lesser of ours (%d) and the kernel's (%d)", got.Minor, OUR_MINOR_VERSION, kernel.Minor)
+	}
+	if got.Flags&^kernel.Flags != 0 {
+		t.Errorf("negotiated flags %x not offered by kernel %x", got.Flags, kernel.Flags)
+	}
+	if got.MaxWrite == 0 || got.MaxWrite > MAX_KERNEL_WRITE {
+		t.Errorf("bad MaxWrite %d", got.MaxWrite)
+	}
+}
+
+func TestLoopbackCreateOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	fs := NewLoopbackFileSystem(dir)
+	ctx := &Context{}
+	ctx.Uid = 1
+	ctx.Gid = 2
+	if _, code := fs.Create("file", uint32(os.O_WRONLY), 0644, ctx); !code.Ok() {
+		t.Fatal("Create:", code)
+	}
+	if code := fs.Mkdir("dir", 0755, ctx); !code.Ok() {
+		t.Fatal("Mkdir:", code)
+	}
+	if code := fs.Symlink("file", "link", ctx); !code.Ok() {
+		t.Fatal("Symlink:", code)
+	}
+	for _, n := range []string{"file", "dir", "link"} {
+		var st syscall.Stat_t
+		CheckSuccess(syscall.Lstat(filepath.Join(dir, n), &st))
+		if st.Uid != 1 || st.Gid != 2 {
+			t.Errorf("%s: got owner %d:%d, want 1:2", n, st.Uid, st.Gid)
+		}
+	}
+
+	// Files in setgid directories keep the directory's group.
+	CheckSuccess(os.Chmod(filepath.Join(dir, "dir"), 0755|os.ModeSetgid))
+	if code := fs.Mkdir("dir/sub", 0755, &Context{Context: raw.Context{Owner: raw.Owner{Uid: 1, Gid: 3}}}); !code.Ok() {
+		t.Fatal("Mkdir:", code)
+	}
+	var st syscall.Stat_t
+	CheckSuccess(syscall.Lstat(filepath.Join(dir, "dir/sub"), &st))
+	if st.Uid != 1 || st.Gid != 2 {
+		t.Errorf("dir/sub: got owner %d:%d, want 1:2", st.Uid, st.Gid)
+	}
+
+	// An existing file keeps its owner.
+	if _, code := fs.Create("file", uint32(os.O_WRONLY), 0644, nil); !code.Ok() {
+		t.Fatal("Create:", code)
+	}
+	CheckSuccess(syscall.Lstat(filepath.Join(dir, "file"), &st))
+	if st.Uid != 1 {
+		t.Errorf("file: got uid %d after second Create, want 1", st.Uid)
+	}
+}
+
+func TestLoopbackNoFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.Mkdir(dir+"/root", 0755))
+	CheckSuccess(ioutil.WriteFile(dir+"/outside", []byte("secret"), 0644))
+	CheckSuccess(os.Symlink("../outside", dir+"/root/link"))
+	CheckSuccess(os.Symlink("../dangling", dir+"/root/dangling"))
+
+	fs := NewLoopbackFileSystem(dir + "/root")
+	if _, code := fs.Open("link", uint32(os.O_RDONLY), nil); code != Status(syscall.ELOOP) {
+		t.Errorf("Open of symlink: got %v, want ELOOP", code)
+	}
+	if _, code := fs.Create("dangling", uint32(os.O_WRONLY), 0644, nil); code.Ok() {
+		t.Errorf("Create through dangling symlink succeeded")
+	}
+	if _, err := os.Lstat(dir + "/dangling"); err == nil {
+		t.Errorf("Create followed the symlink")
+	}
+}
+
+func TestLoopbackXAttrSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(dir+"/file", nil, 0644))
+
+	fs := NewLoopbackFileSystem(dir)
+	attrs, code := fs.ListXAttr("file", nil)
+	if !code.Ok() || len(attrs) != 0 {
+		t.Fatalf("ListXAttr on bare file: got %v, %v", attrs, code)
+	}
+	big := bytes.Repeat([]byte("x"), 3000)
+	if code := fs.SetXAttr("file", "user.big", big, 0, nil); code == ENOTSUP {
+		t.Skip("no user xattrs on", dir)
+	} else if !code.Ok() {
+		t.Fatal("SetXAttr:", code)
+	}
+	val, code := fs.GetXAttr("file", "user.big", nil)
+	if !code.Ok() || !bytes.Equal(val, big) {
+		t.Errorf("GetXAttr: got %d bytes, %v, want %d bytes", len(val), code, len(big))
+	}
+
+	fs.RemoveXAttr("file", "user.big", nil)
+
+	// Ext4 fits all attributes in one block, so the list cannot
+	// be much larger than the initial buffer.
+	var names []string
+	for i := 0; i < 60; i++ {
+		n := fmt.Sprintf("user.attribute%03d", i)
+		names = append(names, n)
+		if code := fs.SetXAttr("file", n, nil, 0, nil); !code.Ok() {
+			t.Fatal("SetXAttr:", code)
+		}
+	}
+	attrs, code = fs.ListXAttr("file", nil)
+	if !code.Ok() || len(attrs) != len(names) {
+		t.Errorf("ListXAttr: got %d attributes, %v, want %d", len(attrs), code, len(names))
+	}
+}
@@ -0,0 +1,86 @@
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tinyFs has a single empty file.
+type tinyFs struct {
+	DefaultFileSystem
+}
+
+func (fs *tinyFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	switch name {
+	case "":
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	case "file":
+		return &Attr{Mode: S_IFREG | 0644}, OK
+	}
+	return nil, ENOENT
+}
+
+const manyMounts = 500
+
+func TestManyMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	before := runtime.NumGoroutine()
+	opts := &MountOptions{
+		Buffers:    NewBufferPool(),
+		MaxReaders: 1,
+	}
+	var states []*MountState
+	defer func() {
+		for _, s := range states {
+			s.Unmount()
+		}
+	}()
+	start := time.Now()
+	for i := 0; i < manyMounts; i++ {
+		mnt := filepath.Join(dir, fmt.Sprint(i))
+		CheckSuccess(os.Mkdir(mnt, 0755))
+		state := NewMountState(NewFileSystemConnector(NewPathNodeFs(&tinyFs{}, nil), nil))
+		if err := state.Mount(mnt, opts); err != nil {
+			t.Fatalf("Mount %d: %v", i, err)
+		}
+		go state.Loop()
+		states = append(states, state)
+	}
+	t.Logf("mounted %d file systems in %v", manyMounts, time.Now().Sub(start))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, manyMounts)
+	for _, s := range states {
+		wg.Add(1)
+		go func(s *MountState) {
+			defer wg.Done()
+			if _, err := os.Lstat(filepath.Join(s.MountPoint(), "file")); err != nil {
+				errs <- err
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error("Lstat:", err)
+	}
+
+	// Wait for readers that exceed MaxReaders to exit.
+	limit := before + manyMounts*(opts.MaxReaders+1)
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > limit && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > limit {
+		t.Errorf("got %d goroutines for %d mounts, want at most %d", n, manyMounts, limit)
+	}
+}
@@ -3,207 +3,443 @@ package fuse
 import (
 	"fmt"
 	"log"
-	"os"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var _ = log.Println
 
+// MemNodeFs is a read-write file system that keeps everything in
+// memory, like tmpfs.  It supports files, directories, symlinks,
+// device nodes, hard links and extended attributes.
+//
+// Its nodes can also be grafted into other NodeFileSystems with
+// NewDir and NewFile, to provide writable synthetic subtrees.
 type MemNodeFs struct {
 	DefaultNodeFileSystem
-	backingStorePrefix string
-	root               *memNode
+	root *memNode
 
-	mutex    sync.Mutex
-	nextFree int
+	// mutex serializes changes to the directory tree, so checks
+	// for existing names are not racy.
+	mutex sync.Mutex
+}
+
+func NewMemNodeFs() *MemNodeFs {
+	fs := &MemNodeFs{}
+	fs.root = fs.newNode(S_IFDIR|0777, nil)
+	return fs
 }
 
 func (fs *MemNodeFs) String() string {
-	return fmt.Sprintf("MemNodeFs(%s)", fs.backingStorePrefix)
+	return "MemNodeFs"
 }
 
 func (fs *MemNodeFs) Root() FsNode {
 	return fs.root
 }
 
-func (fs *MemNodeFs) newNode() *memNode {
-	fs.mutex.Lock()
-	n := &memNode{
-		fs: fs,
-		id: fs.nextFree,
+func (fs *MemNodeFs) newNode(mode uint32, context *Context) *memNode {
+	n := &memNode{fs: fs}
+	now := time.Now()
+	n.info.SetTimes(&now, &now, &now)
+	n.info.Mode = mode
+	n.info.Nlink = 1
+	if context != nil {
+		n.info.Owner = context.Owner
 	}
-	now := time.Now().UnixNano()
-	n.info.SetNs(now, now, now)
-	n.info.Mode = S_IFDIR | 0777
-	fs.nextFree++
-	fs.mutex.Unlock()
 	return n
 }
 
-func NewMemNodeFs(prefix string) *MemNodeFs {
-	me := &MemNodeFs{}
-	me.backingStorePrefix = prefix
-	me.root = me.newNode()
-	return me
+// NewDir adds an empty directory called name to parent, which may
+// belong to any NodeFileSystem.  Everything below the directory is
+// served by fs.
+func (fs *MemNodeFs) NewDir(parent *Inode, name string, mode uint32) FsNode {
+	n := fs.newNode(S_IFDIR|mode, nil)
+	parent.AddChild(name, parent.New(true, n))
+	return n
 }
 
-func (fs *MemNodeFs) Filename(n *Inode) string {
-	mn := n.FsNode().(*memNode)
-	return mn.filename()
+// NewFile adds a regular file called name with the given contents to
+// parent, which may belong to any NodeFileSystem.
+func (fs *MemNodeFs) NewFile(parent *Inode, name string, data []byte, mode uint32) FsNode {
+	n := fs.newNode(S_IFREG|mode, nil)
+	n.data = append([]byte{}, data...)
+	n.info.Size = uint64(len(data))
+	parent.AddChild(name, parent.New(false, n))
+	return n
 }
 
 type memNode struct {
 	DefaultFsNode
 	fs *MemNodeFs
-	id int
 
-	link string
-	info Attr
+	// mutex protects the fields below.
+	mutex  sync.Mutex
+	info   Attr
+	link   string
+	data   []byte
+	xattrs map[string][]byte
 }
 
-func (n *memNode) newNode(isdir bool) *memNode {
-	newNode := n.fs.newNode()
-	n.Inode().New(isdir, newNode)
-	return newNode
+func (n *memNode) Deletable() bool {
+	return false
 }
 
-func (n *memNode) filename() string {
-	return fmt.Sprintf("%s%d", n.fs.backingStorePrefix, n.id)
+func (n *memNode) StatFs() *StatfsOut {
+	return &StatfsOut{}
 }
 
-func (n *memNode) Deletable() bool {
-	return false
+// touch sets the modification and change time to now.
+func (n *memNode) touch() {
+	now := time.Now()
+	n.mutex.Lock()
+	n.info.SetTimes(nil, &now, &now)
+	n.mutex.Unlock()
 }
 
-func (n *memNode) Readlink(c *Context) ([]byte, Status) {
-	return []byte(n.link), OK
+// addLinks adds delta to the link count, and sets the change time.
+func (n *memNode) addLinks(delta int) {
+	now := time.Now()
+	n.mutex.Lock()
+	n.info.Nlink = uint32(int(n.info.Nlink) + delta)
+	n.info.SetTimes(nil, nil, &now)
+	n.mutex.Unlock()
 }
 
-func (n *memNode) Mkdir(name string, mode uint32, context *Context) (newNode FsNode, code Status) {
-	ch := n.newNode(true)
-	ch.info.Mode = mode | S_IFDIR
-	n.Inode().AddChild(name, ch.Inode())
+// newChild adds a node for a new entry name.  Must be called with
+// fs.mutex held.
+func (n *memNode) newChild(name string, mode uint32, context *Context) (*memNode, Status) {
+	if n.Inode().GetChild(name) != nil {
+		return nil, Status(syscall.EEXIST)
+	}
+	ch := n.fs.newNode(mode, context)
+	n.Inode().AddChild(name, n.Inode().New(mode&syscall.S_IFMT == S_IFDIR, ch))
+	n.touch()
 	return ch, OK
 }
 
-func (n *memNode) Unlink(name string, context *Context) (code Status) {
-	ch := n.Inode().RmChild(name)
-	if ch == nil {
-		return ENOENT
+func (n *memNode) Readlink(c *Context) ([]byte, Status) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.info.Mode&syscall.S_IFMT != S_IFLNK {
+		return nil, EINVAL
 	}
-	return OK
+	return []byte(n.link), OK
 }
 
-func (n *memNode) Rmdir(name string, context *Context) (code Status) {
-	return n.Unlink(name, context)
+func (n *memNode) Mknod(name string, mode uint32, dev uint32, context *Context) (newNode FsNode, code Status) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	ch, code := n.newChild(name, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	ch.info.Rdev = dev
+	return ch, OK
 }
 
-func (n *memNode) Symlink(name string, content string, context *Context) (newNode FsNode, code Status) {
-	ch := n.newNode(false)
-	ch.info.Mode = S_IFLNK | 0777
-	ch.link = content
-	n.Inode().AddChild(name, ch.Inode())
-
+func (n *memNode) Mkdir(name string, mode uint32, context *Context) (newNode FsNode, code Status) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	ch, code := n.newChild(name, mode|S_IFDIR, context)
+	if !code.Ok() {
+		return nil, code
+	}
 	return ch, OK
 }
 
-func (n *memNode) Rename(oldName string, newParent FsNode, newName string, context *Context) (code Status) {
-	ch := n.Inode().RmChild(oldName)
-	newParent.Inode().RmChild(newName)
-	newParent.Inode().AddChild(newName, ch)
-	return OK
+func (n *memNode) Symlink(name string, content string, context *Context) (newNode FsNode, code Status) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	ch, code := n.newChild(name, S_IFLNK|0777, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	ch.link = content
+	ch.info.Size = uint64(len(content))
+	return ch, OK
 }
 
 func (n *memNode) Link(name string, existing FsNode, context *Context) (newNode FsNode, code Status) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	target, ok := existing.(*memNode)
+	if !ok {
+		return nil, EXDEV
+	}
+	if existing.Inode().IsDir() {
+		return nil, EPERM
+	}
+	if n.Inode().GetChild(name) != nil {
+		return nil, Status(syscall.EEXIST)
+	}
 	n.Inode().AddChild(name, existing.Inode())
-	return existing, code
+	target.addLinks(1)
+	n.touch()
+	return existing, OK
 }
 
 func (n *memNode) Create(name string, flags uint32, mode uint32, context *Context) (file File, newNode FsNode, code Status) {
-	ch := n.newNode(false)
-	ch.info.Mode = mode | S_IFREG
-
-	f, err := os.Create(n.filename())
-	if err != nil {
-		return nil, nil, ToStatus(err)
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	ch, code := n.newChild(name, mode|S_IFREG, context)
+	if !code.Ok() {
+		return nil, nil, code
 	}
-	n.Inode().AddChild(name, ch.Inode())
-	return ch.newFile(f), ch, OK
+	return ch.newFile(), ch, OK
 }
 
-type memNodeFile struct {
-	LoopbackFile
-	node *memNode
+// remove drops the entry name, which must be a directory if dir is
+// set.  Must be called with fs.mutex held.
+func (n *memNode) remove(name string, dir bool) Status {
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return ENOENT
+	}
+	code := checkReplace(ch, dir)
+	if !code.Ok() {
+		return code
+	}
+	n.Inode().RmChild(name)
+	ch.FsNode().(*memNode).addLinks(-1)
+	n.touch()
+	return OK
 }
 
-func (n *memNodeFile) String() string {
-	return fmt.Sprintf("memNodeFile(%s)", n.LoopbackFile.String())
+// checkReplace checks whether node may be removed, or be replaced
+// by a rename, where dir says whether it must be a directory.
+func checkReplace(node *Inode, dir bool) Status {
+	if !dir && node.IsDir() {
+		return Status(syscall.EISDIR)
+	}
+	if dir && !node.IsDir() {
+		return ENOTDIR
+	}
+	if dir && len(node.Children()) > 0 {
+		return Status(syscall.ENOTEMPTY)
+	}
+	return OK
 }
 
-func (n *memNodeFile) InnerFile() File {
-	return &n.LoopbackFile
+func (n *memNode) Unlink(name string, context *Context) (code Status) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.remove(name, false)
 }
 
-func (n *memNodeFile) Flush() Status {
-	code := n.LoopbackFile.Flush()
-	var a Attr
-	n.LoopbackFile.GetAttr(&a)
-	n.node.info.Size = a.Size
-	n.node.info.Blocks = a.Blocks
-	return code
+func (n *memNode) Rmdir(name string, context *Context) (code Status) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.remove(name, true)
 }
 
-func (n *memNode) newFile(f *os.File) File {
-	return &memNodeFile{
-		LoopbackFile: LoopbackFile{File: f},
-		node:         n,
+func (n *memNode) Rename(oldName string, newParent FsNode, newName string, context *Context) (code Status) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	ch := n.Inode().GetChild(oldName)
+	if ch == nil {
+		return ENOENT
 	}
+	dest, ok := newParent.(*memNode)
+	if !ok {
+		return EXDEV
+	}
+	if old := dest.Inode().GetChild(newName); old != nil {
+		if old == ch {
+			return OK
+		}
+		if code := dest.remove(newName, ch.IsDir()); !code.Ok() {
+			return code
+		}
+	}
+	n.Inode().RmChild(oldName)
+	dest.Inode().AddChild(newName, ch)
+
+	// Only the change time of the renamed node is updated.
+	ch.FsNode().(*memNode).addLinks(0)
+	n.touch()
+	dest.touch()
+	return OK
 }
 
 func (n *memNode) Open(flags uint32, context *Context) (file File, code Status) {
-	f, err := os.OpenFile(n.filename(), int(flags), 0666)
-	if err != nil {
-		return nil, ToStatus(err)
+	if flags&syscall.O_TRUNC != 0 {
+		n.setSize(0)
 	}
-
-	return n.newFile(f), OK
+	return n.newFile(), OK
 }
 
 func (n *memNode) GetAttr(fi *Attr, file File, context *Context) (code Status) {
+	n.mutex.Lock()
 	*fi = n.info
+	n.mutex.Unlock()
+	if n.Inode().IsDir() {
+		fi.Nlink = 2
+		for _, ch := range n.Inode().FsChildren() {
+			if ch.IsDir() {
+				fi.Nlink++
+			}
+		}
+	}
 	return OK
 }
 
-func (n *memNode) Truncate(file File, size uint64, context *Context) (code Status) {
-	if file != nil {
-		code = file.Truncate(size)
+// setSize truncates or extends the data to size.
+func (n *memNode) setSize(size uint64) {
+	now := time.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if size < uint64(len(n.data)) {
+		n.data = n.data[:size]
 	} else {
-		err := os.Truncate(n.filename(), int64(size))
-		code = ToStatus(err)
+		n.data = append(n.data, make([]byte, size-uint64(len(n.data)))...)
 	}
-	if code.Ok() {
-		n.info.SetNs(-1, -1, time.Now().UnixNano())
-		// TODO - should update mtime too?
-		n.info.Size = size
+	n.info.Size = size
+	n.info.SetTimes(nil, &now, &now)
+}
+
+func (n *memNode) Truncate(file File, size uint64, context *Context) (code Status) {
+	if n.Inode().IsDir() {
+		return Status(syscall.EISDIR)
 	}
-	return code
+	n.setSize(size)
+	return OK
 }
 
-func (n *memNode) Utimens(file File, atime int64, mtime int64, context *Context) (code Status) {
-	n.info.SetNs(int64(atime), int64(mtime), time.Now().UnixNano())
+func (n *memNode) Utimens(file File, atime *time.Time, mtime *time.Time, context *Context) (code Status) {
+	now := time.Now()
+	n.mutex.Lock()
+	n.info.SetTimes(atime, mtime, &now)
+	n.mutex.Unlock()
 	return OK
 }
 
 func (n *memNode) Chmod(file File, perms uint32, context *Context) (code Status) {
-	n.info.Mode = (n.info.Mode ^ 07777) | perms
-	n.info.SetNs(-1, -1, time.Now().UnixNano())
+	now := time.Now()
+	n.mutex.Lock()
+	n.info.Mode = (n.info.Mode &^ 07777) | (perms & 07777)
+	n.info.SetTimes(nil, nil, &now)
+	n.mutex.Unlock()
 	return OK
 }
 
 func (n *memNode) Chown(file File, uid uint32, gid uint32, context *Context) (code Status) {
+	now := time.Now()
+	n.mutex.Lock()
 	n.info.Uid = uid
 	n.info.Gid = gid
-	n.info.SetNs(-1, -1, time.Now().UnixNano())
+	n.info.SetTimes(nil, nil, &now)
+	n.mutex.Unlock()
+	return OK
+}
+
+func (n *memNode) GetXAttr(attribute string, context *Context) (data []byte, code Status) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	data, ok := n.xattrs[attribute]
+	if !ok {
+		return nil, ENODATA
+	}
+	return data, OK
+}
+
+func (n *memNode) SetXAttr(attr string, data []byte, flags int, context *Context) Status {
+	now := time.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	_, ok := n.xattrs[attr]
+	if ok && flags&XATTR_CREATE != 0 {
+		return Status(syscall.EEXIST)
+	}
+	if !ok && flags&XATTR_REPLACE != 0 {
+		return ENODATA
+	}
+	if n.xattrs == nil {
+		n.xattrs = make(map[string][]byte)
+	}
+	n.xattrs[attr] = append([]byte{}, data...)
+	n.info.SetTimes(nil, nil, &now)
+	return OK
+}
+
+func (n *memNode) RemoveXAttr(attr string, context *Context) Status {
+	now := time.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.xattrs[attr]; !ok {
+		return ENODATA
+	}
+	delete(n.xattrs, attr)
+	n.info.SetTimes(nil, nil, &now)
+	return OK
+}
+
+func (n *memNode) ListXAttr(context *Context) (attrs []string, code Status) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for k := range n.xattrs {
+		attrs = append(attrs, k)
+	}
+	return attrs, OK
+}
+
+func (n *memNode) newFile() File {
+	return &memNodeFile{node: n}
+}
+
+// memNodeFile reads and writes the data of a memNode.
+type memNodeFile struct {
+	DefaultFile
+	node *memNode
+}
+
+func (f *memNodeFile) String() string {
+	return fmt.Sprintf("memNodeFile(%p)", f.node)
+}
+
+func (f *memNodeFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	n := f.node
+	now := time.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.info.SetTimes(&now, nil, nil)
+	if input.Offset >= uint64(len(n.data)) {
+		return nil, OK
+	}
+	buf := bp.AllocBuffer(input.Size)
+	c := copy(buf, n.data[input.Offset:])
+	return buf[:c], OK
+}
+
+func (f *memNodeFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	n := f.node
+	now := time.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	end := input.Offset + uint64(len(data))
+	if end > uint64(len(n.data)) {
+		n.data = append(n.data, make([]byte, end-uint64(len(n.data)))...)
+		n.info.Size = end
+	}
+	copy(n.data[input.Offset:], data)
+	n.info.SetTimes(nil, &now, &now)
+	return uint32(len(data)), OK
+}
+
+func (f *memNodeFile) Flush(input *FlushIn) Status {
 	return OK
 }
+
+func (f *memNodeFile) Fsync(flags int) (code Status) {
+	return OK
+}
+
+func (f *memNodeFile) Truncate(size uint64, context *Context) Status {
+	f.node.setSize(size)
+	return OK
+}
+
+func (f *memNodeFile) GetAttr(out *Attr) Status {
+	return f.node.GetAttr(out, f, nil)
+}
@@ -4,7 +4,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var _ = log.Println
@@ -12,9 +14,7 @@ var _ = log.Println
 func setupMemNodeTest(t *testing.T) (wd string, fs *MemNodeFs, clean func()) {
 	tmp, err := ioutil.TempDir("", "go-fuse")
 	CheckSuccess(err)
-	back := tmp + "/backing"
-	os.Mkdir(back, 0700)
-	fs = NewMemNodeFs(back)
+	fs = NewMemNodeFs()
 	mnt := tmp + "/mnt"
 	os.Mkdir(mnt, 0700)
 
@@ -76,3 +76,204 @@ func TestMemNodeSetattr(t *testing.T) {
 		t.Errorf("Size should be 4096 after Truncate: %d", fi.Size())
 	}
 }
+
+// newMemNodeTestFs returns a MemNodeFs attached to a connector, but
+// not mounted, so its nodes can be called directly.
+func newMemNodeTestFs() (*MemNodeFs, FsNode) {
+	fs := NewMemNodeFs()
+	NewFileSystemConnector(fs, nil)
+	return fs, fs.Root()
+}
+
+func TestMemNodeData(t *testing.T) {
+	_, root := newMemNodeTestFs()
+
+	f, node, code := root.Create("file", 0, 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Write(&WriteIn{Offset: 0}, []byte("hello world"))
+	f.Write(&WriteIn{Offset: 6}, []byte("there"))
+	f.Write(&WriteIn{Offset: 20}, []byte("!"))
+
+	bp := NewBufferPool()
+	content, code := f.Read(&ReadIn{Offset: 0, Size: 100}, bp)
+	want := "hello there\x00\x00\x00\x00\x00\x00\x00\x00\x00!"
+	if !code.Ok() || string(content) != want {
+		t.Errorf("got %q, %v, want %q", content, code, want)
+	}
+	var a Attr
+	node.GetAttr(&a, nil, nil)
+	if a.Size != uint64(len(want)) || !a.IsRegular() || a.Mode&07777 != 0644 {
+		t.Errorf("got attr %v", &a)
+	}
+
+	if code := node.Truncate(nil, 5, nil); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	node.Truncate(nil, 7, nil)
+	content, _ = f.Read(&ReadIn{Offset: 0, Size: 100}, bp)
+	if string(content) != "hello\x00\x00" {
+		t.Errorf("after truncate got %q", content)
+	}
+	content, _ = f.Read(&ReadIn{Offset: 100, Size: 100}, bp)
+	if len(content) != 0 {
+		t.Errorf("read beyond end got %q", content)
+	}
+}
+
+func TestMemNodeNamespace(t *testing.T) {
+	_, root := newMemNodeTestFs()
+
+	dir, code := root.Mkdir("dir", 0755, nil)
+	if !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	if _, code := root.Mkdir("dir", 0755, nil); code != Status(syscall.EEXIST) {
+		t.Errorf("Mkdir of existing dir: got %v, want EEXIST", code)
+	}
+	_, file, _ := dir.Create("file", 0, 0644, nil)
+	if _, code := root.Link("hard", file, nil); !code.Ok() {
+		t.Fatalf("Link: %v", code)
+	}
+	link, _ := root.Symlink("link", "dir/file", nil)
+
+	if code := root.Rmdir("dir", nil); code != Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir of non-empty dir: got %v, want ENOTEMPTY", code)
+	}
+	if code := root.Unlink("dir", nil); code != Status(syscall.EISDIR) {
+		t.Errorf("Unlink of dir: got %v, want EISDIR", code)
+	}
+
+	target, code := link.Readlink(nil)
+	if !code.Ok() || string(target) != "dir/file" {
+		t.Errorf("Readlink got %q, %v", target, code)
+	}
+
+	var a Attr
+	file.GetAttr(&a, nil, nil)
+	if a.Nlink != 2 {
+		t.Errorf("got nlink %d, want 2", a.Nlink)
+	}
+	root.GetAttr(&a, nil, nil)
+	if a.Nlink != 3 {
+		t.Errorf("got root nlink %d, want 3", a.Nlink)
+	}
+
+	root.Create("other", 0, 0644, nil)
+	if code := root.Rename("other", dir, "file", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	file.GetAttr(&a, nil, nil)
+	if a.Nlink != 1 {
+		t.Errorf("got nlink %d after rename over link, want 1", a.Nlink)
+	}
+	if root.Inode().GetChild("hard") != file.Inode() {
+		t.Errorf("hard link lost")
+	}
+	if code := root.Rename("hard", root, "dir", nil); code != Status(syscall.EISDIR) {
+		t.Errorf("Rename over dir: got %v, want EISDIR", code)
+	}
+
+	if code := dir.Unlink("file", nil); !code.Ok() {
+		t.Errorf("Unlink: %v", code)
+	}
+	if code := root.Rmdir("dir", nil); !code.Ok() {
+		t.Errorf("Rmdir: %v", code)
+	}
+	if ch := root.Inode().Children(); len(ch) != 2 {
+		t.Errorf("got %v, want entries hard and link", ch)
+	}
+}
+
+func TestMemNodeTimes(t *testing.T) {
+	_, root := newMemNodeTestFs()
+
+	mtime := time.Unix(1e9, 0)
+	root.Utimens(nil, nil, &mtime, nil)
+
+	f, node, _ := root.Create("file", 0, 0644, nil)
+	var a Attr
+	root.GetAttr(&a, nil, nil)
+	if !a.ModTime().After(mtime) {
+		t.Errorf("directory mtime %v not updated by create", a.ModTime())
+	}
+
+	node.Utimens(nil, &mtime, &mtime, nil)
+	f.Write(&WriteIn{}, []byte("abc"))
+	node.GetAttr(&a, nil, nil)
+	if !a.ModTime().After(mtime) || !a.AccessTime().Equal(mtime) {
+		t.Errorf("got atime %v mtime %v after write", a.AccessTime(), a.ModTime())
+	}
+
+	node.Chmod(nil, 0600, nil)
+	node.GetAttr(&a, nil, nil)
+	if a.Mode != S_IFREG|0600 {
+		t.Errorf("got mode %o, want %o", a.Mode, S_IFREG|0600)
+	}
+}
+
+func TestMemNodeXAttr(t *testing.T) {
+	_, root := newMemNodeTestFs()
+
+	if code := root.SetXAttr("user.a", []byte("val"), XATTR_REPLACE, nil); code != ENODATA {
+		t.Errorf("XATTR_REPLACE of absent attribute: got %v, want ENODATA", code)
+	}
+	if code := root.SetXAttr("user.a", []byte("val"), XATTR_CREATE, nil); !code.Ok() {
+		t.Fatalf("SetXAttr: %v", code)
+	}
+	if code := root.SetXAttr("user.a", []byte("val"), XATTR_CREATE, nil); code != Status(syscall.EEXIST) {
+		t.Errorf("XATTR_CREATE of existing attribute: got %v, want EEXIST", code)
+	}
+	val, code := root.GetXAttr("user.a", nil)
+	if !code.Ok() || string(val) != "val" {
+		t.Errorf("GetXAttr got %q, %v", val, code)
+	}
+	attrs, code := root.ListXAttr(nil)
+	if !code.Ok() || len(attrs) != 1 || attrs[0] != "user.a" {
+		t.Errorf("ListXAttr got %v, %v", attrs, code)
+	}
+	if code := root.RemoveXAttr("user.a", nil); !code.Ok() {
+		t.Errorf("RemoveXAttr: %v", code)
+	}
+	if _, code := root.GetXAttr("user.a", nil); code != ENODATA {
+		t.Errorf("GetXAttr after remove: got %v, want ENODATA", code)
+	}
+}
+
+type graftTestFs struct {
+	DefaultNodeFileSystem
+	root DefaultFsNode
+}
+
+func (fs *graftTestFs) Root() FsNode {
+	return &fs.root
+}
+
+func TestMemNodeGraft(t *testing.T) {
+	fs := &graftTestFs{}
+	NewFileSystemConnector(fs, nil)
+	mem := NewMemNodeFs()
+	file := mem.NewFile(fs.root.Inode(), "file", []byte("hello"), 0644)
+	dir := mem.NewDir(fs.root.Inode(), "dir", 0755)
+
+	f, code := file.Open(0, nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	content, _ := f.Read(&ReadIn{Size: 100}, NewBufferPool())
+	if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+
+	if _, code := dir.Mkdir("sub", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	entries, code := dir.OpenDir(nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != "sub" || entries[0].Mode&S_IFDIR == 0 {
+		t.Errorf("OpenDir got %v, %v", entries, code)
+	}
+	if code := dir.Rename("sub", &fs.root, "sub", nil); code != EXDEV {
+		t.Errorf("Rename out of the subtree: got %v, want EXDEV", code)
+	}
+}
@@ -0,0 +1,598 @@
+package fuse
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MirrorPolicy says what a MirrorFileSystem does when a replica fails
+// an operation that the primary did.
+type MirrorPolicy int
+
+const (
+	// Return the error of the replica.  The primary keeps the
+	// change, so the replica has diverged.
+	MIRROR_FAIL_FAST = MirrorPolicy(iota)
+
+	// Return the result of the primary, and retry operations that
+	// failed with a temporary error, like EIO or ENOSPC, until
+	// they succeed.  Later operations on the replica wait for
+	// them.  Other errors are divergences.
+	MIRROR_RETRY
+)
+
+type MirrorOptions struct {
+	Policy MirrorPolicy
+
+	// RetryInterval is the time between retries of queued
+	// operations.  Defaults to 10 seconds.
+	RetryInterval time.Duration
+
+	// If set, each divergence is written to Journal, as a line.
+	Journal io.Writer
+}
+
+// Divergence records an operation that a replica did not apply.
+type Divergence struct {
+	Time    time.Time
+	Replica int
+	Op      string
+	Names   []string
+	Status  Status
+}
+
+func (d *Divergence) String() string {
+	return fmt.Sprintf("%s replica %d: %s %q: %v",
+		d.Time.UTC().Format(time.RFC3339), d.Replica, d.Op, d.Names, d.Status)
+}
+
+// MirrorFileSystem is a wrapper that applies all changes to a primary
+// file system and to its replicas, and reads from the primary.
+// Mutations are serialized, so the replicas see them in the same
+// order.
+//
+// It can be used to move a mount to another backend while it is in
+// use: mount with the old backend as primary and the new one as
+// replica, copy the existing data over, eg. with CopyFile, and
+// switch once Pending is zero and the divergences are repaired.
+type MirrorFileSystem struct {
+	FileSystem
+
+	options  MirrorOptions
+	replicas []*mirrorReplica
+
+	// order is held while a change is applied.
+	order sync.Mutex
+
+	lock        sync.Mutex
+	divergences []Divergence
+	timer       *time.Timer
+}
+
+type mirrorReplica struct {
+	fs    FileSystem
+	index int
+	// Operations to retry, oldest first.  Protected by order.
+	pending []*mirrorOp
+}
+
+type mirrorOp struct {
+	op    string
+	names []string
+	do    func(fs FileSystem) Status
+}
+
+// NewMirrorFileSystem returns a MirrorFileSystem that reads from
+// primary.  Replicas are numbered from 1 in divergences.
+func NewMirrorFileSystem(primary FileSystem, replicas []FileSystem, opts *MirrorOptions) *MirrorFileSystem {
+	fs := &MirrorFileSystem{FileSystem: primary}
+	if opts != nil {
+		fs.options = *opts
+	}
+	if fs.options.RetryInterval <= 0 {
+		fs.options.RetryInterval = 10 * time.Second
+	}
+	for i, r := range replicas {
+		fs.replicas = append(fs.replicas, &mirrorReplica{fs: r, index: i + 1})
+	}
+	return fs
+}
+
+func (fs *MirrorFileSystem) String() string {
+	names := []string{fs.FileSystem.String()}
+	for _, r := range fs.replicas {
+		names = append(names, r.fs.String())
+	}
+	return fmt.Sprintf("MirrorFileSystem(%s)", strings.Join(names, ", "))
+}
+
+// Divergences returns the operations that replicas did not apply.
+func (fs *MirrorFileSystem) Divergences() []Divergence {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return append([]Divergence(nil), fs.divergences...)
+}
+
+// Pending returns the number of operations waiting to be retried.
+func (fs *MirrorFileSystem) Pending() int {
+	fs.order.Lock()
+	defer fs.order.Unlock()
+	n := 0
+	for _, r := range fs.replicas {
+		n += len(r.pending)
+	}
+	return n
+}
+
+// Retry retries the queued operations now, and returns the number
+// that are still waiting.
+func (fs *MirrorFileSystem) Retry() int {
+	fs.order.Lock()
+	defer fs.order.Unlock()
+	n := 0
+	for _, r := range fs.replicas {
+		for len(r.pending) > 0 {
+			op := r.pending[0]
+			code := op.do(r.fs)
+			if !code.Ok() && isTransient(code) {
+				break
+			}
+			if !code.Ok() {
+				fs.diverge(r, op, code)
+			}
+			r.pending = r.pending[1:]
+		}
+		n += len(r.pending)
+	}
+	if n > 0 {
+		fs.scheduleRetry()
+	}
+	return n
+}
+
+func (fs *MirrorFileSystem) scheduleRetry() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.timer != nil {
+		return
+	}
+	fs.timer = time.AfterFunc(fs.options.RetryInterval, func() {
+		fs.lock.Lock()
+		fs.timer = nil
+		fs.lock.Unlock()
+		fs.Retry()
+	})
+}
+
+func (fs *MirrorFileSystem) diverge(r *mirrorReplica, op *mirrorOp, code Status) {
+	d := Divergence{
+		Time:    time.Now(),
+		Replica: r.index,
+		Op:      op.op,
+		Names:   op.names,
+		Status:  code,
+	}
+	log.Printf("MirrorFileSystem: %v", &d)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.divergences = append(fs.divergences, d)
+	if fs.options.Journal != nil {
+		fmt.Fprintln(fs.options.Journal, d.String())
+	}
+}
+
+func isTransient(code Status) bool {
+	switch syscall.Errno(code) {
+	case syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.ENOSPC,
+		syscall.EDQUOT, syscall.EBUSY, syscall.ETIMEDOUT, syscall.ENOTCONN:
+		return true
+	}
+	return false
+}
+
+// applyReplica applies op to r, or queues it.  The caller must hold
+// the order lock.
+func (fs *MirrorFileSystem) applyReplica(r *mirrorReplica, op *mirrorOp) Status {
+	if len(r.pending) > 0 {
+		r.pending = append(r.pending, op)
+		return OK
+	}
+	code := op.do(r.fs)
+	if code.Ok() {
+		return OK
+	}
+	if fs.options.Policy == MIRROR_RETRY && isTransient(code) {
+		r.pending = append(r.pending, op)
+		fs.scheduleRetry()
+		return OK
+	}
+	fs.diverge(r, op, code)
+	return code
+}
+
+// apply applies op to the primary, and if that succeeds, to the
+// replicas.
+func (fs *MirrorFileSystem) apply(op *mirrorOp) Status {
+	fs.order.Lock()
+	defer fs.order.Unlock()
+	code := op.do(fs.FileSystem)
+	if !code.Ok() {
+		return code
+	}
+	for _, r := range fs.replicas {
+		if c := fs.applyReplica(r, op); !c.Ok() && fs.options.Policy == MIRROR_FAIL_FAST {
+			code = c
+		}
+	}
+	return code
+}
+
+// copyContext returns a copy of c, so queued operations do not see
+// the buffers of later requests.
+func copyContext(c *Context) *Context {
+	if c == nil {
+		return nil
+	}
+	copied := *c
+	return &copied
+}
+
+func (fs *MirrorFileSystem) Chmod(name string, mode uint32, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Chmod", []string{name}, func(fs FileSystem) Status {
+		return fs.Chmod(name, mode, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Chown", []string{name}, func(fs FileSystem) Status {
+		return fs.Chown(name, uid, gid, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *Context) Status {
+	context = copyContext(context)
+	atime, mtime = copyTime(atime), copyTime(mtime)
+	return fs.apply(&mirrorOp{"Utimens", []string{name}, func(fs FileSystem) Status {
+		return fs.Utimens(name, atime, mtime, context)
+	}})
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	copied := *t
+	return &copied
+}
+
+func (fs *MirrorFileSystem) Truncate(name string, size uint64, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Truncate", []string{name}, func(fs FileSystem) Status {
+		return fs.Truncate(name, size, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Link(oldName string, newName string, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Link", []string{oldName, newName}, func(fs FileSystem) Status {
+		return fs.Link(oldName, newName, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Mkdir", []string{name}, func(fs FileSystem) Status {
+		return fs.Mkdir(name, mode, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Mknod", []string{name}, func(fs FileSystem) Status {
+		return fs.Mknod(name, mode, dev, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Rename(oldName string, newName string, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Rename", []string{oldName, newName}, func(fs FileSystem) Status {
+		return fs.Rename(oldName, newName, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Rmdir(name string, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Rmdir", []string{name}, func(fs FileSystem) Status {
+		return fs.Rmdir(name, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Unlink(name string, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Unlink", []string{name}, func(fs FileSystem) Status {
+		return fs.Unlink(name, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Symlink(value string, linkName string, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"Symlink", []string{linkName}, func(fs FileSystem) Status {
+		return fs.Symlink(value, linkName, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	context = copyContext(context)
+	data = append([]byte(nil), data...)
+	return fs.apply(&mirrorOp{"SetXAttr", []string{name}, func(fs FileSystem) Status {
+		return fs.SetXAttr(name, attr, data, flags, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"RemoveXAttr", []string{name}, func(fs FileSystem) Status {
+		return fs.RemoveXAttr(name, attr, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) SyncFs(context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"SyncFs", nil, func(fs FileSystem) Status {
+		return fs.SyncFs(context)
+	}})
+}
+
+func (fs *MirrorFileSystem) FsyncDir(name string, flags int, context *Context) Status {
+	context = copyContext(context)
+	return fs.apply(&mirrorOp{"FsyncDir", []string{name}, func(fs FileSystem) Status {
+		return fs.FsyncDir(name, flags, context)
+	}})
+}
+
+func (fs *MirrorFileSystem) Open(name string, flags uint32, context *Context) (File, Status) {
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY && flags&syscall.O_TRUNC == 0 {
+		return fs.FileSystem.Open(name, flags, context)
+	}
+	context = copyContext(context)
+	return fs.openFile(&mirrorOp{"Open", []string{name}, nil}, name, func(fs FileSystem) (File, Status) {
+		return fs.Open(name, flags, context)
+	})
+}
+
+func (fs *MirrorFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (File, Status) {
+	context = copyContext(context)
+	return fs.openFile(&mirrorOp{"Create", []string{name}, nil}, name, func(fs FileSystem) (File, Status) {
+		return fs.Create(name, flags, mode, context)
+	})
+}
+
+// openFile opens a file for writing on all file systems.  Replicas
+// that cannot open it now get the change of the open, like O_TRUNC,
+// queued, and later writes by name.
+func (fs *MirrorFileSystem) openFile(op *mirrorOp, name string, open func(fs FileSystem) (File, Status)) (File, Status) {
+	fs.order.Lock()
+	defer fs.order.Unlock()
+	primary, code := open(fs.FileSystem)
+	if !code.Ok() {
+		return nil, code
+	}
+	f := &mirrorFile{
+		File:  primary,
+		fs:    fs,
+		name:  name,
+		files: make([]File, len(fs.replicas)),
+		skip:  make([]bool, len(fs.replicas)),
+	}
+	op.do = func(fs FileSystem) Status {
+		file, code := open(fs)
+		if code.Ok() {
+			file.Release(&ReleaseIn{})
+		}
+		return code
+	}
+	for i, r := range fs.replicas {
+		if len(r.pending) == 0 {
+			file, c := open(r.fs)
+			if c.Ok() {
+				f.files[i] = file
+				continue
+			}
+			if fs.options.Policy == MIRROR_RETRY && isTransient(c) {
+				r.pending = append(r.pending, op)
+				fs.scheduleRetry()
+				continue
+			}
+			fs.diverge(r, op, c)
+			f.skip[i] = true
+			if fs.options.Policy == MIRROR_FAIL_FAST {
+				f.release(&ReleaseIn{})
+				return nil, c
+			}
+			continue
+		}
+		r.pending = append(r.pending, op)
+	}
+	return f, OK
+}
+
+// mirrorFile is a file opened for writing on a MirrorFileSystem.
+type mirrorFile struct {
+	File
+	fs   *MirrorFileSystem
+	name string
+
+	// The handles on the replicas.  A replica has none if it was
+	// behind when the file was opened, or failed to open it.
+	files []File
+	// skip is set for replicas that failed to open the file.
+	skip []bool
+}
+
+func (f *mirrorFile) String() string {
+	return fmt.Sprintf("mirrorFile(%s)", f.File.String())
+}
+
+func (f *mirrorFile) InnerFile() File {
+	return f.File
+}
+
+// mirror applies a change to the primary file, and then to the
+// replicas.  Replicas without a handle, or with queued operations,
+// get the change by name, as returned by byName, which may be nil
+// for changes that only apply to handles.
+func (f *mirrorFile) mirror(op string, do func(f File) Status, byName func() func(fs FileSystem) Status) Status {
+	fs := f.fs
+	fs.order.Lock()
+	defer fs.order.Unlock()
+	code := do(f.File)
+	if !code.Ok() {
+		return code
+	}
+	for i, r := range fs.replicas {
+		if f.skip[i] {
+			continue
+		}
+		var c Status
+		if f.files[i] != nil && len(r.pending) == 0 {
+			if c = do(f.files[i]); c.Ok() {
+				continue
+			}
+			if byName == nil || fs.options.Policy != MIRROR_RETRY || !isTransient(c) {
+				fs.diverge(r, &mirrorOp{op, []string{f.name}, nil}, c)
+				f.skip[i] = true
+			} else {
+				r.pending = append(r.pending, &mirrorOp{op, []string{f.name}, byName()})
+				fs.scheduleRetry()
+			}
+		} else if byName != nil {
+			if c = fs.applyReplica(r, &mirrorOp{op, []string{f.name}, byName()}); !c.Ok() {
+				f.skip[i] = true
+			}
+		}
+		if !c.Ok() && fs.options.Policy == MIRROR_FAIL_FAST {
+			code = c
+		}
+	}
+	return code
+}
+
+// byName returns a function that opens the file on a replica for
+// writing, and applies do.
+func (f *mirrorFile) byName(do func(f File) Status) func() func(fs FileSystem) Status {
+	return func() func(fs FileSystem) Status {
+		name := f.name
+		return func(fs FileSystem) Status {
+			file, code := fs.Open(name, uint32(os.O_WRONLY), nil)
+			if !code.Ok() {
+				return code
+			}
+			defer file.Release(&ReleaseIn{})
+			if code := do(file); !code.Ok() {
+				return code
+			}
+			return file.Flush(&FlushIn{})
+		}
+	}
+}
+
+func (f *mirrorFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	var written uint32
+	offset := input.Offset
+	code := f.mirror("Write", func(file File) Status {
+		n, code := file.Write(input, data)
+		if code.Ok() && int(n) < len(data) && file == f.File {
+			// Only mirror what the primary wrote.
+			data = data[:n]
+		}
+		if file == f.File {
+			written = n
+		}
+		return code
+	}, func() func(fs FileSystem) Status {
+		data := append([]byte(nil), data...)
+		return f.byName(func(file File) Status {
+			_, code := file.Write(&WriteIn{Offset: offset, Size: uint32(len(data))}, data)
+			return code
+		})()
+	})
+	return written, code
+}
+
+func (f *mirrorFile) Truncate(size uint64, context *Context) Status {
+	context = copyContext(context)
+	do := func(file File) Status {
+		return file.Truncate(size, context)
+	}
+	return f.mirror("Truncate", do, f.byName(do))
+}
+
+func (f *mirrorFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	context = copyContext(context)
+	do := func(file File) Status {
+		return file.Chown(uid, gid, context)
+	}
+	return f.mirror("Chown", do, f.byName(do))
+}
+
+func (f *mirrorFile) Chmod(perms uint32, context *Context) Status {
+	context = copyContext(context)
+	do := func(file File) Status {
+		return file.Chmod(perms, context)
+	}
+	return f.mirror("Chmod", do, f.byName(do))
+}
+
+func (f *mirrorFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	context = copyContext(context)
+	atime, mtime = copyTime(atime), copyTime(mtime)
+	do := func(file File) Status {
+		return file.Utimens(atime, mtime, context)
+	}
+	return f.mirror("Utimens", do, f.byName(do))
+}
+
+func (f *mirrorFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	context = copyContext(context)
+	copied := *attr
+	do := func(file File) Status {
+		return file.Setattr(valid, &copied, context)
+	}
+	return f.mirror("Setattr", do, f.byName(do))
+}
+
+func (f *mirrorFile) Flush(input *FlushIn) Status {
+	return f.mirror("Flush", func(file File) Status {
+		return file.Flush(input)
+	}, nil)
+}
+
+func (f *mirrorFile) Fsync(flags int) Status {
+	return f.mirror("Fsync", func(file File) Status {
+		return file.Fsync(flags)
+	}, nil)
+}
+
+func (f *mirrorFile) release(input *ReleaseIn) {
+	for i, file := range f.files {
+		if file != nil {
+			file.Release(input)
+			f.files[i] = nil
+		}
+	}
+	f.File.Release(input)
+}
+
+func (f *mirrorFile) Release(input *ReleaseIn) {
+	f.fs.order.Lock()
+	defer f.fs.order.Unlock()
+	f.release(input)
+}
@@ -0,0 +1,139 @@
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func setupMirrorFs(t *testing.T, opts *MirrorOptions) (fs *MirrorFileSystem, replica *FaultFileSystem, dirs []string, clean func()) {
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "go-fuse")
+		CheckSuccess(err)
+		dirs = append(dirs, dir)
+	}
+	replica = NewFaultFileSystem(NewLoopbackFileSystem(dirs[1]))
+	fs = NewMirrorFileSystem(NewLoopbackFileSystem(dirs[0]), []FileSystem{replica}, opts)
+	return fs, replica, dirs, func() {
+		for _, d := range dirs {
+			os.RemoveAll(d)
+		}
+	}
+}
+
+func checkMirrored(t *testing.T, dirs []string, name string, want string) {
+	for i, d := range dirs {
+		data, err := ioutil.ReadFile(filepath.Join(d, name))
+		if err != nil || string(data) != want {
+			t.Errorf("backend %d: %s: got %q, %v", i, name, data, err)
+		}
+	}
+}
+
+func writeMirrorFile(t *testing.T, fs FileSystem, name string, data string) {
+	f, code := fs.Create(name, uint32(os.O_WRONLY|os.O_CREATE|os.O_TRUNC), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create(%q): %v", name, code)
+	}
+	defer f.Release(&ReleaseIn{})
+	if _, code := f.Write(&WriteIn{}, []byte(data)); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	if code := f.Flush(&FlushIn{}); !code.Ok() {
+		t.Fatalf("Flush: %v", code)
+	}
+}
+
+func TestMirrorFs(t *testing.T) {
+	fs, _, dirs, clean := setupMirrorFs(t, nil)
+	defer clean()
+
+	fs.Mkdir("dir", 0755, nil)
+	writeMirrorFile(t, fs, "dir/file", "hello")
+	if code := fs.Rename("dir/file", "moved", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	checkMirrored(t, dirs, "moved", "hello")
+
+	f, _ := fs.Open("moved", uint32(os.O_RDWR), nil)
+	f.Write(&WriteIn{Offset: 5}, []byte(" world"))
+	f.Truncate(8, nil)
+	f.Release(&ReleaseIn{})
+	checkMirrored(t, dirs, "moved", "hello wo")
+
+	fs.Unlink("moved", nil)
+	fs.Rmdir("dir", nil)
+	for i, d := range dirs {
+		if names, _ := ioutil.ReadDir(d); len(names) != 0 {
+			t.Errorf("backend %d: left %v", i, names[0].Name())
+		}
+	}
+	if d := fs.Divergences(); len(d) != 0 {
+		t.Errorf("divergences: %v", d)
+	}
+}
+
+func TestMirrorFsFailFast(t *testing.T) {
+	journal := &bytes.Buffer{}
+	fs, replica, _, clean := setupMirrorFs(t, &MirrorOptions{Journal: journal})
+	defer clean()
+
+	replica.AddFault(Fault{Op: "Mkdir", Status: Status(syscall.ENOSPC)})
+	if code := fs.Mkdir("dir", 0755, nil); code != Status(syscall.ENOSPC) {
+		t.Errorf("Mkdir: got %v", code)
+	}
+	if _, code := fs.GetAttr("dir", nil); !code.Ok() {
+		t.Errorf("primary lost the change: %v", code)
+	}
+	d := fs.Divergences()
+	if len(d) != 1 || d[0].Replica != 1 || d[0].Op != "Mkdir" || d[0].Names[0] != "dir" {
+		t.Errorf("divergences: %v", d)
+	}
+	if !strings.Contains(journal.String(), `replica 1: Mkdir ["dir"]`) {
+		t.Errorf("journal: %q", journal.String())
+	}
+}
+
+func TestMirrorFsRetry(t *testing.T) {
+	fs, replica, dirs, clean := setupMirrorFs(t, &MirrorOptions{
+		Policy:        MIRROR_RETRY,
+		RetryInterval: time.Hour,
+	})
+	defer clean()
+
+	id := replica.AddFault(Fault{Status: EIO})
+	fs.Mkdir("dir", 0755, nil)
+	writeMirrorFile(t, fs, "dir/file", "hello")
+	fs.Rename("dir/file", "dir/moved", nil)
+	if _, err := os.Stat(filepath.Join(dirs[1], "dir")); err == nil {
+		t.Errorf("replica changed while failing")
+	}
+	if n := fs.Pending(); n != 4 {
+		t.Errorf("pending: %d", n)
+	}
+	if n := fs.Retry(); n != 4 {
+		t.Errorf("pending after failed retry: %d", n)
+	}
+
+	replica.RemoveFault(id)
+	if n := fs.Retry(); n != 0 {
+		t.Errorf("pending after retry: %d", n)
+	}
+	checkMirrored(t, dirs, "dir/moved", "hello")
+
+	// Errors that will not go away are divergences, and the queue
+	// moves on.
+	replica.AddFault(Fault{Op: "Chmod", Status: ENOENT})
+	fs.Chmod("dir/moved", 0600, nil)
+	if d := fs.Divergences(); len(d) != 1 || d[0].Status != ENOENT {
+		t.Errorf("divergences: %v", d)
+	}
+	if n := fs.Pending(); n != 0 {
+		t.Errorf("pending: %d", n)
+	}
+}
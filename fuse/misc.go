@@ -26,6 +26,34 @@ func (code Status) String() string {
 	return fmt.Sprintf("%d=%v", int(code), syscall.Errno(code))
 }
 
+func (r UnmountReason) String() string {
+	switch r {
+	case UNMOUNT_KERNEL:
+		return "kernel"
+	case UNMOUNT_DAEMON:
+		return "daemon"
+	case UNMOUNT_ERROR:
+		return "error"
+	case UNMOUNT_SUBMOUNT:
+		return "submount"
+	case UNMOUNT_HANDOFF:
+		return "handoff"
+	}
+	return fmt.Sprintf("UnmountReason(%d)", int(r))
+}
+
+func (m UnmountMethod) String() string {
+	switch m {
+	case UNMOUNT_NORMAL:
+		return "normal"
+	case UNMOUNT_FORCE:
+		return "force"
+	case UNMOUNT_LAZY:
+		return "lazy"
+	}
+	return fmt.Sprintf("UnmountMethod(%d)", int(m))
+}
+
 func (code Status) Ok() bool {
 	return code == OK
 }
@@ -43,6 +71,8 @@ func ToStatus(err error) Status {
 		return ENOENT
 	case os.ErrInvalid:
 		return EINVAL
+	case os.ErrClosed:
+		return EBADF
 	}
 
 	switch t := err.(type) {
@@ -0,0 +1,153 @@
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// The mount helpers of macFUSE, and of its predecessor osxfuse.
+const (
+	macfuseMount = "/Library/Filesystems/macfuse.fs/Contents/Resources/mount_macfuse"
+	osxfuseMount = "/Library/Filesystems/osxfuse.fs/Contents/Resources/mount_osxfuse"
+)
+
+// Create a FUSE FS on the specified mount point.  The returned
+// mount point is always absolute.
+//
+// The helper only finishes the mount(2) once the kernel has seen
+// our reply to INIT, so it runs in the background, and its failure
+// is logged rather than returned.
+func mount(mountPoint string, options string) (f *os.File, finalMountPoint string, err error) {
+	mountPoint, err = filepath.Abs(mountPoint)
+	if err != nil {
+		return
+	}
+
+	var cmd *exec.Cmd
+	if _, statErr := os.Stat(macfuseMount); statErr == nil {
+		cmd, f, err = startMacfuse(mountPoint, options)
+	} else if _, statErr := os.Stat(osxfuseMount); statErr == nil {
+		cmd, f, err = startOsxfuse(mountPoint, options)
+	} else {
+		err = fmt.Errorf("cannot mount: neither macFUSE nor osxfuse is installed")
+	}
+	if err != nil {
+		return
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("%s %s: %v", filepath.Base(cmd.Path), mountPoint, err)
+		}
+	}()
+	finalMountPoint = mountPoint
+	return
+}
+
+// startMacfuse has mount_macfuse open the device, which it passes
+// back over a socket, like fusermount does on Linux.
+func startMacfuse(mountPoint string, options string) (cmd *exec.Cmd, f *os.File, err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "socketpair-half1")
+	remote := os.NewFile(uintptr(fds[1]), "socketpair-half2")
+	defer local.Close()
+	defer remote.Close()
+
+	cmd = helperCommand(macfuseMount, options, mountPoint)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(),
+		"_FUSE_CALL_BY_LIB=1",
+		"_FUSE_COMMFD=3",
+		"_FUSE_COMMVERS=2",
+		"_FUSE_DAEMON_PATH="+daemonPath())
+	if err = cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	// Once our half is closed, a helper that fails before
+	// sending the device ends the recvmsg.
+	remote.Close()
+	fd, err := getConnection(local)
+	if err != nil {
+		if waitErr := cmd.Wait(); waitErr != nil {
+			err = fmt.Errorf("%s: %v", filepath.Base(macfuseMount), waitErr)
+		}
+		return nil, nil, err
+	}
+	return cmd, os.NewFile(uintptr(fd), "<fuseConnection>"), nil
+}
+
+// startOsxfuse opens a free device, and passes it to mount_osxfuse.
+func startOsxfuse(mountPoint string, options string) (cmd *exec.Cmd, f *os.File, err error) {
+	for i := 0; ; i++ {
+		f, err = os.OpenFile("/dev/osxfuse"+strconv.Itoa(i), os.O_RDWR, 0)
+		if err == nil {
+			break
+		}
+		if !isBusy(err) {
+			return nil, nil, fmt.Errorf("cannot open a FUSE device: %v", err)
+		}
+	}
+
+	cmd = helperCommand(osxfuseMount, options, "3", mountPoint)
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(),
+		"MOUNT_OSXFUSE_CALL_BY_LIB=",
+		"MOUNT_OSXFUSE_DAEMON_PATH="+daemonPath())
+	if err = cmd.Start(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return cmd, f, nil
+}
+
+func isBusy(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.EBUSY
+	}
+	return false
+}
+
+func helperCommand(bin string, options string, args ...string) *exec.Cmd {
+	var cmdArgs []string
+	if options != "" {
+		cmdArgs = append(cmdArgs, "-o", options)
+	}
+	cmd := exec.Command(bin, append(cmdArgs, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// daemonPath is the program that the helper names as the daemon of
+// the mount.
+func daemonPath() string {
+	if p, err := os.Executable(); err == nil {
+		return p
+	}
+	return os.Args[0]
+}
+
+func unmount(mountPoint string) error {
+	return syscall.Unmount(mountPoint, 0)
+}
+
+// _MNT_FORCE is MNT_FORCE of <sys/mount.h>.
+const _MNT_FORCE = 0x80000
+
+func forceUnmount(mountPoint string) error {
+	return syscall.Unmount(mountPoint, _MNT_FORCE)
+}
+
+// lazyUnmount forces the unmount, as Darwin has no MNT_DETACH.
+func lazyUnmount(mountPoint string) error {
+	return forceUnmount(mountPoint)
+}
@@ -0,0 +1,172 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var fusermountBinary string
+var umountBinary string
+
+// FusermountBinary returns the path of the setuid helper that mounts
+// and unmounts for unprivileged users: fusermount3 if it is
+// installed, or else fusermount.  It is empty if neither was found,
+// in which case only root can unmount, and nobody can mount.
+func FusermountBinary() string {
+	return fusermountBinary
+}
+
+// fuse2Options are mount options that fusermount takes, and
+// fusermount3 rejects, because they are always on with FUSE 3.
+var fuse2Options = map[string]bool{
+	"nonempty": true,
+}
+
+// helperOptions returns the options to pass to the helper bin.
+func helperOptions(bin string, options string) string {
+	if filepath.Base(bin) != "fusermount3" || options == "" {
+		return options
+	}
+	var kept []string
+	for _, o := range strings.Split(options, ",") {
+		if !fuse2Options[o] {
+			kept = append(kept, o)
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
+// Create a FUSE FS on the specified mount point.  The returned
+// mount point is always absolute.
+func mount(mountPoint string, options string) (f *os.File, finalMountPoint string, err error) {
+	local, remote, err := unixgramSocketpair()
+	if err != nil {
+		return
+	}
+
+	defer local.Close()
+	defer remote.Close()
+
+	mountPoint = filepath.Clean(mountPoint)
+	if !filepath.IsAbs(mountPoint) {
+		cwd := ""
+		cwd, err = os.Getwd()
+		if err != nil {
+			return
+		}
+		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
+	}
+
+	if fusermountBinary == "" {
+		err = fmt.Errorf("cannot mount: neither fusermount3 nor fusermount was found")
+		return
+	}
+	options = helperOptions(fusermountBinary, options)
+	cmd := []string{fusermountBinary, mountPoint}
+	if options != "" {
+		cmd = append(cmd, "-o")
+		cmd = append(cmd, options)
+	}
+	proc, err := os.StartProcess(fusermountBinary,
+		cmd,
+		&os.ProcAttr{
+			Env:   []string{"_FUSE_COMMFD=3"},
+			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, remote}})
+
+	if err != nil {
+		return
+	}
+
+	w, err := proc.Wait()
+	if err != nil {
+		return
+	}
+	if !w.Success() {
+		err = fmt.Errorf("%s exited with code %v\n", filepath.Base(fusermountBinary), w.Sys())
+		return
+	}
+
+	fd, err := getConnection(local)
+	if err != nil {
+		return
+	}
+	// Reads go through the poller, so they can be interrupted for
+	// a Handoff, and closing the file wakes up the loops.
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, "", os.NewSyscallError("fcntl", err)
+	}
+	f = os.NewFile(uintptr(fd), "<fuseConnection>")
+	finalMountPoint = mountPoint
+	return
+}
+
+func privilegedUnmount(mountPoint string) error {
+	dir, _ := filepath.Split(mountPoint)
+	proc, err := os.StartProcess(umountBinary,
+		[]string{umountBinary, mountPoint},
+		&os.ProcAttr{Dir: dir, Files: []*os.File{nil, nil, os.Stderr}})
+	if err != nil {
+		return err
+	}
+	w, err := proc.Wait()
+	if !w.Success() {
+		return fmt.Errorf("umount exited with code %v\n", w.Sys())
+	}
+	return err
+}
+
+func unmount(mountPoint string) (err error) {
+	if os.Geteuid() == 0 || fusermountBinary == "" {
+		return privilegedUnmount(mountPoint)
+	}
+	return fusermountUnmount(mountPoint, "-u")
+}
+
+// lazyUnmount detaches the mount, like umount -l.
+func lazyUnmount(mountPoint string) error {
+	if os.Geteuid() == 0 || fusermountBinary == "" {
+		return os.NewSyscallError("umount2", syscall.Unmount(mountPoint, syscall.MNT_DETACH))
+	}
+	return fusermountUnmount(mountPoint, "-uz")
+}
+
+// forceUnmount aborts the connection, and unmounts if nothing else
+// keeps the mount busy.  fusermount cannot force, so this needs root.
+func forceUnmount(mountPoint string) error {
+	return os.NewSyscallError("umount2", syscall.Unmount(mountPoint, syscall.MNT_FORCE))
+}
+
+func fusermountUnmount(mountPoint string, flags string) (err error) {
+	dir, _ := filepath.Split(mountPoint)
+	proc, err := os.StartProcess(fusermountBinary,
+		[]string{fusermountBinary, flags, mountPoint},
+		&os.ProcAttr{Dir: dir, Files: []*os.File{nil, nil, os.Stderr}})
+	if err != nil {
+		return
+	}
+	w, err := proc.Wait()
+	if err != nil {
+		return
+	}
+	if !w.Success() {
+		return fmt.Errorf("%s %s exited with code %v\n", filepath.Base(fusermountBinary), flags, w.Sys())
+	}
+	return
+}
+
+func init() {
+	// Distributions that ship FUSE 3 may not have fusermount any
+	// more, so a missing helper only fails Mount.
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if bin, err := exec.LookPath(name); err == nil {
+			fusermountBinary = bin
+			break
+		}
+	}
+	umountBinary, _ = exec.LookPath("umount")
+}
@@ -0,0 +1,20 @@
+package fuse
+
+import (
+	"testing"
+)
+
+func TestHelperOptions(t *testing.T) {
+	for _, c := range []struct {
+		bin, in, want string
+	}{
+		{"/bin/fusermount", "nonempty,allow_other", "nonempty,allow_other"},
+		{"/bin/fusermount3", "nonempty,allow_other", "allow_other"},
+		{"/bin/fusermount3", "nonempty", ""},
+		{"/bin/fusermount3", "", ""},
+	} {
+		if got := helperOptions(c.bin, c.in); got != c.want {
+			t.Errorf("helperOptions(%q, %q): got %q, want %q", c.bin, c.in, got, c.want)
+		}
+	}
+}
@@ -8,6 +8,20 @@ import (
 	"time"
 )
 
+// unmountReleased unmounts the file system at path, waiting for the
+// kernel to release the files that were closed: close(2) returns
+// before the RELEASE is sent.
+func unmountReleased(fs *PathNodeFs, path string) Status {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code := fs.Unmount(path)
+		if code != EBUSY || time.Now().After(deadline) {
+			return code
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func TestMountOnExisting(t *testing.T) {
 	ts := NewTestCase(t)
 	defer ts.Cleanup()
@@ -92,11 +106,8 @@ func TestRecursiveMount(t *testing.T) {
 	}
 
 	f.Close()
-	t.Log("Waiting for kernel to flush file-close to fuse...")
-	time.Sleep(testTtl)
-
 	t.Log("Attempting unmount, should succeed")
-	code = ts.pathFs.Unmount("mnt")
+	code = unmountReleased(ts.pathFs, "mnt")
 	if code != OK {
 		t.Error("umount failed.", code)
 	}
@@ -129,9 +140,45 @@ func TestDeletedUnmount(t *testing.T) {
 	}
 
 	f.Close()
-	time.Sleep((3 * testTtl) / 2)
-	code = ts.pathFs.Unmount("mnt")
+	code = unmountReleased(ts.pathFs, "mnt")
 	if !code.Ok() {
 		t.Error("should succeed", code)
 	}
 }
+
+func TestMountSubtree(t *testing.T) {
+	ts := NewTestCase(t)
+	defer ts.Cleanup()
+
+	err := os.MkdirAll(ts.orig+"/sub/dir", 0755)
+	CheckSuccess(err)
+	err = ioutil.WriteFile(ts.orig+"/sub/dir/file", []byte("hello"), 0644)
+	CheckSuccess(err)
+
+	code := ts.pathFs.MountSubtree("view", "sub", nil)
+	if !code.Ok() {
+		t.Fatal("MountSubtree:", code)
+	}
+
+	content, err := ioutil.ReadFile(ts.mnt + "/view/dir/file")
+	CheckSuccess(err)
+	if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+
+	err = ioutil.WriteFile(ts.mnt+"/view/new", []byte("world"), 0644)
+	CheckSuccess(err)
+	content, err = ioutil.ReadFile(ts.orig + "/sub/new")
+	CheckSuccess(err)
+	if string(content) != "world" {
+		t.Errorf("got %q, want %q", content, "world")
+	}
+
+	code = unmountReleased(ts.pathFs, "view")
+	if !code.Ok() {
+		t.Fatal("Unmount:", code)
+	}
+	if _, err := os.Lstat(ts.mnt + "/view"); err == nil {
+		t.Error("view should be gone after Unmount")
+	}
+}
@@ -0,0 +1,61 @@
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestNewMountStateFd(t *testing.T) {
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+	defer local.Close()
+	fd, err := syscall.Dup(int(remote.Fd()))
+	CheckSuccess(err)
+	remote.Close()
+
+	events := make(chan string, 10)
+	c := NewFileSystemConnector(NewPathNodeFs(&unmountFs{name: "root", events: events}, nil), nil)
+	ms, err := NewMountStateFd(c, fd, "", &MountOptions{MaxWrite: 1 << 17})
+	CheckSuccess(err)
+	done := make(chan bool)
+	go func() {
+		ms.Loop()
+		done <- true
+	}()
+
+	type initRequest struct {
+		header raw.InHeader
+		in     raw.InitIn
+	}
+	input := initRequest{
+		header: raw.InHeader{Opcode: _OP_INIT, Unique: 1},
+		in:     raw.InitIn{Major: FUSE_KERNEL_VERSION, Minor: OUR_MINOR_VERSION, MaxReadAhead: 4096},
+	}
+	input.header.Length = uint32(unsafe.Sizeof(input))
+	_, err = local.Write((*[unsafe.Sizeof(input)]byte)(unsafe.Pointer(&input))[:])
+	CheckSuccess(err)
+
+	type initReply struct {
+		header raw.OutHeader
+		out    raw.InitOut
+	}
+	var reply initReply
+	n, err := local.Read((*[unsafe.Sizeof(reply)]byte)(unsafe.Pointer(&reply))[:])
+	CheckSuccess(err)
+	if n < int(unsafe.Sizeof(reply.header)) || reply.header.Unique != 1 || reply.header.Status != 0 {
+		t.Fatalf("INIT reply: %d bytes, %+v", n, reply.header)
+	}
+	if reply.out.Major != FUSE_KERNEL_VERSION || reply.out.MaxWrite != 1<<17 {
+		t.Errorf("INIT: %+v", reply.out)
+	}
+
+	// Without a mount point, Unmount closes the connection.
+	CheckSuccess(ms.Unmount())
+	<-done
+	if got := <-events; got != "root:daemon" {
+		t.Errorf("got %q, want root:daemon", got)
+	}
+}
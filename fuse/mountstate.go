@@ -4,7 +4,9 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -29,29 +31,110 @@ type MountState struct {
 	// Dump debug info onto stdout.
 	Debug bool
 
+	// If set, Logger receives a record of each operation.  It
+	// replaces the operation logging of Debug.
+	Logger OpLogger
+
 	// For efficient reads and writes.
-	buffers *BufferPoolImpl
+	buffers BufferPool
 
 	latencies *LatencyMap
+	sizes     *SizeHistogram
+
+	opts               *MountOptions
+	kernelSettings     raw.InitIn
+	negotiatedSettings raw.InitOut
+
+	// Set if we serve a CUSE device rather than a mount.
+	cuseOptions *CuseOptions
 
-	opts           *MountOptions
-	kernelSettings raw.InitIn
+	// Set if someone else mounted the file system, and did not
+	// say where, so Unmount can only close the connection.
+	unmountByClose bool
 
 	// Number of loops blocked on reading; used to control amount
 	// of concurrency.
 	readers int32
+
+	// Held for reading by mutating operations, and for writing
+	// while the file system is frozen.
+	freezeLock sync.RWMutex
+
+	// Held for reading while a request is served, and for
+	// writing during a Pause.  paused is set during a Pause.
+	pauseLock      sync.RWMutex
+	paused         int32
+	pauseStatsLock sync.Mutex
+	pauseStats     PauseStats
+
+	// Guards notifyNodes, byUnique and request.notifies.  It is
+	// never held while writing to the kernel.
+	notifyLock sync.Mutex
+	// The requests in flight and the queued notifications, by
+	// node ID.
+	notifyNodes map[uint64]*nodeNotify
+	// The requests in flight by unique ID, for interrupts.
+	byUnique map[uint64]*request
+
+	// Counts the goroutines running loop, so Loop can wait for
+	// the requests they serve.
+	loops sync.WaitGroup
+
+	// Set when Loop starts, and by Unmount.  Accessed atomically.
+	looping    int32
+	unmounting int32
+
+	// Why reading stopped; set once, by the first loop to stop.
+	stopOnce   sync.Once
+	stopReason UnmountReason
+
+	// Closed when Loop returns.
+	loopDone chan struct{}
+
+	// Set while Handoff waits for the loops to stop.
+	handoffLock sync.Mutex
+	handoff     *handoffRequest
+
+	// Pipes for splicing replies, and their protection.
+	pipesLock sync.Mutex
+	pipes     []*pipePair
+}
+
+// pendingNotify is a notification that waits for the replies to the
+// requests on its node that were in flight when it was issued.
+type pendingNotify struct {
+	req     *request
+	waiting int
+}
+
+// nodeNotify orders the notifications for a node after the replies
+// to the requests on that node.
+type nodeNotify struct {
+	requests map[*request]bool
+	queue    []*pendingNotify
+
+	// Set while a goroutine writes from queue, so the
+	// notifications reach the kernel in the order they were
+	// issued.
+	writing bool
 }
 
 func (ms *MountState) KernelSettings() raw.InitIn {
 	return ms.kernelSettings
 }
 
+// NegotiatedSettings returns the result of the INIT handshake: the
+// protocol version in use, the capability flags enabled on both
+// sides, the readahead and the maximum write size.
+func (ms *MountState) NegotiatedSettings() raw.InitOut {
+	return ms.negotiatedSettings
+}
+
 func (ms *MountState) MountPoint() string {
 	return ms.mountPoint
 }
 
-// Mount filesystem on mountPoint.
-func (ms *MountState) Mount(mountPoint string, opts *MountOptions) error {
+func (ms *MountState) setOptions(opts *MountOptions) {
 	if opts == nil {
 		opts = &MountOptions{
 			MaxBackground: _DEFAULT_BACKGROUND_TASKS,
@@ -67,18 +150,62 @@ func (ms *MountState) Mount(mountPoint string, opts *MountOptions) error {
 	if o.MaxWrite > MAX_KERNEL_WRITE {
 		o.MaxWrite = MAX_KERNEL_WRITE
 	}
-	opts = &o
+	if o.MaxReaders <= 0 {
+		o.MaxReaders = _MAX_READERS
+	}
+	if o.Buffers != nil {
+		ms.buffers = o.Buffers
+		if p, ok := o.Buffers.(*BufferPoolImpl); ok {
+			p.addMount()
+		}
+	}
 	ms.opts = &o
+}
+
+// Mount filesystem on mountPoint.
+func (ms *MountState) Mount(mountPoint string, opts *MountOptions) error {
+	ms.setOptions(opts)
+	opts = ms.opts
 
 	optStrs := opts.Options
 	if opts.AllowOther {
 		optStrs = append(optStrs, "allow_other")
 	}
+	if ro, ok := ms.fileSystem.(readOnlyFs); ok && ro.readOnly() {
+		optStrs = append(optStrs, "ro")
+	}
 
 	file, mp, err := mount(mountPoint, strings.Join(optStrs, ","))
 	if err != nil {
 		return err
 	}
+	ms.init(file, mp)
+	return nil
+}
+
+// NewMountStateFd returns a MountState that serves fs on fd, a
+// /dev/fuse descriptor that was opened and mounted by someone else,
+// eg. passed on by fusermount, or by a container runtime that set up
+// the mount namespace.  The MountState owns fd from then on.
+// mountPoint is only used by Unmount and MountPoint.  If it is
+// empty, Unmount closes fd, which aborts the connection, and the
+// mount must be removed by whoever made it.
+func NewMountStateFd(fs RawFileSystem, fd int, mountPoint string, opts *MountOptions) (*MountState, error) {
+	// Non-blocking reads go through the poller, so closing the
+	// file in Unmount wakes up the loops.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return nil, os.NewSyscallError("fcntl", err)
+	}
+
+	ms := NewMountState(fs)
+	ms.setOptions(opts)
+	ms.unmountByClose = mountPoint == ""
+	ms.init(os.NewFile(uintptr(fd), "/dev/fuse"), mountPoint)
+	return ms, nil
+}
+
+// init sets up serving the mount on file.
+func (ms *MountState) init(file *os.File, mountPoint string) {
 	initParams := RawFsInit{
 		InodeNotify: func(n *raw.NotifyInvalInodeOut) Status {
 			return ms.writeInodeNotify(n)
@@ -86,40 +213,141 @@ func (ms *MountState) Mount(mountPoint string, opts *MountOptions) error {
 		EntryNotify: func(parent uint64, n string) Status {
 			return ms.writeEntryNotify(parent, n)
 		},
+		KernelSettings:     ms.KernelSettings,
+		NegotiatedSettings: ms.NegotiatedSettings,
+		Interrupted:        ms.interrupted,
 	}
 	ms.fileSystem.Init(&initParams)
-	ms.mountPoint = mp
+	ms.mountPoint = mountPoint
 	ms.mountFile = file
-	return nil
 }
 
 func (ms *MountState) SetRecordStatistics(record bool) {
 	if record {
 		ms.latencies = NewLatencyMap()
+		ms.sizes = NewSizeHistogram()
 	} else {
 		ms.latencies = nil
+		ms.sizes = nil
 	}
 }
 
+// Unmount unmounts the file system.  If Loop is running, it waits
+// until Loop has called OnUnmount and returned, so it must not be
+// called while serving a request.
 func (ms *MountState) Unmount() (err error) {
+	_, err = ms.UnmountWithOptions(nil)
+	return err
+}
+
+// UnmountWithOptions is Unmount, with a choice of what to do if the
+// mount is busy.  It returns how the mount was removed.  After a
+// lazy unmount, it does not wait for Loop, which returns once the
+// kernel closes the connection.
+func (ms *MountState) UnmountWithOptions(opts *UnmountOptions) (UnmountMethod, error) {
+	method, err := ms.detach(opts)
+	if err != nil {
+		return method, err
+	}
+	if method != UNMOUNT_LAZY {
+		ms.waitLoop()
+	}
+	return method, nil
+}
+
+// detach removes the mount, or closes the connection if we cannot
+// unmount ourselves, after which the loops stop reading.
+func (ms *MountState) detach(opts *UnmountOptions) (method UnmountMethod, err error) {
+	if ms.cuseOptions != nil || ms.unmountByClose {
+		atomic.StoreInt32(&ms.unmounting, 1)
+		return UNMOUNT_NORMAL, ms.mountFile.Close()
+	}
 	if ms.mountPoint == "" {
-		return nil
+		return UNMOUNT_NORMAL, nil
 	}
+
+	o := UnmountOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	switch {
+	case o.Retries == 0:
+		o.Retries = 5
+	case o.Retries < 0:
+		o.Retries = 0
+	}
+	if o.RetryDelay == 0 {
+		o.RetryDelay = 5 * time.Millisecond
+	}
+
+	atomic.StoreInt32(&ms.unmounting, 1)
 	delay := time.Duration(0)
-	for try := 0; try < 5; try++ {
+	for try := 0; try < 1+o.Retries; try++ {
+		if try > 0 {
+			// Sleep for a bit. This is not pretty, but there
+			// is no way we can be certain that the kernel
+			// thinks all open files have already been closed.
+			delay = 2*delay + o.RetryDelay
+			time.Sleep(delay)
+		}
 		err = unmount(ms.mountPoint)
 		if err == nil {
 			break
 		}
-
-		// Sleep for a bit. This is not pretty, but there is
-		// no way we can be certain that the kernel thinks all
-		// open files have already been closed.
-		delay = 2*delay + 5*time.Millisecond
-		time.Sleep(delay)
+	}
+	if err != nil && o.Force {
+		method = UNMOUNT_FORCE
+		if err = forceUnmount(ms.mountPoint); err != nil {
+			log.Printf("Forced unmount of %s failed: %v", ms.mountPoint, err)
+		}
+	}
+	if err != nil && o.Lazy {
+		method = UNMOUNT_LAZY
+		err = lazyUnmount(ms.mountPoint)
+	}
+	if err != nil {
+		atomic.StoreInt32(&ms.unmounting, 0)
+		return method, err
 	}
 	ms.mountPoint = ""
-	return err
+	return method, nil
+}
+
+// fd returns the descriptor of the connection.  Unlike File.Fd, it
+// leaves a non-blocking file in non-blocking mode.
+func (ms *MountState) fd() int {
+	fd := -1
+	if rc, err := ms.mountFile.SyscallConn(); err == nil {
+		rc.Control(func(s uintptr) { fd = int(s) })
+	}
+	return fd
+}
+
+// waitLoop waits for Loop to return, if it is running.
+func (ms *MountState) waitLoop() {
+	if atomic.LoadInt32(&ms.looping) != 0 {
+		<-ms.loopDone
+	}
+}
+
+// Freeze blocks new mutating operations, waits for the ones in
+// flight to finish and calls SyncFs on all file systems.  When it
+// returns OK, the backing store can be snapshotted consistently.
+// Read-only operations continue to be served.  Every Freeze must be
+// followed by a Thaw, also if the sync failed.
+func (ms *MountState) Freeze() Status {
+	ms.freezeLock.Lock()
+	code := ms.fileSystem.SyncFs(&raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, &raw.SyncFsIn{})
+	if code == ENOSYS {
+		// Nothing is buffered in the file system.
+		code = OK
+	}
+	return code
+}
+
+// Thaw lets mutating operations held back by Freeze proceed.
+func (ms *MountState) Thaw() {
+	ms.freezeLock.Unlock()
 }
 
 func NewMountState(fs RawFileSystem) *MountState {
@@ -127,6 +355,9 @@ func NewMountState(fs RawFileSystem) *MountState {
 	ms.mountPoint = ""
 	ms.fileSystem = fs
 	ms.buffers = NewBufferPool()
+	ms.notifyNodes = make(map[uint64]*nodeNotify)
+	ms.byUnique = make(map[uint64]*request)
+	ms.loopDone = make(chan struct{})
 	return ms
 }
 
@@ -144,6 +375,12 @@ func (ms *MountState) OperationCounts() map[string]int {
 	return ms.latencies.Counts()
 }
 
+// RequestSizes returns the histogram of READ, WRITE and READDIR
+// sizes, recorded if statistics are enabled.
+func (ms *MountState) RequestSizes() *SizeHistogram {
+	return ms.sizes
+}
+
 func (ms *MountState) BufferPoolStats() string {
 	return ms.buffers.String()
 }
@@ -166,27 +403,67 @@ func (ms *MountState) recordStats(req *request) {
 				{opname, "", dt},
 				{opname + "-write", "", endNs - req.preWriteNs}})
 	}
+	if ms.sizes != nil && req.inData != nil {
+		switch req.inHeader.Opcode {
+		case _OP_READ, _OP_READDIR:
+			ms.sizes.Add(operationName(req.inHeader.Opcode), (*ReadIn)(req.inData).Size)
+		case _OP_WRITE:
+			ms.sizes.Add("WRITE", (*WriteIn)(req.inData).Size)
+		}
+	}
 }
 
 // Loop initiates the FUSE loop. Normally, callers should run Loop()
 // and wait for it to exit, but tests will want to run this in a
 // goroutine.
 //
-// Each filesystem operation executes in a separate goroutine.
+// Each filesystem operation executes in a separate goroutine.  When
+// the connection is closed, Loop waits for all operations to finish,
+// calls OnUnmount on the file system, and returns.  After a Handoff,
+// it does the same, but the mount lives on in the receiving process.
 func (ms *MountState) Loop() {
-	ms.loop()
+	atomic.StoreInt32(&ms.looping, 1)
+	for {
+		ms.loops.Add(1)
+		ms.loop()
+		ms.loops.Wait()
+		if ms.pendingHandoff() == nil || ms.finishHandoff() {
+			break
+		}
+	}
 	ms.mountFile.Close()
+	ms.closePipes()
+	ms.fileSystem.OnUnmount(ms.stopReason)
+	close(ms.loopDone)
+}
+
+// stop records why reading from the kernel stopped.
+func (ms *MountState) stop(errNo Status) {
+	ms.stopOnce.Do(func() {
+		switch {
+		case atomic.LoadInt32(&ms.unmounting) != 0:
+			ms.stopReason = UNMOUNT_DAEMON
+		case errNo == ENODEV:
+			ms.stopReason = UNMOUNT_KERNEL
+		default:
+			log.Printf("Failed to read from fuse conn: %v", errNo)
+			ms.stopReason = UNMOUNT_ERROR
+			// Unblock the other loops.
+			ms.mountFile.Close()
+		}
+	})
 }
 
 const _MAX_READERS = 10
 func (ms *MountState) loop() {
+	defer ms.loops.Done()
 	var dest []byte
 	var req *request
 	for {
 		if dest == nil {
 			dest = ms.buffers.AllocBuffer(uint32(ms.opts.MaxWrite + 4096))
 		}
-		if atomic.AddInt32(&ms.readers, 0) > _MAX_READERS {
+		if atomic.AddInt32(&ms.readers, 0) > int32(ms.opts.MaxReaders) {
 			break
 		}
 
@@ -194,6 +471,10 @@ func (ms *MountState) loop() {
 		n, err := ms.mountFile.Read(dest)
 		readers := atomic.AddInt32(&ms.readers, -1)
 		if err != nil {
+			if ms.pendingHandoff() != nil {
+				// Handoff interrupted the read.
+				break
+			}
 			errNo := ToStatus(err)
 		
 			// Retry.
@@ -201,23 +482,21 @@ func (ms *MountState) loop() {
 				continue
 			}
 
-			// Unmount.
-			if errNo == ENODEV {
-				break
-			}
-
-			log.Printf("Failed to read from fuse conn: %v", errNo)
+			ms.stop(errNo)
 			break
 		}
 		
+		// Don't start more readers while paused.
+		done := ms.waitPause()
 		if readers <= 0 {
+			ms.loops.Add(1)
 			go ms.loop()
 		}
 
 		if req == nil {
 			req = ms.newRequest()
 		}
-		if ms.latencies != nil {
+		if ms.latencies != nil || ms.opLogger() != nil {
 			req.startNs = time.Now().UnixNano()
 		}
 		if req.setInput(dest[:n]) {
@@ -225,6 +504,7 @@ func (ms *MountState) loop() {
 		}
 
 		ms.handleRequest(req)
+		done()
 		req.clear()
 	}
 
@@ -240,24 +520,181 @@ func (ms *MountState) handleRequest(req *request) {
 		req.status = ENOSYS
 	}
 
-	if req.status.Ok() && ms.Debug {
-		log.Println(req.InputDebug())
-	}
-
 	if req.status.Ok() && req.handler.Func == nil {
 		log.Printf("Unimplemented opcode %v", operationName(req.inHeader.Opcode))
 		req.status = ENOSYS
 	}
 
+	if req.status.Ok() && req.handler.Mutating {
+		ms.freezeLock.RLock()
+		defer ms.freezeLock.RUnlock()
+	}
+	ms.startRequest(req)
 	if req.status.Ok() {
 		req.handler.Func(ms, req)
 	}
 
-	errNo := ms.write(req)
+	errNo := ms.finishRequest(req)
 	if errNo != 0 {
 		log.Printf("writer: Write/Writev failed, err: %v. opcode: %v",
 			errNo, operationName(req.inHeader.Opcode))
 	}
+	if l := ms.opLogger(); l != nil && req.inHeader != nil {
+		l.LogOp(req.opLog())
+	}
+}
+
+// requestNodes returns the nodes of req whose notifications must
+// wait for its reply: the ones the kernel may hold locked.
+func requestNodes(req *request) []uint64 {
+	nodes := []uint64{req.inHeader.NodeId}
+	switch req.inHeader.Opcode {
+	case _OP_RENAME:
+		nodes = append(nodes, (*raw.RenameIn)(req.inData).Newdir)
+	case _OP_LINK:
+		nodes = append(nodes, (*raw.LinkIn)(req.inData).Oldnodeid)
+	}
+	return nodes
+}
+
+// startRequest registers req as in flight: notifications for its
+// nodes issued from now on are written after its reply.
+func (ms *MountState) startRequest(req *request) {
+	if req.inHeader == nil || !req.status.Ok() {
+		return
+	}
+	switch req.inHeader.Opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT:
+		return
+	}
+	ms.notifyLock.Lock()
+	ms.byUnique[req.inHeader.Unique] = req
+	for _, node := range requestNodes(req) {
+		nn := ms.notifyNodes[node]
+		if nn == nil {
+			nn = &nodeNotify{requests: map[*request]bool{}}
+			ms.notifyNodes[node] = nn
+		}
+		nn.requests[req] = true
+	}
+	ms.notifyLock.Unlock()
+}
+
+// finishRequest writes the reply to req, and then the notifications
+// that were only waiting for it.
+func (ms *MountState) finishRequest(req *request) Status {
+	errNo := ms.write(req)
+
+	ms.notifyLock.Lock()
+	if ms.byUnique[req.inHeader.Unique] != req {
+		ms.notifyLock.Unlock()
+		return errNo
+	}
+	delete(ms.byUnique, req.inHeader.Unique)
+	for _, n := range req.notifies {
+		n.waiting--
+	}
+	req.notifies = nil
+	var flush []uint64
+	for _, node := range requestNodes(req) {
+		nn := ms.notifyNodes[node]
+		if nn == nil {
+			continue
+		}
+		delete(nn.requests, req)
+		if len(nn.queue) > 0 {
+			flush = append(flush, node)
+		} else {
+			ms.dropNodeNotify(node, nn)
+		}
+	}
+	ms.notifyLock.Unlock()
+
+	for _, node := range flush {
+		ms.flushNode(node)
+	}
+	return errNo
+}
+
+// dropNodeNotify forgets nn once it has nothing to order.  The
+// notifyLock must be held.
+func (ms *MountState) dropNodeNotify(node uint64, nn *nodeNotify) {
+	if len(nn.requests) == 0 && len(nn.queue) == 0 && !nn.writing {
+		delete(ms.notifyNodes, node)
+	}
+}
+
+// flushNotify writes the queued notifications that no longer wait
+// for any reply.
+func (ms *MountState) flushNotify() {
+	ms.notifyLock.Lock()
+	var nodes []uint64
+	for node, nn := range ms.notifyNodes {
+		if len(nn.queue) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	ms.notifyLock.Unlock()
+	for _, node := range nodes {
+		ms.flushNode(node)
+	}
+}
+
+// flushNode writes the notifications at the head of the queue of
+// node that no longer wait for any reply.  There is no caller left
+// to return an error to, so failures are logged.
+func (ms *MountState) flushNode(node uint64) {
+	ms.notifyLock.Lock()
+	defer ms.notifyLock.Unlock()
+	nn := ms.notifyNodes[node]
+	if nn == nil || nn.writing {
+		return
+	}
+	nn.writing = true
+	for len(nn.queue) > 0 && nn.queue[0].waiting == 0 && atomic.LoadInt32(&ms.paused) == 0 {
+		n := nn.queue[0]
+		nn.queue = nn.queue[1:]
+		ms.notifyLock.Unlock()
+		code := ms.write(n.req)
+		ms.logNotify(n.req, code)
+		if !code.Ok() {
+			log.Printf("writer: queued %v for node %d failed: %v",
+				operationName(n.req.inHeader.Opcode), node, code)
+		}
+		ms.notifyLock.Lock()
+	}
+	nn.writing = false
+	ms.dropNodeNotify(node, nn)
+}
+
+// notify writes the notification req for node.  If requests on node
+// are in flight, the kernel may still be waiting for a reply that
+// the notification logically follows, eg. the CREATE reply for an
+// EntryNotify issued by Create; writing the notification first
+// confuses the kernel's caches, or deadlocks on the directory.  In
+// that case, req is queued until those replies are written, OK is
+// returned, and a failure to write it is logged.  Notifications
+// issued during a Pause are queued until it ends.
+func (ms *MountState) notify(req *request, node uint64) Status {
+	ms.notifyLock.Lock()
+	nn := ms.notifyNodes[node]
+	paused := atomic.LoadInt32(&ms.paused) != 0
+	if !paused && (nn == nil || (len(nn.requests) == 0 && len(nn.queue) == 0 && !nn.writing)) {
+		ms.notifyLock.Unlock()
+		return ms.write(req)
+	}
+	if nn == nil {
+		nn = &nodeNotify{requests: map[*request]bool{}}
+		ms.notifyNodes[node] = nn
+	}
+	n := &pendingNotify{req: req}
+	for r := range nn.requests {
+		r.notifies = append(r.notifies, n)
+		n.waiting++
+	}
+	nn.queue = append(nn.queue, n)
+	ms.notifyLock.Unlock()
+	return OK
 }
 
 func (ms *MountState) write(req *request) Status {
@@ -265,11 +702,12 @@ func (ms *MountState) write(req *request) Status {
 	if req.inHeader.Opcode == _OP_FORGET || req.inHeader.Opcode == _OP_BATCH_FORGET {
 		return OK
 	}
+	// Interrupts are only answered to be retried.
+	if req.inHeader.Opcode == _OP_INTERRUPT && req.status != EAGAIN {
+		return OK
+	}
 
 	header, data := req.serialize()
-	if ms.Debug {
-		log.Println(req.OutputDebug())
-	}
 
 	if ms.latencies != nil {
 		req.preWriteNs = time.Now().UnixNano()
@@ -278,35 +716,39 @@ func (ms *MountState) write(req *request) Status {
 	if header == nil {
 		return OK
 	}
+	if req.fdData != nil && req.status.Ok() {
+		return ms.writeFd(header, req)
+	}
+
 	var err error
 	if data == nil {
 		_, err = ms.mountFile.Write(header)
 	} else {
-		_, err = Writev(int(ms.mountFile.Fd()), [][]byte{header, data})
+		_, err = Writev(ms.fd(), [][]byte{header, data})
 	}
 
 	return ToStatus(err)
 }
 
 func (ms *MountState) writeInodeNotify(entry *raw.NotifyInvalInodeOut) Status {
-	req := request{
+	req := &request{
 		inHeader: &raw.InHeader{
 			Opcode: _OP_NOTIFY_INODE,
 		},
 		handler: operationHandlers[_OP_NOTIFY_INODE],
 		status:  raw.NOTIFY_INVAL_INODE,
 	}
-	req.outData = unsafe.Pointer(entry)
-	result := ms.write(&req)
-
-	if ms.Debug {
-		log.Println("Response: INODE_NOTIFY", result)
-	}
+	// The notification may be queued, so don't hang on to the
+	// caller's struct.
+	out := *entry
+	req.outData = unsafe.Pointer(&out)
+	result := ms.notify(req, entry.Ino)
+	ms.logNotify(req, result)
 	return result
 }
 
 func (ms *MountState) writeEntryNotify(parent uint64, name string) Status {
-	req := request{
+	req := &request{
 		inHeader: &raw.InHeader{
 			Opcode: _OP_NOTIFY_ENTRY,
 		},
@@ -323,10 +765,29 @@ func (ms *MountState) writeEntryNotify(parent uint64, name string) Status {
 	nameBytes := []byte(name + "\000")
 	req.outData = unsafe.Pointer(entry)
 	req.flatData = nameBytes
-	result := ms.write(&req)
+	result := ms.notify(req, parent)
+	ms.logNotify(req, result)
+	return result
+}
 
-	if ms.Debug {
-		log.Printf("Response: ENTRY_NOTIFY: %v", result)
+// logNotify logs the notification req, which was written, or queued,
+// with the given result.
+func (ms *MountState) logNotify(req *request, result Status) {
+	l := ms.opLogger()
+	if l == nil {
+		return
 	}
-	return result
+	op := &OpLog{
+		Op:     operationName(req.inHeader.Opcode),
+		Status: result,
+	}
+	switch out := req.handler.DecodeOut(req.outData).(type) {
+	case *raw.NotifyInvalInodeOut:
+		op.NodeId = out.Ino
+		op.Input = out
+	case *raw.NotifyInvalEntryOut:
+		op.NodeId = out.Parent
+		op.Names = []string{strings.TrimRight(string(req.flatData), "\x00")}
+	}
+	l.LogOp(op)
 }
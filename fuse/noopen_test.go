@@ -0,0 +1,65 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestNoOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+
+	content := "hello"
+	err = ioutil.WriteFile(dir+"/orig/file.txt", []byte(content), 0644)
+	CheckSuccess(err)
+
+	opts := NewFileSystemOptions()
+	opts.NoOpen = true
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir+"/orig"), nil)
+	state, conn, err := MountNodeFileSystem(dir+"/mnt", pfs, opts)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	conn.Debug = VerboseTest()
+	state.SetRecordStatistics(true)
+	go state.Loop()
+	defer state.Unmount()
+
+	for i := 0; i < 2; i++ {
+		c, err := ioutil.ReadFile(dir + "/mnt/file.txt")
+		CheckSuccess(err)
+		if string(c) != content {
+			t.Fatalf("got %q, want %q", c, content)
+		}
+	}
+	names, err := ioutil.ReadDir(dir + "/mnt")
+	CheckSuccess(err)
+	if len(names) != 1 || names[0].Name() != "file.txt" {
+		t.Fatalf("unexpected directory listing: %v", names)
+	}
+	names, err = ioutil.ReadDir(dir + "/mnt")
+	CheckSuccess(err)
+	if len(names) != 1 {
+		t.Fatalf("unexpected directory listing: %v", names)
+	}
+
+	if state.KernelSettings().Flags&raw.CAP_NO_OPEN_SUPPORT == 0 {
+		t.Log("Kernel does not support FUSE_NO_OPEN_SUPPORT; skipping.")
+		return
+	}
+	counts := state.OperationCounts()
+	if counts["OPEN"] > 1 || counts["RELEASE"] > 0 {
+		t.Errorf("got %d OPEN and %d RELEASE, want at most 1 OPEN and no RELEASE",
+			counts["OPEN"], counts["RELEASE"])
+	}
+	if state.KernelSettings().Flags&raw.CAP_NO_OPENDIR_SUPPORT != 0 &&
+		(counts["OPENDIR"] > 1 || counts["RELEASEDIR"] > 0) {
+		t.Errorf("got %d OPENDIR and %d RELEASEDIR, want at most 1 OPENDIR and no RELEASEDIR",
+			counts["OPENDIR"], counts["RELEASEDIR"])
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
 )
 
 var _ = log.Println
@@ -130,3 +134,105 @@ func TestEntryNotify(t *testing.T) {
 	fi, err := os.Lstat(fn)
 	CheckSuccess(err)
 }
+
+// createNotifyFs issues an EntryNotify for every file it creates,
+// before the CREATE reply is written.
+type createNotifyFs struct {
+	FileSystem
+	pathFs *PathNodeFs
+}
+
+func (fs *createNotifyFs) Create(name string, flags uint32, mode uint32, context *Context) (File, Status) {
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	if code.Ok() {
+		fs.pathFs.EntryNotify("", name)
+	}
+	return f, code
+}
+
+func TestEntryNotifyDuringCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+
+	fs := &createNotifyFs{FileSystem: NewLoopbackFileSystem(dir + "/orig")}
+	fs.pathFs = NewPathNodeFs(fs, nil)
+	state, _, err := MountNodeFileSystem(dir+"/mnt", fs.pathFs, nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ioutil.WriteFile(dir+"/mnt/file", []byte("hello"), 0644)
+	}()
+	select {
+	case err := <-done:
+		CheckSuccess(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Create hangs: notification was written before the reply")
+	}
+
+	fi, err := os.Lstat(dir + "/mnt/file")
+	CheckSuccess(err)
+	if fi.Size() != 5 {
+		t.Errorf("got size %d, want 5", fi.Size())
+	}
+}
+
+// readOut reads the header of a message to the kernel.
+func readOut(f *os.File) raw.OutHeader {
+	buf := make([]byte, 4096)
+	n, err := f.Read(buf)
+	CheckSuccess(err)
+	if n < int(unsafe.Sizeof(raw.OutHeader{})) {
+		panic("short message")
+	}
+	return *(*raw.OutHeader)(unsafe.Pointer(&buf[0]))
+}
+
+// Notifications wait for the replies to requests on their node only.
+func TestNotifyWaitsForNode(t *testing.T) {
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+	defer local.Close()
+	defer remote.Close()
+	ms := NewMountState(&DefaultRawFileSystem{})
+	ms.setOptions(nil)
+	ms.mountFile = remote
+
+	create := &request{
+		inHeader: &raw.InHeader{Opcode: _OP_MKNOD, Unique: 1, NodeId: 5},
+		handler:  getHandler(_OP_MKNOD),
+	}
+	ms.startRequest(create)
+
+	if code := ms.writeEntryNotify(7, "other"); !code.Ok() {
+		t.Fatalf("EntryNotify on another node: %v", code)
+	}
+	if out := readOut(local); out.Unique != 0 {
+		t.Fatalf("got reply %d, want the notification for node 7", out.Unique)
+	}
+
+	if code := ms.writeEntryNotify(5, "new"); !code.Ok() {
+		t.Fatalf("EntryNotify: %v", code)
+	}
+	create.status = Status(syscall.EEXIST)
+	if code := ms.finishRequest(create); !code.Ok() {
+		t.Fatalf("reply: %v", code)
+	}
+	if out := readOut(local); out.Unique != 1 {
+		t.Errorf("got message %d first, want the reply", out.Unique)
+	}
+	if out := readOut(local); out.Unique != 0 {
+		t.Errorf("got message %d second, want the notification", out.Unique)
+	}
+	ms.notifyLock.Lock()
+	defer ms.notifyLock.Unlock()
+	if len(ms.notifyNodes) != 0 || len(ms.byUnique) != 0 {
+		t.Errorf("state left behind: %v, %v", ms.notifyNodes, ms.byUnique)
+	}
+}
@@ -0,0 +1,84 @@
+package fuse
+
+import (
+	"sync"
+	"time"
+)
+
+type entryNotifyKey struct {
+	dir  *Inode
+	name string
+}
+
+// entryNotifyQueue sends the entry notifications of EntryNotifyMany
+// from a goroutine of its own, at most one per interval.
+type entryNotifyQueue struct {
+	connector *FileSystemConnector
+	interval  time.Duration
+
+	mu      sync.Mutex
+	pending map[entryNotifyKey]bool
+	queue   []entryNotifyKey
+	running bool
+}
+
+func newEntryNotifyQueue(c *FileSystemConnector, rate int) *entryNotifyQueue {
+	if rate <= 0 {
+		rate = _DEFAULT_NOTIFY_RATE
+	}
+	return &entryNotifyQueue{
+		connector: c,
+		interval:  time.Second / time.Duration(rate),
+		pending:   map[entryNotifyKey]bool{},
+	}
+}
+
+// add queues notifications for names in dir.  Names that are
+// already queued are not queued again.
+func (q *entryNotifyQueue) add(dir *Inode, names []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, name := range names {
+		k := entryNotifyKey{dir, name}
+		if q.pending[k] {
+			continue
+		}
+		q.pending[k] = true
+		q.queue = append(q.queue, k)
+	}
+	if !q.running && len(q.queue) > 0 {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *entryNotifyQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.queue) == 0 {
+			q.running = false
+			q.queue = nil
+			q.mu.Unlock()
+			return
+		}
+		k := q.queue[0]
+		q.queue = q.queue[1:]
+		delete(q.pending, k)
+		q.mu.Unlock()
+
+		q.connector.EntryNotify(k.dir, k.name)
+		time.Sleep(q.interval)
+	}
+}
+
+// EntryNotifyMany asks the kernel to drop the entries for names in
+// dir, like EntryNotify.  It returns immediately: the notifications
+// are sent from a separate goroutine, at most
+// FileSystemOptions.NotifyRate per second, and names that are still
+// waiting to be sent are not sent twice.  Since the kernel may hold
+// the directory locked while it waits for a request to finish,
+// calling EntryNotify from a file system callback can deadlock, but
+// EntryNotifyMany can be used there.
+func (c *FileSystemConnector) EntryNotifyMany(dir *Inode, names []string) {
+	c.entryNotifies.add(dir, names)
+}
@@ -0,0 +1,51 @@
+package fuse
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestEntryNotifyMany(t *testing.T) {
+	opts := NewFileSystemOptions()
+	opts.NotifyRate = 100
+	c := NewFileSystemConnector(NewPathNodeFs(&DefaultFileSystem{}, nil), opts)
+	block := make(chan bool)
+	notified := make(chan string, 20)
+	c.Init(&RawFsInit{
+		EntryNotify: func(parent uint64, name string) Status {
+			<-block
+			if parent != raw.FUSE_ROOT_ID {
+				t.Errorf("notify %q: parent %d", name, parent)
+			}
+			notified <- name
+			return OK
+		},
+	})
+
+	// The first notification is held up, so the rest are still
+	// queued when they are added again.
+	var names []string
+	for i := 0; i < 5; i++ {
+		names = append(names, fmt.Sprintf("file%d", i))
+	}
+	c.EntryNotifyMany(c.rootNode, names)
+	c.EntryNotifyMany(c.rootNode, names[1:])
+
+	start := time.Now()
+	close(block)
+	for _, want := range names {
+		if got := <-notified; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if d := time.Now().Sub(start); d < 40*time.Millisecond {
+		t.Errorf("5 notifications took %v, want at least 40ms", d)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(notified) != 0 {
+		t.Errorf("duplicate notifications: %d", len(notified))
+	}
+}
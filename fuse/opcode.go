@@ -14,63 +14,68 @@ var _ = log.Printf
 var _ = fmt.Printf
 
 const (
-	_OP_LOOKUP       = int32(1)
-	_OP_FORGET       = int32(2)
-	_OP_GETATTR      = int32(3)
-	_OP_SETATTR      = int32(4)
-	_OP_READLINK     = int32(5)
-	_OP_SYMLINK      = int32(6)
-	_OP_MKNOD        = int32(8)
-	_OP_MKDIR        = int32(9)
-	_OP_UNLINK       = int32(10)
-	_OP_RMDIR        = int32(11)
-	_OP_RENAME       = int32(12)
-	_OP_LINK         = int32(13)
-	_OP_OPEN         = int32(14)
-	_OP_READ         = int32(15)
-	_OP_WRITE        = int32(16)
-	_OP_STATFS       = int32(17)
-	_OP_RELEASE      = int32(18)
-	_OP_FSYNC        = int32(20)
-	_OP_SETXATTR     = int32(21)
-	_OP_GETXATTR     = int32(22)
-	_OP_LISTXATTR    = int32(23)
-	_OP_REMOVEXATTR  = int32(24)
-	_OP_FLUSH        = int32(25)
-	_OP_INIT         = int32(26)
-	_OP_OPENDIR      = int32(27)
-	_OP_READDIR      = int32(28)
-	_OP_RELEASEDIR   = int32(29)
-	_OP_FSYNCDIR     = int32(30)
-	_OP_GETLK        = int32(31)
-	_OP_SETLK        = int32(32)
-	_OP_SETLKW       = int32(33)
-	_OP_ACCESS       = int32(34)
-	_OP_CREATE       = int32(35)
-	_OP_INTERRUPT    = int32(36)
-	_OP_BMAP         = int32(37)
-	_OP_DESTROY      = int32(38)
-	_OP_IOCTL        = int32(39)
-	_OP_POLL         = int32(40)
-	_OP_NOTIFY_REPLY = int32(41)
-	_OP_BATCH_FORGET = int32(42)
+	_OP_LOOKUP          = int32(1)
+	_OP_FORGET          = int32(2)
+	_OP_GETATTR         = int32(3)
+	_OP_SETATTR         = int32(4)
+	_OP_READLINK        = int32(5)
+	_OP_SYMLINK         = int32(6)
+	_OP_MKNOD           = int32(8)
+	_OP_MKDIR           = int32(9)
+	_OP_UNLINK          = int32(10)
+	_OP_RMDIR           = int32(11)
+	_OP_RENAME          = int32(12)
+	_OP_LINK            = int32(13)
+	_OP_OPEN            = int32(14)
+	_OP_READ            = int32(15)
+	_OP_WRITE           = int32(16)
+	_OP_STATFS          = int32(17)
+	_OP_RELEASE         = int32(18)
+	_OP_FSYNC           = int32(20)
+	_OP_SETXATTR        = int32(21)
+	_OP_GETXATTR        = int32(22)
+	_OP_LISTXATTR       = int32(23)
+	_OP_REMOVEXATTR     = int32(24)
+	_OP_FLUSH           = int32(25)
+	_OP_INIT            = int32(26)
+	_OP_OPENDIR         = int32(27)
+	_OP_READDIR         = int32(28)
+	_OP_RELEASEDIR      = int32(29)
+	_OP_FSYNCDIR        = int32(30)
+	_OP_GETLK           = int32(31)
+	_OP_SETLK           = int32(32)
+	_OP_SETLKW          = int32(33)
+	_OP_ACCESS          = int32(34)
+	_OP_CREATE          = int32(35)
+	_OP_INTERRUPT       = int32(36)
+	_OP_BMAP            = int32(37)
+	_OP_DESTROY         = int32(38)
+	_OP_IOCTL           = int32(39)
+	_OP_POLL            = int32(40)
+	_OP_NOTIFY_REPLY    = int32(41)
+	_OP_BATCH_FORGET    = int32(42)
+	_OP_COPY_FILE_RANGE = int32(47)
 
 	// Ugh - what will happen if FUSE introduces a new opcode here?
+	_OP_SYNCFS       = int32(50)
 	_OP_NOTIFY_ENTRY = int32(51)
 	_OP_NOTIFY_INODE = int32(52)
 
 	_OPCODE_COUNT = int32(53)
+
+	// CUSE opcodes live outside the FUSE range.
+	_OP_CUSE_INIT = int32(raw.CUSE_INIT)
+)
+
+const (
+	FUSE_KERNEL_VERSION   = 7
+	MINIMUM_MINOR_VERSION = 13
+	OUR_MINOR_VERSION     = 34
 )
 
 ////////////////////////////////////////////////////////////////
 
 func doInit(state *MountState, req *request) {
-	const (
-		FUSE_KERNEL_VERSION       = 7
-		MINIMUM_MINOR_VERSION = 13
-		OUR_MINOR_VERSION = 16
-	)
-
 	input := (*raw.InitIn)(req.inData)
 	if input.Major != FUSE_KERNEL_VERSION {
 		log.Printf("Major versions does not match. Given %d, want %d\n", input.Major, FUSE_KERNEL_VERSION)
@@ -83,8 +88,25 @@ func doInit(state *MountState, req *request) {
 		return
 	}
 
+	want := uint32(raw.CAP_ASYNC_READ | raw.CAP_BIG_WRITES | raw.CAP_FILE_OPS |
+		raw.CAP_NO_OPEN_SUPPORT | raw.CAP_NO_OPENDIR_SUPPORT | raw.CAP_PARALLEL_DIROPS)
+	if state.opts.PosixACL {
+		want |= raw.CAP_POSIX_ACL
+	}
+	if state.opts.HandleKillPriv {
+		want |= raw.CAP_HANDLE_KILLPRIV | raw.CAP_HANDLE_KILLPRIV_V2
+	}
+	if state.opts.ExportSupport {
+		want |= raw.CAP_EXPORT_SUPPORT
+	}
+	if state.opts.CacheSymlinks {
+		want |= raw.CAP_CACHE_SYMLINKS
+	}
+	if !state.opts.NoSplice {
+		want |= raw.CAP_SPLICE_WRITE
+	}
 	state.kernelSettings = *input
-	state.kernelSettings.Flags = input.Flags & (raw.CAP_ASYNC_READ | raw.CAP_BIG_WRITES | raw.CAP_FILE_OPS)
+	state.kernelSettings.Flags = input.Flags & want
 	out := &raw.InitOut{
 		Major:               FUSE_KERNEL_VERSION,
 		Minor:               OUR_MINOR_VERSION,
@@ -97,8 +119,15 @@ func doInit(state *MountState, req *request) {
 	if out.Minor > input.Minor {
 		out.Minor = input.Minor
 	}
-	
+	state.negotiatedSettings = *out
+
 	req.outData = unsafe.Pointer(out)
+	if out.Minor < 23 {
+		// Older kernels reject replies longer than their
+		// InitOut.
+		req.outData = nil
+		req.flatData = asSlice(unsafe.Pointer(out), raw.COMPAT_22_INIT_OUT_SIZE)
+	}
 	req.status = OK
 }
 
@@ -121,7 +150,7 @@ func doReadDir(state *MountState, req *request) {
 	in := (*ReadIn)(req.inData)
 	buf := state.buffers.AllocBuffer(in.Size)
 	entries := NewDirEntryList(buf, uint64(in.Offset))
-	
+
 	code := state.fileSystem.ReadDir(entries, req.inHeader, in)
 	req.flatData = entries.Bytes()
 	req.status = code
@@ -151,9 +180,12 @@ const _SECURITY_ACL_DEFAULT = "system.posix_acl_default"
 
 func doGetXAttr(state *MountState, req *request) {
 	if state.opts.IgnoreSecurityLabels && req.inHeader.Opcode == _OP_GETXATTR {
+		// Enforced ACLs are not labels, so they are always
+		// passed on.
 		fn := req.filenames[0]
-		if fn == _SECURITY_CAPABILITY || fn == _SECURITY_ACL_DEFAULT ||
-			fn == _SECURITY_ACL {
+		acl := state.kernelSettings.Flags&raw.CAP_POSIX_ACL != 0
+		if fn == _SECURITY_CAPABILITY ||
+			(!acl && (fn == _SECURITY_ACL_DEFAULT || fn == _SECURITY_ACL)) {
 			req.status = ENODATA
 			return
 		}
@@ -200,9 +232,17 @@ func doForget(state *MountState, req *request) {
 	state.fileSystem.Forget(req.inHeader.NodeId, (*raw.ForgetIn)(req.inData).Nlookup)
 }
 
+func doInterrupt(state *MountState, req *request) {
+	if !state.interrupt((*raw.InterruptIn)(req.inData).Unique) {
+		// Not read yet, or answered already.  In the first
+		// case, the kernel sends the interrupt again.
+		req.status = EAGAIN
+	}
+}
+
 func doBatchForget(state *MountState, req *request) {
 	in := (*raw.BatchForgetIn)(req.inData)
-	wantBytes := uintptr(in.Count)*unsafe.Sizeof(raw.BatchForgetIn{})
+	wantBytes := uintptr(in.Count) * unsafe.Sizeof(raw.BatchForgetIn{})
 	if uintptr(len(req.arg)) < wantBytes {
 		// We have no return value to complain, so log an error.
 		log.Printf("Too few bytes for batch forget. Got %d bytes, want %d (%d entries)",
@@ -230,7 +270,7 @@ func doLookup(state *MountState, req *request) {
 
 func doMknod(state *MountState, req *request) {
 	out := (*raw.EntryOut)(req.outData)
-	
+
 	req.status = state.fileSystem.Mknod(out, req.inHeader, (*raw.MknodIn)(req.inData), req.filenames[0])
 }
 
@@ -253,7 +293,14 @@ func doLink(state *MountState, req *request) {
 }
 
 func doRead(state *MountState, req *request) {
-	req.flatData, req.status = state.fileSystem.Read(req.inHeader, (*ReadIn)(req.inData), state.buffers)
+	input := (*ReadIn)(req.inData)
+	if fdr, ok := state.fileSystem.(fdReader); ok && state.canSplice() {
+		if fd, release, ok := fdr.readFd(req.inHeader, input); ok {
+			req.fdData = &fdData{fd: fd, off: int64(input.Offset), size: int(input.Size), release: release}
+			return
+		}
+	}
+	req.flatData, req.status = state.fileSystem.Read(req.inHeader, input, state.buffers)
 }
 
 func doFlush(state *MountState, req *request) {
@@ -264,6 +311,17 @@ func doRelease(state *MountState, req *request) {
 	state.fileSystem.Release(req.inHeader, (*raw.ReleaseIn)(req.inData))
 }
 
+func doSyncFs(state *MountState, req *request) {
+	req.status = state.fileSystem.SyncFs(req.inHeader, (*raw.SyncFsIn)(req.inData))
+}
+
+func doCopyFileRange(state *MountState, req *request) {
+	n, status := state.fileSystem.CopyFileRange(req.inHeader, (*raw.CopyFileRangeIn)(req.inData))
+	o := (*raw.WriteOut)(req.outData)
+	o.Size = n
+	req.status = status
+}
+
 func doFsync(state *MountState, req *request) {
 	req.status = state.fileSystem.Fsync(req.inHeader, (*raw.FsyncIn)(req.inData))
 }
@@ -317,9 +375,14 @@ type operationHandler struct {
 	DecodeOut   castPointerFunc
 	FileNames   int
 	FileNameOut bool
+
+	// Mutating operations are held back while the MountState is
+	// frozen.
+	Mutating bool
 }
 
 var operationHandlers []*operationHandler
+var cuseInitHandler *operationHandler
 
 func operationName(op int32) string {
 	h := getHandler(op)
@@ -330,6 +393,9 @@ func operationName(op int32) string {
 }
 
 func getHandler(o int32) *operationHandler {
+	if o == _OP_CUSE_INIT {
+		return cuseInitHandler
+	}
 	if o >= _OPCODE_COUNT {
 		return nil
 	}
@@ -337,6 +403,15 @@ func getHandler(o int32) *operationHandler {
 }
 
 func init() {
+	cuseInitHandler = &operationHandler{
+		Name:       "CUSE_INIT",
+		Func:       doCuseInit,
+		InputSize:  unsafe.Sizeof(raw.CuseInitIn{}),
+		OutputSize: unsafe.Sizeof(raw.CuseInitOut{}),
+		DecodeIn:   func(ptr unsafe.Pointer) interface{} { return (*raw.CuseInitIn)(ptr) },
+		DecodeOut:  func(ptr unsafe.Pointer) interface{} { return (*raw.CuseInitOut)(ptr) },
+	}
+
 	operationHandlers = make([]*operationHandler, _OPCODE_COUNT)
 	for i := range operationHandlers {
 		operationHandlers[i] = &operationHandler{Name: "UNKNOWN"}
@@ -347,142 +422,160 @@ func init() {
 		operationHandlers[op].FileNameOut = true
 	}
 
+	// FLUSH is sent on every close, so it is not included.
+	mutatingOps := []int32{
+		_OP_SETATTR, _OP_SYMLINK, _OP_MKNOD, _OP_MKDIR, _OP_UNLINK,
+		_OP_RMDIR, _OP_RENAME, _OP_LINK, _OP_WRITE, _OP_SETXATTR,
+		_OP_REMOVEXATTR, _OP_CREATE, _OP_COPY_FILE_RANGE,
+	}
+	for _, op := range mutatingOps {
+		operationHandlers[op].Mutating = true
+	}
+
 	for op, sz := range map[int32]uintptr{
-		_OP_FORGET:       unsafe.Sizeof(raw.ForgetIn{}),
-		_OP_BATCH_FORGET: unsafe.Sizeof(raw.BatchForgetIn{}),
-		_OP_GETATTR:      unsafe.Sizeof(raw.GetAttrIn{}),
-		_OP_SETATTR:      unsafe.Sizeof(raw.SetAttrIn{}),
-		_OP_MKNOD:        unsafe.Sizeof(raw.MknodIn{}),
-		_OP_MKDIR:        unsafe.Sizeof(raw.MkdirIn{}),
-		_OP_RENAME:       unsafe.Sizeof(raw.RenameIn{}),
-		_OP_LINK:         unsafe.Sizeof(raw.LinkIn{}),
-		_OP_OPEN:         unsafe.Sizeof(raw.OpenIn{}),
-		_OP_READ:         unsafe.Sizeof(ReadIn{}),
-		_OP_WRITE:        unsafe.Sizeof(WriteIn{}),
-		_OP_RELEASE:      unsafe.Sizeof(raw.ReleaseIn{}),
-		_OP_FSYNC:        unsafe.Sizeof(raw.FsyncIn{}),
-		_OP_SETXATTR:     unsafe.Sizeof(raw.SetXAttrIn{}),
-		_OP_GETXATTR:     unsafe.Sizeof(raw.GetXAttrIn{}),
-		_OP_LISTXATTR:    unsafe.Sizeof(raw.GetXAttrIn{}),
-		_OP_FLUSH:        unsafe.Sizeof(raw.FlushIn{}),
-		_OP_INIT:         unsafe.Sizeof(raw.InitIn{}),
-		_OP_OPENDIR:      unsafe.Sizeof(raw.OpenIn{}),
-		_OP_READDIR:      unsafe.Sizeof(ReadIn{}),
-		_OP_RELEASEDIR:   unsafe.Sizeof(raw.ReleaseIn{}),
-		_OP_FSYNCDIR:     unsafe.Sizeof(raw.FsyncIn{}),
-		_OP_ACCESS:       unsafe.Sizeof(raw.AccessIn{}),
-		_OP_CREATE:       unsafe.Sizeof(raw.CreateIn{}),
-		_OP_INTERRUPT:    unsafe.Sizeof(raw.InterruptIn{}),
-		_OP_BMAP:         unsafe.Sizeof(raw.BmapIn{}),
-		_OP_IOCTL:        unsafe.Sizeof(raw.IoctlIn{}),
-		_OP_POLL:         unsafe.Sizeof(raw.PollIn{}),
+		_OP_FORGET:          unsafe.Sizeof(raw.ForgetIn{}),
+		_OP_BATCH_FORGET:    unsafe.Sizeof(raw.BatchForgetIn{}),
+		_OP_GETATTR:         unsafe.Sizeof(raw.GetAttrIn{}),
+		_OP_SETATTR:         unsafe.Sizeof(raw.SetAttrIn{}),
+		_OP_MKNOD:           unsafe.Sizeof(raw.MknodIn{}),
+		_OP_MKDIR:           unsafe.Sizeof(raw.MkdirIn{}),
+		_OP_RENAME:          unsafe.Sizeof(raw.RenameIn{}),
+		_OP_LINK:            unsafe.Sizeof(raw.LinkIn{}),
+		_OP_OPEN:            unsafe.Sizeof(raw.OpenIn{}),
+		_OP_READ:            unsafe.Sizeof(ReadIn{}),
+		_OP_WRITE:           unsafe.Sizeof(WriteIn{}),
+		_OP_RELEASE:         unsafe.Sizeof(raw.ReleaseIn{}),
+		_OP_FSYNC:           unsafe.Sizeof(raw.FsyncIn{}),
+		_OP_SYNCFS:          unsafe.Sizeof(raw.SyncFsIn{}),
+		_OP_COPY_FILE_RANGE: unsafe.Sizeof(raw.CopyFileRangeIn{}),
+		_OP_SETXATTR:        unsafe.Sizeof(raw.SetXAttrIn{}),
+		_OP_GETXATTR:        unsafe.Sizeof(raw.GetXAttrIn{}),
+		_OP_LISTXATTR:       unsafe.Sizeof(raw.GetXAttrIn{}),
+		_OP_FLUSH:           unsafe.Sizeof(raw.FlushIn{}),
+		_OP_INIT:            unsafe.Sizeof(raw.InitIn{}),
+		_OP_OPENDIR:         unsafe.Sizeof(raw.OpenIn{}),
+		_OP_READDIR:         unsafe.Sizeof(ReadIn{}),
+		_OP_RELEASEDIR:      unsafe.Sizeof(raw.ReleaseIn{}),
+		_OP_FSYNCDIR:        unsafe.Sizeof(raw.FsyncIn{}),
+		_OP_ACCESS:          unsafe.Sizeof(raw.AccessIn{}),
+		_OP_CREATE:          unsafe.Sizeof(raw.CreateIn{}),
+		_OP_INTERRUPT:       unsafe.Sizeof(raw.InterruptIn{}),
+		_OP_BMAP:            unsafe.Sizeof(raw.BmapIn{}),
+		_OP_IOCTL:           unsafe.Sizeof(raw.IoctlIn{}),
+		_OP_POLL:            unsafe.Sizeof(raw.PollIn{}),
 	} {
 		operationHandlers[op].InputSize = sz
 	}
 
 	for op, sz := range map[int32]uintptr{
-		_OP_LOOKUP:       unsafe.Sizeof(raw.EntryOut{}),
-		_OP_GETATTR:      unsafe.Sizeof(raw.AttrOut{}),
-		_OP_SETATTR:      unsafe.Sizeof(raw.AttrOut{}),
-		_OP_SYMLINK:      unsafe.Sizeof(raw.EntryOut{}),
-		_OP_MKNOD:        unsafe.Sizeof(raw.EntryOut{}),
-		_OP_MKDIR:        unsafe.Sizeof(raw.EntryOut{}),
-		_OP_LINK:         unsafe.Sizeof(raw.EntryOut{}),
-		_OP_OPEN:         unsafe.Sizeof(raw.OpenOut{}),
-		_OP_WRITE:        unsafe.Sizeof(raw.WriteOut{}),
-		_OP_STATFS:       unsafe.Sizeof(StatfsOut{}),
-		_OP_GETXATTR:     unsafe.Sizeof(raw.GetXAttrOut{}),
-		_OP_LISTXATTR:    unsafe.Sizeof(raw.GetXAttrOut{}),
-		_OP_INIT:         unsafe.Sizeof(raw.InitOut{}),
-		_OP_OPENDIR:      unsafe.Sizeof(raw.OpenOut{}),
-		_OP_CREATE:       unsafe.Sizeof(raw.CreateOut{}),
-		_OP_BMAP:         unsafe.Sizeof(raw.BmapOut{}),
-		_OP_IOCTL:        unsafe.Sizeof(raw.IoctlOut{}),
-		_OP_POLL:         unsafe.Sizeof(raw.PollOut{}),
-		_OP_NOTIFY_ENTRY: unsafe.Sizeof(raw.NotifyInvalEntryOut{}),
-		_OP_NOTIFY_INODE: unsafe.Sizeof(raw.NotifyInvalInodeOut{}),
+		_OP_LOOKUP:          unsafe.Sizeof(raw.EntryOut{}),
+		_OP_GETATTR:         unsafe.Sizeof(raw.AttrOut{}),
+		_OP_SETATTR:         unsafe.Sizeof(raw.AttrOut{}),
+		_OP_SYMLINK:         unsafe.Sizeof(raw.EntryOut{}),
+		_OP_MKNOD:           unsafe.Sizeof(raw.EntryOut{}),
+		_OP_MKDIR:           unsafe.Sizeof(raw.EntryOut{}),
+		_OP_LINK:            unsafe.Sizeof(raw.EntryOut{}),
+		_OP_OPEN:            unsafe.Sizeof(raw.OpenOut{}),
+		_OP_WRITE:           unsafe.Sizeof(raw.WriteOut{}),
+		_OP_COPY_FILE_RANGE: unsafe.Sizeof(raw.WriteOut{}),
+		_OP_STATFS:          unsafe.Sizeof(StatfsOut{}),
+		_OP_GETXATTR:        unsafe.Sizeof(raw.GetXAttrOut{}),
+		_OP_LISTXATTR:       unsafe.Sizeof(raw.GetXAttrOut{}),
+		_OP_INIT:            unsafe.Sizeof(raw.InitOut{}),
+		_OP_OPENDIR:         unsafe.Sizeof(raw.OpenOut{}),
+		_OP_CREATE:          unsafe.Sizeof(raw.CreateOut{}),
+		_OP_BMAP:            unsafe.Sizeof(raw.BmapOut{}),
+		_OP_IOCTL:           unsafe.Sizeof(raw.IoctlOut{}),
+		_OP_POLL:            unsafe.Sizeof(raw.PollOut{}),
+		_OP_NOTIFY_ENTRY:    unsafe.Sizeof(raw.NotifyInvalEntryOut{}),
+		_OP_NOTIFY_INODE:    unsafe.Sizeof(raw.NotifyInvalInodeOut{}),
 	} {
 		operationHandlers[op].OutputSize = sz
 	}
 
 	for op, v := range map[int32]string{
-		_OP_LOOKUP:       "LOOKUP",
-		_OP_FORGET:       "FORGET",
-		_OP_BATCH_FORGET: "BATCH_FORGET",
-		_OP_GETATTR:      "GETATTR",
-		_OP_SETATTR:      "SETATTR",
-		_OP_READLINK:     "READLINK",
-		_OP_SYMLINK:      "SYMLINK",
-		_OP_MKNOD:        "MKNOD",
-		_OP_MKDIR:        "MKDIR",
-		_OP_UNLINK:       "UNLINK",
-		_OP_RMDIR:        "RMDIR",
-		_OP_RENAME:       "RENAME",
-		_OP_LINK:         "LINK",
-		_OP_OPEN:         "OPEN",
-		_OP_READ:         "READ",
-		_OP_WRITE:        "WRITE",
-		_OP_STATFS:       "STATFS",
-		_OP_RELEASE:      "RELEASE",
-		_OP_FSYNC:        "FSYNC",
-		_OP_SETXATTR:     "SETXATTR",
-		_OP_GETXATTR:     "GETXATTR",
-		_OP_LISTXATTR:    "LISTXATTR",
-		_OP_REMOVEXATTR:  "REMOVEXATTR",
-		_OP_FLUSH:        "FLUSH",
-		_OP_INIT:         "INIT",
-		_OP_OPENDIR:      "OPENDIR",
-		_OP_READDIR:      "READDIR",
-		_OP_RELEASEDIR:   "RELEASEDIR",
-		_OP_FSYNCDIR:     "FSYNCDIR",
-		_OP_GETLK:        "GETLK",
-		_OP_SETLK:        "SETLK",
-		_OP_SETLKW:       "SETLKW",
-		_OP_ACCESS:       "ACCESS",
-		_OP_CREATE:       "CREATE",
-		_OP_INTERRUPT:    "INTERRUPT",
-		_OP_BMAP:         "BMAP",
-		_OP_DESTROY:      "DESTROY",
-		_OP_IOCTL:        "IOCTL",
-		_OP_POLL:         "POLL",
-		_OP_NOTIFY_ENTRY: "NOTIFY_ENTRY",
-		_OP_NOTIFY_INODE: "NOTIFY_INODE",
+		_OP_LOOKUP:          "LOOKUP",
+		_OP_FORGET:          "FORGET",
+		_OP_BATCH_FORGET:    "BATCH_FORGET",
+		_OP_GETATTR:         "GETATTR",
+		_OP_SETATTR:         "SETATTR",
+		_OP_READLINK:        "READLINK",
+		_OP_SYMLINK:         "SYMLINK",
+		_OP_MKNOD:           "MKNOD",
+		_OP_MKDIR:           "MKDIR",
+		_OP_UNLINK:          "UNLINK",
+		_OP_RMDIR:           "RMDIR",
+		_OP_RENAME:          "RENAME",
+		_OP_LINK:            "LINK",
+		_OP_OPEN:            "OPEN",
+		_OP_READ:            "READ",
+		_OP_WRITE:           "WRITE",
+		_OP_STATFS:          "STATFS",
+		_OP_SYNCFS:          "SYNCFS",
+		_OP_COPY_FILE_RANGE: "COPY_FILE_RANGE",
+		_OP_RELEASE:         "RELEASE",
+		_OP_FSYNC:           "FSYNC",
+		_OP_SETXATTR:        "SETXATTR",
+		_OP_GETXATTR:        "GETXATTR",
+		_OP_LISTXATTR:       "LISTXATTR",
+		_OP_REMOVEXATTR:     "REMOVEXATTR",
+		_OP_FLUSH:           "FLUSH",
+		_OP_INIT:            "INIT",
+		_OP_OPENDIR:         "OPENDIR",
+		_OP_READDIR:         "READDIR",
+		_OP_RELEASEDIR:      "RELEASEDIR",
+		_OP_FSYNCDIR:        "FSYNCDIR",
+		_OP_GETLK:           "GETLK",
+		_OP_SETLK:           "SETLK",
+		_OP_SETLKW:          "SETLKW",
+		_OP_ACCESS:          "ACCESS",
+		_OP_CREATE:          "CREATE",
+		_OP_INTERRUPT:       "INTERRUPT",
+		_OP_BMAP:            "BMAP",
+		_OP_DESTROY:         "DESTROY",
+		_OP_IOCTL:           "IOCTL",
+		_OP_POLL:            "POLL",
+		_OP_NOTIFY_ENTRY:    "NOTIFY_ENTRY",
+		_OP_NOTIFY_INODE:    "NOTIFY_INODE",
 	} {
 		operationHandlers[op].Name = v
 	}
 
 	for op, v := range map[int32]operationFunc{
-		_OP_OPEN:         doOpen,
-		_OP_READDIR:      doReadDir,
-		_OP_WRITE:        doWrite,
-		_OP_OPENDIR:      doOpenDir,
-		_OP_CREATE:       doCreate,
-		_OP_SETATTR:      doSetattr,
-		_OP_GETXATTR:     doGetXAttr,
-		_OP_LISTXATTR:    doGetXAttr,
-		_OP_GETATTR:      doGetAttr,
-		_OP_FORGET:       doForget,
-		_OP_BATCH_FORGET: doBatchForget,
-		_OP_READLINK:     doReadlink,
-		_OP_INIT:         doInit,
-		_OP_LOOKUP:       doLookup,
-		_OP_MKNOD:        doMknod,
-		_OP_MKDIR:        doMkdir,
-		_OP_UNLINK:       doUnlink,
-		_OP_RMDIR:        doRmdir,
-		_OP_LINK:         doLink,
-		_OP_READ:         doRead,
-		_OP_FLUSH:        doFlush,
-		_OP_RELEASE:      doRelease,
-		_OP_FSYNC:        doFsync,
-		_OP_RELEASEDIR:   doReleaseDir,
-		_OP_FSYNCDIR:     doFsyncDir,
-		_OP_SETXATTR:     doSetXAttr,
-		_OP_REMOVEXATTR:  doRemoveXAttr,
-		_OP_ACCESS:       doAccess,
-		_OP_SYMLINK:      doSymlink,
-		_OP_RENAME:       doRename,
-		_OP_STATFS:       doStatFs,
+		_OP_OPEN:            doOpen,
+		_OP_READDIR:         doReadDir,
+		_OP_WRITE:           doWrite,
+		_OP_OPENDIR:         doOpenDir,
+		_OP_CREATE:          doCreate,
+		_OP_SETATTR:         doSetattr,
+		_OP_GETXATTR:        doGetXAttr,
+		_OP_LISTXATTR:       doGetXAttr,
+		_OP_GETATTR:         doGetAttr,
+		_OP_FORGET:          doForget,
+		_OP_BATCH_FORGET:    doBatchForget,
+		_OP_INTERRUPT:       doInterrupt,
+		_OP_READLINK:        doReadlink,
+		_OP_INIT:            doInit,
+		_OP_LOOKUP:          doLookup,
+		_OP_MKNOD:           doMknod,
+		_OP_MKDIR:           doMkdir,
+		_OP_UNLINK:          doUnlink,
+		_OP_RMDIR:           doRmdir,
+		_OP_LINK:            doLink,
+		_OP_READ:            doRead,
+		_OP_FLUSH:           doFlush,
+		_OP_RELEASE:         doRelease,
+		_OP_FSYNC:           doFsync,
+		_OP_RELEASEDIR:      doReleaseDir,
+		_OP_FSYNCDIR:        doFsyncDir,
+		_OP_SETXATTR:        doSetXAttr,
+		_OP_REMOVEXATTR:     doRemoveXAttr,
+		_OP_ACCESS:          doAccess,
+		_OP_SYMLINK:         doSymlink,
+		_OP_RENAME:          doRename,
+		_OP_STATFS:          doStatFs,
+		_OP_SYNCFS:          doSyncFs,
+		_OP_COPY_FILE_RANGE: doCopyFileRange,
 	} {
 		operationHandlers[op].Func = v
 	}
@@ -507,23 +600,25 @@ func init() {
 
 	// Inputs.
 	for op, f := range map[int32]castPointerFunc{
-		_OP_FLUSH:        func(ptr unsafe.Pointer) interface{} { return (*raw.FlushIn)(ptr) },
-		_OP_GETATTR:      func(ptr unsafe.Pointer) interface{} { return (*raw.GetAttrIn)(ptr) },
-		_OP_SETATTR:      func(ptr unsafe.Pointer) interface{} { return (*raw.SetAttrIn)(ptr) },
-		_OP_INIT:         func(ptr unsafe.Pointer) interface{} { return (*raw.InitIn)(ptr) },
-		_OP_IOCTL:        func(ptr unsafe.Pointer) interface{} { return (*raw.IoctlIn)(ptr) },
-		_OP_OPEN:         func(ptr unsafe.Pointer) interface{} { return (*raw.OpenIn)(ptr) },
-		_OP_MKNOD:        func(ptr unsafe.Pointer) interface{} { return (*raw.MknodIn)(ptr) },
-		_OP_CREATE:       func(ptr unsafe.Pointer) interface{} { return (*raw.CreateIn)(ptr) },
-		_OP_READ:         func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
-		_OP_READDIR:      func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
-		_OP_ACCESS:       func(ptr unsafe.Pointer) interface{} { return (*raw.AccessIn)(ptr) },
-		_OP_FORGET:       func(ptr unsafe.Pointer) interface{} { return (*raw.ForgetIn)(ptr) },
-		_OP_BATCH_FORGET: func(ptr unsafe.Pointer) interface{} { return (*raw.BatchForgetIn)(ptr) },
-		_OP_LINK:         func(ptr unsafe.Pointer) interface{} { return (*raw.LinkIn)(ptr) },
-		_OP_MKDIR:        func(ptr unsafe.Pointer) interface{} { return (*raw.MkdirIn)(ptr) },
-		_OP_RELEASE:      func(ptr unsafe.Pointer) interface{} { return (*raw.ReleaseIn)(ptr) },
-		_OP_RELEASEDIR:   func(ptr unsafe.Pointer) interface{} { return (*raw.ReleaseIn)(ptr) },
+		_OP_FLUSH:           func(ptr unsafe.Pointer) interface{} { return (*raw.FlushIn)(ptr) },
+		_OP_GETATTR:         func(ptr unsafe.Pointer) interface{} { return (*raw.GetAttrIn)(ptr) },
+		_OP_SETATTR:         func(ptr unsafe.Pointer) interface{} { return (*raw.SetAttrIn)(ptr) },
+		_OP_INIT:            func(ptr unsafe.Pointer) interface{} { return (*raw.InitIn)(ptr) },
+		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*raw.IoctlIn)(ptr) },
+		_OP_OPEN:            func(ptr unsafe.Pointer) interface{} { return (*raw.OpenIn)(ptr) },
+		_OP_MKNOD:           func(ptr unsafe.Pointer) interface{} { return (*raw.MknodIn)(ptr) },
+		_OP_CREATE:          func(ptr unsafe.Pointer) interface{} { return (*raw.CreateIn)(ptr) },
+		_OP_READ:            func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
+		_OP_READDIR:         func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
+		_OP_ACCESS:          func(ptr unsafe.Pointer) interface{} { return (*raw.AccessIn)(ptr) },
+		_OP_FORGET:          func(ptr unsafe.Pointer) interface{} { return (*raw.ForgetIn)(ptr) },
+		_OP_BATCH_FORGET:    func(ptr unsafe.Pointer) interface{} { return (*raw.BatchForgetIn)(ptr) },
+		_OP_INTERRUPT:       func(ptr unsafe.Pointer) interface{} { return (*raw.InterruptIn)(ptr) },
+		_OP_LINK:            func(ptr unsafe.Pointer) interface{} { return (*raw.LinkIn)(ptr) },
+		_OP_MKDIR:           func(ptr unsafe.Pointer) interface{} { return (*raw.MkdirIn)(ptr) },
+		_OP_RELEASE:         func(ptr unsafe.Pointer) interface{} { return (*raw.ReleaseIn)(ptr) },
+		_OP_RELEASEDIR:      func(ptr unsafe.Pointer) interface{} { return (*raw.ReleaseIn)(ptr) },
+		_OP_COPY_FILE_RANGE: func(ptr unsafe.Pointer) interface{} { return (*raw.CopyFileRangeIn)(ptr) },
 	} {
 		operationHandlers[op].DecodeIn = f
 	}
@@ -548,7 +643,7 @@ func init() {
 	var r request
 	sizeOfOutHeader := unsafe.Sizeof(raw.OutHeader{})
 	for code, h := range operationHandlers {
-		if h.OutputSize + sizeOfOutHeader > unsafe.Sizeof(r.outBuf) {
+		if h.OutputSize+sizeOfOutHeader > unsafe.Sizeof(r.outBuf) {
 			log.Panicf("request output buffer too small: code %v, sz %d + %d %v", code, h.OutputSize, sizeOfOutHeader, h)
 		}
 	}
@@ -0,0 +1,97 @@
+package fuse
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// The protocol minor version that introduced each capability.
+var capMinor = map[uint32]uint32{
+	raw.CAP_ASYNC_READ:         9,
+	raw.CAP_FILE_OPS:           9,
+	raw.CAP_BIG_WRITES:         9,
+	raw.CAP_EXPORT_SUPPORT:     10,
+	raw.CAP_SPLICE_WRITE:       14,
+	raw.CAP_NO_OPEN_SUPPORT:    23,
+	raw.CAP_PARALLEL_DIROPS:    25,
+	raw.CAP_HANDLE_KILLPRIV:    26,
+	raw.CAP_POSIX_ACL:          26,
+	raw.CAP_CACHE_SYMLINKS:     28,
+	raw.CAP_NO_OPENDIR_SUPPORT: 29,
+	raw.CAP_HANDLE_KILLPRIV_V2: 33,
+}
+
+func TestInitCapsMatchMinor(t *testing.T) {
+	if OUR_MINOR_VERSION < 34 {
+		t.Errorf("minor %d is older than SYNCFS (7.34)", OUR_MINOR_VERSION)
+	}
+	ms := NewMountState(&DefaultRawFileSystem{})
+	ms.setOptions(&MountOptions{
+		PosixACL:       true,
+		HandleKillPriv: true,
+		ExportSupport:  true,
+		CacheSymlinks:  true,
+	})
+	in := raw.InitIn{
+		Major: FUSE_KERNEL_VERSION,
+		Minor: OUR_MINOR_VERSION + 1,
+		Flags: ^uint32(0),
+	}
+	req := &request{
+		inHeader: &raw.InHeader{Opcode: _OP_INIT, Unique: 1},
+		inData:   unsafe.Pointer(&in),
+		handler:  getHandler(_OP_INIT),
+	}
+	doInit(ms, req)
+	if !req.status.Ok() {
+		t.Fatal("doInit:", req.status)
+	}
+	if req.outData == nil {
+		t.Fatal("no InitOut in the reply")
+	}
+	out := (*raw.InitOut)(req.outData)
+	if out.Minor != OUR_MINOR_VERSION {
+		t.Errorf("got minor %d, want %d", out.Minor, OUR_MINOR_VERSION)
+	}
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if out.Flags&bit == 0 {
+			continue
+		}
+		if m, ok := capMinor[bit]; !ok {
+			t.Errorf("capability %x is not known", bit)
+		} else if m > out.Minor {
+			t.Errorf("capability %x needs 7.%d, we speak 7.%d", bit, m, out.Minor)
+		}
+	}
+	if _, data := req.serialize(); len(data) != 0 {
+		t.Errorf("got %d bytes of flat data", len(data))
+	}
+}
+
+func TestInitOldKernel(t *testing.T) {
+	if sz := unsafe.Sizeof(raw.InitOut{}); sz != 64 {
+		t.Errorf("InitOut has %d bytes, want 64", sz)
+	}
+	ms := NewMountState(&DefaultRawFileSystem{})
+	ms.setOptions(&MountOptions{MaxWrite: 1 << 16})
+	in := raw.InitIn{Major: FUSE_KERNEL_VERSION, Minor: 22}
+	req := &request{
+		inHeader: &raw.InHeader{Opcode: _OP_INIT, Unique: 1},
+		inData:   unsafe.Pointer(&in),
+		handler:  getHandler(_OP_INIT),
+	}
+	doInit(ms, req)
+	if !req.status.Ok() {
+		t.Fatal("doInit:", req.status)
+	}
+	header, data := req.serialize()
+	if len(header) != int(unsafe.Sizeof(raw.OutHeader{})) || len(data) != raw.COMPAT_22_INIT_OUT_SIZE {
+		t.Fatalf("got %d+%d bytes, want the header and %d", len(header), len(data), raw.COMPAT_22_INIT_OUT_SIZE)
+	}
+	out := (*raw.InitOut)(unsafe.Pointer(&data[0]))
+	if out.Minor != 22 || out.MaxWrite != 1<<16 {
+		t.Errorf("got minor %d, MaxWrite %d", out.Minor, out.MaxWrite)
+	}
+}
@@ -0,0 +1,101 @@
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// OpLog describes an operation served by a MountState, for an
+// OpLogger.
+type OpLog struct {
+	// Op is the name of the operation, eg. "LOOKUP".
+	// Notifications to the kernel are "NOTIFY_ENTRY" and
+	// "NOTIFY_INODE".
+	Op string
+
+	// NodeId is the node the request is for.
+	NodeId uint64
+
+	// Names holds the file name arguments of the request, or of
+	// an entry notification.
+	Names []string
+
+	// Input and Output are the decoded request and reply
+	// structs, or nil.  They point into buffers that are reused,
+	// so they must not be kept after LogOp returns.
+	Input  interface{}
+	Output interface{}
+
+	// Status is the result sent to the kernel.
+	Status Status
+
+	// Duration is the time from reading the request to writing
+	// the reply.  It is zero for notifications.
+	Duration time.Duration
+}
+
+func (o *OpLog) String() string {
+	s := fmt.Sprintf("%s NodeId: %d", o.Op, o.NodeId)
+	if o.Names != nil {
+		s += fmt.Sprintf(" names: %q", o.Names)
+	}
+	if o.Input != nil {
+		s += fmt.Sprintf(" in: %v", o.Input)
+	}
+	if o.Output != nil {
+		out := fmt.Sprintf("%v", o.Output)
+		if max := 1024; len(out) > max {
+			out = out[:max] + " ...trimmed"
+		}
+		s += " out: " + out
+	}
+	return fmt.Sprintf("%s: %v (%v)", s, o.Status, o.Duration)
+}
+
+// An OpLogger receives a record of every request that a MountState
+// serves, once the reply is written, and of every notification.  It
+// is called from the goroutines that serve requests, so it must be
+// safe for concurrent use, and should be quick.
+type OpLogger interface {
+	LogOp(op *OpLog)
+}
+
+// debugLogger writes records with the log package.  It is used if
+// MountState.Debug is set, and there is no Logger.
+type debugLogger struct{}
+
+func (debugLogger) LogOp(op *OpLog) {
+	log.Println(op)
+}
+
+// opLogger returns the OpLogger to use, or nil.
+func (ms *MountState) opLogger() OpLogger {
+	if ms.Logger != nil {
+		return ms.Logger
+	}
+	if ms.Debug {
+		return debugLogger{}
+	}
+	return nil
+}
+
+// opLog describes req for an OpLogger.
+func (r *request) opLog() *OpLog {
+	op := &OpLog{
+		Op:     operationName(r.inHeader.Opcode),
+		NodeId: r.inHeader.NodeId,
+		Names:  r.filenames,
+		Status: r.status,
+	}
+	if r.handler != nil && r.handler.DecodeIn != nil && r.inData != nil {
+		op.Input = r.handler.DecodeIn(r.inData)
+	}
+	if r.handler != nil && r.handler.DecodeOut != nil && r.outData != nil {
+		op.Output = r.handler.DecodeOut(r.outData)
+	}
+	if r.startNs != 0 {
+		op.Duration = time.Duration(time.Now().UnixNano() - r.startNs)
+	}
+	return op
+}
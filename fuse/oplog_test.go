@@ -0,0 +1,71 @@
+package fuse
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+type recordingLogger struct {
+	mu  sync.Mutex
+	ops []OpLog
+	got chan bool
+}
+
+func (l *recordingLogger) LogOp(op *OpLog) {
+	l.mu.Lock()
+	l.ops = append(l.ops, *op)
+	l.mu.Unlock()
+	l.got <- true
+}
+
+func TestOpLogger(t *testing.T) {
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+	defer local.Close()
+
+	logger := &recordingLogger{got: make(chan bool, 10)}
+	ms := NewMountState(&DefaultRawFileSystem{})
+	ms.setOptions(nil)
+	ms.Logger = logger
+	ms.mountFile = remote
+	go ms.Loop()
+
+	type getAttrRequest struct {
+		header raw.InHeader
+		in     raw.GetAttrIn
+	}
+	input := getAttrRequest{
+		header: raw.InHeader{
+			Opcode: _OP_GETATTR,
+			Unique: 1,
+			NodeId: raw.FUSE_ROOT_ID,
+		},
+	}
+	input.header.Length = uint32(unsafe.Sizeof(input))
+	_, err = local.Write((*[unsafe.Sizeof(input)]byte)(unsafe.Pointer(&input))[:])
+	CheckSuccess(err)
+	<-logger.got
+
+	ms.writeEntryNotify(42, "name")
+	<-logger.got
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.ops) != 2 {
+		t.Fatalf("got %d records, want 2: %v", len(logger.ops), logger.ops)
+	}
+	op := logger.ops[0]
+	if op.Op != "GETATTR" || op.NodeId != raw.FUSE_ROOT_ID || op.Status != ENOSYS || op.Input == nil {
+		t.Errorf("bad GETATTR record: %v", &op)
+	}
+	op = logger.ops[1]
+	if op.Op != "NOTIFY_ENTRY" || op.NodeId != 42 || len(op.Names) != 1 || op.Names[0] != "name" {
+		t.Errorf("bad NOTIFY_ENTRY record: %v", &op)
+	}
+
+	syscall.Shutdown(int(local.Fd()), syscall.SHUT_RDWR)
+}
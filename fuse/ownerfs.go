@@ -0,0 +1,167 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// ChownPolicy says what an OwnerFileSystem does with chown(2).
+type ChownPolicy int
+
+const (
+	// Succeed without changing anything, so programs that copy
+	// ownership, like cp -a and tar, do not fail.
+	CHOWN_IGNORE = ChownPolicy(iota)
+
+	// Fail with EPERM.
+	CHOWN_DENY
+
+	// Pass the change on unchanged.
+	CHOWN_PASS
+)
+
+type OwnerOptions struct {
+	// Owner is shown as the owner of all entries.  Defaults to
+	// the user and group of the process.
+	Owner *Owner
+
+	// If set, Uids and Gids map the ids they have, and leave the
+	// others alone, like the --map option of bindfs, instead of
+	// showing Owner.
+	Uids map[uint32]uint32
+	Gids map[uint32]uint32
+
+	Chown ChownPolicy
+}
+
+// OwnerFileSystem is a wrapper that shows all entries as owned by one
+// user, eg. the one who mounted it, so a tree that was made by other
+// users, or by a container with its own ids, can be used as if it
+// were one's own.  Mount with DefaultPermissions, so the kernel checks
+// access against the owners shown.
+type OwnerFileSystem struct {
+	FileSystem
+
+	options OwnerOptions
+}
+
+// NewOwnerFileSystem wraps fs.
+func NewOwnerFileSystem(fs FileSystem, opts *OwnerOptions) *OwnerFileSystem {
+	o := &OwnerFileSystem{FileSystem: fs}
+	if opts != nil {
+		o.options = *opts
+	}
+	if o.options.Owner == nil {
+		o.options.Owner = &Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	}
+	return o
+}
+
+func (fs *OwnerFileSystem) String() string {
+	return fmt.Sprintf("OwnerFileSystem(%s)", fs.FileSystem.String())
+}
+
+// attr changes the owner of a.
+func (fs *OwnerFileSystem) attr(a *Attr) {
+	if a == nil {
+		return
+	}
+	if fs.options.Uids == nil {
+		a.Uid = fs.options.Owner.Uid
+	} else if uid, ok := fs.options.Uids[a.Uid]; ok {
+		a.Uid = uid
+	}
+	if fs.options.Gids == nil {
+		a.Gid = fs.options.Owner.Gid
+	} else if gid, ok := fs.options.Gids[a.Gid]; ok {
+		a.Gid = gid
+	}
+}
+
+func (fs *OwnerFileSystem) wrap(f File) File {
+	if f == nil {
+		return nil
+	}
+	if withFlags, ok := f.(*WithFlags); ok {
+		wrapped := *withFlags
+		wrapped.File = fs.wrap(withFlags.File)
+		return &wrapped
+	}
+	return &ownerFile{File: f, fs: fs}
+}
+
+func (fs *OwnerFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	fs.attr(a)
+	return a, code
+}
+
+func (fs *OwnerFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) Status {
+	switch fs.options.Chown {
+	case CHOWN_IGNORE:
+		return OK
+	case CHOWN_DENY:
+		return EPERM
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *OwnerFileSystem) Open(name string, flags uint32, context *Context) (File, Status) {
+	f, code := fs.FileSystem.Open(name, flags, context)
+	return fs.wrap(f), code
+}
+
+func (fs *OwnerFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (File, Status) {
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	return fs.wrap(f), code
+}
+
+// ownerFile changes the owner of the attributes of an open file.
+type ownerFile struct {
+	File
+	fs *OwnerFileSystem
+}
+
+func (f *ownerFile) InnerFile() File {
+	return f.File
+}
+
+func (f *ownerFile) String() string {
+	return fmt.Sprintf("ownerFile(%s)", f.File.String())
+}
+
+func (f *ownerFile) GetAttr(out *Attr) Status {
+	code := f.File.GetAttr(out)
+	if code.Ok() {
+		f.fs.attr(out)
+	}
+	return code
+}
+
+func (f *ownerFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	switch f.fs.options.Chown {
+	case CHOWN_IGNORE:
+		return OK
+	case CHOWN_DENY:
+		return EPERM
+	}
+	return f.File.Chown(uid, gid, context)
+}
+
+func (f *ownerFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	const ids = raw.FATTR_UID | raw.FATTR_GID
+	if valid&ids != 0 {
+		switch f.fs.options.Chown {
+		case CHOWN_IGNORE:
+			valid &^= ids
+			if valid == 0 {
+				return OK
+			}
+		case CHOWN_DENY:
+			return EPERM
+		}
+	}
+	return f.File.Setattr(valid, attr, context)
+}
@@ -0,0 +1,59 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestOwnerFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644))
+
+	fs := NewOwnerFileSystem(NewLoopbackFileSystem(dir), &OwnerOptions{Owner: &Owner{Uid: 1234, Gid: 5678}})
+	a, code := fs.GetAttr("file", nil)
+	if !code.Ok() || a.Uid != 1234 || a.Gid != 5678 {
+		t.Errorf("GetAttr: %v %v", a, code)
+	}
+	f, code := fs.Open("file", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer f.Release(&ReleaseIn{})
+	var fa Attr
+	if code := f.GetAttr(&fa); !code.Ok() || fa.Uid != 1234 {
+		t.Errorf("File.GetAttr: %v %v", &fa, code)
+	}
+
+	// chown to any id succeeds, and changes nothing.
+	if code := fs.Chown("file", 0, 0, nil); !code.Ok() {
+		t.Errorf("Chown: %v", code)
+	}
+	if code := f.Setattr(raw.FATTR_UID, &Attr{Owner: raw.Owner{Uid: 0}}, nil); !code.Ok() {
+		t.Errorf("Setattr: %v", code)
+	}
+	st, _ := os.Stat(filepath.Join(dir, "file"))
+	if uid := st.Sys().(*syscall.Stat_t).Uid; uid != uint32(os.Getuid()) {
+		t.Errorf("owner changed to %d", uid)
+	}
+
+	fs = NewOwnerFileSystem(NewLoopbackFileSystem(dir), &OwnerOptions{Chown: CHOWN_DENY})
+	if code := fs.Chown("file", 0, 0, nil); code != EPERM {
+		t.Errorf("Chown: got %v", code)
+	}
+
+	// Maps only change the ids they have.
+	fs = NewOwnerFileSystem(NewLoopbackFileSystem(dir), &OwnerOptions{
+		Uids: map[uint32]uint32{uint32(os.Getuid()): 42},
+		Gids: map[uint32]uint32{},
+	})
+	if a, _ := fs.GetAttr("file", nil); a.Uid != 42 || a.Gid != uint32(os.Getgid()) {
+		t.Errorf("mapped: %v", a)
+	}
+}
@@ -0,0 +1,92 @@
+package fuse
+
+import (
+	"strings"
+	"testing"
+)
+
+// treeFs has a directory for every path, and accepts all renames and
+// removals.
+type treeFs struct {
+	DefaultFileSystem
+}
+
+func (fs *treeFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	return &Attr{Mode: S_IFDIR | 0755}, OK
+}
+
+func (fs *treeFs) Rename(oldName string, newName string, context *Context) Status {
+	return OK
+}
+
+func (fs *treeFs) Rmdir(name string, context *Context) Status {
+	return OK
+}
+
+func TestPathCache(t *testing.T) {
+	pfs := NewPathNodeFs(&treeFs{}, nil)
+	NewFileSystemConnector(pfs, nil)
+
+	node := pfs.LookupNode("a/b/c")
+	if p := pfs.Path(node); p != "a/b/c" {
+		t.Fatalf("got %q, want a/b/c", p)
+	}
+	// Also caches the paths of a and a/b.
+	if p := pfs.Path(pfs.Node("a/b")); p != "a/b" {
+		t.Errorf("got %q, want a/b", p)
+	}
+
+	root := pfs.Root().(*pathInode)
+	if code := root.Rename("a", root, "x", nil); !code.Ok() {
+		t.Fatal("Rename:", code)
+	}
+	if p := pfs.Path(node); p != "x/b/c" {
+		t.Errorf("after rename: got %q, want x/b/c", p)
+	}
+
+	b := pfs.Node("x/b").FsNode().(*pathInode)
+	if code := b.Rmdir("c", nil); !code.Ok() {
+		t.Fatal("Rmdir:", code)
+	}
+	if p := pfs.Path(node); p != ".deleted" {
+		t.Errorf("after rmdir: got %q, want .deleted", p)
+	}
+}
+
+// A rename only invalidates the cached paths below the renamed node.
+func TestPathCacheRenameKeepsOthers(t *testing.T) {
+	pfs := NewPathNodeFs(&treeFs{}, nil)
+	NewFileSystemConnector(pfs, nil)
+
+	moved := pfs.LookupNode("a/b").FsNode().(*pathInode)
+	other := pfs.LookupNode("c/d").FsNode().(*pathInode)
+	moved.GetPath()
+	other.GetPath()
+	ver := other.cacheVer
+
+	root := pfs.Root().(*pathInode)
+	if code := root.Rename("a", root, "x", nil); !code.Ok() {
+		t.Fatal("Rename:", code)
+	}
+	if p := moved.GetPath(); p != "x/b" {
+		t.Errorf("after rename: got %q, want x/b", p)
+	}
+	if p := other.GetPath(); p != "c/d" {
+		t.Errorf("after rename: got %q, want c/d", p)
+	}
+	if other.cacheVer != ver {
+		t.Errorf("path of c/d was recomputed after renaming a")
+	}
+}
+
+func BenchmarkPathCacheGetPath(b *testing.B) {
+	pfs := NewPathNodeFs(&treeFs{}, nil)
+	NewFileSystemConnector(pfs, nil)
+	node := pfs.LookupNode(strings.Repeat("dir/", 20) + "file")
+	pNode := node.FsNode().(*pathInode)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pNode.GetPath()
+	}
+}
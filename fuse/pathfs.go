@@ -1,10 +1,19 @@
 package fuse
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
 )
 
 var _ = log.Println
@@ -30,12 +39,23 @@ type PathNodeFs struct {
 	root      *pathInode
 	connector *FileSystemConnector
 
-	// protects clientInodeMap and pathInode.Parent pointers
-	pathLock sync.RWMutex
+	// Protects pathInode.Parent pointers, and changes to
+	// clientInodes.  Readers lock a shard chosen by the node.
+	pathLock shardedRWMutex
+
+	// This lists all the parent links known for a given
+	// client inode.
+	clientInodes *clientInodeTable
+
+	// Counter for the names of silly-renamed files, see
+	// options.SillyRename.  Protected by pathLock.
+	hiddenCount uint64
 
-	// This map lists all the parent links known for a given
-	// nodeId.
-	clientInodeMap map[uint64][]*clientInodePath
+	// With options.LinkKeys, client inode numbers are handed out
+	// per link key rather than taken from GetAttr.  Protected by
+	// pathLock.
+	linkKeyInodes map[string]uint64
+	nextLinkInode uint64
 
 	options *PathNodeFsOptions
 }
@@ -52,13 +72,33 @@ func (fs *PathNodeFs) Mount(path string, nodeFs NodeFileSystem, opts *FileSystem
 	return fs.connector.Mount(parent, name, nodeFs, opts)
 }
 
+// SubtreeFs returns a NodeFileSystem that shows the directory subdir
+// of this file system.  It uses the same FileSystem, so any caching
+// done by the FileSystem is shared between both views.  The kernel
+// caches of the two views are independent, so changes made through
+// one view may take up to the attribute and entry timeouts to show
+// up in the other.
+func (fs *PathNodeFs) SubtreeFs(subdir string) *PathNodeFs {
+	view := NewPathNodeFs(&subtreeFileSystem{
+		PrefixFileSystem{FileSystem: fs.fs, Prefix: subdir},
+	}, fs.options)
+	view.Debug = fs.Debug
+	return view
+}
+
+// MountSubtree mounts SubtreeFs(subdir) on path, using the
+// connector's submounts.  It can be removed with Unmount(path).
+func (fs *PathNodeFs) MountSubtree(path string, subdir string, opts *FileSystemOptions) Status {
+	return fs.Mount(path, fs.SubtreeFs(subdir), opts)
+}
+
 // Forgets all known information on client inodes.
 func (fs *PathNodeFs) ForgetClientInodes() {
 	if !fs.options.ClientInodes {
 		return
 	}
 	fs.pathLock.Lock()
-	fs.clientInodeMap = map[uint64][]*clientInodePath{}
+	fs.clientInodes.reset()
 	fs.root.forgetClientInodes()
 	fs.pathLock.Unlock()
 }
@@ -84,7 +124,8 @@ func (fs *PathNodeFs) Unmount(path string) Status {
 	return fs.connector.Unmount(node)
 }
 
-func (fs *PathNodeFs) OnUnmount() {
+func (fs *PathNodeFs) OnUnmount(reason UnmountReason) {
+	fs.fs.OnUnmount(reason)
 }
 
 func (fs *PathNodeFs) String() string {
@@ -134,6 +175,18 @@ func (fs *PathNodeFs) EntryNotify(dir string, name string) Status {
 	return fs.connector.EntryNotify(node, name)
 }
 
+// EntryNotifyMany drops the kernel's entries for names in dir, like
+// FileSystemConnector.EntryNotifyMany, so it can be called from file
+// system callbacks.
+func (fs *PathNodeFs) EntryNotifyMany(dir string, names []string) Status {
+	node, rest := fs.connector.Node(fs.root.Inode(), dir)
+	if len(rest) > 0 {
+		return ENOENT
+	}
+	fs.connector.EntryNotifyMany(node, names)
+	return OK
+}
+
 func (fs *PathNodeFs) Notify(path string) Status {
 	node, rest := fs.connector.Node(fs.root.Inode(), path)
 	if len(rest) > 0 {
@@ -142,6 +195,86 @@ func (fs *PathNodeFs) Notify(path string) Status {
 	return fs.connector.FileNotify(node, 0, 0)
 }
 
+// InvalidateTree invalidates the kernel's cached data, attributes
+// and entries for path and all nodes below it that we know of.
+// Entries the kernel has already forgotten are skipped; the first
+// other failure is returned.
+func (fs *PathNodeFs) InvalidateTree(path string) Status {
+	node, rest := fs.connector.Node(fs.root.Inode(), path)
+	if len(rest) > 0 {
+		return fs.connector.EntryNotify(node, rest[0])
+	}
+
+	type entry struct {
+		parent *Inode
+		name   string
+	}
+	nodes := []*Inode{node}
+	var entries []entry
+	for i := 0; i < len(nodes); i++ {
+		for name, ch := range nodes[i].FsChildren() {
+			nodes = append(nodes, ch)
+			entries = append(entries, entry{nodes[i], name})
+		}
+	}
+
+	result := OK
+	update := func(code Status) {
+		if result.Ok() && !code.Ok() && code != ENOENT {
+			result = code
+		}
+	}
+	for _, n := range nodes {
+		update(fs.connector.FileNotify(n, 0, 0))
+	}
+	// Deepest entries first, so the kernel drops leaves before
+	// their directories.
+	for i := len(entries) - 1; i >= 0; i-- {
+		update(fs.connector.EntryNotify(entries[i].parent, entries[i].name))
+	}
+	return result
+}
+
+// DumpTree returns a description of the nodes we know of, one per
+// line and indented by depth, with their node IDs, lookup counts and
+// open files, for debugging.  Mounts below the root are listed, but
+// not their contents.
+func (fs *PathNodeFs) DumpTree() string {
+	var b bytes.Buffer
+	fs.dumpNode(&b, fs.root.Inode(), "/", 0)
+	return b.String()
+}
+
+func (fs *PathNodeFs) dumpNode(b *bytes.Buffer, n *Inode, name string, depth int) {
+	fmt.Fprintf(b, "%s%s id=%d lookups=%d open=%d",
+		strings.Repeat("  ", depth), name, n.NodeId(), n.LookupCount(), len(n.Files(0)))
+	if m := n.mount; m != fs.root.Inode().mount {
+		fmt.Fprintf(b, " mount=%v\n", m.fs)
+		return
+	}
+	if p, ok := n.FsNode().(*pathInode); ok {
+		unlock := p.RLockTree()
+		if fs.trackLinks() && p.clientInode != 0 {
+			fmt.Fprintf(b, " clientInode=%d", p.clientInode)
+		}
+		if p.hidden {
+			b.WriteString(" hidden")
+		}
+		unlock()
+	}
+	b.WriteString("\n")
+
+	children := n.Children()
+	names := make([]string, 0, len(children))
+	for k := range children {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fs.dumpNode(b, children[k], k, depth+1)
+	}
+}
+
 func (fs *PathNodeFs) AllFiles(name string, mask uint32) []WithFlags {
 	n := fs.Node(name)
 	if n == nil {
@@ -157,21 +290,61 @@ func NewPathNodeFs(fs FileSystem, opts *PathNodeFsOptions) *PathNodeFs {
 	if opts == nil {
 		opts = &PathNodeFsOptions{}
 	}
+	if opts.RewritePath != nil {
+		root.fs = &rewriteFileSystem{fs, opts.RewritePath}
+	}
 
 	pfs := &PathNodeFs{
-		fs:             fs,
-		root:           root,
-		clientInodeMap: map[uint64][]*clientInodePath{},
-		options:        opts,
+		fs:            fs,
+		root:          root,
+		clientInodes:  newClientInodeTable(),
+		linkKeyInodes: map[string]uint64{},
+		options:       opts,
 	}
 	root.pathFs = pfs
+	root.stableIno = raw.FUSE_ROOT_ID
 	return pfs
 }
 
+func (fs *PathNodeFs) stableInodes() bool {
+	return fs.options.StableInodes
+}
+
+func (fs *PathNodeFs) readOnly() bool {
+	return fs.options.ReadOnly
+}
+
 func (fs *PathNodeFs) Root() FsNode {
 	return fs.root
 }
 
+// trackLinks returns true if hard-linked files are kept in the
+// clientInodeMap.
+func (fs *PathNodeFs) trackLinks() bool {
+	return fs.options.ClientInodes || fs.options.LinkKeys
+}
+
+// keyInode returns the client inode number for a link key, allocating
+// one for new keys.  Must be called with pathLock held for writing.
+func (fs *PathNodeFs) keyInode(key string) uint64 {
+	ino := fs.linkKeyInodes[key]
+	if ino == 0 {
+		fs.nextLinkInode++
+		ino = fs.nextLinkInode
+		fs.linkKeyInodes[key] = ino
+	}
+	return ino
+}
+
+// forgetClientInode drops the links of node.  Must be called with
+// pathLock held for writing.
+func (fs *PathNodeFs) forgetClientInode(node *pathInode) {
+	fs.clientInodes.drop(node.clientInode)
+	if node.linkKey != "" {
+		delete(fs.linkKeyInodes, node.linkKey)
+	}
+}
+
 // This is a combination of dentry (entry in the file/directory and
 // the inode). This structure is used to implement glue for FSes where
 // there is a one-to-one mapping of paths and inodes.
@@ -187,6 +360,40 @@ type pathInode struct {
 	// real filesystem.
 	clientInode uint64
 
+	// The inode number for the kernel, with
+	// options.StableInodes.  Protected by pathLock.
+	stableIno uint64
+
+	// The FileSystem.LinkKey the clientInode was allocated for,
+	// with options.LinkKeys.
+	linkKey string
+
+	// With options.CaseInsensitive, maps the lower case names of
+	// the children to the names they are stored under.  Protected
+	// by pathLock.
+	folded map[string]string
+
+	// Set if the node was unlinked while open, and renamed to a
+	// hidden name until the last file is released.  Protected by
+	// pathLock.
+	hidden bool
+
+	// Incremented when Parent or Name change.  Protected by
+	// pathLock.
+	gen uint64
+
+	// The result of the last getPath.  It is valid while gen is
+	// cacheGen and the version of the parent's path is
+	// cacheParentVer; cacheVer changes with every new result.
+	// Readers of pathLock fill it in, so it has a lock of its own.
+	cacheMutex     sync.Mutex
+	cachedPath     string
+	cachedOk       bool
+	cacheValid     bool
+	cacheGen       uint64
+	cacheParentVer uint64
+	cacheVer       uint64
+
 	DefaultFsNode
 }
 
@@ -208,49 +415,159 @@ func (n *pathInode) updateClientInodes() {
 
 func (n *pathInode) LockTree() func() {
 	n.pathFs.pathLock.Lock()
-	return func() { n.pathFs.pathLock.Unlock() }
+	return n.pathFs.pathLock.Unlock
 }
 
 func (n *pathInode) RLockTree() func() {
-	n.pathFs.pathLock.RLock()
-	return func() { n.pathFs.pathLock.RUnlock() }
+	return n.pathFs.pathLock.rlock(uintptr(unsafe.Pointer(n))).RUnlock
 }
 
 // GetPath returns the path relative to the mount governing this
-// inode.  It returns nil for mount if the file was deleted or the
-// filesystem unmounted.
+// inode.  If the file was deleted or the filesystem unmounted, it
+// returns the path from options.DeletedResolver, or ".deleted".
 func (n *pathInode) GetPath() (path string) {
+	path, code := n.path()
+	if !code.Ok() {
+		return ".deleted"
+	}
+	return path
+}
+
+// path returns the path to pass to the FileSystem for n.  For a node
+// that is no longer in the tree, it applies options.DeletedNodes and
+// options.DeletedResolver.
+func (n *pathInode) path() (string, Status) {
+	unlock := n.RLockTree()
+	path, ok := n.getPath()
+	unlock()
+	if ok {
+		if n.pathFs.Debug {
+			log.Printf("Inode %d = %q (%s)", n.Inode().nodeId, path, n.fs.String())
+		}
+		return path, OK
+	}
+
+	opts := n.pathFs.options
+	switch {
+	case opts.DeletedResolver != nil:
+		return opts.DeletedResolver(n.Inode())
+	case opts.DeletedNodes == DELETED_PATH:
+		return ".deleted", OK
+	}
+	return "", ESTALE
+}
+
+// childPath returns the path of the child name of n.
+func (n *pathInode) childPath(name string) (string, Status) {
+	p, code := n.path()
+	return filepath.Join(p, name), code
+}
+
+// deleted returns true if n is no longer in the tree.
+func (n *pathInode) deleted() bool {
 	defer n.RLockTree()()
+	_, ok := n.getPath()
+	return !ok
+}
+
+// getPath returns the path of n, and false if n is not connected to
+// the root.  Paths are cached per node, and a cached path is used as
+// long as no node on the way to the root moved, so renaming a
+// directory only affects the nodes below it.  Must be called with
+// pathLock held.
+func (n *pathInode) getPath() (path string, ok bool) {
+	path, ok, _ = n.versionedPath()
+	return path, ok
+}
 
-	rev_components := make([]string, 0, 10)
-	p := n
-	for ; p.Parent != nil; p = p.Parent {
-		rev_components = append(rev_components, p.Name)
+// versionedPath is getPath, and also returns the version of the
+// result, which changes when the path changes.
+func (n *pathInode) versionedPath() (path string, ok bool, ver uint64) {
+	var parentPath string
+	var parentOk bool
+	var parentVer uint64
+	if n.Parent != nil {
+		parentPath, parentOk, parentVer = n.Parent.versionedPath()
 	}
-	if p != p.pathFs.root {
-		return ".deleted"
+
+	n.cacheMutex.Lock()
+	defer n.cacheMutex.Unlock()
+	if n.cacheValid && n.cacheGen == n.gen && n.cacheParentVer == parentVer {
+		return n.cachedPath, n.cachedOk, n.cacheVer
 	}
-	path = ReverseJoin(rev_components, "/")
-	if n.pathFs.Debug {
-		log.Printf("Inode %d = %q (%s)", n.Inode().nodeId, path, n.fs.String())
+
+	switch {
+	case n.Parent != nil:
+		path, ok = parentPath, parentOk
+		if ok && path != "" {
+			path = path + "/" + n.Name
+		} else if ok {
+			path = n.Name
+		}
+	case n == n.pathFs.root:
+		ok = true
+	}
+	if !ok {
+		path = ""
 	}
 
-	return path
+	n.cachedPath, n.cachedOk = path, ok
+	n.cacheValid, n.cacheGen, n.cacheParentVer = true, n.gen, parentVer
+	n.cacheVer++
+	return path, ok, n.cacheVer
+}
+
+// setParent moves n to name in parent, or detaches it if parent is
+// nil.  Must be called with pathLock held for writing.
+func (n *pathInode) setParent(parent *pathInode, name string) {
+	n.gen++
+	n.Parent = parent
+	n.Name = name
 }
 
 func (n *pathInode) addChild(name string, child *pathInode) {
 	n.Inode().AddChild(name, child.Inode())
-	child.Parent = n
-	child.Name = name
 
-	if child.clientInode > 0 && n.pathFs.options.ClientInodes {
-		defer n.LockTree()()
-		m := n.pathFs.clientInodeMap[child.clientInode]
-		e := &clientInodePath{
-			n, name, child,
+	defer n.LockTree()()
+	child.setParent(n, name)
+	n.registerChild(name, child)
+}
+
+// addNewChild adds the new node child as name, unless a concurrent
+// lookup added a child by that name first, and returns the child in
+// the tree.
+func (n *pathInode) addNewChild(name string, child *pathInode) *pathInode {
+	// The parent is set first, so a lookup that finds the child
+	// before it is registered can compute its path.
+	unlock := n.LockTree()
+	child.setParent(n, name)
+	unlock()
+	if ch := n.Inode().addChildOnce(name, child.Inode()); ch != child.Inode() {
+		return ch.FsNode().(*pathInode)
+	}
+
+	defer n.LockTree()()
+	n.registerChild(name, child)
+	return child
+}
+
+// registerChild records the new child name in the indexes of the
+// file system.  Must be called with pathLock held for writing.
+func (n *pathInode) registerChild(name string, child *pathInode) {
+	if n.pathFs.options.StableInodes && child.stableIno == 0 {
+		p, _ := child.getPath()
+		child.stableIno = pathIno(p)
+	}
+	if n.pathFs.options.CaseInsensitive {
+		if n.folded == nil {
+			n.folded = map[string]string{}
 		}
-		m = append(m, e)
-		n.pathFs.clientInodeMap[child.clientInode] = m
+		n.folded[strings.ToLower(name)] = name
+	}
+	if child.clientInode > 0 && n.pathFs.trackLinks() {
+		n.pathFs.clientInodes.add(child.clientInode, &clientInodePath{
+			n, name, child,
+		})
 	}
 }
 
@@ -261,32 +578,19 @@ func (n *pathInode) rmChild(name string) *pathInode {
 	}
 	ch := childInode.FsNode().(*pathInode)
 
-	if ch.clientInode > 0 && n.pathFs.options.ClientInodes {
-		defer n.LockTree()()
-		m := n.pathFs.clientInodeMap[ch.clientInode]
-
-		idx := -1
-		for i, v := range m {
-			if v.parent == n && v.name == name {
-				idx = i
-				break
-			}
-		}
-		if idx >= 0 {
-			m[idx] = m[len(m)-1]
-			m = m[:len(m)-1]
-		}
-		if len(m) > 0 {
-			ch.Parent = m[0].parent
-			ch.Name = m[0].name
+	defer n.LockTree()()
+	if n.folded != nil {
+		delete(n.folded, strings.ToLower(name))
+	}
+	if ch.clientInode > 0 && n.pathFs.trackLinks() {
+		if next := n.pathFs.clientInodes.remove(ch.clientInode, n, name); next != nil {
+			ch.setParent(next.parent, next.name)
 			return ch
-		} else {
-			delete(n.pathFs.clientInodeMap, ch.clientInode)
 		}
+		n.pathFs.forgetClientInode(ch)
 	}
 
-	ch.Name = ".deleted"
-	ch.Parent = nil
+	ch.setParent(nil, ".deleted")
 
 	return ch
 }
@@ -294,12 +598,12 @@ func (n *pathInode) rmChild(name string) *pathInode {
 // Handle a change in clientInode number for an other wise unchanged
 // pathInode.
 func (n *pathInode) setClientInode(ino uint64) {
-	if ino == n.clientInode || !n.pathFs.options.ClientInodes {
+	if ino == n.clientInode || !n.pathFs.trackLinks() {
 		return
 	}
 	defer n.LockTree()()
 	if n.clientInode != 0 {
-		delete(n.pathFs.clientInodeMap, n.clientInode)
+		n.pathFs.clientInodes.drop(n.clientInode)
 	}
 
 	n.clientInode = ino
@@ -307,64 +611,225 @@ func (n *pathInode) setClientInode(ino uint64) {
 		e := &clientInodePath{
 			n.Parent, n.Name, n,
 		}
-		n.pathFs.clientInodeMap[ino] = append(n.pathFs.clientInodeMap[ino], e)
+		n.pathFs.clientInodes.add(ino, e)
 	}
 }
 
 func (n *pathInode) OnForget() {
-	if n.clientInode == 0 || !n.pathFs.options.ClientInodes {
+	if n.clientInode == 0 || !n.pathFs.trackLinks() {
 		return
 	}
 	defer n.LockTree()()
-	delete(n.pathFs.clientInodeMap, n.clientInode)
+	n.pathFs.forgetClientInode(n)
+}
+
+// linkKeyInode returns the client inode number for the file at
+// fullPath from its LinkKey, and the key.  Files with a single link
+// are not asked, and get 0.
+func (n *pathInode) linkKeyInode(fullPath string, fi *Attr, context *Context) (uint64, string) {
+	if fi.IsDir() || fi.Nlink < 2 {
+		return 0, ""
+	}
+	key, code := n.fs.LinkKey(fullPath, context)
+	if !code.Ok() || key == "" {
+		return 0, ""
+	}
+	defer n.LockTree()()
+	return n.pathFs.keyInode(key), key
 }
 
 ////////////////////////////////////////////////////////////////
 // FS operations
 
 func (n *pathInode) StatFs() *StatfsOut {
-	return n.fs.StatFs(n.GetPath())
+	p, code := n.path()
+	if !code.Ok() {
+		return nil
+	}
+	return n.fs.StatFs(p)
+}
+
+func (n *pathInode) SyncFs(context *Context) (code Status) {
+	return n.fs.SyncFs(context)
+}
+
+func (n *pathInode) FsyncDir(flags int, context *Context) (code Status) {
+	p, code := n.path()
+	if !code.Ok() {
+		return code
+	}
+	return n.fs.FsyncDir(p, flags, context)
 }
 
 func (n *pathInode) Readlink(c *Context) ([]byte, Status) {
-	path := n.GetPath()
+	path, code := n.path()
+	if !code.Ok() {
+		return nil, code
+	}
 
 	val, err := n.fs.Readlink(path, c)
+	if err.Ok() && n.pathFs.options.RewriteSymlink != nil {
+		val, err = n.pathFs.options.RewriteSymlink(path, val)
+	}
 	return []byte(val), err
 }
 
 func (n *pathInode) Access(mode uint32, context *Context) (code Status) {
-	p := n.GetPath()
+	if n.pathFs.options.ReadOnly && mode&raw.W_OK != 0 {
+		return EROFS
+	}
+	p, code := n.path()
+	if !code.Ok() {
+		return code
+	}
 	return n.fs.Access(p, mode, context)
 }
 
 func (n *pathInode) GetXAttr(attribute string, context *Context) (data []byte, code Status) {
-	return n.fs.GetXAttr(n.GetPath(), attribute, context)
+	p, code := n.path()
+	if !code.Ok() {
+		return nil, code
+	}
+	return n.fs.GetXAttr(p, attribute, context)
 }
 
 func (n *pathInode) RemoveXAttr(attr string, context *Context) Status {
-	p := n.GetPath()
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
+	p, code := n.path()
+	if !code.Ok() {
+		return code
+	}
 	return n.fs.RemoveXAttr(p, attr, context)
 }
 
 func (n *pathInode) SetXAttr(attr string, data []byte, flags int, context *Context) Status {
-	return n.fs.SetXAttr(n.GetPath(), attr, data, flags, context)
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
+	p, code := n.path()
+	if !code.Ok() {
+		return code
+	}
+	return n.fs.SetXAttr(p, attr, data, flags, context)
 }
 
 func (n *pathInode) ListXAttr(context *Context) (attrs []string, code Status) {
-	return n.fs.ListXAttr(n.GetPath(), context)
+	p, code := n.path()
+	if !code.Ok() {
+		return nil, code
+	}
+	return n.fs.ListXAttr(p, context)
 }
 
 func (n *pathInode) Flush(file File, openFlags uint32, context *Context) (code Status) {
-	return file.Flush()
+	return file.Flush(&FlushIn{})
 }
 
 func (n *pathInode) OpenDir(context *Context) ([]DirEntry, Status) {
-	return n.fs.OpenDir(n.GetPath(), context)
+	p, code := n.path()
+	if !code.Ok() {
+		return nil, code
+	}
+	stream, code := n.fs.OpenDir(p, context)
+	if !code.Ok() {
+		return stream, code
+	}
+
+	n.fillDirEntries(p, stream, context)
+	return stream, code
+}
+
+// fillDirEntries completes the types, if FillDirEntryTypes is set,
+// and the inode numbers of entries of the directory p.
+func (n *pathInode) fillDirEntries(p string, stream []DirEntry, context *Context) {
+	for i := range stream {
+		e := &stream[i]
+		fullPath := filepath.Join(p, e.Name)
+		if n.pathFs.options.FillDirEntryTypes && e.Mode&syscall.S_IFMT == S_IFUNKNOWN {
+			if a, c := n.fs.GetAttr(fullPath, context); c.Ok() {
+				e.Mode = a.Mode
+				if e.Ino == 0 {
+					e.Ino = a.Ino
+				}
+			}
+		}
+		if n.pathFs.options.StableInodes {
+			e.Ino = n.direntIno(e.Name, fullPath)
+		}
+	}
+}
+
+func (n *pathInode) OpenDirStream(context *Context) (DirStream, Status) {
+	p, code := n.path()
+	if !code.Ok() {
+		return nil, code
+	}
+	stream, code := n.fs.OpenDirStream(p, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &pathDirStream{stream, n, p}, OK
+}
+
+// pathDirStream fills in the entries read from a DirStream, as
+// OpenDir does.
+type pathDirStream struct {
+	DirStream
+	node *pathInode
+	path string
+}
+
+func (s *pathDirStream) ReadDir(offset uint64, context *Context) ([]DirEntry, Status) {
+	entries, code := s.DirStream.ReadDir(offset, context)
+	if code.Ok() {
+		s.node.fillDirEntries(s.path, entries, context)
+	}
+	return entries, code
+}
+
+// direntIno returns the d_ino for the entry name with
+// options.StableInodes: the number that stat shows for a known child,
+// or else the hash of the path that it will get.
+func (n *pathInode) direntIno(name string, fullPath string) uint64 {
+	var ch *Inode
+	if n.Inode() != nil {
+		ch = n.Inode().GetChild(name)
+	}
+	if ch != nil && !n.pathFs.options.LinkKeys {
+		if child, ok := ch.FsNode().(*pathInode); ok {
+			unlock := n.RLockTree()
+			ino := child.stableIno
+			unlock()
+			if ino != 0 {
+				return ino
+			}
+		}
+	}
+	return pathIno(fullPath)
+}
+
+// pathIno hashes a path into an inode number.  It avoids the numbers
+// with a special meaning, including that of the root.
+func pathIno(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	ino := h.Sum64()
+	if ino <= raw.FUSE_ROOT_ID || ino == raw.FUSE_UNKNOWN_INO {
+		ino = raw.FUSE_ROOT_ID + 1
+	}
+	return ino
 }
 
 func (n *pathInode) Mknod(name string, mode uint32, dev uint32, context *Context) (newNode FsNode, code Status) {
-	fullPath := filepath.Join(n.GetPath(), name)
+	if n.pathFs.options.ReadOnly {
+		return nil, EROFS
+	}
+	fullPath, code := n.childPath(name)
+	if !code.Ok() {
+		return nil, code
+	}
 	code = n.fs.Mknod(fullPath, mode, dev, context)
 	if code.Ok() {
 		pNode := n.createChild(false)
@@ -375,7 +840,13 @@ func (n *pathInode) Mknod(name string, mode uint32, dev uint32, context *Context
 }
 
 func (n *pathInode) Mkdir(name string, mode uint32, context *Context) (newNode FsNode, code Status) {
-	fullPath := filepath.Join(n.GetPath(), name)
+	if n.pathFs.options.ReadOnly {
+		return nil, EROFS
+	}
+	fullPath, code := n.childPath(name)
+	if !code.Ok() {
+		return nil, code
+	}
 	code = n.fs.Mkdir(fullPath, mode, context)
 	if code.Ok() {
 		pNode := n.createChild(true)
@@ -385,16 +856,157 @@ func (n *pathInode) Mkdir(name string, mode uint32, context *Context) (newNode F
 	return
 }
 
+// storedName returns the name under which a child that equals name
+// ignoring case is stored, with options.CaseInsensitive.  Otherwise,
+// or if there is no such child, it returns name.
+func (n *pathInode) storedName(name string) string {
+	if !n.pathFs.options.CaseInsensitive {
+		return name
+	}
+	defer n.RLockTree()()
+	if stored, ok := n.folded[strings.ToLower(name)]; ok {
+		return stored
+	}
+	return name
+}
+
+// scanName looks for an entry that equals name ignoring case in the
+// directory listing, for children that are not known yet.
+func (n *pathInode) scanName(name string, context *Context) (string, bool) {
+	p, code := n.path()
+	if !code.Ok() {
+		return name, false
+	}
+	entries, code := n.fs.OpenDir(p, context)
+	if !code.Ok() {
+		return name, false
+	}
+	key := strings.ToLower(name)
+	for _, e := range entries {
+		if e.Name != name && strings.ToLower(e.Name) == key {
+			return e.Name, true
+		}
+	}
+	return name, false
+}
+
 func (n *pathInode) Unlink(name string, context *Context) (code Status) {
-	code = n.fs.Unlink(filepath.Join(n.GetPath(), name), context)
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
+	name = n.storedName(name)
+	if ch := n.openChild(name); ch != nil {
+		return n.sillyRename(name, ch, context)
+	}
+	fullPath, code := n.childPath(name)
+	if !code.Ok() {
+		return code
+	}
+	code = n.fs.Unlink(fullPath, context)
 	if code.Ok() {
 		n.rmChild(name)
 	}
 	return code
 }
 
+// openChild returns the child name, if options.SillyRename is set and
+// removing the child would leave open files without a path.
+func (n *pathInode) openChild(name string) *pathInode {
+	if !n.pathFs.options.SillyRename {
+		return nil
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil || ch.IsDir() || len(ch.Files(0)) == 0 {
+		return nil
+	}
+	child := ch.FsNode().(*pathInode)
+	if child.clientInode > 0 && n.pathFs.trackLinks() {
+		if _, links := n.pathFs.clientInodes.node(child.clientInode); links > 1 {
+			// Other names keep the file reachable.
+			return nil
+		}
+	}
+	return child
+}
+
+// sillyRename moves the open child name to a hidden name, like NFS
+// clients do, so path based operations on the open files keep
+// working.  The hidden file is removed when the last file is
+// released.
+func (n *pathInode) sillyRename(name string, ch *pathInode, context *Context) Status {
+	unlock := n.LockTree()
+	n.pathFs.hiddenCount++
+	hidden := fmt.Sprintf(".fuse_hidden%016x", n.pathFs.hiddenCount)
+	unlock()
+
+	dir, code := n.path()
+	if !code.Ok() {
+		return code
+	}
+	code = n.fs.Rename(filepath.Join(dir, name), filepath.Join(dir, hidden), context)
+	if !code.Ok() {
+		return code
+	}
+	n.rmChild(name)
+	n.addChild(hidden, ch)
+
+	unlock = n.LockTree()
+	ch.hidden = true
+	unlock()
+
+	// The last file may have been released meanwhile.
+	ch.removeHidden()
+	return OK
+}
+
+// removeHidden removes a silly-renamed file once it is no longer open.
+func (n *pathInode) removeHidden() {
+	if len(n.Inode().Files(0)) > 0 {
+		return
+	}
+	unlock := n.LockTree()
+	parent, name, hidden := n.Parent, n.Name, n.hidden
+	n.hidden = false
+	unlock()
+	if !hidden || parent == nil {
+		return
+	}
+	p, code := parent.childPath(name)
+	if code.Ok() {
+		code = n.fs.Unlink(p, nil)
+	}
+	if !code.Ok() {
+		log.Printf("removing %q: %v", name, code)
+	}
+	parent.rmChild(name)
+}
+
+// sillyFile removes the hidden name of its node, if any, when the
+// last open file of the node is released.
+type sillyFile struct {
+	File
+	node *pathInode
+}
+
+func (f *sillyFile) InnerFile() File {
+	return f.File
+}
+
+func (f *sillyFile) Release(input *ReleaseIn) {
+	f.File.Release(input)
+	f.node.removeHidden()
+}
+
 func (n *pathInode) Rmdir(name string, context *Context) (code Status) {
-	code = n.fs.Rmdir(filepath.Join(n.GetPath(), name), context)
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
+	name = n.storedName(name)
+	fullPath, code := n.childPath(name)
+	if !code.Ok() {
+		return code
+	}
+	code = n.fs.Rmdir(fullPath, context)
 	if code.Ok() {
 		n.rmChild(name)
 	}
@@ -402,7 +1014,13 @@ func (n *pathInode) Rmdir(name string, context *Context) (code Status) {
 }
 
 func (n *pathInode) Symlink(name string, content string, context *Context) (newNode FsNode, code Status) {
-	fullPath := filepath.Join(n.GetPath(), name)
+	if n.pathFs.options.ReadOnly {
+		return nil, EROFS
+	}
+	fullPath, code := n.childPath(name)
+	if !code.Ok() {
+		return nil, code
+	}
 	code = n.fs.Symlink(content, fullPath, context)
 	if code.Ok() {
 		pNode := n.createChild(false)
@@ -413,54 +1031,113 @@ func (n *pathInode) Symlink(name string, content string, context *Context) (newN
 }
 
 func (n *pathInode) Rename(oldName string, newParent FsNode, newName string, context *Context) (code Status) {
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
 	p := newParent.(*pathInode)
-	oldPath := filepath.Join(n.GetPath(), oldName)
-	newPath := filepath.Join(p.GetPath(), newName)
+	oldName = n.storedName(oldName)
+	if stored := p.storedName(newName); stored != oldName || p != n {
+		// Changing only the case of a name keeps the new
+		// spelling.
+		newName = stored
+	}
+	oldPath, code := n.childPath(oldName)
+	if !code.Ok() {
+		return code
+	}
+	newPath, code := p.childPath(newName)
+	if !code.Ok() {
+		return code
+	}
+	if target := p.openChild(newName); target != nil {
+		// The target would be gone, so move it aside first.
+		if code = p.sillyRename(newName, target, context); !code.Ok() {
+			return code
+		}
+	}
 	code = n.fs.Rename(oldPath, newPath, context)
 	if code.Ok() {
 		ch := n.rmChild(oldName)
 		p.rmChild(newName)
-		p.addChild(newName, ch)
+		if ch != nil {
+			p.addChild(newName, ch)
+
+			unlock := n.LockTree()
+			ch.hidden = false
+			unlock()
+		}
 	}
 	return code
 }
 
 func (n *pathInode) Link(name string, existingFsnode FsNode, context *Context) (newNode FsNode, code Status) {
-	if !n.pathFs.options.ClientInodes {
+	if n.pathFs.options.ReadOnly {
+		return nil, EROFS
+	}
+	if !n.pathFs.trackLinks() {
 		return nil, ENOSYS
 	}
 
-	newPath := filepath.Join(n.GetPath(), name)
+	newPath, code := n.childPath(name)
+	if !code.Ok() {
+		return nil, code
+	}
 	existing := existingFsnode.(*pathInode)
-	oldPath := existing.GetPath()
+	oldPath, code := existing.path()
+	if !code.Ok() {
+		return nil, code
+	}
 	code = n.fs.Link(oldPath, newPath, context)
 
 	var a *Attr
 	if code.Ok() {
 		a, code = n.fs.GetAttr(newPath, context)
 	}
+	if !code.Ok() {
+		return nil, code
+	}
 
-	if code.Ok() {
-		if existing.clientInode != 0 && existing.clientInode == a.Ino {
-			newNode = existing
-			n.addChild(name, existing)
-		} else {
-			pNode := n.createChild(false)
-			newNode = pNode
-			pNode.clientInode = a.Ino
-			n.addChild(name, pNode)
+	ino, key := a.Ino, ""
+	if n.pathFs.options.LinkKeys {
+		if existing.clientInode == 0 {
+			// existing had a single link when it was
+			// looked up, so it has no key yet.
+			eIno, eKey := existing.linkKeyInode(oldPath, a, context)
+			existing.linkKey = eKey
+			existing.setClientInode(eIno)
 		}
+		ino, key = n.linkKeyInode(newPath, a, context)
 	}
-	return
+
+	if existing.clientInode != 0 && existing.clientInode == ino {
+		newNode = existing
+		n.addChild(name, existing)
+	} else {
+		pNode := n.createChild(false)
+		newNode = pNode
+		pNode.clientInode = ino
+		pNode.linkKey = key
+		n.addChild(name, pNode)
+	}
+	return newNode, OK
 }
 
 func (n *pathInode) Create(name string, flags uint32, mode uint32, context *Context) (file File, newNode FsNode, code Status) {
-	fullPath := filepath.Join(n.GetPath(), name)
+	if n.pathFs.options.ReadOnly {
+		return nil, nil, EROFS
+	}
+	fullPath, code := n.childPath(name)
+	if !code.Ok() {
+		return nil, nil, code
+	}
 	file, code = n.fs.Create(fullPath, flags, mode, context)
 	if code.Ok() {
 		pNode := n.createChild(false)
 		newNode = pNode
 		n.addChild(name, pNode)
+		if n.pathFs.options.SillyRename {
+			file = &sillyFile{file, pNode}
+		}
 	}
 	return
 }
@@ -475,134 +1152,240 @@ func (n *pathInode) createChild(isDir bool) *pathInode {
 }
 
 func (n *pathInode) Open(flags uint32, context *Context) (file File, code Status) {
-	file, code = n.fs.Open(n.GetPath(), flags, context)
+	if n.pathFs.options.ReadOnly && flags&O_ANYWRITE != 0 {
+		return nil, EROFS
+	}
+	p, code := n.path()
+	if !code.Ok() {
+		return nil, code
+	}
+	file, code = n.fs.Open(p, flags, context)
+	if code.Ok() && n.pathFs.options.SillyRename {
+		file = &sillyFile{file, n}
+	}
 	if n.pathFs.Debug {
 		file = &WithFlags{
 			File:        file,
-			Description: n.GetPath(),
+			Description: p,
 		}
 	}
 	return
 }
 
 func (n *pathInode) Lookup(out *Attr, name string, context *Context) (node FsNode, code Status) {
-	fullPath := filepath.Join(n.GetPath(), name)
+	name = n.storedName(name)
+	dir, code := n.path()
+	if !code.Ok() {
+		return nil, code
+	}
+	fullPath := filepath.Join(dir, name)
 	fi, code := n.fs.GetAttr(fullPath, context)
+	if code == ENOENT && n.pathFs.options.CaseInsensitive {
+		if stored, ok := n.scanName(name, context); ok {
+			name = stored
+			fullPath = filepath.Join(dir, name)
+			fi, code = n.fs.GetAttr(fullPath, context)
+		}
+	}
 	if code.Ok() {
-		node = n.findChild(fi, name, fullPath)
+		child := n.findChild(fi, name, fullPath, context)
 		*out = *fi
+		child.setStableIno(out)
+		node = child
 	}
 
 	return node, code
 }
 
-func (n *pathInode) findChild(fi *Attr, name string, fullPath string) (out *pathInode) {
-	if fi.Ino > 0 {
+// setStableIno puts the inode number of n into out, with
+// options.StableInodes.
+func (n *pathInode) setStableIno(out *Attr) {
+	if n.pathFs.options.StableInodes {
 		unlock := n.RLockTree()
-		v := n.pathFs.clientInodeMap[fi.Ino]
-		if len(v) > 0 {
-			out = v[0].node
+		out.Ino = n.stableIno
+		unlock()
+	}
+}
 
-			if fi.Nlink == 1 {
-				log.Println("Found linked inode, but Nlink == 1", fullPath)
-			}
+func (n *pathInode) findChild(fi *Attr, name string, fullPath string, context *Context) (out *pathInode) {
+	ino, key := fi.Ino, ""
+	if n.pathFs.options.LinkKeys {
+		ino, key = n.linkKeyInode(fullPath, fi, context)
+	}
+	if ino > 0 {
+		out, _ = n.pathFs.clientInodes.node(ino)
+		if out != nil && fi.Nlink == 1 {
+			log.Println("Found linked inode, but Nlink == 1", fullPath)
 		}
-		unlock()
 	}
 
 	if out == nil {
-		out = n.createChild(fi.IsDir())
-		out.clientInode = fi.Ino
-		n.addChild(name, out)
+		// With parallel dirops, a concurrent lookup for the
+		// same name may add the child first; then both
+		// return that one.
+		ch := n.createChild(fi.IsDir())
+		ch.clientInode = ino
+		ch.linkKey = key
+		out = n.addNewChild(name, ch)
 	}
 
 	return out
 }
 
 func (n *pathInode) GetAttr(out *Attr, file File, context *Context) (code Status) {
-	var fi *Attr
-	if file == nil {
-		// called on a deleted files.
-		file = n.inode.AnyFile()
-	}
-
 	if file != nil {
+		// The kernel asks about a specific open file, eg. for
+		// lseek(SEEK_END).  Only the handle knows its state,
+		// and the path may be gone.
 		code = file.GetAttr(out)
+		if code != ENOSYS && code != EBADF {
+			return code
+		}
 	}
 
-	if file == nil || code == ENOSYS || code == EBADF {
-		fi, code = n.fs.GetAttr(n.GetPath(), context)
-		*out = *fi
+	var fi *Attr
+	p, code := n.path()
+	if code.Ok() {
+		fi, code = n.fs.GetAttr(p, context)
 	}
-
-	if fi != nil {
+	if (code == ENOENT || code == ESTALE && n.pathFs.options.DeletedNodes == DELETED_FILES) && file == nil {
+		// Called on a deleted file without a handle; ask an
+		// open file, if any.
+		if f := n.inode.AnyFile(); f != nil && f.GetAttr(out).Ok() {
+			return OK
+		}
+	}
+	if !code.Ok() || fi == nil {
+		return code
+	}
+	*out = *fi
+	if !n.pathFs.options.LinkKeys {
 		n.setClientInode(fi.Ino)
 	}
+	n.setStableIno(out)
 
-	if fi != nil && !fi.IsDir() && fi.Nlink == 0 {
-		fi.Nlink = 1
+	if !out.IsDir() && out.Nlink == 0 {
+		out.Nlink = 1
 	}
 	return code
 }
 
-func (n *pathInode) Chmod(file File, perms uint32, context *Context) (code Status) {
+// setattrFiles returns the open files that attribute changes are
+// tried on before the path: those open for writing, or with
+// DELETED_FILES, any of them once the node has lost its path.
+func (n *pathInode) setattrFiles() []WithFlags {
+	if n.pathFs.options.DeletedNodes == DELETED_FILES && n.deleted() {
+		return n.inode.Files(0)
+	}
+	return n.inode.Files(O_ANYWRITE)
+}
+
+// Setattr offers the whole change to file, and then to the open
+// files. If they do not implement Setattr, we return ENOSYS so the
+// connector applies it piecewise; the FileSystem API has no Setattr.
+func (n *pathInode) Setattr(file File, valid uint32, attr *Attr, context *Context) (code Status) {
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
 	files := n.inode.Files(O_ANYWRITE)
+	if file != nil {
+		files = append([]WithFlags{{File: file}}, files...)
+	}
+	code = ENOSYS
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Chmod(perms)
+		code = f.Setattr(valid, attr, context)
+		if code.Ok() {
+			return code
+		}
+	}
+	if code == EBADF {
+		code = ENOSYS
+	}
+	return code
+}
+
+func (n *pathInode) Chmod(file File, perms uint32, context *Context) (code Status) {
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
+	files := n.setattrFiles()
+	for _, f := range files {
+		code = f.Chmod(perms, context)
 		if code.Ok() {
 			return
 		}
 	}
 
 	if len(files) == 0 || code == ENOSYS || code == EBADF {
-		code = n.fs.Chmod(n.GetPath(), perms, context)
+		if p, c := n.path(); c.Ok() {
+			code = n.fs.Chmod(p, perms, context)
+		} else {
+			code = c
+		}
 	}
 	return code
 }
 
 func (n *pathInode) Chown(file File, uid uint32, gid uint32, context *Context) (code Status) {
-	files := n.inode.Files(O_ANYWRITE)
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
+	files := n.setattrFiles()
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Chown(uid, gid)
+		code = f.Chown(uid, gid, context)
 		if code.Ok() {
 			return code
 		}
 	}
 	if len(files) == 0 || code == ENOSYS || code == EBADF {
 		// TODO - can we get just FATTR_GID but not FATTR_UID ?
-		code = n.fs.Chown(n.GetPath(), uid, gid, context)
+		if p, c := n.path(); c.Ok() {
+			code = n.fs.Chown(p, uid, gid, context)
+		} else {
+			code = c
+		}
 	}
 	return code
 }
 
 func (n *pathInode) Truncate(file File, size uint64, context *Context) (code Status) {
-	files := n.inode.Files(O_ANYWRITE)
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
+	files := n.setattrFiles()
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Truncate(size)
+		code = f.Truncate(size, context)
 		if code.Ok() {
 			return code
 		}
 	}
 	if len(files) == 0 || code == ENOSYS || code == EBADF {
-		code = n.fs.Truncate(n.GetPath(), size, context)
+		if p, c := n.path(); c.Ok() {
+			code = n.fs.Truncate(p, size, context)
+		} else {
+			code = c
+		}
 	}
 	return code
 }
 
-func (n *pathInode) Utimens(file File, atime int64, mtime int64, context *Context) (code Status) {
-	files := n.inode.Files(O_ANYWRITE)
+func (n *pathInode) Utimens(file File, atime *time.Time, mtime *time.Time, context *Context) (code Status) {
+	if n.pathFs.options.ReadOnly {
+		return EROFS
+	}
+	files := n.setattrFiles()
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Utimens(atime, mtime)
+		code = f.Utimens(atime, mtime, context)
 		if code.Ok() {
 			return code
 		}
 	}
 	if len(files) == 0 || code == ENOSYS || code == EBADF {
-		code = n.fs.Utimens(n.GetPath(), atime, mtime, context)
+		if p, c := n.path(); c.Ok() {
+			code = n.fs.Utimens(p, atime, mtime, context)
+		} else {
+			code = c
+		}
 	}
 	return code
 }
@@ -0,0 +1,119 @@
+package fuse
+
+import (
+	"sync"
+)
+
+const lockShards = 16
+
+// shardedRWMutex is a read/write lock for read-mostly data.  A reader
+// locks one of several shards, chosen by a key, so readers of
+// different keys do not contend on the same reader count.  Writers
+// lock all shards.
+type shardedRWMutex struct {
+	shards [lockShards]struct {
+		sync.RWMutex
+
+		// Keep the shards on separate cache lines.
+		_ [64]byte
+	}
+}
+
+// rlock read-locks the shard for key, and returns it for RUnlock.
+func (m *shardedRWMutex) rlock(key uintptr) *sync.RWMutex {
+	// Fibonacci hashing; the top bits index the 16 shards.
+	h := uint32(key>>4) * 2654435761
+	s := &m.shards[h>>28].RWMutex
+	s.RLock()
+	return s
+}
+
+func (m *shardedRWMutex) Lock() {
+	for i := range m.shards {
+		m.shards[i].Lock()
+	}
+}
+
+func (m *shardedRWMutex) Unlock() {
+	for i := len(m.shards) - 1; i >= 0; i-- {
+		m.shards[i].Unlock()
+	}
+}
+
+// clientInodeTable lists the known names of each client inode.  It
+// is sharded by inode number, and has locks of its own, so lookups
+// need not take the pathLock.  Changes that must be consistent with
+// the tree are still made with the pathLock held for writing.
+type clientInodeTable struct {
+	shards [lockShards]struct {
+		sync.Mutex
+		links map[uint64][]*clientInodePath
+	}
+}
+
+func newClientInodeTable() *clientInodeTable {
+	t := &clientInodeTable{}
+	t.reset()
+	return t
+}
+
+func (t *clientInodeTable) shard(ino uint64) (*sync.Mutex, map[uint64][]*clientInodePath) {
+	s := &t.shards[ino%lockShards]
+	s.Lock()
+	return &s.Mutex, s.links
+}
+
+// reset forgets all inodes.
+func (t *clientInodeTable) reset() {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		s.links = map[uint64][]*clientInodePath{}
+		s.Unlock()
+	}
+}
+
+// add records a name for ino.
+func (t *clientInodeTable) add(ino uint64, e *clientInodePath) {
+	mu, links := t.shard(ino)
+	links[ino] = append(links[ino], e)
+	mu.Unlock()
+}
+
+// remove drops the name of ino in directory parent, and returns one
+// of the remaining names, if any.
+func (t *clientInodeTable) remove(ino uint64, parent *pathInode, name string) *clientInodePath {
+	mu, links := t.shard(ino)
+	defer mu.Unlock()
+	m := links[ino]
+	for i, v := range m {
+		if v.parent == parent && v.name == name {
+			m[i] = m[len(m)-1]
+			m = m[:len(m)-1]
+			links[ino] = m
+			break
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m[0]
+}
+
+// drop forgets ino.
+func (t *clientInodeTable) drop(ino uint64) {
+	mu, links := t.shard(ino)
+	delete(links, ino)
+	mu.Unlock()
+}
+
+// node returns the node for ino, and its number of names.
+func (t *clientInodeTable) node(ino uint64) (node *pathInode, count int) {
+	mu, links := t.shard(ino)
+	defer mu.Unlock()
+	m := links[ino]
+	if len(m) == 0 {
+		return nil, 0
+	}
+	return m[0].node, len(m)
+}
@@ -0,0 +1,131 @@
+package fuse
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PauseStats describes the pauses of a MountState.
+type PauseStats struct {
+	// Number of pauses so far, including the current one.
+	Pauses int
+
+	// Number of pauses ended by their maximum duration rather
+	// than by Resume.
+	Expired int
+
+	// Number of requests read from the kernel while paused.
+	HeldRequests int
+
+	// Total and longest duration of the pauses that have ended.
+	Total   time.Duration
+	Longest time.Duration
+}
+
+// PauseToken represents a pause of the request loop.  Pass it around
+// to whoever should end the pause.
+type PauseToken struct {
+	ms    *MountState
+	start time.Time
+	timer *time.Timer
+
+	mu      sync.Mutex
+	done    bool
+	expired bool
+}
+
+// Pause stops serving requests, and waits for the requests in flight
+// to finish.  When it returns, the file system is not called until
+// the pause ends, so the backing store can be maintained, eg.
+// compacted or reindexed.  Unlike Freeze, Pause also holds back
+// reads and lookups, and does not sync.  Requests issued in the
+// meantime queue up in the kernel, and notifications are written
+// when the pause ends.
+//
+// If max is positive, the pause ends by itself after max, so a
+// maintenance task that hangs cannot hang the mount.  Do not call
+// Pause while frozen.
+func (ms *MountState) Pause(max time.Duration) *PauseToken {
+	ms.pauseLock.Lock()
+	atomic.StoreInt32(&ms.paused, 1)
+
+	t := &PauseToken{ms: ms, start: time.Now()}
+	ms.pauseStatsLock.Lock()
+	ms.pauseStats.Pauses++
+	ms.pauseStatsLock.Unlock()
+	if max > 0 {
+		t.timer = time.AfterFunc(max, func() { t.end(true) })
+	}
+	if ms.Debug {
+		log.Printf("Paused request loop, max %v", max)
+	}
+	return t
+}
+
+// Resume ends the pause.  It returns false if the pause had ended
+// already, eg. because it reached its maximum duration.
+func (t *PauseToken) Resume() bool {
+	return t.end(false)
+}
+
+// Expired returns true if the pause was ended by its maximum
+// duration.
+func (t *PauseToken) Expired() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.expired
+}
+
+func (t *PauseToken) end(expired bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return false
+	}
+	t.done = true
+	t.expired = expired
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+
+	ms := t.ms
+	dt := time.Now().Sub(t.start)
+	ms.pauseStatsLock.Lock()
+	ms.pauseStats.Total += dt
+	if dt > ms.pauseStats.Longest {
+		ms.pauseStats.Longest = dt
+	}
+	if expired {
+		ms.pauseStats.Expired++
+	}
+	ms.pauseStatsLock.Unlock()
+	if ms.Debug || expired {
+		log.Printf("Resumed request loop after %v, expired %v", dt, expired)
+	}
+
+	atomic.StoreInt32(&ms.paused, 0)
+	ms.pauseLock.Unlock()
+	ms.flushNotify()
+	return true
+}
+
+// PauseStats returns statistics on the pauses so far.
+func (ms *MountState) PauseStats() PauseStats {
+	ms.pauseStatsLock.Lock()
+	defer ms.pauseStatsLock.Unlock()
+	return ms.pauseStats
+}
+
+// waitPause blocks while the loop is paused.  The returned function
+// must be called when the request is done.
+func (ms *MountState) waitPause() func() {
+	if atomic.LoadInt32(&ms.paused) != 0 {
+		ms.pauseStatsLock.Lock()
+		ms.pauseStats.HeldRequests++
+		ms.pauseStatsLock.Unlock()
+	}
+	ms.pauseLock.RLock()
+	return ms.pauseLock.RUnlock
+}
@@ -0,0 +1,100 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// statAsync stats a fresh name in the mount, so the kernel has to ask
+// us.
+func statAsync(tc *testCase, i int) chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Lstat(filepath.Join(tc.mnt, fmt.Sprintf("absent%d", i)))
+		done <- err
+	}()
+	return done
+}
+
+func TestPauseResume(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	token := tc.state.Pause(0)
+	done := statAsync(tc, 0)
+	select {
+	case err := <-done:
+		t.Fatalf("stat returned during pause: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if !token.Resume() {
+		t.Fatal("Resume returned false")
+	}
+	select {
+	case err := <-done:
+		if !os.IsNotExist(err) {
+			t.Errorf("got %v, want ENOENT", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stat hangs after Resume")
+	}
+	if token.Resume() {
+		t.Error("second Resume returned true")
+	}
+
+	stats := tc.state.PauseStats()
+	if stats.Pauses != 1 || stats.Expired != 0 || stats.HeldRequests < 1 || stats.Longest < 50*time.Millisecond {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPauseExpire(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	token := tc.state.Pause(20 * time.Millisecond)
+	select {
+	case <-statAsync(tc, 1):
+	case <-time.After(time.Second):
+		t.Fatal("pause did not expire")
+	}
+	if token.Resume() || !token.Expired() {
+		t.Error("pause should have expired")
+	}
+	if stats := tc.state.PauseStats(); stats.Expired != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPauseNotify(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	queued := func() int {
+		tc.state.notifyLock.Lock()
+		defer tc.state.notifyLock.Unlock()
+		n := 0
+		for _, nn := range tc.state.notifyNodes {
+			n += len(nn.queue)
+		}
+		return n
+	}
+
+	// Notifications are queued rather than written to the kernel,
+	// which could be waiting for a held request.
+	token := tc.state.Pause(0)
+	if code := tc.connector.EntryNotify(tc.connector.rootNode, "absent"); !code.Ok() {
+		t.Errorf("EntryNotify: %v", code)
+	}
+	if n := queued(); n != 1 {
+		t.Errorf("got %d queued notifications during pause, want 1", n)
+	}
+	token.Resume()
+	if n := queued(); n != 0 {
+		t.Errorf("got %d queued notifications after Resume, want 0", n)
+	}
+}
@@ -0,0 +1,311 @@
+// Permission checks for FileSystemOptions.DefaultPermissions.
+
+package fuse
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// checkPerms returns true if the connector checks permissions for
+// the node.
+func checkPerms(node *Inode) bool {
+	return node.mount.options.DefaultPermissions
+}
+
+// permAttr returns the attributes of node as the kernel sees them,
+// with the owner override of the mount applied.
+func permAttr(node *Inode, context *Context) (*Attr, Status) {
+	attr := &Attr{}
+	if code := node.fsInode.GetAttr(attr, nil, context); !code.Ok() {
+		return nil, code
+	}
+	if o := node.mount.options.Owner; o != nil {
+		attr.Owner = raw.Owner(*o)
+	}
+	return attr, OK
+}
+
+// callerGroups returns the supplementary groups of the calling
+// process, which the kernel does not send.
+func callerGroups(pid uint32) []uint32 {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var groups []uint32
+		for _, field := range strings.Fields(line[len("Groups:"):]) {
+			if g, err := strconv.ParseUint(field, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// How long the groups of a process are cached, and how many
+// processes are kept.  A process that changes its groups may see the
+// old ones for this long.
+const (
+	_GROUP_CACHE_TTL  = time.Second
+	_GROUP_CACHE_SIZE = 1024
+)
+
+// groupCache caches callerGroups, which reads a file for every
+// call.
+type groupCache struct {
+	mu      sync.Mutex
+	entries map[uint32]groupCacheEntry
+}
+
+type groupCacheEntry struct {
+	groups  []uint32
+	expires time.Time
+}
+
+func newGroupCache() *groupCache {
+	return &groupCache{entries: map[uint32]groupCacheEntry{}}
+}
+
+func (gc *groupCache) get(pid uint32) []uint32 {
+	now := time.Now()
+	gc.mu.Lock()
+	e, ok := gc.entries[pid]
+	gc.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.groups
+	}
+
+	groups := callerGroups(pid)
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if len(gc.entries) >= _GROUP_CACHE_SIZE {
+		for k, e := range gc.entries {
+			if !now.Before(e.expires) {
+				delete(gc.entries, k)
+			}
+		}
+		if len(gc.entries) >= _GROUP_CACHE_SIZE {
+			gc.entries = map[uint32]groupCacheEntry{}
+		}
+	}
+	gc.entries[pid] = groupCacheEntry{groups, now.Add(_GROUP_CACHE_TTL)}
+	return groups
+}
+
+// inGroup returns true if the caller is a member of gid.
+func inGroup(gid uint32, context *Context) bool {
+	if context.Gid == gid {
+		return true
+	}
+	groups := callerGroups
+	if context.groups != nil {
+		groups = context.groups
+	}
+	for _, g := range groups(context.Pid) {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// permits returns true if attr grants the access in mask, a
+// combination of raw.R_OK, raw.W_OK and raw.X_OK, to the caller.  As
+// in the kernel, root may do anything, except executing files that
+// have no execute bits.
+func permits(attr *Attr, mask uint32, context *Context) bool {
+	if context.Uid == 0 {
+		return mask&raw.X_OK == 0 || attr.IsDir() || attr.Mode&0111 != 0
+	}
+	var bits uint32
+	switch {
+	case context.Uid == attr.Uid:
+		bits = attr.Mode >> 6
+	case inGroup(attr.Gid, context):
+		bits = attr.Mode >> 3
+	default:
+		bits = attr.Mode
+	}
+	return bits&mask&07 == mask
+}
+
+// checkAccess returns EACCES unless the caller has the access in mask
+// to node.
+func checkAccess(node *Inode, mask uint32, context *Context) Status {
+	attr, code := permAttr(node, context)
+	if !code.Ok() {
+		return code
+	}
+	if !permits(attr, mask, context) {
+		return EACCES
+	}
+	return OK
+}
+
+// checkOwner returns EPERM unless the caller owns the attributes, or
+// is root.
+func checkOwner(attr *Attr, context *Context) Status {
+	if context.Uid != 0 && context.Uid != attr.Uid {
+		return EPERM
+	}
+	return OK
+}
+
+// openMask returns the access needed for opening with flags.
+func openMask(flags uint32) uint32 {
+	var mask uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mask = raw.R_OK
+	case syscall.O_WRONLY:
+		mask = raw.W_OK
+	case syscall.O_RDWR:
+		mask = raw.R_OK | raw.W_OK
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mask |= raw.W_OK
+	}
+	return mask
+}
+
+// checkRemove checks that the caller may remove or rename name from
+// parent: it needs write and search access to parent, and, if parent
+// is sticky, must own parent or the child.
+func (c *FileSystemConnector) checkRemove(parent *Inode, name string, context *Context) Status {
+	dir, code := permAttr(parent, context)
+	if !code.Ok() {
+		return code
+	}
+	if !permits(dir, raw.W_OK|raw.X_OK, context) {
+		return EACCES
+	}
+	if dir.Mode&syscall.S_ISVTX == 0 || context.Uid == 0 || context.Uid == dir.Uid {
+		return OK
+	}
+	childAttr := &Attr{}
+	child, code := c.statChild(childAttr, parent, name, context)
+	if !code.Ok() {
+		return code
+	}
+	if o := child.mount.options.Owner; o != nil {
+		childAttr.Owner = raw.Owner(*o)
+	}
+	return checkOwner(childAttr, context)
+}
+
+// statChild returns the node and attributes of the child name of
+// parent, like internalLookup, but does not leave a node that the
+// kernel has not looked up in the tree, as nothing would forget it.
+func (c *FileSystemConnector) statChild(out *Attr, parent *Inode, name string, context *Context) (*Inode, Status) {
+	known := parent.GetChild(name)
+	child, code := c.internalLookup(out, parent, name, context)
+	if child == nil || known != nil || child.mountPoint != nil {
+		return child, code
+	}
+
+	child.lookupMutex.Lock()
+	defer child.lookupMutex.Unlock()
+	parent.treeLock.Lock()
+	defer parent.treeLock.Unlock()
+	if parent.children[name] == child && c.recursiveConsiderDropInode(child) {
+		parent.rmChild(name)
+		child.fsInode.OnForget()
+	}
+	return child, code
+}
+
+// checkRename checks removing oldName from oldParent, and adding
+// newName to newParent, where an existing newName is removed too.
+// Moving a directory to another parent also needs write access to
+// the directory, for its "..".
+func (c *FileSystemConnector) checkRename(oldParent *Inode, oldName string, newParent *Inode, newName string, context *Context) Status {
+	if code := c.checkRemove(oldParent, oldName, context); !code.Ok() {
+		return code
+	}
+	if code := c.checkRemove(newParent, newName, context); !code.Ok() && code != ENOENT {
+		return code
+	}
+	if oldParent == newParent {
+		return OK
+	}
+	if child := oldParent.GetChild(oldName); child != nil && child.IsDir() {
+		return checkAccess(child, raw.W_OK, context)
+	}
+	return OK
+}
+
+// checkSetattr checks the ownership and access rules of chmod,
+// chown, truncate and utimes.  It may clear the setgid bit of a
+// chmod, as the kernel does for callers outside the file's group.
+func checkSetattr(node *Inode, input *raw.SetAttrIn, context *Context) Status {
+	attr, code := permAttr(node, context)
+	if !code.Ok() {
+		return code
+	}
+	if input.Valid&raw.FATTR_MODE != 0 {
+		if code := checkOwner(attr, context); !code.Ok() {
+			return code
+		}
+		if context.Uid != 0 && !inGroup(attr.Gid, context) {
+			input.Mode &^= syscall.S_ISGID
+		}
+	}
+	if input.Valid&raw.FATTR_UID != 0 && input.Uid != attr.Uid && context.Uid != 0 {
+		return EPERM
+	}
+	if input.Valid&raw.FATTR_GID != 0 && input.Gid != attr.Gid && context.Uid != 0 {
+		if context.Uid != attr.Uid || !inGroup(input.Gid, context) {
+			return EPERM
+		}
+	}
+	if input.Valid&raw.FATTR_SIZE != 0 && input.Valid&raw.FATTR_FH == 0 &&
+		!permits(attr, raw.W_OK, context) {
+		return EACCES
+	}
+
+	if input.Valid&(raw.FATTR_ATIME|raw.FATTR_MTIME) != 0 && !checkOwner(attr, context).Ok() {
+		// Setting times to now only needs write access.
+		explicit := (input.Valid&raw.FATTR_ATIME != 0 && input.Valid&raw.FATTR_ATIME_NOW == 0) ||
+			(input.Valid&raw.FATTR_MTIME != 0 && input.Valid&raw.FATTR_MTIME_NOW == 0)
+		if explicit {
+			return EPERM
+		}
+		if !permits(attr, raw.W_OK, context) {
+			return EACCES
+		}
+	}
+	return OK
+}
+
+// checkXAttr checks the access in mask for reading or writing the
+// extended attribute attr.  As in the kernel, user attributes follow
+// the file permissions, and trusted attributes are for root only.
+func checkXAttr(node *Inode, attr string, mask uint32, context *Context) Status {
+	switch {
+	case strings.HasPrefix(attr, "trusted."):
+		if context.Uid != 0 {
+			return EPERM
+		}
+		return OK
+	case strings.HasPrefix(attr, "user."):
+		return checkAccess(node, mask, context)
+	}
+	return OK
+}
@@ -0,0 +1,73 @@
+package fuse
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDefaultPermissions(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to switch users")
+	}
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	orig := filepath.Join(dir, "orig")
+	mnt := filepath.Join(dir, "mnt")
+	CheckSuccess(os.Mkdir(orig, 0755))
+	CheckSuccess(os.Mkdir(mnt, 0755))
+	CheckSuccess(os.Chmod(dir, 0755))
+
+	CheckSuccess(ioutil.WriteFile(filepath.Join(orig, "private"), nil, 0600))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(orig, "public"), nil, 0644))
+	CheckSuccess(os.Mkdir(filepath.Join(orig, "dir"), 0755))
+	CheckSuccess(os.Mkdir(filepath.Join(orig, "sticky"), 0777))
+	CheckSuccess(os.Chmod(filepath.Join(orig, "sticky"), os.ModeSticky|0777))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(orig, "sticky", "rootfile"), nil, 0666))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(orig, "sticky", "mine"), nil, 0644))
+	CheckSuccess(os.Chown(filepath.Join(orig, "sticky", "mine"), 1000, 1000))
+
+	opts := NewFileSystemOptions()
+	opts.Owner = nil
+	opts.DefaultPermissions = true
+	nfs := NewPathNodeFs(NewLoopbackFileSystem(orig), nil)
+	state, _, err := MountNodeFileSystem(mnt, nfs, opts)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	expect := func(what string, err error, want error) {
+		if want == nil && err != nil || want != nil && !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", what, err, want)
+		}
+	}
+	open := func(name string, flags int) error {
+		f, err := os.OpenFile(filepath.Join(mnt, name), flags, 0644)
+		if err == nil {
+			f.Close()
+		}
+		return err
+	}
+
+	asUser(func() error {
+		expect("read private", open("private", os.O_RDONLY), syscall.EACCES)
+		expect("read public", open("public", os.O_RDONLY), nil)
+		expect("write public", open("public", os.O_WRONLY), syscall.EACCES)
+		expect("create in dir", open("dir/new", os.O_WRONLY|os.O_CREATE), syscall.EACCES)
+		expect("truncate public", os.Truncate(filepath.Join(mnt, "public"), 0), syscall.EACCES)
+		expect("chmod public", os.Chmod(filepath.Join(mnt, "public"), 0666), syscall.EPERM)
+
+		expect("create in sticky", open("sticky/new", os.O_WRONLY|os.O_CREATE), nil)
+		expect("unlink own in sticky", os.Remove(filepath.Join(mnt, "sticky/mine")), nil)
+		expect("unlink root's in sticky", os.Remove(filepath.Join(mnt, "sticky/rootfile")), syscall.EPERM)
+		return nil
+	})
+
+	expect("read private as root", open("private", os.O_RDONLY), nil)
+	expect("unlink in sticky as root", os.Remove(filepath.Join(mnt, "sticky/rootfile")), nil)
+}
@@ -0,0 +1,78 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestPermits(t *testing.T) {
+	attr := &Attr{Mode: S_IFREG | 0640, Owner: raw.Owner{Uid: 1, Gid: 2}}
+	owner := &Context{}
+	owner.Uid = 1
+	member := &Context{}
+	member.Uid, member.Gid = 3, 2
+	other := &Context{}
+	other.Uid, other.Gid = 3, 3
+	root := &Context{}
+
+	cases := []struct {
+		ctx  *Context
+		mask uint32
+		ok   bool
+	}{
+		{owner, 6, true},
+		{owner, 1, false},
+		{member, 4, true},
+		{member, 2, false},
+		{other, 4, false},
+		{root, 6, true},
+		{root, 1, false},
+	}
+	for _, c := range cases {
+		if got := permits(attr, c.mask, c.ctx); got != c.ok {
+			t.Errorf("permits(%o, uid %d gid %d) = %v, want %v", c.mask, c.ctx.Uid, c.ctx.Gid, got, c.ok)
+		}
+	}
+}
+
+func TestGroupCache(t *testing.T) {
+	gc := newGroupCache()
+	pid := uint32(os.Getpid())
+	groups := gc.get(pid)
+	if len(gc.entries) != 1 {
+		t.Fatalf("got %d cache entries, want 1", len(gc.entries))
+	}
+	gc.entries[pid] = groupCacheEntry{[]uint32{12345}, time.Now().Add(time.Hour)}
+	if got := gc.get(pid); len(got) != 1 || got[0] != 12345 {
+		t.Errorf("got %v, want the cached groups", got)
+	}
+	gc.entries[pid] = groupCacheEntry{[]uint32{12345}, time.Now()}
+	if got := gc.get(pid); len(got) != len(groups) {
+		t.Errorf("got %v after expiry, want %v", got, groups)
+	}
+}
+
+// Checking the owner of a child in a sticky directory does not leave
+// a node in the tree that the kernel does not know about.
+func TestCheckRemoveNoNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.Chmod(dir, os.ModeSticky|0777))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+
+	c := NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(dir), nil), nil)
+	ctx := &Context{}
+	ctx.Uid, ctx.Gid = 12345, 12345
+	if code := c.checkRemove(c.rootNode, "file", ctx); code != EPERM {
+		t.Errorf("checkRemove: got %v, want EPERM", code)
+	}
+	if c.rootNode.GetChild("file") != nil {
+		t.Error("checkRemove left a node for the child")
+	}
+}
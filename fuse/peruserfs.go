@@ -0,0 +1,368 @@
+package fuse
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+type PerUserOptions struct {
+	// Users has the file systems of users, by uid.
+	Users map[uint32]FileSystem
+
+	// If set, NewUser makes the file system of a user that is not
+	// in Users, on their first request.  The result is kept.  An
+	// error denies the user.
+	NewUser func(uid uint32) (FileSystem, Status)
+
+	// Default serves users that have no file system of their
+	// own, and requests without a caller.  If nil, those users
+	// get EACCES, and see an empty root.
+	Default FileSystem
+}
+
+// PerUserFileSystem shows each user their own file system, chosen by
+// the uid of the caller, so that one mount with the allow_other
+// option can serve, eg., the home directories of all users.
+//
+// The kernel caches entries, attributes and data per path, for all
+// users.  Mount with EntryTimeout, AttrTimeout and NegativeTimeout
+// set to zero, so each user gets their own answers.  Files are opened
+// with direct I/O for the same reason.
+type PerUserFileSystem struct {
+	options PerUserOptions
+
+	lock  sync.Mutex
+	users map[uint32]FileSystem
+}
+
+// NewPerUserFileSystem returns a PerUserFileSystem.
+func NewPerUserFileSystem(opts *PerUserOptions) *PerUserFileSystem {
+	fs := &PerUserFileSystem{users: map[uint32]FileSystem{}}
+	if opts != nil {
+		fs.options = *opts
+	}
+	for uid, u := range fs.options.Users {
+		fs.users[uid] = u
+	}
+	return fs
+}
+
+func (fs *PerUserFileSystem) String() string {
+	return "PerUserFileSystem"
+}
+
+// SetUser sets the file system of uid.  A nil file system removes
+// it, so the next request makes a new one with NewUser.
+func (fs *PerUserFileSystem) SetUser(uid uint32, userFs FileSystem) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if userFs == nil {
+		delete(fs.users, uid)
+	} else {
+		fs.users[uid] = userFs
+	}
+}
+
+// user returns the file system of the caller.
+func (fs *PerUserFileSystem) user(context *Context) (FileSystem, Status) {
+	if context == nil {
+		if fs.options.Default == nil {
+			return nil, EACCES
+		}
+		return fs.options.Default, OK
+	}
+	uid := context.Uid
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if u := fs.users[uid]; u != nil {
+		return u, OK
+	}
+	if fs.options.NewUser != nil {
+		u, code := fs.options.NewUser(uid)
+		if !code.Ok() {
+			return nil, code
+		}
+		fs.users[uid] = u
+		return u, OK
+	}
+	if fs.options.Default == nil {
+		return nil, EACCES
+	}
+	return fs.options.Default, OK
+}
+
+func (fs *PerUserFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		if name == "" {
+			// The mount itself must stay usable.
+			return &Attr{Mode: syscall.S_IFDIR | 0755}, OK
+		}
+		return nil, code
+	}
+	return u.GetAttr(name, context)
+}
+
+func (fs *PerUserFileSystem) Chmod(name string, mode uint32, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Chmod(name, mode, context)
+}
+
+func (fs *PerUserFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Chown(name, uid, gid, context)
+}
+
+func (fs *PerUserFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Utimens(name, atime, mtime, context)
+}
+
+func (fs *PerUserFileSystem) Truncate(name string, size uint64, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Truncate(name, size, context)
+}
+
+func (fs *PerUserFileSystem) Access(name string, mode uint32, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Access(name, mode, context)
+}
+
+func (fs *PerUserFileSystem) Link(oldName string, newName string, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Link(oldName, newName, context)
+}
+
+func (fs *PerUserFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Mkdir(name, mode, context)
+}
+
+func (fs *PerUserFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Mknod(name, mode, dev, context)
+}
+
+func (fs *PerUserFileSystem) Rename(oldName string, newName string, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Rename(oldName, newName, context)
+}
+
+func (fs *PerUserFileSystem) Rmdir(name string, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Rmdir(name, context)
+}
+
+func (fs *PerUserFileSystem) Unlink(name string, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Unlink(name, context)
+}
+
+func (fs *PerUserFileSystem) LinkKey(name string, context *Context) (string, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return "", code
+	}
+	return u.LinkKey(name, context)
+}
+
+func (fs *PerUserFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return u.GetXAttr(name, attr, context)
+}
+
+func (fs *PerUserFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return u.ListXAttr(name, context)
+}
+
+func (fs *PerUserFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.RemoveXAttr(name, attr, context)
+}
+
+func (fs *PerUserFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.SetXAttr(name, attr, data, flags, context)
+}
+
+// OnMount and OnUnmount are passed on to the file systems known at
+// the time.
+func (fs *PerUserFileSystem) OnMount(nodeFs *PathNodeFs) {
+	for _, u := range fs.all() {
+		u.OnMount(nodeFs)
+	}
+}
+
+func (fs *PerUserFileSystem) OnUnmount(reason UnmountReason) {
+	for _, u := range fs.all() {
+		u.OnUnmount(reason)
+	}
+}
+
+func (fs *PerUserFileSystem) all() []FileSystem {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var result []FileSystem
+	if fs.options.Default != nil {
+		result = append(result, fs.options.Default)
+	}
+	for _, u := range fs.users {
+		result = append(result, u)
+	}
+	return result
+}
+
+func (fs *PerUserFileSystem) Open(name string, flags uint32, context *Context) (File, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return nil, code
+	}
+	f, code := u.Open(name, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &WithFlags{File: f, FuseFlags: raw.FOPEN_DIRECT_IO}, OK
+}
+
+func (fs *PerUserFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (File, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return nil, code
+	}
+	f, code := u.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &WithFlags{File: f, FuseFlags: raw.FOPEN_DIRECT_IO}, OK
+}
+
+func (fs *PerUserFileSystem) OpenDir(name string, context *Context) ([]DirEntry, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		if name == "" {
+			return nil, OK
+		}
+		return nil, code
+	}
+	return u.OpenDir(name, context)
+}
+
+func (fs *PerUserFileSystem) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return nil, ENOSYS
+	}
+	return u.OpenDirStream(name, context)
+}
+
+func (fs *PerUserFileSystem) Symlink(value string, linkName string, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.Symlink(value, linkName, context)
+}
+
+func (fs *PerUserFileSystem) Readlink(name string, context *Context) (string, Status) {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return "", code
+	}
+	return u.Readlink(name, context)
+}
+
+// StatFs has no caller, so it reports on the Default file system.
+func (fs *PerUserFileSystem) StatFs(name string) *StatfsOut {
+	if fs.options.Default == nil {
+		return nil
+	}
+	return fs.options.Default.StatFs(name)
+}
+
+func (fs *PerUserFileSystem) SyncFs(context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.SyncFs(context)
+}
+
+func (fs *PerUserFileSystem) FsyncDir(name string, flags int, context *Context) Status {
+	u, code := fs.user(context)
+	if !code.Ok() {
+		return code
+	}
+	return u.FsyncDir(name, flags, context)
+}
+
+// NewSubdirFileSystem returns a view of the directory dir of fs, eg.
+// for the users of a PerUserFileSystem.  Symlinks are not changed.
+func NewSubdirFileSystem(fs FileSystem, dir string) FileSystem {
+	dir = filepath.Clean(dir)
+	return &subdirFileSystem{
+		rewriteFileSystem{fs, func(name string) (string, Status) {
+			return filepath.Join(dir, name), OK
+		}},
+		dir,
+	}
+}
+
+type subdirFileSystem struct {
+	rewriteFileSystem
+	dir string
+}
+
+func (fs *subdirFileSystem) String() string {
+	return fmt.Sprintf("%s:%s", fs.FileSystem.String(), fs.dir)
+}
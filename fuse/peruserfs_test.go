@@ -0,0 +1,75 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func userContext(uid uint32) *Context {
+	return &Context{Context: raw.Context{Owner: raw.Owner{Uid: uid}}}
+}
+
+func TestPerUserFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"home/alice", "home/bob", "public"} {
+		CheckSuccess(os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "home/alice/file"), []byte("alice"), 0644))
+
+	loopback := NewLoopbackFileSystem(dir)
+	fs := NewPerUserFileSystem(&PerUserOptions{
+		Users: map[uint32]FileSystem{1000: NewSubdirFileSystem(loopback, "home/alice")},
+		NewUser: func(uid uint32) (FileSystem, Status) {
+			if uid == 1001 {
+				return NewSubdirFileSystem(loopback, "home/bob"), OK
+			}
+			return nil, ENOENT
+		},
+	})
+	alice, bob, eve := userContext(1000), userContext(1001), userContext(1002)
+
+	if _, code := fs.GetAttr("file", alice); !code.Ok() {
+		t.Errorf("alice: %v", code)
+	}
+	if _, code := fs.GetAttr("file", bob); code != ENOENT {
+		t.Errorf("bob sees alice's file: %v", code)
+	}
+	f, code := fs.Create("file", uint32(os.O_WRONLY|os.O_CREATE), 0644, bob)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Write(&WriteIn{}, []byte("bob"))
+	f.Release(&ReleaseIn{})
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "home/bob/file")); string(data) != "bob" {
+		t.Errorf("bob's file: %q", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "home/alice/file")); string(data) != "alice" {
+		t.Errorf("alice's file: %q", data)
+	}
+
+	// Unknown users are denied, but the root stays a directory.
+	if _, code := fs.OpenDir("", eve); !code.Ok() {
+		t.Errorf("eve: OpenDir: %v", code)
+	}
+	if a, code := fs.GetAttr("", eve); !code.Ok() || !a.IsDir() {
+		t.Errorf("eve: GetAttr root: %v", code)
+	}
+	if _, code := fs.GetAttr("file", eve); code != ENOENT {
+		t.Errorf("eve: GetAttr: %v", code)
+	}
+
+	// A default view serves everyone else.
+	fs = NewPerUserFileSystem(&PerUserOptions{Default: NewSubdirFileSystem(loopback, "public")})
+	if code := fs.Mkdir("shared", 0755, eve); !code.Ok() {
+		t.Errorf("Mkdir: %v", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "public/shared")); err != nil {
+		t.Errorf("default: %v", err)
+	}
+}
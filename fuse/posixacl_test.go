@@ -0,0 +1,68 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse/acl"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestPosixACL(t *testing.T) {
+	orig, err := ioutil.TempDir("", "go-fuse-orig")
+	CheckSuccess(err)
+	defer os.RemoveAll(orig)
+	mnt, err := ioutil.TempDir("", "go-fuse-mnt")
+	CheckSuccess(err)
+	defer os.RemoveAll(mnt)
+
+	CheckSuccess(ioutil.WriteFile(filepath.Join(orig, "file"), []byte("hello"), 0644))
+	if errno := Setxattr(filepath.Join(orig, "file"), acl.AccessXAttr, acl.FromMode(0644).Encode(), 0); errno != 0 {
+		t.Skipf("backing file system has no ACLs: %v", syscall.Errno(errno))
+	}
+
+	fs := NewLoopbackFileSystem(orig)
+	state := NewMountState(NewFileSystemConnector(NewPathNodeFs(fs, nil), nil))
+	state.Debug = VerboseTest()
+	CheckSuccess(state.Mount(mnt, &MountOptions{PosixACL: true, IgnoreSecurityLabels: true}))
+	go state.Loop()
+	defer state.Unmount()
+
+	mntFile := filepath.Join(mnt, "file")
+	_, err = os.Lstat(mntFile)
+	CheckSuccess(err)
+	if state.KernelSettings().Flags&raw.CAP_POSIX_ACL == 0 {
+		t.Skip("kernel does not support POSIX ACLs")
+	}
+
+	want := acl.ACL{
+		{Tag: acl.UserObj, Perm: acl.Read | acl.Write},
+		{Tag: acl.User, Perm: acl.Read | acl.Write, Id: 1000},
+		{Tag: acl.GroupObj, Perm: acl.Read},
+		{Tag: acl.Mask, Perm: acl.Read},
+		{Tag: acl.Other},
+	}
+	if errno := Setxattr(mntFile, acl.AccessXAttr, want.Encode(), 0); errno != 0 {
+		t.Fatalf("Setxattr: %v", syscall.Errno(errno))
+	}
+
+	// IgnoreSecurityLabels must not hide enforced ACLs.
+	data, errno := GetXAttr(mntFile, acl.AccessXAttr, make([]byte, 1024))
+	if errno != 0 {
+		t.Fatalf("GetXAttr: %v", syscall.Errno(errno))
+	}
+	got, err := acl.Decode(data)
+	CheckSuccess(err)
+	if err := got.Valid(); err != nil || len(got) != len(want) || got[1].Id != 1000 {
+		t.Errorf("got ACL %v (%v), want %v", got, err, want)
+	}
+
+	fi, err := os.Lstat(mntFile)
+	CheckSuccess(err)
+	if m := uint32(fi.Mode().Perm()); m != want.Mode() {
+		t.Errorf("got mode %o, want %o from the ACL", m, want.Mode())
+	}
+}
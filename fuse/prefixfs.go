@@ -3,6 +3,7 @@ package fuse
 import (
 	"fmt"
 	"path/filepath"
+	"time"
 )
 
 // PrefixFileSystem adds a path prefix to incoming calls. 
@@ -51,6 +52,10 @@ func (fs *PrefixFileSystem) Link(oldName string, newName string, context *Contex
 	return fs.FileSystem.Link(fs.prefixed(oldName), fs.prefixed(newName), context)
 }
 
+func (fs *PrefixFileSystem) LinkKey(name string, context *Context) (key string, code Status) {
+	return fs.FileSystem.LinkKey(fs.prefixed(name), context)
+}
+
 func (fs *PrefixFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
 	return fs.FileSystem.Chmod(fs.prefixed(name), mode, context)
 }
@@ -71,12 +76,16 @@ func (fs *PrefixFileSystem) OpenDir(name string, context *Context) (stream []Dir
 	return fs.FileSystem.OpenDir(fs.prefixed(name), context)
 }
 
+func (fs *PrefixFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, status Status) {
+	return fs.FileSystem.OpenDirStream(fs.prefixed(name), context)
+}
+
 func (fs *PrefixFileSystem) OnMount(nodeFs *PathNodeFs) {
 	fs.FileSystem.OnMount(nodeFs)
 }
 
-func (fs *PrefixFileSystem) OnUnmount() {
-	fs.FileSystem.OnUnmount()
+func (fs *PrefixFileSystem) OnUnmount(reason UnmountReason) {
+	fs.FileSystem.OnUnmount(reason)
 }
 
 func (fs *PrefixFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
@@ -87,8 +96,8 @@ func (fs *PrefixFileSystem) Create(name string, flags uint32, mode uint32, conte
 	return fs.FileSystem.Create(fs.prefixed(name), flags, mode, context)
 }
 
-func (fs *PrefixFileSystem) Utimens(name string, AtimeNs int64, CtimeNs int64, context *Context) (code Status) {
-	return fs.FileSystem.Utimens(fs.prefixed(name), AtimeNs, CtimeNs, context)
+func (fs *PrefixFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	return fs.FileSystem.Utimens(fs.prefixed(name), Atime, Mtime, context)
 }
 
 func (fs *PrefixFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
@@ -107,6 +116,27 @@ func (fs *PrefixFileSystem) RemoveXAttr(name string, attr string, context *Conte
 	return fs.FileSystem.RemoveXAttr(fs.prefixed(name), attr, context)
 }
 
+func (fs *PrefixFileSystem) FsyncDir(name string, flags int, context *Context) Status {
+	return fs.FileSystem.FsyncDir(fs.prefixed(name), flags, context)
+}
+
 func (fs *PrefixFileSystem) String() string {
 	return fmt.Sprintf("PrefixFileSystem(%s,%s)", fs.FileSystem.String(), fs.Prefix)
 }
+
+// subtreeFileSystem is a PrefixFileSystem for a second view on a
+// FileSystem that is mounted already, so it must not pass on
+// OnMount and OnUnmount.
+type subtreeFileSystem struct {
+	PrefixFileSystem
+}
+
+func (fs *subtreeFileSystem) OnMount(nodeFs *PathNodeFs) {
+}
+
+func (fs *subtreeFileSystem) OnUnmount(reason UnmountReason) {
+}
+
+func (fs *subtreeFileSystem) String() string {
+	return fmt.Sprintf("subtree(%s,%s)", fs.FileSystem.String(), fs.Prefix)
+}
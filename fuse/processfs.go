@@ -0,0 +1,315 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ProcessRule allows or denies access to some names, for some
+// programs.
+type ProcessRule struct {
+	// Exe is a filepath.Match pattern for the executable of the
+	// caller, as /proc/PID/exe shows it.  Empty matches all
+	// programs.
+	Exe string
+
+	// Path is a filepath.Match pattern for the names the rule
+	// covers, and the names below them.  Empty matches all names.
+	Path string
+
+	Allow bool
+}
+
+type ProcessAccessOptions struct {
+	// Rules are tried in order, and the first that matches
+	// decides.
+	Rules []ProcessRule
+
+	// DefaultAllow decides for names that no rule matches.
+	DefaultAllow bool
+
+	// If set, OnDeny is called for each denied operation.
+	OnDeny func(e *ProcessAccessEvent)
+}
+
+// ProcessAccessEvent describes a denied operation.
+type ProcessAccessEvent struct {
+	Op   string
+	Name string
+	Pid  uint32
+	// Exe is the executable of the caller, or empty if it could
+	// not be found.
+	Exe string
+}
+
+// ProcessAccessFileSystem is a wrapper that allows operations based on
+// the program that asks for them, so that eg. only a given binary can
+// read a directory of secrets.  Denied operations fail with EACCES.
+//
+// The program is found from the pid of the caller in /proc, so the
+// file system must run in the same pid namespace as its users.  A
+// process whose executable cannot be found, eg. because it exited,
+// matches only rules with an empty Exe.  Access is checked when a
+// file is opened; the open file can be used by any process it is
+// passed on to.  Requests without a caller are allowed.
+type ProcessAccessFileSystem struct {
+	FileSystem
+
+	options ProcessAccessOptions
+
+	// exe returns the executable of a process.
+	exe func(pid uint32) (string, error)
+}
+
+// NewProcessAccessFileSystem wraps fs.
+func NewProcessAccessFileSystem(fs FileSystem, opts *ProcessAccessOptions) *ProcessAccessFileSystem {
+	p := &ProcessAccessFileSystem{
+		FileSystem: fs,
+		exe: func(pid uint32) (string, error) {
+			return os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+		},
+	}
+	if opts != nil {
+		p.options = *opts
+	}
+	return p
+}
+
+func (fs *ProcessAccessFileSystem) String() string {
+	return fmt.Sprintf("ProcessAccessFileSystem(%s)", fs.FileSystem.String())
+}
+
+// matchPath returns true if name or one of its parents matches
+// pattern.
+func matchPath(pattern string, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	for name != "." && name != "" {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+		name = filepath.Dir(name)
+	}
+	return false
+}
+
+// Allowed returns true if the process pid may use name.
+func (fs *ProcessAccessFileSystem) Allowed(name string, pid uint32) bool {
+	allowed, _ := fs.decide(name, pid)
+	return allowed
+}
+
+func (fs *ProcessAccessFileSystem) decide(name string, pid uint32) (allowed bool, exe string) {
+	looked := false
+	for _, r := range fs.options.Rules {
+		if !matchPath(r.Path, name) {
+			continue
+		}
+		if r.Exe != "" {
+			if !looked {
+				exe, _ = fs.exe(pid)
+				looked = true
+			}
+			if ok, _ := filepath.Match(r.Exe, exe); exe == "" || !ok {
+				continue
+			}
+		}
+		return r.Allow, exe
+	}
+	return fs.options.DefaultAllow, exe
+}
+
+// check returns EACCES if the caller may not use one of names.
+func (fs *ProcessAccessFileSystem) check(op string, context *Context, names ...string) Status {
+	if context == nil {
+		return OK
+	}
+	for _, name := range names {
+		if ok, exe := fs.decide(name, context.Pid); !ok {
+			if fs.options.OnDeny != nil {
+				fs.options.OnDeny(&ProcessAccessEvent{
+					Op:   op,
+					Name: name,
+					Pid:  context.Pid,
+					Exe:  exe,
+				})
+			}
+			return EACCES
+		}
+	}
+	return OK
+}
+
+// GetAttr always allows the root, so the mount point can be used.
+func (fs *ProcessAccessFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	if name != "" {
+		if code := fs.check("GetAttr", context, name); !code.Ok() {
+			return nil, code
+		}
+	}
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *ProcessAccessFileSystem) Chmod(name string, mode uint32, context *Context) Status {
+	if code := fs.check("Chmod", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *ProcessAccessFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) Status {
+	if code := fs.check("Chown", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *ProcessAccessFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *Context) Status {
+	if code := fs.check("Utimens", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *ProcessAccessFileSystem) Truncate(name string, size uint64, context *Context) Status {
+	if code := fs.check("Truncate", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *ProcessAccessFileSystem) Access(name string, mode uint32, context *Context) Status {
+	if code := fs.check("Access", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *ProcessAccessFileSystem) Link(oldName string, newName string, context *Context) Status {
+	if code := fs.check("Link", context, oldName, newName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *ProcessAccessFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	if code := fs.check("Mkdir", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *ProcessAccessFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	if code := fs.check("Mknod", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *ProcessAccessFileSystem) Rename(oldName string, newName string, context *Context) Status {
+	if code := fs.check("Rename", context, oldName, newName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *ProcessAccessFileSystem) Rmdir(name string, context *Context) Status {
+	if code := fs.check("Rmdir", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *ProcessAccessFileSystem) Unlink(name string, context *Context) Status {
+	if code := fs.check("Unlink", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *ProcessAccessFileSystem) LinkKey(name string, context *Context) (string, Status) {
+	if code := fs.check("LinkKey", context, name); !code.Ok() {
+		return "", code
+	}
+	return fs.FileSystem.LinkKey(name, context)
+}
+
+func (fs *ProcessAccessFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	if code := fs.check("GetXAttr", context, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.GetXAttr(name, attr, context)
+}
+
+func (fs *ProcessAccessFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
+	if code := fs.check("ListXAttr", context, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *ProcessAccessFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	if code := fs.check("RemoveXAttr", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *ProcessAccessFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	if code := fs.check("SetXAttr", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *ProcessAccessFileSystem) Open(name string, flags uint32, context *Context) (File, Status) {
+	if code := fs.check("Open", context, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+func (fs *ProcessAccessFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (File, Status) {
+	if code := fs.check("Create", context, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+func (fs *ProcessAccessFileSystem) OpenDir(name string, context *Context) ([]DirEntry, Status) {
+	if code := fs.check("OpenDir", context, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *ProcessAccessFileSystem) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	if code := fs.check("OpenDir", context, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *ProcessAccessFileSystem) Symlink(value string, linkName string, context *Context) Status {
+	if code := fs.check("Symlink", context, linkName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *ProcessAccessFileSystem) Readlink(name string, context *Context) (string, Status) {
+	if code := fs.check("Readlink", context, name); !code.Ok() {
+		return "", code
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *ProcessAccessFileSystem) FsyncDir(name string, flags int, context *Context) Status {
+	if code := fs.check("FsyncDir", context, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.FsyncDir(name, flags, context)
+}
@@ -0,0 +1,74 @@
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestProcessAccessFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.Mkdir(filepath.Join(dir, "secrets"), 0755))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "secrets/key"), []byte("key"), 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "public"), []byte("hello"), 0644))
+
+	var denied []*ProcessAccessEvent
+	fs := NewProcessAccessFileSystem(NewLoopbackFileSystem(dir), &ProcessAccessOptions{
+		Rules: []ProcessRule{
+			{Exe: "/usr/sbin/sshd", Path: "secrets", Allow: true},
+			{Path: "secrets"},
+		},
+		DefaultAllow: true,
+		OnDeny:       func(e *ProcessAccessEvent) { denied = append(denied, e) },
+	})
+	exes := map[uint32]string{1: "/usr/sbin/sshd", 2: "/bin/cat"}
+	fs.exe = func(pid uint32) (string, error) {
+		if exe, ok := exes[pid]; ok {
+			return exe, nil
+		}
+		return "", fmt.Errorf("no process %d", pid)
+	}
+	caller := func(pid uint32) *Context {
+		return &Context{Context: raw.Context{Pid: pid}}
+	}
+
+	if f, code := fs.Open("secrets/key", uint32(os.O_RDONLY), caller(1)); !code.Ok() {
+		t.Errorf("sshd: %v", code)
+	} else {
+		f.Release(&ReleaseIn{})
+	}
+	if _, code := fs.Open("secrets/key", uint32(os.O_RDONLY), caller(2)); code != EACCES {
+		t.Errorf("cat: got %v", code)
+	}
+	if code := fs.Rename("public", "secrets/public", caller(2)); code != EACCES {
+		t.Errorf("cat: Rename: got %v", code)
+	}
+	if _, code := fs.GetAttr("public", caller(2)); !code.Ok() {
+		t.Errorf("cat: public: %v", code)
+	}
+	// A process that is gone only gets what is open to all.
+	if _, code := fs.GetAttr("secrets", caller(3)); code != EACCES {
+		t.Errorf("unknown: got %v", code)
+	}
+	if _, code := fs.GetAttr("secrets", nil); !code.Ok() {
+		t.Errorf("no caller: %v", code)
+	}
+	if len(denied) != 3 || denied[0].Exe != "/bin/cat" || denied[0].Op != "Open" || denied[2].Exe != "" {
+		t.Errorf("denied: %v", denied)
+	}
+
+	// The real lookup finds the test binary.
+	exe, _ := os.Readlink("/proc/self/exe")
+	fs = NewProcessAccessFileSystem(NewLoopbackFileSystem(dir), &ProcessAccessOptions{
+		Rules: []ProcessRule{{Exe: exe, Allow: true}},
+	})
+	if !fs.Allowed("secrets/key", uint32(os.Getpid())) {
+		t.Errorf("test binary %q is denied", exe)
+	}
+}
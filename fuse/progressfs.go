@@ -0,0 +1,180 @@
+package fuse
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type ProgressEventType int
+
+const (
+	PROGRESS_OPEN = ProgressEventType(iota)
+	PROGRESS_READ
+	PROGRESS_WRITE
+	PROGRESS_CLOSE
+)
+
+func (t ProgressEventType) String() string {
+	switch t {
+	case PROGRESS_OPEN:
+		return "open"
+	case PROGRESS_READ:
+		return "read"
+	case PROGRESS_WRITE:
+		return "write"
+	case PROGRESS_CLOSE:
+		return "close"
+	}
+	return fmt.Sprintf("ProgressEventType(%d)", int(t))
+}
+
+// ProgressEvent describes the data that has flowed through a single
+// open file. The byte counts are cumulative since the open.
+type ProgressEvent struct {
+	Type         ProgressEventType
+	Path         string
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// ProgressObserver receives progress events. It is called
+// synchronously from the file system operation, so it should return
+// quickly.
+type ProgressObserver interface {
+	Progress(event *ProgressEvent)
+}
+
+// ProgressFileSystem is a wrapper that reports open, close and
+// transfer progress of files to a ProgressObserver.  Open and close
+// are always reported; read and write events are throttled to at
+// most EventsPerSecond per file system.
+type ProgressFileSystem struct {
+	FileSystem
+
+	observer ProgressObserver
+	interval time.Duration
+
+	lock     sync.Mutex
+	lastSent time.Time
+}
+
+// NewProgressFileSystem wraps fs.  If eventsPerSecond is zero or
+// negative, read and write events are not throttled.
+func NewProgressFileSystem(fs FileSystem, observer ProgressObserver, eventsPerSecond int) *ProgressFileSystem {
+	p := &ProgressFileSystem{
+		FileSystem: fs,
+		observer:   observer,
+	}
+	if eventsPerSecond > 0 {
+		p.interval = time.Second / time.Duration(eventsPerSecond)
+	}
+	return p
+}
+
+func (fs *ProgressFileSystem) String() string {
+	return fmt.Sprintf("ProgressFileSystem(%s)", fs.FileSystem.String())
+}
+
+func (fs *ProgressFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	file, code = fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return fs.newFile(file, name), code
+}
+
+func (fs *ProgressFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	file, code = fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return fs.newFile(file, name), code
+}
+
+func (fs *ProgressFileSystem) newFile(file File, name string) File {
+	f := &progressFile{
+		File: file,
+		fs:   fs,
+		path: name,
+	}
+	f.report(PROGRESS_OPEN, true)
+	return f
+}
+
+// throttle returns true if a transfer event may be sent now.
+func (fs *ProgressFileSystem) throttle() bool {
+	if fs.interval == 0 {
+		return true
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(fs.lastSent) < fs.interval {
+		return false
+	}
+	fs.lastSent = now
+	return true
+}
+
+type progressFile struct {
+	File
+
+	fs   *ProgressFileSystem
+	path string
+
+	lock         sync.Mutex
+	bytesRead    int64
+	bytesWritten int64
+}
+
+func (f *progressFile) String() string {
+	return fmt.Sprintf("progressFile(%s)", f.File.String())
+}
+
+func (f *progressFile) InnerFile() File {
+	return f.File
+}
+
+func (f *progressFile) report(t ProgressEventType, always bool) {
+	if !always && !f.fs.throttle() {
+		return
+	}
+	f.lock.Lock()
+	ev := ProgressEvent{
+		Type:         t,
+		Path:         f.path,
+		BytesRead:    f.bytesRead,
+		BytesWritten: f.bytesWritten,
+	}
+	f.lock.Unlock()
+	f.fs.observer.Progress(&ev)
+}
+
+func (f *progressFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	data, code := f.File.Read(input, bp)
+	if code.Ok() {
+		f.lock.Lock()
+		f.bytesRead += int64(len(data))
+		f.lock.Unlock()
+		f.report(PROGRESS_READ, false)
+	}
+	return data, code
+}
+
+func (f *progressFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	n, code := f.File.Write(input, data)
+	if n > 0 {
+		f.lock.Lock()
+		f.bytesWritten += int64(n)
+		f.lock.Unlock()
+		f.report(PROGRESS_WRITE, false)
+	}
+	return n, code
+}
+
+func (f *progressFile) Release(input *ReleaseIn) {
+	f.File.Release(input)
+	f.report(PROGRESS_CLOSE, true)
+}
@@ -0,0 +1,90 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	lock   sync.Mutex
+	events []ProgressEvent
+}
+
+func (o *recordingObserver) Progress(ev *ProgressEvent) {
+	o.lock.Lock()
+	o.events = append(o.events, *ev)
+	o.lock.Unlock()
+}
+
+func TestProgressFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+
+	obs := &recordingObserver{}
+	fs := NewProgressFileSystem(NewLoopbackFileSystem(dir+"/orig"), obs, 0)
+	state, _, err := MountNodeFileSystem(dir+"/mnt", NewPathNodeFs(fs, nil), nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	content := []byte("hello world")
+	err = ioutil.WriteFile(dir+"/mnt/file.txt", content, 0644)
+	CheckSuccess(err)
+	back, err := ioutil.ReadFile(dir + "/mnt/file.txt")
+	CheckSuccess(err)
+	if string(back) != string(content) {
+		t.Fatalf("content mismatch: %q", back)
+	}
+
+	// RELEASE is sent asynchronously by the kernel.
+	var closes []ProgressEvent
+	for i := 0; i < 100 && len(closes) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		closes = nil
+		obs.lock.Lock()
+		for _, ev := range obs.events {
+			if ev.Type == PROGRESS_CLOSE {
+				closes = append(closes, ev)
+			}
+		}
+		obs.lock.Unlock()
+	}
+
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	for _, ev := range obs.events {
+		if ev.Path != "file.txt" {
+			t.Errorf("unexpected path %q", ev.Path)
+		}
+	}
+	if len(closes) != 2 {
+		t.Fatalf("want 2 close events, got %v", obs.events)
+	}
+	if closes[0].BytesWritten != int64(len(content)) {
+		t.Errorf("written: got %d, want %d", closes[0].BytesWritten, len(content))
+	}
+	if closes[1].BytesRead != int64(len(content)) {
+		t.Errorf("read: got %d, want %d", closes[1].BytesRead, len(content))
+	}
+}
+
+type nopObserver struct{}
+
+func (o nopObserver) Progress(ev *ProgressEvent) {}
+
+func TestProgressThrottle(t *testing.T) {
+	fs := NewProgressFileSystem(nil, nopObserver{}, 1)
+	if !fs.throttle() {
+		t.Error("first event should pass")
+	}
+	if fs.throttle() {
+		t.Error("second event within interval should be dropped")
+	}
+}
@@ -0,0 +1,103 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestPathNodeFsReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), &PathNodeFsOptions{ReadOnly: true})
+	c := NewFileSystemConnector(pfs, nil)
+	if !c.readOnly() {
+		t.Error("connector does not ask for a read-only mount")
+	}
+	root := pfs.Root().(*pathInode)
+	var a Attr
+	node, code := root.Lookup(&a, "file", nil)
+	if !code.Ok() {
+		t.Fatal("Lookup:", code)
+	}
+	file := node.(*pathInode)
+
+	if f, code := file.Open(uint32(os.O_RDONLY), nil); !code.Ok() {
+		t.Error("Open for reading:", code)
+	} else {
+		f.Release(&ReleaseIn{})
+	}
+	for name, code := range map[string]Status{
+		"Open":     func() Status { _, c := file.Open(uint32(os.O_WRONLY), nil); return c }(),
+		"Access":   file.Access(raw.W_OK, nil),
+		"Truncate": file.Truncate(nil, 0, nil),
+		"Chmod":    file.Chmod(nil, 0600, nil),
+		"Unlink":   root.Unlink("file", nil),
+		"Rename":   root.Rename("file", root, "other", nil),
+		"Mkdir":    func() Status { _, c := root.Mkdir("dir", 0755, nil); return c }(),
+		"Create":   func() Status { _, _, c := root.Create("new", 0, 0644, nil); return c }(),
+		"SetXAttr": file.SetXAttr("user.attr", []byte("x"), 0, nil),
+	} {
+		if code != EROFS {
+			t.Errorf("%s: got %v, want EROFS", name, code)
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	CheckSuccess(err)
+	if len(names) != 1 {
+		t.Errorf("directory changed: %v", names)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "file")); err != nil || fi.Size() != 4 || fi.Mode().Perm() != 0644 {
+		t.Errorf("file changed: %v, %v", fi, err)
+	}
+}
+
+func TestReadonlyFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+
+	fs := NewReadonlyFileSystem(NewLoopbackFileSystem(dir))
+	if a, code := fs.GetAttr("file", nil); !code.Ok() || a.Mode&0777 != 0444 {
+		t.Errorf("GetAttr: %v %v", a, code)
+	}
+	f, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal("Open for reading:", code)
+	}
+	defer f.Release(&ReleaseIn{})
+	var a Attr
+	if code := f.GetAttr(&a); !code.Ok() || a.Mode&0777 != 0444 {
+		t.Errorf("File.GetAttr: %v %v", &a, code)
+	}
+
+	for name, code := range map[string]Status{
+		"Open":         func() Status { _, c := fs.Open("file", uint32(os.O_RDWR), nil); return c }(),
+		"Create":       func() Status { _, c := fs.Create("new", 0, 0644, nil); return c }(),
+		"Access":       fs.Access("file", raw.W_OK, nil),
+		"Truncate":     fs.Truncate("file", 0, nil),
+		"Rename":       fs.Rename("file", "other", nil),
+		"Unlink":       fs.Unlink("file", nil),
+		"SetXAttr":     fs.SetXAttr("file", "user.attr", []byte("x"), 0, nil),
+		"File.Write":   func() Status { _, c := f.Write(&WriteIn{}, []byte("x")); return c }(),
+		"File.Setattr": f.Setattr(raw.FATTR_SIZE, &Attr{}, nil),
+	} {
+		if code != EROFS {
+			t.Errorf("%s: got %v, want EROFS", name, code)
+		}
+	}
+	if code := fs.Access("file", raw.R_OK, nil); !code.Ok() {
+		t.Errorf("Access for reading: %v", code)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "file")); err != nil || fi.Size() != 4 || fi.Mode().Perm() != 0644 {
+		t.Errorf("file changed: %v, %v", fi, err)
+	}
+}
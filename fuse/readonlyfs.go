@@ -2,15 +2,31 @@ package fuse
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
 )
 
-// This is a wrapper that only exposes read-only operations.
+// This is a wrapper that only exposes read-only operations.  Changes
+// fail with EROFS, and the write bits are taken off modes, so
+// programs do not try them.  Unlike PathNodeFsOptions.ReadOnly, it
+// can be used on a FileSystem that is mounted in several ways, or
+// that is part of another one, eg. a branch of a union.
 type ReadonlyFileSystem struct {
 	FileSystem
 }
 
+// NewReadonlyFileSystem wraps fs.
+func NewReadonlyFileSystem(fs FileSystem) *ReadonlyFileSystem {
+	return &ReadonlyFileSystem{fs}
+}
+
 func (fs *ReadonlyFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
-	return fs.FileSystem.GetAttr(name, context)
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if a != nil {
+		a.Mode &^= 0222
+	}
+	return a, code
 }
 
 func (fs *ReadonlyFileSystem) Readlink(name string, context *Context) (string, Status) {
@@ -18,63 +34,80 @@ func (fs *ReadonlyFileSystem) Readlink(name string, context *Context) (string, S
 }
 
 func (fs *ReadonlyFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Unlink(name string, context *Context) (code Status) {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Rmdir(name string, context *Context) (code Status) {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Link(oldName string, newName string, context *Context) (code Status) {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) (code Status) {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Truncate(name string, offset uint64, context *Context) (code Status) {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
 	if flags&O_ANYWRITE != 0 {
-		return nil, EPERM
+		return nil, EROFS
 	}
 	file, code = fs.FileSystem.Open(name, flags, context)
-	return &ReadOnlyFile{file}, code
+	return readOnlyFile(file), code
+}
+
+// readOnlyFile wraps f in a ReadOnlyFile, inside its flags.
+func readOnlyFile(f File) File {
+	if f == nil {
+		return nil
+	}
+	if withFlags, ok := f.(*WithFlags); ok {
+		wrapped := *withFlags
+		wrapped.File = readOnlyFile(withFlags.File)
+		return &wrapped
+	}
+	return &ReadOnlyFile{f}
 }
 
 func (fs *ReadonlyFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, status Status) {
 	return fs.FileSystem.OpenDir(name, context)
 }
 
+func (fs *ReadonlyFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, status Status) {
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
 func (fs *ReadonlyFileSystem) OnMount(nodeFs *PathNodeFs) {
 	fs.FileSystem.OnMount(nodeFs)
 }
 
-func (fs *ReadonlyFileSystem) OnUnmount() {
-	fs.FileSystem.OnUnmount()
+func (fs *ReadonlyFileSystem) OnUnmount(reason UnmountReason) {
+	fs.FileSystem.OnUnmount(reason)
 }
 
 func (fs *ReadonlyFileSystem) String() string {
@@ -82,15 +115,18 @@ func (fs *ReadonlyFileSystem) String() string {
 }
 
 func (fs *ReadonlyFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
+	if mode&raw.W_OK != 0 {
+		return EROFS
+	}
 	return fs.FileSystem.Access(name, mode, context)
 }
 
 func (fs *ReadonlyFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
-	return nil, EPERM
+	return nil, EROFS
 }
 
-func (fs *ReadonlyFileSystem) Utimens(name string, AtimeNs int64, CtimeNs int64, context *Context) (code Status) {
-	return EPERM
+func (fs *ReadonlyFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
@@ -98,7 +134,7 @@ func (fs *ReadonlyFileSystem) GetXAttr(name string, attr string, context *Contex
 }
 
 func (fs *ReadonlyFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
-	return EPERM
+	return EROFS
 }
 
 func (fs *ReadonlyFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
@@ -106,5 +142,5 @@ func (fs *ReadonlyFileSystem) ListXAttr(name string, context *Context) ([]string
 }
 
 func (fs *ReadonlyFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
-	return EPERM
+	return EROFS
 }
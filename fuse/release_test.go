@@ -0,0 +1,92 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// closeFs records the Flush and Release calls of its files.
+type closeFs struct {
+	DefaultFileSystem
+
+	mu       sync.Mutex
+	flushes  []FlushIn
+	released chan ReleaseIn
+}
+
+func (fs *closeFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	switch name {
+	case "":
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	case "file":
+		return &Attr{Mode: S_IFREG | 0644}, OK
+	}
+	return nil, ENOENT
+}
+
+func (fs *closeFs) Open(name string, flags uint32, context *Context) (File, Status) {
+	return &closeFile{fs: fs}, OK
+}
+
+type closeFile struct {
+	DefaultFile
+	fs *closeFs
+}
+
+func (f *closeFile) Flush(input *FlushIn) Status {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.flushes = append(f.fs.flushes, *input)
+	return OK
+}
+
+func (f *closeFile) Release(input *ReleaseIn) {
+	f.fs.released <- *input
+}
+
+func TestReleaseFlushLockOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	fs := &closeFs{released: make(chan ReleaseIn, 2)}
+	state, _, err := MountNodeFileSystem(dir, NewPathNodeFs(fs, nil), nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	f, err := os.Open(dir + "/file")
+	CheckSuccess(err)
+	dup, err := syscall.Dup(int(f.Fd()))
+	CheckSuccess(err)
+	CheckSuccess(syscall.Close(dup))
+
+	select {
+	case in := <-fs.released:
+		t.Fatalf("released after closing dup'ed descriptor: %v", in)
+	default:
+	}
+
+	f.Close()
+	select {
+	case <-fs.released:
+	case <-time.After(time.Second):
+		t.Fatal("no release after final close")
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(fs.flushes) != 2 {
+		t.Fatalf("got %d flushes, want one per close: %v", len(fs.flushes), fs.flushes)
+	}
+	for _, in := range fs.flushes {
+		if in.LockOwner == 0 {
+			t.Errorf("flush without lock owner: %v", in)
+		}
+	}
+}
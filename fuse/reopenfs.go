@@ -0,0 +1,239 @@
+package fuse
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ReopenStats counts the attempts to replace stale files.
+type ReopenStats struct {
+	Attempts  int64
+	Successes int64
+	Failures  int64
+}
+
+// ReopenFileSystem is a wrapper for backends whose file descriptors
+// may go stale, such as a LoopbackFileSystem on NFS, or a proxy whose
+// server restarts.  When an operation on an open file returns
+// ESTALE, the file is opened again by its path and the operation is
+// retried, so applications holding the file open through the mount
+// do not notice.  Each open file is reopened at most MaxReopens
+// times.
+type ReopenFileSystem struct {
+	FileSystem
+
+	MaxReopens int
+
+	stats ReopenStats
+
+	lock  sync.Mutex
+	files map[*reopenFile]bool
+}
+
+// NewReopenFileSystem wraps fs.
+func NewReopenFileSystem(fs FileSystem, maxReopens int) *ReopenFileSystem {
+	return &ReopenFileSystem{
+		FileSystem: fs,
+		MaxReopens: maxReopens,
+		files:      map[*reopenFile]bool{},
+	}
+}
+
+func (fs *ReopenFileSystem) String() string {
+	return fmt.Sprintf("ReopenFileSystem(%s)", fs.FileSystem.String())
+}
+
+// Stats returns a snapshot of the reopen counters.
+func (fs *ReopenFileSystem) Stats() ReopenStats {
+	return ReopenStats{
+		Attempts:  atomic.LoadInt64(&fs.stats.Attempts),
+		Successes: atomic.LoadInt64(&fs.stats.Successes),
+		Failures:  atomic.LoadInt64(&fs.stats.Failures),
+	}
+}
+
+func (fs *ReopenFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	file, code = fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return fs.newFile(file, name, flags, context), code
+}
+
+func (fs *ReopenFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	file, code = fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return fs.newFile(file, name, flags, context), code
+}
+
+// Rename updates the paths of open files, so they are reopened under
+// their new name.
+func (fs *ReopenFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
+	code = fs.FileSystem.Rename(oldName, newName, context)
+	if !code.Ok() {
+		return code
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for f := range fs.files {
+		f.lock.Lock()
+		if f.path == oldName {
+			f.path = newName
+		} else if strings.HasPrefix(f.path, oldName+"/") {
+			f.path = newName + f.path[len(oldName):]
+		}
+		f.lock.Unlock()
+	}
+	return code
+}
+
+func (fs *ReopenFileSystem) newFile(file File, name string, flags uint32, context *Context) File {
+	f := &reopenFile{
+		fs:    fs,
+		file:  file,
+		path:  name,
+		flags: flags &^ (syscall.O_CREAT | syscall.O_EXCL | syscall.O_TRUNC),
+	}
+	if context != nil {
+		f.context = *context
+	}
+	fs.lock.Lock()
+	fs.files[f] = true
+	fs.lock.Unlock()
+	return f
+}
+
+type reopenFile struct {
+	fs      *ReopenFileSystem
+	flags   uint32
+	context Context
+
+	lock    sync.Mutex
+	file    File
+	path    string
+	inode   *Inode
+	reopens int
+}
+
+func (f *reopenFile) current() File {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file
+}
+
+// reopen replaces stale by a fresh file. It returns false if the
+// operation should not be retried.
+func (f *reopenFile) reopen(stale File) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file != stale {
+		// Someone else reopened it already.
+		return true
+	}
+	if f.reopens >= f.fs.MaxReopens {
+		return false
+	}
+	f.reopens++
+	atomic.AddInt64(&f.fs.stats.Attempts, 1)
+	fresh, code := f.fs.FileSystem.Open(f.path, f.flags, &f.context)
+	if !code.Ok() {
+		atomic.AddInt64(&f.fs.stats.Failures, 1)
+		return false
+	}
+	atomic.AddInt64(&f.fs.stats.Successes, 1)
+	if f.inode != nil {
+		fresh.SetInode(f.inode)
+	}
+	f.file = fresh
+	stale.Release(&ReleaseIn{})
+	return true
+}
+
+// retry runs op, reopening the file as long as it returns ESTALE.
+func (f *reopenFile) retry(op func(File) Status) Status {
+	for {
+		file := f.current()
+		code := op(file)
+		if code != ESTALE || !f.reopen(file) {
+			return code
+		}
+	}
+}
+
+func (f *reopenFile) SetInode(inode *Inode) {
+	f.lock.Lock()
+	f.inode = inode
+	file := f.file
+	f.lock.Unlock()
+	file.SetInode(inode)
+}
+
+func (f *reopenFile) String() string {
+	return fmt.Sprintf("reopenFile(%s)", f.current().String())
+}
+
+func (f *reopenFile) InnerFile() File {
+	return f.current()
+}
+
+func (f *reopenFile) Read(input *ReadIn, bp BufferPool) (data []byte, code Status) {
+	f.retry(func(file File) Status {
+		data, code = file.Read(input, bp)
+		return code
+	})
+	return data, code
+}
+
+func (f *reopenFile) Write(input *WriteIn, data []byte) (written uint32, code Status) {
+	f.retry(func(file File) Status {
+		written, code = file.Write(input, data)
+		return code
+	})
+	return written, code
+}
+
+func (f *reopenFile) Flush(input *FlushIn) Status {
+	return f.retry(func(file File) Status { return file.Flush(input) })
+}
+
+func (f *reopenFile) Release(input *ReleaseIn) {
+	f.fs.lock.Lock()
+	delete(f.fs.files, f)
+	f.fs.lock.Unlock()
+	f.current().Release(input)
+}
+
+func (f *reopenFile) Fsync(flags int) Status {
+	return f.retry(func(file File) Status { return file.Fsync(flags) })
+}
+
+func (f *reopenFile) Truncate(size uint64, context *Context) Status {
+	return f.retry(func(file File) Status { return file.Truncate(size, context) })
+}
+
+func (f *reopenFile) GetAttr(out *Attr) Status {
+	return f.retry(func(file File) Status { return file.GetAttr(out) })
+}
+
+func (f *reopenFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	return f.retry(func(file File) Status { return file.Chown(uid, gid, context) })
+}
+
+func (f *reopenFile) Chmod(perms uint32, context *Context) Status {
+	return f.retry(func(file File) Status { return file.Chmod(perms, context) })
+}
+
+func (f *reopenFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	return f.retry(func(file File) Status { return file.Utimens(atime, mtime, context) })
+}
+
+func (f *reopenFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	return f.retry(func(file File) Status { return file.Setattr(valid, attr, context) })
+}
@@ -0,0 +1,85 @@
+package fuse
+
+import (
+	"syscall"
+	"testing"
+)
+
+// staleFs hands out files that go stale when gen is incremented.
+type staleFs struct {
+	DefaultFileSystem
+	gen    int
+	opened []string
+}
+
+func (fs *staleFs) Open(name string, flags uint32, context *Context) (File, Status) {
+	fs.opened = append(fs.opened, name)
+	return &staleFile{fs: fs, gen: fs.gen}, OK
+}
+
+func (fs *staleFs) Rename(oldName string, newName string, context *Context) Status {
+	return OK
+}
+
+type staleFile struct {
+	DefaultFile
+	fs  *staleFs
+	gen int
+}
+
+func (f *staleFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	if f.gen != f.fs.gen {
+		return nil, ESTALE
+	}
+	return []byte("data"), OK
+}
+
+func TestReopenFileSystem(t *testing.T) {
+	backend := &staleFs{}
+	fs := NewReopenFileSystem(backend, 2)
+
+	f, code := fs.Open("file", syscall.O_RDWR, nil)
+	if !code.Ok() {
+		t.Fatal("Open:", code)
+	}
+	read := func() Status {
+		_, code := f.Read(&ReadIn{Size: 4}, nil)
+		return code
+	}
+	if code := read(); !code.Ok() {
+		t.Fatal("Read:", code)
+	}
+
+	backend.gen++
+	if code := read(); !code.Ok() {
+		t.Fatal("Read after going stale:", code)
+	}
+
+	if code := fs.Rename("file", "renamed", nil); !code.Ok() {
+		t.Fatal("Rename:", code)
+	}
+	backend.gen++
+	if code := read(); !code.Ok() {
+		t.Fatal("Read after rename:", code)
+	}
+
+	backend.gen++
+	if code := read(); code != ESTALE {
+		t.Fatalf("got %v, want ESTALE after MaxReopens", code)
+	}
+
+	want := []string{"file", "file", "renamed"}
+	if len(backend.opened) != len(want) {
+		t.Fatalf("got opens %v, want %v", backend.opened, want)
+	}
+	for i := range want {
+		if backend.opened[i] != want[i] {
+			t.Errorf("open %d: got %q, want %q", i, backend.opened[i], want[i])
+		}
+	}
+	stats := fs.Stats()
+	if stats.Attempts != 2 || stats.Successes != 2 || stats.Failures != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	f.Release(&ReleaseIn{})
+}
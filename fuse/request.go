@@ -2,9 +2,7 @@ package fuse
 
 import (
 	"bytes"
-	"fmt"
 	"log"
-	"strings"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/raw"
@@ -16,6 +14,9 @@ var zeroOutBuf [160]byte
 func (req *request) Discard() {
 	req.pool.FreeBuffer(req.flatData)
 	req.pool.FreeBuffer(req.bufferPoolInputBuf)
+	if req.fdData != nil {
+		req.fdData.release()
+	}
 }
 
 type request struct {
@@ -43,6 +44,10 @@ type request struct {
 	status   Status
 	flatData []byte
 
+	// If set, the data of a READ reply is spliced from a file
+	// descriptor rather than taken from flatData.
+	fdData *fdData
+
 	// Space to keep header + structured data for what we send
 	// back to the kernel.
 	outBuf         [160]byte
@@ -53,6 +58,15 @@ type request struct {
 
 	// All information pertaining to opcode of this request.
 	handler *operationHandler
+
+	// Closed on interrupt, if someone asked for it; see
+	// Context.Interrupted.  Protected by MountState.notifyLock.
+	interrupt   chan struct{}
+	interrupted bool
+
+	// Notifications that wait for the reply.  Protected by
+	// MountState.notifyLock.
+	notifies []*pendingNotify
 }
 
 func (r *request) clear() {
@@ -65,58 +79,13 @@ func (r *request) clear() {
 	r.outData = nil
 	r.status = OK
 	r.flatData = nil
+	r.fdData = nil
 	r.preWriteNs = 0
 	r.startNs = 0
 	r.handler = nil
-}
-
-func (r *request) InputDebug() string {
-	val := " "
-	if r.handler.DecodeIn != nil {
-		val = fmt.Sprintf(" data: %v ", r.handler.DecodeIn(r.inData))
-	}
-
-	names := ""
-	if r.filenames != nil {
-		names = fmt.Sprintf("names: %v", r.filenames)
-	}
-
-	if len(r.arg) > 0 {
-		names += fmt.Sprintf(" %d bytes", len(r.arg))
-	}
-
-	return fmt.Sprintf("Dispatch: %s, NodeId: %v.%v%v",
-		operationName(r.inHeader.Opcode), r.inHeader.NodeId, val, names)
-}
-
-func (r *request) OutputDebug() string {
-	var val interface{}
-	if r.handler.DecodeOut != nil && r.outData != nil {
-		val = r.handler.DecodeOut(r.outData)
-	}
-
-	dataStr := ""
-	if val != nil {
-		dataStr = fmt.Sprintf("%v", val)
-	}
-
-	max := 1024
-	if len(dataStr) > max {
-		dataStr = dataStr[:max] + fmt.Sprintf(" ...trimmed")
-	}
-
-	flatStr := ""
-	if len(r.flatData) > 0 {
-		if r.handler.FileNameOut {
-			s := strings.TrimRight(string(r.flatData), "\x00")
-			flatStr = fmt.Sprintf(" %q", s)
-		} else {
-			flatStr = fmt.Sprintf(" %d bytes data\n", len(r.flatData))
-		}
-	}
-
-	return fmt.Sprintf("Serialize: %s code: %v value: %v%v",
-		operationName(r.inHeader.Opcode), r.status, dataStr, flatStr)
+	r.interrupt = nil
+	r.interrupted = false
+	r.notifies = nil
 }
 
 // setInput returns true if it takes ownership of the argument, false if not.
@@ -0,0 +1,221 @@
+package fuse
+
+import (
+	"fmt"
+	"time"
+)
+
+// rewriteFileSystem passes all paths through
+// PathNodeFsOptions.RewritePath before calling the FileSystem.
+type rewriteFileSystem struct {
+	FileSystem
+	rewrite PathRewriter
+}
+
+func (fs *rewriteFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *rewriteFileSystem) Readlink(name string, context *Context) (string, Status) {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return "", code
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *rewriteFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *rewriteFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *rewriteFileSystem) Unlink(name string, context *Context) (code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *rewriteFileSystem) Rmdir(name string, context *Context) (code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *rewriteFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	linkName, code = fs.rewrite(linkName)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *rewriteFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
+	if oldName, code = fs.rewrite(oldName); !code.Ok() {
+		return code
+	}
+	if newName, code = fs.rewrite(newName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *rewriteFileSystem) Link(oldName string, newName string, context *Context) (code Status) {
+	if oldName, code = fs.rewrite(oldName); !code.Ok() {
+		return code
+	}
+	if newName, code = fs.rewrite(newName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *rewriteFileSystem) LinkKey(name string, context *Context) (key string, code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return "", code
+	}
+	return fs.FileSystem.LinkKey(name, context)
+}
+
+func (fs *rewriteFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *rewriteFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) (code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *rewriteFileSystem) Truncate(name string, offset uint64, context *Context) (code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Truncate(name, offset, context)
+}
+
+func (fs *rewriteFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+func (fs *rewriteFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, status Status) {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *rewriteFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, status Status) {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *rewriteFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *rewriteFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+func (fs *rewriteFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	name, code = fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Utimens(name, Atime, Mtime, context)
+}
+
+func (fs *rewriteFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.GetXAttr(name, attr, context)
+}
+
+func (fs *rewriteFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *rewriteFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *rewriteFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *rewriteFileSystem) FsyncDir(name string, flags int, context *Context) Status {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.FsyncDir(name, flags, context)
+}
+
+func (fs *rewriteFileSystem) StatFs(name string) *StatfsOut {
+	name, code := fs.rewrite(name)
+	if !code.Ok() {
+		return nil
+	}
+	return fs.FileSystem.StatFs(name)
+}
+
+func (fs *rewriteFileSystem) String() string {
+	return fmt.Sprintf("rewrite(%s)", fs.FileSystem.String())
+}
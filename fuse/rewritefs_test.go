@@ -0,0 +1,43 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(os.MkdirAll(filepath.Join(dir, "jail/secret"), 0755))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "jail/file"), []byte("data"), 0644))
+
+	rewrite := func(name string) (string, Status) {
+		if strings.HasPrefix(name, "secret") {
+			return "", EACCES
+		}
+		return filepath.Join("jail", name), OK
+	}
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), &PathNodeFsOptions{RewritePath: rewrite})
+	NewFileSystemConnector(pfs, nil)
+	root := pfs.Root().(*pathInode)
+
+	var a Attr
+	if _, code := root.Lookup(&a, "file", nil); !code.Ok() || a.Size != 4 {
+		t.Errorf("Lookup file: %v, size %d", code, a.Size)
+	}
+	if _, code := root.Lookup(&a, "secret", nil); code != EACCES {
+		t.Errorf("Lookup secret: got %v, want EACCES", code)
+	}
+	if code := root.Rename("file", root, "secret", nil); code != EACCES {
+		t.Errorf("Rename into secret: got %v, want EACCES", code)
+	}
+
+	entries, code := root.OpenDir(nil)
+	if !code.Ok() || len(entries) != 2 {
+		t.Errorf("OpenDir: %v, %v", code, entries)
+	}
+}
@@ -0,0 +1,203 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+type setattrNode struct {
+	DefaultFsNode
+
+	mu    sync.Mutex
+	attr  Attr
+	valid []uint32
+}
+
+func (n *setattrNode) GetAttr(out *Attr, file File, context *Context) Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	*out = n.attr
+	return OK
+}
+
+func (n *setattrNode) Setattr(file File, valid uint32, attr *Attr, context *Context) Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.valid = append(n.valid, valid)
+	if valid&raw.FATTR_MODE != 0 {
+		n.attr.Mode = S_IFREG | attr.Mode
+	}
+	if valid&raw.FATTR_SIZE != 0 {
+		n.attr.Size = attr.Size
+	}
+	if valid&raw.FATTR_MTIME != 0 {
+		n.attr.Mtime = attr.Mtime
+		n.attr.Mtimensec = attr.Mtimensec
+	}
+	return OK
+}
+
+type setattrFs struct {
+	DefaultNodeFileSystem
+	root DefaultFsNode
+	file *setattrNode
+}
+
+func (fs *setattrFs) Root() FsNode {
+	return &fs.root
+}
+
+func (fs *setattrFs) OnMount(conn *FileSystemConnector) {
+	fs.root.Inode().AddChild("file", fs.root.Inode().New(false, fs.file))
+}
+
+func TestSetattr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	node := &setattrNode{}
+	node.attr.Mode = S_IFREG | 0644
+	fs := &setattrFs{file: node}
+	state, _, err := MountNodeFileSystem(dir, fs, nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	err = os.Chmod(dir+"/file", 0600)
+	CheckSuccess(err)
+	err = os.Truncate(dir+"/file", 42)
+	CheckSuccess(err)
+	mtime := time.Unix(1234567890, 0)
+	err = os.Chtimes(dir+"/file", mtime, mtime)
+	CheckSuccess(err)
+
+	fi, err := os.Lstat(dir + "/file")
+	CheckSuccess(err)
+	if fi.Mode().Perm() != 0600 || fi.Size() != 42 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("got mode %o size %d mtime %v", fi.Mode(), fi.Size(), fi.ModTime())
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	want := []uint32{
+		raw.FATTR_MODE,
+		raw.FATTR_SIZE,
+		raw.FATTR_ATIME | raw.FATTR_MTIME,
+	}
+	if len(node.valid) != len(want) {
+		t.Fatalf("got Setattr calls %v, want %v", node.valid, want)
+	}
+	for i, v := range node.valid {
+		if v&^(raw.FATTR_FH|raw.FATTR_LOCKOWNER) != want[i] {
+			t.Errorf("call %d: got valid %x, want %x", i, v, want[i])
+		}
+	}
+}
+
+// setattrFileFs opens files that implement Setattr.
+type setattrFileFs struct {
+	DefaultFileSystem
+	file *setattrFile
+}
+
+func (fs *setattrFileFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	if name == "" {
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	}
+	return &Attr{Mode: S_IFREG | 0644}, OK
+}
+
+func (fs *setattrFileFs) Open(name string, flags uint32, context *Context) (File, Status) {
+	return fs.file, OK
+}
+
+type setattrFile struct {
+	DefaultFile
+	valid []uint32
+}
+
+func (f *setattrFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	f.valid = append(f.valid, valid)
+	return OK
+}
+
+// A SETATTR on a file handle goes to that file, even if it was
+// opened read-only.
+func TestPathFsSetattrFile(t *testing.T) {
+	fs := &setattrFileFs{file: &setattrFile{}}
+	c := NewFileSystemConnector(NewPathNodeFs(fs, nil), nil)
+	var entry raw.EntryOut
+	if code := c.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file"); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	header := &raw.InHeader{NodeId: entry.NodeId}
+	var open raw.OpenOut
+	if code := c.Open(&open, header, &raw.OpenIn{Flags: uint32(os.O_RDONLY)}); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	var out raw.AttrOut
+	in := &raw.SetAttrIn{Valid: raw.FATTR_FH | raw.FATTR_MTIME, Fh: open.Fh}
+	if code := c.SetAttr(&out, header, in); !code.Ok() {
+		t.Fatalf("SetAttr: %v", code)
+	}
+	if len(fs.file.valid) != 1 || fs.file.valid[0]&raw.FATTR_MTIME == 0 {
+		t.Errorf("got Setattr calls %v, want one with FATTR_MTIME", fs.file.valid)
+	}
+}
+
+// utimensFs records the times passed to Utimens.
+type utimensFs struct {
+	setattrFileFs
+	atime, mtime *time.Time
+}
+
+func (fs *utimensFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *Context) Status {
+	fs.atime, fs.mtime = atime, mtime
+	return OK
+}
+
+// FATTR_MTIME_NOW reaches Utimens as UtimeNow, so the file system
+// can leave the permission check of touch(1) to utimensat.
+func TestSetattrMtimeNow(t *testing.T) {
+	fs := &utimensFs{}
+	c := NewFileSystemConnector(NewPathNodeFs(fs, nil), nil)
+	var entry raw.EntryOut
+	if code := c.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file"); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	var out raw.AttrOut
+	in := &raw.SetAttrIn{Valid: raw.FATTR_MTIME | raw.FATTR_MTIME_NOW}
+	if code := c.SetAttr(&out, &raw.InHeader{NodeId: entry.NodeId}, in); !code.Ok() {
+		t.Fatalf("SetAttr: %v", code)
+	}
+	if fs.atime != nil || !IsUtimeNow(fs.mtime) {
+		t.Errorf("got Utimens(%v, %v), want Utimens(nil, UtimeNow)", fs.atime, fs.mtime)
+	}
+}
+
+func TestLoopbackUtimeNow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(dir+"/file", nil, 0644))
+	old := time.Unix(1234567890, 0)
+	CheckSuccess(os.Chtimes(dir+"/file", old, old))
+
+	start := time.Now().Add(-time.Second)
+	fs := NewLoopbackFileSystem(dir)
+	if code := fs.Utimens("file", nil, &UtimeNow, nil); !code.Ok() {
+		t.Fatalf("Utimens: %v", code)
+	}
+	fi, err := os.Lstat(dir + "/file")
+	CheckSuccess(err)
+	if fi.ModTime().Before(start) {
+		t.Errorf("got mtime %v, want the current time", fi.ModTime())
+	}
+}
@@ -0,0 +1,131 @@
+package fuse
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const _DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// ShutdownOptions configures UnmountOnSignal.
+type ShutdownOptions struct {
+	// The signals that start the shutdown.  If empty, SIGINT and
+	// SIGTERM.
+	Signals []os.Signal
+
+	// How long to wait for the requests in flight, before they
+	// are interrupted.  If zero, 10 seconds; if negative, there
+	// is no limit.
+	Timeout time.Duration
+
+	// What to do if the mount is busy.
+	Unmount *UnmountOptions
+}
+
+// Shutdown stops serving new requests, waits for the requests in
+// flight to finish, writes the notifications that were waiting for
+// them, and unmounts.  Requests that arrive in the meantime are held
+// back, and aborted by the unmount.  On success, it waits for Loop
+// to return like Unmount.
+//
+// If ctx is done first, the requests still running are interrupted,
+// see Context.Interrupted, and it unmounts without waiting for them;
+// Loop returns once they finish.  If unmounting fails, eg. because
+// the mount is busy, serving resumes and the error is returned.
+func (ms *MountState) Shutdown(ctx context.Context) error {
+	return ms.shutdown(ctx, nil)
+}
+
+func (ms *MountState) shutdown(ctx context.Context, opts *UnmountOptions) error {
+	paused := make(chan *PauseToken, 1)
+	go func() {
+		paused <- ms.Pause(0)
+	}()
+
+	var token *PauseToken
+	select {
+	case token = <-paused:
+		ms.flushNotify()
+	case <-ctx.Done():
+		n := ms.interruptAll()
+		log.Printf("Shutdown: %v with %d requests in flight; interrupting them, and unmounting anyway", ctx.Err(), n)
+	}
+
+	method, err := ms.detach(opts)
+	if token != nil {
+		token.Resume()
+	} else {
+		// The pause starts when the stragglers are done.
+		go func() {
+			(<-paused).Resume()
+		}()
+	}
+	if err != nil || token == nil || method == UNMOUNT_LAZY {
+		return err
+	}
+	ms.waitLoop()
+	return nil
+}
+
+// shutdownTimeout is shutdown with a timeout; a negative timeout
+// waits indefinitely.
+func (ms *MountState) shutdownTimeout(timeout time.Duration, opts *UnmountOptions) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return ms.shutdown(ctx, opts)
+}
+
+// UnmountOnSignal calls Shutdown when one of the signals in opts
+// arrives, so a daemon that is killed does not leave a stale mount
+// behind.  If the shutdown fails, the next signal tries again.  The
+// returned function stops listening for the signals; the handler
+// stops by itself once Loop returns.
+func (ms *MountState) UnmountOnSignal(opts *ShutdownOptions) (stop func()) {
+	o := ShutdownOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if len(o.Signals) == 0 {
+		o.Signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	if o.Timeout == 0 {
+		o.Timeout = _DEFAULT_SHUTDOWN_TIMEOUT
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, o.Signals...)
+	quit := make(chan struct{})
+	mountPoint := ms.MountPoint()
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case sig := <-sigs:
+				log.Printf("Got %v, unmounting %s", sig, mountPoint)
+				err := ms.shutdownTimeout(o.Timeout, o.Unmount)
+				if err == nil {
+					return
+				}
+				log.Printf("Unmounting %s failed: %v", mountPoint, err)
+			case <-ms.loopDone:
+				return
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+	}
+}
@@ -0,0 +1,133 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// startSlowGetAttr serves a connection on a socketpair, and sends
+// a GETATTR that blocks in unmountFs until block is closed.
+func startSlowGetAttr(t *testing.T) (ms *MountState, local *os.File, root *unmountFs, done chan bool) {
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+	fd, err := syscall.Dup(int(remote.Fd()))
+	CheckSuccess(err)
+	remote.Close()
+
+	events := make(chan string, 10)
+	root = &unmountFs{name: "root", events: events}
+	c := NewFileSystemConnector(NewPathNodeFs(root, nil), nil)
+	entry := raw.EntryOut{}
+	if code := c.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "slow"); !code.Ok() {
+		t.Fatal("Lookup:", code)
+	}
+	root.block = make(chan bool)
+
+	ms, err = NewMountStateFd(c, fd, "", nil)
+	CheckSuccess(err)
+	done = make(chan bool)
+	go func() {
+		ms.Loop()
+		done <- true
+	}()
+
+	type getAttrRequest struct {
+		header raw.InHeader
+		in     raw.GetAttrIn
+	}
+	input := getAttrRequest{
+		header: raw.InHeader{
+			Opcode: _OP_GETATTR,
+			Unique: 1,
+			NodeId: entry.NodeId,
+		},
+	}
+	input.header.Length = uint32(unsafe.Sizeof(input))
+	_, err = local.Write((*[unsafe.Sizeof(input)]byte)(unsafe.Pointer(&input))[:])
+	CheckSuccess(err)
+	if got := <-events; got != "getattr" {
+		t.Fatalf("got %q, want getattr", got)
+	}
+	return ms, local, root, done
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	ms, local, root, done := startSlowGetAttr(t)
+	defer local.Close()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- ms.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned during GetAttr: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(root.block)
+	var reply raw.OutHeader
+	n, err := local.Read((*[unsafe.Sizeof(reply)]byte)(unsafe.Pointer(&reply))[:])
+	if err != nil || n < int(unsafe.Sizeof(reply)) || reply.Unique != 1 || reply.Status != 0 {
+		t.Errorf("GETATTR reply: %d bytes, %+v, %v", n, reply, err)
+	}
+	CheckSuccess(<-shutdown)
+	<-done
+	if got := <-root.events; got != "root:daemon" {
+		t.Errorf("got %q, want root:daemon", got)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ms, local, root, done := startSlowGetAttr(t)
+	defer local.Close()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	CheckSuccess(ms.Shutdown(ctx))
+	if dt := time.Now().Sub(start); dt > time.Second {
+		t.Errorf("Shutdown took %v", dt)
+	}
+
+	// The GetAttr was interrupted, so Loop returns without it.
+	<-done
+	if got := <-root.events; got != "root:daemon" {
+		t.Errorf("got %q, want root:daemon", got)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	ms, local, _, done := startSlowGetAttr(t)
+	defer local.Close()
+
+	type interruptRequest struct {
+		header raw.InHeader
+		in     raw.InterruptIn
+	}
+	input := interruptRequest{
+		header: raw.InHeader{Opcode: _OP_INTERRUPT, Unique: 2},
+		in:     raw.InterruptIn{Unique: 1},
+	}
+	input.header.Length = uint32(unsafe.Sizeof(input))
+	_, err := local.Write((*[unsafe.Sizeof(input)]byte)(unsafe.Pointer(&input))[:])
+	CheckSuccess(err)
+
+	// The INTERRUPT itself is not answered.
+	var reply raw.OutHeader
+	n, err := local.Read((*[unsafe.Sizeof(reply)]byte)(unsafe.Pointer(&reply))[:])
+	if err != nil || n < int(unsafe.Sizeof(reply)) || reply.Unique != 1 || Status(-reply.Status) != Status(syscall.EINTR) {
+		t.Errorf("GETATTR reply: %d bytes, %+v, %v", n, reply, err)
+	}
+
+	CheckSuccess(ms.Unmount())
+	<-done
+}
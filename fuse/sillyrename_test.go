@@ -0,0 +1,107 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestSillyRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	for _, n := range []string{"file", "target", "source"} {
+		CheckSuccess(ioutil.WriteFile(filepath.Join(dir, n), []byte(n), 0644))
+	}
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), &PathNodeFsOptions{SillyRename: true})
+	c := NewFileSystemConnector(pfs, nil)
+	rootHeader := &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}
+
+	open := func(name string) (*raw.InHeader, uint64) {
+		entry := raw.EntryOut{}
+		if code := c.Lookup(&entry, rootHeader, name); !code.Ok() {
+			t.Fatalf("Lookup %q: %v", name, code)
+		}
+		header := &raw.InHeader{NodeId: entry.NodeId}
+		out := raw.OpenOut{}
+		if code := c.Open(&out, header, &raw.OpenIn{Flags: uint32(os.O_RDONLY)}); !code.Ok() {
+			t.Fatalf("Open %q: %v", name, code)
+		}
+		return header, out.Fh
+	}
+	hidden := func() []string {
+		names, err := filepath.Glob(filepath.Join(dir, ".fuse_hidden*"))
+		CheckSuccess(err)
+		return names
+	}
+
+	header, fh := open("file")
+	if code := c.Unlink(rootHeader, "file"); !code.Ok() {
+		t.Fatal("Unlink:", code)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Errorf("file still exists after unlink: %v", err)
+	}
+	if h := hidden(); len(h) != 1 {
+		t.Errorf("want 1 hidden file, got %v", h)
+	}
+	attr := raw.AttrOut{}
+	if code := c.GetAttr(&attr, header, &raw.GetAttrIn{}); !code.Ok() || attr.Size != 4 {
+		t.Errorf("GetAttr on unlinked open file: %v, size %d", code, attr.Size)
+	}
+	c.Release(header, &raw.ReleaseIn{Fh: fh})
+	if h := hidden(); len(h) != 0 {
+		t.Errorf("hidden files left after release: %v", h)
+	}
+
+	header, fh = open("target")
+	if code := c.Rename(rootHeader, &raw.RenameIn{Newdir: raw.FUSE_ROOT_ID}, "source", "target"); !code.Ok() {
+		t.Fatal("Rename:", code)
+	}
+	if h := hidden(); len(h) != 1 {
+		t.Errorf("want 1 hidden file, got %v", h)
+	}
+	attr = raw.AttrOut{}
+	if code := c.GetAttr(&attr, header, &raw.GetAttrIn{}); !code.Ok() {
+		t.Errorf("GetAttr on replaced open file: %v", code)
+	}
+	c.Release(header, &raw.ReleaseIn{Fh: fh})
+	if h := hidden(); len(h) != 0 {
+		t.Errorf("hidden files left after release: %v", h)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "target")); err != nil || string(data) != "source" {
+		t.Errorf("target after rename: %q, %v", data, err)
+	}
+}
+
+// The files of a SillyRename file system keep their optional
+// interfaces, eg. for splicing reads.
+func TestSillyRenameFdFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644))
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), &PathNodeFsOptions{SillyRename: true})
+	c := NewFileSystemConnector(pfs, nil)
+	entry := raw.EntryOut{}
+	if code := c.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file"); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	header := &raw.InHeader{NodeId: entry.NodeId}
+	out := raw.OpenOut{}
+	if code := c.Open(&out, header, &raw.OpenIn{Flags: uint32(os.O_RDONLY)}); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer c.Release(header, &raw.ReleaseIn{Fh: out.Fh})
+
+	_, release, ok := c.readFd(header, &ReadIn{Fh: out.Fh})
+	if !ok {
+		t.Fatal("readFd: no descriptor for a loopback file")
+	}
+	release()
+}
@@ -0,0 +1,138 @@
+package fuse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SizeHistogram counts request sizes per operation in power-of-two
+// buckets.  Bucket 0 holds empty requests; bucket i holds the sizes
+// above BucketLimit(i-1) up to BucketLimit(i).
+type SizeHistogram struct {
+	sync.Mutex
+	buckets map[string][]int
+}
+
+func NewSizeHistogram() *SizeHistogram {
+	return &SizeHistogram{
+		buckets: make(map[string][]int),
+	}
+}
+
+func sizeBucket(size uint32) int {
+	b := 0
+	for s := uint64(1); s < uint64(size); s <<= 1 {
+		b++
+	}
+	if size > 0 {
+		b++
+	}
+	return b
+}
+
+// BucketLimit returns the largest size counted in bucket b.
+func BucketLimit(b int) uint32 {
+	if b == 0 {
+		return 0
+	}
+	return 1 << uint(b-1)
+}
+
+func (h *SizeHistogram) Add(name string, size uint32) {
+	b := sizeBucket(size)
+	h.Mutex.Lock()
+	counts := h.buckets[name]
+	for len(counts) <= b {
+		counts = append(counts, 0)
+	}
+	counts[b]++
+	h.buckets[name] = counts
+	h.Mutex.Unlock()
+}
+
+// Buckets returns a copy of the bucket counts for name.
+func (h *SizeHistogram) Buckets(name string) []int {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	return append([]int(nil), h.buckets[name]...)
+}
+
+func (h *SizeHistogram) String() string {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	names := make([]string, 0, len(h.buckets))
+	for k := range h.buckets {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, n := range names {
+		var parts []string
+		for b, c := range h.buckets[n] {
+			if c > 0 {
+				parts = append(parts, fmt.Sprintf("<=%d:%d", BucketLimit(b), c))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", n, strings.Join(parts, " ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// fraction returns the fraction of the requests for name with size
+// at most limit, and the total number of requests.
+func (h *SizeHistogram) fraction(name string, limit uint32) (float64, int) {
+	total := 0
+	below := 0
+	for b, c := range h.Buckets(name) {
+		total += c
+		if BucketLimit(b) <= limit {
+			below += c
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(below) / float64(total), total
+}
+
+// Below this many requests, we don't make suggestions.
+const _MIN_TUNING_SAMPLES = 100
+
+// TuningSuggestions inspects the statistics recorded since
+// SetRecordStatistics(true), and returns suggestions for options that
+// may improve throughput.
+func (ms *MountState) TuningSuggestions() []string {
+	if ms.sizes == nil || ms.latencies == nil {
+		return []string{"enable statistics with SetRecordStatistics(true) to get suggestions"}
+	}
+	var result []string
+
+	maxWrite := uint32(ms.opts.MaxWrite)
+	small, total := ms.sizes.fraction("WRITE", maxWrite/2)
+	if total >= _MIN_TUNING_SAMPLES && small < 0.5 && maxWrite < MAX_KERNEL_WRITE {
+		result = append(result, fmt.Sprintf(
+			"%.0f%% of writes are larger than half of MaxWrite (%d); raise MountOptions.MaxWrite up to %d",
+			100*(1-small), maxWrite, MAX_KERNEL_WRITE))
+	}
+
+	small, total = ms.sizes.fraction("WRITE", 4096)
+	if total >= _MIN_TUNING_SAMPLES && small > 0.5 {
+		result = append(result, fmt.Sprintf(
+			"%.0f%% of writes are 4k or smaller; buffer writes in the File implementation "+
+				"(kernel writeback caching is not supported)",
+			100*small))
+	}
+
+	counts := ms.latencies.Counts()
+	lookups, readdirs := counts["LOOKUP"], counts["READDIR"]
+	if readdirs > 0 && lookups >= _MIN_TUNING_SAMPLES && lookups > 10*readdirs {
+		result = append(result, fmt.Sprintf(
+			"%d LOOKUPs for %d READDIRs suggest stat-after-readdir; raise FileSystemOptions.EntryTimeout "+
+				"and AttrTimeout (READDIRPLUS is not supported)",
+			lookups, readdirs))
+	}
+	return result
+}
@@ -0,0 +1,42 @@
+package fuse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSizeHistogram(t *testing.T) {
+	h := NewSizeHistogram()
+	for _, s := range []uint32{0, 1, 2, 3, 4, 4096, 4097} {
+		h.Add("READ", s)
+	}
+	b := h.Buckets("READ")
+	for i, want := range map[int]int{0: 1, 1: 1, 2: 1, 3: 2, 13: 1, 14: 1} {
+		if b[i] != want {
+			t.Errorf("bucket %d (<=%d): got %d, want %d", i, BucketLimit(i), b[i], want)
+		}
+	}
+	if !strings.Contains(h.String(), "<=4096:1") {
+		t.Errorf("unexpected String(): %s", h.String())
+	}
+}
+
+func TestTuningSuggestions(t *testing.T) {
+	ms := NewMountState(&DefaultRawFileSystem{})
+	ms.setOptions(&MountOptions{MaxWrite: 16384})
+	if s := ms.TuningSuggestions(); len(s) != 1 || !strings.Contains(s[0], "SetRecordStatistics") {
+		t.Errorf("want hint to enable statistics, got %v", s)
+	}
+
+	ms.SetRecordStatistics(true)
+	if s := ms.TuningSuggestions(); len(s) != 0 {
+		t.Errorf("want no suggestions without data, got %v", s)
+	}
+	for i := 0; i < _MIN_TUNING_SAMPLES; i++ {
+		ms.sizes.Add("WRITE", 16384)
+	}
+	s := ms.TuningSuggestions()
+	if len(s) != 1 || !strings.Contains(s[0], "MaxWrite") {
+		t.Errorf("want MaxWrite suggestion, got %v", s)
+	}
+}
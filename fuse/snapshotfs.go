@@ -0,0 +1,560 @@
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// SnapshotFileSystem is a wrapper that keeps the previous versions of
+// files.  Before a file is changed for the first time through an open
+// file, before it is truncated, and when it is unlinked or renamed
+// over, its contents are kept as
+//
+//	.snapshots/<path>/@GMT-2006.01.02-15.04.05
+//
+// named after the time of the change, in UTC, and with the old
+// modification time.  Versions can be read and deleted, but not
+// changed.  Empty files, and files that already got a version in the
+// same second, are not kept again.
+//
+// The whole tree as it was at the end of a second can also be read,
+// as the directory .snapshots/@GMT-<time>.  These directories are not
+// listed, but any time can be looked up.  They are made from the
+// versions of each file, so files that were changed without being
+// kept, eg. by chmod, show their current state.
+type SnapshotFileSystem struct {
+	FileSystem
+
+	options SnapshotOptions
+
+	// Serializes making versions.
+	lock sync.Mutex
+
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+type SnapshotOptions struct {
+	// Dir is the directory of the versions, relative to the
+	// root.  Defaults to ".snapshots".
+	Dir string
+
+	// MaxVersions is the number of versions kept of each file;
+	// the oldest are removed.  0 keeps all of them.
+	MaxVersions int
+}
+
+const _SNAPSHOT_FORMAT = "@GMT-2006.01.02-15.04.05"
+
+// NewSnapshotFileSystem wraps fs, which also holds the versions.
+func NewSnapshotFileSystem(fs FileSystem, opts *SnapshotOptions) *SnapshotFileSystem {
+	s := &SnapshotFileSystem{
+		FileSystem: fs,
+		now:        time.Now,
+	}
+	if opts != nil {
+		s.options = *opts
+	}
+	if s.options.Dir == "" {
+		s.options.Dir = ".snapshots"
+	}
+	s.options.Dir = strings.Trim(filepath.Clean(s.options.Dir), "/")
+	return s
+}
+
+func (fs *SnapshotFileSystem) String() string {
+	return fmt.Sprintf("SnapshotFileSystem(%s)", fs.FileSystem.String())
+}
+
+// inDir returns true if name is in the directory of versions.
+func (fs *SnapshotFileSystem) inDir(name string) bool {
+	return name == fs.options.Dir || strings.HasPrefix(name, fs.options.Dir+"/")
+}
+
+func parseSnapshotTime(name string) (time.Time, bool) {
+	t, err := time.ParseInLocation(_SNAPSHOT_FORMAT, name, time.UTC)
+	return t, err == nil
+}
+
+// view returns the time and the path within it, if name is in a tree
+// of a past time.
+func (fs *SnapshotFileSystem) view(name string) (t time.Time, rest string, ok bool) {
+	if !strings.HasPrefix(name, fs.options.Dir+"/") {
+		return t, "", false
+	}
+	name = name[len(fs.options.Dir)+1:]
+	first := name
+	if i := strings.Index(name, "/"); i >= 0 {
+		first, rest = name[:i], name[i+1:]
+	}
+	t, ok = parseSnapshotTime(first)
+	return t, rest, ok
+}
+
+// readOnly returns EROFS for names that cannot be changed.
+func (fs *SnapshotFileSystem) readOnly(name string) Status {
+	if fs.inDir(name) {
+		return EROFS
+	}
+	return OK
+}
+
+// versions returns the names of the versions of name, oldest first.
+func (fs *SnapshotFileSystem) versions(name string, context *Context) []string {
+	stream, code := fs.FileSystem.OpenDir(filepath.Join(fs.options.Dir, name), context)
+	if !code.Ok() {
+		return nil
+	}
+	var names []string
+	for _, e := range stream {
+		if _, ok := parseSnapshotTime(e.Name); ok {
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *SnapshotFileSystem) mkdirAll(dir string, context *Context) Status {
+	if dir == "" || dir == "." {
+		return OK
+	}
+	a, code := fs.FileSystem.GetAttr(dir, context)
+	if code.Ok() {
+		if !a.IsDir() {
+			return ENOTDIR
+		}
+		return OK
+	}
+	if code := fs.mkdirAll(filepath.Dir(dir), context); !code.Ok() {
+		return code
+	}
+	if code := fs.FileSystem.Mkdir(dir, 0755, context); !code.Ok() && code != Status(syscall.EEXIST) {
+		return code
+	}
+	return OK
+}
+
+// keep makes a version of name, by copying it, or if move is set, by
+// renaming it.  It returns ENOENT if there is nothing to keep.
+func (fs *SnapshotFileSystem) keep(name string, move bool, context *Context) Status {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if !a.IsRegular() || a.Size == 0 {
+		return ENOENT
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	dest := filepath.Join(fs.options.Dir, name, fs.now().UTC().Format(_SNAPSHOT_FORMAT))
+	if _, code := fs.FileSystem.GetAttr(dest, context); code.Ok() {
+		return ENOENT
+	}
+	if code := fs.mkdirAll(filepath.Dir(dest), context); !code.Ok() {
+		return code
+	}
+	if move {
+		code = fs.FileSystem.Rename(name, dest, context)
+	} else {
+		code = CopyFile(fs.FileSystem, fs.FileSystem, name, dest, context)
+		if code.Ok() {
+			atime, mtime := a.AccessTime(), a.ModTime()
+			code = fs.FileSystem.Utimens(dest, &atime, &mtime, context)
+		}
+		if !code.Ok() {
+			fs.FileSystem.Unlink(dest, context)
+		}
+	}
+	if !code.Ok() {
+		return code
+	}
+
+	if max := fs.options.MaxVersions; max > 0 {
+		old := fs.versions(name, context)
+		for len(old) > max {
+			fs.FileSystem.Unlink(filepath.Join(fs.options.Dir, name, old[0]), context)
+			old = old[1:]
+		}
+	}
+	return OK
+}
+
+// snapshot makes a copy of name before it changes.
+func (fs *SnapshotFileSystem) snapshot(name string, context *Context) Status {
+	if code := fs.keep(name, false, context); !code.Ok() && code != ENOENT {
+		log.Printf("SnapshotFileSystem: keeping %q: %v", name, code)
+		return code
+	}
+	return OK
+}
+
+// find returns the entry that showed name at the end of the second t:
+// the oldest later version, or the current entry.
+func (fs *SnapshotFileSystem) find(name string, t time.Time, context *Context) (string, *Attr, Status) {
+	if name == "" {
+		a, code := fs.FileSystem.GetAttr("", context)
+		return "", a, code
+	}
+	if fs.inDir(name) {
+		return "", nil, ENOENT
+	}
+	secs := uint64(t.Unix())
+	for _, v := range fs.versions(name, context) {
+		if vt, _ := parseSnapshotTime(v); !vt.After(t) {
+			continue
+		}
+		p := filepath.Join(fs.options.Dir, name, v)
+		a, code := fs.FileSystem.GetAttr(p, context)
+		if !code.Ok() {
+			return "", nil, code
+		}
+		if a.Mtime > secs {
+			// It was made later.
+			return "", nil, ENOENT
+		}
+		return p, a, OK
+	}
+
+	// Files that changed since t have a later version, so the
+	// current one is only new if it was made after t.
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if code.Ok() && (!a.IsRegular() || a.Mtime <= secs) {
+		return name, a, OK
+	}
+
+	// A removed directory, that still has versions of files that
+	// existed at t.
+	p := filepath.Join(fs.options.Dir, name)
+	if a, code := fs.FileSystem.GetAttr(p, context); code.Ok() && a.IsDir() {
+		stream, _ := fs.FileSystem.OpenDir(p, context)
+		for _, e := range stream {
+			if _, ok := parseSnapshotTime(e.Name); ok {
+				continue
+			}
+			if _, _, code := fs.find(filepath.Join(name, e.Name), t, context); code.Ok() {
+				return p, a, OK
+			}
+		}
+	}
+	return "", nil, ENOENT
+}
+
+// resolve returns the path to read for name, which may be in a tree
+// of a past time.
+func (fs *SnapshotFileSystem) resolve(name string, context *Context) (string, Status) {
+	t, rest, ok := fs.view(name)
+	if !ok {
+		return name, OK
+	}
+	p, _, code := fs.find(rest, t, context)
+	return p, code
+}
+
+func (fs *SnapshotFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	t, rest, ok := fs.view(name)
+	if !ok {
+		return fs.FileSystem.GetAttr(name, context)
+	}
+	_, a, code := fs.find(rest, t, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	c := *a
+	c.Mode &^= 0222
+	return &c, OK
+}
+
+func (fs *SnapshotFileSystem) Readlink(name string, context *Context) (string, Status) {
+	name, code := fs.resolve(name, context)
+	if !code.Ok() {
+		return "", code
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *SnapshotFileSystem) Access(name string, mode uint32, context *Context) Status {
+	if _, _, ok := fs.view(name); ok && mode&raw.W_OK != 0 {
+		return EROFS
+	}
+	name, code := fs.resolve(name, context)
+	if !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *SnapshotFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	name, code := fs.resolve(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.GetXAttr(name, attr, context)
+}
+
+func (fs *SnapshotFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
+	name, code := fs.resolve(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *SnapshotFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	if fs.inDir(name) {
+		if flags&O_ANYWRITE != 0 {
+			return nil, EROFS
+		}
+		if name, code = fs.resolve(name, context); !code.Ok() {
+			return nil, code
+		}
+		return fs.FileSystem.Open(name, flags, context)
+	}
+	if flags&O_ANYWRITE == 0 {
+		return fs.FileSystem.Open(name, flags, context)
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		if code := fs.snapshot(name, context); !code.Ok() {
+			return nil, code
+		}
+	}
+	file, code = fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() || flags&syscall.O_TRUNC != 0 {
+		return file, code
+	}
+	return &snapshotFile{File: file, fs: fs, name: name}, OK
+}
+
+func (fs *SnapshotFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (File, Status) {
+	if code := fs.readOnly(name); !code.Ok() {
+		return nil, code
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		if code := fs.snapshot(name, context); !code.Ok() {
+			return nil, code
+		}
+	}
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+func (fs *SnapshotFileSystem) Truncate(name string, size uint64, context *Context) Status {
+	if code := fs.readOnly(name); !code.Ok() {
+		return code
+	}
+	if code := fs.snapshot(name, context); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+// Unlink moves the file to its versions.  Versions themselves can be
+// removed.
+func (fs *SnapshotFileSystem) Unlink(name string, context *Context) Status {
+	if _, _, ok := fs.view(name); ok {
+		return EROFS
+	}
+	if fs.inDir(name) {
+		return fs.FileSystem.Unlink(name, context)
+	}
+	code := fs.keep(name, true, context)
+	if code == ENOENT {
+		return fs.FileSystem.Unlink(name, context)
+	}
+	return code
+}
+
+func (fs *SnapshotFileSystem) Rmdir(name string, context *Context) Status {
+	if _, _, ok := fs.view(name); ok || name == fs.options.Dir {
+		return EROFS
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+// Rename keeps the file that is renamed over.
+func (fs *SnapshotFileSystem) Rename(oldName string, newName string, context *Context) Status {
+	if fs.inDir(oldName) || fs.inDir(newName) {
+		return EROFS
+	}
+	// Do not move the target away if the rename cannot work.
+	if _, code := fs.FileSystem.GetAttr(oldName, context); !code.Ok() {
+		return code
+	}
+	if code := fs.keep(newName, true, context); !code.Ok() && code != ENOENT {
+		return code
+	}
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *SnapshotFileSystem) Link(oldName string, newName string, context *Context) Status {
+	if fs.inDir(oldName) || fs.inDir(newName) {
+		return EROFS
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *SnapshotFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	if code := fs.readOnly(name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *SnapshotFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	if code := fs.readOnly(name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *SnapshotFileSystem) Symlink(value string, linkName string, context *Context) Status {
+	if code := fs.readOnly(linkName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *SnapshotFileSystem) Chmod(name string, mode uint32, context *Context) Status {
+	if code := fs.readOnly(name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *SnapshotFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) Status {
+	if code := fs.readOnly(name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *SnapshotFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *Context) Status {
+	if code := fs.readOnly(name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *SnapshotFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	if code := fs.readOnly(name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *SnapshotFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	if code := fs.readOnly(name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *SnapshotFileSystem) OpenDir(name string, context *Context) ([]DirEntry, Status) {
+	t, rest, ok := fs.view(name)
+	if !ok {
+		return fs.FileSystem.OpenDir(name, context)
+	}
+	if _, a, code := fs.find(rest, t, context); !code.Ok() {
+		return nil, code
+	} else if !a.IsDir() {
+		return nil, ENOTDIR
+	}
+
+	// The names in the directory and in its versions.
+	names := map[string]bool{}
+	current, _ := fs.FileSystem.OpenDir(rest, context)
+	for _, e := range current {
+		names[e.Name] = true
+	}
+	if rest == "" {
+		delete(names, fs.options.Dir)
+	}
+	kept, _ := fs.FileSystem.OpenDir(filepath.Join(fs.options.Dir, rest), context)
+	for _, e := range kept {
+		if _, ok := parseSnapshotTime(e.Name); !ok {
+			names[e.Name] = true
+		}
+	}
+
+	var stream []DirEntry
+	for n := range names {
+		if _, a, code := fs.find(filepath.Join(rest, n), t, context); code.Ok() {
+			stream = append(stream, DirEntry{Name: n, Mode: a.Mode})
+		}
+	}
+	return stream, OK
+}
+
+func (fs *SnapshotFileSystem) OpenDirStream(name string, context *Context) (DirStream, Status) {
+	if _, _, ok := fs.view(name); ok {
+		return nil, ENOSYS
+	}
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *SnapshotFileSystem) StatFs(name string) *StatfsOut {
+	if _, _, ok := fs.view(name); ok {
+		name = fs.options.Dir
+	}
+	return fs.FileSystem.StatFs(name)
+}
+
+// snapshotFile makes a version of the file before it is first changed.
+type snapshotFile struct {
+	File
+	fs   *SnapshotFileSystem
+	name string
+
+	lock sync.Mutex
+	kept bool
+}
+
+func (f *snapshotFile) String() string {
+	return fmt.Sprintf("snapshotFile(%s)", f.File.String())
+}
+
+func (f *snapshotFile) InnerFile() File {
+	return f.File
+}
+
+func (f *snapshotFile) snapshot(context *Context) Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.kept {
+		return OK
+	}
+	code := f.fs.snapshot(f.name, context)
+	f.kept = code.Ok()
+	return code
+}
+
+func (f *snapshotFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	if code := f.snapshot(nil); !code.Ok() {
+		return 0, code
+	}
+	return f.File.Write(input, data)
+}
+
+func (f *snapshotFile) Truncate(size uint64, context *Context) Status {
+	if code := f.snapshot(context); !code.Ok() {
+		return code
+	}
+	return f.File.Truncate(size, context)
+}
+
+func (f *snapshotFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	if valid&raw.FATTR_SIZE != 0 {
+		if code := f.snapshot(context); !code.Ok() {
+			return code
+		}
+	}
+	return f.File.Setattr(valid, attr, context)
+}
@@ -0,0 +1,148 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	fs := NewSnapshotFileSystem(NewLoopbackFileSystem(dir), &SnapshotOptions{MaxVersions: 2})
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1, t2, t3 := t0.Add(time.Hour), t0.Add(2*time.Hour), t0.Add(3*time.Hour)
+	fs.now = func() time.Time { return t1 }
+	stamp := func(t time.Time) string { return t.Format(_SNAPSHOT_FORMAT) }
+
+	// Files are written outside the wrapper, with the mtimes of
+	// the fake clock.
+	put := func(name string, data string, mtime time.Time) {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		CheckSuccess(ioutil.WriteFile(p, []byte(data), 0644))
+		CheckSuccess(os.Chtimes(p, mtime, mtime))
+	}
+	read := func(name string) string {
+		f, code := fs.Open(name, uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			return "error " + code.String()
+		}
+		defer f.Release(&ReleaseIn{})
+		data, code := f.Read(&ReadIn{Size: 100}, NewBufferPool())
+		if !code.Ok() {
+			t.Fatalf("Read(%q): %v", name, code)
+		}
+		return string(data)
+	}
+	list := func(name string) string {
+		stream, code := fs.OpenDir(name, nil)
+		if !code.Ok() {
+			return "error " + code.String()
+		}
+		var names []string
+		for _, e := range stream {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	put("d/file", "v1", t0)
+	put("other", "x", t0)
+
+	// The first write through a handle keeps the old contents.
+	f, code := fs.Open("d/file", uint32(os.O_WRONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	f.Write(&WriteIn{}, []byte("v2"))
+	f.Write(&WriteIn{Offset: 2}, []byte("!"))
+	f.Release(&ReleaseIn{})
+	CheckSuccess(os.Chtimes(filepath.Join(dir, "d/file"), t1, t1))
+	if got := list(".snapshots/d/file"); got != stamp(t1) {
+		t.Errorf("versions: got %q", got)
+	}
+	if got := read(".snapshots/d/file/" + stamp(t1)); got != "v1" {
+		t.Errorf("version at t1: got %q", got)
+	}
+	if a, _ := fs.GetAttr(".snapshots/d/file/"+stamp(t1), nil); a.Mtime != uint64(t0.Unix()) {
+		t.Errorf("version mtime: got %d", a.Mtime)
+	}
+
+	// Unlinking moves the file to its versions.
+	fs.now = func() time.Time { return t2 }
+	if code := fs.Unlink("d/file", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if _, code := fs.GetAttr("d/file", nil); code != ENOENT {
+		t.Errorf("unlinked file: got %v", code)
+	}
+	if got := read(".snapshots/d/file/" + stamp(t2)); got != "v2!" {
+		t.Errorf("version at t2: got %q", got)
+	}
+	fs.Rmdir("d", nil)
+
+	// The tree at each time.
+	for _, c := range []struct {
+		t    time.Time
+		root string
+		file string
+	}{
+		{t0.Add(-time.Second), "", "error " + ENOENT.String()},
+		{t0, "d other", "v1"},
+		{t1, "d other", "v2!"},
+		{t2, "other", "error " + ENOENT.String()},
+	} {
+		view := ".snapshots/" + stamp(c.t)
+		if got := list(view); got != c.root {
+			t.Errorf("%s: got %q, want %q", view, got, c.root)
+		}
+		if got := read(view + "/d/file"); got != c.file {
+			t.Errorf("%s/d/file: got %q, want %q", view, got, c.file)
+		}
+	}
+
+	// Versions cannot be changed, but can be removed.
+	if _, code := fs.Open(".snapshots/d/file/"+stamp(t1), uint32(os.O_WRONLY), nil); code != EROFS {
+		t.Errorf("opening version for writing: got %v", code)
+	}
+	if code := fs.Unlink(".snapshots/"+stamp(t1)+"/other", nil); code != EROFS {
+		t.Errorf("unlink in tree: got %v", code)
+	}
+	if code := fs.Rename("other", ".snapshots/x", nil); code != EROFS {
+		t.Errorf("rename into versions: got %v", code)
+	}
+
+	// Truncating and renaming over keep versions too, at most
+	// MaxVersions of them.
+	fs.now = func() time.Time { return t1 }
+	fs.Truncate("other", 0, nil)
+	put("other", "x2", t1)
+	fs.now = func() time.Time { return t2 }
+	fs.Truncate("other", 0, nil)
+	put("other", "x3", t2)
+	put("new", "n", t2)
+	fs.now = func() time.Time { return t3 }
+	if code := fs.Rename("new", "other", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if got := list(".snapshots/other"); got != stamp(t2)+" "+stamp(t3) {
+		t.Errorf("versions of other: got %q", got)
+	}
+	if got := read(".snapshots/other/" + stamp(t3)); got != "x3" {
+		t.Errorf("renamed over: got %q", got)
+	}
+	if got := read("other"); got != "n" {
+		t.Errorf("other: got %q", got)
+	}
+	if code := fs.Unlink(".snapshots/other/"+stamp(t2), nil); !code.Ok() {
+		t.Errorf("removing version: %v", code)
+	}
+}
@@ -0,0 +1,147 @@
+package fuse
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// Splicing a READ reply goes through two pipes: the data is spliced
+// into the first, which tells how much there is.  The header with
+// the final length is then written to the second pipe, followed by
+// the data, and the second pipe is spliced to the kernel in one go,
+// as the device wants each reply in a single write.
+//
+// Only READ replies are spliced.  WRITE data arrives in the request,
+// which is read into a buffer along with its header.
+
+// fdReader is implemented by RawFileSystems that can name the
+// descriptor to splice a read from, like FileSystemConnector.
+type fdReader interface {
+	readFd(header *raw.InHeader, input *ReadIn) (fd int, release func(), ok bool)
+}
+
+// fdData is the data of a READ reply, to be spliced from fd.
+type fdData struct {
+	fd      int
+	off     int64
+	size    int
+	release func()
+}
+
+type pipePair struct {
+	r, w int
+
+	// The capacity of both pipes.
+	size int
+}
+
+func (p *pipePair) close() {
+	syscall.Close(p.r)
+	syscall.Close(p.w)
+}
+
+// canSplice returns true if READ replies may be spliced.
+func (ms *MountState) canSplice() bool {
+	return !ms.opts.NoSplice && ms.kernelSettings.Flags&raw.CAP_SPLICE_WRITE != 0
+}
+
+// getPipes returns two empty pipes that hold size bytes each.
+func (ms *MountState) getPipes(size int) (p1, p2 *pipePair, err error) {
+	ms.pipesLock.Lock()
+	for len(ms.pipes) > 0 && (p1 == nil || p2 == nil) {
+		p := ms.pipes[len(ms.pipes)-1]
+		ms.pipes = ms.pipes[:len(ms.pipes)-1]
+		if p1 == nil {
+			p1 = p
+		} else {
+			p2 = p
+		}
+	}
+	ms.pipesLock.Unlock()
+
+	for _, p := range []**pipePair{&p1, &p2} {
+		if *p == nil {
+			*p, err = newPipePair()
+		}
+		if err == nil {
+			err = (*p).grow(size)
+		}
+	}
+	if err != nil {
+		ms.discardPipes(p1, p2)
+		return nil, nil, err
+	}
+	return p1, p2, nil
+}
+
+// putPipes returns empty pipes to the pool.
+func (ms *MountState) putPipes(pipes ...*pipePair) {
+	ms.pipesLock.Lock()
+	ms.pipes = append(ms.pipes, pipes...)
+	ms.pipesLock.Unlock()
+}
+
+// discardPipes closes pipes that may have data in them.
+func (ms *MountState) discardPipes(pipes ...*pipePair) {
+	for _, p := range pipes {
+		if p != nil {
+			p.close()
+		}
+	}
+}
+
+func (ms *MountState) closePipes() {
+	ms.pipesLock.Lock()
+	ms.discardPipes(ms.pipes...)
+	ms.pipes = nil
+	ms.pipesLock.Unlock()
+}
+
+// writeFd writes the reply to a READ request that has fdData,
+// splicing the data if possible, and copying it otherwise.
+func (ms *MountState) writeFd(header []byte, req *request) Status {
+	d := req.fdData
+	p1, p2, err := ms.getPipes(d.size + len(header))
+	if err == nil {
+		var sent bool
+		sent, err = ms.trySplice(header, d, p1, p2)
+		if err == nil {
+			ms.putPipes(p1, p2)
+			return OK
+		}
+		ms.discardPipes(p1, p2)
+		if sent {
+			// The kernel has seen part of the reply.
+			return ToStatus(err)
+		}
+	}
+
+	// Fall back to copying.
+	buf := ms.buffers.AllocBuffer(uint32(d.size))
+	defer ms.buffers.FreeBuffer(buf)
+	n, err := syscall.Pread(d.fd, buf, d.off)
+	if err != nil {
+		return ms.writeStatus(header, ToStatus(err))
+	}
+	setOutLength(header, n)
+	_, err = Writev(ms.fd(), [][]byte{header, buf[:n]})
+	return ToStatus(err)
+}
+
+// setOutLength sets the length in the reply header for dataSize
+// bytes of data.
+func setOutLength(header []byte, dataSize int) {
+	o := (*raw.OutHeader)(unsafe.Pointer(&header[0]))
+	o.Length = uint32(len(header) + dataSize)
+}
+
+// writeStatus sends an error reply with the given header.
+func (ms *MountState) writeStatus(header []byte, code Status) Status {
+	o := (*raw.OutHeader)(unsafe.Pointer(&header[0]))
+	o.Status = int32(-code)
+	o.Length = uint32(sizeOfOutHeader)
+	_, err := ms.mountFile.Write(header[:sizeOfOutHeader])
+	return ToStatus(err)
+}
@@ -0,0 +1,20 @@
+package fuse
+
+import (
+	"syscall"
+)
+
+// Darwin has no splice(2), and its kernel never offers
+// CAP_SPLICE_WRITE, so READ replies are always copied.
+
+func newPipePair() (*pipePair, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (p *pipePair) grow(size int) error {
+	return syscall.ENOSYS
+}
+
+func (ms *MountState) trySplice(header []byte, d *fdData, p1, p2 *pipePair) (sent bool, err error) {
+	return false, syscall.ENOSYS
+}
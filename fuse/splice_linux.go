@@ -0,0 +1,67 @@
+package fuse
+
+import (
+	"syscall"
+)
+
+const (
+	_F_SETPIPE_SZ  = 1031
+	_SPLICE_F_MOVE = 1
+)
+
+func newPipePair() (*pipePair, error) {
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+	return &pipePair{r: fds[0], w: fds[1], size: PAGESIZE * 16}, nil
+}
+
+// grow makes the pipe hold at least size bytes.
+func (p *pipePair) grow(size int) error {
+	if size <= p.size {
+		return nil
+	}
+	n, _, errNo := syscall.Syscall(syscall.SYS_FCNTL, uintptr(p.w), _F_SETPIPE_SZ, uintptr(size))
+	if errNo != 0 {
+		return errNo
+	}
+	p.size = int(n)
+	return nil
+}
+
+// trySplice sends the header and the data from d through the pipes.
+// sent says whether anything was written to the kernel.
+func (ms *MountState) trySplice(header []byte, d *fdData, p1, p2 *pipePair) (sent bool, err error) {
+	off := d.off
+	n := 0
+	for n < d.size {
+		m, err := syscall.Splice(d.fd, &off, p1.w, nil, d.size-n, _SPLICE_F_MOVE)
+		if err != nil {
+			return false, err
+		}
+		if m == 0 {
+			break
+		}
+		n += int(m)
+	}
+
+	setOutLength(header, n)
+	if _, err := syscall.Write(p2.w, header); err != nil {
+		return false, err
+	}
+	for left := n; left > 0; {
+		m, err := syscall.Splice(p1.r, nil, p2.w, nil, left, _SPLICE_F_MOVE)
+		if err != nil {
+			return false, err
+		}
+		left -= int(m)
+	}
+
+	total := len(header) + n
+	m, err := syscall.Splice(p2.r, nil, ms.fd(), nil, total, _SPLICE_F_MOVE)
+	if err == nil && int(m) != total {
+		err = syscall.EIO
+	}
+	return true, err
+}
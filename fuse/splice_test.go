@@ -0,0 +1,122 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+type spliceTestCase struct {
+	t      *testing.T
+	local  *os.File
+	ms     *MountState
+	unique uint64
+}
+
+func newSpliceTestCase(t *testing.T, dir string, opts *MountOptions) *spliceTestCase {
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), nil)
+	ms := NewMountState(NewFileSystemConnector(pfs, nil))
+	ms.setOptions(opts)
+	ms.kernelSettings.Flags = raw.CAP_SPLICE_WRITE
+	ms.mountFile = remote
+	go ms.Loop()
+	return &spliceTestCase{t: t, local: local, ms: ms}
+}
+
+func (tc *spliceTestCase) Close() {
+	syscall.Shutdown(int(tc.local.Fd()), syscall.SHUT_RDWR)
+	tc.local.Close()
+}
+
+// roundTrip sends a request, and returns the status and data of the
+// reply.
+func (tc *spliceTestCase) roundTrip(opcode int32, nodeId uint64, in []byte) (Status, []byte) {
+	tc.unique++
+	header := raw.InHeader{
+		Opcode: opcode,
+		Unique: tc.unique,
+		NodeId: nodeId,
+	}
+	header.Length = uint32(unsafe.Sizeof(header)) + uint32(len(in))
+	msg := append((*[unsafe.Sizeof(header)]byte)(unsafe.Pointer(&header))[:], in...)
+	_, err := tc.local.Write(msg)
+	CheckSuccess(err)
+
+	// A spliced reply may arrive in pieces.
+	var reply []byte
+	buf := make([]byte, 1<<17)
+	for {
+		n, err := tc.local.Read(buf)
+		CheckSuccess(err)
+		reply = append(reply, buf[:n]...)
+		out := (*raw.OutHeader)(unsafe.Pointer(&reply[0]))
+		if len(reply) >= int(out.Length) {
+			if out.Unique != tc.unique || len(reply) != int(out.Length) {
+				tc.t.Fatalf("bad reply %v, %d bytes", out, len(reply))
+			}
+			return Status(-out.Status), reply[sizeOfOutHeader:]
+		}
+	}
+}
+
+func (tc *spliceTestCase) read(nodeId uint64, off uint64, size uint32) []byte {
+	in := ReadIn{Offset: off, Size: size}
+	code, data := tc.roundTrip(_OP_READ, nodeId, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	if !code.Ok() {
+		tc.t.Fatalf("READ: %v", code)
+	}
+	return data
+}
+
+func testSpliceRead(t *testing.T, opts *MountOptions) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	CheckSuccess(ioutil.WriteFile(dir+"/file", content, 0644))
+
+	tc := newSpliceTestCase(t, dir, opts)
+	defer tc.Close()
+
+	code, data := tc.roundTrip(_OP_LOOKUP, raw.FUSE_ROOT_ID, []byte("file\x00"))
+	if !code.Ok() {
+		t.Fatalf("LOOKUP: %v", code)
+	}
+	nodeId := (*raw.EntryOut)(unsafe.Pointer(&data[0])).NodeId
+
+	for _, r := range []struct {
+		off  uint64
+		size uint32
+	}{{0, 65536}, {1000, 4096}, {99000, 4096}, {200000, 4096}} {
+		got := tc.read(nodeId, r.off, r.size)
+		want := []byte{}
+		if r.off < uint64(len(content)) {
+			end := int(r.off) + int(r.size)
+			if end > len(content) {
+				end = len(content)
+			}
+			want = content[r.off:end]
+		}
+		if string(got) != string(want) {
+			t.Errorf("read(%d, %d): got %d bytes, want %d", r.off, r.size, len(got), len(want))
+		}
+	}
+}
+
+func TestSpliceRead(t *testing.T) {
+	testSpliceRead(t, nil)
+}
+
+func TestSpliceReadDisabled(t *testing.T) {
+	testSpliceRead(t, &MountOptions{NoSplice: true})
+}
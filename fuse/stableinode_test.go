@@ -0,0 +1,64 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestStableInodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	for _, n := range []string{"a", "b"} {
+		CheckSuccess(ioutil.WriteFile(filepath.Join(dir, n), []byte(n), 0644))
+	}
+
+	// lookup mounts dir afresh, and returns the inode numbers of
+	// the names, looked up in the given order.
+	lookup := func(names ...string) map[string]uint64 {
+		pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), &PathNodeFsOptions{StableInodes: true})
+		c := NewFileSystemConnector(pfs, nil)
+		rootHeader := &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}
+		inos := map[string]uint64{}
+		for _, n := range names {
+			out := raw.EntryOut{}
+			if code := c.Lookup(&out, rootHeader, n); !code.Ok() {
+				t.Fatalf("Lookup %q: %v", n, code)
+			}
+			attr := raw.AttrOut{}
+			if code := c.GetAttr(&attr, &raw.InHeader{NodeId: out.NodeId}, &raw.GetAttrIn{}); !code.Ok() {
+				t.Fatalf("GetAttr %q: %v", n, code)
+			}
+			if attr.Ino != out.Ino {
+				t.Errorf("%q: GetAttr ino %d, Lookup ino %d", n, attr.Ino, out.Ino)
+			}
+			inos[n] = out.Ino
+		}
+
+		entries, code := pfs.Root().OpenDir(nil)
+		if !code.Ok() {
+			t.Fatal("OpenDir:", code)
+		}
+		for _, e := range entries {
+			if e.Ino != inos[e.Name] {
+				t.Errorf("%q: readdir ino %d, stat ino %d", e.Name, e.Ino, inos[e.Name])
+			}
+		}
+		return inos
+	}
+
+	first := lookup("a", "b")
+	second := lookup("b", "a")
+	for n, ino := range first {
+		if second[n] != ino {
+			t.Errorf("%q: ino %d after remount, was %d", n, second[n], ino)
+		}
+	}
+	if first["a"] == first["b"] {
+		t.Errorf("a and b share ino %d", first["a"])
+	}
+}
@@ -0,0 +1,393 @@
+package fuse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SwitchedFileSystem is an entry of a SwitchFileSystem.
+type SwitchedFileSystem struct {
+	// Paths equal to or below Prefix go to FileSystem.  The empty
+	// prefix matches all paths.
+	Prefix string
+	FileSystem
+
+	// If set, the Prefix is removed from the paths passed to the
+	// FileSystem, so its root shows up at Prefix.
+	StripPrefix bool
+}
+
+// SwitchFileSystem dispatches operations to one of several
+// FileSystems, by the longest Prefix that matches the path.
+// Directories above the prefixes are synthesized where no FileSystem
+// has them, and listing a directory shows the prefixes directly
+// below it.  Renames and links between FileSystems return EXDEV.
+type SwitchFileSystem struct {
+	DefaultFileSystem
+
+	// Sorted by decreasing prefix length.
+	fileSystems []*SwitchedFileSystem
+}
+
+// NewSwitchFileSystem creates a SwitchFileSystem for the given
+// entries.
+func NewSwitchFileSystem(fileSystems []SwitchedFileSystem) *SwitchFileSystem {
+	fs := &SwitchFileSystem{}
+	for i := range fileSystems {
+		sub := fileSystems[i]
+		sub.Prefix = strings.Trim(sub.Prefix, "/")
+		fs.fileSystems = append(fs.fileSystems, &sub)
+	}
+	sort.Sort(byPrefixLength(fs.fileSystems))
+	return fs
+}
+
+type byPrefixLength []*SwitchedFileSystem
+
+func (s byPrefixLength) Len() int           { return len(s) }
+func (s byPrefixLength) Less(i, j int) bool { return len(s[i].Prefix) > len(s[j].Prefix) }
+func (s byPrefixLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// find returns the entry for name and the path to pass on, or nil if
+// no prefix matches.
+func (fs *SwitchFileSystem) find(name string) (*SwitchedFileSystem, string) {
+	for _, sub := range fs.fileSystems {
+		p := sub.Prefix
+		if p != "" && name != p && !strings.HasPrefix(name, p+"/") {
+			continue
+		}
+		if sub.StripPrefix && p != "" {
+			name = strings.TrimPrefix(strings.TrimPrefix(name, p), "/")
+		}
+		return sub, name
+	}
+	return nil, ""
+}
+
+// below returns the names of the entries in directory dir that lead
+// to a prefix.
+func (fs *SwitchFileSystem) below(dir string) (names []string) {
+	seen := map[string]bool{}
+	for _, sub := range fs.fileSystems {
+		rest := sub.Prefix
+		if dir != "" {
+			if !strings.HasPrefix(rest, dir+"/") {
+				continue
+			}
+			rest = rest[len(dir)+1:]
+		}
+		if rest == "" {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			rest = rest[:i]
+		}
+		if !seen[rest] {
+			seen[rest] = true
+			names = append(names, rest)
+		}
+	}
+	return names
+}
+
+// isBoundary returns true if name is a prefix, or a directory leading
+// to one.  These cannot be removed or renamed.
+func (fs *SwitchFileSystem) isBoundary(name string) bool {
+	if len(fs.below(name)) > 0 {
+		return true
+	}
+	for _, sub := range fs.fileSystems {
+		if sub.Prefix != "" && sub.Prefix == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *SwitchFileSystem) String() string {
+	var names []string
+	for _, sub := range fs.fileSystems {
+		names = append(names, fmt.Sprintf("%q:%s", sub.Prefix, sub.FileSystem.String()))
+	}
+	return fmt.Sprintf("SwitchFileSystem(%s)", strings.Join(names, ","))
+}
+
+func (fs *SwitchFileSystem) OnMount(nodeFs *PathNodeFs) {
+	for _, sub := range fs.fileSystems {
+		sub.FileSystem.OnMount(nodeFs)
+	}
+}
+
+func (fs *SwitchFileSystem) OnUnmount(reason UnmountReason) {
+	for _, sub := range fs.fileSystems {
+		sub.FileSystem.OnUnmount(reason)
+	}
+}
+
+func (fs *SwitchFileSystem) GetAttr(name string, context *Context) (a *Attr, code Status) {
+	code = ENOENT
+	if sub, subName := fs.find(name); sub != nil {
+		a, code = sub.FileSystem.GetAttr(subName, context)
+	}
+	if !code.Ok() && len(fs.below(name)) > 0 {
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	}
+	return a, code
+}
+
+func (fs *SwitchFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, code Status) {
+	code = ENOENT
+	if sub, subName := fs.find(name); sub != nil {
+		stream, code = sub.FileSystem.OpenDir(subName, context)
+	}
+	below := fs.below(name)
+	if len(below) == 0 {
+		return stream, code
+	}
+
+	// The prefixes hide entries of the same name.
+	hidden := map[string]bool{}
+	for _, n := range below {
+		hidden[n] = true
+	}
+	var out []DirEntry
+	if code.Ok() {
+		for _, e := range stream {
+			if !hidden[e.Name] {
+				out = append(out, e)
+			}
+		}
+	}
+	for _, n := range below {
+		out = append(out, DirEntry{Name: n, Mode: S_IFDIR})
+	}
+	return out, OK
+}
+
+func (fs *SwitchFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, code Status) {
+	if len(fs.below(name)) > 0 {
+		// Merged by OpenDir.
+		return nil, ENOSYS
+	}
+	sub, name := fs.find(name)
+	if sub == nil {
+		return nil, ENOENT
+	}
+	return sub.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *SwitchFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
+	sub, subName := fs.find(name)
+	if sub != nil {
+		code = sub.FileSystem.Access(subName, mode, context)
+	} else {
+		code = ENOENT
+	}
+	if !code.Ok() && len(fs.below(name)) > 0 {
+		return OK
+	}
+	return code
+}
+
+func (fs *SwitchFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return ENOENT
+	}
+	return sub.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *SwitchFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) (code Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return ENOENT
+	}
+	return sub.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *SwitchFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return ENOENT
+	}
+	return sub.FileSystem.Utimens(name, Atime, Mtime, context)
+}
+
+func (fs *SwitchFileSystem) Truncate(name string, offset uint64, context *Context) (code Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return ENOENT
+	}
+	return sub.FileSystem.Truncate(name, offset, context)
+}
+
+func (fs *SwitchFileSystem) Readlink(name string, context *Context) (string, Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return "", ENOENT
+	}
+	return sub.FileSystem.Readlink(name, context)
+}
+
+func (fs *SwitchFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return EPERM
+	}
+	return sub.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *SwitchFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return EPERM
+	}
+	return sub.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *SwitchFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	sub, linkName := fs.find(linkName)
+	if sub == nil {
+		return EPERM
+	}
+	return sub.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *SwitchFileSystem) Unlink(name string, context *Context) (code Status) {
+	if fs.isBoundary(name) {
+		return EBUSY
+	}
+	sub, name := fs.find(name)
+	if sub == nil {
+		return ENOENT
+	}
+	return sub.FileSystem.Unlink(name, context)
+}
+
+func (fs *SwitchFileSystem) Rmdir(name string, context *Context) (code Status) {
+	if fs.isBoundary(name) {
+		return EBUSY
+	}
+	sub, name := fs.find(name)
+	if sub == nil {
+		return ENOENT
+	}
+	return sub.FileSystem.Rmdir(name, context)
+}
+
+func (fs *SwitchFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
+	if fs.isBoundary(oldName) || fs.isBoundary(newName) {
+		return EBUSY
+	}
+	oldSub, oldName := fs.find(oldName)
+	newSub, newName := fs.find(newName)
+	if oldSub == nil {
+		return ENOENT
+	}
+	if oldSub != newSub {
+		return EXDEV
+	}
+	return oldSub.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *SwitchFileSystem) Link(oldName string, newName string, context *Context) (code Status) {
+	oldSub, oldName := fs.find(oldName)
+	newSub, newName := fs.find(newName)
+	if oldSub == nil {
+		return ENOENT
+	}
+	if oldSub != newSub {
+		return EXDEV
+	}
+	return oldSub.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *SwitchFileSystem) LinkKey(name string, context *Context) (key string, code Status) {
+	sub, subName := fs.find(name)
+	if sub == nil {
+		return "", ENOENT
+	}
+	key, code = sub.FileSystem.LinkKey(subName, context)
+	if code.Ok() && key != "" {
+		// Files in different FileSystems are never the same.
+		key = sub.Prefix + "\x00" + key
+	}
+	return key, code
+}
+
+func (fs *SwitchFileSystem) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return nil, ENODATA
+	}
+	return sub.FileSystem.GetXAttr(name, attr, context)
+}
+
+func (fs *SwitchFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return EPERM
+	}
+	return sub.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *SwitchFileSystem) ListXAttr(name string, context *Context) ([]string, Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return nil, OK
+	}
+	return sub.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *SwitchFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return ENODATA
+	}
+	return sub.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *SwitchFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return nil, ENOENT
+	}
+	return sub.FileSystem.Open(name, flags, context)
+}
+
+func (fs *SwitchFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return nil, EPERM
+	}
+	return sub.FileSystem.Create(name, flags, mode, context)
+}
+
+func (fs *SwitchFileSystem) StatFs(name string) *StatfsOut {
+	sub, name := fs.find(name)
+	if sub == nil {
+		return &StatfsOut{}
+	}
+	return sub.FileSystem.StatFs(name)
+}
+
+// SyncFs syncs all FileSystems, and returns the first error.
+func (fs *SwitchFileSystem) SyncFs(context *Context) (code Status) {
+	code = OK
+	for _, sub := range fs.fileSystems {
+		if c := sub.FileSystem.SyncFs(context); !c.Ok() && c != ENOSYS && code.Ok() {
+			code = c
+		}
+	}
+	return code
+}
+
+func (fs *SwitchFileSystem) FsyncDir(name string, flags int, context *Context) (code Status) {
+	sub, subName := fs.find(name)
+	if sub == nil {
+		return OK
+	}
+	return sub.FileSystem.FsyncDir(subName, flags, context)
+}
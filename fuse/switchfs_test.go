@@ -0,0 +1,62 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestSwitchFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"main/sub", "other"} {
+		CheckSuccess(os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "main/file"), []byte("main"), 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "main/sub/hidden"), []byte("main"), 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "other/file"), []byte("other file"), 0644))
+
+	fs := NewSwitchFileSystem([]SwitchedFileSystem{
+		{Prefix: "", FileSystem: NewLoopbackFileSystem(filepath.Join(dir, "main"))},
+		{Prefix: "sub/deep/", FileSystem: NewLoopbackFileSystem(filepath.Join(dir, "other")), StripPrefix: true},
+	})
+
+	if a, code := fs.GetAttr("file", nil); !code.Ok() || a.Size != 4 {
+		t.Errorf("GetAttr file: %v, %v", code, a)
+	}
+	if a, code := fs.GetAttr("sub/deep/file", nil); !code.Ok() || a.Size != 10 {
+		t.Errorf("GetAttr sub/deep/file: %v, %v", code, a)
+	}
+	if a, code := fs.GetAttr("sub/deep", nil); !code.Ok() || !a.IsDir() {
+		t.Errorf("GetAttr sub/deep: %v, %v", code, a)
+	}
+
+	stream, code := fs.OpenDir("sub", nil)
+	if !code.Ok() {
+		t.Fatal("OpenDir:", code)
+	}
+	var names []string
+	for _, e := range stream {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "deep" || names[1] != "hidden" {
+		t.Errorf("OpenDir sub: got %v", names)
+	}
+
+	if code := fs.Rename("file", "sub/deep/file2", nil); code != EXDEV {
+		t.Errorf("Rename across file systems: got %v, want EXDEV", code)
+	}
+	if code := fs.Rmdir("sub", nil); code != EBUSY {
+		t.Errorf("Rmdir of prefix parent: got %v, want EBUSY", code)
+	}
+	if code := fs.Rename("sub/deep/file", "sub/deep/file2", nil); !code.Ok() {
+		t.Errorf("Rename within file system: %v", code)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "other/file2")); err != nil {
+		t.Errorf("rename was not done in the right place: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package fuse
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ConfineSymlinks returns a SymlinkRewriter for file systems that
+// export the directory exportRoot, such as a LoopbackFileSystem.
+// Absolute targets inside exportRoot are rewritten to relative
+// targets, so they resolve inside the mount.  Targets that point
+// outside exportRoot, either absolute or relative, are denied with
+// EACCES.
+func ConfineSymlinks(exportRoot string) SymlinkRewriter {
+	root := filepath.Clean(exportRoot)
+	return func(name string, target string) (string, Status) {
+		dir := filepath.Dir(name)
+		if filepath.IsAbs(target) {
+			rel, ok := relativeTo(root, filepath.Clean(target))
+			if !ok {
+				return "", EACCES
+			}
+			r, err := filepath.Rel(dir, rel)
+			if err != nil {
+				return "", EACCES
+			}
+			return r, OK
+		}
+
+		resolved := filepath.Join(dir, target)
+		if resolved == ".." || strings.HasPrefix(resolved, "../") {
+			return "", EACCES
+		}
+		return target, OK
+	}
+}
+
+// relativeTo returns path relative to root, if root contains path.
+func relativeTo(root, path string) (string, bool) {
+	if path == root {
+		return ".", true
+	}
+	if root == "/" {
+		return path[1:], true
+	}
+	if !strings.HasPrefix(path, root+"/") {
+		return "", false
+	}
+	return path[len(root)+1:], true
+}
@@ -0,0 +1,89 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestConfineSymlinks(t *testing.T) {
+	rewrite := ConfineSymlinks("/export/root/")
+	for _, c := range []struct {
+		name, target, want string
+		code               Status
+	}{
+		{"link", "file", "file", OK},
+		{"a/link", "../file", "../file", OK},
+		{"a/link", "../../file", "", EACCES},
+		{"link", "/export/root/file", "file", OK},
+		{"a/b/link", "/export/root/file", "../../file", OK},
+		{"link", "/export/rootfile", "", EACCES},
+		{"link", "/etc/passwd", "", EACCES},
+	} {
+		got, code := rewrite(c.name, c.target)
+		if code != c.code || got != c.want {
+			t.Errorf("rewrite(%q, %q) = %q, %v, want %q, %v",
+				c.name, c.target, got, code, c.want, c.code)
+		}
+	}
+}
+
+func TestRewriteSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	orig := dir + "/orig"
+	mnt := dir + "/mnt"
+	os.Mkdir(orig, 0755)
+	os.Mkdir(mnt, 0755)
+
+	err = os.Symlink(orig+"/file", orig+"/inside")
+	CheckSuccess(err)
+	err = os.Symlink("/etc/passwd", orig+"/outside")
+	CheckSuccess(err)
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(orig), &PathNodeFsOptions{
+		RewriteSymlink: ConfineSymlinks(orig),
+	})
+	state, _, err := MountNodeFileSystem(mnt, pfs, nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	val, err := os.Readlink(mnt + "/inside")
+	CheckSuccess(err)
+	if val != "file" {
+		t.Errorf("got %q, want %q", val, "file")
+	}
+	if _, err := os.Readlink(mnt + "/outside"); ToStatus(err) != EACCES {
+		t.Errorf("want EACCES, got %v", err)
+	}
+}
+
+func TestCacheSymlinksInit(t *testing.T) {
+	for _, want := range []bool{false, true} {
+		ms := NewMountState(&DefaultRawFileSystem{})
+		ms.setOptions(&MountOptions{CacheSymlinks: want})
+		in := raw.InitIn{
+			Major: FUSE_KERNEL_VERSION,
+			Minor: OUR_MINOR_VERSION,
+			Flags: raw.CAP_ASYNC_READ | raw.CAP_CACHE_SYMLINKS,
+		}
+		req := &request{inData: unsafe.Pointer(&in)}
+		doInit(ms, req)
+		if !req.status.Ok() {
+			t.Fatal("doInit:", req.status)
+		}
+		out := (*raw.InitOut)(req.outData)
+		if got := out.Flags&raw.CAP_CACHE_SYMLINKS != 0; got != want {
+			t.Errorf("CacheSymlinks %v: negotiated %v", want, got)
+		}
+		if got := ms.KernelSettings().Flags&raw.CAP_CACHE_SYMLINKS != 0; got != want {
+			t.Errorf("CacheSymlinks %v: kernel settings %v", want, got)
+		}
+	}
+}
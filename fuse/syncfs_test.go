@@ -0,0 +1,99 @@
+package fuse
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+type syncFs struct {
+	DefaultFileSystem
+
+	mu    sync.Mutex
+	syncs int
+}
+
+func (fs *syncFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	if name == "" {
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	}
+	return nil, ENOENT
+}
+
+func (fs *syncFs) SyncFs(context *Context) Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.syncs++
+	return OK
+}
+
+func TestSyncFs(t *testing.T) {
+	ts := NewTestCase(t)
+	defer ts.Cleanup()
+
+	fs := &syncFs{}
+	code := ts.connector.Mount(ts.rootNode(), "mnt", NewPathNodeFs(fs, nil), nil)
+	if !code.Ok() {
+		t.Fatal("mount should succeed:", code)
+	}
+	defer ts.pathFs.Unmount("mnt")
+
+	f, err := os.Open(ts.mnt)
+	CheckSuccess(err)
+	if errno := syncfs(int(f.Fd())); errno != 0 {
+		t.Errorf("syncfs: %v", Status(errno))
+	}
+	f.Close()
+	fs.mu.Lock()
+	if fs.syncs == 0 {
+		t.Log("kernel did not send SYNCFS")
+	}
+	fs.syncs = 0
+	fs.mu.Unlock()
+
+	header := &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}
+	if code := ts.connector.SyncFs(header, &raw.SyncFsIn{}); !code.Ok() {
+		t.Fatal("SyncFs:", code)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.syncs != 1 {
+		t.Errorf("submount got %d syncs, want 1", fs.syncs)
+	}
+}
+
+func (fs *syncFs) count() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.syncs
+}
+
+// The kernel does not send SYNCFS over /dev/fuse, so file systems
+// are synced when they are unmounted.
+func TestSyncFsOnUnmount(t *testing.T) {
+	rootFs := &syncFs{}
+	c := NewFileSystemConnector(NewPathNodeFs(rootFs, nil), nil)
+	subFs := &syncFs{}
+	if code := c.Mount(c.rootNode, "sub", NewPathNodeFs(subFs, nil), nil); !code.Ok() {
+		t.Fatal("Mount:", code)
+	}
+
+	c.OnUnmount(UNMOUNT_HANDOFF)
+	if rootFs.count() != 0 || subFs.count() != 0 {
+		t.Errorf("synced on handoff: root %d, sub %d", rootFs.count(), subFs.count())
+	}
+
+	if code := c.Unmount(c.rootNode.GetChild("sub")); !code.Ok() {
+		t.Fatal("Unmount:", code)
+	}
+	if subFs.count() != 1 {
+		t.Errorf("submount got %d syncs on Unmount, want 1", subFs.count())
+	}
+
+	c.OnUnmount(UNMOUNT_DAEMON)
+	if rootFs.count() != 1 {
+		t.Errorf("root got %d syncs on unmount, want 1", rootFs.count())
+	}
+}
@@ -37,25 +37,50 @@ func Writev(fd int, packet [][]byte) (n int, err error) {
 	return n, err
 }
 
-func getxattr(path string, attr string, dest []byte) (sz int, errno int) {
-	pathBs := syscall.StringBytePtr(path)
-	attrBs := syscall.StringBytePtr(attr)
-	size, _, errNo := syscall.Syscall6(
-		syscall.SYS_GETXATTR,
-		uintptr(unsafe.Pointer(pathBs)),
-		uintptr(unsafe.Pointer(attrBs)),
-		uintptr(unsafe.Pointer(&dest[0])),
-		uintptr(len(dest)),
-		0, 0)
-	return int(size), int(errNo)
+// statAttrFallback is statAttr with stat(2): it supports an empty
+// path, for dirfd itself, or a path relative to the current directory.
+func statAttrFallback(a *Attr, dirfd int, path string, flags int) error {
+	var st syscall.Stat_t
+	var err error
+	switch {
+	case path == "":
+		err = syscall.Fstat(dirfd, &st)
+	case flags&_AT_SYMLINK_NOFOLLOW != 0:
+		err = syscall.Lstat(path, &st)
+	default:
+		err = syscall.Stat(path, &st)
+	}
+	if err != nil {
+		return err
+	}
+	a.FromStat(&st)
+	return nil
 }
 
+// The xattr functions have variants that do not follow symlinks;
+// the system calls behind them are in syscall_$GOOS.go.
+
 func GetXAttr(path string, attr string, dest []byte) (value []byte, errno int) {
-	sz, errno := getxattr(path, attr, dest)
+	return getXAttr(false, path, attr, dest)
+}
+
+// LGetXAttr is GetXAttr for the symlink path itself.
+func LGetXAttr(path string, attr string, dest []byte) (value []byte, errno int) {
+	return getXAttr(true, path, attr, dest)
+}
 
-	for sz > cap(dest) && errno == 0 {
+func getXAttr(nofollow bool, path string, attr string, dest []byte) (value []byte, errno int) {
+	sz, errno := getxattr(nofollow, path, attr, dest)
+
+	// ERANGE means dest is too small; ask for the size, which may
+	// change again before we read.
+	for errno == int(syscall.ERANGE) {
+		sz, errno = getxattr(nofollow, path, attr, nil)
+		if errno != 0 {
+			break
+		}
 		dest = make([]byte, sz)
-		sz, errno = getxattr(path, attr, dest)
+		sz, errno = getxattr(nofollow, path, attr, dest)
 	}
 
 	if errno != 0 {
@@ -65,27 +90,31 @@ func GetXAttr(path string, attr string, dest []byte) (value []byte, errno int) {
 	return dest[:sz], errno
 }
 
-func listxattr(path string, dest []byte) (sz int, errno int) {
-	pathbs := syscall.StringBytePtr(path)
-	size, _, errNo := syscall.Syscall(
-		syscall.SYS_LISTXATTR,
-		uintptr(unsafe.Pointer(pathbs)),
-		uintptr(unsafe.Pointer(&dest[0])),
-		uintptr(len(dest)))
+func ListXAttr(path string) (attributes []string, errno int) {
+	return listXAttr(false, path)
+}
 
-	return int(size), int(errNo)
+// LListXAttr is ListXAttr for the symlink path itself.
+func LListXAttr(path string) (attributes []string, errno int) {
+	return listXAttr(true, path)
 }
 
-func ListXAttr(path string) (attributes []string, errno int) {
+func listXAttr(nofollow bool, path string) (attributes []string, errno int) {
 	dest := make([]byte, 1024)
-	sz, errno := listxattr(path, dest)
+	sz, errno := listxattr(nofollow, path, dest)
+	for errno == int(syscall.ERANGE) {
+		sz, errno = listxattr(nofollow, path, nil)
+		if errno != 0 {
+			break
+		}
+		dest = make([]byte, sz)
+		sz, errno = listxattr(nofollow, path, dest)
+	}
 	if errno != 0 {
 		return nil, errno
 	}
-
-	for sz > cap(dest) && errno == 0 {
-		dest = make([]byte, sz)
-		sz, errno = listxattr(path, dest)
+	if sz == 0 {
+		return []string{}, 0
 	}
 
 	// -1 to drop the final empty slice.
@@ -99,27 +128,21 @@ func ListXAttr(path string) (attributes []string, errno int) {
 }
 
 func Setxattr(path string, attr string, data []byte, flags int) (errno int) {
-	pathbs := syscall.StringBytePtr(path)
-	attrbs := syscall.StringBytePtr(attr)
-	_, _, errNo := syscall.Syscall6(
-		syscall.SYS_SETXATTR,
-		uintptr(unsafe.Pointer(pathbs)),
-		uintptr(unsafe.Pointer(attrbs)),
-		uintptr(unsafe.Pointer(&data[0])),
-		uintptr(len(data)),
-		uintptr(flags), 0)
-
-	return int(errNo)
+	return setxattr(false, path, attr, data, flags)
+}
+
+// LSetxattr is Setxattr for the symlink path itself.
+func LSetxattr(path string, attr string, data []byte, flags int) (errno int) {
+	return setxattr(true, path, attr, data, flags)
 }
 
 func Removexattr(path string, attr string) (errno int) {
-	pathbs := syscall.StringBytePtr(path)
-	attrbs := syscall.StringBytePtr(attr)
-	_, _, errNo := syscall.Syscall(
-		syscall.SYS_REMOVEXATTR,
-		uintptr(unsafe.Pointer(pathbs)),
-		uintptr(unsafe.Pointer(attrbs)), 0)
-	return int(errNo)
+	return removexattr(false, path, attr)
+}
+
+// LRemovexattr is Removexattr for the symlink path itself.
+func LRemovexattr(path string, attr string) (errno int) {
+	return removexattr(true, path, attr)
 }
 
 func ioctl(fd int, cmd int, arg uintptr) (int, int) {
@@ -129,19 +152,3 @@ func ioctl(fd int, cmd int, arg uintptr) (int, int) {
 	errno := int(e1)
 	return val, errno
 }
-
-const AT_FDCWD = -100
-
-func Linkat(fd1 int, n1 string, fd2 int, n2 string) int {
-	b1 := syscall.StringBytePtr(n1)
-	b2 := syscall.StringBytePtr(n2)
-
-	_, _, errNo := syscall.Syscall6(
-		syscall.SYS_LINKAT,
-		uintptr(fd1),
-		uintptr(unsafe.Pointer(b1)),
-		uintptr(fd2),
-		uintptr(unsafe.Pointer(b2)),
-		0, 0)
-	return int(errNo)
-}
@@ -0,0 +1,172 @@
+package fuse
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Darwin has a single set of xattr system calls, which take an
+// options argument, and a position that only resource forks use.
+const _XATTR_NOFOLLOW = 0x1
+
+func xattrOptions(nofollow bool) uintptr {
+	if nofollow {
+		return _XATTR_NOFOLLOW
+	}
+	return 0
+}
+
+func getxattr(nofollow bool, path string, attr string, dest []byte) (sz int, errno int) {
+	pathBs := syscall.StringBytePtr(path)
+	attrBs := syscall.StringBytePtr(attr)
+	var destPtr unsafe.Pointer
+	if len(dest) > 0 {
+		destPtr = unsafe.Pointer(&dest[0])
+	}
+	size, _, errNo := syscall.Syscall6(
+		syscall.SYS_GETXATTR,
+		uintptr(unsafe.Pointer(pathBs)),
+		uintptr(unsafe.Pointer(attrBs)),
+		uintptr(destPtr),
+		uintptr(len(dest)),
+		0, xattrOptions(nofollow))
+	return int(size), int(errNo)
+}
+
+func listxattr(nofollow bool, path string, dest []byte) (sz int, errno int) {
+	pathbs := syscall.StringBytePtr(path)
+	var destPtr unsafe.Pointer
+	if len(dest) > 0 {
+		destPtr = unsafe.Pointer(&dest[0])
+	}
+	size, _, errNo := syscall.Syscall6(
+		syscall.SYS_LISTXATTR,
+		uintptr(unsafe.Pointer(pathbs)),
+		uintptr(destPtr),
+		uintptr(len(dest)),
+		xattrOptions(nofollow), 0, 0)
+	return int(size), int(errNo)
+}
+
+func setxattr(nofollow bool, path string, attr string, data []byte, flags int) (errno int) {
+	pathbs := syscall.StringBytePtr(path)
+	attrbs := syscall.StringBytePtr(attr)
+	var dataPtr unsafe.Pointer
+	if len(data) > 0 {
+		dataPtr = unsafe.Pointer(&data[0])
+	}
+	_, _, errNo := syscall.Syscall6(
+		syscall.SYS_SETXATTR,
+		uintptr(unsafe.Pointer(pathbs)),
+		uintptr(unsafe.Pointer(attrbs)),
+		uintptr(dataPtr),
+		uintptr(len(data)),
+		0, uintptr(flags)|xattrOptions(nofollow))
+	return int(errNo)
+}
+
+func removexattr(nofollow bool, path string, attr string) (errno int) {
+	pathbs := syscall.StringBytePtr(path)
+	attrbs := syscall.StringBytePtr(attr)
+	_, _, errNo := syscall.Syscall(
+		syscall.SYS_REMOVEXATTR,
+		uintptr(unsafe.Pointer(pathbs)),
+		uintptr(unsafe.Pointer(attrbs)),
+		xattrOptions(nofollow))
+	return int(errNo)
+}
+
+const (
+	AT_FDCWD = -2
+
+	_SYS_LINKAT = 471
+)
+
+func Linkat(fd1 int, n1 string, fd2 int, n2 string) int {
+	b1 := syscall.StringBytePtr(n1)
+	b2 := syscall.StringBytePtr(n2)
+
+	_, _, errNo := syscall.Syscall6(
+		_SYS_LINKAT,
+		uintptr(fd1),
+		uintptr(unsafe.Pointer(b1)),
+		uintptr(fd2),
+		uintptr(unsafe.Pointer(b2)),
+		0, 0)
+	return int(errNo)
+}
+
+// Darwin has no statx; its Stat_t carries the birth time already.
+const (
+	_AT_EMPTY_PATH       = 0
+	_AT_SYMLINK_NOFOLLOW = 0x20
+)
+
+func statAttr(a *Attr, dirfd int, path string, flags int) error {
+	return statAttrFallback(a, dirfd, path, flags)
+}
+
+// syncfs syncs all file systems, as Darwin cannot sync just one.
+func syncfs(fd int) int {
+	syscall.Sync()
+	return 0
+}
+
+func fdatasync(fd int) error {
+	return syscall.Fsync(fd)
+}
+
+// fillTimes replaces the nil times with the ones from st.  Darwin
+// has no UTIME_NOW, so UtimeNow is read from the clock.
+func fillTimes(st *syscall.Stat_t, atime *time.Time, mtime *time.Time) (a, m time.Time) {
+	a = time.Unix(st.Atimespec.Unix())
+	m = time.Unix(st.Mtimespec.Unix())
+	if atime != nil {
+		a = *ResolveUtime(atime)
+	}
+	if mtime != nil {
+		m = *ResolveUtime(mtime)
+	}
+	return a, m
+}
+
+// Lutimens sets the times of path like Utimens.  A nil time is left
+// unchanged.  Darwin has no system call to set the times of a
+// symlink, so that fails with ENOSYS.
+func Lutimens(path string, atime *time.Time, mtime *time.Time) (errno int) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return int(err.(syscall.Errno))
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return int(syscall.ENOSYS)
+	}
+	a, m := fillTimes(&st, atime, mtime)
+	ts := []syscall.Timespec{
+		syscall.NsecToTimespec(a.UnixNano()),
+		syscall.NsecToTimespec(m.UnixNano()),
+	}
+	if err := syscall.UtimesNano(path, ts); err != nil {
+		return int(err.(syscall.Errno))
+	}
+	return 0
+}
+
+// futimens sets the times of an open file, with microsecond
+// precision.  A nil time is left unchanged.
+func futimens(fd int, atime *time.Time, mtime *time.Time) int {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return int(err.(syscall.Errno))
+	}
+	a, m := fillTimes(&st, atime, mtime)
+	tv := []syscall.Timeval{
+		syscall.NsecToTimeval(a.UnixNano()),
+		syscall.NsecToTimeval(m.UnixNano()),
+	}
+	if err := syscall.Futimes(fd, tv); err != nil {
+		return int(err.(syscall.Errno))
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package fuse
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func getxattr(nofollow bool, path string, attr string, dest []byte) (sz int, errno int) {
+	pathBs := syscall.StringBytePtr(path)
+	attrBs := syscall.StringBytePtr(attr)
+	var destPtr unsafe.Pointer
+	if len(dest) > 0 {
+		destPtr = unsafe.Pointer(&dest[0])
+	}
+	trap := uintptr(syscall.SYS_GETXATTR)
+	if nofollow {
+		trap = syscall.SYS_LGETXATTR
+	}
+	size, _, errNo := syscall.Syscall6(
+		trap,
+		uintptr(unsafe.Pointer(pathBs)),
+		uintptr(unsafe.Pointer(attrBs)),
+		uintptr(destPtr),
+		uintptr(len(dest)),
+		0, 0)
+	return int(size), int(errNo)
+}
+
+func listxattr(nofollow bool, path string, dest []byte) (sz int, errno int) {
+	pathbs := syscall.StringBytePtr(path)
+	var destPtr unsafe.Pointer
+	if len(dest) > 0 {
+		destPtr = unsafe.Pointer(&dest[0])
+	}
+	trap := uintptr(syscall.SYS_LISTXATTR)
+	if nofollow {
+		trap = syscall.SYS_LLISTXATTR
+	}
+	size, _, errNo := syscall.Syscall(
+		trap,
+		uintptr(unsafe.Pointer(pathbs)),
+		uintptr(destPtr),
+		uintptr(len(dest)))
+
+	return int(size), int(errNo)
+}
+
+func setxattr(nofollow bool, path string, attr string, data []byte, flags int) (errno int) {
+	pathbs := syscall.StringBytePtr(path)
+	attrbs := syscall.StringBytePtr(attr)
+	var dataPtr unsafe.Pointer
+	if len(data) > 0 {
+		dataPtr = unsafe.Pointer(&data[0])
+	}
+	trap := uintptr(syscall.SYS_SETXATTR)
+	if nofollow {
+		trap = syscall.SYS_LSETXATTR
+	}
+	_, _, errNo := syscall.Syscall6(
+		trap,
+		uintptr(unsafe.Pointer(pathbs)),
+		uintptr(unsafe.Pointer(attrbs)),
+		uintptr(dataPtr),
+		uintptr(len(data)),
+		uintptr(flags), 0)
+
+	return int(errNo)
+}
+
+func removexattr(nofollow bool, path string, attr string) (errno int) {
+	pathbs := syscall.StringBytePtr(path)
+	attrbs := syscall.StringBytePtr(attr)
+	trap := uintptr(syscall.SYS_REMOVEXATTR)
+	if nofollow {
+		trap = syscall.SYS_LREMOVEXATTR
+	}
+	_, _, errNo := syscall.Syscall(
+		trap,
+		uintptr(unsafe.Pointer(pathbs)),
+		uintptr(unsafe.Pointer(attrbs)), 0)
+	return int(errNo)
+}
+
+func copyFileRange(fdIn int, offIn int64, fdOut int, offOut int64, size int) (int, error) {
+	n, _, errno := syscall.Syscall6(_SYS_COPY_FILE_RANGE,
+		uintptr(fdIn), uintptr(unsafe.Pointer(&offIn)),
+		uintptr(fdOut), uintptr(unsafe.Pointer(&offOut)),
+		uintptr(size), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+const AT_FDCWD = -100
+
+func Linkat(fd1 int, n1 string, fd2 int, n2 string) int {
+	b1 := syscall.StringBytePtr(n1)
+	b2 := syscall.StringBytePtr(n2)
+
+	_, _, errNo := syscall.Syscall6(
+		syscall.SYS_LINKAT,
+		uintptr(fd1),
+		uintptr(unsafe.Pointer(b1)),
+		uintptr(fd2),
+		uintptr(unsafe.Pointer(b2)),
+		0, 0)
+	return int(errNo)
+}
+
+type statxTimestamp struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved int32
+}
+
+// statxT is struct statx from <linux/stat.h>.
+type statxT struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          statxTimestamp
+	Btime          statxTimestamp
+	Ctime          statxTimestamp
+	Mtime          statxTimestamp
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	Spare          [14]uint64
+}
+
+const (
+	_AT_EMPTY_PATH       = 0x1000
+	_AT_SYMLINK_NOFOLLOW = 0x100
+	_STATX_BASIC_STATS   = 0x7ff
+	_STATX_BTIME         = 0x800
+)
+
+func statx(dirfd int, path string, flags int, mask uint32, dest *statxT) int {
+	b := syscall.StringBytePtr(path)
+	_, _, errNo := syscall.Syscall6(
+		_SYS_STATX,
+		uintptr(dirfd),
+		uintptr(unsafe.Pointer(b)),
+		uintptr(flags),
+		uintptr(mask),
+		uintptr(unsafe.Pointer(dest)),
+		0)
+	return int(errNo)
+}
+
+// statAttr fills a with statx, which also returns the birth time and
+// the file attribute flags.  Kernels without statx get a plain stat.
+func statAttr(a *Attr, dirfd int, path string, flags int) error {
+	var st statxT
+	errno := statx(dirfd, path, flags, _STATX_BASIC_STATS|_STATX_BTIME, &st)
+	if errno == int(syscall.ENOSYS) {
+		return statAttrFallback(a, dirfd, path, flags)
+	}
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	a.fromStatx(&st)
+	return nil
+}
+
+func syncfs(fd int) int {
+	_, _, errNo := syscall.Syscall(_SYS_SYNCFS, uintptr(fd), 0, 0)
+	return int(errNo)
+}
+
+// _UTIME_OMIT in a timespec leaves the time unchanged.
+const _UTIME_OMIT = (1 << 30) - 2
+
+// utimeSpec converts a Utimens argument for utimensat, where nil
+// means the time should be left alone.
+func utimeSpec(t *time.Time) syscall.Timespec {
+	switch {
+	case t == nil:
+		return syscall.Timespec{Nsec: _UTIME_OMIT}
+	case IsUtimeNow(t):
+		return syscall.Timespec{Nsec: UTIME_NOW}
+	}
+	return syscall.NsecToTimespec(t.UnixNano())
+}
+
+// Lutimens sets the times of path, or of the symlink path itself,
+// like Utimens.  A nil time is left unchanged.
+func Lutimens(path string, atime *time.Time, mtime *time.Time) (errno int) {
+	dirfd := AT_FDCWD
+	pathbs := syscall.StringBytePtr(path)
+	ts := [2]syscall.Timespec{utimeSpec(atime), utimeSpec(mtime)}
+	_, _, errNo := syscall.Syscall6(syscall.SYS_UTIMENSAT,
+		uintptr(dirfd), uintptr(unsafe.Pointer(pathbs)),
+		uintptr(unsafe.Pointer(&ts[0])), _AT_SYMLINK_NOFOLLOW, 0, 0)
+	return int(errNo)
+}
+
+// futimens sets the times of an open file.  A nil time is left
+// unchanged.
+func futimens(fd int, atime *time.Time, mtime *time.Time) int {
+	ts := [2]syscall.Timespec{utimeSpec(atime), utimeSpec(mtime)}
+	_, _, errNo := syscall.Syscall6(syscall.SYS_UTIMENSAT,
+		uintptr(fd), 0, uintptr(unsafe.Pointer(&ts[0])), 0, 0, 0)
+	return int(errNo)
+}
+
+func fdatasync(fd int) error {
+	return syscall.Fdatasync(fd)
+}
@@ -0,0 +1,7 @@
+package fuse
+
+const (
+	_SYS_STATX           = 383
+	_SYS_SYNCFS          = 344
+	_SYS_COPY_FILE_RANGE = 377
+)
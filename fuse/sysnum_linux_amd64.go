@@ -0,0 +1,7 @@
+package fuse
+
+const (
+	_SYS_STATX           = 332
+	_SYS_SYNCFS          = 306
+	_SYS_COPY_FILE_RANGE = 326
+)
@@ -0,0 +1,7 @@
+package fuse
+
+const (
+	_SYS_STATX           = 397
+	_SYS_SYNCFS          = 373
+	_SYS_COPY_FILE_RANGE = 391
+)
@@ -0,0 +1,7 @@
+package fuse
+
+const (
+	_SYS_STATX           = 291
+	_SYS_SYNCFS          = 267
+	_SYS_COPY_FILE_RANGE = 285
+)
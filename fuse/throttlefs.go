@@ -0,0 +1,335 @@
+package fuse
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ThrottleOptions are the limits of a ThrottleFileSystem.  Zero
+// values mean no limit.
+type ThrottleOptions struct {
+	// Bytes per second read from and written to files.
+	ReadBytesPerSecond  int64
+	WriteBytesPerSecond int64
+
+	// Operations per second: each call of the FileSystem, and of
+	// Read, Write and the attribute methods of open files.
+	OpsPerSecond int
+
+	// Burst is how long a caller that was quiet may go at full
+	// speed before it is slowed down.  Defaults to a second.
+	Burst time.Duration
+
+	// If set, each uid gets the limits for itself.  Otherwise all
+	// callers share them.  Open files are charged to the uid that
+	// opened them.
+	PerUid bool
+}
+
+// ThrottleFileSystem is a wrapper that limits the bandwidth and the
+// rate of operations of its callers with token buckets.  Operations
+// over the limit are delayed, not failed.
+type ThrottleFileSystem struct {
+	FileSystem
+
+	options ThrottleOptions
+
+	lock   sync.Mutex
+	limits map[uint32]*throttleLimits
+}
+
+// NewThrottleFileSystem wraps fs.
+func NewThrottleFileSystem(fs FileSystem, opts *ThrottleOptions) *ThrottleFileSystem {
+	t := &ThrottleFileSystem{
+		FileSystem: fs,
+		limits:     map[uint32]*throttleLimits{},
+	}
+	if opts != nil {
+		t.options = *opts
+	}
+	if t.options.Burst <= 0 {
+		t.options.Burst = time.Second
+	}
+	return t
+}
+
+func (fs *ThrottleFileSystem) String() string {
+	return fmt.Sprintf("ThrottleFileSystem(%s)", fs.FileSystem.String())
+}
+
+// tokenBucket lets rate tokens per second through, after allowing
+// burst tokens at once.  A nil bucket has no limit.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst time.Duration) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := rate * burst.Seconds()
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+// reserve takes n tokens at time now, and returns how long the caller
+// must wait for them.  The tokens may go negative, so later callers
+// queue up behind.
+func (b *tokenBucket) reserve(n int64, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	if d := b.reserve(n, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttleLimits struct {
+	ops    *tokenBucket
+	reads  *tokenBucket
+	writes *tokenBucket
+}
+
+// limitsFor returns the limits that apply to the caller.
+func (fs *ThrottleFileSystem) limitsFor(context *Context) *throttleLimits {
+	var uid uint32
+	if fs.options.PerUid && context != nil {
+		uid = context.Uid
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	l := fs.limits[uid]
+	if l == nil {
+		o := &fs.options
+		l = &throttleLimits{
+			ops:    newTokenBucket(float64(o.OpsPerSecond), o.Burst),
+			reads:  newTokenBucket(float64(o.ReadBytesPerSecond), o.Burst),
+			writes: newTokenBucket(float64(o.WriteBytesPerSecond), o.Burst),
+		}
+		fs.limits[uid] = l
+	}
+	return l
+}
+
+func (fs *ThrottleFileSystem) op(context *Context) {
+	fs.limitsFor(context).ops.take(1)
+}
+
+func (fs *ThrottleFileSystem) GetAttr(name string, context *Context) (*Attr, Status) {
+	fs.op(context)
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *ThrottleFileSystem) Chmod(name string, mode uint32, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *ThrottleFileSystem) Chown(name string, uid uint32, gid uint32, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *ThrottleFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Utimens(name, Atime, Mtime, context)
+}
+
+func (fs *ThrottleFileSystem) Truncate(name string, size uint64, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *ThrottleFileSystem) Access(name string, mode uint32, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *ThrottleFileSystem) Link(oldName string, newName string, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *ThrottleFileSystem) Mkdir(name string, mode uint32, context *Context) Status {
+	fs.op(context)
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *ThrottleFileSystem) Mknod(name string, mode uint32, dev uint32, context *Context) Status {
+	fs.op(context)
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *ThrottleFileSystem) Rename(oldName string, newName string, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *ThrottleFileSystem) Rmdir(name string, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *ThrottleFileSystem) Unlink(name string, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *ThrottleFileSystem) GetXAttr(name string, attribute string, context *Context) (data []byte, code Status) {
+	fs.op(context)
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *ThrottleFileSystem) ListXAttr(name string, context *Context) (attributes []string, code Status) {
+	fs.op(context)
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *ThrottleFileSystem) RemoveXAttr(name string, attr string, context *Context) Status {
+	fs.op(context)
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *ThrottleFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *Context) Status {
+	fs.op(context)
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *ThrottleFileSystem) Open(name string, flags uint32, context *Context) (file File, code Status) {
+	fs.op(context)
+	file, code = fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return &throttleFile{File: file, limits: fs.limitsFor(context)}, code
+}
+
+func (fs *ThrottleFileSystem) Create(name string, flags uint32, mode uint32, context *Context) (file File, code Status) {
+	fs.op(context)
+	file, code = fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return file, code
+	}
+	return &throttleFile{File: file, limits: fs.limitsFor(context)}, code
+}
+
+func (fs *ThrottleFileSystem) OpenDir(name string, context *Context) (stream []DirEntry, code Status) {
+	fs.op(context)
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *ThrottleFileSystem) OpenDirStream(name string, context *Context) (stream DirStream, code Status) {
+	fs.op(context)
+	return fs.FileSystem.OpenDirStream(name, context)
+}
+
+func (fs *ThrottleFileSystem) Symlink(value string, linkName string, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *ThrottleFileSystem) Readlink(name string, context *Context) (string, Status) {
+	fs.op(context)
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *ThrottleFileSystem) SyncFs(context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.SyncFs(context)
+}
+
+func (fs *ThrottleFileSystem) FsyncDir(name string, flags int, context *Context) (code Status) {
+	fs.op(context)
+	return fs.FileSystem.FsyncDir(name, flags, context)
+}
+
+// throttleFile charges the operations on an open file to the limits
+// of its opener.
+type throttleFile struct {
+	File
+	limits *throttleLimits
+}
+
+func (f *throttleFile) String() string {
+	return fmt.Sprintf("throttleFile(%s)", f.File.String())
+}
+
+func (f *throttleFile) InnerFile() File {
+	return f.File
+}
+
+// Read takes the tokens for the bytes afterwards, as it is only known
+// then how many there were.  This slows down the next read.
+func (f *throttleFile) Read(input *ReadIn, bp BufferPool) ([]byte, Status) {
+	f.limits.ops.take(1)
+	data, code := f.File.Read(input, bp)
+	f.limits.reads.take(int64(len(data)))
+	return data, code
+}
+
+func (f *throttleFile) Write(input *WriteIn, data []byte) (uint32, Status) {
+	f.limits.ops.take(1)
+	f.limits.writes.take(int64(len(data)))
+	return f.File.Write(input, data)
+}
+
+func (f *throttleFile) Fsync(flags int) (code Status) {
+	f.limits.ops.take(1)
+	return f.File.Fsync(flags)
+}
+
+func (f *throttleFile) Truncate(size uint64, context *Context) Status {
+	f.limits.ops.take(1)
+	return f.File.Truncate(size, context)
+}
+
+func (f *throttleFile) GetAttr(out *Attr) Status {
+	f.limits.ops.take(1)
+	return f.File.GetAttr(out)
+}
+
+func (f *throttleFile) Chown(uid uint32, gid uint32, context *Context) Status {
+	f.limits.ops.take(1)
+	return f.File.Chown(uid, gid, context)
+}
+
+func (f *throttleFile) Chmod(perms uint32, context *Context) Status {
+	f.limits.ops.take(1)
+	return f.File.Chmod(perms, context)
+}
+
+func (f *throttleFile) Utimens(atime *time.Time, mtime *time.Time, context *Context) Status {
+	f.limits.ops.take(1)
+	return f.File.Utimens(atime, mtime, context)
+}
+
+func (f *throttleFile) Setattr(valid uint32, attr *Attr, context *Context) Status {
+	f.limits.ops.take(1)
+	return f.File.Setattr(valid, attr, context)
+}
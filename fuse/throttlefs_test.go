@@ -0,0 +1,57 @@
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(100, time.Second)
+	now := time.Now()
+	if d := b.reserve(100, now); d != 0 {
+		t.Errorf("burst: got delay %v", d)
+	}
+	if d := b.reserve(50, now); d != 500*time.Millisecond {
+		t.Errorf("over burst: got delay %v, want 500ms", d)
+	}
+	// The next caller queues behind the first.
+	if d := b.reserve(50, now); d != time.Second {
+		t.Errorf("queued: got delay %v, want 1s", d)
+	}
+	if d := b.reserve(100, now.Add(3*time.Second)); d != 0 {
+		t.Errorf("after refill: got delay %v", d)
+	}
+	if newTokenBucket(0, time.Second) != nil {
+		t.Errorf("zero rate should not limit")
+	}
+}
+
+func TestThrottleFsPerUid(t *testing.T) {
+	fs := NewThrottleFileSystem(&DefaultFileSystem{}, &ThrottleOptions{
+		OpsPerSecond: 1,
+		PerUid:       true,
+	})
+	ctx := func(uid uint32) *Context {
+		c := &Context{}
+		c.Uid = uid
+		return c
+	}
+	if fs.limitsFor(ctx(1)) == fs.limitsFor(ctx(2)) {
+		t.Errorf("uids share limits")
+	}
+	if fs.limitsFor(ctx(1)) != fs.limitsFor(ctx(1)) {
+		t.Errorf("uid has different limits")
+	}
+
+	// Each uid has its own burst of one operation.
+	start := time.Now()
+	fs.GetAttr("", ctx(1))
+	fs.GetAttr("", ctx(2))
+	if d := time.Now().Sub(start); d > 500*time.Millisecond {
+		t.Errorf("operations of different uids delayed %v", d)
+	}
+	fs.GetAttr("", ctx(1))
+	if d := time.Now().Sub(start); d < 500*time.Millisecond {
+		t.Errorf("second operation not delayed: %v", d)
+	}
+}
@@ -0,0 +1,55 @@
+package fuse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// timeoutFs has an immutable file, cached for an hour, and a volatile
+// one, not cached at all.
+type timeoutFs struct {
+	DefaultFileSystem
+}
+
+func (fs *timeoutFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	switch name {
+	case "":
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	case "immutable":
+		return &Attr{Mode: S_IFREG | 0644, EntryTimeout: time.Hour, AttrTimeout: time.Hour}, OK
+	case "volatile":
+		return &Attr{Mode: S_IFREG | 0644, EntryTimeout: -1, AttrTimeout: -1}, OK
+	case "plain":
+		return &Attr{Mode: S_IFREG | 0644}, OK
+	}
+	return nil, ENOENT
+}
+
+func TestAttrTimeouts(t *testing.T) {
+	c := NewFileSystemConnector(NewPathNodeFs(&timeoutFs{}, nil), nil)
+	rootHeader := &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}
+
+	for name, want := range map[string]uint64{
+		"immutable": 3600,
+		"volatile":  0,
+		"plain":     1,
+	} {
+		entry := raw.EntryOut{}
+		if code := c.Lookup(&entry, rootHeader, name); !code.Ok() {
+			t.Fatalf("Lookup %q: %v", name, code)
+		}
+		if entry.EntryValid != want || entry.AttrValid != want {
+			t.Errorf("Lookup %q: entry %d attr %d, want %d", name, entry.EntryValid, entry.AttrValid, want)
+		}
+
+		attr := raw.AttrOut{}
+		if code := c.GetAttr(&attr, &raw.InHeader{NodeId: entry.NodeId}, &raw.GetAttrIn{}); !code.Ok() {
+			t.Fatalf("GetAttr %q: %v", name, code)
+		}
+		if attr.AttrValid != want {
+			t.Errorf("GetAttr %q: attr %d, want %d", name, attr.AttrValid, want)
+		}
+	}
+}
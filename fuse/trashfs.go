@@ -0,0 +1,281 @@
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TrashFileSystem is a wrapper that moves files and directories to a
+// trash directory when they are unlinked or removed, instead of
+// deleting them.  The trash follows the freedesktop.org trash
+// specification, so file managers can show and restore its entries:
+// an entry is kept as files/<name>, with an info/<name>.trashinfo
+// that says where it came from and when it was deleted.
+//
+// Deleting in the trash deletes for real, and renaming an entry out
+// of files/ restores it.  Entries are deleted for real when they are
+// older than TrashOptions.Expiry, which is checked at most once a
+// minute while entries are trashed, or with Purge.
+type TrashFileSystem struct {
+	FileSystem
+
+	options TrashOptions
+
+	// Serializes picking names in the trash.
+	lock      sync.Mutex
+	lastPurge time.Time
+
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+type TrashOptions struct {
+	// Dir is the trash directory, relative to the root.  Defaults
+	// to ".Trash".
+	Dir string
+
+	// Expiry is how long entries stay in the trash.  0 keeps them
+	// until they are deleted.
+	Expiry time.Duration
+}
+
+const (
+	_TRASH_DATE_FORMAT = "2006-01-02T15:04:05"
+	_TRASH_INFO_SUFFIX = ".trashinfo"
+)
+
+// NewTrashFileSystem wraps fs, which also holds the trash.
+func NewTrashFileSystem(fs FileSystem, opts *TrashOptions) *TrashFileSystem {
+	t := &TrashFileSystem{
+		FileSystem: fs,
+		now:        time.Now,
+	}
+	if opts != nil {
+		t.options = *opts
+	}
+	if t.options.Dir == "" {
+		t.options.Dir = ".Trash"
+	}
+	t.options.Dir = strings.Trim(filepath.Clean(t.options.Dir), "/")
+	return t
+}
+
+func (fs *TrashFileSystem) String() string {
+	return fmt.Sprintf("TrashFileSystem(%s)", fs.FileSystem.String())
+}
+
+func (fs *TrashFileSystem) inTrash(name string) bool {
+	return name == fs.options.Dir || strings.HasPrefix(name, fs.options.Dir+"/")
+}
+
+func (fs *TrashFileSystem) filesDir() string {
+	return filepath.Join(fs.options.Dir, "files")
+}
+
+func (fs *TrashFileSystem) infoDir() string {
+	return filepath.Join(fs.options.Dir, "info")
+}
+
+// infoName returns the info file of an entry in files/, or "" if name
+// is not one.
+func (fs *TrashFileSystem) infoName(name string) string {
+	dir, base := filepath.Split(name)
+	if filepath.Clean(dir) != fs.filesDir() {
+		return ""
+	}
+	return filepath.Join(fs.infoDir(), base+_TRASH_INFO_SUFFIX)
+}
+
+func (fs *TrashFileSystem) mkdir(dir string, context *Context) Status {
+	if code := fs.FileSystem.Mkdir(dir, 0700, context); !code.Ok() && code != Status(syscall.EEXIST) {
+		return code
+	}
+	return OK
+}
+
+// trash moves name into the trash.
+func (fs *TrashFileSystem) trash(name string, context *Context) Status {
+	if _, code := fs.FileSystem.GetAttr(name, context); !code.Ok() {
+		return code
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, d := range []string{fs.options.Dir, fs.filesDir(), fs.infoDir()} {
+		if code := fs.mkdir(d, context); !code.Ok() {
+			return code
+		}
+	}
+
+	var comps []string
+	for _, c := range strings.Split(name, "/") {
+		comps = append(comps, url.PathEscape(c))
+	}
+	info := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		strings.Join(comps, "/"), fs.now().Format(_TRASH_DATE_FORMAT))
+
+	// The info file is made first, with O_EXCL, to claim the name.
+	base := filepath.Base(name)
+	for n := 1; ; n++ {
+		entry := base
+		if n > 1 {
+			entry = fmt.Sprintf("%s.%d", base, n)
+		}
+		infoName := filepath.Join(fs.infoDir(), entry+_TRASH_INFO_SUFFIX)
+		f, code := fs.FileSystem.Create(infoName, uint32(os.O_WRONLY|os.O_CREATE|os.O_EXCL), 0600, context)
+		if code == Status(syscall.EEXIST) {
+			continue
+		}
+		if !code.Ok() {
+			return code
+		}
+		_, code = f.Write(&WriteIn{}, []byte(info))
+		f.Flush(&FlushIn{})
+		f.Release(&ReleaseIn{})
+		if code.Ok() {
+			code = fs.FileSystem.Rename(name, filepath.Join(fs.filesDir(), entry), context)
+		}
+		if !code.Ok() {
+			fs.FileSystem.Unlink(infoName, context)
+		}
+		return code
+	}
+}
+
+// removeAll deletes name, and everything below it.
+func (fs *TrashFileSystem) removeAll(name string, context *Context) Status {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if !a.IsDir() {
+		return fs.FileSystem.Unlink(name, context)
+	}
+	stream, code := fs.FileSystem.OpenDir(name, context)
+	if !code.Ok() {
+		return code
+	}
+	for _, e := range stream {
+		if code := fs.removeAll(filepath.Join(name, e.Name), context); !code.Ok() && code != ENOENT {
+			return code
+		}
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+// deletionDate reads the deletion date from an info file.
+func (fs *TrashFileSystem) deletionDate(infoName string, context *Context) (time.Time, bool) {
+	f, code := fs.FileSystem.Open(infoName, uint32(os.O_RDONLY), context)
+	if !code.Ok() {
+		return time.Time{}, false
+	}
+	defer f.Release(&ReleaseIn{})
+	data, code := f.Read(&ReadIn{Size: 64 << 10}, NewGcBufferPool())
+	if !code.Ok() {
+		return time.Time{}, false
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(l, "DeletionDate=") {
+			t, err := time.ParseInLocation(_TRASH_DATE_FORMAT, strings.TrimSpace(l[len("DeletionDate="):]), time.Local)
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// Purge deletes the entries that are older than the expiry.
+func (fs *TrashFileSystem) Purge(context *Context) Status {
+	if fs.options.Expiry <= 0 {
+		return OK
+	}
+	stream, code := fs.FileSystem.OpenDir(fs.infoDir(), context)
+	if code == ENOENT {
+		return OK
+	} else if !code.Ok() {
+		return code
+	}
+	cutoff := fs.now().Add(-fs.options.Expiry)
+	for _, e := range stream {
+		if !strings.HasSuffix(e.Name, _TRASH_INFO_SUFFIX) {
+			continue
+		}
+		infoName := filepath.Join(fs.infoDir(), e.Name)
+		t, ok := fs.deletionDate(infoName, context)
+		if !ok || !t.Before(cutoff) {
+			continue
+		}
+		entry := filepath.Join(fs.filesDir(), strings.TrimSuffix(e.Name, _TRASH_INFO_SUFFIX))
+		if code := fs.removeAll(entry, context); !code.Ok() && code != ENOENT {
+			log.Printf("TrashFileSystem: purging %q: %v", entry, code)
+			continue
+		}
+		fs.FileSystem.Unlink(infoName, context)
+	}
+	return OK
+}
+
+// maybePurge runs Purge if it has not run for a minute.
+func (fs *TrashFileSystem) maybePurge(context *Context) {
+	if fs.options.Expiry <= 0 {
+		return
+	}
+	fs.lock.Lock()
+	now := fs.now()
+	due := now.Sub(fs.lastPurge) >= time.Minute
+	if due {
+		fs.lastPurge = now
+	}
+	fs.lock.Unlock()
+	if due {
+		fs.Purge(context)
+	}
+}
+
+func (fs *TrashFileSystem) Unlink(name string, context *Context) Status {
+	if fs.inTrash(name) {
+		code := fs.FileSystem.Unlink(name, context)
+		if info := fs.infoName(name); code.Ok() && info != "" {
+			fs.FileSystem.Unlink(info, context)
+		}
+		return code
+	}
+	code := fs.trash(name, context)
+	fs.maybePurge(context)
+	return code
+}
+
+func (fs *TrashFileSystem) Rmdir(name string, context *Context) Status {
+	if fs.inTrash(name) {
+		code := fs.FileSystem.Rmdir(name, context)
+		if info := fs.infoName(name); code.Ok() && info != "" {
+			fs.FileSystem.Unlink(info, context)
+		}
+		return code
+	}
+	// Only empty directories can be removed.
+	stream, code := fs.FileSystem.OpenDir(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if len(stream) > 0 {
+		return Status(syscall.ENOTEMPTY)
+	}
+	code = fs.trash(name, context)
+	fs.maybePurge(context)
+	return code
+}
+
+// Rename restores entries that are moved out of the trash.
+func (fs *TrashFileSystem) Rename(oldName string, newName string, context *Context) Status {
+	code := fs.FileSystem.Rename(oldName, newName, context)
+	if info := fs.infoName(oldName); code.Ok() && info != "" && !fs.inTrash(newName) {
+		fs.FileSystem.Unlink(info, context)
+	}
+	return code
+}
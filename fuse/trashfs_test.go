@@ -0,0 +1,90 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTrashFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	fs := NewTrashFileSystem(NewLoopbackFileSystem(dir), &TrashOptions{Expiry: 24 * time.Hour})
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	fs.now = func() time.Time { return now }
+
+	list := func(name string) string {
+		stream, _ := fs.OpenDir(name, nil)
+		var names []string
+		for _, e := range stream {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+	exists := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	os.MkdirAll(filepath.Join(dir, "a/b"), 0755)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "a/b/my file"), []byte("1"), 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "my file"), []byte("2"), 0644))
+
+	if code := fs.Unlink("a/b/my file", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if code := fs.Rmdir("a", nil); code != Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir of full directory: got %v", code)
+	}
+	if code := fs.Rmdir("a/b", nil); !code.Ok() {
+		t.Fatalf("Rmdir: %v", code)
+	}
+	now = now.Add(2 * time.Hour)
+	if code := fs.Unlink("my file", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if exists("my file") || exists("a/b") {
+		t.Errorf("entries not removed")
+	}
+	if got := list(".Trash/files"); got != "b my file my file.2" {
+		t.Errorf("files: got %q", got)
+	}
+	if got := list(".Trash/info"); got != "b.trashinfo my file.2.trashinfo my file.trashinfo" {
+		t.Errorf("info: got %q", got)
+	}
+	info, err := ioutil.ReadFile(filepath.Join(dir, ".Trash/info/my file.trashinfo"))
+	CheckSuccess(err)
+	if want := "[Trash Info]\nPath=a/b/my%20file\nDeletionDate=2020-01-01T12:00:00\n"; string(info) != want {
+		t.Errorf("info: got %q, want %q", info, want)
+	}
+
+	// Restoring, and deleting for real.
+	if code := fs.Rename(".Trash/files/my file.2", "restored", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "restored")); string(data) != "2" {
+		t.Errorf("restored: got %q", data)
+	}
+	if code := fs.Unlink(".Trash/files/my file", nil); !code.Ok() {
+		t.Fatalf("Unlink in trash: %v", code)
+	}
+	if got := list(".Trash/info"); got != "b.trashinfo" {
+		t.Errorf("info after restore: got %q", got)
+	}
+
+	// Expired entries go at the next delete.
+	fs.Unlink("restored", nil)
+	now = now.Add(23 * time.Hour)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "new"), []byte("3"), 0644))
+	fs.Unlink("new", nil)
+	if got := list(".Trash/files"); got != "new restored" {
+		t.Errorf("after expiry: got %q", got)
+	}
+}
@@ -10,8 +10,9 @@ var readFlagNames map[int]string
 
 func init() {
 	writeFlagNames = map[int]string{
-		WRITE_CACHE:     "CACHE",
-		WRITE_LOCKOWNER: "LOCKOWNER",
+		WRITE_CACHE:        "CACHE",
+		WRITE_LOCKOWNER:    "LOCKOWNER",
+		WRITE_KILL_SUIDGID: "KILL_SUIDGID",
 	}
 	readFlagNames = map[int]string{
 		READ_LOCKOWNER: "LOCKOWNER",
@@ -31,5 +32,3 @@ func (me *WithFlags) String() string {
 		me.File, me.Description, raw.FlagString(raw.OpenFlagNames, int(me.OpenFlags), "O_RDONLY"),
 		raw.FlagString(raw.FuseOpenFlagNames, int(me.FuseFlags), ""))
 }
-
-
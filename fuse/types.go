@@ -3,6 +3,8 @@ package fuse
 import (
 	"os"
 	"syscall"
+	"time"
+
 	"github.com/hanwen/go-fuse/raw"
 )
 
@@ -19,6 +21,8 @@ const PAGESIZE = 4096
 
 const (
 	_DEFAULT_BACKGROUND_TASKS = 12
+	_DEFAULT_BLKSIZE          = PAGESIZE
+	_DEFAULT_NOTIFY_RATE      = 1000
 )
 
 type Status int32
@@ -31,7 +35,6 @@ const (
 	EIO     = Status(syscall.EIO)
 	ENOENT  = Status(syscall.ENOENT)
 	ENOSYS  = Status(syscall.ENOSYS)
-	ENODATA = Status(syscall.ENODATA)
 	ENOTDIR = Status(syscall.ENOTDIR)
 	EPERM   = Status(syscall.EPERM)
 	ERANGE  = Status(syscall.ERANGE)
@@ -39,14 +42,90 @@ const (
 	EBADF   = Status(syscall.EBADF)
 	ENODEV  = Status(syscall.ENODEV)
 	EROFS   = Status(syscall.EROFS)
+	ESTALE  = Status(syscall.ESTALE)
+	EAGAIN  = Status(syscall.EAGAIN)
+	ENOTSUP = Status(syscall.ENOTSUP)
 )
 
 
-type Attr raw.Attr
+// Attr holds the attributes of a file.  The fields up to Blksize
+// are sent to the kernel as a raw.Attr.  The protocol version we
+// speak has no room for the remaining statx style fields, so these
+// are only visible to Go callers.
+//
+// Blocks counts 512-byte units.  If Blksize is zero, the connector
+// reports FileSystemOptions.Blksize instead, and Blocks computed from
+// Size if Blocks is zero too; set Blksize to choose the preferred I/O
+// size of a file, or to report a sparse file with zero Blocks.
+type Attr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	raw.Owner
+	Rdev    uint32
+	Blksize uint32
+
+	// Birth (creation) time. Zero if unknown.
+	Btime     uint64
+	Btimensec uint32
+
+	// STATX_ATTR_* flags, and the mask of flags that are
+	// supported by the file system.
+	Attributes     uint64
+	AttributesMask uint64
+
+	// If non-zero, these replace FileSystemOptions.EntryTimeout
+	// and AttrTimeout for the reply that carries this Attr, so
+	// immutable files can be cached longer than volatile ones.
+	// A negative value means no caching.  A Lookup that fails
+	// with ENOENT may set EntryTimeout to have the kernel cache
+	// the negative entry.
+	EntryTimeout time.Duration
+	AttrTimeout  time.Duration
+}
 
 type Owner raw.Owner
 
-type Context raw.Context
+// Context describes the caller of an operation.
+type Context struct {
+	raw.Context
+
+	// The umask of the caller, for Create, Mkdir and Mknod.  The
+	// kernel has applied it to the mode already.
+	Umask uint32
+
+	// The request, for Interrupted.
+	unique      uint64
+	interrupted func(unique uint64) <-chan struct{}
+
+	// Looks up the supplementary groups of a process.  If nil,
+	// they are read from /proc.
+	groups func(pid uint32) []uint32
+}
+
+func newContext(header *raw.InHeader) *Context {
+	return &Context{Context: header.Context}
+}
+
+// Interrupted returns a channel that is closed when the request is
+// interrupted: by the kernel, eg. because the caller got a signal, or
+// by MountState.Shutdown when it stops waiting.  Slow operations can
+// watch it, and return EINTR early.  If the request cannot be
+// interrupted, it returns nil, which blocks forever.
+func (c *Context) Interrupted() <-chan struct{} {
+	if c == nil || c.interrupted == nil {
+		return nil
+	}
+	return c.interrupted(c.unique)
+}
 
 type StatfsOut raw.StatfsOut
 
@@ -54,6 +133,21 @@ const (
 	READ_LOCKOWNER = (1 << 1)
 )
 
+// FlushIn is passed to File.Flush.  The kernel flushes on every
+// close(2) of a file descriptor, so dup'ed descriptors produce one
+// flush each.  LockOwner identifies the POSIX locks of the closing
+// process, which should be released.
+type FlushIn raw.FlushIn
+
+const (
+	RELEASE_FLUSH = raw.RELEASE_FLUSH
+)
+
+// ReleaseIn is passed to File.Release, which is called once, after
+// the last descriptor for the file was closed.  If ReleaseFlags has
+// RELEASE_FLUSH set, the file should be flushed as well.
+type ReleaseIn raw.ReleaseIn
+
 type ReadIn struct {
 	Fh        uint64
 	Offset    uint64
@@ -67,6 +161,10 @@ type ReadIn struct {
 const (
 	WRITE_CACHE     = (1 << 0)
 	WRITE_LOCKOWNER = (1 << 1)
+
+	// Clear the setuid and setgid bits, with
+	// MountOptions.HandleKillPriv.
+	WRITE_KILL_SUIDGID = (1 << 2)
 )
 
 type WriteIn struct {
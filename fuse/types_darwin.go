@@ -0,0 +1,15 @@
+package fuse
+
+import (
+	"syscall"
+)
+
+const (
+	// Darwin has no ENODATA; getxattr(2) fails with ENOATTR
+	// instead.
+	ENODATA = Status(syscall.ENOATTR)
+
+	// Flags for SetXAttr, see setxattr(2).
+	XATTR_CREATE  = 2
+	XATTR_REPLACE = 4
+)
@@ -0,0 +1,13 @@
+package fuse
+
+import (
+	"syscall"
+)
+
+const (
+	ENODATA = Status(syscall.ENODATA)
+
+	// Flags for SetXAttr, see setxattr(2).
+	XATTR_CREATE  = 1
+	XATTR_REPLACE = 2
+)
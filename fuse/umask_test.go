@@ -0,0 +1,66 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+type umaskFs struct {
+	FileSystem
+
+	mu     sync.Mutex
+	umasks map[string]uint32
+}
+
+func (fs *umaskFs) record(name string, context *Context) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.umasks[name] = context.Umask
+}
+
+func (fs *umaskFs) Mkdir(name string, mode uint32, context *Context) Status {
+	fs.record(name, context)
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *umaskFs) Create(name string, flags uint32, mode uint32, context *Context) (File, Status) {
+	fs.record(name, context)
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+func TestContextUmask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+
+	fs := &umaskFs{
+		FileSystem: NewLoopbackFileSystem(dir + "/orig"),
+		umasks:     map[string]uint32{},
+	}
+	state, _, err := MountNodeFileSystem(dir+"/mnt", NewPathNodeFs(fs, nil), nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	old := syscall.Umask(027)
+	defer syscall.Umask(old)
+
+	err = os.Mkdir(dir+"/mnt/dir", 0777)
+	CheckSuccess(err)
+	err = ioutil.WriteFile(dir+"/mnt/file", []byte("hello"), 0666)
+	CheckSuccess(err)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, n := range []string{"dir", "file"} {
+		if got := fs.umasks[n]; got != 027 {
+			t.Errorf("%s: got umask %o, want 027", n, got)
+		}
+	}
+}
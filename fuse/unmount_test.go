@@ -0,0 +1,154 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// unmountFs reports OnUnmount calls, and blocks in GetAttr of
+// "slow" until block is closed, or the request is interrupted.
+type unmountFs struct {
+	DefaultFileSystem
+	name   string
+	events chan string
+	block  chan bool
+}
+
+func (fs *unmountFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	switch name {
+	case "":
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	case "slow":
+		a := &Attr{Mode: S_IFREG | 0644}
+		if fs.block != nil {
+			fs.events <- "getattr"
+			select {
+			case <-fs.block:
+			case <-context.Interrupted():
+				return nil, Status(syscall.EINTR)
+			}
+		}
+		return a, OK
+	}
+	return nil, ENOENT
+}
+
+func (fs *unmountFs) OnUnmount(reason UnmountReason) {
+	fs.events <- fs.name + ":" + reason.String()
+}
+
+func TestOnUnmountSubmount(t *testing.T) {
+	events := make(chan string, 10)
+	c := NewFileSystemConnector(NewPathNodeFs(&unmountFs{name: "root", events: events}, nil), nil)
+	c.Init(&RawFsInit{
+		EntryNotify: func(parent uint64, name string) Status { return OK },
+	})
+	sub := &unmountFs{name: "sub", events: events}
+	if code := c.Mount(c.rootNode, "sub", NewPathNodeFs(sub, nil), nil); !code.Ok() {
+		t.Fatal("Mount:", code)
+	}
+	if code := c.Unmount(c.rootNode.GetChild("sub")); !code.Ok() {
+		t.Fatal("Unmount:", code)
+	}
+	if got := <-events; got != "sub:submount" {
+		t.Errorf("got %q, want sub:submount", got)
+	}
+}
+
+func TestOnUnmountAfterRequests(t *testing.T) {
+	local, remote, err := unixgramSocketpair()
+	CheckSuccess(err)
+	defer local.Close()
+
+	events := make(chan string, 10)
+	root := &unmountFs{name: "root", events: events, block: make(chan bool)}
+	c := NewFileSystemConnector(NewPathNodeFs(root, nil), nil)
+	sub := &unmountFs{name: "sub", events: events}
+	if code := c.Mount(c.rootNode, "sub", NewPathNodeFs(sub, nil), nil); !code.Ok() {
+		t.Fatal("Mount:", code)
+	}
+	entry := raw.EntryOut{}
+	block := root.block
+	root.block = nil
+	if code := c.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "slow"); !code.Ok() {
+		t.Fatal("Lookup:", code)
+	}
+	root.block = block
+
+	ms := NewMountState(c)
+	ms.setOptions(nil)
+	ms.mountFile = remote
+	done := make(chan bool)
+	go func() {
+		ms.Loop()
+		done <- true
+	}()
+
+	type getAttrRequest struct {
+		header raw.InHeader
+		in     raw.GetAttrIn
+	}
+	input := getAttrRequest{
+		header: raw.InHeader{
+			Opcode: _OP_GETATTR,
+			Unique: 1,
+			NodeId: entry.NodeId,
+		},
+	}
+	input.header.Length = uint32(unsafe.Sizeof(input))
+	_, err = local.Write((*[unsafe.Sizeof(input)]byte)(unsafe.Pointer(&input))[:])
+	CheckSuccess(err)
+	if got := <-events; got != "getattr" {
+		t.Fatalf("got %q, want getattr", got)
+	}
+
+	// Closing the connection does not unmount while GetAttr runs.
+	syscall.Shutdown(int(local.Fd()), syscall.SHUT_RDWR)
+	select {
+	case got := <-events:
+		t.Fatalf("got %q while a request was in flight", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(block)
+	for _, want := range []string{"sub:error", "root:error"} {
+		if got := <-events; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	<-done
+}
+
+func TestUnmountLazy(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	CheckSuccess(ioutil.WriteFile(tc.origFile, []byte("hello"), 0644))
+	f, err := os.Open(tc.mnt)
+	CheckSuccess(err)
+	method, err := tc.state.UnmountWithOptions(&UnmountOptions{Retries: -1})
+	if err == nil {
+		t.Fatalf("unmount of a busy mount succeeded with %v", method)
+	}
+
+	method, err = tc.state.UnmountWithOptions(&UnmountOptions{Retries: -1, Lazy: true})
+	CheckSuccess(err)
+	if method != UNMOUNT_LAZY {
+		t.Errorf("got %v, want lazy", method)
+	}
+	if _, err := os.Lstat(tc.mountFile); err == nil {
+		t.Error("mount still visible after lazy unmount")
+	}
+
+	// The open directory is still served.
+	if _, err := f.Readdirnames(-1); err != nil {
+		t.Errorf("Readdirnames after lazy unmount: %v", err)
+	}
+	f.Close()
+}
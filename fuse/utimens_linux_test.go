@@ -0,0 +1,98 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const _UTIME_NOW = (1 << 30) - 1
+
+func TestUtimensOmitNow(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	CheckSuccess(ioutil.WriteFile(tc.origFile, []byte("hello"), 0644))
+	atime := syscall.Timespec{Sec: 1000, Nsec: 500}
+	mtime := syscall.Timespec{Sec: 2000, Nsec: 250}
+	CheckSuccess(syscall.UtimesNano(tc.origFile, []syscall.Timespec{atime, mtime}))
+
+	times := func() (a, m syscall.Timespec) {
+		var st syscall.Stat_t
+		CheckSuccess(syscall.Stat(tc.origFile, &st))
+		return st.Atim, st.Mtim
+	}
+
+	for _, open := range []bool{false, true} {
+		if open {
+			// Utimens on the open file, through futimens.
+			f, err := os.OpenFile(tc.mountFile, os.O_WRONLY, 0)
+			CheckSuccess(err)
+			defer f.Close()
+		}
+
+		mtime = syscall.Timespec{Sec: 3000, Nsec: 123456789}
+		CheckSuccess(syscall.UtimesNano(tc.mountFile,
+			[]syscall.Timespec{{Nsec: _UTIME_OMIT}, mtime}))
+		if a, m := times(); a != atime || m != mtime {
+			t.Errorf("open %v: got %v %v, want atime untouched %v, mtime %v", open, a, m, atime, mtime)
+		}
+
+		before := time.Now().Add(-time.Second)
+		CheckSuccess(syscall.UtimesNano(tc.mountFile,
+			[]syscall.Timespec{{Nsec: _UTIME_NOW}, {Nsec: _UTIME_OMIT}}))
+		a, m := times()
+		if time.Unix(a.Unix()).Before(before) || m != mtime {
+			t.Errorf("open %v: got %v %v, want atime now, mtime untouched %v", open, a, m, mtime)
+		}
+		atime = a
+	}
+}
+
+func TestLoopbackSymlinkMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	target := dir + "/target"
+	link := dir + "/link"
+	CheckSuccess(ioutil.WriteFile(target, nil, 0644))
+	CheckSuccess(os.Symlink("target", link))
+	old := time.Unix(1000, 0)
+	CheckSuccess(os.Chtimes(target, old, old))
+
+	fs := NewLoopbackFileSystem(dir)
+	mtime := time.Unix(2000, 0)
+	if code := fs.Utimens("link", nil, &mtime, nil); !code.Ok() {
+		t.Fatal("Utimens:", code)
+	}
+	if fi, err := os.Lstat(link); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("link mtime: %v, %v", fi.ModTime(), err)
+	}
+	if fi, err := os.Stat(target); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("target mtime changed: %v, %v", fi.ModTime(), err)
+	}
+
+	// Symlinks cannot have user attributes, so this must fail
+	// rather than set the target's.
+	fs.SetXAttr("link", "user.attr", []byte("x"), 0, nil)
+	if _, errno := GetXAttr(target, "user.attr", make([]byte, 10)); errno == 0 {
+		t.Error("SetXAttr changed the target")
+	}
+
+	if os.Geteuid() == 0 {
+		if code := fs.Chown("link", 1, 1, nil); !code.Ok() {
+			t.Fatal("Chown:", code)
+		}
+		var st syscall.Stat_t
+		CheckSuccess(syscall.Lstat(link, &st))
+		if st.Uid != 1 {
+			t.Errorf("link uid %d, want 1", st.Uid)
+		}
+		CheckSuccess(syscall.Stat(target, &st))
+		if st.Uid != 0 {
+			t.Errorf("target uid changed to %d", st.Uid)
+		}
+	}
+}
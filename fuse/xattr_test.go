@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"testing"
 )
@@ -176,3 +177,60 @@ func TestXAttrRead(t *testing.T) {
 		t.Error("Data not removed?", errno, val)
 	}
 }
+
+// noXAttrFs has a single file, and no extended attributes.
+type noXAttrFs struct {
+	DefaultFileSystem
+	getXAttrCalls int32
+}
+
+func (fs *noXAttrFs) GetAttr(name string, context *Context) (*Attr, Status) {
+	switch name {
+	case "":
+		return &Attr{Mode: S_IFDIR | 0755}, OK
+	case "file":
+		return &Attr{Mode: S_IFREG | 0644}, OK
+	}
+	return nil, ENOENT
+}
+
+func (fs *noXAttrFs) GetXAttr(name string, attr string, context *Context) ([]byte, Status) {
+	atomic.AddInt32(&fs.getXAttrCalls, 1)
+	return nil, ENOSYS
+}
+
+func TestXAttrENOSYSSubmount(t *testing.T) {
+	xfs := NewXAttrFs(xattrFilename, xattrGolden)
+	xfs.tester = t
+	mountPoint, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(mountPoint)
+
+	nfs := NewPathNodeFs(xfs, nil)
+	state, connector, err := MountNodeFileSystem(mountPoint, nfs, nil)
+	CheckSuccess(err)
+	state.Debug = VerboseTest()
+	go state.Loop()
+	defer state.Unmount()
+
+	sub := &noXAttrFs{}
+	if code := connector.Mount(nfs.Root().Inode(), "sub", NewPathNodeFs(sub, nil), nil); !code.Ok() {
+		t.Fatal("Mount:", code)
+	}
+
+	subFile := filepath.Join(mountPoint, "sub", "file")
+	for i := 0; i < 3; i++ {
+		if _, errno := readXAttr(subFile, "user.attr1"); errno != int(ENOTSUP) {
+			t.Errorf("GetXAttr on submount: got errno %v, want ENOTSUP", syscall.Errno(errno))
+		}
+	}
+	if n := atomic.LoadInt32(&sub.getXAttrCalls); n != 1 {
+		t.Errorf("GetXAttr called %d times, want 1", n)
+	}
+
+	// ENOTSUP keeps the kernel asking the root file system.
+	val, errno := readXAttr(filepath.Join(mountPoint, xattrFilename), "user.attr1")
+	if errno != 0 || string(val) != "val1" {
+		t.Errorf("GetXAttr on root: got %q, %v", val, syscall.Errno(errno))
+	}
+}
@@ -0,0 +1,542 @@
+// Package gitfs serves a git repository as a read-only tree:
+//
+//	HEAD                  symlink to the current branch
+//	branches/<name>       symlink to commits/<sha> of the branch
+//	tags/<name>           symlink to commits/<sha> of the tag
+//	commits/<sha>/...     the tree of the commit
+//
+// Branches and tags are read again each time their link is followed,
+// so they follow the repository.  Commits never change, so their
+// trees can be cached.  Every path is an inode of its own, also when
+// trees share objects.
+package gitfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var _ = (fuse.NodeFileSystem)((*GitFs)(nil))
+
+// Blobs up to this size are read whole when they are opened.  Larger
+// ones are streamed from git.
+var streamSize int64 = 1 << 20
+
+// GitFs is a NodeFileSystem for a Repo.
+type GitFs struct {
+	fuse.DefaultNodeFileSystem
+	repo *Repo
+	root *rootNode
+}
+
+func NewGitFs(repo *Repo) *GitFs {
+	fs := &GitFs{repo: repo}
+	fs.root = &rootNode{gitNode: gitNode{fs: fs}}
+	return fs
+}
+
+func (fs *GitFs) String() string {
+	return fmt.Sprintf("GitFs(%s)", fs.repo.dir)
+}
+
+func (fs *GitFs) Root() fuse.FsNode {
+	return fs.root
+}
+
+func (fs *GitFs) gitError(op string, name string, err error) fuse.Status {
+	if err == errNotFound {
+		return fuse.ENOENT
+	}
+	log.Printf("GitFs: %s %s: %v", op, name, err)
+	return fuse.EIO
+}
+
+// gitNode has what all nodes share.
+type gitNode struct {
+	fuse.DefaultFsNode
+	fs    *GitFs
+	mtime time.Time
+}
+
+func (n *gitNode) Deletable() bool {
+	return true
+}
+
+func (n *gitNode) attr(out *fuse.Attr, mode uint32, size uint64) fuse.Status {
+	out.Mode = mode
+	out.Size = size
+	out.Blocks = (size + 511) / 512
+	out.SetTimes(&n.mtime, &n.mtime, &n.mtime)
+	return fuse.OK
+}
+
+// add makes child the node for name in parent.
+func add(parent fuse.FsNode, name string, child fuse.FsNode, out *fuse.Attr, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	if code := child.GetAttr(out, nil, context); !code.Ok() {
+		return nil, code
+	}
+	parent.Inode().AddChild(name, parent.Inode().New(out.IsDir(), child))
+	return child, fuse.OK
+}
+
+type rootNode struct {
+	gitNode
+}
+
+func (n *rootNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	return n.attr(out, fuse.S_IFDIR|0555, 0)
+}
+
+func (n *rootNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return []fuse.DirEntry{
+		{Name: "HEAD", Mode: fuse.S_IFLNK},
+		{Name: "branches", Mode: fuse.S_IFDIR},
+		{Name: "tags", Mode: fuse.S_IFDIR},
+		{Name: "commits", Mode: fuse.S_IFDIR},
+	}, fuse.OK
+}
+
+func (n *rootNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	var child fuse.FsNode
+	switch name {
+	case "HEAD":
+		child = &headNode{gitNode: gitNode{fs: n.fs}}
+	case "branches":
+		child = &refsNode{gitNode: gitNode{fs: n.fs}, prefix: "refs/heads/"}
+	case "tags":
+		child = &refsNode{gitNode: gitNode{fs: n.fs}, prefix: "refs/tags/"}
+	case "commits":
+		child = &commitsNode{gitNode: gitNode{fs: n.fs}}
+	default:
+		return nil, fuse.ENOENT
+	}
+	return add(n, name, child, out, context)
+}
+
+// headNode links to the current branch, or the commit if HEAD is
+// detached.
+type headNode struct {
+	gitNode
+}
+
+func (n *headNode) target() (string, fuse.Status) {
+	if branch, err := n.fs.repo.Head(); err == nil {
+		return "branches/" + branch, fuse.OK
+	}
+	sha, _, _, err := n.fs.repo.Stat("HEAD^{commit}")
+	if err != nil {
+		return "", n.fs.gitError("resolve", "HEAD", err)
+	}
+	return "commits/" + sha, fuse.OK
+}
+
+func (n *headNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	t, code := n.target()
+	if !code.Ok() {
+		return code
+	}
+	return n.attr(out, fuse.S_IFLNK|0777, uint64(len(t)))
+}
+
+func (n *headNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	t, code := n.target()
+	return []byte(t), code
+}
+
+// refsNode is a directory of refs.  Refs with a '/' in their name,
+// like feature/x, are in subdirectories.
+type refsNode struct {
+	gitNode
+	prefix string
+	// The number of directories between this one and the root.
+	depth int
+}
+
+func (n *refsNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	return n.attr(out, fuse.S_IFDIR|0555, 0)
+}
+
+func (n *refsNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	refs, err := n.fs.repo.Refs(n.prefix)
+	if err != nil {
+		return nil, n.fs.gitError("list", n.prefix, err)
+	}
+	seen := map[string]bool{}
+	var stream []fuse.DirEntry
+	for _, r := range refs {
+		mode := uint32(fuse.S_IFLNK)
+		if i := strings.Index(r, "/"); i >= 0 {
+			r = r[:i]
+			mode = fuse.S_IFDIR
+		}
+		if !seen[r] {
+			seen[r] = true
+			stream = append(stream, fuse.DirEntry{Name: r, Mode: mode})
+		}
+	}
+	return stream, fuse.OK
+}
+
+func (n *refsNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	refs, err := n.fs.repo.Refs(n.prefix)
+	if err != nil {
+		return nil, n.fs.gitError("list", n.prefix, err)
+	}
+	for _, r := range refs {
+		if r == name {
+			return add(n, name, &refNode{gitNode: gitNode{fs: n.fs}, ref: n.prefix + name, depth: n.depth}, out, context)
+		}
+		if strings.HasPrefix(r, name+"/") {
+			return add(n, name, &refsNode{gitNode: gitNode{fs: n.fs}, prefix: n.prefix + name + "/", depth: n.depth + 1}, out, context)
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// refNode links to the commit of a branch or tag.
+type refNode struct {
+	gitNode
+	ref   string
+	depth int
+}
+
+func (n *refNode) target() (string, fuse.Status) {
+	sha, _, _, err := n.fs.repo.Stat(n.ref + "^{commit}")
+	if err != nil {
+		return "", n.fs.gitError("resolve", n.ref, err)
+	}
+	return strings.Repeat("../", n.depth+1) + "commits/" + sha, fuse.OK
+}
+
+func (n *refNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	t, code := n.target()
+	if !code.Ok() {
+		return code
+	}
+	return n.attr(out, fuse.S_IFLNK|0777, uint64(len(t)))
+}
+
+func (n *refNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	t, code := n.target()
+	return []byte(t), code
+}
+
+// commitsNode has a directory for every commit.  Any abbreviation of
+// a commit's sha can be looked up.  Listing it runs git rev-list, so
+// it only shows commits reachable from refs.
+type commitsNode struct {
+	gitNode
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return len(s) >= 4
+}
+
+func (n *commitsNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	return n.attr(out, fuse.S_IFDIR|0555, 0)
+}
+
+func (n *commitsNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	if !isHex(name) {
+		return nil, fuse.ENOENT
+	}
+	mtime, err := n.fs.repo.CommitTime(name)
+	if err != nil {
+		return nil, n.fs.gitError("read commit", name, err)
+	}
+	sha, _, err := n.fs.repo.Tree(name)
+	if err != nil {
+		return nil, n.fs.gitError("read tree", name, err)
+	}
+	return add(n, name, &treeNode{gitNode: gitNode{fs: n.fs, mtime: mtime}, sha: sha}, out, context)
+}
+
+func (n *commitsNode) OpenDirStream(context *fuse.Context) (fuse.DirStream, fuse.Status) {
+	return &revListStream{repo: n.fs.repo}, fuse.OK
+}
+
+// revListStream lists the commits from git rev-list as it runs.  The
+// offset of a commit is its position in the output.
+type revListStream struct {
+	repo *Repo
+
+	lock sync.Mutex
+	cmd  *exec.Cmd
+	out  io.ReadCloser
+	r    *bufio.Reader
+	pos  uint64
+}
+
+func (s *revListStream) start() error {
+	s.Release()
+	s.cmd = s.repo.git("rev-list", "--all")
+	var err error
+	if s.out, err = s.cmd.StdoutPipe(); err != nil {
+		return err
+	}
+	if err := s.cmd.Start(); err != nil {
+		return err
+	}
+	s.r = bufio.NewReader(s.out)
+	s.pos = 0
+	return nil
+}
+
+func (s *revListStream) next() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	s.pos++
+	return strings.TrimSpace(line), nil
+}
+
+func (s *revListStream) ReadDir(offset uint64, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cmd == nil || offset < s.pos {
+		if err := s.start(); err != nil {
+			log.Printf("GitFs: rev-list: %v", err)
+			return nil, fuse.EIO
+		}
+	}
+	for s.pos < offset {
+		if _, err := s.next(); err != nil {
+			return nil, fuse.OK
+		}
+	}
+	var entries []fuse.DirEntry
+	for len(entries) < 128 {
+		sha, err := s.next()
+		if err != nil {
+			break
+		}
+		entries = append(entries, fuse.DirEntry{Name: sha, Mode: fuse.S_IFDIR, Off: s.pos})
+	}
+	return entries, fuse.OK
+}
+
+func (s *revListStream) Release() {
+	if s.cmd == nil {
+		return
+	}
+	s.out.Close()
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+	s.cmd = nil
+}
+
+// fileMode returns the mode for a git tree entry mode.
+func fileMode(mode uint32) uint32 {
+	switch mode {
+	case MODE_TREE, MODE_GITLINK:
+		return fuse.S_IFDIR | 0555
+	case MODE_EXEC:
+		return fuse.S_IFREG | 0555
+	case MODE_SYMLINK:
+		return fuse.S_IFLNK | 0777
+	}
+	return fuse.S_IFREG | 0444
+}
+
+// treeNode is a directory in a commit.  Submodules are empty
+// directories, with no sha.
+type treeNode struct {
+	gitNode
+	sha string
+}
+
+func (n *treeNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	return n.attr(out, fuse.S_IFDIR|0555, 0)
+}
+
+func (n *treeNode) entries() ([]TreeEntry, fuse.Status) {
+	if n.sha == "" {
+		return nil, fuse.OK
+	}
+	_, entries, err := n.fs.repo.Tree(n.sha)
+	if err != nil {
+		return nil, n.fs.gitError("read tree", n.sha, err)
+	}
+	return entries, fuse.OK
+}
+
+func (n *treeNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, code := n.entries()
+	if !code.Ok() {
+		return nil, code
+	}
+	stream := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		stream = append(stream, fuse.DirEntry{Name: e.Name, Mode: fileMode(e.Mode) &^ 07777})
+	}
+	return stream, fuse.OK
+}
+
+func (n *treeNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	entries, code := n.entries()
+	if !code.Ok() {
+		return nil, code
+	}
+	for _, e := range entries {
+		if e.Name != name {
+			continue
+		}
+		base := gitNode{fs: n.fs, mtime: n.mtime}
+		var child fuse.FsNode
+		switch e.Mode {
+		case MODE_TREE:
+			child = &treeNode{gitNode: base, sha: e.Sha}
+		case MODE_GITLINK:
+			child = &treeNode{gitNode: base}
+		default:
+			child = &blobNode{gitNode: base, sha: e.Sha, mode: e.Mode, size: -1}
+		}
+		return add(n, name, child, out, context)
+	}
+	return nil, fuse.ENOENT
+}
+
+// blobNode is a file or symlink in a commit.
+type blobNode struct {
+	gitNode
+	sha  string
+	mode uint32
+
+	lock sync.Mutex
+	size int64
+}
+
+func (n *blobNode) getSize() (int64, fuse.Status) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.size < 0 {
+		_, _, size, err := n.fs.repo.Stat(n.sha)
+		if err != nil {
+			return 0, n.fs.gitError("stat", n.sha, err)
+		}
+		n.size = size
+	}
+	return n.size, fuse.OK
+}
+
+func (n *blobNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	size, code := n.getSize()
+	if !code.Ok() {
+		return code
+	}
+	n.attr(out, fileMode(n.mode), uint64(size))
+	out.Nlink = 1
+	return fuse.OK
+}
+
+func (n *blobNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	if n.mode != MODE_SYMLINK {
+		return nil, fuse.EINVAL
+	}
+	_, _, data, err := n.fs.repo.Object(n.sha)
+	if err != nil {
+		return nil, n.fs.gitError("read", n.sha, err)
+	}
+	return data, fuse.OK
+}
+
+func (n *blobNode) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	if n.mode == MODE_SYMLINK {
+		return nil, fuse.Status(syscall.ELOOP)
+	}
+	size, code := n.getSize()
+	if !code.Ok() {
+		return nil, code
+	}
+	if size <= streamSize {
+		_, _, data, err := n.fs.repo.Object(n.sha)
+		if err != nil {
+			return nil, n.fs.gitError("read", n.sha, err)
+		}
+		return fuse.NewDataFile(data), fuse.OK
+	}
+	return &blobFile{node: n, size: size}, fuse.OK
+}
+
+// blobFile streams a large blob from git cat-file.  Reading backwards
+// starts it again.
+type blobFile struct {
+	fuse.DefaultFile
+	node *blobNode
+	size int64
+
+	lock   sync.Mutex
+	reader *blobReader
+	pos    int64
+}
+
+func (f *blobFile) String() string {
+	return fmt.Sprintf("blobFile(%s)", f.node.sha)
+}
+
+func (f *blobFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	off := int64(input.Offset)
+	if off >= f.size {
+		return []byte{}, fuse.OK
+	}
+	if f.reader == nil || off < f.pos {
+		f.close()
+		r, err := f.node.fs.repo.openBlob(f.node.sha)
+		if err != nil {
+			return nil, f.node.fs.gitError("read", f.node.sha, err)
+		}
+		f.reader, f.pos = r, 0
+	}
+	if off > f.pos {
+		n, err := io.CopyN(ioutil.Discard, f.reader, off-f.pos)
+		f.pos += n
+		if err != nil {
+			return nil, f.node.fs.gitError("read", f.node.sha, err)
+		}
+	}
+	buf := bp.AllocBuffer(input.Size)
+	n, err := io.ReadFull(f.reader, buf)
+	f.pos += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, f.node.fs.gitError("read", f.node.sha, err)
+	}
+	return buf[:n], fuse.OK
+}
+
+func (f *blobFile) close() {
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+}
+
+func (f *blobFile) Release(input *fuse.ReleaseIn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.close()
+}
+
+func (f *blobFile) GetAttr(out *fuse.Attr) fuse.Status {
+	return f.node.GetAttr(out, f, nil)
+}
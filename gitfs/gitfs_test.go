@@ -0,0 +1,201 @@
+package gitfs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_AUTHOR_DATE=1000000000 +0000",
+		"GIT_COMMITTER_NAME=c", "GIT_COMMITTER_EMAIL=c@example.com", "GIT_COMMITTER_DATE=1000000000 +0000")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+var testBig = strings.Repeat("0123456789", 300)
+
+// setupRepo makes a repository with two commits on main, a branch
+// feature/x and an annotated tag v1 at the first one.  It returns the
+// git directory and the shas of the commits.
+func setupRepo(t *testing.T) (dir string, first string, second string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "go-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, data string, mode os.FileMode) {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(t, dir, "init", "-q", "-b", "main")
+	write("README", "hello", 0644)
+	write("dir/sub.txt", "sub", 0644)
+	write("run.sh", "#!/bin/sh\n", 0755)
+	write("big", testBig, 0644)
+	os.Symlink("README", filepath.Join(dir, "link"))
+	git(t, dir, "add", ".")
+	git(t, dir, "commit", "-q", "-m", "first")
+	first = git(t, dir, "rev-parse", "HEAD")
+	git(t, dir, "tag", "-a", "-m", "tag", "v1")
+	git(t, dir, "branch", "feature/x")
+	write("README", "hello2", 0644)
+	git(t, dir, "commit", "-q", "-a", "-m", "second")
+	second = git(t, dir, "rev-parse", "HEAD")
+	return dir, first, second
+}
+
+func TestGitFs(t *testing.T) {
+	dir, first, second := setupRepo(t)
+	defer os.RemoveAll(dir)
+
+	repo, err := OpenRepo(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatalf("OpenRepo: %v", err)
+	}
+	defer repo.Close()
+	fs := NewGitFs(repo)
+	fuse.NewFileSystemConnector(fs, nil)
+
+	names := func(n fuse.FsNode) string {
+		stream, code := n.OpenDir(nil)
+		if !code.Ok() {
+			t.Fatalf("OpenDir: %v", code)
+		}
+		var l []string
+		for _, e := range stream {
+			l = append(l, e.Name)
+		}
+		sort.Strings(l)
+		return strings.Join(l, " ")
+	}
+	lookup := func(p string) (fuse.FsNode, *fuse.Attr) {
+		var n fuse.FsNode = fs.Root()
+		var a fuse.Attr
+		for _, c := range strings.Split(p, "/") {
+			var code fuse.Status
+			if n, code = n.Lookup(&a, c, nil); !code.Ok() {
+				t.Fatalf("Lookup(%q): %v", p, code)
+			}
+		}
+		return n, &a
+	}
+	readlink := func(p string) string {
+		n, _ := lookup(p)
+		target, code := n.Readlink(nil)
+		if !code.Ok() {
+			t.Fatalf("Readlink(%q): %v", p, code)
+		}
+		return string(target)
+	}
+	read := func(f fuse.File, off uint64, size uint32) string {
+		data, code := f.Read(&fuse.ReadIn{Offset: off, Size: size}, fuse.NewGcBufferPool())
+		if !code.Ok() {
+			t.Fatalf("Read: %v", code)
+		}
+		return string(data)
+	}
+	open := func(p string) fuse.File {
+		n, _ := lookup(p)
+		f, code := n.Open(0, nil)
+		if !code.Ok() {
+			t.Fatalf("Open(%q): %v", p, code)
+		}
+		return f
+	}
+
+	if got := names(fs.Root()); got != "HEAD branches commits tags" {
+		t.Errorf("root: got %q", got)
+	}
+	if got := readlink("HEAD"); got != "branches/main" {
+		t.Errorf("HEAD: got %q", got)
+	}
+	branches, _ := lookup("branches")
+	if got := names(branches); got != "feature main" {
+		t.Errorf("branches: got %q", got)
+	}
+	if got := readlink("branches/main"); got != "../commits/"+second {
+		t.Errorf("branches/main: got %q", got)
+	}
+	if got := readlink("branches/feature/x"); got != "../../commits/"+first {
+		t.Errorf("branches/feature/x: got %q", got)
+	}
+	if got := readlink("tags/v1"); got != "../commits/"+first {
+		t.Errorf("tags/v1: got %q", got)
+	}
+
+	if got := read(open("commits/"+second+"/README"), 0, 100); got != "hello2" {
+		t.Errorf("second README: got %q", got)
+	}
+	if got := read(open("commits/"+first[:8]+"/README"), 0, 100); got != "hello" {
+		t.Errorf("first README: got %q", got)
+	}
+	tree, a := lookup("commits/" + second)
+	if got := names(tree); got != "README big dir link run.sh" {
+		t.Errorf("tree: got %q", got)
+	}
+	if a.Mtime != 1000000000 {
+		t.Errorf("commit time: got %d", a.Mtime)
+	}
+	if got := read(open("commits/"+second+"/dir/sub.txt"), 0, 100); got != "sub" {
+		t.Errorf("dir/sub.txt: got %q", got)
+	}
+	if _, a := lookup("commits/" + second + "/run.sh"); a.Mode != fuse.S_IFREG|0555 || a.Size != 10 {
+		t.Errorf("run.sh: got %v", a)
+	}
+	if got := readlink("commits/" + second + "/link"); got != "README" {
+		t.Errorf("link: got %q", got)
+	}
+
+	// Large blobs are streamed, also when reading backwards.
+	streamSize = 1000
+	defer func() { streamSize = 1 << 20 }()
+	big := open("commits/" + second + "/big")
+	if _, ok := big.(*blobFile); !ok {
+		t.Errorf("big was not streamed: %v", big)
+	}
+	for _, off := range []int{0, 2000, 500, 2990} {
+		if got := read(big, uint64(off), 100); got != testBig[off:off+len(got)] || len(got) == 0 {
+			t.Errorf("big at %d: got %q", off, got)
+		}
+	}
+	big.Release(&fuse.ReleaseIn{})
+
+	commits, _ := lookup("commits")
+	stream, code := commits.OpenDirStream(nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDirStream: %v", code)
+	}
+	defer stream.Release()
+	entries, _ := stream.ReadDir(0, nil)
+	if len(entries) != 2 || entries[0].Name+entries[1].Name != first+second && entries[0].Name+entries[1].Name != second+first {
+		t.Fatalf("commits: got %v", entries)
+	}
+	rest, _ := stream.ReadDir(entries[0].Off, nil)
+	if len(rest) != 1 || rest[0] != entries[1] {
+		t.Errorf("commits from %d: got %v", entries[0].Off, rest)
+	}
+
+	treeSha := git(t, dir, "rev-parse", "HEAD^{tree}")
+	for _, name := range []string{"zzzz", treeSha, "0000000000"} {
+		if _, code := commits.Lookup(&fuse.Attr{}, name, nil); code != fuse.ENOENT {
+			t.Errorf("Lookup(%q): got %v", name, code)
+		}
+	}
+}
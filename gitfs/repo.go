@@ -0,0 +1,271 @@
+package gitfs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNotFound = errors.New("gitfs: object not found")
+
+// The number of parsed trees kept in memory.
+const cacheTrees = 1024
+
+// Git file modes, from tree entries.
+const (
+	MODE_TREE    = 040000
+	MODE_FILE    = 0100644
+	MODE_EXEC    = 0100755
+	MODE_SYMLINK = 0120000
+	MODE_GITLINK = 0160000
+)
+
+type TreeEntry struct {
+	Name string
+	Mode uint32
+	Sha  string
+}
+
+// catFile is a running git cat-file --batch or --batch-check, which
+// answers one object name per line.
+type catFile struct {
+	lock sync.Mutex
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  *bufio.Reader
+}
+
+func (r *Repo) startCatFile(mode string) (*catFile, error) {
+	c := &catFile{cmd: r.git("cat-file", mode)}
+	var err error
+	if c.in, err = c.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.out = bufio.NewReader(stdout)
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// query asks about name, and returns the header fields: the sha, the
+// type and the size.  The caller must hold the lock.
+func (c *catFile) query(name string) (sha string, typ string, size int64, err error) {
+	if strings.ContainsAny(name, "\n") {
+		return "", "", 0, errNotFound
+	}
+	if _, err = fmt.Fprintf(c.in, "%s\n", name); err != nil {
+		return "", "", 0, err
+	}
+	line, err := c.out.ReadString('\n')
+	if err != nil {
+		return "", "", 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 2 && (fields[1] == "missing" || fields[1] == "ambiguous") {
+		return "", "", 0, errNotFound
+	}
+	if len(fields) != 3 {
+		return "", "", 0, fmt.Errorf("gitfs: cat-file: bad header %q", line)
+	}
+	size, err = strconv.ParseInt(fields[2], 10, 64)
+	return fields[0], fields[1], size, err
+}
+
+func (c *catFile) close() {
+	c.in.Close()
+	c.cmd.Wait()
+}
+
+// Repo reads objects from a git repository, with the git command.
+// Only SHA-1 repositories are supported.
+type Repo struct {
+	dir string
+
+	batch *catFile
+	check *catFile
+
+	cacheLock sync.Mutex
+	trees     map[string][]TreeEntry
+}
+
+// OpenRepo opens the repository whose git directory is dir, which is
+// the repository itself if it is bare.
+func OpenRepo(dir string) (*Repo, error) {
+	r := &Repo{dir: dir, trees: map[string][]TreeEntry{}}
+	if out, err := r.git("rev-parse", "--git-dir").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("gitfs: %s: %s", dir, bytes.TrimSpace(out))
+	}
+	var err error
+	if r.batch, err = r.startCatFile("--batch"); err != nil {
+		return nil, err
+	}
+	if r.check, err = r.startCatFile("--batch-check"); err != nil {
+		r.batch.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Repo) Close() {
+	r.batch.close()
+	r.check.close()
+}
+
+func (r *Repo) git(args ...string) *exec.Cmd {
+	return exec.Command("git", append([]string{"--git-dir=" + r.dir}, args...)...)
+}
+
+// Stat returns the sha, type and size of the object called name,
+// which may be anything git rev-parse understands.
+func (r *Repo) Stat(name string) (sha string, typ string, size int64, err error) {
+	r.check.lock.Lock()
+	defer r.check.lock.Unlock()
+	return r.check.query(name)
+}
+
+// Object returns the sha, type and contents of an object.
+func (r *Repo) Object(name string) (sha string, typ string, data []byte, err error) {
+	c := r.batch
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	sha, typ, size, err := c.query(name)
+	if err != nil {
+		return "", "", nil, err
+	}
+	data = make([]byte, size+1)
+	if _, err := io.ReadFull(c.out, data); err != nil {
+		return "", "", nil, err
+	}
+	return sha, typ, data[:size], nil
+}
+
+// Tree returns the entries of the tree called name, which may also
+// name a commit or tag.
+func (r *Repo) Tree(name string) (sha string, entries []TreeEntry, err error) {
+	r.cacheLock.Lock()
+	entries, ok := r.trees[name]
+	r.cacheLock.Unlock()
+	if ok {
+		return name, entries, nil
+	}
+
+	sha, typ, data, err := r.Object(name + "^{tree}")
+	if err != nil {
+		return "", nil, err
+	}
+	if typ != "tree" {
+		return "", nil, fmt.Errorf("gitfs: %s is a %s", name, typ)
+	}
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || nul+21 > len(data) {
+			return "", nil, fmt.Errorf("gitfs: tree %s is corrupt", sha)
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("gitfs: tree %s: %v", sha, err)
+		}
+		entries = append(entries, TreeEntry{
+			Name: string(data[sp+1 : nul]),
+			Mode: uint32(mode),
+			Sha:  fmt.Sprintf("%x", data[nul+1:nul+21]),
+		})
+		data = data[nul+21:]
+	}
+
+	r.cacheLock.Lock()
+	if len(r.trees) >= cacheTrees {
+		r.trees = map[string][]TreeEntry{}
+	}
+	r.trees[sha] = entries
+	r.cacheLock.Unlock()
+	return sha, entries, nil
+}
+
+// CommitTime returns when the commit called name was made.
+func (r *Repo) CommitTime(name string) (time.Time, error) {
+	_, _, data, err := r.Object(name + "^{commit}")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		if !strings.HasPrefix(line, "committer ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			break
+		}
+		secs, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("gitfs: commit %s has no committer", name)
+}
+
+// Refs returns the names of the refs below prefix, such as
+// "refs/heads/", with the prefix removed.
+func (r *Repo) Refs(prefix string) ([]string, error) {
+	out, err := r.git("for-each-ref", "--format=%(refname)", prefix).Output()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(l, prefix) {
+			names = append(names, l[len(prefix):])
+		}
+	}
+	return names, nil
+}
+
+// Head returns the branch HEAD is on, without the refs/heads/ prefix.
+func (r *Repo) Head() (string, error) {
+	out, err := r.git("symbolic-ref", "-q", "HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(out)), "refs/heads/"), nil
+}
+
+// blobReader streams the contents of a blob.
+type blobReader struct {
+	cmd *exec.Cmd
+	io.ReadCloser
+}
+
+func (r *Repo) openBlob(sha string) (*blobReader, error) {
+	b := &blobReader{cmd: r.git("cat-file", "blob", sha)}
+	var err error
+	if b.ReadCloser, err = b.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := b.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *blobReader) Close() error {
+	b.ReadCloser.Close()
+	b.cmd.Process.Kill()
+	return b.cmd.Wait()
+}
@@ -0,0 +1,137 @@
+package httpfs
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type cacheItem struct {
+	key  string
+	size int64
+	// The data, if it is kept in memory.
+	data []byte
+}
+
+// blockCache keeps fetched blocks, in files in a directory or in
+// memory.  The least recently used blocks are dropped when the
+// blocks take more than max bytes.
+type blockCache struct {
+	dir string
+	max int64
+
+	lock  sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	used  int64
+}
+
+func newBlockCache(dir string, max int64) (*blockCache, error) {
+	c := &blockCache{
+		dir:   dir,
+		max:   max,
+		lru:   list.New(),
+		items: map[string]*list.Element{},
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Blocks of earlier mounts are used again, oldest first out.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != ".blk" {
+			continue
+		}
+		c.add(&cacheItem{key: fi.Name(), size: fi.Size()})
+	}
+	c.evict()
+	return c, nil
+}
+
+// blockKey names block n of a file.  The size and time are part of
+// it, so blocks of a file that changed are not used.
+func blockKey(url string, size int64, mtime int64, n int64) string {
+	h := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d", url, size, mtime, n)))
+	return fmt.Sprintf("%x.blk", h)
+}
+
+// add puts it at the back of the lru list.  Call with the lock held.
+func (c *blockCache) add(it *cacheItem) {
+	c.items[it.key] = c.lru.PushBack(it)
+	c.used += it.size
+}
+
+func (c *blockCache) remove(e *list.Element) {
+	it := c.lru.Remove(e).(*cacheItem)
+	delete(c.items, it.key)
+	c.used -= it.size
+	if c.dir != "" {
+		os.Remove(filepath.Join(c.dir, it.key))
+	}
+}
+
+func (c *blockCache) evict() {
+	for c.used > c.max && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *blockCache) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e := c.items[key]
+	if e == nil {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	it := e.Value.(*cacheItem)
+	if c.dir == "" {
+		return it.data, true
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		c.remove(e)
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *blockCache) put(key string, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.items[key] != nil {
+		return
+	}
+	it := &cacheItem{key: key, size: int64(len(data))}
+	if c.dir == "" {
+		it.data = data
+	} else {
+		// Write and rename, so other mounts never see a partial
+		// block.
+		tmp := filepath.Join(c.dir, key+".tmp")
+		if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+			return
+		}
+		if err := os.Rename(tmp, filepath.Join(c.dir, key)); err != nil {
+			os.Remove(tmp)
+			return
+		}
+	}
+	c.items[key] = c.lru.PushFront(it)
+	c.used += it.size
+	c.evict()
+}
@@ -0,0 +1,447 @@
+// Package httpfs serves a tree of files published over HTTP(S)
+// read-only, so large datasets can be mounted without downloading
+// them.  Files are read in blocks with Range requests, and the blocks
+// are cached locally.
+package httpfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var _ = (fuse.NodeFileSystem)((*HttpFs)(nil))
+
+type HttpFsOptions struct {
+	// Client makes the requests.  The default is
+	// http.DefaultClient.
+	Client *http.Client
+
+	// Files are fetched and cached in blocks of BlockSize bytes.
+	// The default is 1 MiB.
+	BlockSize int
+
+	// If set, blocks are cached in files in CacheDir, which are
+	// used again by later mounts.  Otherwise they are kept in
+	// memory.
+	CacheDir string
+
+	// CacheSize is the number of bytes of blocks kept.  The
+	// default is 256 MiB.
+	CacheSize int64
+}
+
+// entry is a file or directory of the tree.
+type entry struct {
+	url   *url.URL
+	mode  uint32
+	link  string
+	size  int64
+	mtime time.Time
+
+	// For files found in an index page: whether size and mtime
+	// were fetched.
+	statted bool
+	// For directories, the entries by name, or nil if the index
+	// page was not read yet.
+	children map[string]*entry
+}
+
+func (e *entry) isDir() bool {
+	return e.mode == syscall.S_IFDIR
+}
+
+// HttpFs is a NodeFileSystem for files below a base URL.  The tree is
+// either given by a manifest, or found by reading the directory index
+// pages that most web servers generate.
+type HttpFs struct {
+	fuse.DefaultNodeFileSystem
+	options HttpFsOptions
+	cache   *blockCache
+	root    *entry
+	node    *httpNode
+
+	// Protects the entries.
+	lock sync.Mutex
+}
+
+// NewHttpFs serves the files below base.  If manifest is nil, index
+// pages are read instead.
+func NewHttpFs(base string, manifest []ManifestEntry, opts *HttpFsOptions) (*HttpFs, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	fs := &HttpFs{}
+	if opts != nil {
+		fs.options = *opts
+	}
+	if fs.options.Client == nil {
+		fs.options.Client = http.DefaultClient
+	}
+	if fs.options.BlockSize <= 0 {
+		fs.options.BlockSize = 1 << 20
+	}
+	if fs.options.CacheSize <= 0 {
+		fs.options.CacheSize = 256 << 20
+	}
+	if fs.cache, err = newBlockCache(fs.options.CacheDir, fs.options.CacheSize); err != nil {
+		return nil, err
+	}
+
+	fs.root = &entry{url: u, mode: syscall.S_IFDIR, statted: true}
+	fs.node = &httpNode{fs: fs, entry: fs.root}
+	if manifest != nil {
+		fs.root.children = map[string]*entry{}
+		for _, m := range manifest {
+			if err := fs.addManifestEntry(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fs, nil
+}
+
+func (fs *HttpFs) addManifestEntry(m ManifestEntry) error {
+	p := strings.Trim(path.Clean("/"+m.Path), "/")
+	if p == "" {
+		return nil
+	}
+	isDir := strings.HasSuffix(m.Path, "/")
+	comps := strings.Split(p, "/")
+	dir := fs.root
+	for i, c := range comps {
+		last := i == len(comps)-1
+		e := dir.children[c]
+		if e == nil {
+			u, err := dir.url.Parse((&url.URL{Path: c}).String())
+			if err != nil {
+				return err
+			}
+			e = &entry{url: u, mode: syscall.S_IFDIR, statted: true}
+			if !last || isDir {
+				e.url.Path += "/"
+				e.children = map[string]*entry{}
+			}
+			dir.children[c] = e
+		}
+		if !last {
+			if !e.isDir() {
+				return fmt.Errorf("httpfs: %s: %s is not a directory", m.Path, c)
+			}
+			dir = e
+			continue
+		}
+		e.mtime = time.Unix(m.Mtime, 0)
+		if isDir {
+			break
+		}
+		e.mode = syscall.S_IFREG
+		e.size = m.Size
+		if m.Link != "" {
+			e.mode = syscall.S_IFLNK
+			e.link = m.Link
+			e.size = int64(len(m.Link))
+		}
+		if m.URL != "" {
+			u, err := fs.root.url.Parse(m.URL)
+			if err != nil {
+				return err
+			}
+			e.url = u
+		}
+	}
+	return nil
+}
+
+func (fs *HttpFs) String() string {
+	return fmt.Sprintf("HttpFs(%s)", fs.root.url)
+}
+
+func (fs *HttpFs) Root() fuse.FsNode {
+	return fs.node
+}
+
+func (fs *HttpFs) httpError(op string, u *url.URL, err error) fuse.Status {
+	log.Printf("HttpFs: %s %s: %v", op, u, err)
+	return fuse.EIO
+}
+
+func statusError(resp *http.Response) fuse.Status {
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return fuse.ENOENT
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fuse.EACCES
+	}
+	log.Printf("HttpFs: %s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+	return fuse.EIO
+}
+
+// readDir reads the index page of directory e, if needed.
+func (fs *HttpFs) readDir(e *entry) fuse.Status {
+	fs.lock.Lock()
+	loaded := e.children != nil
+	fs.lock.Unlock()
+	if loaded {
+		return fuse.OK
+	}
+
+	resp, err := fs.options.Client.Get(e.url.String())
+	if err != nil {
+		return fs.httpError("GET", e.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	page, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fs.httpError("GET", e.url, err)
+	}
+	children := map[string]*entry{}
+	for _, l := range parseIndex(page, e.url) {
+		u, _ := e.url.Parse((&url.URL{Path: l.name}).String())
+		c := &entry{url: u, mode: syscall.S_IFREG}
+		if l.dir {
+			u.Path += "/"
+			c.mode = syscall.S_IFDIR
+			c.statted = true
+		}
+		children[l.name] = c
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if e.children == nil {
+		e.children = children
+	}
+	return fuse.OK
+}
+
+// stat fetches the size and time of a file found in an index page.
+func (fs *HttpFs) stat(e *entry) fuse.Status {
+	fs.lock.Lock()
+	statted := e.statted
+	fs.lock.Unlock()
+	if statted {
+		return fuse.OK
+	}
+
+	resp, err := fs.options.Client.Head(e.url.String())
+	if err != nil {
+		return fs.httpError("HEAD", e.url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	var mtime time.Time
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		mtime, _ = http.ParseTime(lm)
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	e.size = resp.ContentLength
+	if e.size < 0 {
+		e.size = 0
+	}
+	e.mtime = mtime
+	e.statted = true
+	return fuse.OK
+}
+
+// block returns block n of file e.
+func (fs *HttpFs) block(e *entry, n int64) ([]byte, fuse.Status) {
+	key := blockKey(e.url.String(), e.size, e.mtime.Unix(), n)
+	if data, ok := fs.cache.get(key); ok {
+		return data, fuse.OK
+	}
+
+	start := n * int64(fs.options.BlockSize)
+	end := start + int64(fs.options.BlockSize)
+	if end > e.size {
+		end = e.size
+	}
+	req, err := http.NewRequest("GET", e.url.String(), nil)
+	if err != nil {
+		return nil, fs.httpError("GET", e.url, err)
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end-1, 10))
+	resp, err := fs.options.Client.Do(req)
+	if err != nil {
+		return nil, fs.httpError("GET", e.url, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, start); err != nil {
+			return nil, fs.httpError("GET", e.url, err)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return []byte{}, fuse.OK
+	default:
+		return nil, statusError(resp)
+	}
+	data := make([]byte, end-start)
+	m, err := io.ReadFull(resp.Body, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fs.httpError("GET", e.url, err)
+	}
+	data = data[:m]
+	fs.cache.put(key, data)
+	return data, fuse.OK
+}
+
+// httpNode is a node for an entry.  Several nodes may share an entry,
+// since nodes are made again when the kernel forgets them.
+type httpNode struct {
+	fuse.DefaultFsNode
+	fs    *HttpFs
+	entry *entry
+}
+
+func (n *httpNode) Deletable() bool {
+	return true
+}
+
+func (n *httpNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	if code := n.fs.stat(n.entry); !code.Ok() {
+		return code
+	}
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	e := n.entry
+	out.Mode = e.mode | 0444
+	if e.isDir() || e.mode == syscall.S_IFLNK {
+		out.Mode |= 0111
+	}
+	out.Size = uint64(e.size)
+	out.Blocks = (out.Size + 511) / 512
+	out.SetTimes(&e.mtime, &e.mtime, &e.mtime)
+	return fuse.OK
+}
+
+func (n *httpNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	if !n.entry.isDir() {
+		return nil, fuse.ENOTDIR
+	}
+	if code := n.fs.readDir(n.entry); !code.Ok() {
+		return nil, code
+	}
+	n.fs.lock.Lock()
+	e := n.entry.children[name]
+	n.fs.lock.Unlock()
+	if e == nil {
+		return nil, fuse.ENOENT
+	}
+	child := &httpNode{fs: n.fs, entry: e}
+	if code := child.GetAttr(out, nil, context); !code.Ok() {
+		return nil, code
+	}
+	n.Inode().AddChild(name, n.Inode().New(e.isDir(), child))
+	return child, fuse.OK
+}
+
+func (n *httpNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if !n.entry.isDir() {
+		return nil, fuse.ENOTDIR
+	}
+	if code := n.fs.readDir(n.entry); !code.Ok() {
+		return nil, code
+	}
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	stream := make([]fuse.DirEntry, 0, len(n.entry.children))
+	for name, e := range n.entry.children {
+		stream = append(stream, fuse.DirEntry{Name: name, Mode: e.mode})
+	}
+	return stream, fuse.OK
+}
+
+func (n *httpNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	if n.entry.mode != syscall.S_IFLNK {
+		return nil, fuse.EINVAL
+	}
+	return []byte(n.entry.link), fuse.OK
+}
+
+func (n *httpNode) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	if n.entry.mode != syscall.S_IFREG {
+		return nil, fuse.EINVAL
+	}
+	if code := n.fs.stat(n.entry); !code.Ok() {
+		return nil, code
+	}
+	return &httpFile{node: n}, fuse.OK
+}
+
+// httpFile is an open file, read block by block.
+type httpFile struct {
+	fuse.DefaultFile
+	node *httpNode
+}
+
+func (f *httpFile) String() string {
+	return fmt.Sprintf("httpFile(%s)", f.node.entry.url)
+}
+
+func (f *httpFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	fs := f.node.fs
+	e := f.node.entry
+	off := int64(input.Offset)
+	end := off + int64(input.Size)
+	if end > e.size {
+		end = e.size
+	}
+	if off >= end {
+		return []byte{}, fuse.OK
+	}
+
+	out := bp.AllocBuffer(uint32(end - off))[:0]
+	bs := int64(fs.options.BlockSize)
+	for n := off / bs; n*bs < end; n++ {
+		data, code := fs.block(e, n)
+		if !code.Ok() {
+			return nil, code
+		}
+		lo := off - n*bs
+		if lo < 0 {
+			lo = 0
+		}
+		hi := end - n*bs
+		if hi > int64(len(data)) {
+			hi = int64(len(data))
+		}
+		if lo >= hi {
+			// The file is shorter than we were told.
+			break
+		}
+		out = append(out, data[lo:hi]...)
+	}
+	return out, fuse.OK
+}
+
+func (f *httpFile) GetAttr(out *fuse.Attr) fuse.Status {
+	return f.node.GetAttr(out, f, nil)
+}
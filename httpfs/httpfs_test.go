@@ -0,0 +1,264 @@
+package httpfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const testBlockSize = 16
+
+var testBig = strings.Repeat("0123456789", 5)
+
+// testServer serves dir, counting the requests by method and range.
+type testServer struct {
+	*httptest.Server
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func newTestServer(t *testing.T) (*testServer, string) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "big"), []byte(testBig), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "with space"), []byte("spaced"), 0644)
+
+	s := &testServer{counts: map[string]int{}}
+	files := http.FileServer(http.Dir(dir))
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		k := r.Method
+		if r.Header.Get("Range") != "" {
+			k = "RANGE"
+		}
+		s.counts[k]++
+		s.lock.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	return s, dir
+}
+
+func (s *testServer) count(k string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[k]
+}
+
+func lookup(t *testing.T, root fuse.FsNode, p string) (fuse.FsNode, *fuse.Attr) {
+	n := root
+	var a fuse.Attr
+	for _, c := range strings.Split(p, "/") {
+		var code fuse.Status
+		n, code = n.Lookup(&a, c, nil)
+		if !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", p, code)
+		}
+	}
+	return n, &a
+}
+
+func read(t *testing.T, n fuse.FsNode, off uint64, size uint32) string {
+	f, code := n.Open(0, nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	data, code := f.Read(&fuse.ReadIn{Offset: off, Size: size}, fuse.NewGcBufferPool())
+	if !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	return string(data)
+}
+
+func names(t *testing.T, n fuse.FsNode) string {
+	stream, code := n.OpenDir(nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	var l []string
+	for _, e := range stream {
+		l = append(l, e.Name)
+	}
+	sort.Strings(l)
+	return strings.Join(l, " ")
+}
+
+func TestHttpFsIndex(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	fs, err := NewHttpFs(s.URL, nil, &HttpFsOptions{BlockSize: testBlockSize})
+	if err != nil {
+		t.Fatalf("NewHttpFs: %v", err)
+	}
+	fuse.NewFileSystemConnector(fs, nil)
+	root := fs.Root()
+
+	if got := names(t, root); got != "big sub" {
+		t.Errorf("root: got %q", got)
+	}
+	big, a := lookup(t, root, "big")
+	if !a.IsRegular() || a.Size != uint64(len(testBig)) {
+		t.Errorf("big: got %v", a)
+	}
+	if got := read(t, big, 0, 100); got != testBig {
+		t.Errorf("big: got %q", got)
+	}
+	if n := s.count("RANGE"); n != 4 {
+		t.Errorf("got %d range requests, want 4", n)
+	}
+	if got := read(t, big, 20, 10); got != testBig[20:30] {
+		t.Errorf("big at 20: got %q", got)
+	}
+	if n := s.count("RANGE"); n != 4 {
+		t.Errorf("cached blocks were fetched again: %d requests", n)
+	}
+
+	_, a = lookup(t, root, "sub")
+	if !a.IsDir() {
+		t.Errorf("sub: got mode %o", a.Mode)
+	}
+	spaced, _ := lookup(t, root, "sub/with space")
+	if got := read(t, spaced, 0, 100); got != "spaced" {
+		t.Errorf("sub/with space: got %q", got)
+	}
+	if _, code := root.Lookup(&fuse.Attr{}, "none", nil); code != fuse.ENOENT {
+		t.Errorf("Lookup(none): got %v", code)
+	}
+	if _, code := big.Open(fuse.O_ANYWRITE, nil); code != fuse.EPERM {
+		t.Errorf("Open for writing: got %v", code)
+	}
+}
+
+func TestHttpFsManifest(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	manifest, err := ReadManifest(strings.NewReader(`[
+		{"path": "data/big", "size": 50, "mtime": 1000},
+		{"path": "data/alias", "size": 6, "url": "sub/with%20space"},
+		{"path": "link", "link": "data/big"},
+		{"path": "empty/"}
+	]`))
+	if err != nil {
+		t.Fatalf("ReadManifest: %v", err)
+	}
+	cache, err := ioutil.TempDir("", "go-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+
+	// The server has no data/ directory.
+	manifest[0].URL = "big"
+	fs, err := NewHttpFs(s.URL, manifest, &HttpFsOptions{BlockSize: testBlockSize, CacheDir: cache})
+	if err != nil {
+		t.Fatalf("NewHttpFs: %v", err)
+	}
+	fuse.NewFileSystemConnector(fs, nil)
+	root := fs.Root()
+
+	if got := names(t, root); got != "data empty link" {
+		t.Errorf("root: got %q", got)
+	}
+	big, a := lookup(t, root, "data/big")
+	if a.Size != 50 || a.Mtime != 1000 {
+		t.Errorf("data/big: got %v", a)
+	}
+	if got := read(t, big, 5, 20); got != testBig[5:25] {
+		t.Errorf("data/big: got %q", got)
+	}
+	alias, _ := lookup(t, root, "data/alias")
+	if got := read(t, alias, 0, 100); got != "spaced" {
+		t.Errorf("data/alias: got %q", got)
+	}
+	link, a := lookup(t, root, "link")
+	if target, _ := link.Readlink(nil); !a.IsSymlink() || string(target) != "data/big" {
+		t.Errorf("link: got %q, mode %o", target, a.Mode)
+	}
+	if s.count("HEAD") != 0 || s.count("GET") != 0 {
+		t.Errorf("manifest entries were fetched: %v", s.counts)
+	}
+
+	// A later mount finds the blocks on disk.
+	fetched := s.count("RANGE")
+	fs, err = NewHttpFs(s.URL, manifest, &HttpFsOptions{BlockSize: testBlockSize, CacheDir: cache})
+	if err != nil {
+		t.Fatalf("NewHttpFs: %v", err)
+	}
+	fuse.NewFileSystemConnector(fs, nil)
+	big, _ = lookup(t, fs.Root(), "data/big")
+	if got := read(t, big, 5, 20); got != testBig[5:25] {
+		t.Errorf("data/big from cache: got %q", got)
+	}
+	if n := s.count("RANGE"); n != fetched {
+		t.Errorf("got %d new requests, want none", n-fetched)
+	}
+}
+
+func TestBlockCacheEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newBlockCache(dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.put("a.blk", []byte("0123456789"))
+	c.put("b.blk", []byte("0123456789"))
+	c.get("a.blk")
+	c.put("c.blk", []byte("0123456789"))
+	if _, ok := c.get("b.blk"); ok {
+		t.Errorf("least recently used block was kept")
+	}
+	for _, k := range []string{"a.blk", "c.blk"} {
+		if data, ok := c.get(k); !ok || string(data) != "0123456789" {
+			t.Errorf("%s: got %q, %v", k, data, ok)
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("got %d files, want 2", len(files))
+	}
+}
+
+func TestParseIndex(t *testing.T) {
+	page := `<html><body><h1>Index of /pub/</h1>
+<a href="?C=N;O=D">Name</a> <a href="/">Parent Directory</a>
+<a href="../">..</a>
+<a href="file%20one.txt">file one.txt</a>
+<A HREF='sub/'>sub/</A>
+<a href="/pub/abs.bin">abs.bin</a>
+<a href="http://other.example/pub/x">x</a>
+<a href="deeper/x">x</a>
+<a href="a&amp;b">a&amp;b</a>
+</body></html>`
+	dir, _ := url.Parse("http://example.com/pub/")
+	var got []string
+	for _, l := range parseIndex([]byte(page), dir) {
+		if l.dir {
+			l.name += "/"
+		}
+		got = append(got, l.name)
+	}
+	want := "file one.txt sub/ abs.bin a&b"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package httpfs
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ManifestEntry describes a file of a published tree.  Paths are
+// relative to the base URL, and those ending in '/' are directories.
+// Directories above a path need not be listed.
+type ManifestEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Modification time, in seconds since the epoch.
+	Mtime int64 `json:"mtime"`
+	// If set, the entry is a symlink to Link.
+	Link string `json:"link,omitempty"`
+	// If set, the data is fetched from URL, resolved against the
+	// base URL, instead of from Path.
+	URL string `json:"url,omitempty"`
+}
+
+// ReadManifest reads a manifest, which is a JSON array of entries.
+func ReadManifest(r io.Reader) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+var hrefRe = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']*)["']`)
+
+type indexLink struct {
+	name string
+	dir  bool
+}
+
+// parseIndex finds the entries of a directory index page, as served
+// by Apache, nginx or http.FileServer, whose URL is dir.  Links are
+// entries if they point right below dir; links ending in '/' are
+// directories.
+func parseIndex(page []byte, dir *url.URL) []indexLink {
+	seen := map[string]bool{}
+	var links []indexLink
+	for _, m := range hrefRe.FindAllSubmatch(page, -1) {
+		href := html.UnescapeString(string(m[1]))
+		if strings.HasPrefix(href, "?") || strings.HasPrefix(href, "#") {
+			continue
+		}
+		u, err := dir.Parse(href)
+		if err != nil || u.Scheme != dir.Scheme || u.Host != dir.Host || u.RawQuery != "" {
+			continue
+		}
+		if !strings.HasPrefix(u.Path, dir.Path) {
+			continue
+		}
+		rest := u.Path[len(dir.Path):]
+		isDir := strings.HasSuffix(rest, "/")
+		rest = strings.TrimSuffix(rest, "/")
+		if rest == "" || rest == "." || rest == ".." || strings.Contains(rest, "/") || seen[rest] {
+			continue
+		}
+		seen[rest] = true
+		links = append(links, indexLink{rest, isDir})
+	}
+	return links
+}
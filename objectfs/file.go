@@ -0,0 +1,160 @@
+package objectfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// objectReader reads an object with ranged GETs.  Sequential reads
+// fetch ReadAhead bytes at a time, and are served from the last
+// fetch while they fall inside it.
+type objectReader struct {
+	fuse.DefaultFile
+	fs   *ObjectFs
+	name string
+	size int64
+
+	lock   sync.Mutex
+	buf    []byte
+	bufOff int64
+	// Where the last read ended.
+	next int64
+}
+
+func newObjectReader(fs *ObjectFs, name string, size int64) *objectReader {
+	return &objectReader{fs: fs, name: name, size: size}
+}
+
+func (f *objectReader) String() string {
+	return fmt.Sprintf("objectReader(%s)", f.name)
+}
+
+func (f *objectReader) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	off := int64(input.Offset)
+	if off >= f.size {
+		return []byte{}, fuse.OK
+	}
+	end := off + int64(input.Size)
+	if end > f.size {
+		end = f.size
+	}
+	if off < f.bufOff || end > f.bufOff+int64(len(f.buf)) {
+		size := int(input.Size)
+		if off == f.next && size < f.fs.options.ReadAhead {
+			size = f.fs.options.ReadAhead
+		}
+		data, code := f.fs.get(f.name, off, size)
+		if !code.Ok() {
+			return nil, code
+		}
+		f.buf, f.bufOff = data, off
+		if end > off+int64(len(data)) {
+			// The object is shorter than when it was opened.
+			end = off + int64(len(data))
+		}
+	}
+	f.next = end
+	return f.buf[off-f.bufOff : end-f.bufOff], fuse.OK
+}
+
+func (f *objectReader) GetAttr(out *fuse.Attr) fuse.Status {
+	a, code := f.fs.GetAttr(f.name, nil)
+	if !code.Ok() {
+		return code
+	}
+	*out = *a
+	return fuse.OK
+}
+
+// objectWriter is a file opened for writing.  Its contents are kept
+// in memory, and uploaded on Flush if they changed.
+type objectWriter struct {
+	fuse.DefaultFile
+	fs   *ObjectFs
+	name string
+
+	lock  sync.Mutex
+	data  []byte
+	dirty bool
+	mtime time.Time
+}
+
+func newObjectWriter(fs *ObjectFs, name string, data []byte, dirty bool) *objectWriter {
+	return &objectWriter{fs: fs, name: name, data: data, dirty: dirty, mtime: time.Now()}
+}
+
+func (f *objectWriter) String() string {
+	return fmt.Sprintf("objectWriter(%s, %d bytes)", f.name, len(f.data))
+}
+
+func (f *objectWriter) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	off := int64(input.Offset)
+	if off >= int64(len(f.data)) {
+		return []byte{}, fuse.OK
+	}
+	end := off + int64(input.Size)
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	return append([]byte{}, f.data[off:end]...), fuse.OK
+}
+
+func (f *objectWriter) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	end := int(input.Offset) + len(data)
+	if end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[input.Offset:], data)
+	f.dirty = true
+	f.mtime = time.Now()
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *objectWriter) Truncate(size uint64, context *fuse.Context) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if int(size) <= len(f.data) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, int(size)-len(f.data))...)
+	}
+	f.dirty = true
+	f.mtime = time.Now()
+	return fuse.OK
+}
+
+func (f *objectWriter) GetAttr(out *fuse.Attr) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(len(f.data))
+	out.Blocks = (out.Size + 511) / 512
+	out.SetTimes(&f.mtime, &f.mtime, &f.mtime)
+	return fuse.OK
+}
+
+func (f *objectWriter) Flush(input *fuse.FlushIn) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.dirty {
+		return fuse.OK
+	}
+	code := f.fs.upload(f.name, f.data)
+	if code.Ok() {
+		f.dirty = false
+	}
+	return code
+}
+
+func (f *objectWriter) Fsync(flags int) fuse.Status {
+	return f.Flush(nil)
+}
@@ -0,0 +1,609 @@
+// Package objectfs serves an object store, such as S3, as a file
+// system in the style of s3fs: keys are paths, and directories are
+// key prefixes.
+//
+// Object stores answer slowly, and some only eventually show what
+// was written.  ObjectFs caches what the store reports for
+// ObjectFsOptions.CacheTimeout, which should also be the kernel's
+// entry and attribute timeout; see FileSystemOptions.  When it finds
+// that an object changed, or when Refresh is called because it
+// changed elsewhere, it tells the kernel to drop its cached entries
+// and data.
+package objectfs
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+var _ = (fuse.FileSystem)((*ObjectFs)(nil))
+
+// Consistency says what an ObjectStore guarantees after a write.
+type Consistency int
+
+const (
+	// Reads and listings show every completed write and delete.
+	CONSISTENCY_STRONG = Consistency(iota)
+
+	// Reads and listings may show the previous state of a key for
+	// a while after it is written or deleted.  ObjectFs then trusts
+	// its own changes over the store for SettleTime, and retries
+	// reads of keys that should exist.
+	CONSISTENCY_EVENTUAL
+)
+
+type ObjectFsOptions struct {
+	// Files larger than PartSize are uploaded in parts of this
+	// size.  The default is 8 MiB.
+	PartSize int
+
+	// Sequential reads fetch at least ReadAhead bytes at a time.
+	// The default is 1 MiB.
+	ReadAhead int
+
+	// CacheTimeout is how long results of Head and List are used.
+	// Zero asks the store every time.
+	CacheTimeout time.Duration
+
+	Consistency Consistency
+
+	// For CONSISTENCY_EVENTUAL, SettleTime is how long this file
+	// system's own changes override what the store says.  The
+	// default is 30 seconds.
+	SettleTime time.Duration
+
+	// For CONSISTENCY_EVENTUAL, reads of objects that should exist
+	// are tried Retries more times, waiting RetryDelay, doubled
+	// each time, in between.  The defaults are 5 and 100ms.
+	Retries    int
+	RetryDelay time.Duration
+}
+
+// entry is what is known about a path.
+type entry struct {
+	dir     bool
+	missing bool
+	info    ObjectInfo
+}
+
+func (e *entry) attr() *fuse.Attr {
+	if e.dir {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0755}
+	}
+	a := &fuse.Attr{
+		Mode:   fuse.S_IFREG | 0644,
+		Size:   uint64(e.info.Size),
+		Blocks: uint64(e.info.Size+511) / 512,
+	}
+	a.SetTimes(&e.info.ModTime, &e.info.ModTime, &e.info.ModTime)
+	return a
+}
+
+type cachedEntry struct {
+	entry
+	expires time.Time
+}
+
+type cachedListing struct {
+	// The entries by name, with their mode.
+	entries map[string]uint32
+	expires time.Time
+}
+
+// change is a change made through this file system, which overrides
+// the store until it settles.
+type change struct {
+	entry
+	until time.Time
+}
+
+// ObjectFs is a path filesystem for an ObjectStore.  Files are
+// written to the store when they are flushed.  Attributes, other than
+// size and times, are not stored.
+type ObjectFs struct {
+	fuse.DefaultFileSystem
+
+	store   ObjectStore
+	options ObjectFsOptions
+	nodeFs  *fuse.PathNodeFs
+
+	lock     sync.Mutex
+	entries  map[string]*cachedEntry
+	listings map[string]*cachedListing
+	changes  map[string]*change
+}
+
+func NewObjectFs(store ObjectStore, opts *ObjectFsOptions) *ObjectFs {
+	fs := &ObjectFs{
+		store:    store,
+		entries:  map[string]*cachedEntry{},
+		listings: map[string]*cachedListing{},
+		changes:  map[string]*change{},
+	}
+	if opts != nil {
+		fs.options = *opts
+	}
+	if fs.options.PartSize <= 0 {
+		fs.options.PartSize = 8 << 20
+	}
+	if fs.options.ReadAhead <= 0 {
+		fs.options.ReadAhead = 1 << 20
+	}
+	if fs.options.SettleTime <= 0 {
+		fs.options.SettleTime = 30 * time.Second
+	}
+	if fs.options.Retries <= 0 {
+		fs.options.Retries = 5
+	}
+	if fs.options.RetryDelay <= 0 {
+		fs.options.RetryDelay = 100 * time.Millisecond
+	}
+	return fs
+}
+
+func (fs *ObjectFs) String() string {
+	return "ObjectFs"
+}
+
+func (fs *ObjectFs) OnMount(nodeFs *fuse.PathNodeFs) {
+	fs.nodeFs = nodeFs
+}
+
+// FileSystemOptions returns mount options whose kernel timeouts
+// match CacheTimeout, so the kernel does not keep entries longer than
+// ObjectFs itself.
+func (fs *ObjectFs) FileSystemOptions() *fuse.FileSystemOptions {
+	opts := fuse.NewFileSystemOptions()
+	opts.EntryTimeout = fs.options.CacheTimeout
+	opts.AttrTimeout = fs.options.CacheTimeout
+	opts.NegativeTimeout = fs.options.CacheTimeout
+	return opts
+}
+
+func parentDir(name string) string {
+	dir, _ := filepath.Split(name)
+	return strings.TrimSuffix(dir, "/")
+}
+
+func dirKey(name string) string {
+	if name == "" {
+		return ""
+	}
+	return name + "/"
+}
+
+func storeError(op string, name string, err error) fuse.Status {
+	if err == ErrNotFound {
+		return fuse.ENOENT
+	}
+	log.Printf("ObjectFs: %s %q: %v", op, name, err)
+	return fuse.EIO
+}
+
+// changed returns the unsettled change to name, if any.  Call with
+// the lock held.
+func (fs *ObjectFs) changed(name string) *change {
+	c := fs.changes[name]
+	if c != nil && time.Now().After(c.until) {
+		delete(fs.changes, name)
+		c = nil
+	}
+	return c
+}
+
+// record notes a change to name made through this file system.
+func (fs *ObjectFs) record(name string, e entry) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	now := time.Now()
+	fs.entries[name] = &cachedEntry{e, now.Add(fs.options.CacheTimeout)}
+	if l := fs.listings[parentDir(name)]; l != nil {
+		_, base := filepath.Split(name)
+		if e.missing {
+			delete(l.entries, base)
+		} else {
+			l.entries[base] = e.attr().Mode & syscall.S_IFMT
+		}
+	}
+	if fs.options.Consistency == CONSISTENCY_EVENTUAL {
+		fs.changes[name] = &change{e, now.Add(fs.options.SettleTime)}
+	}
+}
+
+// lookup finds out what name is.
+func (fs *ObjectFs) lookup(name string) (*entry, fuse.Status) {
+	if name == "" {
+		return &entry{dir: true}, fuse.OK
+	}
+	fs.lock.Lock()
+	if c := fs.changed(name); c != nil {
+		fs.lock.Unlock()
+		return &c.entry, fuse.OK
+	}
+	old := fs.entries[name]
+	fs.lock.Unlock()
+	if old != nil && time.Now().Before(old.expires) {
+		return &old.entry, fuse.OK
+	}
+
+	e := &entry{}
+	info, err := fs.store.Head(name)
+	if err == nil {
+		e.info = *info
+	} else if err != ErrNotFound {
+		return nil, storeError("Head", name, err)
+	} else {
+		objects, prefixes, err := fs.store.List(dirKey(name), "/")
+		if err != nil {
+			return nil, storeError("List", name, err)
+		}
+		e.dir = len(objects) > 0 || len(prefixes) > 0
+		e.missing = !e.dir
+	}
+
+	fs.lock.Lock()
+	fs.update(name, *e, time.Now())
+	fs.lock.Unlock()
+	return e, fuse.OK
+}
+
+// update caches e for name.  If the object changed, the kernel is told
+// to drop its data.  Call with the lock held.
+func (fs *ObjectFs) update(name string, e entry, now time.Time) {
+	old := fs.entries[name]
+	fs.entries[name] = &cachedEntry{e, now.Add(fs.options.CacheTimeout)}
+	if old != nil && !old.dir && !old.missing && old.info.ETag != e.info.ETag && fs.nodeFs != nil {
+		// Notifying the kernel from within a callback can block,
+		// so do it afterwards.
+		go fs.nodeFs.FileNotify(name, 0, 0)
+	}
+}
+
+// list returns the entries of the directory name.
+func (fs *ObjectFs) list(name string) (map[string]uint32, fuse.Status) {
+	fs.lock.Lock()
+	old := fs.listings[name]
+	if old != nil && time.Now().Before(old.expires) {
+		entries := fs.overlay(name, old.entries)
+		fs.lock.Unlock()
+		return entries, fuse.OK
+	}
+	fs.lock.Unlock()
+
+	objects, prefixes, err := fs.store.List(dirKey(name), "/")
+	if err != nil {
+		return nil, storeError("List", name, err)
+	}
+	entries := map[string]uint32{}
+	found := name == ""
+	now := time.Now()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, o := range objects {
+		base := strings.TrimPrefix(o.Key, dirKey(name))
+		found = true
+		if base == "" {
+			// The directory's own marker.
+			continue
+		}
+		entries[base] = syscall.S_IFREG
+		fs.update(o.Key, entry{info: o}, now)
+	}
+	for _, p := range prefixes {
+		base := strings.TrimSuffix(strings.TrimPrefix(p, dirKey(name)), "/")
+		entries[base] = syscall.S_IFDIR
+		found = true
+	}
+	if c := fs.changed(name); c != nil {
+		found = !c.missing
+	}
+	if !found {
+		return nil, fuse.ENOENT
+	}
+
+	if old != nil && fs.nodeFs != nil {
+		var gone []string
+		for n := range old.entries {
+			if _, ok := entries[n]; !ok {
+				gone = append(gone, n)
+			}
+		}
+		if len(gone) > 0 {
+			fs.nodeFs.EntryNotifyMany(name, gone)
+		}
+	}
+	fs.listings[name] = &cachedListing{entries, now.Add(fs.options.CacheTimeout)}
+	return fs.overlay(name, entries), fuse.OK
+}
+
+// overlay returns the entries of directory dir, with the unsettled
+// changes to it applied.  Call with the lock held.
+func (fs *ObjectFs) overlay(dir string, entries map[string]uint32) map[string]uint32 {
+	result := make(map[string]uint32, len(entries))
+	for n, m := range entries {
+		result[n] = m
+	}
+	for n := range fs.changes {
+		if parentDir(n) != dir {
+			continue
+		}
+		c := fs.changed(n)
+		if c == nil {
+			continue
+		}
+		_, base := filepath.Split(n)
+		if c.missing {
+			delete(result, base)
+		} else {
+			result[base] = c.attr().Mode & syscall.S_IFMT
+		}
+	}
+	return result
+}
+
+// get reads from an object that should exist.
+func (fs *ObjectFs) get(name string, off int64, size int) ([]byte, fuse.Status) {
+	delay := fs.options.RetryDelay
+	for i := 0; ; i++ {
+		data, err := fs.store.GetRange(name, off, size)
+		if err == nil {
+			return data, fuse.OK
+		}
+		if err != ErrNotFound || fs.options.Consistency != CONSISTENCY_EVENTUAL || i >= fs.options.Retries {
+			return nil, storeError("GetRange", name, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// upload stores data as name, in parts if it is large.
+func (fs *ObjectFs) upload(name string, data []byte) fuse.Status {
+	var info *ObjectInfo
+	var err error
+	if len(data) <= fs.options.PartSize {
+		info, err = fs.store.Put(name, data)
+	} else {
+		info, err = fs.uploadParts(name, data)
+	}
+	if err != nil {
+		return storeError("upload", name, err)
+	}
+	fs.record(name, entry{info: *info})
+	return fuse.OK
+}
+
+func (fs *ObjectFs) uploadParts(name string, data []byte) (*ObjectInfo, error) {
+	id, err := fs.store.CreateMultipartUpload(name)
+	if err != nil {
+		return nil, err
+	}
+	var etags []string
+	for off := 0; off < len(data); off += fs.options.PartSize {
+		end := off + fs.options.PartSize
+		if end > len(data) {
+			end = len(data)
+		}
+		tag, err := fs.store.UploadPart(name, id, len(etags)+1, data[off:end])
+		if err != nil {
+			fs.store.AbortMultipartUpload(name, id)
+			return nil, err
+		}
+		etags = append(etags, tag)
+	}
+	info, err := fs.store.CompleteMultipartUpload(name, id, etags)
+	if err != nil {
+		fs.store.AbortMultipartUpload(name, id)
+	}
+	return info, err
+}
+
+// Refresh forgets what is cached about name, and the listing of its
+// directory, and tells the kernel to do the same.  Call it when name
+// was changed by another client of the store.  The first failure to
+// notify the kernel is returned, other than ENOENT for entries it
+// does not know.
+func (fs *ObjectFs) Refresh(name string) fuse.Status {
+	fs.lock.Lock()
+	// Keep the old results, so changes are noticed when they are
+	// read again.
+	for _, n := range []string{name, parentDir(name)} {
+		if e := fs.entries[n]; e != nil {
+			e.expires = time.Time{}
+		}
+		if l := fs.listings[n]; l != nil {
+			l.expires = time.Time{}
+		}
+	}
+	delete(fs.changes, name)
+	fs.lock.Unlock()
+
+	if fs.nodeFs == nil {
+		return fuse.OK
+	}
+	code := fs.nodeFs.FileNotify(name, 0, 0)
+	if code == fuse.ENOENT {
+		code = fuse.OK
+	}
+	if name == "" {
+		return code
+	}
+	_, base := filepath.Split(name)
+	if c := fs.nodeFs.EntryNotify(parentDir(name), base); code.Ok() && c != fuse.ENOENT {
+		code = c
+	}
+	return code
+}
+
+func (fs *ObjectFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	e, code := fs.lookup(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if e.missing {
+		return nil, fuse.ENOENT
+	}
+	return e.attr(), fuse.OK
+}
+
+func (fs *ObjectFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, code := fs.list(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	stream := make([]fuse.DirEntry, 0, len(entries))
+	for n, mode := range entries {
+		stream = append(stream, fuse.DirEntry{Name: n, Mode: mode})
+	}
+	return stream, fuse.OK
+}
+
+func (fs *ObjectFs) Open(name string, flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	e, code := fs.lookup(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if e.missing {
+		return nil, fuse.ENOENT
+	}
+	if e.dir {
+		return nil, fuse.Status(syscall.EISDIR)
+	}
+	if flags&fuse.O_ANYWRITE == 0 {
+		return newObjectReader(fs, name, e.info.Size), fuse.OK
+	}
+	data := []byte{}
+	if flags&syscall.O_TRUNC == 0 && e.info.Size > 0 {
+		data, code = fs.get(name, 0, int(e.info.Size))
+		if !code.Ok() {
+			return nil, code
+		}
+	}
+	return newObjectWriter(fs, name, data, flags&syscall.O_TRUNC != 0), fuse.OK
+}
+
+func (fs *ObjectFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	// Store the empty object right away, so it is listed while it
+	// is being written.
+	if code := fs.upload(name, nil); !code.Ok() {
+		return nil, code
+	}
+	return newObjectWriter(fs, name, []byte{}, false), fuse.OK
+}
+
+func (fs *ObjectFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	e, code := fs.lookup(name)
+	if !code.Ok() {
+		return code
+	}
+	if e.missing {
+		return fuse.ENOENT
+	}
+	if e.info.Size == int64(size) {
+		return fuse.OK
+	}
+	data := []byte{}
+	if size > 0 {
+		data, code = fs.get(name, 0, int(size))
+		if !code.Ok() {
+			return code
+		}
+	}
+	if len(data) < int(size) {
+		data = append(data, make([]byte, int(size)-len(data))...)
+	}
+	return fs.upload(name, data)
+}
+
+// Utimens is accepted, so tools like touch work, but objects keep
+// the time they were written.
+func (fs *ObjectFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	_, code := fs.GetAttr(name, context)
+	return code
+}
+
+func (fs *ObjectFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if _, err := fs.store.Put(dirKey(name), nil); err != nil {
+		return storeError("Put", name, err)
+	}
+	fs.record(name, entry{dir: true})
+	fs.lock.Lock()
+	fs.listings[name] = &cachedListing{map[string]uint32{}, time.Now().Add(fs.options.CacheTimeout)}
+	fs.lock.Unlock()
+	return fuse.OK
+}
+
+func (fs *ObjectFs) Unlink(name string, context *fuse.Context) fuse.Status {
+	if err := fs.store.Delete(name); err != nil {
+		return storeError("Delete", name, err)
+	}
+	fs.record(name, entry{missing: true})
+	return fuse.OK
+}
+
+func (fs *ObjectFs) Rmdir(name string, context *fuse.Context) fuse.Status {
+	entries, code := fs.list(name)
+	if !code.Ok() {
+		return code
+	}
+	if len(entries) > 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	// Directories that only existed as a prefix have no marker.
+	if err := fs.store.Delete(dirKey(name)); err != nil && err != ErrNotFound {
+		return storeError("Delete", name, err)
+	}
+	fs.record(name, entry{missing: true})
+	fs.lock.Lock()
+	delete(fs.listings, name)
+	fs.lock.Unlock()
+	return fuse.OK
+}
+
+// Rename copies the object and deletes the old one.  Renaming a
+// directory would mean copying everything below it, so it fails with
+// EXDEV, which makes mv do that itself.
+func (fs *ObjectFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	e, code := fs.lookup(oldName)
+	if !code.Ok() {
+		return code
+	}
+	if e.missing {
+		return fuse.ENOENT
+	}
+	if e.dir {
+		return fuse.Status(syscall.EXDEV)
+	}
+	if err := fs.store.Copy(oldName, newName); err != nil {
+		return storeError("Copy", oldName, err)
+	}
+	if err := fs.store.Delete(oldName); err != nil {
+		return storeError("Delete", oldName, err)
+	}
+	info := e.info
+	info.Key = newName
+	fs.record(newName, entry{info: info})
+	fs.record(oldName, entry{missing: true})
+	return fuse.OK
+}
+
+func (fs *ObjectFs) StatFs(name string) *fuse.StatfsOut {
+	// Object stores have no fixed size.
+	return &fuse.StatfsOut{Kstatfs: raw.Kstatfs{
+		Blocks:  1 << 40,
+		Bfree:   1 << 40,
+		Bavail:  1 << 40,
+		Files:   1 << 40,
+		Ffree:   1 << 40,
+		Bsize:   4096,
+		Frsize:  4096,
+		NameLen: 1024,
+	}}
+}
@@ -0,0 +1,250 @@
+package objectfs
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// notifications records what would be sent to the kernel.
+type notifications struct {
+	lock   sync.Mutex
+	inodes int
+	entry  chan string
+}
+
+// setup serves fs without mounting it, recording notifications.
+func setup(fs *ObjectFs) *notifications {
+	n := &notifications{entry: make(chan string, 10)}
+	conn := fuse.NewFileSystemConnector(fuse.NewPathNodeFs(fs, nil), nil)
+	conn.Init(&fuse.RawFsInit{
+		InodeNotify: func(*raw.NotifyInvalInodeOut) fuse.Status {
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			n.inodes++
+			return fuse.OK
+		},
+		EntryNotify: func(parent uint64, name string) fuse.Status {
+			n.entry <- name
+			return fuse.OK
+		},
+	})
+	return n
+}
+
+func names(t *testing.T, fs *ObjectFs, dir string) string {
+	stream, code := fs.OpenDir(dir, nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDir(%q): %v", dir, code)
+	}
+	var l []string
+	for _, e := range stream {
+		l = append(l, e.Name)
+	}
+	sort.Strings(l)
+	return strings.Join(l, " ")
+}
+
+func write(t *testing.T, fs *ObjectFs, name string, data string) {
+	f, code := fs.Create(name, syscall.O_WRONLY, 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create(%q): %v", name, code)
+	}
+	if _, code := f.Write(&fuse.WriteIn{}, []byte(data)); !code.Ok() {
+		t.Fatalf("Write(%q): %v", name, code)
+	}
+	if code := f.Flush(&fuse.FlushIn{}); !code.Ok() {
+		t.Fatalf("Flush(%q): %v", name, code)
+	}
+	f.Release(&fuse.ReleaseIn{})
+}
+
+func read(t *testing.T, fs *ObjectFs, name string) string {
+	f, code := fs.Open(name, syscall.O_RDONLY, nil)
+	if !code.Ok() {
+		t.Fatalf("Open(%q): %v", name, code)
+	}
+	data, code := f.Read(&fuse.ReadIn{Size: 1 << 16}, fuse.NewGcBufferPool())
+	if !code.Ok() {
+		t.Fatalf("Read(%q): %v", name, code)
+	}
+	return string(data)
+}
+
+func TestObjectFs(t *testing.T) {
+	store := NewMemStore()
+	fs := NewObjectFs(store, &ObjectFsOptions{PartSize: 10, CacheTimeout: time.Hour})
+	setup(fs)
+
+	write(t, fs, "small", "hello")
+	if store.Count("CreateMultipartUpload") != 0 {
+		t.Errorf("small file was uploaded in parts")
+	}
+	big := strings.Repeat("0123456789", 3) + "x"
+	if code := fs.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	write(t, fs, "dir/big", big)
+	if got := store.Count("UploadPart"); got != 4 {
+		t.Errorf("got %d parts, want 4", got)
+	}
+	if got := read(t, fs, "dir/big"); got != big {
+		t.Errorf("dir/big: got %q", got)
+	}
+	if a, code := fs.GetAttr("dir/big", nil); !code.Ok() || a.Size != uint64(len(big)) {
+		t.Errorf("GetAttr: got %v, %v", a, code)
+	}
+	if got := names(t, fs, ""); got != "dir small" {
+		t.Errorf("root: got %q", got)
+	}
+
+	// Directories also exist as the prefix of a key.
+	store.Put("implicit/file", []byte("x"))
+	if a, code := fs.GetAttr("implicit", nil); !code.Ok() || !a.IsDir() {
+		t.Errorf("implicit: got %v, %v", a, code)
+	}
+
+	if code := fs.Rmdir("dir", nil); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir: got %v", code)
+	}
+	if code := fs.Rename("dir/big", "moved", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if code := fs.Rename("dir", "other", nil); code != fuse.Status(syscall.EXDEV) {
+		t.Errorf("Rename dir: got %v", code)
+	}
+	if code := fs.Rmdir("dir", nil); !code.Ok() {
+		t.Errorf("Rmdir: %v", code)
+	}
+	if got := read(t, fs, "moved"); got != big {
+		t.Errorf("moved: got %q", got)
+	}
+	if code := fs.Unlink("small", nil); !code.Ok() {
+		t.Errorf("Unlink: %v", code)
+	}
+	if _, code := fs.GetAttr("small", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr after Unlink: got %v", code)
+	}
+	if got := names(t, fs, ""); got != "moved" {
+		t.Errorf("cached root: got %q", got)
+	}
+	fs.Refresh("implicit")
+	if got := names(t, fs, ""); got != "implicit moved" {
+		t.Errorf("root: got %q", got)
+	}
+
+	f, code := fs.Open("moved", syscall.O_WRONLY, nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	f.Write(&fuse.WriteIn{Offset: 4}, []byte("abc"))
+	f.Flush(&fuse.FlushIn{})
+	if got := read(t, fs, "moved"); got != "0123abc789"+big[10:] {
+		t.Errorf("after Write: got %q", got)
+	}
+}
+
+func TestObjectFsReadAhead(t *testing.T) {
+	store := NewMemStore()
+	data := strings.Repeat("abcdefghij", 10)
+	store.Put("f", []byte(data))
+	fs := NewObjectFs(store, &ObjectFsOptions{ReadAhead: 64})
+	setup(fs)
+
+	f, code := fs.Open("f", syscall.O_RDONLY, nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	var got string
+	for off := 0; off < len(data); off += 10 {
+		b, code := f.Read(&fuse.ReadIn{Offset: uint64(off), Size: 10}, fuse.NewGcBufferPool())
+		if !code.Ok() {
+			t.Fatalf("Read: %v", code)
+		}
+		got += string(b)
+	}
+	if got != data {
+		t.Errorf("got %q", got)
+	}
+	if n := store.Count("GetRange"); n != 2 {
+		t.Errorf("sequential reads: got %d GETs, want 2", n)
+	}
+
+	// Random reads fetch only what is asked.
+	b, _ := f.Read(&fuse.ReadIn{Offset: 5, Size: 3}, fuse.NewGcBufferPool())
+	b, _ = f.Read(&fuse.ReadIn{Offset: 50, Size: 3}, fuse.NewGcBufferPool())
+	if string(b) != "abc" || store.Count("GetRange") != 4 {
+		t.Errorf("random read: got %q, %d GETs", b, store.Count("GetRange"))
+	}
+}
+
+func TestObjectFsEventual(t *testing.T) {
+	store := NewMemStore()
+	store.Put("old", []byte("old"))
+	store.Lag = 2
+	fs := NewObjectFs(store, &ObjectFsOptions{
+		Consistency: CONSISTENCY_EVENTUAL,
+		RetryDelay:  time.Millisecond,
+	})
+	setup(fs)
+
+	// The store does not show these yet, but we know better.
+	write(t, fs, "new", "new data")
+	if code := fs.Unlink("old", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if got := names(t, fs, ""); got != "new" {
+		t.Errorf("root: got %q", got)
+	}
+	if _, code := fs.GetAttr("old", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr(old): got %v", code)
+	}
+	if got := read(t, fs, "new"); got != "new data" {
+		t.Errorf("new: got %q", got)
+	}
+}
+
+func TestObjectFsRefresh(t *testing.T) {
+	store := NewMemStore()
+	store.Put("a", []byte("a"))
+	store.Put("b", []byte("b"))
+	fs := NewObjectFs(store, &ObjectFsOptions{CacheTimeout: time.Hour})
+	n := setup(fs)
+
+	if got := names(t, fs, ""); got != "a b" {
+		t.Fatalf("root: got %q", got)
+	}
+
+	// Changes by others are only seen after Refresh.
+	store.Delete("a")
+	store.Put("b", []byte("changed"))
+	if got := names(t, fs, ""); got != "a b" {
+		t.Errorf("cached root: got %q", got)
+	}
+	if code := fs.Refresh("b"); !code.Ok() {
+		t.Errorf("Refresh: %v", code)
+	}
+	if name := <-n.entry; name != "b" {
+		t.Errorf("Refresh notified %q", name)
+	}
+	if got := names(t, fs, ""); got != "b" {
+		t.Errorf("root: got %q", got)
+	}
+	select {
+	case name := <-n.entry:
+		if name != "a" {
+			t.Errorf("got notification for %q, want a", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no notification for removed entry")
+	}
+	if a, code := fs.GetAttr("b", nil); !code.Ok() || a.Size != uint64(len("changed")) {
+		t.Errorf("b: got %v, %v", a, code)
+	}
+}
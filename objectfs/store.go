@@ -0,0 +1,288 @@
+package objectfs
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by an ObjectStore for keys it does not
+// have.
+var ErrNotFound = errors.New("objectfs: key not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// ETag changes whenever the contents do.
+	ETag string
+}
+
+// ObjectStore is a flat namespace of keys, like S3.  Keys use '/'
+// to separate path components, and a key ending in '/' marks a
+// directory.  Implementations must be safe for concurrent use.
+type ObjectStore interface {
+	Head(key string) (*ObjectInfo, error)
+
+	// GetRange returns size bytes of the object starting at off,
+	// or fewer at its end.
+	GetRange(key string, off int64, size int) ([]byte, error)
+
+	Put(key string, data []byte) (*ObjectInfo, error)
+
+	// List returns the objects whose key starts with prefix.  Keys
+	// that have delimiter after the prefix are collapsed into
+	// prefixes, which include the delimiter.
+	List(prefix string, delimiter string) (objects []ObjectInfo, prefixes []string, err error)
+
+	Delete(key string) error
+	Copy(src string, dst string) error
+
+	// Multipart uploads store an object from parts, which are
+	// numbered from 1.  UploadPart returns the ETag of the part, and
+	// CompleteMultipartUpload takes the ETags of all parts in order.
+	CreateMultipartUpload(key string) (uploadId string, err error)
+	UploadPart(key string, uploadId string, part int, data []byte) (etag string, err error)
+	CompleteMultipartUpload(key string, uploadId string, etags []string) (*ObjectInfo, error)
+	AbortMultipartUpload(key string, uploadId string) error
+}
+
+type memObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+// staleKey is the state of a key that a MemStore still shows after it
+// was changed.
+type staleKey struct {
+	old  *memObject
+	left int
+}
+
+// MemStore is an ObjectStore in memory, for tests.
+type MemStore struct {
+	// Lag is the number of reads of a key, by Head, GetRange or
+	// List, that still see its previous state after it is written
+	// or deleted, to simulate an eventually consistent store.
+	Lag int
+
+	lock    sync.Mutex
+	objects map[string]*memObject
+	stale   map[string]*staleKey
+	uploads map[string]map[int][]byte
+	nextId  int
+	counts  map[string]int
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		objects: map[string]*memObject{},
+		stale:   map[string]*staleKey{},
+		uploads: map[string]map[int][]byte{},
+		counts:  map[string]int{},
+	}
+}
+
+// Count returns how often the method op, eg. "GetRange", was called.
+func (s *MemStore) Count(op string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[op]
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+// get returns the object for key as a reader sees it now.
+func (s *MemStore) get(key string) *memObject {
+	if st := s.stale[key]; st != nil {
+		st.left--
+		if st.left <= 0 {
+			delete(s.stale, key)
+		}
+		return st.old
+	}
+	return s.objects[key]
+}
+
+// set changes key, which readers see after Lag reads.
+func (s *MemStore) set(key string, o *memObject) {
+	if s.Lag > 0 {
+		if st := s.stale[key]; st != nil {
+			st.left = s.Lag
+		} else {
+			s.stale[key] = &staleKey{s.objects[key], s.Lag}
+		}
+	}
+	if o == nil {
+		delete(s.objects, key)
+	} else {
+		s.objects[key] = o
+	}
+}
+
+func (s *MemStore) store(key string, data []byte, tag string) *ObjectInfo {
+	o := &memObject{
+		data: data,
+		info: ObjectInfo{Key: key, Size: int64(len(data)), ModTime: time.Now(), ETag: tag},
+	}
+	s.set(key, o)
+	info := o.info
+	return &info
+}
+
+func (s *MemStore) Head(key string) (*ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["Head"]++
+	o := s.get(key)
+	if o == nil {
+		return nil, ErrNotFound
+	}
+	info := o.info
+	return &info, nil
+}
+
+func (s *MemStore) GetRange(key string, off int64, size int) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["GetRange"]++
+	o := s.get(key)
+	if o == nil {
+		return nil, ErrNotFound
+	}
+	if off >= int64(len(o.data)) {
+		return []byte{}, nil
+	}
+	end := off + int64(size)
+	if end > int64(len(o.data)) {
+		end = int64(len(o.data))
+	}
+	return append([]byte{}, o.data[off:end]...), nil
+}
+
+func (s *MemStore) Put(key string, data []byte) (*ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["Put"]++
+	data = append([]byte{}, data...)
+	return s.store(key, data, etag(data)), nil
+}
+
+func (s *MemStore) List(prefix string, delimiter string) (objects []ObjectInfo, prefixes []string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["List"]++
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	for k := range s.stale {
+		if s.objects[k] == nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		o := s.get(k)
+		if o == nil {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				p := k[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, p)
+				}
+				continue
+			}
+		}
+		objects = append(objects, o.info)
+	}
+	return objects, prefixes, nil
+}
+
+func (s *MemStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["Delete"]++
+	if s.objects[key] == nil {
+		return ErrNotFound
+	}
+	s.set(key, nil)
+	return nil
+}
+
+func (s *MemStore) Copy(src string, dst string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["Copy"]++
+	o := s.objects[src]
+	if o == nil {
+		return ErrNotFound
+	}
+	s.store(dst, o.data, o.info.ETag)
+	return nil
+}
+
+func (s *MemStore) CreateMultipartUpload(key string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["CreateMultipartUpload"]++
+	s.nextId++
+	id := fmt.Sprintf("%s#%d", key, s.nextId)
+	s.uploads[id] = map[int][]byte{}
+	return id, nil
+}
+
+func (s *MemStore) UploadPart(key string, uploadId string, part int, data []byte) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["UploadPart"]++
+	parts := s.uploads[uploadId]
+	if parts == nil {
+		return "", ErrNotFound
+	}
+	parts[part] = append([]byte{}, data...)
+	return etag(data), nil
+}
+
+func (s *MemStore) CompleteMultipartUpload(key string, uploadId string, etags []string) (*ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["CompleteMultipartUpload"]++
+	parts := s.uploads[uploadId]
+	if parts == nil {
+		return nil, ErrNotFound
+	}
+	var data []byte
+	for i, tag := range etags {
+		p, ok := parts[i+1]
+		if !ok || etag(p) != tag {
+			return nil, fmt.Errorf("objectfs: part %d of %s does not match", i+1, key)
+		}
+		data = append(data, p...)
+	}
+	delete(s.uploads, uploadId)
+	return s.store(key, data, fmt.Sprintf("%s-%d", etag(data), len(etags))), nil
+}
+
+func (s *MemStore) AbortMultipartUpload(key string, uploadId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts["AbortMultipartUpload"]++
+	delete(s.uploads, uploadId)
+	return nil
+}
@@ -24,6 +24,14 @@ func init() {
 		CAP_SPLICE_WRITE:   "SPLICE_WRITE",
 		CAP_SPLICE_MOVE:    "SPLICE_MOVE",
 		CAP_SPLICE_READ:    "SPLICE_READ",
+
+		CAP_NO_OPEN_SUPPORT:    "NO_OPEN_SUPPORT",
+		CAP_PARALLEL_DIROPS:    "PARALLEL_DIROPS",
+		CAP_HANDLE_KILLPRIV:    "HANDLE_KILLPRIV",
+		CAP_POSIX_ACL:          "POSIX_ACL",
+		CAP_CACHE_SYMLINKS:     "CACHE_SYMLINKS",
+		CAP_NO_OPENDIR_SUPPORT: "NO_OPENDIR_SUPPORT",
+		CAP_HANDLE_KILLPRIV_V2: "HANDLE_KILLPRIV_V2",
 	}
 	releaseFlagNames = map[int]string{
 		RELEASE_FLUSH: "FLUSH",
@@ -41,10 +49,10 @@ func init() {
 		os.O_TRUNC:         "TRUNC",
 
 		syscall.O_CLOEXEC:   "CLOEXEC",
-		syscall.O_DIRECT:    "DIRECT",
 		syscall.O_DIRECTORY: "DIRECTORY",
-		syscall.O_LARGEFILE: "LARGEFILE",
-		syscall.O_NOATIME:   "NOATIME",
+	}
+	for k, v := range sysOpenFlagNames {
+		OpenFlagNames[k] = v
 	}
 	FuseOpenFlagNames = map[int]string{
 		FOPEN_DIRECT_IO:   "DIRECT",
@@ -117,6 +125,9 @@ func (me *SetAttrIn) String() string {
 	if me.Valid&FATTR_MTIME != 0 {
 		s = append(s, fmt.Sprintf("fh %d", me.Fh))
 	}
+	if me.Valid&FATTR_KILL_SUIDGID != 0 {
+		s = append(s, "kill suidgid")
+	}
 	// TODO - FATTR_ATIME_NOW = (1 << 7), FATTR_MTIME_NOW = (1 << 8), FATTR_LOCKOWNER = (1 << 9)
 	return fmt.Sprintf("{%s}", strings.Join(s, ", "))
 }
@@ -134,6 +145,9 @@ func (me *ReleaseIn) String() string {
 }
 
 func (me *OpenIn) String() string {
+	if me.OpenFlags&OPEN_KILL_SUIDGID != 0 {
+		return fmt.Sprintf("{%s kill suidgid}", FlagString(OpenFlagNames, int(me.Flags), "O_RDONLY"))
+	}
 	return fmt.Sprintf("{%s}", FlagString(OpenFlagNames, int(me.Flags), "O_RDONLY"))
 }
 
@@ -202,18 +216,3 @@ func (me *Kstatfs) String() string {
 		me.Blocks, me.Bfree, me.Bavail, me.Files, me.Ffree,
 		me.Bsize, me.NameLen, me.Frsize)
 }
-
-func (a *Attr) String() string {
-	return fmt.Sprintf(
-		"{M0%o S=%d L=%d "+
-			"%d:%d "+
-			"%d*%d %d:%d "+
-			"A %d.%09d "+
-			"M %d.%09d "+
-			"C %d.%09d}",
-		a.Mode, a.Size, a.Nlink,
-		a.Uid, a.Gid,
-		a.Blocks, a.Blksize,
-		a.Rdev, a.Ino, a.Atime, a.Atimensec, a.Mtime, a.Mtimensec,
-		a.Ctime, a.Ctimensec)
-}
@@ -0,0 +1,24 @@
+package raw
+
+import (
+	"fmt"
+)
+
+// sysOpenFlagNames are the open flags that only Linux has.
+var sysOpenFlagNames = map[int]string{}
+
+func (a *Attr) String() string {
+	return fmt.Sprintf(
+		"{M0%o S=%d L=%d "+
+			"%d:%d "+
+			"%d %d:%d "+
+			"A %d.%09d "+
+			"M %d.%09d "+
+			"C %d.%09d "+
+			"B %d.%09d F0%o}",
+		a.Mode, a.Size, a.Nlink,
+		a.Uid, a.Gid,
+		a.Blocks,
+		a.Rdev, a.Ino, a.Atime, a.Atimensec, a.Mtime, a.Mtimensec,
+		a.Ctime, a.Ctimensec, a.Crtime, a.Crtimensec, a.Flags)
+}
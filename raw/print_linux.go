@@ -0,0 +1,28 @@
+package raw
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// sysOpenFlagNames are the open flags that only Linux has.
+var sysOpenFlagNames = map[int]string{
+	syscall.O_DIRECT:    "DIRECT",
+	syscall.O_LARGEFILE: "LARGEFILE",
+	syscall.O_NOATIME:   "NOATIME",
+}
+
+func (a *Attr) String() string {
+	return fmt.Sprintf(
+		"{M0%o S=%d L=%d "+
+			"%d:%d "+
+			"%d*%d %d:%d "+
+			"A %d.%09d "+
+			"M %d.%09d "+
+			"C %d.%09d}",
+		a.Mode, a.Size, a.Nlink,
+		a.Uid, a.Gid,
+		a.Blocks, a.Blksize,
+		a.Rdev, a.Ino, a.Atime, a.Atimensec, a.Mtime, a.Mtimensec,
+		a.Ctime, a.Ctimensec)
+}
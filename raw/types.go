@@ -3,7 +3,6 @@
 
 package raw
 
-
 type ForgetIn struct {
 	Nlookup uint64
 }
@@ -18,7 +17,6 @@ type BatchForgetIn struct {
 	Dummy uint32
 }
 
-
 type MkdirIn struct {
 	Mode  uint32
 	Umask uint32
@@ -31,7 +29,7 @@ type RenameIn struct {
 type LinkIn struct {
 	Oldnodeid uint64
 }
-	
+
 type MknodIn struct {
 	Mode    uint32
 	Rdev    uint32
@@ -55,25 +53,11 @@ const ( // SetAttrIn.Valid
 	FATTR_ATIME_NOW = (1 << 7)
 	FATTR_MTIME_NOW = (1 << 8)
 	FATTR_LOCKOWNER = (1 << 9)
-)
 
-type SetAttrIn struct {
-	Valid     uint32
-	Padding   uint32
-	Fh        uint64
-	Size      uint64
-	LockOwner uint64
-	Atime     uint64
-	Mtime     uint64
-	Unused2   uint64
-	Atimensec uint32
-	Mtimensec uint32
-	Unused3   uint32
-	Mode      uint32
-	Unused4   uint32
-	Owner
-	Unused5 uint32
-}
+	// Clear the setuid and setgid bits, with
+	// CAP_HANDLE_KILLPRIV_V2.
+	FATTR_KILL_SUIDGID = (1 << 11)
+)
 
 const (
 	// Mask for GetAttrIn.Flags. If set, GetAttrIn has a file handle set.
@@ -86,7 +70,6 @@ type GetAttrIn struct {
 	Fh    uint64
 }
 
-
 const RELEASE_FLUSH = (1 << 0)
 
 type ReleaseIn struct {
@@ -97,10 +80,17 @@ type ReleaseIn struct {
 }
 
 type OpenIn struct {
-	Flags  uint32
-	Unused uint32
+	Flags     uint32
+	OpenFlags uint32
 }
 
+// OpenIn.OpenFlags and CreateIn.OpenFlags
+const (
+	// Clear the setuid and setgid bits on O_TRUNC, with
+	// CAP_HANDLE_KILLPRIV_V2.
+	OPEN_KILL_SUIDGID = (1 << 0)
+)
+
 const (
 	// OpenOut.Flags
 	FOPEN_DIRECT_IO   = (1 << 0)
@@ -126,6 +116,14 @@ const (
 	CAP_SPLICE_WRITE   = (1 << 7)
 	CAP_SPLICE_MOVE    = (1 << 8)
 	CAP_SPLICE_READ    = (1 << 9)
+
+	CAP_NO_OPEN_SUPPORT    = (1 << 17)
+	CAP_PARALLEL_DIROPS    = (1 << 18)
+	CAP_HANDLE_KILLPRIV    = (1 << 19)
+	CAP_POSIX_ACL          = (1 << 20)
+	CAP_CACHE_SYMLINKS     = (1 << 23)
+	CAP_NO_OPENDIR_SUPPORT = (1 << 24)
+	CAP_HANDLE_KILLPRIV_V2 = (1 << 28)
 )
 
 type InitIn struct {
@@ -135,6 +133,8 @@ type InitIn struct {
 	Flags        uint32
 }
 
+// InitOut is the reply to INIT as of protocol 7.23.  Older kernels
+// take only the fields up to MaxWrite.
 type InitOut struct {
 	Major               uint32
 	Minor               uint32
@@ -143,8 +143,15 @@ type InitOut struct {
 	MaxBackground       uint16
 	CongestionThreshold uint16
 	MaxWrite            uint32
+	TimeGran            uint32
+	MaxPages            uint16
+	MapAlignment        uint16
+	Unused              [8]uint32
 }
 
+// The size of InitOut before protocol 7.23.
+const COMPAT_22_INIT_OUT_SIZE = 24
+
 type CuseInitIn struct {
 	Major  uint32
 	Minor  uint32
@@ -221,16 +228,6 @@ type WriteOut struct {
 	Padding uint32
 }
 
-type SetXAttrIn struct {
-	Size  uint32
-	Flags uint32
-}
-
-type GetXAttrIn struct {
-	Size    uint32
-	Padding uint32
-}
-
 type GetXAttrOut struct {
 	Size    uint32
 	Padding uint32
@@ -268,12 +265,31 @@ type AccessIn struct {
 	Padding uint32
 }
 
+// FsyncIn.FsyncFlags
+const (
+	FUSE_FSYNC_FDATASYNC = (1 << 0)
+)
+
 type FsyncIn struct {
 	Fh         uint64
 	FsyncFlags uint32
 	Padding    uint32
 }
 
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeIdOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
+type SyncFsIn struct {
+	Padding uint64
+}
+
 type OutHeader struct {
 	Length uint32
 	Status int32
@@ -281,13 +297,12 @@ type OutHeader struct {
 }
 
 type CreateIn struct {
-	Flags   uint32
-	Mode    uint32
-	Umask   uint32
-	Padding uint32
+	Flags     uint32
+	Mode      uint32
+	Umask     uint32
+	OpenFlags uint32
 }
 
-
 type NotifyInvalInodeOut struct {
 	Ino    uint64
 	Off    int64
@@ -314,24 +329,6 @@ type FlushIn struct {
 	LockOwner uint64
 }
 
-type Attr struct {
-	Ino       uint64
-	Size      uint64
-	Blocks    uint64
-	Atime     uint64
-	Mtime     uint64
-	Ctime     uint64
-	Atimensec uint32
-	Mtimensec uint32
-	Ctimensec uint32
-	Mode      uint32
-	Nlink     uint32
-	Owner
-	Rdev    uint32
-	Blksize uint32
-	Padding uint32
-}
-
 type EntryOut struct {
 	NodeId         uint64
 	Generation     uint64
@@ -368,7 +365,6 @@ type InHeader struct {
 	Padding uint32
 }
 
-
 type Kstatfs struct {
 	Blocks  uint64
 	Bfree   uint64
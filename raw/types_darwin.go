@@ -0,0 +1,70 @@
+package raw
+
+// The macFUSE kernel extension speaks protocol 7.19 with additions
+// for the BSD file attributes: creation and backup times, and
+// chflags(2) flags.
+
+const (
+	CAP_CASE_INSENSITIVE = (1 << 29)
+	CAP_VOL_RENAME       = (1 << 30)
+	CAP_XTIMES           = (1 << 31)
+)
+
+type SetAttrIn struct {
+	Valid     uint32
+	Padding   uint32
+	Fh        uint64
+	Size      uint64
+	LockOwner uint64
+	Atime     uint64
+	Mtime     uint64
+	Unused2   uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Unused3   uint32
+	Mode      uint32
+	Unused4   uint32
+	Owner
+	Unused5 uint32
+
+	Bkuptime     uint64
+	Chgtime      uint64
+	Crtime       uint64
+	Bkuptimensec uint32
+	Chgtimensec  uint32
+	Crtimensec   uint32
+	Flags        uint32
+}
+
+type SetXAttrIn struct {
+	Size     uint32
+	Flags    uint32
+	Position uint32
+	Padding  uint32
+}
+
+type GetXAttrIn struct {
+	Size     uint32
+	Padding  uint32
+	Position uint32
+	Padding2 uint32
+}
+
+type Attr struct {
+	Ino        uint64
+	Size       uint64
+	Blocks     uint64
+	Atime      uint64
+	Mtime      uint64
+	Ctime      uint64
+	Crtime     uint64
+	Atimensec  uint32
+	Mtimensec  uint32
+	Ctimensec  uint32
+	Crtimensec uint32
+	Mode       uint32
+	Nlink      uint32
+	Owner
+	Rdev  uint32
+	Flags uint32
+}
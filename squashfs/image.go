@@ -0,0 +1,685 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	MAGIC = 0x73717368
+
+	metadataSize = 8192
+
+	// Set in the size of a data block or fragment if it is
+	// stored uncompressed.
+	uncompressedData = 1 << 24
+	// Set in the header of a metadata block if it is stored
+	// uncompressed.
+	uncompressedMetadata = 1 << 15
+
+	noFragment = 0xFFFFFFFF
+	noXattr    = 0xFFFFFFFF
+	noTable    = 0xFFFFFFFFFFFFFFFF
+
+	// The number of decompressed blocks kept in memory.
+	cacheBlocks = 256
+)
+
+// Compressor IDs, from the superblock.
+const (
+	COMPRESSOR_GZIP = 1
+	COMPRESSOR_LZMA = 2
+	COMPRESSOR_LZO  = 3
+	COMPRESSOR_XZ   = 4
+	COMPRESSOR_LZ4  = 5
+	COMPRESSOR_ZSTD = 6
+)
+
+// Inode types.
+const (
+	dirType = iota + 1
+	fileType
+	symlinkType
+	blockDevType
+	charDevType
+	fifoType
+	socketType
+	extDirType
+	extFileType
+	extSymlinkType
+	extBlockDevType
+	extCharDevType
+	extFifoType
+	extSocketType
+)
+
+// Decompressor returns the uncompressed contents of a block.
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+var decompressors = map[uint16]Decompressor{
+	COMPRESSOR_GZIP: func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	},
+}
+
+var compressorNames = map[uint16]string{
+	COMPRESSOR_GZIP: "gzip",
+	COMPRESSOR_LZMA: "lzma",
+	COMPRESSOR_LZO:  "lzo",
+	COMPRESSOR_XZ:   "xz",
+	COMPRESSOR_LZ4:  "lz4",
+	COMPRESSOR_ZSTD: "zstd",
+}
+
+// RegisterDecompressor adds support for images that use the
+// compressor with the given ID.  Only gzip is built in; others, such
+// as COMPRESSOR_ZSTD, need a decoder from outside the standard
+// library.  It should be called before any images are opened.
+func RegisterDecompressor(id uint16, d Decompressor) {
+	decompressors[id] = d
+}
+
+type superblock struct {
+	Magic             uint32
+	InodeCount        uint32
+	ModTime           uint32
+	BlockSize         uint32
+	FragCount         uint32
+	Compressor        uint16
+	BlockLog          uint16
+	Flags             uint16
+	IdCount           uint16
+	VersionMajor      uint16
+	VersionMinor      uint16
+	RootInode         uint64
+	BytesUsed         uint64
+	IdTableStart      uint64
+	XattrIdTableStart uint64
+	InodeTableStart   uint64
+	DirTableStart     uint64
+	FragTableStart    uint64
+	ExportTableStart  uint64
+}
+
+type fragmentEntry struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+type xattrId struct {
+	Ref   uint64
+	Count uint32
+	Size  uint32
+}
+
+// Image is a squashfs image, version 4.0.
+type Image struct {
+	r          io.ReaderAt
+	super      superblock
+	decompress Decompressor
+
+	ids        []uint32
+	fragments  []fragmentEntry
+	xattrIds   []xattrId
+	xattrStart int64
+
+	cacheLock sync.Mutex
+	cache     map[int64]*cachedBlock
+}
+
+type cachedBlock struct {
+	data []byte
+	// The position of the next metadata block.
+	next int64
+}
+
+// NewImage reads the tables of the image in r.
+func NewImage(r io.ReaderAt) (*Image, error) {
+	img := &Image{
+		r:     r,
+		cache: map[int64]*cachedBlock{},
+	}
+	sb := &img.super
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, sb); err != nil {
+		return nil, err
+	}
+	if sb.Magic != MAGIC {
+		return nil, errors.New("squashfs: bad magic")
+	}
+	if sb.VersionMajor != 4 {
+		return nil, fmt.Errorf("squashfs: unsupported version %d.%d", sb.VersionMajor, sb.VersionMinor)
+	}
+	if img.decompress = decompressors[sb.Compressor]; img.decompress == nil {
+		name := compressorNames[sb.Compressor]
+		if name == "" {
+			name = "unknown"
+		}
+		return nil, fmt.Errorf("squashfs: no decompressor for compressor %d (%s); only gzip is built in, see RegisterDecompressor",
+			sb.Compressor, name)
+	}
+	if sb.BlockSize == 0 || sb.BlockSize > 1<<20 {
+		return nil, fmt.Errorf("squashfs: bad block size %d", sb.BlockSize)
+	}
+
+	img.ids = make([]uint32, sb.IdCount)
+	if err := img.readTable(int64(sb.IdTableStart), len(img.ids)*4, img.ids); err != nil {
+		return nil, fmt.Errorf("squashfs: id table: %v", err)
+	}
+	if sb.FragTableStart != noTable && sb.FragCount > 0 {
+		img.fragments = make([]fragmentEntry, sb.FragCount)
+		if err := img.readTable(int64(sb.FragTableStart), len(img.fragments)*16, img.fragments); err != nil {
+			return nil, fmt.Errorf("squashfs: fragment table: %v", err)
+		}
+	}
+	if sb.XattrIdTableStart != noTable {
+		if err := img.readXattrIds(); err != nil {
+			return nil, fmt.Errorf("squashfs: xattr table: %v", err)
+		}
+	}
+	return img, nil
+}
+
+// BlockSize returns the size of the data blocks.
+func (img *Image) BlockSize() uint32 {
+	return img.super.BlockSize
+}
+
+// readTable reads a table of size bytes into out.  The table is
+// stored in metadata blocks, whose positions are listed at start.
+func (img *Image) readTable(start int64, size int, out interface{}) error {
+	if size == 0 {
+		return nil
+	}
+	n := (size + metadataSize - 1) / metadataSize
+	locations := make([]uint64, n)
+	if err := binary.Read(io.NewSectionReader(img.r, start, int64(8*n)), binary.LittleEndian, locations); err != nil {
+		return err
+	}
+	var data []byte
+	for _, l := range locations {
+		block, err := img.metadataBlock(int64(l))
+		if err != nil {
+			return err
+		}
+		data = append(data, block.data...)
+	}
+	if len(data) < size {
+		return io.ErrUnexpectedEOF
+	}
+	return binary.Read(bytes.NewReader(data[:size]), binary.LittleEndian, out)
+}
+
+func (img *Image) readXattrIds() error {
+	var header struct {
+		TableStart uint64
+		Count      uint32
+		Unused     uint32
+	}
+	start := int64(img.super.XattrIdTableStart)
+	if err := binary.Read(io.NewSectionReader(img.r, start, 16), binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	img.xattrStart = int64(header.TableStart)
+	img.xattrIds = make([]xattrId, header.Count)
+	return img.readTable(start+16, len(img.xattrIds)*16, img.xattrIds)
+}
+
+func (img *Image) cached(pos int64) *cachedBlock {
+	img.cacheLock.Lock()
+	defer img.cacheLock.Unlock()
+	return img.cache[pos]
+}
+
+func (img *Image) store(pos int64, b *cachedBlock) {
+	img.cacheLock.Lock()
+	defer img.cacheLock.Unlock()
+	if len(img.cache) >= cacheBlocks {
+		for k := range img.cache {
+			delete(img.cache, k)
+			break
+		}
+	}
+	img.cache[pos] = b
+}
+
+// readBlock reads size bytes at pos, and decompresses them if needed.
+func (img *Image) readBlock(pos int64, size int, compressed bool, max int) ([]byte, error) {
+	raw := make([]byte, size)
+	if _, err := img.r.ReadAt(raw, pos); err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return raw, nil
+	}
+	r, err := img.decompress(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.LimitReader(r, int64(max)))
+}
+
+// metadataBlock returns the decompressed metadata block at pos.
+func (img *Image) metadataBlock(pos int64) (*cachedBlock, error) {
+	if b := img.cached(pos); b != nil {
+		return b, nil
+	}
+	var header [2]byte
+	if _, err := img.r.ReadAt(header[:], pos); err != nil {
+		return nil, err
+	}
+	h := binary.LittleEndian.Uint16(header[:])
+	size := int(h &^ uncompressedMetadata)
+	data, err := img.readBlock(pos+2, size, h&uncompressedMetadata == 0, metadataSize)
+	if err != nil {
+		return nil, err
+	}
+	b := &cachedBlock{data: data, next: pos + 2 + int64(size)}
+	img.store(pos, b)
+	return b, nil
+}
+
+// dataBlock returns the decompressed data block or fragment block at
+// pos, whose size is encoded as in the block lists of inodes.
+func (img *Image) dataBlock(pos int64, size uint32) ([]byte, error) {
+	if b := img.cached(pos); b != nil {
+		return b.data, nil
+	}
+	data, err := img.readBlock(pos, int(size&^uncompressedData), size&uncompressedData == 0, int(img.super.BlockSize))
+	if err != nil {
+		return nil, err
+	}
+	img.store(pos, &cachedBlock{data: data})
+	return data, nil
+}
+
+// metaReader reads a stream of metadata, across metadata blocks.
+type metaReader struct {
+	img  *Image
+	next int64
+	buf  []byte
+}
+
+// metaReaderAt starts reading the table at start, at the position
+// given by ref: the offset of the metadata block from the start of
+// the table in the upper bits, and the offset in the decompressed
+// block in the lower 16 bits.
+func (img *Image) metaReaderAt(start int64, ref uint64) (*metaReader, error) {
+	m := &metaReader{img: img, next: start + int64(ref>>16)}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	offset := int(ref & 0xFFFF)
+	if offset > len(m.buf) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	m.buf = m.buf[offset:]
+	return m, nil
+}
+
+func (m *metaReader) load() error {
+	b, err := m.img.metadataBlock(m.next)
+	if err != nil {
+		return err
+	}
+	m.buf = b.data
+	m.next = b.next
+	return nil
+}
+
+func (m *metaReader) Read(p []byte) (int, error) {
+	for len(m.buf) == 0 {
+		if err := m.load(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, m.buf)
+	m.buf = m.buf[n:]
+	return n, nil
+}
+
+func (m *metaReader) read(out interface{}) error {
+	return binary.Read(m, binary.LittleEndian, out)
+}
+
+// inode is the decoded form of all inode types.
+type inode struct {
+	Type   uint16
+	Perm   uint16
+	Uid    uint32
+	Gid    uint32
+	Mtime  uint32
+	Number uint32
+	Nlink  uint32
+	Size   uint64
+	Rdev   uint32
+	Xattr  uint32
+
+	// Directories: the position of the listing in the
+	// directory table.
+	dirBlock  uint32
+	dirOffset uint16
+
+	// Files.
+	blocksStart uint64
+	blockSizes  []uint32
+	fragment    uint32
+	fragOffset  uint32
+
+	// Symlinks.
+	target []byte
+}
+
+func (in *inode) isDir() bool {
+	return in.Type == dirType || in.Type == extDirType
+}
+
+// readInode reads the inode at ref in the inode table.
+func (img *Image) readInode(ref uint64) (*inode, error) {
+	m, err := img.metaReaderAt(int64(img.super.InodeTableStart), ref)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Type, Perm, UidIdx, GidIdx uint16
+		Mtime, Number              uint32
+	}
+	if err := m.read(&header); err != nil {
+		return nil, err
+	}
+	if int(header.UidIdx) >= len(img.ids) || int(header.GidIdx) >= len(img.ids) {
+		return nil, errors.New("squashfs: bad id index")
+	}
+	in := &inode{
+		Type:   header.Type,
+		Perm:   header.Perm,
+		Uid:    img.ids[header.UidIdx],
+		Gid:    img.ids[header.GidIdx],
+		Mtime:  header.Mtime,
+		Number: header.Number,
+		Xattr:  noXattr,
+	}
+
+	switch in.Type {
+	case dirType:
+		var d struct {
+			StartBlock uint32
+			Nlink      uint32
+			Size       uint16
+			Offset     uint16
+			Parent     uint32
+		}
+		err = m.read(&d)
+		in.dirBlock, in.Nlink, in.Size, in.dirOffset = d.StartBlock, d.Nlink, uint64(d.Size), d.Offset
+	case extDirType:
+		var d struct {
+			Nlink      uint32
+			Size       uint32
+			StartBlock uint32
+			Parent     uint32
+			IndexCount uint16
+			Offset     uint16
+			Xattr      uint32
+		}
+		err = m.read(&d)
+		in.Nlink, in.Size, in.dirBlock, in.dirOffset, in.Xattr = d.Nlink, uint64(d.Size), d.StartBlock, d.Offset, d.Xattr
+	case fileType:
+		var f struct {
+			BlocksStart uint32
+			Fragment    uint32
+			Offset      uint32
+			Size        uint32
+		}
+		err = m.read(&f)
+		in.blocksStart, in.fragment, in.fragOffset, in.Size = uint64(f.BlocksStart), f.Fragment, f.Offset, uint64(f.Size)
+		in.Nlink = 1
+	case extFileType:
+		var f struct {
+			BlocksStart uint64
+			Size        uint64
+			Sparse      uint64
+			Nlink       uint32
+			Fragment    uint32
+			Offset      uint32
+			Xattr       uint32
+		}
+		err = m.read(&f)
+		in.blocksStart, in.Size, in.Nlink, in.fragment, in.fragOffset, in.Xattr = f.BlocksStart, f.Size, f.Nlink, f.Fragment, f.Offset, f.Xattr
+	case symlinkType, extSymlinkType:
+		var s struct {
+			Nlink uint32
+			Size  uint32
+		}
+		if err = m.read(&s); err != nil {
+			break
+		}
+		if s.Size > 4096 {
+			return nil, errors.New("squashfs: symlink too long")
+		}
+		in.Nlink, in.Size = s.Nlink, uint64(s.Size)
+		in.target = make([]byte, s.Size)
+		if _, err = io.ReadFull(m, in.target); err == nil && in.Type == extSymlinkType {
+			err = m.read(&in.Xattr)
+		}
+	case blockDevType, charDevType, extBlockDevType, extCharDevType:
+		var d struct {
+			Nlink uint32
+			Rdev  uint32
+		}
+		if err = m.read(&d); err == nil && in.Type >= extBlockDevType {
+			err = m.read(&in.Xattr)
+		}
+		in.Nlink, in.Rdev = d.Nlink, d.Rdev
+	case fifoType, socketType, extFifoType, extSocketType:
+		if err = m.read(&in.Nlink); err == nil && in.Type >= extFifoType {
+			err = m.read(&in.Xattr)
+		}
+	default:
+		return nil, fmt.Errorf("squashfs: bad inode type %d", in.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if in.Type == fileType || in.Type == extFileType {
+		bs := uint64(img.super.BlockSize)
+		n := in.Size / bs
+		if in.fragment == noFragment && in.Size%bs != 0 {
+			n++
+		}
+		if n > 1<<30 {
+			return nil, errors.New("squashfs: file too large")
+		}
+		in.blockSizes = make([]uint32, n)
+		if err := m.read(in.blockSizes); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// dirEntry is an entry of a directory listing.
+type dirEntry struct {
+	Name string
+	Type uint16
+	// The inode reference, for readInode.
+	Ref uint64
+}
+
+// readDir reads the listing of directory in.
+func (img *Image) readDir(in *inode) ([]dirEntry, error) {
+	// The size includes 3 bytes for "." and "..".
+	if in.Size <= 3 {
+		return nil, nil
+	}
+	m, err := img.metaReaderAt(int64(img.super.DirTableStart), uint64(in.dirBlock)<<16|uint64(in.dirOffset))
+	if err != nil {
+		return nil, err
+	}
+	r := &io.LimitedReader{R: m, N: int64(in.Size) - 3}
+	var entries []dirEntry
+	for r.N > 0 {
+		var header struct {
+			Count, Start, Number uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+		if header.Count >= 256 {
+			return nil, errors.New("squashfs: bad directory header")
+		}
+		for i := uint32(0); i <= header.Count; i++ {
+			var e struct {
+				Offset      uint16
+				InodeOffset int16
+				Type        uint16
+				NameSize    uint16
+			}
+			if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+				return nil, err
+			}
+			name := make([]byte, int(e.NameSize)+1)
+			if _, err := io.ReadFull(r, name); err != nil {
+				return nil, err
+			}
+			entries = append(entries, dirEntry{
+				Name: string(name),
+				Type: e.Type,
+				Ref:  uint64(header.Start)<<16 | uint64(e.Offset),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// readFile reads the data of file in at off into dest.
+func (img *Image) readFile(in *inode, dest []byte, off int64) (int, error) {
+	if off >= int64(in.Size) {
+		return 0, nil
+	}
+	if rest := int64(in.Size) - off; int64(len(dest)) > rest {
+		dest = dest[:rest]
+	}
+	bs := int64(img.super.BlockSize)
+	n := 0
+	for n < len(dest) {
+		block, err := img.fileBlock(in, (off+int64(n))/bs)
+		if err != nil {
+			return n, err
+		}
+		start := int((off + int64(n)) % bs)
+		if start >= len(block) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(dest[n:], block[start:])
+	}
+	return n, nil
+}
+
+// fileBlock returns block i of file in.  The last one may be shorter
+// than the block size.
+func (img *Image) fileBlock(in *inode, i int64) ([]byte, error) {
+	bs := int64(img.super.BlockSize)
+	size := int64(in.Size) - i*bs
+	if size > bs {
+		size = bs
+	}
+	if i < int64(len(in.blockSizes)) {
+		if in.blockSizes[i] == 0 {
+			// A sparse block.
+			return make([]byte, size), nil
+		}
+		pos := int64(in.blocksStart)
+		for _, s := range in.blockSizes[:i] {
+			pos += int64(s &^ uncompressedData)
+		}
+		return img.dataBlock(pos, in.blockSizes[i])
+	}
+
+	if int(in.fragment) >= len(img.fragments) {
+		return nil, errors.New("squashfs: bad fragment index")
+	}
+	f := img.fragments[in.fragment]
+	data, err := img.dataBlock(int64(f.Start), f.Size)
+	if err != nil {
+		return nil, err
+	}
+	end := int64(in.fragOffset) + size
+	if end > int64(len(data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data[in.fragOffset:end], nil
+}
+
+var xattrPrefixes = []string{"user.", "trusted.", "security."}
+
+// readXattrs returns the extended attributes of in.
+func (img *Image) readXattrs(in *inode) (map[string][]byte, error) {
+	if in.Xattr == noXattr {
+		return nil, nil
+	}
+	if int(in.Xattr) >= len(img.xattrIds) {
+		return nil, errors.New("squashfs: bad xattr index")
+	}
+	id := img.xattrIds[in.Xattr]
+	m, err := img.metaReaderAt(img.xattrStart, id.Ref)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string][]byte{}
+	for i := uint32(0); i < id.Count; i++ {
+		var key struct {
+			Type, NameSize uint16
+		}
+		if err := m.read(&key); err != nil {
+			return nil, err
+		}
+		name := make([]byte, key.NameSize)
+		if _, err := io.ReadFull(m, name); err != nil {
+			return nil, err
+		}
+		value, err := readXattrValue(m)
+		if err != nil {
+			return nil, err
+		}
+		// Values stored out of line are referenced by
+		// position, to share them between inodes.
+		if key.Type&0x100 != 0 {
+			if len(value) != 8 {
+				return nil, errors.New("squashfs: bad xattr reference")
+			}
+			vm, err := img.metaReaderAt(img.xattrStart, binary.LittleEndian.Uint64(value))
+			if err != nil {
+				return nil, err
+			}
+			if value, err = readXattrValue(vm); err != nil {
+				return nil, err
+			}
+		}
+		prefix := int(key.Type & 0xFF)
+		if prefix >= len(xattrPrefixes) {
+			continue
+		}
+		attrs[xattrPrefixes[prefix]+string(name)] = value
+	}
+	return attrs, nil
+}
+
+func readXattrValue(m *metaReader) ([]byte, error) {
+	var size uint32
+	if err := m.read(&size); err != nil {
+		return nil, err
+	}
+	if size > 1<<16 {
+		return nil, errors.New("squashfs: xattr value too large")
+	}
+	value := make([]byte, size)
+	_, err := io.ReadFull(m, value)
+	return value, err
+}
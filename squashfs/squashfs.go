@@ -0,0 +1,217 @@
+// Package squashfs serves squashfs images read-only, without the
+// kernel's squashfs driver.
+//
+// Only gzip compressed images can be read out of the box, since the
+// standard library has no decoders for the other squashfs compressors
+// (lzma, lzo, xz, lz4 and zstd).  NewImage fails with an error naming
+// the compressor of such images, unless a decoder for it was added
+// with RegisterDecompressor.
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+var _ = (fuse.NodeFileSystem)((*SquashFs)(nil))
+
+// SquashFs is a NodeFileSystem for a squashfs image.  Inodes are read
+// from the image when they are looked up.
+type SquashFs struct {
+	fuse.DefaultNodeFileSystem
+	img  *Image
+	root *squashNode
+}
+
+// NewSquashFs opens the squashfs image in r.
+func NewSquashFs(r io.ReaderAt) (*SquashFs, error) {
+	img, err := NewImage(r)
+	if err != nil {
+		return nil, err
+	}
+	in, err := img.readInode(img.super.RootInode)
+	if err != nil {
+		return nil, fmt.Errorf("squashfs: root inode: %v", err)
+	}
+	if !in.isDir() {
+		return nil, fmt.Errorf("squashfs: root is not a directory")
+	}
+	fs := &SquashFs{img: img}
+	fs.root = &squashNode{fs: fs, inode: in}
+	return fs, nil
+}
+
+func (fs *SquashFs) String() string {
+	return "SquashFs"
+}
+
+func (fs *SquashFs) Root() fuse.FsNode {
+	return fs.root
+}
+
+// modes maps the inode types to file types.
+var modes = map[uint16]uint32{
+	dirType:         syscall.S_IFDIR,
+	fileType:        syscall.S_IFREG,
+	symlinkType:     syscall.S_IFLNK,
+	blockDevType:    syscall.S_IFBLK,
+	charDevType:     syscall.S_IFCHR,
+	fifoType:        syscall.S_IFIFO,
+	socketType:      syscall.S_IFSOCK,
+	extDirType:      syscall.S_IFDIR,
+	extFileType:     syscall.S_IFREG,
+	extSymlinkType:  syscall.S_IFLNK,
+	extBlockDevType: syscall.S_IFBLK,
+	extCharDevType:  syscall.S_IFCHR,
+	extFifoType:     syscall.S_IFIFO,
+	extSocketType:   syscall.S_IFSOCK,
+}
+
+type squashNode struct {
+	fuse.DefaultFsNode
+	fs    *SquashFs
+	inode *inode
+}
+
+func (n *squashNode) ioError(op string, err error) fuse.Status {
+	log.Printf("squashfs: %s of inode %d: %v", op, n.inode.Number, err)
+	return fuse.EIO
+}
+
+func (n *squashNode) Deletable() bool {
+	return true
+}
+
+func (n *squashNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	in := n.inode
+	out.Mode = modes[in.Type] | uint32(in.Perm)&07777
+	out.Size = in.Size
+	out.Blocks = (in.Size + 511) / 512
+	out.Nlink = in.Nlink
+	out.Uid = in.Uid
+	out.Gid = in.Gid
+	out.Rdev = in.Rdev
+	t := time.Unix(int64(in.Mtime), 0)
+	out.SetTimes(&t, &t, &t)
+	return fuse.OK
+}
+
+func (n *squashNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	if !n.inode.isDir() {
+		return nil, fuse.ENOTDIR
+	}
+	entries, err := n.fs.img.readDir(n.inode)
+	if err != nil {
+		return nil, n.ioError("readDir", err)
+	}
+	for _, e := range entries {
+		if e.Name != name {
+			continue
+		}
+		in, err := n.fs.img.readInode(e.Ref)
+		if err != nil {
+			return nil, n.ioError("readInode", err)
+		}
+		child := &squashNode{fs: n.fs, inode: in}
+		n.Inode().AddChild(name, n.Inode().New(in.isDir(), child))
+		child.GetAttr(out, nil, context)
+		return child, fuse.OK
+	}
+	return nil, fuse.ENOENT
+}
+
+func (n *squashNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if !n.inode.isDir() {
+		return nil, fuse.ENOTDIR
+	}
+	entries, err := n.fs.img.readDir(n.inode)
+	if err != nil {
+		return nil, n.ioError("readDir", err)
+	}
+	stream := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		stream = append(stream, fuse.DirEntry{Name: e.Name, Mode: modes[e.Type]})
+	}
+	return stream, fuse.OK
+}
+
+func (n *squashNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	if n.inode.target == nil {
+		return nil, fuse.EINVAL
+	}
+	return n.inode.target, fuse.OK
+}
+
+func (n *squashNode) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	if modes[n.inode.Type] != syscall.S_IFREG {
+		return nil, fuse.EINVAL
+	}
+	return &squashFile{node: n}, fuse.OK
+}
+
+func (n *squashNode) GetXAttr(attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	attrs, err := n.fs.img.readXattrs(n.inode)
+	if err != nil {
+		return nil, n.ioError("readXattrs", err)
+	}
+	v, ok := attrs[attribute]
+	if !ok {
+		return nil, fuse.ENODATA
+	}
+	return v, fuse.OK
+}
+
+func (n *squashNode) ListXAttr(context *fuse.Context) ([]string, fuse.Status) {
+	attrs, err := n.fs.img.readXattrs(n.inode)
+	if err != nil {
+		return nil, n.ioError("readXattrs", err)
+	}
+	names := make([]string, 0, len(attrs))
+	for k := range attrs {
+		names = append(names, k)
+	}
+	return names, fuse.OK
+}
+
+func (n *squashNode) StatFs() *fuse.StatfsOut {
+	sb := &n.fs.img.super
+	return &fuse.StatfsOut{Kstatfs: raw.Kstatfs{
+		Blocks:  (sb.BytesUsed + uint64(sb.BlockSize) - 1) / uint64(sb.BlockSize),
+		Files:   uint64(sb.InodeCount),
+		Bsize:   sb.BlockSize,
+		Frsize:  sb.BlockSize,
+		NameLen: 256,
+	}}
+}
+
+// squashFile is an open regular file.
+type squashFile struct {
+	fuse.DefaultFile
+	node *squashNode
+}
+
+func (f *squashFile) String() string {
+	return fmt.Sprintf("squashFile(inode %d)", f.node.inode.Number)
+}
+
+func (f *squashFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	slice := bp.AllocBuffer(input.Size)
+	n, err := f.node.fs.img.readFile(f.node.inode, slice, int64(input.Offset))
+	if err != nil {
+		return nil, f.node.ioError("read", err)
+	}
+	return slice[:n], fuse.OK
+}
+
+func (f *squashFile) GetAttr(out *fuse.Attr) fuse.Status {
+	return f.node.GetAttr(out, f, nil)
+}
@@ -0,0 +1,258 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const testBlockSize = 4096
+
+// imageBuilder writes a squashfs image piece by piece.
+type imageBuilder struct {
+	bytes.Buffer
+}
+
+func (b *imageBuilder) put(vals ...interface{}) {
+	for _, v := range vals {
+		binary.Write(b, binary.LittleEndian, v)
+	}
+}
+
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// metadata writes a single metadata block, and returns its position.
+func (b *imageBuilder) metadata(data []byte, compressed bool) uint64 {
+	pos := uint64(b.Len())
+	if compressed {
+		data = compress(data)
+		b.put(uint16(len(data)))
+	} else {
+		b.put(uint16(len(data)) | uncompressedMetadata)
+	}
+	b.Write(data)
+	return pos
+}
+
+// table writes a table in one metadata block, followed by its index,
+// and returns the position of the index.
+func (b *imageBuilder) table(data []byte) uint64 {
+	block := b.metadata(data, true)
+	pos := uint64(b.Len())
+	b.put(block)
+	return pos
+}
+
+func le(vals ...interface{}) []byte {
+	var b imageBuilder
+	b.put(vals...)
+	return b.Bytes()
+}
+
+type testDirEntry struct {
+	name   string
+	typ    uint16
+	number uint32
+	offset uint16
+}
+
+func listing(entries []testDirEntry) []byte {
+	var b imageBuilder
+	b.put(uint32(len(entries)-1), uint32(0), entries[0].number)
+	for _, e := range entries {
+		b.put(e.offset, int16(e.number-entries[0].number), e.typ, uint16(len(e.name)-1))
+		b.WriteString(e.name)
+	}
+	return b.Bytes()
+}
+
+// buildImage returns an image with
+//
+//	big     ext. file: a compressed block, a sparse block and a fragment, xattr user.color
+//	link -> small
+//	small   file in the fragment
+//	sub/inner  file of one uncompressed block
+func buildImage() (image []byte, big, inner []byte) {
+	var b imageBuilder
+	b.Write(make([]byte, 96))
+
+	big = make([]byte, 2*testBlockSize+1000)
+	for i := 0; i < testBlockSize; i++ {
+		big[i] = byte(i % 251)
+	}
+	for i := 2 * testBlockSize; i < len(big); i++ {
+		big[i] = 'T'
+	}
+	inner = bytes.Repeat([]byte("inner"), testBlockSize/5+1)[:testBlockSize]
+
+	bigStart := uint64(b.Len())
+	block0 := compress(big[:testBlockSize])
+	b.Write(block0)
+	fragStart := uint64(b.Len())
+	frag := compress(append(append([]byte{}, big[2*testBlockSize:]...), "hello small"...))
+	b.Write(frag)
+	innerStart := uint64(b.Len())
+	b.Write(inner)
+
+	// Inodes, in order: big, small, link, inner, sub, root.
+	// Directory inodes have a fixed size, so the offsets do not
+	// depend on the directory table.
+	header := func(typ uint16, number uint32) []byte {
+		return le(typ, uint16(0644), uint16(0), uint16(1), uint32(1234567890), number)
+	}
+	var inodes []byte
+	offsets := map[string]uint16{}
+	add := func(name string, data ...[]byte) {
+		offsets[name] = uint16(len(inodes))
+		for _, d := range data {
+			inodes = append(inodes, d...)
+		}
+	}
+	add("big", header(extFileType, 1), le(bigStart, uint64(len(big)), uint64(testBlockSize), uint32(1), uint32(0), uint32(0), uint32(0), uint32(len(block0)), uint32(0)))
+	add("small", header(fileType, 2), le(uint32(0), uint32(0), uint32(1000), uint32(len("hello small"))))
+	add("link", header(symlinkType, 3), le(uint32(1), uint32(len("small"))), []byte("small"))
+	add("inner", header(fileType, 4), le(uint32(innerStart), uint32(noFragment), uint32(0), uint32(testBlockSize), uint32(testBlockSize|uncompressedData)))
+
+	subListing := listing([]testDirEntry{{"inner", fileType, 4, offsets["inner"]}})
+	rootListing := listing([]testDirEntry{
+		{"big", fileType, 1, offsets["big"]},
+		{"link", symlinkType, 3, offsets["link"]},
+		{"small", fileType, 2, offsets["small"]},
+		{"sub", dirType, 5, uint16(len(inodes))},
+	})
+	add("sub", header(dirType, 5), le(uint32(0), uint32(2), uint16(len(subListing)+3), uint16(0), uint32(6)))
+	add("root", header(dirType, 6), le(uint32(0), uint32(3), uint16(len(rootListing)+3), uint16(len(subListing)), uint32(7)))
+
+	inodeTable := b.metadata(inodes, false)
+	dirTable := b.metadata(append(subListing, rootListing...), true)
+	fragTable := b.table(le(fragStart, uint32(len(frag)), uint32(0)))
+	idTable := b.table(le(uint32(1000), uint32(0)))
+
+	xattrTable := b.metadata(append(le(uint16(0), uint16(5)), append([]byte("color"), le(uint32(4), []byte("blue"))...)...), false)
+	xattrIds := b.metadata(le(uint64(0), uint32(1), uint32(17)), false)
+	xattrIdTable := uint64(b.Len())
+	b.put(xattrTable, uint32(1), uint32(0), xattrIds)
+
+	image = b.Bytes()
+	sb := superblock{
+		Magic:             MAGIC,
+		InodeCount:        6,
+		BlockSize:         testBlockSize,
+		FragCount:         1,
+		Compressor:        COMPRESSOR_GZIP,
+		BlockLog:          12,
+		IdCount:           2,
+		VersionMajor:      4,
+		RootInode:         uint64(offsets["root"]),
+		BytesUsed:         uint64(len(image)),
+		IdTableStart:      idTable,
+		XattrIdTableStart: xattrIdTable,
+		InodeTableStart:   inodeTable,
+		DirTableStart:     dirTable,
+		FragTableStart:    fragTable,
+		ExportTableStart:  noTable,
+	}
+	copy(image, le(sb))
+	return image, big, inner
+}
+
+func TestSquashFs(t *testing.T) {
+	image, big, inner := buildImage()
+	fs, err := NewSquashFs(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("NewSquashFs: %v", err)
+	}
+	fuse.NewFileSystemConnector(fs, nil)
+	root := fs.Root()
+
+	entries, code := root.OpenDir(nil)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); !code.Ok() || got != "big link small sub" {
+		t.Errorf("OpenDir: got %q, %v", got, code)
+	}
+
+	lookup := func(dir fuse.FsNode, name string) (fuse.FsNode, *fuse.Attr) {
+		var a fuse.Attr
+		n, code := dir.Lookup(&a, name, nil)
+		if !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		return n, &a
+	}
+	read := func(n fuse.FsNode, off uint64, size uint32) string {
+		f, code := n.Open(0, nil)
+		if !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+		data, code := f.Read(&fuse.ReadIn{Offset: off, Size: size}, fuse.NewGcBufferPool())
+		if !code.Ok() {
+			t.Fatalf("Read: %v", code)
+		}
+		return string(data)
+	}
+
+	bigNode, a := lookup(root, "big")
+	if a.Size != uint64(len(big)) || a.Uid != 1000 || a.Gid != 0 || !a.IsRegular() || a.Mode&07777 != 0644 {
+		t.Errorf("big: got attr %v", a)
+	}
+	for _, r := range [][2]int{{0, len(big)}, {100, 10}, {testBlockSize - 5, 10}, {2*testBlockSize - 5, 10}, {len(big) - 5, 100}} {
+		want := string(big[r[0]:])
+		if r[0]+r[1] < len(big) {
+			want = string(big[r[0] : r[0]+r[1]])
+		}
+		if got := read(bigNode, uint64(r[0]), uint32(r[1])); got != want {
+			t.Errorf("read big at %d: got %d bytes, want %d", r[0], len(got), len(want))
+		}
+	}
+	if v, code := bigNode.GetXAttr("user.color", nil); !code.Ok() || string(v) != "blue" {
+		t.Errorf("GetXAttr: got %q, %v", v, code)
+	}
+	if _, code := bigNode.GetXAttr("user.none", nil); code != fuse.ENODATA {
+		t.Errorf("GetXAttr missing: got %v", code)
+	}
+
+	small, _ := lookup(root, "small")
+	if got := read(small, 0, 100); got != "hello small" {
+		t.Errorf("small: got %q", got)
+	}
+	link, a := lookup(root, "link")
+	if target, code := link.Readlink(nil); !a.IsSymlink() || string(target) != "small" {
+		t.Errorf("link: got %q, %v, mode %o", target, code, a.Mode)
+	}
+	sub, a := lookup(root, "sub")
+	if !a.IsDir() {
+		t.Errorf("sub: got mode %o", a.Mode)
+	}
+	in, _ := lookup(sub, "inner")
+	if got := read(in, 0, testBlockSize); got != string(inner) {
+		t.Errorf("inner: got %q", got)
+	}
+	if _, code := root.Lookup(&fuse.Attr{}, "none", nil); code != fuse.ENOENT {
+		t.Errorf("Lookup missing: got %v", code)
+	}
+}
+
+func TestUnsupportedCompressor(t *testing.T) {
+	image, _, _ := buildImage()
+	// The Compressor field of the superblock.
+	copy(image[20:], le(uint16(COMPRESSOR_ZSTD)))
+	_, err := NewImage(bytes.NewReader(image))
+	if err == nil || !strings.Contains(err.Error(), "compressor 6 (zstd)") {
+		t.Errorf("got error %v, want one naming zstd", err)
+	}
+}
@@ -0,0 +1,403 @@
+// Package synthfs builds read-mostly file systems whose files are
+// made by functions, like /proc, so a daemon can show its state and
+// take settings as files:
+//
+//	fs := synthfs.NewSynthFs(nil)
+//	fs.AddFile("status", synthfs.Text(func() string { return d.Status() }))
+//	fs.AddInt64("limits/connections", &d.maxConns)
+//	fuse.MountNodeFileSystem(dir, fs, nil)
+//
+// The contents of a file are made when it is opened, and again when
+// it is read from the start, so polling a file shows the current
+// state.  Files and directories can be added and removed while the
+// file system is mounted.
+package synthfs
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+var _ = (fuse.NodeFileSystem)((*SynthFs)(nil))
+
+// Generator returns the current contents of a file.
+type Generator func() ([]byte, error)
+
+// Handler takes what was written to a file, when the file is closed.
+// Returning a syscall.Errno fails the close with that error; other
+// errors become EINVAL.
+type Handler func(data []byte) error
+
+// Text makes a Generator from a function returning a string.  A
+// newline is added if it is missing.
+func Text(f func() string) Generator {
+	return func() ([]byte, error) {
+		s := f()
+		if !strings.HasSuffix(s, "\n") {
+			s += "\n"
+		}
+		return []byte(s), nil
+	}
+}
+
+type SynthFsOptions struct {
+	// If set, the size of a file is found by running its
+	// Generator on each stat.  Otherwise files have size 0, like
+	// in /proc, which some tools such as cp do not handle.  Reads
+	// are never cut off at the size.
+	ExactSize bool
+}
+
+// entry is a file or directory that was added.
+type entry struct {
+	path  string
+	gen   Generator
+	set   Handler
+	mtime time.Time
+	// For directories, the entries by name.
+	children map[string]*entry
+}
+
+func (e *entry) isDir() bool {
+	return e.children != nil
+}
+
+func (e *entry) mode() uint32 {
+	if e.isDir() {
+		return fuse.S_IFDIR | 0555
+	}
+	var perm uint32
+	if e.gen != nil {
+		perm |= 0444
+	}
+	if e.set != nil {
+		perm |= 0200
+	}
+	return fuse.S_IFREG | perm
+}
+
+// SynthFs is a NodeFileSystem of generated files.
+type SynthFs struct {
+	fuse.DefaultNodeFileSystem
+	options SynthFsOptions
+	conn    *fuse.FileSystemConnector
+	root    *synthNode
+
+	// Protects the entries.
+	lock sync.Mutex
+}
+
+func NewSynthFs(opts *SynthFsOptions) *SynthFs {
+	fs := &SynthFs{}
+	if opts != nil {
+		fs.options = *opts
+	}
+	fs.root = &synthNode{fs: fs, entry: &entry{mtime: time.Now(), children: map[string]*entry{}}}
+	return fs
+}
+
+func (fs *SynthFs) String() string {
+	return "SynthFs"
+}
+
+func (fs *SynthFs) Root() fuse.FsNode {
+	return fs.root
+}
+
+func (fs *SynthFs) OnMount(conn *fuse.FileSystemConnector) {
+	fs.conn = conn
+}
+
+// splitPath returns the directory and name of p, cleaned.
+func splitPath(p string) (dir []string, name string, err error) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil, "", fmt.Errorf("synthfs: empty path")
+	}
+	comps := strings.Split(p, "/")
+	return comps[:len(comps)-1], comps[len(comps)-1], nil
+}
+
+// add puts e at p, making the directories above it.
+func (fs *SynthFs) add(p string, e *entry) error {
+	dir, name, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+	e.path = strings.Join(append(dir, name), "/")
+	e.mtime = time.Now()
+	fs.lock.Lock()
+	parent := fs.root.entry
+	// The kernel may remember that the name, or the first
+	// directory made for it, did not exist.
+	notifyDir, notifyName := dir, name
+	made := false
+	for i, c := range dir {
+		next := parent.children[c]
+		if next == nil {
+			if !made {
+				notifyDir, notifyName, made = dir[:i], c, true
+			}
+			next = &entry{mtime: e.mtime, children: map[string]*entry{}}
+			parent.children[c] = next
+		} else if !next.isDir() {
+			fs.lock.Unlock()
+			return fmt.Errorf("synthfs: %s: %s is a file", p, c)
+		}
+		parent = next
+	}
+	if parent.children[name] != nil {
+		fs.lock.Unlock()
+		return fmt.Errorf("synthfs: %s exists", p)
+	}
+	parent.children[name] = e
+	parent.mtime = e.mtime
+	fs.lock.Unlock()
+
+	fs.notify(notifyDir, notifyName)
+	return nil
+}
+
+// notify drops the kernel's entry for name in dir, if the kernel
+// knows dir.
+func (fs *SynthFs) notify(dir []string, name string) {
+	if fs.conn == nil {
+		return
+	}
+	node, rest := fs.conn.Node(fs.root.Inode(), strings.Join(dir, "/"))
+	if len(rest) == 0 {
+		fs.conn.EntryNotify(node, name)
+	}
+}
+
+// AddFile adds a read-only file made by gen.  Directories above it
+// are made as needed.
+func (fs *SynthFs) AddFile(p string, gen Generator) error {
+	return fs.add(p, &entry{gen: gen})
+}
+
+// AddControl adds a file whose contents are passed to set when it is
+// written.  If gen is nil, the file cannot be read.
+func (fs *SynthFs) AddControl(p string, gen Generator, set Handler) error {
+	return fs.add(p, &entry{gen: gen, set: set})
+}
+
+// AddInt64 adds a file showing *v, which can be changed by writing a
+// number to it.  *v is read and written atomically.
+func (fs *SynthFs) AddInt64(p string, v *int64) error {
+	gen := func() ([]byte, error) {
+		return []byte(strconv.FormatInt(atomic.LoadInt64(v), 10) + "\n"), nil
+	}
+	set := func(data []byte) error {
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 0, 64)
+		if err != nil {
+			return syscall.EINVAL
+		}
+		atomic.StoreInt64(v, n)
+		return nil
+	}
+	return fs.add(p, &entry{gen: gen, set: set})
+}
+
+// AddDir adds an empty directory.
+func (fs *SynthFs) AddDir(p string) error {
+	return fs.add(p, &entry{children: map[string]*entry{}})
+}
+
+// Remove removes a file, or a directory with everything below it.
+func (fs *SynthFs) Remove(p string) error {
+	dir, name, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	parent := fs.root.entry
+	for _, c := range dir {
+		if parent = parent.children[c]; parent == nil || !parent.isDir() {
+			fs.lock.Unlock()
+			return fmt.Errorf("synthfs: %s does not exist", p)
+		}
+	}
+	if parent.children[name] == nil {
+		fs.lock.Unlock()
+		return fmt.Errorf("synthfs: %s does not exist", p)
+	}
+	delete(parent.children, name)
+	parent.mtime = time.Now()
+	fs.lock.Unlock()
+
+	fs.notify(dir, name)
+	return nil
+}
+
+func toStatus(err error) fuse.Status {
+	if errno, ok := err.(syscall.Errno); ok {
+		return fuse.Status(errno)
+	}
+	return fuse.EINVAL
+}
+
+// synthNode is a node for an entry.  Nodes are made again each time
+// the kernel looks an entry up, so entries can be replaced.
+type synthNode struct {
+	fuse.DefaultFsNode
+	fs    *SynthFs
+	entry *entry
+}
+
+func (n *synthNode) Deletable() bool {
+	return true
+}
+
+func (n *synthNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	n.fs.lock.Lock()
+	e := n.entry
+	out.Mode = e.mode()
+	mtime := e.mtime
+	n.fs.lock.Unlock()
+
+	if n.fs.options.ExactSize && e.gen != nil {
+		data, err := e.gen()
+		if err == nil {
+			out.Size = uint64(len(data))
+		}
+	}
+	out.Nlink = 1
+	out.SetTimes(&mtime, &mtime, &mtime)
+	return fuse.OK
+}
+
+func (n *synthNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	n.fs.lock.Lock()
+	e := n.entry.children[name]
+	n.fs.lock.Unlock()
+	if e == nil {
+		return nil, fuse.ENOENT
+	}
+	child := &synthNode{fs: n.fs, entry: e}
+	child.GetAttr(out, nil, context)
+	n.Inode().AddChild(name, n.Inode().New(e.isDir(), child))
+	return child, fuse.OK
+}
+
+func (n *synthNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	if !n.entry.isDir() {
+		return nil, fuse.ENOTDIR
+	}
+	stream := make([]fuse.DirEntry, 0, len(n.entry.children))
+	for name, e := range n.entry.children {
+		stream = append(stream, fuse.DirEntry{Name: name, Mode: e.mode()})
+	}
+	return stream, fuse.OK
+}
+
+func (n *synthNode) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	e := n.entry
+	if e.isDir() {
+		return nil, fuse.Status(syscall.EISDIR)
+	}
+	if flags&fuse.O_ANYWRITE != 0 && e.set == nil {
+		return nil, fuse.EPERM
+	}
+	if flags&syscall.O_ACCMODE != syscall.O_WRONLY && e.gen == nil {
+		return nil, fuse.EACCES
+	}
+	// The size changes, so the kernel must not cache the data, nor
+	// stop reading at the size it was told.
+	return &fuse.WithFlags{
+		File:      &synthFile{node: n},
+		FuseFlags: raw.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+// synthFile is an open generated file.  Reads are served from the
+// contents made at the first read, or the last read at offset 0.
+// Writes are collected, and handed to the Handler on Flush.
+type synthFile struct {
+	fuse.DefaultFile
+	node *synthNode
+
+	lock    sync.Mutex
+	data    []byte
+	loaded  bool
+	written []byte
+	dirty   bool
+}
+
+func (f *synthFile) String() string {
+	return fmt.Sprintf("synthFile(%d bytes)", len(f.data))
+}
+
+func (f *synthFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.loaded || input.Offset == 0 {
+		data, err := f.node.entry.gen()
+		if err != nil {
+			log.Printf("SynthFs: generating %s: %v", f.node.entry.path, err)
+			return nil, fuse.EIO
+		}
+		f.data, f.loaded = data, true
+	}
+	if input.Offset >= uint64(len(f.data)) {
+		return []byte{}, fuse.OK
+	}
+	end := input.Offset + uint64(input.Size)
+	if end > uint64(len(f.data)) {
+		end = uint64(len(f.data))
+	}
+	return f.data[input.Offset:end], fuse.OK
+}
+
+func (f *synthFile) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	end := int(input.Offset) + len(data)
+	if end > len(f.written) {
+		f.written = append(f.written, make([]byte, end-len(f.written))...)
+	}
+	copy(f.written[input.Offset:], data)
+	f.dirty = true
+	return uint32(len(data)), fuse.OK
+}
+
+// Truncate is accepted, since shells truncate files they write to.
+func (f *synthFile) Truncate(size uint64, context *fuse.Context) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if size < uint64(len(f.written)) {
+		f.written = f.written[:size]
+	}
+	return fuse.OK
+}
+
+func (f *synthFile) Flush(input *fuse.FlushIn) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.dirty {
+		return fuse.OK
+	}
+	f.dirty = false
+	data := f.written
+	f.written = nil
+	if err := f.node.entry.set(data); err != nil {
+		return toStatus(err)
+	}
+	return fuse.OK
+}
+
+func (f *synthFile) GetAttr(out *fuse.Attr) fuse.Status {
+	return f.node.GetAttr(out, f, nil)
+}
@@ -0,0 +1,178 @@
+package synthfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestSynthFs(t *testing.T) {
+	fs := NewSynthFs(nil)
+	conn := fuse.NewFileSystemConnector(fs, nil)
+	var notified []string
+	conn.Init(&fuse.RawFsInit{
+		InodeNotify: func(*raw.NotifyInvalInodeOut) fuse.Status { return fuse.OK },
+		EntryNotify: func(parent uint64, name string) fuse.Status {
+			notified = append(notified, fmt.Sprintf("%d/%s", parent, name))
+			return fuse.OK
+		},
+	})
+
+	reads := 0
+	if err := fs.AddFile("stats/reads", Text(func() string {
+		reads++
+		return fmt.Sprint(reads)
+	})); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+	var limit int64 = 5
+	if err := fs.AddInt64("limit", &limit); err != nil {
+		t.Fatalf("AddInt64: %v", err)
+	}
+	var last string
+	fs.AddControl("cmd", nil, func(data []byte) error {
+		if string(data) == "bad" {
+			return syscall.EBUSY
+		}
+		last = string(data)
+		return nil
+	})
+	if err := fs.AddFile("stats/reads", nil); err == nil {
+		t.Errorf("adding twice succeeded")
+	}
+	if err := fs.AddFile("limit/x", nil); err == nil {
+		t.Errorf("adding below a file succeeded")
+	}
+
+	lookup := func(p string) (fuse.FsNode, *fuse.Attr, fuse.Status) {
+		var n fuse.FsNode = fs.Root()
+		var a fuse.Attr
+		for _, c := range strings.Split(p, "/") {
+			var code fuse.Status
+			if n, code = n.Lookup(&a, c, nil); !code.Ok() {
+				return nil, nil, code
+			}
+		}
+		return n, &a, fuse.OK
+	}
+	open := func(p string, flags uint32) fuse.File {
+		n, _, code := lookup(p)
+		if !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", p, code)
+		}
+		f, code := n.Open(flags, nil)
+		if !code.Ok() {
+			t.Fatalf("Open(%q): %v", p, code)
+		}
+		if wf, ok := f.(*fuse.WithFlags); !ok || wf.FuseFlags&raw.FOPEN_DIRECT_IO == 0 {
+			t.Errorf("Open(%q): not direct I/O: %v", p, f)
+		}
+		return f
+	}
+	read := func(f fuse.File, off uint64) string {
+		data, code := f.Read(&fuse.ReadIn{Offset: off, Size: 100}, fuse.NewGcBufferPool())
+		if !code.Ok() {
+			t.Fatalf("Read: %v", code)
+		}
+		return string(data)
+	}
+
+	stream, _ := fs.Root().OpenDir(nil)
+	var names []string
+	for _, e := range stream {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "cmd limit stats" {
+		t.Errorf("root: got %q", got)
+	}
+
+	// Reads from the start see new contents; later reads do not.
+	f := open("stats/reads", 0)
+	if got := read(f, 0); got != "1\n" {
+		t.Errorf("first read: got %q", got)
+	}
+	if got := read(f, 1); got != "\n" {
+		t.Errorf("read at 1: got %q", got)
+	}
+	if got := read(f, 0); got != "2\n" {
+		t.Errorf("second read: got %q", got)
+	}
+	if _, a, _ := lookup("stats/reads"); a.Size != 0 || a.Mode != fuse.S_IFREG|0444 {
+		t.Errorf("attr: got %v", a)
+	}
+	n, _, _ := lookup("stats/reads")
+	if _, code := n.Open(uint32(syscall.O_WRONLY), nil); code != fuse.EPERM {
+		t.Errorf("opening read-only file for writing: got %v", code)
+	}
+
+	// Writes are handed over on Flush.
+	f = open("limit", uint32(syscall.O_RDWR))
+	f.Truncate(0, nil)
+	f.Write(&fuse.WriteIn{Offset: 0}, []byte("4"))
+	f.Write(&fuse.WriteIn{Offset: 1}, []byte("2\n"))
+	if code := f.Flush(&fuse.FlushIn{}); !code.Ok() {
+		t.Errorf("Flush: %v", code)
+	}
+	if limit != 42 {
+		t.Errorf("limit: got %d", limit)
+	}
+	if got := read(f, 0); got != "42\n" {
+		t.Errorf("read limit: got %q", got)
+	}
+	f.Write(&fuse.WriteIn{Offset: 0}, []byte("x"))
+	if code := f.Flush(&fuse.FlushIn{}); code != fuse.EINVAL {
+		t.Errorf("Flush bad number: got %v", code)
+	}
+
+	n, a, _ := lookup("cmd")
+	if a.Mode != fuse.S_IFREG|0200 {
+		t.Errorf("cmd mode: got %o", a.Mode)
+	}
+	if _, code := n.Open(uint32(syscall.O_RDONLY), nil); code != fuse.EACCES {
+		t.Errorf("reading write-only file: got %v", code)
+	}
+	f = open("cmd", uint32(syscall.O_WRONLY))
+	f.Write(&fuse.WriteIn{}, []byte("bad"))
+	if code := f.Flush(&fuse.FlushIn{}); code != fuse.Status(syscall.EBUSY) {
+		t.Errorf("Flush: got %v", code)
+	}
+	f.Write(&fuse.WriteIn{}, []byte("go"))
+	f.Flush(&fuse.FlushIn{})
+	if last != "go" {
+		t.Errorf("cmd: got %q", last)
+	}
+
+	// Changes while mounted tell the kernel about directories it
+	// knows, which here is only the root.
+	notified = nil
+	if err := fs.Remove("stats/reads"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	fs.Remove("limit")
+	fs.AddFile("other/x", Text(func() string { return "x" }))
+	if got := strings.Join(notified, " "); got != "1/limit 1/other" {
+		t.Errorf("notified: got %q", got)
+	}
+	if _, _, code := lookup("stats/reads"); code != fuse.ENOENT {
+		t.Errorf("removed file: got %v", code)
+	}
+	if err := fs.Remove("stats/reads"); err == nil {
+		t.Errorf("removing twice succeeded")
+	}
+}
+
+func TestSynthFsExactSize(t *testing.T) {
+	fs := NewSynthFs(&SynthFsOptions{ExactSize: true})
+	fuse.NewFileSystemConnector(fs, nil)
+	fs.AddFile("f", Text(func() string { return "hello" }))
+	var a fuse.Attr
+	if _, code := fs.Root().Lookup(&a, "f", nil); !code.Ok() || a.Size != 6 {
+		t.Errorf("Lookup: %v %v", code, &a)
+	}
+}
@@ -352,13 +352,16 @@ func (fs *AutoUnionFs) DebugData() string {
 		return "AutoUnionFs.mountState not set"
 	}
 	setting := fs.mountState.KernelSettings()
+	negotiated := fs.mountState.NegotiatedSettings()
 	msg := fmt.Sprintf(
 		"Version: %v\n"+
 			"Bufferpool: %v\n"+
-			"Kernel: %v\n",
+			"Kernel: %v\n"+
+			"Negotiated: %v\n",
 		fuse.Version(),
 		fs.mountState.BufferPoolStats(),
-		&setting)
+		&setting,
+		&negotiated)
 
 	lat := fs.mountState.Latencies()
 	if len(lat) > 0 {
@@ -0,0 +1,281 @@
+package unionfs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// The branches of a UnionFs can be changed while it is mounted,
+// through the methods below.  With UnionFsOptions.BranchesFile, the
+// user running the file system can also write commands to the
+// .branches file in the root of the mount, one per line:
+//
+//   add DIRECTORY [INDEX]
+//   remove INDEX
+//   move FROM TO
+//
+// Reading .branches lists the branches with their indices.  The
+// writable branch has index 0, and cannot be changed.
+//
+// Operations that run while the branches change may still see the
+// old ones.
+
+const _BRANCHES = ".branches"
+
+func (fs *UnionFs) isBranchesFile(name string) bool {
+	return fs.options.BranchesFile && name == _BRANCHES
+}
+
+// callerUid returns the user of context.  Calls from within the
+// process have no context, and run as the user of the process.
+func callerUid(context *fuse.Context) uint32 {
+	if context == nil {
+		return uint32(os.Getuid())
+	}
+	return context.Uid
+}
+
+func (fs *UnionFs) branches() []fuse.FileSystem {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	return fs.fileSystems
+}
+
+// branchFs returns the file system that holds r.
+func (fs *UnionFs) branchFs(r branchResult) fuse.FileSystem {
+	if r.branch == 0 {
+		return fs.writable
+	}
+	return r.fs
+}
+
+// Branches returns the current branches, the writable one first.
+func (fs *UnionFs) Branches() []fuse.FileSystem {
+	return append([]fuse.FileSystem{}, fs.branches()...)
+}
+
+// AddBranch inserts a read-only branch, so it has the given index.
+func (fs *UnionFs) AddBranch(index int, branch fuse.FileSystem) fuse.Status {
+	fs.branchLock.Lock()
+	old := fs.fileSystems
+	if index < 1 || index > len(old) {
+		fs.branchLock.Unlock()
+		return fuse.EINVAL
+	}
+	branches := make([]fuse.FileSystem, 0, len(old)+1)
+	branches = append(branches, old[:index]...)
+	branches = append(branches, branch)
+	branches = append(branches, old[index:]...)
+	fs.fileSystems = branches
+	fs.branchLock.Unlock()
+
+	fs.branchesChanged(branch)
+	return fuse.OK
+}
+
+// RemoveBranch removes the read-only branch with the given index.
+func (fs *UnionFs) RemoveBranch(index int) fuse.Status {
+	fs.branchLock.Lock()
+	old := fs.fileSystems
+	if index < 1 || index >= len(old) {
+		fs.branchLock.Unlock()
+		return fuse.EINVAL
+	}
+	branches := make([]fuse.FileSystem, 0, len(old)-1)
+	branches = append(branches, old[:index]...)
+	branches = append(branches, old[index+1:]...)
+	fs.fileSystems = branches
+	fs.branchLock.Unlock()
+
+	fs.branchesChanged(old[index])
+	return fuse.OK
+}
+
+// MoveBranch moves the read-only branch with index from, so it gets
+// index to.
+func (fs *UnionFs) MoveBranch(from, to int) fuse.Status {
+	fs.branchLock.Lock()
+	old := fs.fileSystems
+	if from < 1 || from >= len(old) || to < 1 || to >= len(old) {
+		fs.branchLock.Unlock()
+		return fuse.EINVAL
+	}
+	moved := old[from]
+	branches := make([]fuse.FileSystem, 0, len(old))
+	branches = append(branches, old[:from]...)
+	branches = append(branches, old[from+1:]...)
+	branches = append(branches[:to], append([]fuse.FileSystem{moved}, branches[to:]...)...)
+	fs.fileSystems = branches
+	fs.branchLock.Unlock()
+
+	// The order of the other branches is unchanged, so only the
+	// files in the moved branch can look different.
+	fs.branchesChanged(moved)
+	return fuse.OK
+}
+
+// branchesChanged drops the caches after branch was added, removed or
+// moved.
+func (fs *UnionFs) branchesChanged(branch fuse.FileSystem) {
+	fs.DropBranchCache(nil)
+	if fs.nodeFs != nil {
+		fs.invalidateBranch(branch)
+	}
+}
+
+// invalidateBranch makes the kernel forget the entries for the files
+// of branch, in the directories it knows of.
+func (fs *UnionFs) invalidateBranch(branch fuse.FileSystem) {
+	type dir struct {
+		path string
+		node *fuse.Inode
+	}
+	dirs := []dir{{"", fs.nodeFs.Root().Inode()}}
+	for i := 0; i < len(dirs); i++ {
+		for name, ch := range dirs[i].node.FsChildren() {
+			if ch.IsDir() {
+				dirs = append(dirs, dir{filepath.Join(dirs[i].path, name), ch})
+			}
+		}
+	}
+
+	// Deepest directories first, so the kernel drops leaves
+	// before their directories.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		stream, code := branch.OpenDir(d.path, nil)
+		if !code.Ok() {
+			continue
+		}
+		for _, e := range stream {
+			code := fs.nodeFs.EntryNotify(d.path, e.Name)
+			if !code.Ok() && code != fuse.ENOENT {
+				log.Printf("UnionFs: invalidating %q: %v", filepath.Join(d.path, e.Name), code)
+			}
+		}
+		fs.nodeFs.FileNotify(d.path, 0, 0)
+	}
+}
+
+// branchListing describes the branches for reading .branches.
+func (fs *UnionFs) branchListing() []byte {
+	var lines []string
+	for i, b := range fs.branches() {
+		lines = append(lines, fmt.Sprintf("%d %v\n", i, b))
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// branchIndex parses a branch index.  Bad indices are returned as
+// -1, which is out of range.
+func branchIndex(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// branchCommand runs one command written to .branches.
+func (fs *UnionFs) branchCommand(cmd string) fuse.Status {
+	args := strings.Fields(cmd)
+	switch {
+	case len(args) == 0:
+		return fuse.OK
+	case args[0] == "add" && len(args) == 2:
+		return fs.AddBranch(len(fs.branches()), fuse.NewLoopbackFileSystem(args[1]))
+	case args[0] == "add" && len(args) == 3:
+		return fs.AddBranch(branchIndex(args[2]), fuse.NewLoopbackFileSystem(args[1]))
+	case args[0] == "remove" && len(args) == 2:
+		return fs.RemoveBranch(branchIndex(args[1]))
+	case args[0] == "move" && len(args) == 3:
+		return fs.MoveBranch(branchIndex(args[1]), branchIndex(args[2]))
+	}
+	log.Printf("UnionFs: bad branch command %q", cmd)
+	return fuse.EINVAL
+}
+
+func (fs *UnionFs) openBranches(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	uid := callerUid(context)
+	if flags&fuse.O_ANYWRITE != 0 && uid != uint32(os.Getuid()) {
+		return nil, fuse.EACCES
+	}
+	return &branchFile{
+		DataFile: fuse.NewDataFile(fs.branchListing()),
+		ufs:      fs,
+		uid:      uid,
+	}, fuse.OK
+}
+
+// branchFile shows the branches, and runs the commands written to
+// it.  Commands may be split over writes, so a command only runs
+// once its line is complete, or the file is flushed.
+type branchFile struct {
+	*fuse.DataFile
+	ufs *UnionFs
+
+	// uid is the user that opened the file.
+	uid uint32
+
+	lock sync.Mutex
+	// next is the offset the next write should have.
+	next    uint64
+	started bool
+	// pending holds the start of an incomplete line.
+	pending []byte
+}
+
+func (f *branchFile) String() string {
+	return "branchFile"
+}
+
+func (f *branchFile) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if f.uid != uint32(os.Getuid()) {
+		return 0, fuse.EACCES
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.started && input.Offset != f.next {
+		return 0, fuse.EINVAL
+	}
+	f.started = true
+	f.next = input.Offset + uint64(len(data))
+
+	f.pending = append(f.pending, data...)
+	for {
+		i := bytes.IndexByte(f.pending, '\n')
+		if i < 0 {
+			break
+		}
+		cmd := string(f.pending[:i])
+		f.pending = f.pending[i+1:]
+		if code := f.ufs.branchCommand(cmd); !code.Ok() {
+			return 0, code
+		}
+	}
+	return uint32(len(data)), fuse.OK
+}
+
+// Flush runs the last command, if it has no newline.
+func (f *branchFile) Flush(input *fuse.FlushIn) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.pending) == 0 {
+		return fuse.OK
+	}
+	cmd := string(f.pending)
+	f.pending = nil
+	return f.ufs.branchCommand(cmd)
+}
+
+func (f *branchFile) Truncate(size uint64, context *fuse.Context) fuse.Status {
+	return fuse.OK
+}
@@ -0,0 +1,157 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestUnionFsBranches(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "go-fuse")
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"rw", "ro1", "ro2"} {
+		CheckSuccess(os.Mkdir(wd+"/"+d, 0755))
+	}
+	CheckSuccess(ioutil.WriteFile(wd+"/ro1/file", []byte("1"), 0644))
+	CheckSuccess(ioutil.WriteFile(wd+"/ro2/file", []byte("22"), 0644))
+	CheckSuccess(ioutil.WriteFile(wd+"/ro2/extra", []byte("x"), 0644))
+
+	ufs := NewUnionFs([]fuse.FileSystem{
+		fuse.NewLoopbackFileSystem(wd + "/rw"),
+		fuse.NewLoopbackFileSystem(wd + "/ro1"),
+	}, testOpts)
+	c := fuse.NewFileSystemConnector(fuse.NewPathNodeFs(ufs, nil), nil)
+	var notified []string
+	c.Init(&fuse.RawFsInit{
+		EntryNotify: func(parent uint64, name string) fuse.Status {
+			notified = append(notified, name)
+			return fuse.OK
+		},
+		InodeNotify: func(*raw.NotifyInvalInodeOut) fuse.Status {
+			return fuse.OK
+		},
+	})
+
+	size := func(name string) int {
+		a, code := ufs.GetAttr(name, nil)
+		if !code.Ok() {
+			return -1
+		}
+		return int(a.Size)
+	}
+	if size("file") != 1 || size("extra") != -1 {
+		t.Fatalf("sizes before: %d %d", size("file"), size("extra"))
+	}
+
+	if code := ufs.AddBranch(2, fuse.NewLoopbackFileSystem(wd+"/ro2")); !code.Ok() {
+		t.Fatalf("AddBranch: %v", code)
+	}
+	if size("file") != 1 || size("extra") != 1 {
+		t.Errorf("sizes after add: %d %d", size("file"), size("extra"))
+	}
+	sort.Strings(notified)
+	if strings.Join(notified, " ") != "extra file" {
+		t.Errorf("got notifications %v, want [extra file]", notified)
+	}
+
+	if code := ufs.MoveBranch(2, 1); !code.Ok() {
+		t.Fatalf("MoveBranch: %v", code)
+	}
+	if size("file") != 2 {
+		t.Errorf("size after move: %d", size("file"))
+	}
+
+	if code := ufs.RemoveBranch(1); !code.Ok() {
+		t.Fatalf("RemoveBranch: %v", code)
+	}
+	if size("file") != 1 || size("extra") != -1 {
+		t.Errorf("sizes after remove: %d %d", size("file"), size("extra"))
+	}
+
+	for _, bad := range []func() fuse.Status{
+		func() fuse.Status { return ufs.RemoveBranch(0) },
+		func() fuse.Status { return ufs.RemoveBranch(2) },
+		func() fuse.Status { return ufs.MoveBranch(1, 0) },
+		func() fuse.Status { return ufs.AddBranch(0, fuse.NewLoopbackFileSystem(wd)) },
+	} {
+		if code := bad(); code != fuse.EINVAL {
+			t.Errorf("got %v for bad index, want EINVAL", code)
+		}
+	}
+}
+
+func TestUnionFsBranchesFile(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "go-fuse")
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"rw", "ro1", "ro2"} {
+		CheckSuccess(os.Mkdir(wd+"/"+d, 0755))
+	}
+	CheckSuccess(ioutil.WriteFile(wd+"/ro2/file", []byte("x"), 0644))
+
+	branches := []fuse.FileSystem{
+		fuse.NewLoopbackFileSystem(wd + "/rw"),
+		fuse.NewLoopbackFileSystem(wd + "/ro1"),
+	}
+	if _, code := NewUnionFs(branches, testOpts).GetAttr(_BRANCHES, nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr without BranchesFile: got %v, want ENOENT", code)
+	}
+
+	opts := testOpts
+	opts.BranchesFile = true
+	ufs := NewUnionFs(branches, opts)
+
+	other := &fuse.Context{}
+	other.Uid = uint32(os.Getuid()) + 1
+	if _, code := ufs.Open(_BRANCHES, uint32(os.O_WRONLY), other); code != fuse.EACCES {
+		t.Errorf("Open by other user: got %v, want EACCES", code)
+	}
+
+	f, code := ufs.Open(_BRANCHES, uint32(os.O_WRONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	// Commands may be split over writes.
+	var off uint64
+	for _, cmd := range []string{"add " + wd, "/ro2\nmo", "ve 2 1\n"} {
+		if n, code := f.Write(&fuse.WriteIn{Offset: off}, []byte(cmd)); !code.Ok() || int(n) != len(cmd) {
+			t.Fatalf("Write: %d, %v", n, code)
+		}
+		off += uint64(len(cmd))
+	}
+	if _, code := f.Write(&fuse.WriteIn{}, []byte("remove 1\n")); code != fuse.EINVAL {
+		t.Errorf("write at wrong offset: got %v, want EINVAL", code)
+	}
+	if _, code := f.Write(&fuse.WriteIn{Offset: off}, []byte("remove x\n")); code != fuse.EINVAL {
+		t.Errorf("bad command: got %v, want EINVAL", code)
+	}
+	f.Release(&fuse.ReleaseIn{})
+
+	if _, code := ufs.GetAttr("file", nil); !code.Ok() {
+		t.Errorf("GetAttr after add: %v", code)
+	}
+
+	a, _ := ufs.GetAttr(_BRANCHES, nil)
+	f, _ = ufs.Open(_BRANCHES, uint32(os.O_RDONLY), nil)
+	data, _ := f.Read(&fuse.ReadIn{Size: 4096}, fuse.NewBufferPool())
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || int(a.Size) != len(data) ||
+		!strings.Contains(lines[1], "ro2") || !strings.Contains(lines[2], "ro1") {
+		t.Errorf("got listing %q, size %d", data, a.Size)
+	}
+
+	// The last command runs on flush, even without a newline.
+	f, _ = ufs.Open(_BRANCHES, uint32(os.O_WRONLY), nil)
+	f.Write(&fuse.WriteIn{}, []byte("remove 2"))
+	if code := f.Flush(&fuse.FlushIn{}); !code.Ok() {
+		t.Errorf("Flush: %v", code)
+	}
+	f.Release(&fuse.ReleaseIn{})
+	if n := len(ufs.Branches()); n != 2 {
+		t.Errorf("got %d branches after remove, want 2", n)
+	}
+}
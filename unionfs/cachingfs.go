@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/hanwen/go-fuse/fuse"
 	"log"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -32,7 +33,10 @@ type linkResponse struct {
 	fuse.Status
 }
 
-// Caches filesystem metadata.
+// Caches filesystem metadata.  Changes made through the
+// CachingFileSystem drop the affected entries; changes made to the
+// underlying file system behind its back show after the TTL, or once
+// Invalidate is called.
 type CachingFileSystem struct {
 	fuse.FileSystem
 
@@ -40,6 +44,18 @@ type CachingFileSystem struct {
 	dirs       *TimedCache
 	links      *TimedCache
 	xattr      *TimedCache
+
+	// Set once mounted, for telling the kernel to drop entries.
+	nodeFs *fuse.PathNodeFs
+}
+
+// CachingOptions sets how long a CachingFileSystem keeps each kind of
+// result.  A TTL <= 0 keeps results until they are invalidated.
+type CachingOptions struct {
+	AttrTTL  time.Duration
+	DirTTL   time.Duration
+	LinkTTL  time.Duration
+	XAttrTTL time.Duration
 }
 
 func readDir(fs fuse.FileSystem, name string) *dirResponse {
@@ -79,24 +95,33 @@ func readLink(fs fuse.FileSystem, name string) *linkResponse {
 }
 
 func NewCachingFileSystem(fs fuse.FileSystem, ttl time.Duration) *CachingFileSystem {
+	return NewCachingFileSystemWithOptions(fs, CachingOptions{
+		AttrTTL:  ttl,
+		DirTTL:   ttl,
+		LinkTTL:  ttl,
+		XAttrTTL: ttl,
+	})
+}
+
+func NewCachingFileSystemWithOptions(fs fuse.FileSystem, options CachingOptions) *CachingFileSystem {
 	c := new(CachingFileSystem)
 	c.FileSystem = fs
 	c.attributes = NewTimedCache(func(n string) (interface{}, bool) {
 		a := getAttr(fs, n)
 		return a, a.Ok()
-	}, ttl)
+	}, options.AttrTTL)
 	c.dirs = NewTimedCache(func(n string) (interface{}, bool) {
 		d := readDir(fs, n)
 		return d, d.Ok()
-	}, ttl)
+	}, options.DirTTL)
 	c.links = NewTimedCache(func(n string) (interface{}, bool) {
 		l := readLink(fs, n)
 		return l, l.Ok()
-	}, ttl)
+	}, options.LinkTTL)
 	c.xattr = NewTimedCache(func(n string) (interface{}, bool) {
 		l := getXAttr(fs, n)
 		return l, l.Ok()
-	}, ttl)
+	}, options.XAttrTTL)
 	return c
 }
 
@@ -106,6 +131,56 @@ func (fs *CachingFileSystem) DropCache() {
 	}
 }
 
+func (fs *CachingFileSystem) OnMount(nodeFs *fuse.PathNodeFs) {
+	fs.nodeFs = nodeFs
+	fs.FileSystem.OnMount(nodeFs)
+}
+
+// drop forgets everything cached for name, and the listing of its
+// directory.
+func (fs *CachingFileSystem) drop(name string) {
+	fs.attributes.DropEntry(name)
+	fs.links.DropEntry(name)
+	fs.dirs.DropEntry(name)
+	fs.xattr.DropPrefix(name + _XATTRSEP)
+	fs.dropParent(name)
+}
+
+// dropParent forgets the listing and attributes of the directory
+// holding name, whose entries changed.
+func (fs *CachingFileSystem) dropParent(name string) {
+	dir := parentDir(name)
+	fs.dirs.DropEntry(dir)
+	fs.attributes.DropEntry(dir)
+}
+
+func parentDir(name string) string {
+	dir, _ := filepath.Split(name)
+	return strings.TrimSuffix(dir, "/")
+}
+
+// Invalidate drops the cached results for name, and the listing of
+// its directory.  If the file system is mounted, the kernel drops its
+// entry and cached data for name too, so the next access sees the
+// current state of the underlying file system.  The first failure to
+// notify the kernel is returned, other than ENOENT for entries it
+// does not know.
+func (fs *CachingFileSystem) Invalidate(name string) fuse.Status {
+	fs.drop(name)
+	if fs.nodeFs == nil || name == "" {
+		return fuse.OK
+	}
+	code := fs.nodeFs.FileNotify(name, 0, 0)
+	if code == fuse.ENOENT {
+		code = fuse.OK
+	}
+	_, base := filepath.Split(name)
+	if c := fs.nodeFs.EntryNotify(parentDir(name), base); code.Ok() && c != fuse.ENOENT {
+		code = c
+	}
+	return code
+}
+
 func (fs *CachingFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	if name == _DROP_CACHE {
 		return &fuse.Attr{
@@ -133,6 +208,12 @@ func (fs *CachingFileSystem) OpenDir(name string, context *fuse.Context) (stream
 	return r.entries, r.Status
 }
 
+// OpenDirStream returns ENOSYS, so directories are read from the
+// cache through OpenDir.
+func (fs *CachingFileSystem) OpenDirStream(name string, context *fuse.Context) (fuse.DirStream, fuse.Status) {
+	return nil, fuse.ENOSYS
+}
+
 func (fs *CachingFileSystem) String() string {
 	return fmt.Sprintf("CachingFileSystem(%v)", fs.FileSystem)
 }
@@ -142,5 +223,131 @@ func (fs *CachingFileSystem) Open(name string, flags uint32, context *fuse.Conte
 		log.Println("Dropping cache for", fs)
 		fs.DropCache()
 	}
-	return fs.FileSystem.Open(name, flags, context)
+	f, status = fs.FileSystem.Open(name, flags, context)
+	if status.Ok() && flags&fuse.O_ANYWRITE != 0 {
+		fs.attributes.DropEntry(name)
+		f = &cachingFile{File: f, fs: fs, name: name}
+	}
+	return f, status
+}
+
+func (fs *CachingFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (f fuse.File, status fuse.Status) {
+	f, status = fs.FileSystem.Create(name, flags, mode, context)
+	fs.drop(name)
+	if status.Ok() {
+		f = &cachingFile{File: f, fs: fs, name: name}
+	}
+	return f, status
+}
+
+func (fs *CachingFileSystem) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Chmod(name, mode, context)
+	fs.attributes.DropEntry(name)
+	return code
+}
+
+func (fs *CachingFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Chown(name, uid, gid, context)
+	fs.attributes.DropEntry(name)
+	return code
+}
+
+func (fs *CachingFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Utimens(name, atime, mtime, context)
+	fs.attributes.DropEntry(name)
+	return code
+}
+
+func (fs *CachingFileSystem) Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Truncate(name, size, context)
+	fs.attributes.DropEntry(name)
+	return code
+}
+
+func (fs *CachingFileSystem) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Link(oldName, newName, context)
+	fs.attributes.DropEntry(oldName)
+	fs.drop(newName)
+	return code
+}
+
+func (fs *CachingFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	code := fs.FileSystem.Mkdir(name, mode, context)
+	fs.drop(name)
+	return code
+}
+
+func (fs *CachingFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	code := fs.FileSystem.Mknod(name, mode, dev, context)
+	fs.drop(name)
+	return code
+}
+
+func (fs *CachingFileSystem) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Symlink(value, linkName, context)
+	fs.drop(linkName)
+	return code
+}
+
+func (fs *CachingFileSystem) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Rename(oldName, newName, context)
+	// The subtree moves along; it is simplest to forget it all.
+	fs.attributes.DropAll(nil)
+	fs.dirs.DropAll(nil)
+	fs.links.DropAll(nil)
+	fs.xattr.DropAll(nil)
+	return code
+}
+
+func (fs *CachingFileSystem) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Rmdir(name, context)
+	fs.drop(name)
+	return code
+}
+
+func (fs *CachingFileSystem) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	code = fs.FileSystem.Unlink(name, context)
+	fs.drop(name)
+	return code
+}
+
+func (fs *CachingFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	code := fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+	fs.xattr.DropEntry(name + _XATTRSEP + attr)
+	fs.attributes.DropEntry(name)
+	return code
+}
+
+func (fs *CachingFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	code := fs.FileSystem.RemoveXAttr(name, attr, context)
+	fs.xattr.DropEntry(name + _XATTRSEP + attr)
+	fs.attributes.DropEntry(name)
+	return code
+}
+
+// cachingFile drops the cached attributes of a file that is written.
+type cachingFile struct {
+	fuse.File
+	fs   *CachingFileSystem
+	name string
+}
+
+func (f *cachingFile) InnerFile() fuse.File {
+	return f.File
+}
+
+func (f *cachingFile) String() string {
+	return fmt.Sprintf("cachingFile(%s)", f.File.String())
+}
+
+func (f *cachingFile) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	n, code := f.File.Write(input, data)
+	f.fs.attributes.DropEntry(f.name)
+	return n, code
+}
+
+func (f *cachingFile) Truncate(size uint64, context *fuse.Context) fuse.Status {
+	code := f.File.Truncate(size, context)
+	f.fs.attributes.DropEntry(f.name)
+	return code
 }
@@ -8,6 +8,7 @@ import (
 	"os"
 	"syscall"
 	"testing"
+	"time"
 )
 
 var _ = fmt.Print
@@ -70,3 +71,88 @@ func TestCachingFs(t *testing.T) {
 		t.Error("Unexpected readdir result", results, expected)
 	}
 }
+
+func TestCachingFsInvalidate(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(wd)
+
+	cfs := NewCachingFileSystemWithOptions(fuse.NewLoopbackFileSystem(wd),
+		CachingOptions{AttrTTL: time.Hour, DirTTL: time.Hour, LinkTTL: time.Hour})
+	c := fuse.NewFileSystemConnector(fuse.NewPathNodeFs(cfs, nil), nil)
+	var notified []string
+	c.Init(&fuse.RawFsInit{
+		EntryNotify: func(parent uint64, name string) fuse.Status {
+			notified = append(notified, name)
+			return fuse.OK
+		},
+	})
+
+	ioutil.WriteFile(wd+"/file", []byte("abc"), 0644)
+	if a, code := cfs.GetAttr("file", nil); !code.Ok() || a.Size != 3 {
+		t.Fatalf("GetAttr: %v, %v", a, code)
+	}
+	if entries, _ := cfs.OpenDir("", nil); len(entries) != 1 {
+		t.Fatalf("OpenDir: %v", entries)
+	}
+
+	// Changes behind our back are not seen.
+	ioutil.WriteFile(wd+"/file", []byte("abcdef"), 0644)
+	ioutil.WriteFile(wd+"/other", nil, 0644)
+	if a, _ := cfs.GetAttr("file", nil); a.Size != 3 {
+		t.Errorf("got size %d, want cached 3", a.Size)
+	}
+	if entries, _ := cfs.OpenDir("", nil); len(entries) != 1 {
+		t.Errorf("got %v, want cached listing", entries)
+	}
+
+	if code := cfs.Invalidate("file"); !code.Ok() {
+		t.Fatal("Invalidate:", code)
+	}
+	if a, _ := cfs.GetAttr("file", nil); a.Size != 6 {
+		t.Errorf("got size %d after Invalidate, want 6", a.Size)
+	}
+	if entries, _ := cfs.OpenDir("", nil); len(entries) != 2 {
+		t.Errorf("got %v after Invalidate, want 2 entries", entries)
+	}
+	if len(notified) != 1 || notified[0] != "file" {
+		t.Errorf("got notifications %v, want [file]", notified)
+	}
+
+	// Changes through the cache are seen at once.
+	if code := cfs.Truncate("file", 1, nil); !code.Ok() {
+		t.Fatal("Truncate:", code)
+	}
+	if a, _ := cfs.GetAttr("file", nil); a.Size != 1 {
+		t.Errorf("got size %d after Truncate, want 1", a.Size)
+	}
+	if code := cfs.Unlink("other", nil); !code.Ok() {
+		t.Fatal("Unlink:", code)
+	}
+	if entries, _ := cfs.OpenDir("", nil); len(entries) != 1 {
+		t.Errorf("got %v after Unlink, want 1 entry", entries)
+	}
+	if _, code := cfs.GetAttr("other", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr after Unlink: got %v, want ENOENT", code)
+	}
+}
+
+func TestCachingFsTTL(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(wd)
+
+	cfs := NewCachingFileSystemWithOptions(fuse.NewLoopbackFileSystem(wd),
+		CachingOptions{AttrTTL: time.Millisecond, DirTTL: time.Hour})
+	ioutil.WriteFile(wd+"/file", []byte("abc"), 0644)
+	cfs.GetAttr("file", nil)
+	cfs.OpenDir("", nil)
+
+	ioutil.WriteFile(wd+"/file", []byte("abcdef"), 0644)
+	ioutil.WriteFile(wd+"/other", nil, 0644)
+	time.Sleep(10 * time.Millisecond)
+	if a, _ := cfs.GetAttr("file", nil); a.Size != 6 {
+		t.Errorf("got size %d after AttrTTL, want 6", a.Size)
+	}
+	if entries, _ := cfs.OpenDir("", nil); len(entries) != 1 {
+		t.Errorf("got %v within DirTTL, want cached listing", entries)
+	}
+}
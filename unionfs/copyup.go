@@ -0,0 +1,518 @@
+package unionfs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// CopyUpPolicy says when a file of a read-only branch is copied to
+// the writable branch, so it can be changed.
+type CopyUpPolicy int
+
+const (
+	// Copy the whole file when it is opened for writing.
+	COPYUP_ON_OPEN = CopyUpPolicy(0)
+
+	// Copy the whole file on the first write through a handle
+	// opened for writing, or when it is opened with O_TRUNC.
+	COPYUP_ON_WRITE = CopyUpPolicy(1)
+
+	// Put a sparse file in the writable branch, and only store
+	// the ranges that are written there.  The rest is read from
+	// the read-only branch.  The ranges are kept in the
+	// user.unionfs.partial xattr, so the writable branch must
+	// support user xattrs, and must always be used with this
+	// policy and the same read-only branches.
+	COPYUP_LAZY = CopyUpPolicy(2)
+
+	// Do not copy files: changing files of read-only branches
+	// returns EROFS.  New files can still be created.
+	COPYUP_DENY = CopyUpPolicy(3)
+)
+
+// copyFile copies the regular file name, with attributes a, from
+// branch src to the writable branch.
+func (fs *UnionFs) copyFile(src fuse.FileSystem, name string, a *fuse.Attr, context *fuse.Context) fuse.Status {
+	if fs.options.CopyUp != COPYUP_LAZY || a.Size == 0 {
+		return fuse.CopyFile(src, fs.writable, name, name, context)
+	}
+
+	f, code := fs.writable.Create(name, uint32(os.O_WRONLY|os.O_CREATE|os.O_TRUNC), a.Mode, context)
+	if !code.Ok() {
+		return code
+	}
+	f.Release(&fuse.ReleaseIn{})
+
+	// Mark the copy before it gets its size, so it is never taken
+	// for a complete one.
+	p := &partialCopy{source: name}
+	code = fs.writable.SetXAttr(name, _PARTIAL_XATTR, p.encode(), 0, context)
+	if !code.Ok() {
+		log.Printf("UnionFs: cannot mark partial copy %q (%v), copying it fully", name, code)
+		return fuse.CopyFile(src, fs.writable, name, name, context)
+	}
+	return fs.writable.Truncate(name, a.Size, context)
+}
+
+// promoteOpenFile copies the file of a handle that was opened for
+// writing under COPYUP_ON_WRITE, before it is written.
+func (fs *UnionFs) promoteOpenFile(uf *unionFsFile) fuse.Status {
+	fs.promoteLock.Lock()
+	defer fs.promoteLock.Unlock()
+	if uf.layer == 0 {
+		return fuse.OK
+	}
+
+	name := fs.nodeFs.Path(uf.node)
+	r := fs.getBranch(name)
+	if r.branch > 0 {
+		if code := fs.Promote(name, r, nil); !code.Ok() {
+			return code
+		}
+	}
+	if uf.layer > 0 {
+		log.Println("UnionFs: open file was not promoted:", name)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// openWritable opens a file of the writable branch, taking care of
+// partial copies.
+func (fs *UnionFs) openWritable(name string, flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	f, code := fs.writable.Open(name, flags, context)
+	if !code.Ok() || fs.options.CopyUp != COPYUP_LAZY {
+		return f, code
+	}
+	p, code := fs.getPartial(name)
+	if !code.Ok() {
+		f.Release(&fuse.ReleaseIn{})
+		return nil, code
+	}
+	if p == nil {
+		return f, fuse.OK
+	}
+	return &partialFile{File: f, ufs: fs, partial: p, name: name}, fuse.OK
+}
+
+// truncatePartial truncates name, which may be a partial copy.
+func (fs *UnionFs) truncatePartial(name string, size uint64, context *fuse.Context) fuse.Status {
+	if fs.options.CopyUp != COPYUP_LAZY {
+		return fs.writable.Truncate(name, size, context)
+	}
+	p, code := fs.getPartial(name)
+	if !code.Ok() {
+		return code
+	}
+	if p == nil {
+		return fs.writable.Truncate(name, size, context)
+	}
+	defer fs.putPartial(p)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	a, code := fs.writable.GetAttr(name, context)
+	if code.Ok() {
+		code = fs.writable.Truncate(name, size, context)
+	}
+	if code.Ok() {
+		code = fs.truncated(p, name, a.Size, size)
+	}
+	return code
+}
+
+////////////////
+// Partial copies.
+
+const _PARTIAL_XATTR = "user.unionfs.partial"
+
+// extent is the byte range [start, end).
+type extent struct {
+	start, end uint64
+}
+
+// extents is a sorted list of disjoint, non-adjacent extents.
+type extents []extent
+
+// add returns e with [start, end) added.
+func (e extents) add(start, end uint64) extents {
+	if start >= end {
+		return e
+	}
+	var out extents
+	for _, x := range e {
+		switch {
+		case x.end < start || x.start > end:
+			out = append(out, x)
+		default:
+			if x.start < start {
+				start = x.start
+			}
+			if x.end > end {
+				end = x.end
+			}
+		}
+	}
+	out = append(out, extent{start, end})
+	sort.Sort(out)
+	return out
+}
+
+// clip returns e without the bytes from size on.
+func (e extents) clip(size uint64) extents {
+	var out extents
+	for _, x := range e {
+		if x.start >= size {
+			break
+		}
+		if x.end > size {
+			x.end = size
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// missing returns the parts of [start, end) that are not in e.
+func (e extents) missing(start, end uint64) extents {
+	var out extents
+	for _, x := range e {
+		if x.end <= start {
+			continue
+		}
+		if x.start >= end {
+			break
+		}
+		if x.start > start {
+			out = append(out, extent{start, x.start})
+		}
+		start = x.end
+	}
+	if start < end {
+		out = append(out, extent{start, end})
+	}
+	return out
+}
+
+func (e extents) Len() int           { return len(e) }
+func (e extents) Less(i, j int) bool { return e[i].start < e[j].start }
+func (e extents) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// partialCopy is the state of a partially copied file, shared by its
+// open handles.
+type partialCopy struct {
+	// Key in UnionFs.partials, and reference count; protected by
+	// UnionFs.partialLock.
+	ino  uint64
+	refs int
+
+	lock sync.Mutex
+
+	// The path of the file in the read-only branches.
+	source string
+
+	// The ranges of the file stored in the writable branch.
+	copied extents
+
+	// The source file, opened on the first read of data that was
+	// not copied.
+	lower fuse.File
+
+	// Set when all data is in the writable branch.
+	complete bool
+}
+
+// encode returns the xattr value for p: the source path, a NUL, and
+// the copied ranges as START-END, separated by commas.
+func (p *partialCopy) encode() []byte {
+	var ranges []string
+	for _, x := range p.copied {
+		ranges = append(ranges, fmt.Sprintf("%d-%d", x.start, x.end))
+	}
+	return []byte(p.source + "\x00" + strings.Join(ranges, ","))
+}
+
+func decodePartial(val []byte) (*partialCopy, error) {
+	parts := strings.SplitN(string(val), "\x00", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("no source in %q", val)
+	}
+	p := &partialCopy{source: parts[0]}
+	if parts[1] == "" {
+		return p, nil
+	}
+	for _, r := range strings.Split(parts[1], ",") {
+		se := strings.SplitN(r, "-", 2)
+		if len(se) != 2 {
+			return nil, fmt.Errorf("bad range %q", r)
+		}
+		start, err := strconv.ParseUint(se[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.ParseUint(se[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		p.copied = p.copied.add(start, end)
+	}
+	return p, nil
+}
+
+// getPartial returns the state of name if it is a partial copy, or
+// nil otherwise.  The result must be returned with putPartial.
+func (fs *UnionFs) getPartial(name string) (*partialCopy, fuse.Status) {
+	a, code := fs.writable.GetAttr(name, nil)
+	if !code.Ok() || !a.IsRegular() {
+		return nil, code
+	}
+
+	fs.partialLock.Lock()
+	defer fs.partialLock.Unlock()
+	if p := fs.partials[a.Ino]; p != nil {
+		p.refs++
+		return p, fuse.OK
+	}
+
+	val, code := fs.writable.GetXAttr(name, _PARTIAL_XATTR, nil)
+	if code == fuse.ENODATA || code == fuse.ENOSYS || code == fuse.Status(syscall.ENOTSUP) {
+		return nil, fuse.OK
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	p, err := decodePartial(val)
+	if err != nil {
+		log.Printf("UnionFs: bad partial copy marker on %q: %v", name, err)
+		return nil, fuse.EIO
+	}
+	p.ino = a.Ino
+	p.refs = 1
+	fs.partials[a.Ino] = p
+	return p, fuse.OK
+}
+
+func (fs *UnionFs) putPartial(p *partialCopy) {
+	fs.partialLock.Lock()
+	defer fs.partialLock.Unlock()
+	p.refs--
+	if p.refs > 0 {
+		return
+	}
+	delete(fs.partials, p.ino)
+	if p.lower != nil {
+		p.lower.Release(&fuse.ReleaseIn{})
+		p.lower = nil
+	}
+}
+
+// written records that [start, end) of the partial copy name, of the
+// given size, was stored.  p.lock must be held.
+func (fs *UnionFs) written(p *partialCopy, name string, start, end, size uint64) fuse.Status {
+	if p.complete || len(p.copied.missing(start, end)) == 0 {
+		return fuse.OK
+	}
+	p.copied = p.copied.add(start, end)
+	return fs.savePartial(p, name, size)
+}
+
+// truncated records that the partial copy name changed size.
+// p.lock must be held.
+func (fs *UnionFs) truncated(p *partialCopy, name string, oldSize, newSize uint64) fuse.Status {
+	if p.complete {
+		return fuse.OK
+	}
+	// Data past the old end is zeros now, not data of the source.
+	p.copied = p.copied.clip(newSize).add(oldSize, newSize)
+	return fs.savePartial(p, name, newSize)
+}
+
+func (fs *UnionFs) savePartial(p *partialCopy, name string, size uint64) fuse.Status {
+	if len(p.copied.missing(0, size)) == 0 {
+		// Fully copied: from now on, this is a normal file.
+		code := fs.writable.RemoveXAttr(name, _PARTIAL_XATTR, nil)
+		if code.Ok() {
+			p.complete = true
+		}
+		return code
+	}
+	return fs.writable.SetXAttr(name, _PARTIAL_XATTR, p.encode(), 0, nil)
+}
+
+// readSource reads [start, end) of the source of p.  p.lock must be
+// held.
+func (fs *UnionFs) readSource(p *partialCopy, dest []byte, start uint64, bp fuse.BufferPool) fuse.Status {
+	if p.lower == nil {
+		code := fuse.ENOENT
+		for _, b := range fs.branches()[1:] {
+			p.lower, code = b.Open(p.source, uint32(os.O_RDONLY), nil)
+			if code.Ok() {
+				break
+			}
+		}
+		if !code.Ok() {
+			log.Printf("UnionFs: source %q of partial copy: %v", p.source, code)
+			return fuse.EIO
+		}
+	}
+
+	for len(dest) > 0 {
+		data, code := p.lower.Read(&fuse.ReadIn{Offset: start, Size: uint32(len(dest))}, bp)
+		if !code.Ok() {
+			return code
+		}
+		n := copy(dest, data)
+		bp.FreeBuffer(data)
+		if n == 0 {
+			// The source is shorter: the rest reads as zeros.
+			for i := range dest {
+				dest[i] = 0
+			}
+			break
+		}
+		dest = dest[n:]
+		start += uint64(n)
+	}
+	return fuse.OK
+}
+
+// partialFile is an open partial copy.  Its data comes from the
+// writable branch where it was copied, and from the source
+// elsewhere.
+type partialFile struct {
+	fuse.File
+	ufs     *UnionFs
+	partial *partialCopy
+
+	// The name at opening, for updating the xattr.
+	name string
+	node *fuse.Inode
+}
+
+func (f *partialFile) String() string {
+	return fmt.Sprintf("partialFile(%s)", f.File.String())
+}
+
+func (f *partialFile) InnerFile() fuse.File {
+	return f.File
+}
+
+func (f *partialFile) SetInode(node *fuse.Inode) {
+	f.node = node
+	f.File.SetInode(node)
+}
+
+// path returns the current name of the file.
+func (f *partialFile) path() string {
+	if f.node != nil && f.ufs.nodeFs != nil {
+		if p := f.ufs.nodeFs.Path(f.node); p != "" {
+			return p
+		}
+	}
+	return f.name
+}
+
+func (f *partialFile) size() (uint64, fuse.Status) {
+	var a fuse.Attr
+	code := f.File.GetAttr(&a)
+	return a.Size, code
+}
+
+func (f *partialFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	p := f.partial
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.complete {
+		return f.File.Read(input, bp)
+	}
+
+	size, code := f.size()
+	if !code.Ok() {
+		return nil, code
+	}
+	start, end := input.Offset, input.Offset+uint64(input.Size)
+	if end > size {
+		end = size
+	}
+	if start >= end {
+		return []byte{}, fuse.OK
+	}
+	missing := p.copied.missing(start, end)
+	if len(missing) == 0 {
+		return f.File.Read(input, bp)
+	}
+
+	// Read what is there, and fill in the rest from the source.
+	buf := make([]byte, end-start)
+	data, code := f.File.Read(&fuse.ReadIn{Offset: start, Size: uint32(end - start)}, bp)
+	if !code.Ok() {
+		return nil, code
+	}
+	copy(buf, data)
+	bp.FreeBuffer(data)
+	for _, x := range missing {
+		if code := f.ufs.readSource(p, buf[x.start-start:x.end-start], x.start, bp); !code.Ok() {
+			return nil, code
+		}
+	}
+	return buf, fuse.OK
+}
+
+func (f *partialFile) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	p := f.partial
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.complete {
+		return f.File.Write(input, data)
+	}
+	size, code := f.size()
+	if !code.Ok() {
+		return 0, code
+	}
+	n, code := f.File.Write(input, data)
+	if !code.Ok() {
+		return n, code
+	}
+
+	// Writing past the end leaves a hole, which reads as zeros.
+	start, end := input.Offset, input.Offset+uint64(n)
+	if start > size {
+		start = size
+	}
+	if end > size {
+		size = end
+	}
+	return n, f.ufs.written(p, f.path(), start, end, size)
+}
+
+func (f *partialFile) Truncate(size uint64, context *fuse.Context) fuse.Status {
+	p := f.partial
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	old, code := f.size()
+	if code.Ok() {
+		code = f.File.Truncate(size, context)
+	}
+	if code.Ok() {
+		code = f.ufs.truncated(p, f.path(), old, size)
+	}
+	return code
+}
+
+// Setattr is applied piecewise, so size changes go through Truncate.
+func (f *partialFile) Setattr(valid uint32, attr *fuse.Attr, context *fuse.Context) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *partialFile) Release(input *fuse.ReleaseIn) {
+	f.File.Release(input)
+	f.ufs.putPartial(f.partial)
+}
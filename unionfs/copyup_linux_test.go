@@ -0,0 +1,69 @@
+package unionfs
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestUnionFsCopyUpLazy(t *testing.T) {
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	tc := newCopyUpTestCase(t, COPYUP_LAZY, content)
+	defer tc.Clean()
+
+	id, fh, code := tc.open("file", os.O_RDWR)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	tc.write(id, fh, 500000, "XY")
+	tc.release(id, fh)
+
+	want := append([]byte{}, content...)
+	copy(want[500000:], "XY")
+
+	var st syscall.Stat_t
+	CheckSuccess(syscall.Stat(tc.wd+"/rw/file", &st))
+	if st.Size != int64(len(content)) || st.Blocks*512 >= st.Size {
+		t.Errorf("copy is not sparse: size %d, %d blocks", st.Size, st.Blocks)
+	}
+
+	id, fh, code = tc.open("file", os.O_RDONLY)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	for _, off := range []uint64{0, 499990, 500001, 1<<20 - 100} {
+		got := tc.read(id, fh, off, 4096)
+		end := off + 4096
+		if end > uint64(len(want)) {
+			end = uint64(len(want))
+		}
+		if !bytes.Equal(got, want[off:end]) {
+			t.Errorf("read at %d differs", off)
+		}
+	}
+	tc.release(id, fh)
+
+	// Growing the file adds zeros, not data of the source.
+	if code := tc.ufs.Truncate("file", 10, nil); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	if code := tc.ufs.Truncate("file", 20, nil); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	id, fh, _ = tc.open("file", os.O_RDWR)
+	want = append(append([]byte{}, content[:10]...), make([]byte, 10)...)
+	if got := tc.read(id, fh, 0, 100); !bytes.Equal(got, want) {
+		t.Errorf("after truncate: got %v, want %v", got, want)
+	}
+
+	// Once all is written, the file is a normal copy.
+	tc.write(id, fh, 0, "0123456789")
+	tc.release(id, fh)
+	if _, err := syscall.Getxattr(tc.wd+"/rw/file", _PARTIAL_XATTR, nil); err != syscall.ENODATA {
+		t.Errorf("partial marker not removed: %v", err)
+	}
+}
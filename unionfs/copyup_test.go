@@ -0,0 +1,137 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// copyUpTestCase drives a UnionFs through the FileSystemConnector,
+// as the kernel would, so open files are tracked.
+type copyUpTestCase struct {
+	t    *testing.T
+	wd   string
+	ufs  *UnionFs
+	conn *fuse.FileSystemConnector
+}
+
+func newCopyUpTestCase(t *testing.T, policy CopyUpPolicy, content []byte) *copyUpTestCase {
+	wd, _ := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(os.Mkdir(wd+"/rw", 0755))
+	CheckSuccess(os.Mkdir(wd+"/ro", 0755))
+	CheckSuccess(ioutil.WriteFile(wd+"/ro/file", content, 0644))
+
+	opts := testOpts
+	opts.CopyUp = policy
+	ufs := NewUnionFs([]fuse.FileSystem{
+		fuse.NewLoopbackFileSystem(wd + "/rw"),
+		fuse.NewLoopbackFileSystem(wd + "/ro"),
+	}, opts)
+	conn := fuse.NewFileSystemConnector(fuse.NewPathNodeFs(ufs, nil), nil)
+	return &copyUpTestCase{t, wd, ufs, conn}
+}
+
+func (tc *copyUpTestCase) Clean() {
+	os.RemoveAll(tc.wd)
+}
+
+func (tc *copyUpTestCase) open(name string, flags int) (nodeId uint64, fh uint64, code fuse.Status) {
+	var entry raw.EntryOut
+	code = tc.conn.Lookup(&entry, &raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, name)
+	if !code.Ok() {
+		tc.t.Fatalf("Lookup(%q): %v", name, code)
+	}
+	var out raw.OpenOut
+	code = tc.conn.Open(&out, &raw.InHeader{NodeId: entry.NodeId}, &raw.OpenIn{Flags: uint32(flags)})
+	return entry.NodeId, out.Fh, code
+}
+
+func (tc *copyUpTestCase) write(nodeId, fh uint64, off uint64, data string) {
+	n, code := tc.conn.Write(&raw.InHeader{NodeId: nodeId}, &fuse.WriteIn{Fh: fh, Offset: off}, []byte(data))
+	if !code.Ok() || int(n) != len(data) {
+		tc.t.Fatalf("Write: %d, %v", n, code)
+	}
+}
+
+func (tc *copyUpTestCase) read(nodeId, fh uint64, off uint64, size uint32) []byte {
+	data, code := tc.conn.Read(&raw.InHeader{NodeId: nodeId}, &fuse.ReadIn{Fh: fh, Offset: off, Size: size}, fuse.NewBufferPool())
+	if !code.Ok() {
+		tc.t.Fatalf("Read: %v", code)
+	}
+	return data
+}
+
+func (tc *copyUpTestCase) release(nodeId, fh uint64) {
+	tc.conn.Release(&raw.InHeader{NodeId: nodeId}, &raw.ReleaseIn{Fh: fh})
+}
+
+func TestUnionFsCopyUpOnWrite(t *testing.T) {
+	tc := newCopyUpTestCase(t, COPYUP_ON_WRITE, []byte("0123456789"))
+	defer tc.Clean()
+
+	id, fh, code := tc.open("file", os.O_RDWR)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	if _, err := os.Lstat(tc.wd + "/rw/file"); err == nil {
+		t.Errorf("file copied on open")
+	}
+	if got := tc.read(id, fh, 0, 10); string(got) != "0123456789" {
+		t.Errorf("read before write: %q", got)
+	}
+
+	tc.write(id, fh, 2, "ab")
+	if got := tc.read(id, fh, 0, 10); string(got) != "01ab456789" {
+		t.Errorf("read after write: %q", got)
+	}
+	tc.release(id, fh)
+
+	if c, _ := ioutil.ReadFile(tc.wd + "/rw/file"); string(c) != "01ab456789" {
+		t.Errorf("copied file: %q", c)
+	}
+	if c, _ := ioutil.ReadFile(tc.wd + "/ro/file"); string(c) != "0123456789" {
+		t.Errorf("read-only file changed: %q", c)
+	}
+}
+
+func TestUnionFsCopyUpSparse(t *testing.T) {
+	tc := newCopyUpTestCase(t, COPYUP_ON_OPEN, []byte("data"))
+	defer tc.Clean()
+	CheckSuccess(os.Truncate(tc.wd+"/ro/file", 64<<20))
+
+	id, fh, code := tc.open("file", os.O_RDWR)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	tc.release(id, fh)
+
+	var st syscall.Stat_t
+	CheckSuccess(syscall.Stat(tc.wd+"/rw/file", &st))
+	if st.Size != 64<<20 || st.Blocks*512 >= 1<<20 {
+		t.Errorf("copy has size %d, %d blocks", st.Size, st.Blocks)
+	}
+}
+
+func TestUnionFsCopyUpDeny(t *testing.T) {
+	tc := newCopyUpTestCase(t, COPYUP_DENY, []byte("data"))
+	defer tc.Clean()
+
+	if _, _, code := tc.open("file", os.O_WRONLY); code != fuse.EROFS {
+		t.Errorf("Open for writing: got %v, want EROFS", code)
+	}
+	if code := tc.ufs.Chmod("file", 0600, nil); code != fuse.EROFS {
+		t.Errorf("Chmod: got %v, want EROFS", code)
+	}
+	if _, _, code := tc.open("file", os.O_RDONLY); !code.Ok() {
+		t.Errorf("Open for reading: %v", code)
+	}
+	f, code := tc.ufs.Create("new", uint32(os.O_WRONLY|os.O_CREATE), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release(&fuse.ReleaseIn{})
+}
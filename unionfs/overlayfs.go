@@ -0,0 +1,629 @@
+package unionfs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+// OverlayFs combines a read-only lower FileSystem with a writable
+// upper FileSystem, in the style of the kernel's overlayfs.  Unlike
+// the kernel version, the layers can be any FileSystem, so it also
+// works for lower layers that are not local file systems, or for
+// unprivileged users.
+//
+// Serve it through a PathNodeFs:
+//
+//	nodeFs := fuse.NewPathNodeFs(unionfs.NewOverlayFs(lower, upper), nil)
+//
+// Implementation notes.
+//
+// * Entries in upper hide entries of the same name in lower.
+//
+// * Writing to a lower entry (opening it for writing, changing its
+// attributes or xattrs, linking it) first copies it up: it and its
+// parent directories are copied to upper.  Files already opened for
+// reading keep reading the lower copy.
+//
+// * Deleting an entry that exists in lower puts a whiteout, an empty
+// file named .wh.NAME, next to it in upper.
+//
+// * A directory created in place of a deleted one is marked opaque
+// with a file called .wh..wh..opq, so the contents of the lower
+// directory no longer show through.
+//
+// * These are the aufs conventions, so the upper layer can also be
+// used with aufs tools.  Names starting with .wh. are reserved.
+//
+// * Renaming a directory that exists in lower returns EXDEV, which
+// makes mv(1) fall back to copying.
+type OverlayFs struct {
+	fuse.DefaultFileSystem
+
+	lower fuse.FileSystem
+	upper fuse.FileSystem
+
+	// Serializes copy-ups.
+	copyLock sync.Mutex
+}
+
+const (
+	_WHITEOUT_PREFIX = ".wh."
+	_OPAQUE_NAME     = ".wh..wh..opq"
+)
+
+func NewOverlayFs(lower, upper fuse.FileSystem) *OverlayFs {
+	return &OverlayFs{
+		lower: lower,
+		upper: upper,
+	}
+}
+
+func (fs *OverlayFs) String() string {
+	return fmt.Sprintf("OverlayFs(%v, %v)", fs.lower, fs.upper)
+}
+
+func isMarker(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), _WHITEOUT_PREFIX)
+}
+
+func whiteoutPath(name string) string {
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, _WHITEOUT_PREFIX+base)
+}
+
+func opaquePath(dir string) string {
+	return filepath.Join(dir, _OPAQUE_NAME)
+}
+
+func (fs *OverlayFs) upperExists(name string) bool {
+	_, code := fs.upper.GetAttr(name, nil)
+	return code.Ok()
+}
+
+// lowerHidden returns true if the lower entry for name is hidden by a
+// whiteout of it or its parents, or by an opaque parent.
+func (fs *OverlayFs) lowerHidden(name string) bool {
+	for p := name; ; p = parentDir(p) {
+		if p != "" && fs.upperExists(whiteoutPath(p)) {
+			return true
+		}
+		if p != name && fs.upperExists(opaquePath(p)) {
+			return true
+		}
+		if p == "" {
+			return false
+		}
+	}
+}
+
+// lowerExists returns true if lower has an entry for name, whether
+// visible or not.
+func (fs *OverlayFs) lowerExists(name string) bool {
+	_, code := fs.lower.GetAttr(name, nil)
+	return code.Ok()
+}
+
+// lookup returns the attributes of name, and whether they came from
+// the upper layer.
+func (fs *OverlayFs) lookup(name string, context *fuse.Context) (a *fuse.Attr, isUpper bool, code fuse.Status) {
+	if name != "" && isMarker(name) {
+		return nil, false, fuse.ENOENT
+	}
+	a, code = fs.upper.GetAttr(name, context)
+	if code != fuse.ENOENT {
+		return a, true, code
+	}
+	if fs.lowerHidden(name) {
+		return nil, false, fuse.ENOENT
+	}
+	a, code = fs.lower.GetAttr(name, context)
+	return a, false, code
+}
+
+// layer returns the file system that holds name.
+func (fs *OverlayFs) layer(name string, context *fuse.Context) (fuse.FileSystem, fuse.Status) {
+	_, isUpper, code := fs.lookup(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if isUpper {
+		return fs.upper, fuse.OK
+	}
+	return fs.lower, fuse.OK
+}
+
+// putMarker creates an empty whiteout or opaque marker.
+func (fs *OverlayFs) putMarker(name string) fuse.Status {
+	if code := fs.copyUpDirs(name, nil); !code.Ok() {
+		return code
+	}
+	f, code := fs.upper.Create(name, uint32(os.O_WRONLY|os.O_TRUNC), 0644, nil)
+	if !code.Ok() {
+		log.Printf("OverlayFs: cannot create %q: %v", name, code)
+		return code
+	}
+	f.Release(&fuse.ReleaseIn{})
+	return fuse.OK
+}
+
+// removeWhiteout removes the whiteout for name, and returns true if
+// there was one.
+func (fs *OverlayFs) removeWhiteout(name string) bool {
+	return fs.upper.Unlink(whiteoutPath(name), nil).Ok()
+}
+
+// clearMarkers removes the whiteouts and opaque marker from an upper
+// directory, so it can be removed.
+func (fs *OverlayFs) clearMarkers(dir string) fuse.Status {
+	entries, code := fs.upper.OpenDir(dir, nil)
+	if !code.Ok() {
+		return code
+	}
+	for _, e := range entries {
+		if !isMarker(e.Name) {
+			continue
+		}
+		if code := fs.upper.Unlink(filepath.Join(dir, e.Name), nil); !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+// checkName refuses to create names that could be taken for markers.
+func checkName(name string) fuse.Status {
+	if isMarker(name) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+////////////////
+// Copy-up.
+
+// copyUpDirs makes sure the parent directories of name exist in
+// upper.
+func (fs *OverlayFs) copyUpDirs(name string, context *fuse.Context) fuse.Status {
+	var todo []string
+	for dir := parentDir(name); dir != "" && !fs.upperExists(dir); dir = parentDir(dir) {
+		todo = append(todo, dir)
+	}
+	for i := len(todo) - 1; i >= 0; i-- {
+		a, code := fs.lower.GetAttr(todo[i], context)
+		if !code.Ok() {
+			return code
+		}
+		if !a.IsDir() {
+			return fuse.ENOTDIR
+		}
+		if code := fs.copyUpAttr(todo[i], a, context); !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+// copyUp copies name to upper, if it is not there yet.
+func (fs *OverlayFs) copyUp(name string, context *fuse.Context) fuse.Status {
+	fs.copyLock.Lock()
+	defer fs.copyLock.Unlock()
+
+	a, isUpper, code := fs.lookup(name, context)
+	if !code.Ok() || isUpper {
+		return code
+	}
+	if code := fs.copyUpDirs(name, context); !code.Ok() {
+		return code
+	}
+	return fs.copyUpAttr(name, a, context)
+}
+
+// copyUpAttr copies the lower entry name with attributes a to upper.
+func (fs *OverlayFs) copyUpAttr(name string, a *fuse.Attr, context *fuse.Context) (code fuse.Status) {
+	switch {
+	case a.IsRegular():
+		code = fuse.CopyFile(fs.lower, fs.upper, name, name, context)
+	case a.IsDir():
+		code = fs.upper.Mkdir(name, a.Mode&07777, context)
+	case a.IsSymlink():
+		var link string
+		link, code = fs.lower.Readlink(name, context)
+		if code.Ok() {
+			code = fs.upper.Symlink(link, name, context)
+		}
+	default:
+		code = fs.upper.Mknod(name, a.Mode, a.Rdev, context)
+	}
+	if !code.Ok() {
+		log.Printf("OverlayFs: copy-up of %q failed: %v", name, code)
+		return code
+	}
+
+	if !a.IsSymlink() {
+		code = fs.upper.Chmod(name, a.Mode&07777, context)
+		if !code.Ok() {
+			return code
+		}
+	}
+
+	// Ownership can only be kept if we run as root.
+	fs.upper.Chown(name, a.Uid, a.Gid, context)
+
+	if attrs, code := fs.lower.ListXAttr(name, context); code.Ok() {
+		for _, attr := range attrs {
+			if data, code := fs.lower.GetXAttr(name, attr, context); code.Ok() {
+				fs.upper.SetXAttr(name, attr, data, 0, context)
+			}
+		}
+	}
+
+	if !a.IsSymlink() {
+		atime, mtime := a.AccessTime(), a.ModTime()
+		code = fs.upper.Utimens(name, &atime, &mtime, context)
+	}
+	return code
+}
+
+////////////////////////////////////////////////////////////////
+// Below: implement interface for a FileSystem.
+
+func (fs *OverlayFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	a, _, code := fs.lookup(name, context)
+	return a, code
+}
+
+func (fs *OverlayFs) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	_, isUpper, code := fs.lookup(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if isUpper {
+		return fs.upper.Access(name, mode, context)
+	}
+	// Lower entries are copied up on writing.
+	return fs.lower.Access(name, mode&^raw.W_OK, context)
+}
+
+func (fs *OverlayFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	layer, code := fs.layer(name, context)
+	if !code.Ok() {
+		return "", code
+	}
+	return layer.Readlink(name, context)
+}
+
+func (fs *OverlayFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	layer, code := fs.layer(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return layer.GetXAttr(name, attr, context)
+}
+
+func (fs *OverlayFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	layer, code := fs.layer(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return layer.ListXAttr(name, context)
+}
+
+func (fs *OverlayFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if code := fs.copyUp(name, context); !code.Ok() {
+		return code
+	}
+	return fs.upper.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *OverlayFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if code := fs.copyUp(name, context); !code.Ok() {
+		return code
+	}
+	return fs.upper.RemoveXAttr(name, attr, context)
+}
+
+func (fs *OverlayFs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.copyUp(name, context); !code.Ok() {
+		return code
+	}
+	return fs.upper.Chmod(name, mode, context)
+}
+
+func (fs *OverlayFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if code := fs.copyUp(name, context); !code.Ok() {
+		return code
+	}
+	return fs.upper.Chown(name, uid, gid, context)
+}
+
+func (fs *OverlayFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if code := fs.copyUp(name, context); !code.Ok() {
+		return code
+	}
+	return fs.upper.Utimens(name, atime, mtime, context)
+}
+
+func (fs *OverlayFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if code := fs.copyUp(name, context); !code.Ok() {
+		return code
+	}
+	return fs.upper.Truncate(name, size, context)
+}
+
+func (fs *OverlayFs) Open(name string, flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	_, isUpper, code := fs.lookup(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if isUpper {
+		return fs.upper.Open(name, flags, context)
+	}
+	if flags&fuse.O_ANYWRITE == 0 {
+		return fs.lower.Open(name, flags, context)
+	}
+	if code := fs.copyUp(name, context); !code.Ok() {
+		return nil, code
+	}
+	return fs.upper.Open(name, flags, context)
+}
+
+// prepareCreate readies upper for creating a new entry name.
+func (fs *OverlayFs) prepareCreate(name string, context *fuse.Context) fuse.Status {
+	if code := checkName(name); !code.Ok() {
+		return code
+	}
+	if _, _, code := fs.lookup(name, context); code.Ok() {
+		return fuse.Status(syscall.EEXIST)
+	}
+	return fs.copyUpDirs(name, context)
+}
+
+func (fs *OverlayFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	if _, _, code := fs.lookup(name, context); code.Ok() {
+		if int(flags)&os.O_EXCL != 0 {
+			return nil, fuse.Status(syscall.EEXIST)
+		}
+		return fs.Open(name, flags, context)
+	}
+	if code := fs.prepareCreate(name, context); !code.Ok() {
+		return nil, code
+	}
+	f, code := fs.upper.Create(name, flags, mode, context)
+	if code.Ok() {
+		fs.removeWhiteout(name)
+	}
+	return f, code
+}
+
+func (fs *OverlayFs) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if code := fs.prepareCreate(name, context); !code.Ok() {
+		return code
+	}
+	code := fs.upper.Mknod(name, mode, dev, context)
+	if code.Ok() {
+		fs.removeWhiteout(name)
+	}
+	return code
+}
+
+func (fs *OverlayFs) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if code := fs.prepareCreate(linkName, context); !code.Ok() {
+		return code
+	}
+	code := fs.upper.Symlink(value, linkName, context)
+	if code.Ok() {
+		fs.removeWhiteout(linkName)
+	}
+	return code
+}
+
+func (fs *OverlayFs) Link(orig string, newName string, context *fuse.Context) fuse.Status {
+	if code := fs.copyUp(orig, context); !code.Ok() {
+		return code
+	}
+	if code := fs.prepareCreate(newName, context); !code.Ok() {
+		return code
+	}
+	code := fs.upper.Link(orig, newName, context)
+	if code.Ok() {
+		fs.removeWhiteout(newName)
+	}
+	return code
+}
+
+func (fs *OverlayFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.prepareCreate(name, context); !code.Ok() {
+		return code
+	}
+	code := fs.upper.Mkdir(name, mode, context)
+	if !code.Ok() {
+		return code
+	}
+	if fs.upperExists(whiteoutPath(name)) {
+		// The directory replaces a deleted one, whose contents
+		// should stay hidden.
+		if code := fs.putMarker(opaquePath(name)); !code.Ok() {
+			return code
+		}
+		fs.removeWhiteout(name)
+	}
+	return fuse.OK
+}
+
+func (fs *OverlayFs) Unlink(name string, context *fuse.Context) fuse.Status {
+	a, isUpper, code := fs.lookup(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if a.IsDir() {
+		return fuse.Status(syscall.EISDIR)
+	}
+	if isUpper {
+		if code := fs.upper.Unlink(name, context); !code.Ok() {
+			return code
+		}
+	}
+	if fs.lowerExists(name) {
+		return fs.putMarker(whiteoutPath(name))
+	}
+	return fuse.OK
+}
+
+func (fs *OverlayFs) Rmdir(name string, context *fuse.Context) fuse.Status {
+	a, isUpper, code := fs.lookup(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if !a.IsDir() {
+		return fuse.ENOTDIR
+	}
+	entries, code := fs.OpenDir(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if len(entries) > 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	if isUpper {
+		if code := fs.clearMarkers(name); !code.Ok() {
+			return code
+		}
+		if code := fs.upper.Rmdir(name, context); !code.Ok() {
+			return code
+		}
+	}
+	if fs.lowerExists(name) {
+		return fs.putMarker(whiteoutPath(name))
+	}
+	return fuse.OK
+}
+
+func (fs *OverlayFs) Rename(src string, dst string, context *fuse.Context) fuse.Status {
+	if code := checkName(dst); !code.Ok() {
+		return code
+	}
+	srcAttr, _, code := fs.lookup(src, context)
+	if !code.Ok() {
+		return code
+	}
+	if srcAttr.IsDir() && fs.lowerExists(src) {
+		// Moving the lower contents would mean copying up the
+		// whole tree.
+		return fuse.Status(syscall.EXDEV)
+	}
+
+	dstAttr, dstUpper, code := fs.lookup(dst, context)
+	if code.Ok() {
+		switch {
+		case srcAttr.IsDir() && !dstAttr.IsDir():
+			return fuse.ENOTDIR
+		case !srcAttr.IsDir() && dstAttr.IsDir():
+			return fuse.Status(syscall.EISDIR)
+		case dstAttr.IsDir():
+			entries, code := fs.OpenDir(dst, context)
+			if !code.Ok() {
+				return code
+			}
+			if len(entries) > 0 {
+				return fuse.Status(syscall.ENOTEMPTY)
+			}
+			if dstUpper {
+				if code := fs.clearMarkers(dst); !code.Ok() {
+					return code
+				}
+			}
+		}
+	} else if code != fuse.ENOENT {
+		return code
+	}
+
+	if code := fs.copyUp(src, context); !code.Ok() {
+		return code
+	}
+	if code := fs.copyUpDirs(dst, context); !code.Ok() {
+		return code
+	}
+	hideLower := fs.lowerExists(dst) || fs.upperExists(whiteoutPath(dst))
+	if code := fs.upper.Rename(src, dst, context); !code.Ok() {
+		return code
+	}
+	if srcAttr.IsDir() && hideLower {
+		if code := fs.putMarker(opaquePath(dst)); !code.Ok() {
+			return code
+		}
+	}
+	fs.removeWhiteout(dst)
+	if fs.lowerExists(src) {
+		return fs.putMarker(whiteoutPath(src))
+	}
+	return fuse.OK
+}
+
+func (fs *OverlayFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	a, isUpper, code := fs.lookup(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if !a.IsDir() {
+		return nil, fuse.ENOTDIR
+	}
+
+	results := map[string]uint32{}
+	whiteouts := map[string]bool{}
+	showLower := !isUpper
+	if isUpper {
+		entries, code := fs.upper.OpenDir(name, context)
+		if !code.Ok() {
+			return nil, code
+		}
+		opaque := false
+		for _, e := range entries {
+			switch {
+			case e.Name == _OPAQUE_NAME:
+				opaque = true
+			case isMarker(e.Name):
+				whiteouts[strings.TrimPrefix(e.Name, _WHITEOUT_PREFIX)] = true
+			default:
+				results[e.Name] = e.Mode
+			}
+		}
+		showLower = !opaque && !fs.lowerHidden(name)
+	}
+
+	if showLower {
+		// The lower directory may legitimately be missing.
+		entries, _ := fs.lower.OpenDir(name, context)
+		for _, e := range entries {
+			if _, ok := results[e.Name]; ok || whiteouts[e.Name] || isMarker(e.Name) {
+				continue
+			}
+			results[e.Name] = e.Mode
+		}
+	}
+
+	stream := make([]fuse.DirEntry, 0, len(results))
+	for k, v := range results {
+		stream = append(stream, fuse.DirEntry{
+			Name: k,
+			Mode: v,
+		})
+	}
+	return stream, fuse.OK
+}
+
+func (fs *OverlayFs) StatFs(name string) *fuse.StatfsOut {
+	return fs.upper.StatFs("")
+}
+
+func (fs *OverlayFs) SyncFs(context *fuse.Context) fuse.Status {
+	return fs.upper.SyncFs(context)
+}
@@ -0,0 +1,184 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// setupOverlayFs creates lower and upper directories in a temporary
+// directory, and returns the OverlayFs combining them.
+func setupOverlayFs(t *testing.T) (fs *OverlayFs, wd string, cleanup func()) {
+	wd, _ = ioutil.TempDir("", "go-fuse")
+	CheckSuccess(os.Mkdir(wd+"/lower", 0755))
+	CheckSuccess(os.Mkdir(wd+"/upper", 0755))
+	CheckSuccess(os.Mkdir(wd+"/lower/dir", 0755))
+	CheckSuccess(ioutil.WriteFile(wd+"/lower/dir/file", []byte("lower"), 0644))
+	CheckSuccess(ioutil.WriteFile(wd+"/lower/dir/other", []byte("other"), 0644))
+	CheckSuccess(os.Symlink("file", wd+"/lower/dir/link"))
+
+	fs = NewOverlayFs(fuse.NewLoopbackFileSystem(wd+"/lower"),
+		fuse.NewLoopbackFileSystem(wd+"/upper"))
+	return fs, wd, func() { os.RemoveAll(wd) }
+}
+
+func overlayNames(t *testing.T, fs *OverlayFs, dir string) []string {
+	entries, code := fs.OpenDir(dir, nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDir(%q): %v", dir, code)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkNames(t *testing.T, fs *OverlayFs, dir string, want ...string) {
+	got := overlayNames(t, fs, dir)
+	if len(got) != len(want) {
+		t.Errorf("OpenDir(%q): got %v, want %v", dir, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("OpenDir(%q): got %v, want %v", dir, got, want)
+			return
+		}
+	}
+}
+
+func TestOverlayFsCopyUp(t *testing.T) {
+	fs, wd, clean := setupOverlayFs(t)
+	defer clean()
+
+	CheckSuccess(os.Chmod(wd+"/lower/dir/file", 0640))
+	f, code := fs.Open("dir/file", uint32(os.O_WRONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	f.Write(&fuse.WriteIn{}, []byte("UPPER"))
+	f.Release(&fuse.ReleaseIn{})
+
+	if c, _ := ioutil.ReadFile(wd + "/upper/dir/file"); string(c) != "UPPER" {
+		t.Errorf("upper content %q", c)
+	}
+	if c, _ := ioutil.ReadFile(wd + "/lower/dir/file"); string(c) != "lower" {
+		t.Errorf("lower content changed: %q", c)
+	}
+	if fi, err := os.Stat(wd + "/upper/dir/file"); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("copied up file: %v, %v", fi, err)
+	}
+	if _, err := os.Lstat(wd + "/upper/dir/other"); err == nil {
+		t.Errorf("copied up unrelated file")
+	}
+
+	if code := fs.Chmod("dir/link", 0755, nil); !code.Ok() {
+		t.Fatalf("Chmod: %v", code)
+	}
+	if l, err := os.Readlink(wd + "/upper/dir/link"); err != nil || l != "file" {
+		t.Errorf("copied up link: %q, %v", l, err)
+	}
+	checkNames(t, fs, "dir", "file", "link", "other")
+}
+
+func TestOverlayFsWhiteout(t *testing.T) {
+	fs, wd, clean := setupOverlayFs(t)
+	defer clean()
+
+	if code := fs.Unlink("dir/file", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if _, code := fs.GetAttr("dir/file", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr after Unlink: %v", code)
+	}
+	if _, err := os.Lstat(wd + "/upper/dir/.wh.file"); err != nil {
+		t.Errorf("whiteout missing: %v", err)
+	}
+	if _, err := os.Lstat(wd + "/lower/dir/file"); err != nil {
+		t.Errorf("lower file removed: %v", err)
+	}
+	if _, code := fs.GetAttr("dir/.wh.file", nil); code != fuse.ENOENT {
+		t.Errorf("whiteout visible: %v", code)
+	}
+	checkNames(t, fs, "dir", "link", "other")
+
+	f, code := fs.Create("dir/file", uint32(os.O_WRONLY|os.O_CREATE), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release(&fuse.ReleaseIn{})
+	if a, code := fs.GetAttr("dir/file", nil); !code.Ok() || a.Size != 0 {
+		t.Errorf("GetAttr after Create: %v, %v", a, code)
+	}
+	if _, err := os.Lstat(wd + "/upper/dir/.wh.file"); err == nil {
+		t.Errorf("whiteout not removed")
+	}
+	checkNames(t, fs, "dir", "file", "link", "other")
+
+	if code := fs.Mkdir("dir/.wh.x", 0755, nil); code != fuse.EPERM {
+		t.Errorf("Mkdir of marker name: %v", code)
+	}
+}
+
+func TestOverlayFsOpaque(t *testing.T) {
+	fs, wd, clean := setupOverlayFs(t)
+	defer clean()
+
+	if code := fs.Rmdir("dir", nil); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir of full dir: %v", code)
+	}
+	for _, n := range []string{"file", "other", "link"} {
+		if code := fs.Unlink("dir/"+n, nil); !code.Ok() {
+			t.Fatalf("Unlink(%q): %v", n, code)
+		}
+	}
+	if code := fs.Rmdir("dir", nil); !code.Ok() {
+		t.Fatalf("Rmdir: %v", code)
+	}
+	checkNames(t, fs, "")
+	if _, err := os.Lstat(wd + "/upper/dir"); err == nil {
+		t.Errorf("upper dir not removed")
+	}
+
+	if code := fs.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	if _, err := os.Lstat(wd + "/upper/dir/.wh..wh..opq"); err != nil {
+		t.Errorf("opaque marker missing: %v", err)
+	}
+	checkNames(t, fs, "dir")
+	if _, code := fs.GetAttr("dir/file", nil); code != fuse.ENOENT {
+		t.Errorf("lower file shows through: %v", code)
+	}
+	checkNames(t, fs, "", "dir")
+}
+
+func TestOverlayFsRename(t *testing.T) {
+	fs, wd, clean := setupOverlayFs(t)
+	defer clean()
+
+	if code := fs.Rename("dir", "newdir", nil); code != fuse.Status(syscall.EXDEV) {
+		t.Errorf("Rename of lower dir: %v", code)
+	}
+	if code := fs.Rename("dir/file", "dir/renamed", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	checkNames(t, fs, "dir", "link", "other", "renamed")
+	if c, _ := ioutil.ReadFile(wd + "/upper/dir/renamed"); string(c) != "lower" {
+		t.Errorf("renamed content %q", c)
+	}
+
+	if code := fs.Rename("dir/renamed", "dir/other", nil); !code.Ok() {
+		t.Fatalf("Rename over lower file: %v", code)
+	}
+	checkNames(t, fs, "dir", "link", "other")
+	if c, _ := ioutil.ReadFile(wd + "/upper/dir/other"); string(c) != "lower" {
+		t.Errorf("replaced content %q", c)
+	}
+}
@@ -2,6 +2,7 @@ package unionfs
 
 import (
 	"log"
+	"strings"
 	"sync"
 	"time"
 )
@@ -71,6 +72,18 @@ func (c *TimedCache) DropEntry(name string) {
 	delete(c.cacheMap, name)
 }
 
+// DropPrefix drops the entries whose name starts with prefix.
+func (c *TimedCache) DropPrefix(prefix string) {
+	c.cacheMapMutex.Lock()
+	defer c.cacheMapMutex.Unlock()
+
+	for k := range c.cacheMap {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.cacheMap, k)
+		}
+	}
+}
+
 func (c *TimedCache) GetFresh(name string) interface{} {
 	data, ok := c.fetch(name)
 	if ok {
@@ -57,7 +57,12 @@ func filePathHash(path string) string {
 type UnionFs struct {
 	fuse.DefaultFileSystem
 
-	// The same, but as interfaces.
+	// The writable branch, which is also fileSystems[0].
+	writable fuse.FileSystem
+
+	// Protects fileSystems, which is replaced rather than
+	// changed when branches are changed.
+	branchLock  sync.RWMutex
 	fileSystems []fuse.FileSystem
 
 	// A file-existence cache.
@@ -69,6 +74,13 @@ type UnionFs struct {
 	// Map of files to hide.
 	hiddenFiles map[string]bool
 
+	// Serializes promotions of open files.
+	promoteLock sync.Mutex
+
+	// Partial copies in use, by inode number.
+	partialLock sync.Mutex
+	partials    map[uint64]*partialCopy
+
 	options *UnionFsOptions
 	nodeFs  *fuse.PathNodeFs
 }
@@ -78,6 +90,24 @@ type UnionFsOptions struct {
 	DeletionCacheTTL time.Duration
 	DeletionDirName  string
 	HiddenFiles      []string
+
+	// How to mark deleted files.  With the overlayfs styles,
+	// DeletionDirName and DeletionCacheTTL are not used.
+	Whiteouts WhiteoutStyle
+
+	// The prefix of the xattrs for opaque directories and xattr
+	// whiteouts. The default is "trusted.overlay.", which needs
+	// root privileges; kernel overlayfs mounted with the userxattr
+	// option uses "user.overlay.".
+	OverlayXAttrPrefix string
+
+	// When to copy files to the writable branch.
+	CopyUp CopyUpPolicy
+
+	// If set, the branches can be changed by writing to the
+	// .branches file in the root.  Only the user running the
+	// file system may write it.
+	BranchesFile bool
 }
 
 const (
@@ -88,15 +118,19 @@ func NewUnionFs(fileSystems []fuse.FileSystem, options UnionFsOptions) *UnionFs
 	g := new(UnionFs)
 	g.options = &options
 	g.fileSystems = fileSystems
+	g.writable = fileSystems[0]
+	g.partials = make(map[uint64]*partialCopy)
 
-	writable := g.fileSystems[0]
-	code := g.createDeletionStore()
-	if !code.Ok() {
-		log.Printf("could not create deletion path %v: %v", options.DeletionDirName, code)
-		return nil
-	}
+	if !g.useWhiteouts() {
+		writable := g.writable
+		code := g.createDeletionStore()
+		if !code.Ok() {
+			log.Printf("could not create deletion path %v: %v", options.DeletionDirName, code)
+			return nil
+		}
 
-	g.deletionCache = NewDirCache(writable, options.DeletionDirName, options.DeletionCacheTTL)
+		g.deletionCache = NewDirCache(writable, options.DeletionDirName, options.DeletionCacheTTL)
+	}
 	g.branchCache = NewTimedCache(
 		func(n string) (interface{}, bool) { return g.getBranchAttrNoCache(n), true },
 		options.BranchCacheTTL)
@@ -120,13 +154,16 @@ func (fs *UnionFs) OnMount(nodeFs *fuse.PathNodeFs) {
 // The isDeleted() method tells us if a path has a marker in the deletion store.
 // It may return an error code if the store could not be accessed.
 func (fs *UnionFs) isDeleted(name string) (deleted bool, code fuse.Status) {
+	if fs.useWhiteouts() {
+		return fs.isWhiteout(name)
+	}
 	marker := fs.deletionPath(name)
 	haveCache, found := fs.deletionCache.HasEntry(filepath.Base(marker))
 	if haveCache {
 		return found, fuse.OK
 	}
 
-	_, code = fs.fileSystems[0].GetAttr(marker, nil)
+	_, code = fs.writable.GetAttr(marker, nil)
 
 	if code == fuse.OK {
 		return true, code
@@ -140,7 +177,7 @@ func (fs *UnionFs) isDeleted(name string) (deleted bool, code fuse.Status) {
 }
 
 func (fs *UnionFs) createDeletionStore() (code fuse.Status) {
-	writable := fs.fileSystems[0]
+	writable := fs.writable
 	fi, code := writable.GetAttr(fs.options.DeletionDirName, nil)
 	if code == fuse.ENOENT {
 		code = writable.Mkdir(fs.options.DeletionDirName, 0755, nil)
@@ -166,6 +203,9 @@ type branchResult struct {
 	attr   *fuse.Attr
 	code   fuse.Status
 	branch int
+
+	// The read-only branch holding the file, if branch > 0.
+	fs fuse.FileSystem
 }
 
 func (fs branchResult) String() string {
@@ -179,15 +219,29 @@ func (fs *UnionFs) getBranchAttrNoCache(name string) branchResult {
 	parent = stripSlash(parent)
 
 	parentBranch := 0
+	opaque := false
 	if base != "" {
 		parentBranch = fs.getBranch(parent).branch
+		if fs.useWhiteouts() {
+			if parentBranch < 0 {
+				// The parent is deleted.
+				return branchResult{nil, fuse.ENOENT, -1, nil}
+			}
+			opaque = parentBranch == 0 && fs.isOpaque(parent)
+		}
 	}
-	for i, fs := range fs.fileSystems {
+	for i, branch := range fs.branches() {
 		if i < parentBranch {
 			continue
 		}
+		if i > 0 && opaque {
+			break
+		}
 
-		a, s := fs.GetAttr(name, nil)
+		a, s := branch.GetAttr(name, nil)
+		if i == 0 && s.Ok() && fs.useWhiteouts() && fs.isWhiteoutAttr(name, a) {
+			return branchResult{nil, fuse.ENOENT, -1, nil}
+		}
 		if s.Ok() {
 			if i > 0 {
 				// Needed to make hardlinks work.
@@ -197,6 +251,7 @@ func (fs *UnionFs) getBranchAttrNoCache(name string) branchResult {
 				attr:   a,
 				code:   s,
 				branch: i,
+				fs:     branch,
 			}
 		} else {
 			if s != fuse.ENOENT {
@@ -204,7 +259,7 @@ func (fs *UnionFs) getBranchAttrNoCache(name string) branchResult {
 			}
 		}
 	}
-	return branchResult{nil, fuse.ENOENT, -1}
+	return branchResult{nil, fuse.ENOENT, -1, nil}
 }
 
 ////////////////
@@ -215,6 +270,11 @@ func (fs *UnionFs) deletionPath(name string) string {
 }
 
 func (fs *UnionFs) removeDeletion(name string) {
+	if fs.useWhiteouts() {
+		// Whiteouts are in the way of new files, so they are
+		// removed beforehand, by clearWhiteout.
+		return
+	}
 	marker := fs.deletionPath(name)
 	fs.deletionCache.RemoveEntry(path.Base(marker))
 
@@ -222,13 +282,16 @@ func (fs *UnionFs) removeDeletion(name string) {
 	// Rmdir() sequentially.  We want to skip the 2nd system call,
 	// so use syscall.Unlink() directly.
 
-	code := fs.fileSystems[0].Unlink(marker, nil)
+	code := fs.writable.Unlink(marker, nil)
 	if !code.Ok() && code != fuse.ENOENT {
 		log.Printf("error unlinking %s: %v", marker, code)
 	}
 }
 
 func (fs *UnionFs) putDeletion(name string) (code fuse.Status) {
+	if fs.useWhiteouts() {
+		return fs.putWhiteout(name)
+	}
 	code = fs.createDeletionStore()
 	if !code.Ok() {
 		return code
@@ -238,7 +301,7 @@ func (fs *UnionFs) putDeletion(name string) (code fuse.Status) {
 	fs.deletionCache.AddEntry(path.Base(marker))
 
 	// Is there a WriteStringToFileOrDie ?
-	writable := fs.fileSystems[0]
+	writable := fs.writable
 	fi, code := writable.GetAttr(marker, nil)
 	if code.Ok() && fi.Size == uint64(len(name)) {
 		return fuse.OK
@@ -255,8 +318,8 @@ func (fs *UnionFs) putDeletion(name string) (code fuse.Status) {
 		log.Printf("could not create deletion file %v: %v", marker, code)
 		return fuse.EPERM
 	}
-	defer f.Release()
-	defer f.Flush()
+	defer f.Release(&fuse.ReleaseIn{})
+	defer f.Flush(&fuse.FlushIn{})
 	n, code := f.Write(&fuse.WriteIn{}, []byte(name))
 	if int(n) != len(name) || !code.Ok() {
 		panic(fmt.Sprintf("Error for writing %v: %v, %v (exp %v) %v", name, marker, n, len(name), code))
@@ -269,21 +332,25 @@ func (fs *UnionFs) putDeletion(name string) (code fuse.Status) {
 // Promotion.
 
 func (fs *UnionFs) Promote(name string, srcResult branchResult, context *fuse.Context) (code fuse.Status) {
-	writable := fs.fileSystems[0]
-	sourceFs := fs.fileSystems[srcResult.branch]
+	writable := fs.writable
+	sourceFs := srcResult.fs
+
+	if srcResult.attr.IsRegular() && fs.options.CopyUp == COPYUP_DENY {
+		return fuse.EROFS
+	}
 
 	// Promote directories.
 	fs.promoteDirsTo(name)
 
 	if srcResult.attr.IsRegular() {
-		code = fuse.CopyFile(sourceFs, writable, name, name, context)
+		code = fs.copyFile(sourceFs, name, srcResult.attr, context)
 
 		if code.Ok() {
 			code = writable.Chmod(name, srcResult.attr.Mode&07777|0200, context)
 		}
 		if code.Ok() {
-			code = writable.Utimens(name, srcResult.attr.Atimens(),
-				srcResult.attr.Mtimens(), context)
+			atime, mtime := srcResult.attr.AccessTime(), srcResult.attr.ModTime()
+			code = writable.Utimens(name, &atime, &mtime, context)
 		}
 
 		files := fs.nodeFs.AllFiles(name, 0)
@@ -308,9 +375,9 @@ func (fs *UnionFs) Promote(name string, srcResult branchResult, context *fuse.Co
 			if uf.layer > 0 {
 				uf.layer = 0
 				f := uf.File
-				uf.File, code = fs.fileSystems[0].Open(name, fileWrapper.OpenFlags, context)
-				f.Flush()
-				f.Release()
+				uf.File, code = fs.openWritable(name, fileWrapper.OpenFlags, context)
+				f.Flush(&fuse.FlushIn{})
+				f.Release(&fuse.ReleaseIn{})
 			}
 		}
 	} else if srcResult.attr.IsSymlink() {
@@ -364,7 +431,8 @@ func (fs *UnionFs) Link(orig string, newName string, context *fuse.Context) (cod
 		code = fs.promoteDirsTo(newName)
 	}
 	if code.Ok() {
-		code = fs.fileSystems[0].Link(orig, newName, context)
+		fs.clearWhiteout(newName)
+		code = fs.writable.Link(orig, newName, context)
 	}
 	if code.Ok() {
 		fs.removeDeletion(newName)
@@ -395,7 +463,10 @@ func (fs *UnionFs) Rmdir(path string, context *fuse.Context) (code fuse.Status)
 		code = fs.putDeletion(path)
 		return code
 	}
-	code = fs.fileSystems[0].Rmdir(path, context)
+	if fs.useWhiteouts() {
+		fs.clearWhiteouts(path)
+	}
+	code = fs.writable.Rmdir(path, context)
 	if code != fuse.OK {
 		return code
 	}
@@ -422,14 +493,20 @@ func (fs *UnionFs) Mkdir(path string, mode uint32, context *fuse.Context) (code
 
 	code = fs.promoteDirsTo(path)
 	if code.Ok() {
-		code = fs.fileSystems[0].Mkdir(path, mode, context)
+		fs.clearWhiteout(path)
+		code = fs.writable.Mkdir(path, mode, context)
 	}
 	if code.Ok() {
 		fs.removeDeletion(path)
+		if deleted && fs.useWhiteouts() {
+			// Hide the contents of the deleted directory. If
+			// that fails, the loop below whites them out.
+			fs.setOpaque(path)
+		}
 		attr := &fuse.Attr{
 			Mode: fuse.S_IFDIR | mode,
 		}
-		fs.branchCache.Set(path, branchResult{attr, fuse.OK, 0})
+		fs.branchCache.Set(path, branchResult{attr, fuse.OK, 0, nil})
 	}
 
 	var stream []fuse.DirEntry
@@ -447,7 +524,8 @@ func (fs *UnionFs) Mkdir(path string, mode uint32, context *fuse.Context) (code
 func (fs *UnionFs) Symlink(pointedTo string, linkName string, context *fuse.Context) (code fuse.Status) {
 	code = fs.promoteDirsTo(linkName)
 	if code.Ok() {
-		code = fs.fileSystems[0].Symlink(pointedTo, linkName, context)
+		fs.clearWhiteout(linkName)
+		code = fs.writable.Symlink(pointedTo, linkName, context)
 	}
 	if code.Ok() {
 		fs.removeDeletion(linkName)
@@ -457,7 +535,7 @@ func (fs *UnionFs) Symlink(pointedTo string, linkName string, context *fuse.Cont
 }
 
 func (fs *UnionFs) Truncate(path string, size uint64, context *fuse.Context) (code fuse.Status) {
-	if path == _DROP_CACHE {
+	if path == _DROP_CACHE || fs.isBranchesFile(path) {
 		return fuse.OK
 	}
 
@@ -468,7 +546,7 @@ func (fs *UnionFs) Truncate(path string, size uint64, context *fuse.Context) (co
 	}
 
 	if code.Ok() {
-		code = fs.fileSystems[0].Truncate(path, size, context)
+		code = fs.truncatePartial(path, size, context)
 	}
 	if code.Ok() {
 		r.attr.Size = size
@@ -479,7 +557,7 @@ func (fs *UnionFs) Truncate(path string, size uint64, context *fuse.Context) (co
 	return code
 }
 
-func (fs *UnionFs) Utimens(name string, atime int64, mtime int64, context *fuse.Context) (code fuse.Status) {
+func (fs *UnionFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
 	name = stripSlash(name)
 	r := fs.getBranch(name)
 
@@ -489,10 +567,11 @@ func (fs *UnionFs) Utimens(name string, atime int64, mtime int64, context *fuse.
 		r.branch = 0
 	}
 	if code.Ok() {
-		code = fs.fileSystems[0].Utimens(name, atime, mtime, context)
+		code = fs.writable.Utimens(name, atime, mtime, context)
 	}
 	if code.Ok() {
-		r.attr.SetNs(atime, mtime, time.Now().UnixNano())
+		now := time.Now()
+		r.attr.SetTimes(atime, mtime, &now)
 		fs.branchCache.Set(name, r)
 	}
 	return code
@@ -517,7 +596,7 @@ func (fs *UnionFs) Chown(name string, uid uint32, gid uint32, context *fuse.Cont
 			}
 			r.branch = 0
 		}
-		fs.fileSystems[0].Chown(name, uid, gid, context)
+		fs.writable.Chown(name, uid, gid, context)
 	}
 	r.attr.Uid = uid
 	r.attr.Gid = gid
@@ -550,7 +629,7 @@ func (fs *UnionFs) Chmod(name string, mode uint32, context *fuse.Context) (code
 			}
 			r.branch = 0
 		}
-		fs.fileSystems[0].Chmod(name, mode, context)
+		fs.writable.Chmod(name, mode, context)
 	}
 	r.attr.Mode = (r.attr.Mode &^ permMask) | mode
 	now := time.Now()
@@ -567,7 +646,7 @@ func (fs *UnionFs) Access(name string, mode uint32, context *fuse.Context) (code
 	}
 	r := fs.getBranch(name)
 	if r.branch >= 0 {
-		return fs.fileSystems[r.branch].Access(name, mode, context)
+		return fs.branchFs(r).Access(name, mode, context)
 	}
 	return fuse.ENOENT
 }
@@ -575,7 +654,7 @@ func (fs *UnionFs) Access(name string, mode uint32, context *fuse.Context) (code
 func (fs *UnionFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
 	r := fs.getBranch(name)
 	if r.branch == 0 {
-		code = fs.fileSystems[0].Unlink(name, context)
+		code = fs.writable.Unlink(name, context)
 		if code != fuse.OK {
 			return code
 		}
@@ -592,7 +671,7 @@ func (fs *UnionFs) Unlink(name string, context *fuse.Context) (code fuse.Status)
 func (fs *UnionFs) Readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
 	r := fs.getBranch(name)
 	if r.branch >= 0 {
-		return fs.fileSystems[r.branch].Readlink(name, context)
+		return fs.branchFs(r).Readlink(name, context)
 	}
 	return "", fuse.ENOENT
 }
@@ -635,13 +714,14 @@ func (fs *UnionFs) promoteDirsTo(filename string) fuse.Status {
 		j := len(todo) - i - 1
 		d := todo[j]
 		r := results[j]
-		code := fs.fileSystems[0].Mkdir(d, r.attr.Mode&07777|0200, nil)
+		code := fs.writable.Mkdir(d, r.attr.Mode&07777|0200, nil)
 		if code != fuse.OK {
-			log.Println("Error creating dir leading to path", d, code, fs.fileSystems[0])
+			log.Println("Error creating dir leading to path", d, code, fs.writable)
 			return fuse.EPERM
 		}
 
-		fs.fileSystems[0].Utimens(d, r.attr.Atimens(), r.attr.Mtimens(), nil)
+		atime, mtime := r.attr.AccessTime(), r.attr.ModTime()
+		fs.writable.Utimens(d, &atime, &mtime, nil)
 		r.branch = 0
 		fs.branchCache.Set(d, r)
 	}
@@ -649,12 +729,13 @@ func (fs *UnionFs) promoteDirsTo(filename string) fuse.Status {
 }
 
 func (fs *UnionFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuseFile fuse.File, code fuse.Status) {
-	writable := fs.fileSystems[0]
+	writable := fs.writable
 
 	code = fs.promoteDirsTo(name)
 	if code != fuse.OK {
 		return nil, code
 	}
+	fs.clearWhiteout(name)
 	fuseFile, code = writable.Create(name, flags, mode, context)
 	if code.Ok() {
 		fuseFile = fs.newUnionFsFile(fuseFile, 0)
@@ -665,7 +746,7 @@ func (fs *UnionFs) Create(name string, flags uint32, mode uint32, context *fuse.
 			Mode: fuse.S_IFREG | mode,
 		}
 		a.SetTimes(nil, &now, &now)
-		fs.branchCache.Set(name, branchResult{&a, fuse.OK, 0})
+		fs.branchCache.Set(name, branchResult{&a, fuse.OK, 0, nil})
 	}
 	return fuseFile, code
 }
@@ -680,7 +761,14 @@ func (fs *UnionFs) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, s
 			Mode: fuse.S_IFREG | 0777,
 		}, fuse.OK
 	}
-	if name == fs.options.DeletionDirName {
+	if fs.isBranchesFile(name) {
+		return &fuse.Attr{
+			Mode:  fuse.S_IFREG | 0644,
+			Size:  uint64(len(fs.branchListing())),
+			Owner: raw.Owner(*fuse.CurrentOwner()),
+		}, fuse.OK
+	}
+	if !fs.useWhiteouts() && name == fs.options.DeletionDirName {
 		return nil, fuse.ENOENT
 	}
 	isDel, s := fs.isDeleted(name)
@@ -702,13 +790,13 @@ func (fs *UnionFs) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, s
 }
 
 func (fs *UnionFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	if name == _DROP_CACHE {
+	if name == _DROP_CACHE || fs.isBranchesFile(name) {
 		return nil, fuse.ENODATA
 	}
 
 	r := fs.getBranch(name)
 	if r.branch >= 0 {
-		return fs.fileSystems[r.branch].GetXAttr(name, attr, context)
+		return fs.branchFs(r).GetXAttr(name, attr, context)
 	}
 	return nil, fuse.ENOENT
 }
@@ -724,19 +812,22 @@ func (fs *UnionFs) OpenDir(directory string, context *fuse.Context) (stream []fu
 	var wg sync.WaitGroup
 	var deletions map[string]bool
 
-	wg.Add(1)
-	go func() {
-		deletions = newDirnameMap(fs.fileSystems[0], fs.options.DeletionDirName)
-		wg.Done()
-	}()
+	if !fs.useWhiteouts() {
+		wg.Add(1)
+		go func() {
+			deletions = newDirnameMap(fs.writable, fs.options.DeletionDirName)
+			wg.Done()
+		}()
+	}
 
-	entries := make([]map[string]uint32, len(fs.fileSystems))
-	for i := range fs.fileSystems {
+	branches := fs.branches()
+	entries := make([]map[string]uint32, len(branches))
+	for i := range branches {
 		entries[i] = make(map[string]uint32)
 	}
 
-	statuses := make([]fuse.Status, len(fs.fileSystems))
-	for i, l := range fs.fileSystems {
+	statuses := make([]fuse.Status, len(branches))
+	for i, l := range branches {
 		if i >= dirBranch.branch {
 			wg.Add(1)
 			go func(j int, pfs fuse.FileSystem) {
@@ -751,8 +842,15 @@ func (fs *UnionFs) OpenDir(directory string, context *fuse.Context) (stream []fu
 	}
 
 	wg.Wait()
-	if deletions == nil {
-		_, code := fs.fileSystems[0].GetAttr(fs.options.DeletionDirName, context)
+	opaque := false
+	isDeleted := func(name string) bool {
+		return deletions[filePathHash(filepath.Join(directory, name))]
+	}
+	if fs.useWhiteouts() {
+		deletions, opaque = fs.dirWhiteouts(directory, entries[0])
+		isDeleted = func(name string) bool { return deletions[name] }
+	} else if deletions == nil {
+		_, code := fs.writable.GetAttr(fs.options.DeletionDirName, context)
 		if code == fuse.ENOENT {
 			deletions = map[string]bool{}
 		} else {
@@ -773,20 +871,24 @@ func (fs *UnionFs) OpenDir(directory string, context *fuse.Context) (stream []fu
 			// branch: it has no deleted files.
 			continue
 		}
+		if opaque {
+			break
+		}
 		for k, v := range m {
 			_, ok := results[k]
 			if ok {
 				continue
 			}
 
-			deleted := deletions[filePathHash(filepath.Join(directory, k))]
-			if !deleted {
+			if !isDeleted(k) {
 				results[k] = v
 			}
 		}
 	}
 	if directory == "" {
-		delete(results, fs.options.DeletionDirName)
+		if !fs.useWhiteouts() {
+			delete(results, fs.options.DeletionDirName)
+		}
 		for name, _ := range fs.hiddenFiles {
 			delete(results, name)
 		}
@@ -846,7 +948,8 @@ func (fs *UnionFs) renameDirectory(srcResult branchResult, srcDir string, dstDir
 	}
 
 	if code.Ok() {
-		writable := fs.fileSystems[0]
+		fs.clearWhiteout(dstDir)
+		writable := fs.writable
 		code = writable.Rename(srcDir, dstDir, context)
 	}
 
@@ -887,7 +990,7 @@ func (fs *UnionFs) Rename(src string, dst string, context *fuse.Context) (code f
 		code = fs.promoteDirsTo(dst)
 	}
 	if code.Ok() {
-		code = fs.fileSystems[0].Rename(src, dst, context)
+		code = fs.writable.Rename(src, dst, context)
 	}
 
 	if code.Ok() {
@@ -908,17 +1011,19 @@ func (fs *UnionFs) DropBranchCache(names []string) {
 }
 
 func (fs *UnionFs) DropDeletionCache() {
-	fs.deletionCache.DropCache()
+	if fs.deletionCache != nil {
+		fs.deletionCache.DropCache()
+	}
 }
 
 func (fs *UnionFs) DropSubFsCaches() {
-	for _, fs := range fs.fileSystems {
+	for _, fs := range fs.branches() {
 		a, code := fs.GetAttr(_DROP_CACHE, nil)
 		if code.Ok() && a.IsRegular() {
 			f, _ := fs.Open(_DROP_CACHE, uint32(os.O_WRONLY), nil)
 			if f != nil {
-				f.Flush()
-				f.Release()
+				f.Flush(&fuse.FlushIn{})
+				f.Release(&fuse.ReleaseIn{})
 			}
 		}
 	}
@@ -935,6 +1040,9 @@ func (fs *UnionFs) Open(name string, flags uint32, context *fuse.Context) (fuseF
 		}
 		return fuse.NewDevNullFile(), fuse.OK
 	}
+	if fs.isBranchesFile(name) {
+		return fs.openBranches(flags, context)
+	}
 	r := fs.getBranch(name)
 	if r.branch < 0 {
 		// This should not happen, as a GetAttr() should have
@@ -942,7 +1050,12 @@ func (fs *UnionFs) Open(name string, flags uint32, context *fuse.Context) (fuseF
 		log.Println("UnionFs: open of non-existent file:", name)
 		return nil, fuse.ENOENT
 	}
-	if flags&fuse.O_ANYWRITE != 0 && r.branch > 0 {
+	if flags&fuse.O_ANYWRITE != 0 && r.branch > 0 && fs.options.CopyUp == COPYUP_ON_WRITE &&
+		flags&uint32(os.O_TRUNC) == 0 {
+		// Until it is written, the file is read from its
+		// branch, which we may not be able to write.
+		flags &^= uint32(os.O_WRONLY | os.O_RDWR)
+	} else if flags&fuse.O_ANYWRITE != 0 && r.branch > 0 {
 		code := fs.Promote(name, r, context)
 		if code != fuse.OK {
 			return nil, code
@@ -952,7 +1065,11 @@ func (fs *UnionFs) Open(name string, flags uint32, context *fuse.Context) (fuseF
 		r.attr.SetTimes(nil, &now, nil)
 		fs.branchCache.Set(name, r)
 	}
-	fuseFile, status = fs.fileSystems[r.branch].Open(name, uint32(flags), context)
+	if r.branch == 0 {
+		fuseFile, status = fs.openWritable(name, uint32(flags), context)
+	} else {
+		fuseFile, status = fs.branchFs(r).Open(name, uint32(flags), context)
+	}
 	if fuseFile != nil {
 		fuseFile = fs.newUnionFsFile(fuseFile, r.branch)
 	}
@@ -961,14 +1078,33 @@ func (fs *UnionFs) Open(name string, flags uint32, context *fuse.Context) (fuseF
 
 func (fs *UnionFs) String() string {
 	names := []string{}
-	for _, fs := range fs.fileSystems {
+	for _, fs := range fs.branches() {
 		names = append(names, fs.String())
 	}
 	return fmt.Sprintf("UnionFs(%v)", names)
 }
 
 func (fs *UnionFs) StatFs(name string) *fuse.StatfsOut {
-	return fs.fileSystems[0].StatFs("")
+	return fs.writable.StatFs("")
+}
+
+// SyncFs syncs the writable branch; the others are not changed by
+// us.
+func (fs *UnionFs) SyncFs(context *fuse.Context) fuse.Status {
+	return fs.writable.SyncFs(context)
+}
+
+// FsyncDir syncs the directory in the writable branch, if it exists
+// there.
+func (fs *UnionFs) FsyncDir(name string, flags int, context *fuse.Context) fuse.Status {
+	r := fs.getBranch(name)
+	if !r.code.Ok() {
+		return r.code
+	}
+	if r.branch > 0 {
+		return fuse.OK
+	}
+	return fs.writable.FsyncDir(name, flags, context)
 }
 
 type unionFsFile struct {
@@ -996,8 +1132,8 @@ func (fs *unionFsFile) InnerFile() (file fuse.File) {
 
 // We can't hook on Release. Release has no response, so it is not
 // ordered wrt any following calls.
-func (fs *unionFsFile) Flush() (code fuse.Status) {
-	code = fs.File.Flush()
+func (fs *unionFsFile) Flush(input *fuse.FlushIn) (code fuse.Status) {
+	code = fs.File.Flush(input)
 	path := fs.ufs.nodeFs.Path(fs.node)
 	fs.ufs.branchCache.GetFresh(path)
 	return code
@@ -1007,6 +1143,55 @@ func (fs *unionFsFile) SetInode(node *fuse.Inode) {
 	fs.node = node
 }
 
+// Write copies a file opened under COPYUP_ON_WRITE to the writable
+// branch first.
+func (fs *unionFsFile) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if fs.layer > 0 {
+		if code := fs.ufs.promoteOpenFile(fs); !code.Ok() {
+			return 0, code
+		}
+	}
+	return fs.File.Write(input, data)
+}
+
+// Changes through files of read-only branches are done by name
+// instead, which copies the file to the writable branch.
+
+func (fs *unionFsFile) Truncate(size uint64, context *fuse.Context) fuse.Status {
+	if fs.layer > 0 {
+		return fuse.ENOSYS
+	}
+	return fs.File.Truncate(size, context)
+}
+
+func (fs *unionFsFile) Chmod(perms uint32, context *fuse.Context) fuse.Status {
+	if fs.layer > 0 {
+		return fuse.ENOSYS
+	}
+	return fs.File.Chmod(perms, context)
+}
+
+func (fs *unionFsFile) Chown(uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if fs.layer > 0 {
+		return fuse.ENOSYS
+	}
+	return fs.File.Chown(uid, gid, context)
+}
+
+func (fs *unionFsFile) Utimens(atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if fs.layer > 0 {
+		return fuse.ENOSYS
+	}
+	return fs.File.Utimens(atime, mtime, context)
+}
+
+func (fs *unionFsFile) Setattr(valid uint32, attr *fuse.Attr, context *fuse.Context) fuse.Status {
+	if fs.layer > 0 {
+		return fuse.ENOSYS
+	}
+	return fs.File.Setattr(valid, attr, context)
+}
+
 func (fs *unionFsFile) GetAttr(out *fuse.Attr) fuse.Status {
 	code := fs.File.GetAttr(out)
 	if code.Ok() {
@@ -195,8 +195,8 @@ func TestUnionFsChtimes(t *testing.T) {
 	CheckSuccess(err)
 
 	fi, err := os.Lstat(wd + "/mnt/file")
-	stat := fuse.ToStatT(fi)
-	if stat.Atim.Sec != 82 || stat.Mtim.Sec != 83 {
+	attr := fuse.ToAttr(fi)
+	if attr.Atime != 82 || attr.Mtime != 83 {
 		t.Error("Incorrect timestamp", fi)
 	}
 }
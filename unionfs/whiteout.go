@@ -0,0 +1,158 @@
+package unionfs
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// WhiteoutStyle says how UnionFs marks files of the read-only
+// branches as deleted.
+type WhiteoutStyle int
+
+const (
+	// A file named after a hash of the path goes into the
+	// DeletionDirName directory of the writable branch.
+	WHITEOUT_DELETION_DIR = WhiteoutStyle(0)
+
+	// A character device with device number 0:0 is put in place
+	// of the deleted file, as the kernel's overlayfs does.
+	WHITEOUT_CHARDEV = WhiteoutStyle(1)
+
+	// An empty file with the overlay.whiteout xattr is put in
+	// place of the deleted file.  This does not need the privilege
+	// to create devices, but kernel overlayfs only understands it
+	// (from Linux 6.7) when the branch is used as a lower layer.
+	WHITEOUT_XATTR = WhiteoutStyle(2)
+)
+
+// With the overlayfs styles, the writable branch can be used as the
+// upper directory of a kernel overlayfs mount.  Either kind of
+// whiteout is recognized, and directories replacing a deleted
+// directory get the overlay.opaque xattr.
+
+const _OVERLAY_XATTR_PREFIX = "trusted.overlay."
+
+func (fs *UnionFs) useWhiteouts() bool {
+	return fs.options.Whiteouts != WHITEOUT_DELETION_DIR
+}
+
+func (fs *UnionFs) overlayXAttr(name string) string {
+	prefix := fs.options.OverlayXAttrPrefix
+	if prefix == "" {
+		prefix = _OVERLAY_XATTR_PREFIX
+	}
+	return prefix + name
+}
+
+// isWhiteoutAttr returns true if a, the attributes of name in the
+// writable branch, are those of a whiteout.
+func (fs *UnionFs) isWhiteoutAttr(name string, a *fuse.Attr) bool {
+	if a.IsChar() {
+		return a.Rdev == 0
+	}
+	if a.IsRegular() && a.Size == 0 {
+		_, code := fs.writable.GetXAttr(name, fs.overlayXAttr("whiteout"), nil)
+		return code.Ok()
+	}
+	return false
+}
+
+func (fs *UnionFs) isWhiteout(name string) (bool, fuse.Status) {
+	a, code := fs.writable.GetAttr(name, nil)
+	switch {
+	case code.Ok():
+		return fs.isWhiteoutAttr(name, a), fuse.OK
+	case code == fuse.ENOENT || code == fuse.ENOTDIR:
+		return false, fuse.OK
+	}
+	log.Println("error accessing whiteout:", name, code)
+	return false, fuse.Status(syscall.EROFS)
+}
+
+// isOpaque returns true if the lower branches should not be looked
+// at for the contents of dir.
+func (fs *UnionFs) isOpaque(dir string) bool {
+	val, code := fs.writable.GetXAttr(dir, fs.overlayXAttr("opaque"), nil)
+	return code.Ok() && string(val) == "y"
+}
+
+func (fs *UnionFs) setOpaque(dir string) fuse.Status {
+	return fs.writable.SetXAttr(dir, fs.overlayXAttr("opaque"), []byte("y"), 0, nil)
+}
+
+func (fs *UnionFs) putWhiteout(name string) (code fuse.Status) {
+	code = fs.promoteDirsTo(name)
+	if !code.Ok() {
+		return code
+	}
+
+	writable := fs.writable
+	if fs.options.Whiteouts == WHITEOUT_CHARDEV {
+		code = writable.Mknod(name, syscall.S_IFCHR, 0, nil)
+	} else {
+		var f fuse.File
+		f, code = writable.Create(name, uint32(os.O_WRONLY|os.O_TRUNC), 0, nil)
+		if code.Ok() {
+			f.Release(&fuse.ReleaseIn{})
+			code = writable.SetXAttr(name, fs.overlayXAttr("whiteout"), []byte("y"), 0, nil)
+		}
+		// The kernel only looks for xattr whiteouts in
+		// directories marked like this.
+		dir := parentDir(name)
+		if code.Ok() && !fs.isOpaque(dir) {
+			code = writable.SetXAttr(dir, fs.overlayXAttr("opaque"), []byte("x"), 0, nil)
+		}
+	}
+	if !code.Ok() {
+		log.Printf("could not create whiteout %v: %v", name, code)
+		return fuse.EPERM
+	}
+	fs.branchCache.Set(name, branchResult{nil, fuse.ENOENT, -1, nil})
+	return fuse.OK
+}
+
+// clearWhiteout removes a whiteout for name, so name can be created
+// in the writable branch.
+func (fs *UnionFs) clearWhiteout(name string) {
+	if !fs.useWhiteouts() {
+		return
+	}
+	if ok, _ := fs.isWhiteout(name); ok {
+		if code := fs.writable.Unlink(name, nil); !code.Ok() {
+			log.Printf("error unlinking whiteout %s: %v", name, code)
+		}
+	}
+}
+
+// clearWhiteouts removes the whiteouts in dir, so it can be removed
+// from the writable branch.
+func (fs *UnionFs) clearWhiteouts(dir string) {
+	stream, code := fs.writable.OpenDir(dir, nil)
+	if !code.Ok() {
+		return
+	}
+	for _, e := range stream {
+		fs.clearWhiteout(filepath.Join(dir, e.Name))
+	}
+}
+
+// dirWhiteouts removes the whiteouts from the listing of dir in the
+// writable branch, and returns their names, and whether dir is
+// opaque.
+func (fs *UnionFs) dirWhiteouts(dir string, entries map[string]uint32) (deleted map[string]bool, opaque bool) {
+	deleted = map[string]bool{}
+	for k, mode := range entries {
+		if t := mode & syscall.S_IFMT; t != syscall.S_IFCHR && t != syscall.S_IFREG {
+			continue
+		}
+		if ok, _ := fs.isWhiteout(filepath.Join(dir, k)); ok {
+			deleted[k] = true
+			delete(entries, k)
+		}
+	}
+	return deleted, fs.isOpaque(dir)
+}
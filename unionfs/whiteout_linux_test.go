@@ -0,0 +1,22 @@
+package unionfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestUnionFsXAttrWhiteouts(t *testing.T) {
+	testWhiteouts(t, UnionFsOptions{
+		Whiteouts:          WHITEOUT_XATTR,
+		OverlayXAttrPrefix: "user.overlay.",
+	}, func(name string) {
+		fi, err := os.Lstat(name)
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() != 0 {
+			t.Errorf("no whiteout at %s: %v %v", name, fi, err)
+		}
+		if _, err := syscall.Getxattr(name, "user.overlay.whiteout", nil); err != nil {
+			t.Errorf("no whiteout xattr on %s: %v", name, err)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func setupWhiteoutUfs(t *testing.T, opts UnionFsOptions) (ufs *UnionFs, wd string, cleanup func()) {
+	wd, _ = ioutil.TempDir("", "go-fuse")
+	CheckSuccess(os.Mkdir(wd+"/rw", 0755))
+	CheckSuccess(os.Mkdir(wd+"/ro", 0755))
+	CheckSuccess(os.Mkdir(wd+"/ro/dir", 0755))
+	CheckSuccess(ioutil.WriteFile(wd+"/ro/dir/file", []byte("ro"), 0644))
+
+	ufs = NewUnionFs([]fuse.FileSystem{
+		fuse.NewLoopbackFileSystem(wd + "/rw"),
+		NewCachingFileSystem(fuse.NewLoopbackFileSystem(wd+"/ro"), 0),
+	}, opts)
+	fuse.NewFileSystemConnector(fuse.NewPathNodeFs(ufs, nil), nil)
+	return ufs, wd, func() { os.RemoveAll(wd) }
+}
+
+func testWhiteouts(t *testing.T, opts UnionFsOptions, check func(string)) {
+	ufs, wd, clean := setupWhiteoutUfs(t, opts)
+	defer clean()
+
+	if code := ufs.Unlink("dir/file", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	check(wd + "/rw/dir/file")
+	if _, err := os.Lstat(wd + "/rw/DELETIONS"); err == nil {
+		t.Errorf("deletion dir created")
+	}
+	if _, code := ufs.GetAttr("dir/file", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr after Unlink: %v", code)
+	}
+	if stream, _ := ufs.OpenDir("dir", nil); len(stream) != 0 {
+		t.Errorf("OpenDir after Unlink: %v", stream)
+	}
+
+	// The deleted directory is recreated as an opaque directory.
+	if code := ufs.Rmdir("dir", nil); !code.Ok() {
+		t.Fatalf("Rmdir: %v", code)
+	}
+	check(wd + "/rw/dir")
+	if code := ufs.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	if stream, _ := ufs.OpenDir("dir", nil); len(stream) != 0 {
+		t.Errorf("OpenDir after Mkdir: %v", stream)
+	}
+	if _, code := ufs.GetAttr("dir/file", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr in new dir: %v", code)
+	}
+
+	f, code := ufs.Create("dir/file", uint32(os.O_WRONLY|os.O_CREATE), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release(&fuse.ReleaseIn{})
+	if a, code := ufs.GetAttr("dir/file", nil); !code.Ok() || a.Size != 0 {
+		t.Errorf("GetAttr after Create: %v %v", a, code)
+	}
+}
+
+func TestUnionFsChardevWhiteouts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create devices")
+	}
+	testWhiteouts(t, UnionFsOptions{Whiteouts: WHITEOUT_CHARDEV},
+		func(name string) {
+			var st syscall.Stat_t
+			err := syscall.Lstat(name, &st)
+			if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+				t.Errorf("no whiteout at %s: %v %v", name, st, err)
+			}
+		})
+}
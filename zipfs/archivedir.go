@@ -0,0 +1,282 @@
+package zipfs
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var _ = (fuse.FileSystem)((*ArchiveDirFs)(nil))
+
+type ArchiveDirOptions struct {
+	// MaxOpen is the number of archives whose contents are kept
+	// in memory.  The least recently used ones are dropped, and
+	// read again when they are next used.  The default is 16.
+	MaxOpen int
+
+	// MemoryLimit, if set, also drops archives while the Go heap
+	// is larger than this many bytes, as long as one is left.
+	MemoryLimit uint64
+}
+
+// archiveTree is the contents of an opened archive.
+type archiveTree struct {
+	name  string
+	files map[string]MemFile
+	// The entries of each directory, by name, with their mode.
+	dirs map[string]map[string]uint32
+	elem *list.Element
+}
+
+func newArchiveTree(name string, files map[string]MemFile) *archiveTree {
+	t := &archiveTree{
+		name:  name,
+		files: files,
+		dirs:  map[string]map[string]uint32{"": {}},
+	}
+	for p, f := range files {
+		var a fuse.Attr
+		f.Stat(&a)
+		t.add(p, a.Mode)
+	}
+	return t
+}
+
+// add adds the entry for p to its directory, and the parent
+// directories that are not in the archive themselves.
+func (t *archiveTree) add(p string, mode uint32) {
+	if mode&syscall.S_IFMT == syscall.S_IFDIR && t.dirs[p] == nil {
+		t.dirs[p] = map[string]uint32{}
+	}
+	dir := filepath.Dir(p)
+	if dir == "." {
+		dir = ""
+	}
+	entries := t.dirs[dir]
+	if entries == nil {
+		entries = map[string]uint32{}
+		t.dirs[dir] = entries
+		t.add(dir, fuse.S_IFDIR|0555)
+	}
+	entries[filepath.Base(p)] = mode
+}
+
+// ArchiveDirFs shows a directory in which archives appear as
+// directories of their contents, so a collection of zip or jar files
+// can be browsed from one mount.  Archives are read when they are
+// first used.  It is read-only.
+type ArchiveDirFs struct {
+	fuse.DefaultFileSystem
+
+	loopback *fuse.LoopbackFileSystem
+	options  ArchiveDirOptions
+
+	lock  sync.Mutex
+	trees map[string]*archiveTree
+	// The archives in trees, most recently used first.
+	lru *list.List
+}
+
+// NewArchiveDirFs serves the directory dir.
+func NewArchiveDirFs(dir string, opts *ArchiveDirOptions) *ArchiveDirFs {
+	fs := &ArchiveDirFs{
+		loopback: fuse.NewLoopbackFileSystem(dir),
+		trees:    map[string]*archiveTree{},
+		lru:      list.New(),
+	}
+	if opts != nil {
+		fs.options = *opts
+	}
+	if fs.options.MaxOpen <= 0 {
+		fs.options.MaxOpen = 16
+	}
+	return fs
+}
+
+func (fs *ArchiveDirFs) String() string {
+	return fmt.Sprintf("ArchiveDirFs(%s)", fs.loopback.Root)
+}
+
+// split finds the archive that name is in, and the path inside it.
+// It returns an empty archive if name is outside archives.
+func (fs *ArchiveDirFs) split(name string) (archive string, inner string) {
+	for i := 0; i <= len(name); i++ {
+		if i < len(name) && name[i] != '/' {
+			continue
+		}
+		prefix := name[:i]
+		if !IsArchive(prefix) {
+			continue
+		}
+		fi, err := os.Stat(fs.loopback.GetPath(prefix))
+		if err == nil && fi.Mode().IsRegular() {
+			return prefix, strings.TrimPrefix(name[i:], "/")
+		}
+	}
+	return "", ""
+}
+
+// tree returns the contents of archive, reading it if needed.
+func (fs *ArchiveDirFs) tree(archive string) (*archiveTree, fuse.Status) {
+	fs.lock.Lock()
+	t := fs.trees[archive]
+	if t != nil {
+		fs.lru.MoveToFront(t.elem)
+	}
+	fs.lock.Unlock()
+	if t != nil {
+		return t, fuse.OK
+	}
+
+	files, err := NewArchiveTree(fs.loopback.GetPath(archive))
+	if err != nil {
+		log.Printf("ArchiveDirFs: reading %s: %v", archive, err)
+		return nil, fuse.EIO
+	}
+	t = newArchiveTree(archive, files)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if old := fs.trees[archive]; old != nil {
+		// Read concurrently by someone else.
+		fs.lru.MoveToFront(old.elem)
+		return old, fuse.OK
+	}
+	t.elem = fs.lru.PushFront(t)
+	fs.trees[archive] = t
+	fs.evict()
+	return t, fuse.OK
+}
+
+// evict drops the least recently used archives while there are too
+// many.  Open files keep their data.
+func (fs *ArchiveDirFs) evict() {
+	for fs.lru.Len() > 1 && (fs.lru.Len() > fs.options.MaxOpen || fs.overLimit()) {
+		t := fs.lru.Remove(fs.lru.Back()).(*archiveTree)
+		delete(fs.trees, t.name)
+	}
+}
+
+func (fs *ArchiveDirFs) overLimit() bool {
+	if fs.options.MemoryLimit == 0 {
+		return false
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc > fs.options.MemoryLimit
+}
+
+// Loaded returns the archives whose contents are in memory, most
+// recently used first.
+func (fs *ArchiveDirFs) Loaded() []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var names []string
+	for e := fs.lru.Front(); e != nil; e = e.Next() {
+		names = append(names, e.Value.(*archiveTree).name)
+	}
+	return names
+}
+
+func (fs *ArchiveDirFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	archive, inner := fs.split(name)
+	if archive == "" {
+		return fs.loopback.GetAttr(name, context)
+	}
+	if inner == "" {
+		a, code := fs.loopback.GetAttr(archive, context)
+		if code.Ok() {
+			a.Mode = fuse.S_IFDIR | 0555
+		}
+		return a, code
+	}
+
+	t, code := fs.tree(archive)
+	if !code.Ok() {
+		return nil, code
+	}
+	if f := t.files[inner]; f != nil {
+		a := &fuse.Attr{}
+		f.Stat(a)
+		return a, fuse.OK
+	}
+	if t.dirs[inner] != nil {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	}
+	return nil, fuse.ENOENT
+}
+
+func (fs *ArchiveDirFs) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
+	archive, inner := fs.split(name)
+	if archive == "" {
+		stream, code = fs.loopback.OpenDir(name, context)
+		for i := range stream {
+			if stream[i].Mode&syscall.S_IFMT == syscall.S_IFREG && IsArchive(stream[i].Name) {
+				stream[i].Mode = fuse.S_IFDIR | 0555
+			}
+		}
+		return stream, code
+	}
+
+	t, code := fs.tree(archive)
+	if !code.Ok() {
+		return nil, code
+	}
+	entries := t.dirs[inner]
+	if entries == nil {
+		return nil, fuse.ENOENT
+	}
+	for n, mode := range entries {
+		stream = append(stream, fuse.DirEntry{Name: n, Mode: mode})
+	}
+	return stream, fuse.OK
+}
+
+func (fs *ArchiveDirFs) Open(name string, flags uint32, context *fuse.Context) (file fuse.File, code fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	archive, inner := fs.split(name)
+	if archive == "" {
+		return fs.loopback.Open(name, flags, context)
+	}
+	t, code := fs.tree(archive)
+	if !code.Ok() {
+		return nil, code
+	}
+	f := t.files[inner]
+	if f == nil {
+		return nil, fuse.ENOENT
+	}
+	if o, ok := f.(MemFileOpener); ok {
+		return o.Open(), fuse.OK
+	}
+	return fuse.NewDataFile(f.Data()), fuse.OK
+}
+
+func (fs *ArchiveDirFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	archive, inner := fs.split(name)
+	if archive == "" {
+		return fs.loopback.Readlink(name, context)
+	}
+	t, code := fs.tree(archive)
+	if !code.Ok() {
+		return "", code
+	}
+	if l, ok := t.files[inner].(MemLink); ok {
+		return string(l.Readlink()), fuse.OK
+	}
+	return "", fuse.EINVAL
+}
+
+func (fs *ArchiveDirFs) StatFs(name string) *fuse.StatfsOut {
+	return fs.loopback.StatFs("")
+}
@@ -0,0 +1,88 @@
+package zipfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestArchiveDirFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile(testZipFile())
+	CheckSuccess(err)
+	CheckSuccess(os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "a.zip"), data, 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "sub/b.jar"), data, 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "plain.txt"), []byte("plain"), 0644))
+	var buf bytes.Buffer
+	writeTestTar(&buf)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "sub/c.tar"), buf.Bytes(), 0644))
+
+	fs := NewArchiveDirFs(dir, &ArchiveDirOptions{MaxOpen: 2})
+	names := func(d string) string {
+		entries, code := fs.OpenDir(d, nil)
+		if !code.Ok() {
+			t.Fatalf("OpenDir(%q): %v", d, code)
+		}
+		var l []string
+		for _, e := range entries {
+			if e.Mode&fuse.S_IFDIR != 0 {
+				l = append(l, e.Name+"/")
+			} else {
+				l = append(l, e.Name)
+			}
+		}
+		sort.Strings(l)
+		return strings.Join(l, " ")
+	}
+	for d, want := range map[string]string{
+		"":          "a.zip/ plain.txt sub/",
+		"sub":       "b.jar/ c.tar/",
+		"a.zip":     "file.txt subdir/",
+		"sub/b.jar": "file.txt subdir/",
+		"sub/c.tar": "b dir/",
+	} {
+		if got := names(d); got != want {
+			t.Errorf("OpenDir(%q): got %q, want %q", d, got, want)
+		}
+	}
+
+	for _, c := range [][2]string{
+		{"plain.txt", "plain"},
+		{"a.zip/subdir/subfile.txt", "hello2"},
+		{"sub/c.tar/dir/a", "hello"},
+	} {
+		name, want := c[0], c[1]
+		f, code := fs.Open(name, 0, nil)
+		if !code.Ok() {
+			t.Fatalf("Open(%q): %v", name, code)
+		}
+		data, code := f.Read(&fuse.ReadIn{Size: 100}, fuse.NewGcBufferPool())
+		if got := strings.TrimSpace(string(data)); !code.Ok() || got != want {
+			t.Errorf("Read(%q): got %q, %v, want %q", name, got, code, want)
+		}
+	}
+	if a, code := fs.GetAttr("a.zip/subdir", nil); !code.Ok() || !a.IsDir() {
+		t.Errorf("GetAttr(a.zip/subdir): %v, %v", a, code)
+	}
+	if _, code := fs.GetAttr("a.zip/none", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr(a.zip/none): got %v", code)
+	}
+
+	// Only the two most recently used archives are kept.
+	if got := strings.Join(fs.Loaded(), " "); got != "a.zip sub/c.tar" {
+		t.Errorf("Loaded: got %q", got)
+	}
+	if _, code := fs.Open("a.zip/file.txt", uint32(os.O_WRONLY), nil); code != fuse.EPERM {
+		t.Errorf("Open for writing: got %v", code)
+	}
+}
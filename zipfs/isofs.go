@@ -0,0 +1,550 @@
+package zipfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	isoSectorSize = 2048
+
+	// Flags of directory records.
+	isoDirFlag         = 0x02
+	isoMultiExtentFlag = 0x80
+
+	// Limits that guard against loops in damaged images.
+	isoMaxDepth         = 64
+	isoMaxContinuations = 32
+)
+
+// isoExtent is a piece of file data.
+type isoExtent struct {
+	start, size int64
+}
+
+// IsoFile is an entry of an ISO9660 image.
+type IsoFile struct {
+	attr    fuse.Attr
+	r       io.ReaderAt
+	extents []isoExtent
+	target  []byte
+}
+
+func (f *IsoFile) Stat(out *fuse.Attr) {
+	*out = f.attr
+}
+
+func (f *IsoFile) Data() []byte {
+	data := make([]byte, f.attr.Size)
+	n, _ := f.ReadAt(data, 0)
+	return data[:n]
+}
+
+func (f *IsoFile) Open() fuse.File {
+	return &isoFile{file: f}
+}
+
+func (f *IsoFile) Readlink() []byte {
+	return f.target
+}
+
+// ReadAt reads the file data at off, which may span extents.
+func (f *IsoFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, e := range f.extents {
+		if len(p) == 0 {
+			break
+		}
+		if off >= e.size {
+			off -= e.size
+			continue
+		}
+		want := p
+		if int64(len(want)) > e.size-off {
+			want = want[:e.size-off]
+		}
+		m, err := f.r.ReadAt(want, e.start+off)
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if m < len(want) {
+			return n, io.ErrUnexpectedEOF
+		}
+		p = p[m:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type isoFile struct {
+	fuse.DefaultFile
+	file *IsoFile
+}
+
+func (f *isoFile) String() string {
+	return fmt.Sprintf("isoFile(%d bytes)", f.file.attr.Size)
+}
+
+func (f *isoFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	slice := bp.AllocBuffer(input.Size)
+	n, err := f.file.ReadAt(slice, int64(input.Offset))
+	if err == io.EOF {
+		err = nil
+	}
+	return slice[:n], fuse.ToStatus(err)
+}
+
+// isoRecord is a directory record.
+type isoRecord struct {
+	extent uint32
+	size   uint32
+	flags  byte
+	name   []byte
+	system []byte
+	time   time.Time
+}
+
+func parseIsoRecord(b []byte) (*isoRecord, error) {
+	if len(b) < 34 || int(b[0]) > len(b) || int(b[0]) < 33+int(b[32]) {
+		return nil, errors.New("iso9660: bad directory record")
+	}
+	b = b[:b[0]]
+	nameLen := int(b[32])
+	r := &isoRecord{
+		extent: binary.LittleEndian.Uint32(b[2:]),
+		size:   binary.LittleEndian.Uint32(b[10:]),
+		flags:  b[25],
+		name:   b[33 : 33+nameLen],
+		time:   isoRecordTime(b[18:25]),
+	}
+	// The name is padded to an even length.
+	sys := 33 + nameLen
+	if nameLen%2 == 0 {
+		sys++
+	}
+	if sys < len(b) {
+		r.system = b[sys:]
+	}
+	return r, nil
+}
+
+// isoRecordTime decodes the 7 byte time of directory records.
+func isoRecordTime(b []byte) time.Time {
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// isoLongTime decodes the 17 byte time of volume descriptors, which
+// Rock Ridge can use too.
+func isoLongTime(b []byte) time.Time {
+	var v [6]int
+	for i, l := range []int{4, 2, 2, 2, 2, 2} {
+		for _, c := range b[:l] {
+			v[i] = v[i]*10 + int(c-'0')
+		}
+		b = b[l:]
+	}
+	hundredths := int(b[0]-'0')*10 + int(b[1]-'0')
+	zone := time.FixedZone("", int(int8(b[2]))*15*60)
+	return time.Date(v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], hundredths*1e7, zone)
+}
+
+// rockRidge holds the Rock Ridge entries of a directory record.
+type rockRidge struct {
+	name    []byte
+	hasMode bool
+	mode    uint32
+	nlink   uint32
+	uid     uint32
+	gid     uint32
+	rdev    uint32
+	target  []byte
+	mtime   *time.Time
+	atime   *time.Time
+	ctime   *time.Time
+
+	// The record is a directory that was moved to keep the tree
+	// shallow; it is shown where its CL entry is.
+	relocated bool
+	// The record stands for the directory at this extent.
+	childLink uint32
+}
+
+// isoReader walks the directory tree of an image.
+type isoReader struct {
+	r         io.ReaderAt
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+	files     map[string]MemFile
+	visited   map[uint32]bool
+}
+
+// NewIsoTree reads the directory tree of the ISO9660 image in r.  It
+// uses the Rock Ridge extensions for names and attributes if the image
+// has them, and else the Joliet names.  UDF is not supported, but most
+// installer images carry an ISO9660 tree as well.
+func NewIsoTree(r io.ReaderAt) (map[string]MemFile, error) {
+	var primary, joliet *isoRecord
+	for sector := int64(16); sector < 16+64; sector++ {
+		var d [isoSectorSize]byte
+		if _, err := r.ReadAt(d[:], sector*isoSectorSize); err != nil {
+			return nil, err
+		}
+		if string(d[1:6]) != "CD001" {
+			return nil, errors.New("iso9660: bad volume descriptor")
+		}
+		if d[0] == 255 {
+			break
+		}
+		if d[0] != 1 && d[0] != 2 {
+			continue
+		}
+		if binary.LittleEndian.Uint16(d[128:]) != isoSectorSize {
+			return nil, errors.New("iso9660: unsupported block size")
+		}
+		root, err := parseIsoRecord(d[156:190])
+		if err != nil {
+			return nil, err
+		}
+		// Joliet is a supplementary descriptor with one of
+		// the UCS-2 escape sequences.
+		esc := string(d[88:91])
+		if d[0] == 1 && primary == nil {
+			primary = root
+		} else if d[0] == 2 && (esc == "%/@" || esc == "%/C" || esc == "%/E") {
+			joliet = root
+		}
+	}
+	if primary == nil {
+		return nil, errors.New("iso9660: no primary volume descriptor")
+	}
+
+	ir := &isoReader{
+		r:       r,
+		files:   map[string]MemFile{},
+		visited: map[uint32]bool{},
+	}
+	root := primary
+	if err := ir.detectRockRidge(primary); err != nil {
+		return nil, err
+	}
+	if !ir.rockRidge && joliet != nil {
+		root = joliet
+		ir.joliet = true
+	}
+	if err := ir.walk(root, "", 0); err != nil {
+		return nil, err
+	}
+	return ir.files, nil
+}
+
+// readExtent reads size bytes at the given block.
+func (ir *isoReader) readExtent(block uint32, size uint32) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := ir.r.ReadAt(data, int64(block)*isoSectorSize); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// records returns the directory records of dir, without "." and "..".
+func (ir *isoReader) records(dir *isoRecord) (dot *isoRecord, recs []*isoRecord, err error) {
+	data, err := ir.readExtent(dir.extent, dir.size)
+	if err != nil {
+		return nil, nil, err
+	}
+	for off := 0; off < len(data); {
+		l := int(data[off])
+		if l == 0 {
+			// Records do not cross sectors; the rest of
+			// this one is padding.
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		rec, err := parseIsoRecord(data[off:])
+		if err != nil {
+			return nil, nil, err
+		}
+		off += l
+		if len(rec.name) == 1 && rec.name[0] == 0 {
+			dot = rec
+		} else if len(rec.name) != 1 || rec.name[0] != 1 {
+			recs = append(recs, rec)
+		}
+	}
+	return dot, recs, nil
+}
+
+// detectRockRidge looks for the SUSP "SP" entry in the "." record of
+// the root directory.
+func (ir *isoReader) detectRockRidge(root *isoRecord) error {
+	dot, _, err := ir.records(root)
+	if err != nil {
+		return err
+	}
+	if dot == nil {
+		return nil
+	}
+	s := dot.system
+	if len(s) >= 7 && string(s[:2]) == "SP" && s[4] == 0xBE && s[5] == 0xEF {
+		ir.rockRidge = true
+		ir.suspSkip = int(s[6])
+	}
+	return nil
+}
+
+// parseRockRidge decodes the SUSP entries in the system use area of
+// rec, following continuation areas.
+func (ir *isoReader) parseRockRidge(rec *isoRecord) (*rockRidge, error) {
+	rr := &rockRidge{}
+	if len(rec.system) < ir.suspSkip {
+		return rr, nil
+	}
+	area := rec.system[ir.suspSkip:]
+	// linkCont is set if the last symlink component continues in
+	// the next SL entry.
+	linkCont := false
+	for conts := 0; ; conts++ {
+		var next *isoExtent
+		for len(area) >= 4 {
+			sig := string(area[:2])
+			l := int(area[2])
+			if l < 4 || l > len(area) {
+				break
+			}
+			data := area[4:l]
+			area = area[l:]
+			switch {
+			case sig == "ST":
+				area = nil
+			case sig == "CE" && len(data) >= 24:
+				next = &isoExtent{
+					start: int64(binary.LittleEndian.Uint32(data[0:]))*isoSectorSize + int64(binary.LittleEndian.Uint32(data[8:])),
+					size:  int64(binary.LittleEndian.Uint32(data[16:])),
+				}
+			case sig == "NM" && len(data) >= 1:
+				// Current and parent flags name "." and "..".
+				if data[0]&0x06 == 0 {
+					rr.name = append(rr.name, data[1:]...)
+				}
+			case sig == "PX" && len(data) >= 32:
+				rr.hasMode = true
+				rr.mode = binary.LittleEndian.Uint32(data[0:])
+				rr.nlink = binary.LittleEndian.Uint32(data[8:])
+				rr.uid = binary.LittleEndian.Uint32(data[16:])
+				rr.gid = binary.LittleEndian.Uint32(data[24:])
+			case sig == "PN" && len(data) >= 16:
+				high := binary.LittleEndian.Uint32(data[0:])
+				low := binary.LittleEndian.Uint32(data[8:])
+				rr.rdev = low
+				if high != 0 {
+					rr.rdev = high<<8 | low&0xff
+				}
+			case sig == "SL" && len(data) >= 1:
+				linkCont = parseSymlinkComponents(rr, data[1:], linkCont)
+			case sig == "TF" && len(data) >= 1:
+				parseTimestamps(rr, data)
+			case sig == "RE":
+				rr.relocated = true
+			case sig == "CL" && len(data) >= 8:
+				rr.childLink = binary.LittleEndian.Uint32(data[0:])
+			}
+		}
+		if next == nil || conts >= isoMaxContinuations || next.size > isoSectorSize {
+			break
+		}
+		area = make([]byte, next.size)
+		if _, err := ir.r.ReadAt(area, next.start); err != nil {
+			return nil, err
+		}
+	}
+	return rr, nil
+}
+
+// parseSymlinkComponents appends the components of an SL entry to
+// the target of rr, and returns whether the last one continues.
+func parseSymlinkComponents(rr *rockRidge, data []byte, cont bool) bool {
+	for len(data) >= 2 {
+		flags, l := data[0], int(data[1])
+		if 2+l > len(data) {
+			break
+		}
+		if !cont && len(rr.target) > 0 && rr.target[len(rr.target)-1] != '/' {
+			rr.target = append(rr.target, '/')
+		}
+		switch {
+		case flags&0x02 != 0:
+			rr.target = append(rr.target, '.')
+		case flags&0x04 != 0:
+			rr.target = append(rr.target, ".."...)
+		case flags&0x08 != 0:
+			if len(rr.target) == 0 {
+				rr.target = append(rr.target, '/')
+			}
+		default:
+			rr.target = append(rr.target, data[2:2+l]...)
+		}
+		cont = flags&0x01 != 0
+		data = data[2+l:]
+	}
+	return cont
+}
+
+// parseTimestamps decodes a TF entry.  The flags say which of the
+// creation, modification, access, attribute change, backup,
+// expiration and effective times follow, in that order.
+func parseTimestamps(rr *rockRidge, data []byte) {
+	flags := data[0]
+	data = data[1:]
+	size := 7
+	if flags&0x80 != 0 {
+		size = 17
+	}
+	for bit := uint(0); bit < 7 && len(data) >= size; bit++ {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		var t time.Time
+		if size == 17 {
+			t = isoLongTime(data)
+		} else {
+			t = isoRecordTime(data)
+		}
+		data = data[size:]
+		switch bit {
+		case 1:
+			rr.mtime = &t
+		case 2:
+			rr.atime = &t
+		case 3:
+			rr.ctime = &t
+		}
+	}
+}
+
+// recordName returns the name of rec, without the version suffix.
+func (ir *isoReader) recordName(rec *isoRecord) string {
+	var name string
+	if ir.joliet {
+		u := make([]uint16, len(rec.name)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(rec.name[2*i:])
+		}
+		name = string(utf16.Decode(u))
+	} else {
+		name = strings.ToLower(string(rec.name))
+	}
+	if i := strings.LastIndex(name, ";"); i >= 0 {
+		name = name[:i]
+	}
+	if rec.flags&isoDirFlag == 0 {
+		name = strings.TrimSuffix(name, ".")
+	}
+	return name
+}
+
+func (ir *isoReader) walk(dir *isoRecord, path string, depth int) error {
+	if depth > isoMaxDepth || ir.visited[dir.extent] {
+		return nil
+	}
+	ir.visited[dir.extent] = true
+	_, recs, err := ir.records(dir)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(recs); i++ {
+		rec := recs[i]
+		f := &IsoFile{r: ir.r}
+		f.extents = append(f.extents, isoExtent{int64(rec.extent) * isoSectorSize, int64(rec.size)})
+		// The data of large files is split over records with
+		// the same name.
+		for rec.flags&isoMultiExtentFlag != 0 && i+1 < len(recs) {
+			i++
+			rec = recs[i]
+			f.extents = append(f.extents, isoExtent{int64(rec.extent) * isoSectorSize, int64(rec.size)})
+		}
+		for _, e := range f.extents {
+			f.attr.Size += uint64(e.size)
+		}
+
+		name := ir.recordName(rec)
+		isDir := rec.flags&isoDirFlag != 0
+		f.attr.Mode = syscall.S_IFREG | 0444
+		if isDir {
+			f.attr.Mode = syscall.S_IFDIR | 0555
+		}
+		f.attr.Nlink = 1
+		f.attr.SetTimes(&rec.time, &rec.time, &rec.time)
+
+		if ir.rockRidge {
+			rr, err := ir.parseRockRidge(rec)
+			if err != nil {
+				return err
+			}
+			if rr.relocated {
+				continue
+			}
+			if rr.name != nil {
+				name = string(rr.name)
+			}
+			if rr.childLink != 0 {
+				// A placeholder file for a relocated
+				// directory.
+				isDir = true
+				if rec, err = ir.relocatedDir(rr.childLink); err != nil {
+					return err
+				}
+			}
+			if rr.hasMode {
+				f.attr.Mode = rr.mode
+				f.attr.Nlink = rr.nlink
+				f.attr.Uid = rr.uid
+				f.attr.Gid = rr.gid
+			}
+			f.attr.Rdev = rr.rdev
+			f.attr.SetTimes(rr.atime, rr.mtime, rr.ctime)
+			if rr.target != nil {
+				f.target = rr.target
+				f.attr.Size = uint64(len(f.target))
+				f.extents = nil
+			}
+		}
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			continue
+		}
+
+		p := filepath.Join(path, name)
+		ir.files[p] = f
+		if isDir {
+			f.attr.Size = isoSectorSize
+			if err := ir.walk(rec, p, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// relocatedDir returns the "." record of the directory at extent.
+func (ir *isoReader) relocatedDir(extent uint32) (*isoRecord, error) {
+	data, err := ir.readExtent(extent, isoSectorSize)
+	if err != nil {
+		return nil, err
+	}
+	return parseIsoRecord(data)
+}
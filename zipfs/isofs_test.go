@@ -0,0 +1,248 @@
+package zipfs
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// isoBuilder writes ISO9660 images sector by sector.
+type isoBuilder struct {
+	sectors [][]byte
+}
+
+func (b *isoBuilder) sector(n int) []byte {
+	for len(b.sectors) <= n {
+		b.sectors = append(b.sectors, make([]byte, isoSectorSize))
+	}
+	return b.sectors[n]
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func isoRec(name []byte, extent, size uint32, flags byte, system []byte) []byte {
+	pad := 0
+	if len(name)%2 == 0 {
+		pad = 1
+	}
+	r := make([]byte, 33+len(name)+pad, 33+len(name)+pad+len(system))
+	r[0] = byte(cap(r))
+	bothEndian32(r[2:], extent)
+	bothEndian32(r[10:], size)
+	copy(r[18:], []byte{120, 1, 2, 3, 4, 5, 0})
+	r[25] = flags
+	r[28] = 1
+	r[32] = byte(len(name))
+	copy(r[33:], name)
+	return append(r, system...)
+}
+
+func susp(sig string, data ...byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+func rrName(name string) []byte {
+	return susp("NM", append([]byte{0}, name...)...)
+}
+
+func rrMode(mode uint32) []byte {
+	d := make([]byte, 32)
+	bothEndian32(d, mode)
+	bothEndian32(d[8:], 1)
+	bothEndian32(d[16:], 1000)
+	bothEndian32(d[24:], 100)
+	return susp("PX", d...)
+}
+
+func joliet(name string) []byte {
+	u := utf16.Encode([]rune(name))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.BigEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// writeDir puts the records of a directory at sector n.
+func (b *isoBuilder) writeDir(n int, dot []byte, recs ...[]byte) {
+	s := b.sector(n)
+	off := 0
+	for _, r := range append([][]byte{isoRec([]byte{0}, uint32(n), isoSectorSize, isoDirFlag, dot), isoRec([]byte{1}, uint32(n), isoSectorSize, isoDirFlag, nil)}, recs...) {
+		off += copy(s[off:], r)
+	}
+}
+
+func (b *isoBuilder) descriptor(n int, typ byte, root int, esc string) {
+	d := b.sector(n)
+	d[0] = typ
+	copy(d[1:], "CD001")
+	d[6] = 1
+	copy(d[88:], esc)
+	binary.LittleEndian.PutUint16(d[128:], isoSectorSize)
+	copy(d[156:], isoRec([]byte{0}, uint32(root), isoSectorSize, isoDirFlag, nil))
+}
+
+const (
+	isoReadme = "hello iso"
+	isoInner  = "inner"
+)
+
+var isoBig = strings.Repeat("0123456789abcdef", isoSectorSize/16) + strings.Repeat("z", 100)
+
+// buildIso returns an image with readme.txt, big.bin (in two
+// extents), dir/inner.txt, an empty directory, and with Rock Ridge,
+// a symlink to dir/inner.txt.
+func buildIso(rr, withJoliet bool) []byte {
+	b := &isoBuilder{}
+	b.descriptor(16, 1, 20, "")
+	term := 17
+	if withJoliet {
+		b.descriptor(17, 2, 22, "%/E")
+		term = 18
+	}
+	b.sector(term)[0] = 255
+	copy(b.sector(term)[1:], "CD001")
+
+	copy(b.sector(30), isoReadme)
+	copy(b.sector(31), isoBig[:isoSectorSize])
+	copy(b.sector(32), isoBig[isoSectorSize:])
+	copy(b.sector(33), isoInner)
+
+	sys := func(data ...[]byte) []byte {
+		if !rr {
+			return nil
+		}
+		var out []byte
+		for _, d := range data {
+			out = append(out, d...)
+		}
+		return out
+	}
+	rootDot := sys(susp("SP", 0xBE, 0xEF, 0))
+	link := susp("SL", 0, 0, 3, 'd', 'i', 'r', 0, 9, 'i', 'n', 'n', 'e', 'r', '.', 't', 'x', 't')
+	recs := [][]byte{
+		isoRec([]byte("BIG.BIN;1"), 31, isoSectorSize, isoMultiExtentFlag, sys(rrName("big.bin"))),
+		isoRec([]byte("BIG.BIN;1"), 32, 100, 0, sys(rrName("big.bin"))),
+		isoRec([]byte("DIR"), 21, isoSectorSize, isoDirFlag, sys(rrName("dir"))),
+		isoRec([]byte("EMPTY"), 23, isoSectorSize, isoDirFlag, sys(rrName("empty"))),
+		isoRec([]byte("README.TXT;1"), 30, uint32(len(isoReadme)), 0, sys(rrName("ReadMe.txt"), rrMode(syscall.S_IFREG|0640))),
+	}
+	if rr {
+		recs = append(recs, isoRec([]byte("LINK.;1"), 0, 0, 0, sys(rrName("link"), rrMode(syscall.S_IFLNK|0777), link)))
+	}
+	b.writeDir(20, rootDot, recs...)
+	b.writeDir(21, nil, isoRec([]byte("INNER.TXT;1"), 33, uint32(len(isoInner)), 0, sys(rrName("inner.txt"))))
+	b.writeDir(23, nil)
+
+	if withJoliet {
+		b.writeDir(22, nil,
+			isoRec(joliet("Big.bin;1"), 31, isoSectorSize, isoMultiExtentFlag, nil),
+			isoRec(joliet("Big.bin;1"), 32, 100, 0, nil),
+			isoRec(joliet("Dir"), 24, isoSectorSize, isoDirFlag, nil),
+			isoRec(joliet("ReadMe.txt;1"), 30, uint32(len(isoReadme)), 0, nil))
+		b.writeDir(24, nil, isoRec(joliet("Inner.txt;1"), 33, uint32(len(isoInner)), 0, nil))
+	}
+
+	var out []byte
+	for _, s := range b.sectors {
+		out = append(out, s...)
+	}
+	return out
+}
+
+func TestIsoFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		rr, joliet    bool
+		readme, inner string
+		big, dir      string
+		names         string
+	}{
+		{true, true, "ReadMe.txt", "dir/inner.txt", "big.bin", "dir", "ReadMe.txt big.bin dir empty link"},
+		{false, true, "ReadMe.txt", "Dir/Inner.txt", "Big.bin", "Dir", "Big.bin Dir ReadMe.txt"},
+		{false, false, "readme.txt", "dir/inner.txt", "big.bin", "dir", "big.bin dir empty readme.txt"},
+	} {
+		name := filepath.Join(dir, "t.iso")
+		CheckSuccess(ioutil.WriteFile(name, buildIso(c.rr, c.joliet), 0644))
+		mfs, err := NewArchiveFileSystem(name)
+		if err != nil {
+			t.Fatalf("NewArchiveFileSystem(rr=%v, joliet=%v): %v", c.rr, c.joliet, err)
+		}
+		fuse.NewFileSystemConnector(mfs, nil)
+
+		root := mfs.Root()
+		entries, _ := root.OpenDir(nil)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != c.names {
+			t.Errorf("rr=%v joliet=%v: got names %q, want %q", c.rr, c.joliet, got, c.names)
+		}
+
+		node := func(p string) fuse.FsNode {
+			n := root.Inode()
+			for _, comp := range strings.Split(p, "/") {
+				if n = n.GetChild(comp); n == nil {
+					t.Fatalf("rr=%v joliet=%v: %s not found", c.rr, c.joliet, p)
+				}
+			}
+			return n.FsNode()
+		}
+		read := func(p string) string {
+			f, code := node(p).Open(0, nil)
+			if !code.Ok() {
+				t.Fatalf("Open(%s): %v", p, code)
+			}
+			data, code := f.Read(&fuse.ReadIn{Size: 1 << 16}, fuse.NewGcBufferPool())
+			if !code.Ok() {
+				t.Fatalf("Read(%s): %v", p, code)
+			}
+			return string(data)
+		}
+		if got := read(c.readme); got != isoReadme {
+			t.Errorf("%s: got %q", c.readme, got)
+		}
+		if got := read(c.big); got != isoBig {
+			t.Errorf("%s: got %d bytes, want %d", c.big, len(got), len(isoBig))
+		}
+		if got := read(c.inner); got != isoInner {
+			t.Errorf("%s: got %q", c.inner, got)
+		}
+		var a fuse.Attr
+		node(c.dir).GetAttr(&a, nil, nil)
+		if !a.IsDir() {
+			t.Errorf("%s: got mode %o", c.dir, a.Mode)
+		}
+
+		if c.rr {
+			node(c.readme).GetAttr(&a, nil, nil)
+			if a.Mode != syscall.S_IFREG|0640 || a.Uid != 1000 || a.Gid != 100 {
+				t.Errorf("%s: got attr %v", c.readme, &a)
+			}
+			target, code := node("link").Readlink(nil)
+			if string(target) != "dir/inner.txt" {
+				t.Errorf("Readlink: got %q, %v", target, code)
+			}
+			node("empty").GetAttr(&a, nil, nil)
+			if !a.IsDir() {
+				t.Errorf("empty: got mode %o", a.Mode)
+			}
+		}
+	}
+}
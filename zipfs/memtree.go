@@ -11,6 +11,26 @@ type MemFile interface {
 	Data() []byte
 }
 
+// MemFileOpener is a MemFile that can serve reads without loading
+// all of its data first.
+type MemFileOpener interface {
+	MemFile
+	Open() fuse.File
+}
+
+// MemLink is a MemFile for a symlink.
+type MemLink interface {
+	MemFile
+	Readlink() []byte
+}
+
+// memIsDir returns whether f is a directory, rather than a file.
+func memIsDir(f MemFile) bool {
+	var a fuse.Attr
+	f.Stat(&a)
+	return a.IsDir()
+}
+
 type memNode struct {
 	fuse.DefaultFsNode
 	file MemFile
@@ -69,6 +89,11 @@ func (n *memNode) OpenDir(context *fuse.Context) (stream []fuse.DirEntry, code f
 		if v.IsDir() {
 			mode = fuse.S_IFDIR | 0777
 		}
+		if mn, ok := v.FsNode().(*memNode); ok && mn.file != nil {
+			var a fuse.Attr
+			mn.file.Stat(&a)
+			mode = int(a.Mode)
+		}
 		stream = append(stream, fuse.DirEntry{
 			Name: k,
 			Mode: uint32(mode),
@@ -81,6 +106,9 @@ func (n *memNode) Open(flags uint32, context *fuse.Context) (fuseFile fuse.File,
 	if flags&fuse.O_ANYWRITE != 0 {
 		return nil, fuse.EPERM
 	}
+	if o, ok := n.file.(MemFileOpener); ok {
+		return o.Open(), fuse.OK
+	}
 
 	return fuse.NewDataFile(n.file.Data()), fuse.OK
 }
@@ -89,8 +117,15 @@ func (n *memNode) Deletable() bool {
 	return false
 }
 
+func (n *memNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	if l, ok := n.file.(MemLink); ok {
+		return l.Readlink(), fuse.OK
+	}
+	return nil, fuse.EINVAL
+}
+
 func (n *memNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) (fuse.Status) {
-	if n.Inode().IsDir() {
+	if n.file == nil {
 		out.Mode= fuse.S_IFDIR | 0777
 		return fuse.OK
 	}
@@ -110,8 +145,11 @@ func (n *MemTreeFs) addFile(name string, f MemFile) {
 				fsnode.file = f
 			}
 
-			child = node.New(fsnode.file == nil, fsnode)
+			child = node.New(fsnode.file == nil || memIsDir(f), fsnode)
 			node.AddChild(c, child)
+		} else if mn, ok := child.FsNode().(*memNode); ok && i == len(comps)-1 && mn.file == nil {
+			// A directory that was added for its children.
+			mn.file = f
 		}
 		node = child
 	}
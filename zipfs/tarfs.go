@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"github.com/hanwen/go-fuse/fuse"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 )
@@ -105,3 +107,198 @@ func NewTarCompressedTree(name string, format string) (map[string]MemFile, error
 
 	return NewTarTree(stream), nil
 }
+
+// TarDecompressor returns the uncompressed stream of a compressed
+// tar archive.
+type TarDecompressor func(r io.Reader) (io.Reader, error)
+
+// tarDecompressors holds the compressed tar formats by suffix.  Only
+// gzip and bzip2 are built in; others, such as ".tar.zst" or
+// ".tar.xz", need RegisterTarDecompressor.
+var tarDecompressors = map[string]TarDecompressor{
+	".tar.gz": gunzip,
+	".tgz":    gunzip,
+	".tar.bz2": func(r io.Reader) (io.Reader, error) {
+		return bzip2.NewReader(r), nil
+	},
+}
+
+func gunzip(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// RegisterTarDecompressor makes NewArchiveFileSystem accept tar
+// archives whose name ends in suffix, eg. ".tar.zst", using d to
+// decompress them.  Only gzip (".tar.gz", ".tgz") and bzip2
+// (".tar.bz2") are built in.  The standard library has no zstd, so
+// ".tar.zst" archives are not recognized until a decoder such as
+// github.com/klauspost/compress/zstd is registered.  If suffixes
+// overlap, the longest one that matches wins.  It should be called
+// before any archives are opened.
+func RegisterTarDecompressor(suffix string, d TarDecompressor) {
+	tarDecompressors[suffix] = d
+}
+
+// tarDecompressorFor returns the decompressor for the longest suffix
+// of name that has one.
+func tarDecompressorFor(name string) (suffix string, d TarDecompressor) {
+	for s, sd := range tarDecompressors {
+		if len(s) > len(suffix) && strings.HasSuffix(name, s) {
+			suffix, d = s, sd
+		}
+	}
+	return suffix, d
+}
+
+func isTarArchive(name string) bool {
+	_, d := tarDecompressorFor(name)
+	return d != nil || strings.HasSuffix(name, ".tar")
+}
+
+// NewTarIndexTree indexes the tar archive called name.  Members are
+// read from the archive when they are opened, rather than being kept
+// in memory.  Compressed archives are decompressed once, into an
+// unlinked temporary file, so reading a member does not mean
+// decompressing everything before it.
+func NewTarIndexTree(name string) (map[string]MemFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, d := tarDecompressorFor(name); d != nil {
+		defer f.Close()
+		r, err := d(f)
+		if err != nil {
+			return nil, err
+		}
+		if f, err = spoolTar(r); err != nil {
+			return nil, err
+		}
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	files, err := NewTarIndex(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return files, nil
+}
+
+// spoolTar copies r to a temporary file that is already unlinked, so
+// it disappears once closed.
+func spoolTar(r io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile("", "go-fuse-tarfs")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewTarIndex records where the members of the uncompressed tar
+// archive in r start.  Sparse members are read into memory, as their
+// data is not stored in one piece.
+func NewTarIndex(r io.ReaderAt, size int64) (map[string]MemFile, error) {
+	files := map[string]MemFile{}
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(filepath.Clean(hdr.Name), "/")
+		if name == "." || name == "" {
+			continue
+		}
+		switch {
+		case hdr.Typeflag == tar.TypeLink:
+			target := strings.TrimPrefix(filepath.Clean(hdr.Linkname), "/")
+			if f := files[target]; f != nil {
+				files[name] = f
+			}
+		case isSparse(hdr):
+			buf := bytes.NewBuffer(make([]byte, 0, hdr.Size))
+			if _, err := io.Copy(buf, tr); err != nil {
+				return nil, err
+			}
+			files[name] = &TarFile{Header: *hdr, data: buf.Bytes()}
+		case hdr.Typeflag == tar.TypeReg:
+			// The reader has just consumed the header, so
+			// the data starts here.
+			start, err := sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			files[name] = &TarMember{
+				Header: *hdr,
+				data:   io.NewSectionReader(r, start, hdr.Size),
+			}
+		}
+	}
+	return files, nil
+}
+
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// TarMember is a file in an indexed tar archive.
+type TarMember struct {
+	tar.Header
+	data *io.SectionReader
+}
+
+func (f *TarMember) Stat(out *fuse.Attr) {
+	HeaderToFileInfo(out, &f.Header)
+	out.Mode = out.Mode&07777 | syscall.S_IFREG
+}
+
+func (f *TarMember) Data() []byte {
+	data := make([]byte, f.data.Size())
+	n, _ := f.data.ReadAt(data, 0)
+	return data[:n]
+}
+
+func (f *TarMember) Open() fuse.File {
+	return &tarMemberFile{member: f}
+}
+
+type tarMemberFile struct {
+	fuse.DefaultFile
+	member *TarMember
+}
+
+func (f *tarMemberFile) String() string {
+	return fmt.Sprintf("tarMemberFile(%s)", f.member.Name)
+}
+
+func (f *tarMemberFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	slice := bp.AllocBuffer(input.Size)
+	n, err := f.member.data.ReadAt(slice, int64(input.Offset))
+	if err == io.EOF {
+		err = nil
+	}
+	return slice[:n], fuse.ToStatus(err)
+}
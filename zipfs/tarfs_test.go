@@ -0,0 +1,105 @@
+package zipfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func writeTestTar(w io.Writer) {
+	tw := tar.NewWriter(w)
+	for _, e := range []struct {
+		name, link, data string
+	}{
+		{"dir/", "", ""},
+		{"dir/a", "", "hello"},
+		{"/b", "", "world, this is b"},
+		{"dir/c", "dir/a", ""},
+	} {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}
+		switch {
+		case e.link != "":
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = e.link
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+		default:
+			hdr.Typeflag = tar.TypeReg
+		}
+		CheckSuccess(tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.data))
+		CheckSuccess(err)
+	}
+	CheckSuccess(tw.Close())
+}
+
+func TestTarIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	writeTestTar(&buf)
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "t.tar"), buf.Bytes(), 0644))
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(buf.Bytes())
+	zw.Close()
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "t.tar.gz"), gz.Bytes(), 0644))
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "t.tar.test"), gz.Bytes(), 0644))
+	RegisterTarDecompressor(".tar.test", gunzip)
+	defer delete(tarDecompressors, ".tar.test")
+
+	// There is no built-in zstd decoder.
+	if IsArchive("t.tar.zst") {
+		t.Errorf("t.tar.zst is an archive without a registered decoder")
+	}
+
+	// The longest matching suffix wins: .test alone would not
+	// decompress.
+	CheckSuccess(ioutil.WriteFile(filepath.Join(dir, "u.tar.gz.test"), gz.Bytes(), 0644))
+	RegisterTarDecompressor(".test", func(r io.Reader) (io.Reader, error) {
+		return r, nil
+	})
+	defer delete(tarDecompressors, ".test")
+	RegisterTarDecompressor(".gz.test", gunzip)
+	defer delete(tarDecompressors, ".gz.test")
+	for i := 0; i < 10; i++ {
+		if s, _ := tarDecompressorFor("u.tar.gz.test"); s != ".gz.test" {
+			t.Fatalf("got suffix %q, want .gz.test", s)
+		}
+	}
+
+	for _, n := range []string{"t.tar", "t.tar.gz", "t.tar.test", "u.tar.gz.test"} {
+		mfs, err := NewArchiveFileSystem(filepath.Join(dir, n))
+		if err != nil {
+			t.Fatalf("NewArchiveFileSystem(%s): %v", n, err)
+		}
+		if len(mfs.files) != 3 {
+			t.Errorf("%s: got files %v", n, mfs.files)
+		}
+		for name, want := range map[string]string{"dir/a": "hello", "b": "world, this is b", "dir/c": "hello"} {
+			m, ok := mfs.files[name].(MemFileOpener)
+			if !ok {
+				t.Errorf("%s: %s is %T", n, name, mfs.files[name])
+				continue
+			}
+			var a fuse.Attr
+			m.Stat(&a)
+			if a.Size != uint64(len(want)) || !a.IsRegular() {
+				t.Errorf("%s: %s has attr %v", n, name, &a)
+			}
+			data, code := m.Open().Read(&fuse.ReadIn{Offset: 1, Size: 100}, fuse.NewGcBufferPool())
+			if !code.Ok() || string(data) != want[1:] {
+				t.Errorf("%s: Read(%s): got %q, %v, want %q", n, name, data, code, want[1:])
+			}
+		}
+	}
+}
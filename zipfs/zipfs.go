@@ -3,6 +3,7 @@ package zipfs
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/hanwen/go-fuse/fuse"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var _ = log.Printf
@@ -23,6 +25,58 @@ func (f *ZipFile) Stat(out *fuse.Attr) {
 	// TODO - do something intelligent with timestamps.
 	out.Mode = fuse.S_IFREG | 0444
 	out.Size = uint64(f.File.UncompressedSize)
+	if btime, ok := ntfsCreationTime(f.File.Extra); ok {
+		out.SetBirthTime(btime)
+	}
+}
+
+const (
+	ntfsExtraID   = 0x000a
+	ntfsTimesTag  = 0x0001
+	ntfsTimesSize = 24
+
+	// Seconds between the Windows epoch (1601) and the Unix epoch.
+	windowsEpochDelta = 11644473600
+)
+
+// ntfsCreationTime extracts the creation time from the NTFS extra
+// field that Windows archivers write.
+func ntfsCreationTime(extra []byte) (time.Time, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		field := extra[:size]
+		extra = extra[size:]
+		if id != ntfsExtraID || len(field) < 4 {
+			continue
+		}
+
+		// Skip the reserved field.
+		for attrs := field[4:]; len(attrs) >= 4; {
+			tag := binary.LittleEndian.Uint16(attrs)
+			tagSize := int(binary.LittleEndian.Uint16(attrs[2:]))
+			attrs = attrs[4:]
+			if tagSize > len(attrs) {
+				break
+			}
+			if tag == ntfsTimesTag && tagSize >= ntfsTimesSize {
+				// Modification, access, and then creation time,
+				// in 100ns units since 1601.
+				ft := binary.LittleEndian.Uint64(attrs[16:])
+				if ft == 0 {
+					return time.Time{}, false
+				}
+				secs := int64(ft/1e7) - windowsEpochDelta
+				return time.Unix(secs, int64(ft%1e7)*100), true
+			}
+			attrs = attrs[tagSize:]
+		}
+	}
+	return time.Time{}, false
 }
 
 func (f *ZipFile) Data() []byte {
@@ -62,29 +116,42 @@ func NewZipTree(name string) (map[string]MemFile, error) {
 
 func NewArchiveFileSystem(name string) (mfs *MemTreeFs, err error) {
 	mfs = &MemTreeFs{}
-	if strings.HasSuffix(name, ".zip") {
-		mfs.files, err = NewZipTree(name)
-	}
-	if strings.HasSuffix(name, ".tar.gz") {
-		mfs.files, err = NewTarCompressedTree(name, "gz")
+	if mfs.files, err = NewArchiveTree(name); err != nil {
+		return nil, err
 	}
-	if strings.HasSuffix(name, ".tar.bz2") {
-		mfs.files, err = NewTarCompressedTree(name, "bz2")
+	return mfs, nil
+}
+
+// IsArchive returns whether name has the suffix of an archive type
+// that NewArchiveTree reads.
+func IsArchive(name string) bool {
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".jar") ||
+		strings.HasSuffix(name, ".iso") || isTarArchive(name)
+}
+
+// NewArchiveTree reads the archive called name, choosing the type by
+// its suffix.  Compressed tar archives other than gzip and bzip2 need
+// RegisterTarDecompressor.
+func NewArchiveTree(name string) (files map[string]MemFile, err error) {
+	if strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".jar") {
+		files, err = NewZipTree(name)
 	}
-	if strings.HasSuffix(name, ".tar") {
-		f, err := os.Open(name)
-		if err != nil {
-			return nil, err
+	if strings.HasSuffix(name, ".iso") {
+		var f *os.File
+		if f, err = os.Open(name); err == nil {
+			files, err = NewIsoTree(f)
 		}
-		mfs.files = NewTarTree(f)
+	}
+	if isTarArchive(name) {
+		files, err = NewTarIndexTree(name)
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	if mfs.files == nil {
+	if files == nil {
 		return nil, errors.New(fmt.Sprintf("Unknown type for %v", name))
 	}
 
-	return mfs, nil
+	return files, nil
 }
@@ -1,12 +1,14 @@
 package zipfs
 
 import (
+	"encoding/binary"
 	"github.com/hanwen/go-fuse/fuse"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 )
 
 func testZipFile() string {
@@ -79,3 +81,25 @@ func TestLinkCount(t *testing.T) {
 		t.Fatal("wrong link count", fuse.ToStatT(fi).Nlink)
 	}
 }
+
+func TestNtfsCreationTime(t *testing.T) {
+	want := time.Date(2012, 5, 1, 12, 0, 0, 500, time.UTC)
+	ft := uint64(want.Unix()+windowsEpochDelta)*1e7 + uint64(want.Nanosecond()/100)
+
+	field := make([]byte, 4+4+ntfsTimesSize)
+	binary.LittleEndian.PutUint16(field[4:], ntfsTimesTag)
+	binary.LittleEndian.PutUint16(field[6:], ntfsTimesSize)
+	binary.LittleEndian.PutUint64(field[8+16:], ft)
+
+	extra := []byte{0x55, 0x54, 1, 0, 0}
+	extra = append(extra, byte(ntfsExtraID), 0, byte(len(field)), 0)
+	extra = append(extra, field...)
+
+	got, ok := ntfsCreationTime(extra)
+	if !ok || !got.Equal(want.Truncate(100)) {
+		t.Errorf("got %v %v, want %v", got, ok, want)
+	}
+	if _, ok := ntfsCreationTime(extra[:5]); ok {
+		t.Errorf("found creation time without NTFS field")
+	}
+}
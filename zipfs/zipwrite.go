@@ -0,0 +1,609 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var _ = (fuse.FileSystem)((*WritableZipFs)(nil))
+
+// zipEntry is a file in a WritableZipFs.  Its data is in the
+// archive, or staged in memory once it is changed.
+type zipEntry struct {
+	orig  *zip.File
+	data  []byte
+	mode  uint32
+	mtime time.Time
+}
+
+func (e *zipEntry) size() uint64 {
+	if e.data == nil && e.orig != nil {
+		return e.orig.UncompressedSize64
+	}
+	return uint64(len(e.data))
+}
+
+// content returns the data of the file, without staging it.
+func (e *zipEntry) content() ([]byte, error) {
+	if e.data != nil || e.orig == nil {
+		return e.data, nil
+	}
+	rc, err := e.orig.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data := make([]byte, e.orig.UncompressedSize64)
+	_, err = io.ReadFull(rc, data)
+	return data, err
+}
+
+// stage loads the data into memory, so it can be changed.
+func (e *zipEntry) stage() fuse.Status {
+	if e.data != nil {
+		return fuse.OK
+	}
+	data, err := e.content()
+	if err != nil {
+		return fuse.EIO
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	e.data = data
+	return fuse.OK
+}
+
+// WritableZipFs is a path filesystem for a zip archive that can be
+// changed.  Changes are staged in memory, and the archive is
+// rewritten by Sync, which is called on fsync, and when the file
+// system is unmounted.
+type WritableZipFs struct {
+	fuse.DefaultFileSystem
+
+	name string
+
+	lock    sync.Mutex
+	reader  *zip.ReadCloser
+	files   map[string]*zipEntry
+	dirs    map[string]bool
+	changed bool
+}
+
+// NewWritableZipFs opens the zip archive called name.  If it does
+// not exist, it is created on the first Sync.
+func NewWritableZipFs(name string) (*WritableZipFs, error) {
+	fs := &WritableZipFs{
+		name:  name,
+		files: map[string]*zipEntry{},
+		dirs:  map[string]bool{"": true},
+	}
+	r, err := zip.OpenReader(name)
+	if os.IsNotExist(err) {
+		fs.changed = true
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs.reader = r
+	for _, f := range r.File {
+		n := filepath.Clean(f.Name)
+		if strings.HasSuffix(f.Name, "/") {
+			fs.addDir(n)
+			continue
+		}
+		mode := uint32(f.Mode().Perm())
+		if mode == 0 {
+			mode = 0644
+		}
+		fs.files[n] = &zipEntry{orig: f, mode: mode, mtime: f.Modified}
+		fs.addDir(filepath.Dir(n))
+	}
+	return fs, nil
+}
+
+func (fs *WritableZipFs) String() string {
+	return fmt.Sprintf("WritableZipFs(%s)", fs.name)
+}
+
+// addDir adds name and its parents.
+func (fs *WritableZipFs) addDir(name string) {
+	for name != "." && name != "" && !fs.dirs[name] {
+		fs.dirs[name] = true
+		name = filepath.Dir(name)
+	}
+}
+
+// isEmpty returns whether directory name has no entries.
+func (fs *WritableZipFs) isEmpty(name string) bool {
+	for n := range fs.files {
+		if filepath.Dir(n) == name {
+			return false
+		}
+	}
+	for n := range fs.dirs {
+		if n != "" && filepath.Dir(n) == name {
+			return false
+		}
+	}
+	return true
+}
+
+// hasParent returns whether the directory that holds name exists.
+func (fs *WritableZipFs) hasParent(name string) bool {
+	dir := filepath.Dir(name)
+	return dir == "." || fs.dirs[dir]
+}
+
+func (fs *WritableZipFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.dirs[name] {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0755}, fuse.OK
+	}
+	e := fs.files[name]
+	if e == nil {
+		return nil, fuse.ENOENT
+	}
+	a := &fuse.Attr{
+		Mode: fuse.S_IFREG | e.mode,
+		Size: e.size(),
+	}
+	a.SetTimes(nil, &e.mtime, &e.mtime)
+	return a, fuse.OK
+}
+
+func (fs *WritableZipFs) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.dirs[name] {
+		return nil, fuse.ENOENT
+	}
+	if name == "" {
+		name = "."
+	}
+	for n, e := range fs.files {
+		if filepath.Dir(n) == name {
+			stream = append(stream, fuse.DirEntry{Name: filepath.Base(n), Mode: fuse.S_IFREG | e.mode})
+		}
+	}
+	for n := range fs.dirs {
+		if n != "" && filepath.Dir(n) == name {
+			stream = append(stream, fuse.DirEntry{Name: filepath.Base(n), Mode: fuse.S_IFDIR | 0755})
+		}
+	}
+	return stream, fuse.OK
+}
+
+func (fs *WritableZipFs) Open(name string, flags uint32, context *fuse.Context) (file fuse.File, code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	e := fs.files[name]
+	if e == nil {
+		if fs.dirs[name] {
+			return nil, fuse.Status(syscall.EISDIR)
+		}
+		return nil, fuse.ENOENT
+	}
+	if flags&fuse.O_ANYWRITE == 0 {
+		data, err := e.content()
+		if err != nil {
+			return nil, fuse.EIO
+		}
+		return fuse.NewDataFile(data), fuse.OK
+	}
+	if code := e.stage(); !code.Ok() {
+		return nil, code
+	}
+	if flags&uint32(os.O_TRUNC) != 0 {
+		e.data = e.data[:0]
+		fs.touch(e)
+	}
+	return &zipWriteFile{fs: fs, entry: e}, fuse.OK
+}
+
+func (fs *WritableZipFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file fuse.File, code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.dirs[name] {
+		return nil, fuse.Status(syscall.EISDIR)
+	}
+	if !fs.hasParent(name) {
+		return nil, fuse.ENOENT
+	}
+	e := fs.files[name]
+	if e == nil || flags&uint32(os.O_TRUNC) != 0 {
+		e = &zipEntry{data: []byte{}, mode: mode & 07777}
+		fs.files[name] = e
+		fs.touch(e)
+	} else if code := e.stage(); !code.Ok() {
+		return nil, code
+	}
+	return &zipWriteFile{fs: fs, entry: e}, fuse.OK
+}
+
+// touch marks e, and the archive, as changed.
+func (fs *WritableZipFs) touch(e *zipEntry) {
+	e.mtime = time.Now()
+	fs.changed = true
+}
+
+func (fs *WritableZipFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.dirs[name] || fs.files[name] != nil {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if !fs.hasParent(name) {
+		return fuse.ENOENT
+	}
+	fs.dirs[name] = true
+	fs.changed = true
+	return fuse.OK
+}
+
+func (fs *WritableZipFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.files[name] == nil {
+		return fuse.ENOENT
+	}
+	delete(fs.files, name)
+	fs.changed = true
+	return fuse.OK
+}
+
+func (fs *WritableZipFs) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.dirs[name] || name == "" {
+		return fuse.ENOENT
+	}
+	if !fs.isEmpty(name) {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	delete(fs.dirs, name)
+	fs.changed = true
+	return fuse.OK
+}
+
+func (fs *WritableZipFs) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.hasParent(newName) {
+		return fuse.ENOENT
+	}
+	if e := fs.files[oldName]; e != nil {
+		if fs.dirs[newName] {
+			return fuse.Status(syscall.EISDIR)
+		}
+		delete(fs.files, oldName)
+		fs.files[newName] = e
+		fs.changed = true
+		return fuse.OK
+	}
+	if !fs.dirs[oldName] || oldName == "" {
+		return fuse.ENOENT
+	}
+	if fs.files[newName] != nil {
+		return fuse.Status(syscall.ENOTDIR)
+	}
+	if fs.dirs[newName] && !fs.isEmpty(newName) {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	if strings.HasPrefix(newName, oldName+"/") {
+		return fuse.EINVAL
+	}
+
+	prefix := oldName + "/"
+	for n, e := range fs.files {
+		if strings.HasPrefix(n, prefix) {
+			delete(fs.files, n)
+			fs.files[newName+"/"+n[len(prefix):]] = e
+		}
+	}
+	delete(fs.dirs, oldName)
+	fs.dirs[newName] = true
+	for n := range fs.dirs {
+		if strings.HasPrefix(n, prefix) {
+			delete(fs.dirs, n)
+			fs.dirs[newName+"/"+n[len(prefix):]] = true
+		}
+	}
+	fs.changed = true
+	return fuse.OK
+}
+
+func (fs *WritableZipFs) Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	e := fs.files[name]
+	if e == nil {
+		return fuse.ENOENT
+	}
+	return fs.truncate(e, size)
+}
+
+func (fs *WritableZipFs) truncate(e *zipEntry, size uint64) fuse.Status {
+	if code := e.stage(); !code.Ok() {
+		return code
+	}
+	if size <= uint64(len(e.data)) {
+		e.data = e.data[:size]
+	} else {
+		e.data = append(e.data, make([]byte, size-uint64(len(e.data)))...)
+	}
+	fs.touch(e)
+	return fuse.OK
+}
+
+func (fs *WritableZipFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	e := fs.files[name]
+	if e == nil {
+		return fuse.ENOENT
+	}
+	e.mode = mode & 07777
+	fs.changed = true
+	return fuse.OK
+}
+
+func (fs *WritableZipFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	e := fs.files[name]
+	if e == nil {
+		return fuse.ENOENT
+	}
+	if Mtime != nil {
+		e.mtime = *fuse.ResolveUtime(Mtime)
+		fs.changed = true
+	}
+	return fuse.OK
+}
+
+func (fs *WritableZipFs) SyncFs(context *fuse.Context) (code fuse.Status) {
+	return fuse.ToStatus(fs.Sync())
+}
+
+func (fs *WritableZipFs) OnUnmount(reason fuse.UnmountReason) {
+	if err := fs.Sync(); err != nil {
+		log.Printf("WritableZipFs: writing %s: %v", fs.name, err)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.reader != nil {
+		fs.reader.Close()
+		fs.reader = nil
+	}
+}
+
+// Sync rewrites the archive, if anything changed.  Files that were
+// not changed are copied without recompressing them.
+func (fs *WritableZipFs) Sync() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.changed {
+		return nil
+	}
+
+	dir, base := filepath.Split(fs.name)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if fi, err := os.Stat(fs.name); err == nil {
+		tmp.Chmod(fi.Mode())
+	}
+	if err := fs.writeArchive(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fs.name); err != nil {
+		return err
+	}
+
+	// Point the unchanged files at the new archive, and drop the
+	// staged data, which is now in it too.
+	r, err := zip.OpenReader(fs.name)
+	if err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		if e := fs.files[filepath.Clean(f.Name)]; e != nil && !strings.HasSuffix(f.Name, "/") {
+			e.orig = f
+			e.data = nil
+		}
+	}
+	if fs.reader != nil {
+		fs.reader.Close()
+	}
+	fs.reader = r
+	fs.changed = false
+	return nil
+}
+
+func (fs *WritableZipFs) writeArchive(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	var dirs []string
+	for n := range fs.dirs {
+		if n != "" {
+			dirs = append(dirs, n)
+		}
+	}
+	sort.Strings(dirs)
+	for _, n := range dirs {
+		h := &zip.FileHeader{Name: n + "/", Method: zip.Store}
+		h.SetMode(os.ModeDir | 0755)
+		if _, err := zw.CreateHeader(h); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for n := range fs.files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		e := fs.files[n]
+		if e.data == nil && e.orig != nil {
+			if err := copyRaw(zw, n, e); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := e.content()
+		if err != nil {
+			return err
+		}
+		h := &zip.FileHeader{Name: n, Method: zip.Deflate, Modified: e.mtime}
+		h.SetMode(os.FileMode(e.mode))
+		fw, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// copyRaw copies the data of e to zw, compressed as it is, with the
+// new name and attributes.
+func copyRaw(zw *zip.Writer, name string, e *zipEntry) error {
+	r, err := e.orig.OpenRaw()
+	if err != nil {
+		return err
+	}
+	h := e.orig.FileHeader
+	h.Name = name
+	h.Modified = e.mtime
+	h.Extra = stripExtraField(h.Extra, extTimeExtraID)
+	h.SetMode(os.FileMode(e.mode))
+	w, err := zw.CreateRaw(&h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// extTimeExtraID is the extended timestamp field, which zip.Writer
+// adds from FileHeader.Modified.
+const extTimeExtraID = 0x5455
+
+// stripExtraField removes the fields with the given ID from the extra
+// data of a zip header.
+func stripExtraField(extra []byte, id uint16) []byte {
+	var out []byte
+	for len(extra) >= 4 {
+		size := 4 + int(binary.LittleEndian.Uint16(extra[2:]))
+		if size > len(extra) {
+			break
+		}
+		if binary.LittleEndian.Uint16(extra) != id {
+			out = append(out, extra[:size]...)
+		}
+		extra = extra[size:]
+	}
+	return out
+}
+
+// zipWriteFile is a file of a WritableZipFs that is open for writing.
+type zipWriteFile struct {
+	fuse.DefaultFile
+	fs    *WritableZipFs
+	entry *zipEntry
+}
+
+func (f *zipWriteFile) String() string {
+	return fmt.Sprintf("zipWriteFile(%d bytes)", f.entry.size())
+}
+
+func (f *zipWriteFile) Read(input *fuse.ReadIn, bp fuse.BufferPool) ([]byte, fuse.Status) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if code := f.entry.stage(); !code.Ok() {
+		return nil, code
+	}
+	data := f.entry.data
+	if input.Offset >= uint64(len(data)) {
+		return nil, fuse.OK
+	}
+	end := input.Offset + uint64(input.Size)
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+	// Copy, since writes may change the data before it is sent.
+	slice := bp.AllocBuffer(input.Size)
+	n := copy(slice, data[input.Offset:end])
+	return slice[:n], fuse.OK
+}
+
+func (f *zipWriteFile) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	e := f.entry
+	if code := e.stage(); !code.Ok() {
+		return 0, code
+	}
+	end := input.Offset + uint64(len(data))
+	if end > uint64(len(e.data)) {
+		e.data = append(e.data, make([]byte, end-uint64(len(e.data)))...)
+	}
+	copy(e.data[input.Offset:], data)
+	f.fs.touch(e)
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *zipWriteFile) Truncate(size uint64, context *fuse.Context) fuse.Status {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	return f.fs.truncate(f.entry, size)
+}
+
+func (f *zipWriteFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	out.Mode = fuse.S_IFREG | f.entry.mode
+	out.Size = f.entry.size()
+	out.SetTimes(nil, &f.entry.mtime, &f.entry.mtime)
+	return fuse.OK
+}
+
+func (f *zipWriteFile) Flush(input *fuse.FlushIn) fuse.Status {
+	return fuse.OK
+}
+
+func (f *zipWriteFile) Fsync(flags int) (code fuse.Status) {
+	return fuse.ToStatus(f.fs.Sync())
+}
@@ -0,0 +1,102 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func readZip(t *testing.T, name string) map[string]string {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		t.Fatalf("OpenReader: %v", err)
+	}
+	defer r.Close()
+	out := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		CheckSuccess(err)
+		data, err := ioutil.ReadAll(rc)
+		CheckSuccess(err)
+		rc.Close()
+		out[f.Name] = string(data)
+	}
+	return out
+}
+
+func TestWritableZipFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse")
+	CheckSuccess(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "t.zip")
+	data, err := ioutil.ReadFile(testZipFile())
+	CheckSuccess(err)
+	CheckSuccess(ioutil.WriteFile(name, data, 0644))
+	before := readZip(t, name)
+
+	fs, err := NewWritableZipFs(name)
+	CheckSuccess(err)
+	if code := fs.Mkdir("new", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	f, code := fs.Create("new/file", 0, 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Write(&fuse.WriteIn{Offset: 0}, []byte("hello"))
+	f.Write(&fuse.WriteIn{Offset: 5}, []byte(" world"))
+	if code := f.Fsync(0); !code.Ok() {
+		t.Fatalf("Fsync: %v", code)
+	}
+	f.Release(&fuse.ReleaseIn{})
+
+	after := readZip(t, name)
+	if after["new/file"] != "hello world" {
+		t.Errorf("after Fsync: got %q", after["new/file"])
+	}
+	for n, d := range before {
+		if after[n] != d {
+			t.Errorf("%s changed: %q, want %q", n, after[n], d)
+		}
+	}
+
+	var old string
+	for n := range before {
+		if !strings.HasSuffix(n, "/") {
+			old = n
+			break
+		}
+	}
+	if code := fs.Rename("new/file", "renamed", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if code := fs.Unlink(old, nil); !code.Ok() {
+		t.Fatalf("Unlink(%s): %v", old, code)
+	}
+	if code := fs.Truncate("renamed", 5, nil); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	fs.OnUnmount(0)
+
+	after = readZip(t, name)
+	if _, ok := after[old]; ok {
+		t.Errorf("%s still in archive", old)
+	}
+	if after["renamed"] != "hello" {
+		t.Errorf("renamed: got %q", after["renamed"])
+	}
+	var names []string
+	for n := range after {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if _, ok := after["new/"]; !ok {
+		t.Errorf("empty directory missing: %v", names)
+	}
+}